@@ -8,6 +8,9 @@ type Resources struct {
 	DiskMB   int
 	IOPS     int
 	Networks []*NetworkResource
+
+	MemoryMaxMB int
+	OOMScoreAdj int
 }
 
 // NetworkResource is used to describe required network
@@ -18,4 +21,6 @@ type NetworkResource struct {
 	ReservedPorts []int
 	DynamicPorts  []string
 	MBits         int
+
+	Mode string
 }
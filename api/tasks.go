@@ -1,5 +1,9 @@
 package api
 
+import (
+	"time"
+)
+
 // TaskGroup is the unit of scheduling.
 type TaskGroup struct {
 	Name        string
@@ -40,12 +44,123 @@ func (g *TaskGroup) AddTask(t *Task) *TaskGroup {
 
 // Task is a single process in a task group.
 type Task struct {
-	Name        string
-	Driver      string
-	Config      map[string]string
-	Constraints []*Constraint
-	Resources   *Resources
-	Meta        map[string]string
+	Name          string
+	Driver        string
+	Config        map[string]string
+	Constraints   []*Constraint
+	Resources     *Resources
+	Meta          map[string]string
+	Env           map[string]string
+	RestartPolicy *RestartPolicy
+	LogConfig     *LogConfig
+	Templates     []*Template
+	Artifacts     []*TaskArtifact
+	Checks        []*TaskCheck
+	Services      []*Service
+	DependsOn     []string
+	Lifecycle     string
+	Leader        bool
+	ShutdownDelay time.Duration
+	KillSignal    string
+	Volumes       []*TaskVolume
+	Secrets       map[string]string
+	EnvFiles      []string
+	User          string
+	Group         string
+
+	ProviderSecrets []*ProviderSecret
+
+	MaxRuntime        time.Duration
+	MaxRuntimeFailure bool
+}
+
+// TaskVolume is a host path mounted into the task.
+type TaskVolume struct {
+	Source      string
+	Destination string
+	ReadOnly    bool
+}
+
+// TaskArtifact is a file downloaded into the task directory.
+type TaskArtifact struct {
+	Source      string
+	Checksum    string
+	Destination string
+}
+
+// TaskCheck is a health check run by the client against the running task.
+type TaskCheck struct {
+	Name             string
+	Type             string
+	Address          string
+	URL              string
+	ExpectedStatus   int
+	Command          string
+	Args             string
+	Pattern          string
+	Log              string
+	Interval         time.Duration
+	Timeout          time.Duration
+	GracePeriod      time.Duration
+	SuccessThreshold int
+	FailureThreshold int
+}
+
+// Service is a service of the task registered with the local Consul agent.
+type Service struct {
+	Name      string
+	PortLabel string
+	Tags      []string
+	Checks    []*ServiceCheck
+}
+
+// ServiceCheck is a check run by the Consul agent against the service.
+type ServiceCheck struct {
+	Name     string
+	Type     string
+	Path     string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Template is used to render a file into the task directory.
+type Template struct {
+	EmbeddedTmpl string
+	DestPath     string
+	ChangeMode   string
+	ChangeSignal string
+}
+
+// ProviderSecret is a secret read from the secret provider of the client.
+type ProviderSecret struct {
+	Path         string
+	ChangeMode   string
+	ChangeSignal string
+}
+
+// RestartPolicy controls how a failed task is restarted by the client.
+type RestartPolicy struct {
+	Attempts       int
+	Interval       time.Duration
+	Delay          time.Duration
+	Mode           string
+	Jitter         float64
+	MinHealthyTime time.Duration
+}
+
+// LogConfig controls the rotation of a task's log files.
+type LogConfig struct {
+	MaxFiles      int
+	MaxFileSizeMB int
+	Syslog        *SyslogLogConfig
+}
+
+// SyslogLogConfig forwards the output of a task to syslog.
+type SyslogLogConfig struct {
+	Address      string
+	Facility     string
+	Tag          string
+	DisableFiles bool
 }
 
 // NewTask creates and initializes a new Task.
@@ -86,3 +201,61 @@ func (t *Task) Constrain(c *Constraint) *Task {
 	t.Constraints = append(t.Constraints, c)
 	return t
 }
+
+// SetEnv is used to add an environment variable to the task.
+func (t *Task) SetEnv(key, val string) *Task {
+	if t.Env == nil {
+		t.Env = make(map[string]string)
+	}
+	t.Env[key] = val
+	return t
+}
+
+// SetRestartPolicy is used to set the restart policy of the task.
+func (t *Task) SetRestartPolicy(p *RestartPolicy) *Task {
+	t.RestartPolicy = p
+	return t
+}
+
+// AddArtifact is used to add an artifact to the task.
+func (t *Task) AddArtifact(a *TaskArtifact) *Task {
+	t.Artifacts = append(t.Artifacts, a)
+	return t
+}
+
+// AddTemplate is used to add a template to the task.
+func (t *Task) AddTemplate(tmpl *Template) *Task {
+	t.Templates = append(t.Templates, tmpl)
+	return t
+}
+
+// AddProviderSecret is used to add a secret read from the secret provider of
+// the client to the task.
+func (t *Task) AddProviderSecret(s *ProviderSecret) *Task {
+	t.ProviderSecrets = append(t.ProviderSecrets, s)
+	return t
+}
+
+// AddCheck is used to add a health check to the task.
+func (t *Task) AddCheck(c *TaskCheck) *Task {
+	t.Checks = append(t.Checks, c)
+	return t
+}
+
+// AddService is used to register a service of the task with Consul.
+func (t *Task) AddService(s *Service) *Task {
+	t.Services = append(t.Services, s)
+	return t
+}
+
+// AddVolume is used to mount a host path into the task.
+func (t *Task) AddVolume(v *TaskVolume) *Task {
+	t.Volumes = append(t.Volumes, v)
+	return t
+}
+
+// SetLogConfig is used to set the log rotation of the task.
+func (t *Task) SetLogConfig(l *LogConfig) *Task {
+	t.LogConfig = l
+	return t
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
@@ -26,6 +27,9 @@ const (
 type taskStatus struct {
 	Status      string
 	Description string
+
+	// Exit is how the task exited, once its status is terminal
+	Exit *structs.TaskExit `json:",omitempty"`
 }
 
 // AllocStateUpdater is used to update the status of an allocation
@@ -50,16 +54,50 @@ type AllocRunner struct {
 
 	updateCh chan *structs.Allocation
 
-	destroy     bool
-	destroyCh   chan struct{}
-	destroyLock sync.Mutex
+	// destroyReason is why the tasks are killed once destroyCh is closed
+	destroy       bool
+	destroyReason KillReason
+	destroyCh     chan struct{}
+	destroyLock   sync.Mutex
+
+	// waitCh is closed once Run returns
+	waitCh chan struct{}
+}
+
+// AllocResourceUsage is the resource usage of the running tasks of an
+// allocation.
+type AllocResourceUsage struct {
+	// CPUPercent and MemoryRSS are summed over the tasks in Tasks.
+	CPUPercent float64
+	MemoryRSS  uint64
+
+	// Tasks maps the names of the running tasks to their latest usage.
+	Tasks map[string]*driver.TaskResourceUsage
+
+	// Unsupported are the names of the running tasks whose drivers can not
+	// report usage. They are not part of the totals.
+	Unsupported []string
+
+	// Timestamp is when the usage was aggregated.
+	Timestamp time.Time
 }
 
 // allocRunnerState is used to snapshot the state of the alloc runner
 type allocRunnerState struct {
 	Alloc      *structs.Allocation
 	TaskStatus map[string]taskStatus
-	Context    *driver.ExecContext
+
+	// Context is only set in the state of older clients, which did not
+	// save the alloc context on its own
+	Context *driver.ExecContext
+}
+
+// allocContextState is the snapshot of the tasks the alloc runner owns and
+// the context they share, from which the task runners are rebuilt
+type allocContextState struct {
+	Tasks     []string
+	AllocDir  *allocdir.AllocDir
+	TaskPorts map[string]map[string]int
 }
 
 // NewAllocRunner is used to create a new allocation context
@@ -74,6 +112,7 @@ func NewAllocRunner(logger *log.Logger, config *config.Config, updater AllocStat
 		taskStatus: make(map[string]taskStatus),
 		updateCh:   make(chan *structs.Allocation, 8),
 		destroyCh:  make(chan struct{}),
+		waitCh:     make(chan struct{}),
 	}
 	return ar
 }
@@ -83,44 +122,104 @@ func (r *AllocRunner) stateFilePath() string {
 	return filepath.Join(r.config.StateDir, "alloc", r.alloc.ID, "state.json")
 }
 
+// contextFilePath returns the path to the state file of the alloc context
+func (r *AllocRunner) contextFilePath() string {
+	return filepath.Join(r.config.StateDir, "alloc", r.alloc.ID, "alloc.json")
+}
+
+// taskStateDirs returns the names of the state directories owned by the
+// tasks of the alloc, including legacy ones that have not been migrated yet
+func (r *AllocRunner) taskStateDirs() map[string]struct{} {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	dirs := make(map[string]struct{}, 2*len(r.tasks))
+	for name := range r.tasks {
+		dirs[taskStateDir(name)] = struct{}{}
+		dirs[legacyTaskStateDir(name)] = struct{}{}
+	}
+	return dirs
+}
+
 // RestoreState is used to restore the state of the alloc runner
 func (r *AllocRunner) RestoreState() error {
-	// Load the snapshot
+	// Load the snapshots
 	var snap allocRunnerState
 	if err := restoreState(r.stateFilePath(), &snap); err != nil {
 		return err
 	}
+	var ctxSnap allocContextState
+	if err := restoreState(r.contextFilePath(), &ctxSnap); err != nil {
+		return err
+	}
 
 	// Restore fields
 	r.alloc = snap.Alloc
 	r.taskStatus = snap.TaskStatus
-	r.ctx = snap.Context
+	if r.taskStatus == nil {
+		r.taskStatus = make(map[string]taskStatus)
+	}
+
+	// Restore the context. Older clients only saved the tasks that have a
+	// status, along with the context in the state of the alloc runner.
+	tasks := ctxSnap.Tasks
+	if _, err := os.Stat(r.contextFilePath()); err == nil {
+		if ctxSnap.AllocDir != nil {
+			r.ctx = driver.NewExecContext(ctxSnap.AllocDir)
+			for name, ports := range ctxSnap.TaskPorts {
+				r.ctx.SetTaskPorts(name, ports)
+			}
+		}
+	} else {
+		r.ctx = snap.Context
+		for name := range r.taskStatus {
+			tasks = append(tasks, name)
+		}
+	}
 
 	// Restore the task runners
 	var mErr multierror.Error
-	for name := range r.taskStatus {
+	var restored []*TaskRunner
+	for _, name := range tasks {
 		task := &structs.Task{Name: name}
 		tr := NewTaskRunner(r.logger, r.config, r.setTaskStatus, r.ctx, r.alloc.ID, task)
+		tr.priority = jobPriority(r.alloc)
 		r.tasks[name] = tr
 		if err := tr.RestoreState(); err != nil {
 			r.logger.Printf("[ERR] client: failed to restore state for alloc %s task '%s': %v", r.alloc.ID, name, err)
 			mErr.Errors = append(mErr.Errors, err)
 		} else {
-			go tr.Run()
+			restored = append(restored, tr)
+		}
+	}
+
+	// Start them once they all exist so tasks that were still waiting for
+	// their dependencies or the prestart tasks keep waiting
+	tg := &structs.TaskGroup{}
+	if r.alloc != nil && r.alloc.Job != nil {
+		if g := r.alloc.Job.LookupTaskGroup(r.alloc.TaskGroup); g != nil {
+			tg = g
 		}
 	}
+	for _, tr := range restored {
+		tr.dependencies = r.taskDependencies(tg, tr.task)
+		tr.prestart = r.prestartTasks(tg, tr.task)
+		go tr.Run()
+	}
 	return mErr.ErrorOrNil()
 }
 
 // SaveState is used to snapshot our state
 func (r *AllocRunner) SaveState() error {
+	if err := r.saveContext(); err != nil {
+		return err
+	}
+
 	r.taskStatusLock.RLock()
 	snap := allocRunnerState{
-		Alloc:      r.alloc,
+		Alloc:      allocWithoutSecrets(r.alloc),
 		TaskStatus: r.taskStatus,
-		Context:    r.ctx,
 	}
-	err := persistState(r.stateFilePath(), &snap)
+	err := persistState(r.stateFilePath(), r.config.StateFormat, &snap)
 	r.taskStatusLock.RUnlock()
 	if err != nil {
 		return err
@@ -140,6 +239,64 @@ func (r *AllocRunner) SaveState() error {
 	return mErr.ErrorOrNil()
 }
 
+// saveContext snapshots the tasks of the alloc runner and the alloc dir and
+// ports they share
+func (r *AllocRunner) saveContext() error {
+	r.taskLock.RLock()
+	snap := allocContextState{
+		Tasks:     make([]string, 0, len(r.tasks)),
+		TaskPorts: make(map[string]map[string]int),
+	}
+	for name := range r.tasks {
+		snap.Tasks = append(snap.Tasks, name)
+	}
+	r.taskLock.RUnlock()
+	sort.Strings(snap.Tasks)
+
+	if r.ctx != nil {
+		snap.AllocDir = r.ctx.AllocDir
+		for _, name := range snap.Tasks {
+			if ports := r.ctx.TaskPorts(name); ports != nil {
+				snap.TaskPorts[name] = ports
+			}
+		}
+	}
+	return persistState(r.contextFilePath(), r.config.StateFormat, &snap)
+}
+
+// allocWithoutSecrets returns the allocation with the secrets of its tasks
+// removed so they are not persisted. The allocation itself is not modified.
+func allocWithoutSecrets(alloc *structs.Allocation) *structs.Allocation {
+	if alloc.Job == nil {
+		return alloc
+	}
+	secrets := false
+	for _, tg := range alloc.Job.TaskGroups {
+		for _, task := range tg.Tasks {
+			secrets = secrets || len(task.Secrets) != 0
+		}
+	}
+	if !secrets {
+		return alloc
+	}
+
+	job := *alloc.Job
+	job.TaskGroups = make([]*structs.TaskGroup, len(alloc.Job.TaskGroups))
+	for i, tg := range alloc.Job.TaskGroups {
+		group := *tg
+		group.Tasks = make([]*structs.Task, len(tg.Tasks))
+		for j, task := range tg.Tasks {
+			t := *task
+			t.Secrets = nil
+			group.Tasks[j] = &t
+		}
+		job.TaskGroups[i] = &group
+	}
+	stripped := *alloc
+	stripped.Job = &job
+	return &stripped
+}
+
 // DestroyState is used to cleanup after ourselves
 func (r *AllocRunner) DestroyState() error {
 	return os.RemoveAll(filepath.Dir(r.stateFilePath()))
@@ -243,11 +400,12 @@ func (r *AllocRunner) setStatus(status, desc string) {
 }
 
 // setTaskStatus is used to set the status of a task
-func (r *AllocRunner) setTaskStatus(taskName, status, desc string) {
+func (r *AllocRunner) setTaskStatus(taskName, status, desc string, exit *structs.TaskExit) {
 	r.taskStatusLock.Lock()
 	r.taskStatus[taskName] = taskStatus{
 		Status:      status,
 		Description: desc,
+		Exit:        exit,
 	}
 	r.taskStatusLock.Unlock()
 	select {
@@ -258,6 +416,7 @@ func (r *AllocRunner) setTaskStatus(taskName, status, desc string) {
 
 // Run is a long running goroutine used to manage an allocation
 func (r *AllocRunner) Run() {
+	defer close(r.waitCh)
 	go r.dirtySyncState()
 
 	// Check if the allocation is in a terminal status
@@ -276,28 +435,101 @@ func (r *AllocRunner) Run() {
 		return
 	}
 
+	// Resolve the order the tasks are started in, failing on cycles
+	order, err := tg.DependencyOrder()
+	if err != nil {
+		r.logger.Printf("[ERR] client: alloc '%s' has invalid task dependencies: %v", alloc.ID, err)
+		r.setStatus(structs.AllocClientStatusFailed, fmt.Sprintf("invalid task dependencies: %v", err))
+		return
+	}
+
+	// Claim the resources of the alloc, waiting for them if the node is
+	// short. An alloc that was already running keeps its resources.
+	if tracker := r.config.ResourceTracker; tracker != nil {
+		resources := allocResources(alloc)
+		if r.ctx != nil {
+			tracker.Restore(alloc.ID, resources)
+		} else if err := tracker.TryClaim(alloc.ID, resources); err != nil {
+			r.logger.Printf("[INFO] client: alloc '%s' is blocked waiting for resources: %v", alloc.ID, err)
+			r.setStatus(structs.AllocClientStatusPending, fmt.Sprintf("blocked waiting for resources: %v", err))
+			if !tracker.Claim(alloc.ID, resources, r.destroyCh) {
+				r.logger.Printf("[DEBUG] client: alloc '%s' destroyed while blocked", alloc.ID)
+				r.setStatus(structs.AllocClientStatusDead, "destroyed while blocked waiting for resources")
+				r.retrySyncState(nil)
+				if r.destroy {
+					if err := r.DestroyState(); err != nil {
+						r.logger.Printf("[ERR] client: failed to destroy state for alloc '%s': %v",
+							r.alloc.ID, err)
+					}
+				}
+				return
+			}
+			r.logger.Printf("[DEBUG] client: alloc '%s' is no longer blocked", alloc.ID)
+			r.setStatus(structs.AllocClientStatusPending, "")
+		}
+		defer tracker.Release(alloc.ID)
+	}
+
 	// Create the execution context
 	if r.ctx == nil {
 		allocDir := allocdir.NewAllocDir(filepath.Join(r.config.AllocDir, r.alloc.ID))
-		allocDir.Build(tg.Tasks)
+		if err := allocDir.Build(tg.Tasks); err != nil {
+			r.logger.Printf("[ERR] client: failed to build alloc dir for alloc '%s': %v", alloc.ID, err)
+			r.setStatus(structs.AllocClientStatusFailed, fmt.Sprintf("failed to build alloc dir: %v", err))
+			if err := allocDir.Destroy(); err != nil {
+				r.logger.Printf("[ERR] client: failed to destroy alloc dir for alloc '%s': %v", alloc.ID, err)
+			}
+			return
+		}
 		r.ctx = driver.NewExecContext(allocDir)
 	}
 
-	// Start the task runners
+	// Start the task runners. They all run concurrently, with every task
+	// waiting for the prestart tasks to complete and its dependencies to be
+	// ready before it is started.
 	r.taskLock.Lock()
-	for _, task := range tg.Tasks {
+	for _, name := range lifecycleOrder(tg, order) {
 		// Skip tasks that were restored
-		if _, ok := r.tasks[task.Name]; ok {
+		if _, ok := r.tasks[name]; ok {
 			continue
 		}
 
 		// Merge in the task resources
+		task := tg.LookupTask(name)
 		task.Resources = alloc.TaskResources[task.Name]
 
 		tr := NewTaskRunner(r.logger, r.config, r.setTaskStatus, r.ctx, r.alloc.ID, task)
+		tr.dependencies = r.taskDependencies(tg, task)
+		tr.prestart = r.prestartTasks(tg, task)
+		tr.priority = jobPriority(alloc)
 		r.tasks[task.Name] = tr
 		go tr.Run()
 	}
+	mainDoneCh := r.watchMainTasks(tg)
+
+	// Free the resources for blocked allocs once all of the tasks exited
+	if tracker := r.config.ResourceTracker; tracker != nil {
+		waitChs := make([]<-chan struct{}, 0, len(r.tasks))
+		for _, tr := range r.tasks {
+			waitChs = append(waitChs, tr.WaitCh())
+		}
+		go func() {
+			for _, waitCh := range waitChs {
+				<-waitCh
+			}
+			tracker.Release(alloc.ID)
+		}()
+	}
+
+	// Watch the leader task, if any, to stop the others once it exits
+	var leaderName string
+	var leaderCh <-chan struct{}
+	for _, task := range tg.Tasks {
+		if tr, ok := r.tasks[task.Name]; ok && task.Leader {
+			leaderName = task.Name
+			leaderCh = tr.WaitCh()
+		}
+	}
 	r.taskLock.Unlock()
 
 OUTER:
@@ -311,32 +543,67 @@ OUTER:
 				break OUTER
 			}
 
-			// Update the task groups
+			// Update the tasks to their spec in the updated job. The task
+			// runners are handed copies so the update never aliases the
+			// tasks of the running alloc.
+			var updateTG *structs.TaskGroup
+			if update.Job != nil {
+				updateTG = update.Job.LookupTaskGroup(alloc.TaskGroup)
+			}
+			if updateTG == nil {
+				r.logger.Printf("[ERR] client: alloc '%s' update is missing task group '%s'",
+					alloc.ID, alloc.TaskGroup)
+				continue
+			}
 			r.taskLock.RLock()
 			for _, task := range tg.Tasks {
-				tr := r.tasks[task.Name]
+				tr, ok := r.tasks[task.Name]
+				if !ok {
+					continue
+				}
+				updated := updateTG.LookupTask(task.Name)
+				if updated == nil {
+					r.logger.Printf("[ERR] client: alloc '%s' update is missing task '%s'",
+						alloc.ID, task.Name)
+					continue
+				}
 
 				// Merge in the task resources
-				task.Resources = update.TaskResources[task.Name]
-				tr.Update(task)
+				t := *updated
+				t.Resources = update.TaskResources[task.Name]
+				tr.Update(&t)
 			}
 			r.taskLock.RUnlock()
 
+		case <-leaderCh:
+			r.logger.Printf("[DEBUG] client: leader task '%s' of alloc '%s' exited, stopping the other tasks",
+				leaderName, r.alloc.ID)
+			r.stopSidecars(leaderName)
+			leaderCh = nil
+
+		case <-mainDoneCh:
+			r.logger.Printf("[DEBUG] client: main tasks of alloc '%s' exited, stopping the sidecar tasks",
+				r.alloc.ID)
+			r.stopLifecycleSidecars(tg)
+			mainDoneCh = nil
+
 		case <-r.destroyCh:
 			break OUTER
 		}
 	}
 
 	// Destroy each sub-task
+	reason := r.getDestroyReason()
 	r.taskLock.RLock()
 	defer r.taskLock.RUnlock()
+	stoppedChs := make([]<-chan struct{}, 0, len(r.tasks))
 	for _, tr := range r.tasks {
-		tr.Destroy()
+		stoppedChs = append(stoppedChs, tr.Kill(reason))
 	}
 
 	// Wait for termination of the task runners
-	for _, tr := range r.tasks {
-		<-tr.WaitCh()
+	for _, stoppedCh := range stoppedChs {
+		<-stoppedCh
 	}
 
 	// Final state sync
@@ -356,6 +623,185 @@ OUTER:
 	r.logger.Printf("[DEBUG] client: terminating runner for alloc '%s'", r.alloc.ID)
 }
 
+// handleIDs returns the IDs of the driver handles of the tasks that are
+// running, along with those restored that their drivers couldn't reattach to
+func (r *AllocRunner) handleIDs() []string {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	var ids []string
+	for _, tr := range r.tasks {
+		if handle := tr.getHandle(); handle != nil {
+			ids = append(ids, handle.ID())
+		}
+		if tr.reattachHandleID != "" {
+			ids = append(ids, tr.reattachHandleID)
+		}
+	}
+	return ids
+}
+
+// jobPriority returns the priority of the job of the alloc, or zero if the
+// job isn't known
+func jobPriority(alloc *structs.Allocation) int {
+	if alloc.Job == nil {
+		return 0
+	}
+	return alloc.Job.Priority
+}
+
+// allocResources returns the resources of the alloc, adding up those of its
+// tasks if the total is not set
+func allocResources(alloc *structs.Allocation) *structs.Resources {
+	if alloc.Resources != nil {
+		return alloc.Resources
+	}
+	total := &structs.Resources{}
+	for _, resources := range alloc.TaskResources {
+		total.Add(resources)
+	}
+	return total
+}
+
+// stopSidecars destroys the tasks other than the exited leader. They are
+// given their kill timeout to exit.
+func (r *AllocRunner) stopSidecars(leader string) {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for name, tr := range r.tasks {
+		if name == leader {
+			continue
+		}
+		select {
+		case <-tr.WaitCh():
+			continue
+		default:
+		}
+		msg := fmt.Sprintf("leader task '%s' exited", leader)
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskLeaderDead).SetMessage(msg))
+		tr.Kill(KillReason{Kind: structs.TaskKillReasonLeaderDead, Message: msg})
+	}
+}
+
+// stopLifecycleSidecars destroys the sidecar and poststart tasks once the main
+// tasks have all exited. They are given their kill timeout to exit.
+func (r *AllocRunner) stopLifecycleSidecars(tg *structs.TaskGroup) {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for _, task := range tg.Tasks {
+		if phase := task.LifecyclePhase(); phase != structs.TaskLifecycleSidecar && phase != structs.TaskLifecyclePoststart {
+			continue
+		}
+		tr, ok := r.tasks[task.Name]
+		if !ok {
+			continue
+		}
+		select {
+		case <-tr.WaitCh():
+			continue
+		default:
+		}
+		msg := "main tasks exited"
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskMainDead).SetMessage(msg))
+		tr.Kill(KillReason{Kind: structs.TaskKillReasonMainDead, Message: msg})
+	}
+}
+
+// watchMainTasks returns a channel closed once the main tasks of the group
+// have all exited, or nil if there are no sidecar or poststart tasks to stop
+// then. The task lock must be held.
+func (r *AllocRunner) watchMainTasks(tg *structs.TaskGroup) <-chan struct{} {
+	var mains []*TaskRunner
+	var sidecars bool
+	for _, task := range tg.Tasks {
+		switch task.LifecyclePhase() {
+		case structs.TaskLifecycleMain:
+			if tr, ok := r.tasks[task.Name]; ok {
+				mains = append(mains, tr)
+			}
+		case structs.TaskLifecycleSidecar, structs.TaskLifecyclePoststart:
+			sidecars = true
+		}
+	}
+	if len(mains) == 0 || !sidecars {
+		return nil
+	}
+
+	doneCh := make(chan struct{})
+	go func() {
+		for _, tr := range mains {
+			<-tr.WaitCh()
+		}
+		close(doneCh)
+	}()
+	return doneCh
+}
+
+// lifecycleOrder orders the tasks so that the prestart tasks are created
+// first and the poststart tasks last, otherwise keeping the dependency order.
+// As tasks can only depend on tasks of their own or earlier phases, every
+// task still comes after its dependencies.
+func lifecycleOrder(tg *structs.TaskGroup, order []string) []string {
+	phases := [][]string{nil, nil, nil}
+	for _, name := range order {
+		switch tg.LookupTask(name).LifecyclePhase() {
+		case structs.TaskLifecyclePrestart:
+			phases[0] = append(phases[0], name)
+		case structs.TaskLifecyclePoststart:
+			phases[2] = append(phases[2], name)
+		default:
+			phases[1] = append(phases[1], name)
+		}
+	}
+	return append(append(phases[0], phases[1]...), phases[2]...)
+}
+
+// taskDependencies returns the runners of the tasks the task depends on.
+// Poststart tasks also depend on the main tasks of the group. The task
+// runners of the dependencies must already exist.
+func (r *AllocRunner) taskDependencies(tg *structs.TaskGroup, task *structs.Task) map[string]*TaskRunner {
+	names := task.DependsOn
+	if task.LifecyclePhase() == structs.TaskLifecyclePoststart {
+		names = append([]string(nil), names...)
+		for _, t := range tg.Tasks {
+			if t.LifecyclePhase() == structs.TaskLifecycleMain {
+				names = append(names, t.Name)
+			}
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+	deps := make(map[string]*TaskRunner, len(names))
+	for _, name := range names {
+		if tr, ok := r.tasks[name]; ok {
+			deps[name] = tr
+		}
+	}
+	return deps
+}
+
+// prestartTasks returns the runners of the prestart tasks the task waits to
+// complete, which is all of them for the tasks of the other phases. The task
+// runners of the prestart tasks must already exist.
+func (r *AllocRunner) prestartTasks(tg *structs.TaskGroup, task *structs.Task) map[string]*TaskRunner {
+	if task.LifecyclePhase() == structs.TaskLifecyclePrestart {
+		return nil
+	}
+	var prestart map[string]*TaskRunner
+	for _, t := range tg.Tasks {
+		if t.LifecyclePhase() != structs.TaskLifecyclePrestart {
+			continue
+		}
+		if tr, ok := r.tasks[t.Name]; ok {
+			if prestart == nil {
+				prestart = make(map[string]*TaskRunner)
+			}
+			prestart[t.Name] = tr
+		}
+	}
+	return prestart
+}
+
 // Update is used to update the allocation of the context
 func (r *AllocRunner) Update(update *structs.Allocation) {
 	select {
@@ -365,8 +811,68 @@ func (r *AllocRunner) Update(update *structs.Allocation) {
 	}
 }
 
+// Reload applies a reload of the config of the client to the running tasks
+func (r *AllocRunner) Reload() {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for _, tr := range r.tasks {
+		tr.Reload()
+	}
+}
+
+// Shutdown is used to release the resources held by the task runners when
+// the client is shutting down. The tasks are left running.
+func (r *AllocRunner) Shutdown() {
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for _, tr := range r.tasks {
+		tr.Shutdown()
+	}
+}
+
+// Stats returns the resource usage of the allocation, summing the latest
+// usage of its running tasks. Tasks that have not reported usage yet are left
+// out, as are tasks whose drivers do not support stats, which are listed
+// instead.
+func (r *AllocRunner) Stats() *AllocResourceUsage {
+	usage := &AllocResourceUsage{
+		Tasks:     make(map[string]*driver.TaskResourceUsage),
+		Timestamp: time.Now(),
+	}
+
+	r.taskLock.RLock()
+	defer r.taskLock.RUnlock()
+	for name, tr := range r.tasks {
+		task, unsupported := tr.resourceStats()
+		if unsupported {
+			usage.Unsupported = append(usage.Unsupported, name)
+			continue
+		}
+		if task == nil {
+			continue
+		}
+		usage.Tasks[name] = task
+		usage.CPUPercent += task.CPUPercent
+		usage.MemoryRSS += task.MemoryRSS
+	}
+	sort.Strings(usage.Unsupported)
+	return usage
+}
+
+// WaitCh returns a channel closed once the alloc runner exits
+func (r *AllocRunner) WaitCh() <-chan struct{} {
+	return r.waitCh
+}
+
 // Destroy is used to indicate that the allocation context should be destroyed
+// as the allocation is stopped
 func (r *AllocRunner) Destroy() {
+	r.Kill(allocStopped)
+}
+
+// Kill is used to destroy the allocation context, killing its tasks for the
+// reason. Only the reason of the first call is kept.
+func (r *AllocRunner) Kill(reason KillReason) {
 	r.destroyLock.Lock()
 	defer r.destroyLock.Unlock()
 
@@ -374,5 +880,13 @@ func (r *AllocRunner) Destroy() {
 		return
 	}
 	r.destroy = true
+	r.destroyReason = reason
 	close(r.destroyCh)
 }
+
+// getDestroyReason returns why the allocation context is destroyed
+func (r *AllocRunner) getDestroyReason() KillReason {
+	r.destroyLock.Lock()
+	defer r.destroyLock.Unlock()
+	return r.destroyReason
+}
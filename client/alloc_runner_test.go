@@ -1,7 +1,13 @@
 package client
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -168,3 +174,628 @@ func TestAllocRunner_SaveRestoreState(t *testing.T) {
 	}
 }
 */
+
+func TestAllocRunner_SaveRestoreState_Context(t *testing.T) {
+	conf := map[string]string{"run_for": "10s"}
+	upd, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web":    conf,
+		"worker": conf,
+	}, nil)
+	go ar.Run()
+	defer ar.Destroy()
+	for _, name := range []string{"web", "worker"} {
+		startedAt(t, taskRunner(t, ar, name))
+	}
+
+	if err := ar.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(ar.stateFilePath()), "alloc.json")); err != nil {
+		t.Fatalf("alloc context not saved: %v", err)
+	}
+
+	// Restoring the alloc as the client does after a restart recreates all
+	// the task runners with the same context
+	ar2 := NewAllocRunner(ar.logger, ar.config, upd.Update, &structs.Allocation{ID: ar.alloc.ID})
+	if err := ar2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer func() {
+		for _, tr := range ar2.tasks {
+			tr.Destroy()
+		}
+	}()
+
+	if len(ar2.tasks) != 2 {
+		t.Fatalf("bad task runners: %#v", ar2.tasks)
+	}
+	if !reflect.DeepEqual(ar2.ctx.AllocDir, ar.ctx.AllocDir) {
+		t.Fatalf("alloc dir differs: %#v != %#v", ar2.ctx.AllocDir, ar.ctx.AllocDir)
+	}
+	for _, name := range []string{"web", "worker"} {
+		tr := ar2.tasks[name]
+		if tr == nil {
+			t.Fatalf("task runner for '%s' not restored", name)
+		}
+		if tr.ctx != ar2.ctx {
+			t.Fatalf("task runner for '%s' does not share the alloc context", name)
+		}
+		exp := ar.ctx.TaskPorts(name)
+		if ports := ar2.ctx.TaskPorts(name); len(exp) == 0 || !reflect.DeepEqual(ports, exp) {
+			t.Fatalf("task '%s': got ports %v; want %v", name, ports, exp)
+		}
+	}
+}
+
+func TestAllocRunner_SaveState_Secrets(t *testing.T) {
+	upd, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "10s"},
+	}, nil)
+	task := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	task.Secrets = map[string]string{"token": "s3cr3t-value"}
+	go ar.Run()
+	defer ar.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		if upd.Count == 0 {
+			return false, nil
+		}
+		last := upd.Allocs[upd.Count-1]
+		return last.ClientStatus == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	if err := ar.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	data, err := ioutil.ReadFile(ar.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(string(data), "s3cr3t-value") {
+		t.Fatalf("secret persisted in alloc state: %s", data)
+	}
+
+	// The allocation being run keeps its secrets
+	if task.Secrets["token"] != "s3cr3t-value" {
+		t.Fatalf("secrets removed from the allocation: %v", task.Secrets)
+	}
+}
+
+// testDependencyAllocRunner returns an alloc runner for a group of mock
+// driver tasks with the given config and dependencies, keyed by task name.
+func testDependencyAllocRunner(configs map[string]map[string]string,
+	deps map[string][]string) (*MockAllocStateUpdater, *AllocRunner) {
+	upd, ar := testAllocRunner()
+	tg := ar.alloc.Job.TaskGroups[0]
+	base := tg.Tasks[0]
+	tg.Tasks = nil
+	for name, conf := range configs {
+		task := new(structs.Task)
+		*task = *base
+		task.Name = name
+		task.Driver = "mock_driver"
+		task.Config = conf
+		task.DependsOn = deps[name]
+		tg.Tasks = append(tg.Tasks, task)
+		ar.alloc.TaskResources[name] = ar.alloc.TaskResources[base.Name]
+	}
+	return upd, ar
+}
+
+// taskRunner waits for the alloc runner to create the named task runner
+func taskRunner(t *testing.T, ar *AllocRunner, name string) *TaskRunner {
+	var tr *TaskRunner
+	testutil.WaitForResult(func() (bool, error) {
+		ar.taskLock.RLock()
+		defer ar.taskLock.RUnlock()
+		tr = ar.tasks[name]
+		return tr != nil, fmt.Errorf("no task runner for '%s'", name)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	return tr
+}
+
+// startedAt returns when the task was last started, waiting for it to start
+func startedAt(t *testing.T, tr *TaskRunner) int64 {
+	var started int64
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskStarted {
+				started = e.Time
+			}
+		}
+		return started != 0, fmt.Errorf("task not started: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	return started
+}
+
+func TestAllocRunner_TaskDependencies_Diamond(t *testing.T) {
+	// web and worker depend on db, and proxy on both. db takes a while
+	// to become ready, so nothing may start before it.
+	conf := map[string]string{"run_for": "10s"}
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"db":     conf,
+		"web":    conf,
+		"worker": conf,
+		"proxy":  conf,
+	}, map[string][]string{
+		"web":    {"db"},
+		"worker": {"db"},
+		"proxy":  {"web", "worker"},
+	})
+	go ar.Run()
+	defer ar.Destroy()
+
+	started := make(map[string]int64)
+	for _, name := range []string{"db", "web", "worker", "proxy"} {
+		started[name] = startedAt(t, taskRunner(t, ar, name))
+	}
+	for _, dep := range [][2]string{{"db", "web"}, {"db", "worker"}, {"web", "proxy"}, {"worker", "proxy"}} {
+		if started[dep[0]] > started[dep[1]] {
+			t.Fatalf("%s started before its dependency %s: %#v", dep[1], dep[0], started)
+		}
+	}
+
+	// Destroying the alloc stops all the tasks
+	ar.Destroy()
+	for _, name := range []string{"db", "web", "worker", "proxy"} {
+		select {
+		case <-taskRunner(t, ar, name).WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("task '%s' not stopped", name)
+		}
+	}
+}
+
+func TestAllocRunner_TaskDependencies_Failed(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"db":    {"run_for": "100ms", "exit_err": "exit status 1"},
+		"web":   {"run_for": "10s"},
+		"proxy": {"run_for": "10s"},
+	}, map[string][]string{
+		"web":   {"db"},
+		"proxy": {"web"},
+	})
+	go ar.Run()
+	defer ar.Destroy()
+
+	// web is killed once db fails, and proxy in turn once web is
+	for _, name := range []string{"web", "proxy"} {
+		tr := taskRunner(t, ar, name)
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("task '%s' not stopped", name)
+		}
+		events := tr.Events()
+		last := events[len(events)-1]
+		if last.Type != structs.TaskDependencyFailed || last.KillReason != structs.TaskKillReasonDependencyFailed {
+			t.Fatalf("task '%s': bad: %#v", name, events)
+		}
+	}
+}
+
+func TestAllocRunner_TaskDependencies_Cycle(t *testing.T) {
+	conf := map[string]string{"run_for": "10s"}
+	upd, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web": conf,
+		"db":  conf,
+	}, map[string][]string{
+		"web": {"db"},
+		"db":  {"web"},
+	})
+	go ar.Run()
+	defer ar.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		if upd.Count == 0 {
+			return false, fmt.Errorf("no updates")
+		}
+		last := upd.Allocs[upd.Count-1]
+		return last.ClientStatus == structs.AllocClientStatusFailed, fmt.Errorf("bad: %#v", last)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// None of the tasks are started
+	ar.taskLock.RLock()
+	defer ar.taskLock.RUnlock()
+	if len(ar.tasks) != 0 {
+		t.Fatalf("tasks started: %#v", ar.tasks)
+	}
+}
+
+func TestAllocRunner_LeaderTask(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web":   {"run_for": "100ms"},
+		"proxy": {"run_for": "10s"},
+		"logs":  {"run_for": "10s", "ignore_kill": "true"},
+	}, nil)
+	killTimeout := 200 * time.Millisecond
+	for _, task := range ar.alloc.Job.TaskGroups[0].Tasks {
+		task.Leader = task.Name == "web"
+		task.KillTimeout = killTimeout
+	}
+	go ar.Run()
+	defer ar.Destroy()
+
+	leader := taskRunner(t, ar, "web")
+	select {
+	case <-leader.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("leader did not exit")
+	}
+	exited := time.Now()
+
+	// The sidecars are stopped once the leader exits, with the one ignoring
+	// the kill given its kill timeout
+	for _, name := range []string{"proxy", "logs"} {
+		tr := taskRunner(t, ar, name)
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("sidecar '%s' not stopped", name)
+		}
+
+		var leaderDead bool
+		for _, e := range tr.Events() {
+			leaderDead = leaderDead || e.Type == structs.TaskLeaderDead
+		}
+		if !leaderDead {
+			t.Fatalf("sidecar '%s': bad: %#v", name, tr.Events())
+		}
+		events := tr.Events()
+		if last := events[len(events)-1]; last.KillReason != structs.TaskKillReasonLeaderDead ||
+			!strings.Contains(last.Message, "leader task 'web' exited") {
+			t.Fatalf("sidecar '%s': bad kill reason: %#v", name, last)
+		}
+	}
+	if elapsed := time.Since(exited); elapsed < killTimeout {
+		t.Fatalf("sidecar force killed after %v, before its kill timeout", elapsed)
+	}
+}
+
+func TestAllocRunner_Lifecycle_Prestart(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"init": {"run_for": "200ms"},
+		"web":  {"run_for": "10s"},
+	}, nil)
+	ar.alloc.Job.TaskGroups[0].LookupTask("init").Lifecycle = structs.TaskLifecyclePrestart
+	go ar.Run()
+	defer ar.Destroy()
+
+	// web is only started once init completed
+	init := taskRunner(t, ar, "init")
+	started := startedAt(t, taskRunner(t, ar, "web"))
+	select {
+	case <-init.WaitCh():
+	default:
+		t.Fatalf("web started before init exited")
+	}
+	events := init.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskTerminated || last.Time > started {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestAllocRunner_Lifecycle_PrestartFailed(t *testing.T) {
+	upd, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"init": {"run_for": "100ms", "exit_code": "1"},
+		"web":  {"run_for": "10s"},
+	}, nil)
+	init := ar.alloc.Job.TaskGroups[0].LookupTask("init")
+	init.Lifecycle = structs.TaskLifecyclePrestart
+	init.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+		Mode:     structs.RestartPolicyModeFail,
+	}
+	go ar.Run()
+	defer ar.Destroy()
+
+	// init is restarted per its restart policy, then web is never started
+	web := taskRunner(t, ar, "web")
+	select {
+	case <-web.WaitCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("web not stopped")
+	}
+	for _, e := range web.Events() {
+		if e.Type == structs.TaskStarted {
+			t.Fatalf("web started: %#v", web.Events())
+		}
+	}
+	events := web.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskDependencyFailed ||
+		!strings.Contains(last.Message, "prestart task 'init'") {
+		t.Fatalf("bad: %#v", events)
+	}
+	if n := countEvents(taskRunner(t, ar, "init"), structs.TaskStarted); n != 2 {
+		t.Fatalf("init started %d times; want 2", n)
+	}
+
+	testutil.WaitForResult(func() (bool, error) {
+		if upd.Count == 0 {
+			return false, fmt.Errorf("no updates")
+		}
+		last := upd.Allocs[upd.Count-1]
+		return last.ClientStatus == structs.AllocClientStatusFailed, fmt.Errorf("bad: %#v", last)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestAllocRunner_Lifecycle_Sidecar(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web":  {"run_for": "200ms"},
+		"logs": {"run_for": "10s"},
+	}, nil)
+	ar.alloc.Job.TaskGroups[0].LookupTask("logs").Lifecycle = structs.TaskLifecycleSidecar
+	go ar.Run()
+	defer ar.Destroy()
+
+	// The sidecar runs alongside web and is stopped once web exits
+	logs := taskRunner(t, ar, "logs")
+	startedAt(t, logs)
+	select {
+	case <-taskRunner(t, ar, "web").WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("web did not exit")
+	}
+	select {
+	case <-logs.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("sidecar not stopped")
+	}
+	if countEvents(logs, structs.TaskMainDead) != 1 {
+		t.Fatalf("bad: %#v", logs.Events())
+	}
+	events := logs.Events()
+	if last := events[len(events)-1]; last.KillReason != structs.TaskKillReasonMainDead {
+		t.Fatalf("bad kill reason: %#v", last)
+	}
+}
+
+func TestAllocRunner_BlockedOnResources(t *testing.T) {
+	// The node only fits one of the allocs at a time
+	tracker := testResourceTracker(800, 1024)
+	_, first := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "500ms"},
+	}, nil)
+	upd, second := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "10s"},
+	}, nil)
+	first.config.ResourceTracker = tracker
+	second.config.ResourceTracker = tracker
+
+	go first.Run()
+	defer first.Destroy()
+	startedAt(t, taskRunner(t, first, "web"))
+	go second.Run()
+	defer second.Destroy()
+
+	// The second alloc is blocked rather than overcommitting the node
+	testutil.WaitForResult(func() (bool, error) {
+		if upd.Count == 0 {
+			return false, fmt.Errorf("no updates")
+		}
+		last := upd.Allocs[upd.Count-1]
+		blocked := strings.Contains(last.ClientDescription, "blocked waiting for resources: not enough CPU")
+		return last.ClientStatus == structs.AllocClientStatusPending && blocked, fmt.Errorf("bad: %#v", last)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	second.taskLock.RLock()
+	n := len(second.tasks)
+	second.taskLock.RUnlock()
+	if n != 0 {
+		t.Fatalf("blocked alloc started %d tasks", n)
+	}
+
+	// It starts once the tasks of the first alloc exit and free its
+	// resources
+	select {
+	case <-taskRunner(t, first, "web").WaitCh():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("first alloc did not exit")
+	}
+	startedAt(t, taskRunner(t, second, "web"))
+}
+
+func TestAllocRunner_Stats(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web":  {"run_for": "10s", "stats": "10:1024"},
+		"db":   {"run_for": "10s", "stats": "25.5:4096"},
+		"logs": {"run_for": "10s", "stats_unsupported": "1"},
+		"cron": {"run_for": "100ms", "stats": "50:8192"},
+	}, nil)
+
+	// Aggregate concurrently with the tasks starting and stopping
+	stopCh := make(chan struct{})
+	doneCh := make(chan struct{})
+	go func() {
+		defer close(doneCh)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+				ar.Stats()
+			}
+		}
+	}()
+	defer func() {
+		close(stopCh)
+		<-doneCh
+	}()
+
+	if usage := ar.Stats(); len(usage.Tasks) != 0 || usage.CPUPercent != 0 {
+		t.Fatalf("stats before start: %#v", usage)
+	}
+
+	go ar.Run()
+	defer ar.Destroy()
+	cron := taskRunner(t, ar, "cron")
+	select {
+	case <-cron.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The exited task is not part of the totals
+	var usage *AllocResourceUsage
+	testutil.WaitForResult(func() (bool, error) {
+		usage = ar.Stats()
+		if len(usage.Tasks) != 2 || len(usage.Unsupported) != 1 {
+			return false, fmt.Errorf("stats not collected: %#v", usage)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if usage.CPUPercent != 35.5 || usage.MemoryRSS != 5120 {
+		t.Fatalf("bad totals: %v CPU, %d RSS", usage.CPUPercent, usage.MemoryRSS)
+	}
+	if web := usage.Tasks["web"]; web == nil || web.CPUPercent != 10 || web.MemoryRSS != 1024 {
+		t.Fatalf("bad web stats: %#v", web)
+	}
+	if db := usage.Tasks["db"]; db == nil || db.CPUPercent != 25.5 || db.MemoryRSS != 4096 {
+		t.Fatalf("bad db stats: %#v", db)
+	}
+	if usage.Unsupported[0] != "logs" {
+		t.Fatalf("bad unsupported tasks: %v", usage.Unsupported)
+	}
+}
+
+func TestAllocRunner_TaskExit(t *testing.T) {
+	upd, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "10ms", "exit_code": "3"},
+	}, nil)
+	ar.alloc.Job.TaskGroups[0].Tasks[0].RestartPolicy = nil
+	go ar.Run()
+	defer ar.Destroy()
+
+	var last *structs.Allocation
+	testutil.WaitForResult(func() (bool, error) {
+		if upd.Count == 0 {
+			return false, fmt.Errorf("no updates")
+		}
+		last = upd.Allocs[upd.Count-1]
+		return last.ClientStatus == structs.AllocClientStatusDead, fmt.Errorf("status %s", last.ClientStatus)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// How the task exited is in the description of the allocation
+	var statuses map[string]taskStatus
+	if err := json.Unmarshal([]byte(last.ClientDescription), &statuses); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := &structs.TaskExit{Reason: structs.TaskExitFailed, ExitCode: 3}
+	if exit := statuses["web"].Exit; !reflect.DeepEqual(exit, exp) {
+		t.Fatalf("got %#v; want %#v", exit, exp)
+	}
+}
+
+// updatedAlloc returns a copy of the alloc whose job has the named task changed
+// by the given function, leaving the alloc untouched. It reads the alloc
+// unlocked so it must not be one being run.
+func updatedAlloc(alloc *structs.Allocation, name string, change func(*structs.Task)) *structs.Allocation {
+	job := new(structs.Job)
+	*job = *alloc.Job
+	job.TaskGroups = nil
+	for _, tg := range alloc.Job.TaskGroups {
+		newTG := new(structs.TaskGroup)
+		*newTG = *tg
+		newTG.Tasks = nil
+		for _, task := range tg.Tasks {
+			newTask := new(structs.Task)
+			*newTask = *task
+			if task.Name == name && tg.Name == alloc.TaskGroup {
+				change(newTask)
+			}
+			newTG.Tasks = append(newTG.Tasks, newTask)
+		}
+		job.TaskGroups = append(job.TaskGroups, newTG)
+	}
+
+	newAlloc := new(structs.Allocation)
+	*newAlloc = *alloc
+	newAlloc.Job = job
+	newAlloc.TaskResources = make(map[string]*structs.Resources, len(alloc.TaskResources))
+	for task, resources := range alloc.TaskResources {
+		newAlloc.TaskResources[task] = resources
+	}
+	return newAlloc
+}
+
+func TestAllocRunner_Update_Task(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "10s"},
+	}, nil)
+	running := ar.alloc.Job.TaskGroups[0].Tasks[0]
+	update := updatedAlloc(ar.alloc, "web", func(task *structs.Task) {
+		task.Env = map[string]string{"FOO": "bar"}
+	})
+	go ar.Run()
+	defer ar.Destroy()
+	tr := taskRunner(t, ar, "web")
+	startedAt(t, tr)
+	handle := tr.getHandle().(*mockHandle)
+
+	// The task is updated to its spec in the new job
+	ar.Update(update)
+	testutil.WaitForResult(func() (bool, error) {
+		return len(handle.receivedUpdates()) != 0, nil
+	}, func(err error) {
+		t.Fatalf("no update applied")
+	})
+	if n := len(handle.receivedUpdates()); n != 1 {
+		t.Fatalf("expected 1 update, got %d", n)
+	}
+	if env := tr.getTask().Env; env["FOO"] != "bar" {
+		t.Fatalf("task not updated to the new spec: %v", env)
+	}
+	if running.Env["FOO"] != "" {
+		t.Fatalf("task of the running alloc was modified: %v", running.Env)
+	}
+
+	// Updating to an identical alloc changes nothing
+	ar.Update(updatedAlloc(update, "web", func(*structs.Task) {}))
+	time.Sleep(100 * time.Millisecond)
+	if n := len(handle.receivedUpdates()); n != 1 {
+		t.Fatalf("expected the identical update to be skipped, got %d updates", n)
+	}
+}
+
+func TestAllocRunner_Update_TaskFailed(t *testing.T) {
+	_, ar := testDependencyAllocRunner(map[string]map[string]string{
+		"web": {"run_for": "10s"},
+	}, nil)
+	update := updatedAlloc(ar.alloc, "web", func(task *structs.Task) {
+		task.Config = map[string]string{"run_for": "10s", "update_err": "can't change the image"}
+	})
+	update.TaskResources["web"] = &structs.Resources{CPU: 1000, MemoryMB: 512}
+	go ar.Run()
+	defer ar.Destroy()
+	tr := taskRunner(t, ar, "web")
+	startedAt(t, tr)
+	original := tr.getTask().Resources
+
+	// An update the driver rejects leaves the task with its resources
+	ar.Update(update)
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskUpdateFailed) != 0, fmt.Errorf("no update failed event: %v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if resources := tr.getTask().Resources; resources != original {
+		t.Fatalf("rejected update changed the resources: %#v", resources)
+	}
+}
@@ -14,12 +14,25 @@ var (
 	// The name of the directory that is shared across tasks in a task group.
 	SharedAllocName = "alloc"
 
+	// The name of the directory inside the shared alloc directory that
+	// tasks log to.
+	SharedLogsName = "logs"
+
 	// The set of directories that exist inside eache shared alloc directory.
-	SharedAllocDirs = []string{"logs", "tmp", "data"}
+	SharedAllocDirs = []string{SharedLogsName, "tmp", "data"}
 
 	// The name of the directory that exists inside each task directory
 	// regardless of driver.
 	TaskLocal = "local"
+
+	// The name of the directory inside each task directory that holds the
+	// secrets of the task. Only the task can access it and it is backed by
+	// memory where supported, so secrets are not written to disk.
+	TaskSecrets = "secrets"
+
+	// The name of the directory inside each task directory for the temporary
+	// files of the task.
+	TaskTmp = "tmp"
 )
 
 type AllocDir struct {
@@ -53,6 +66,14 @@ func (d *AllocDir) Destroy() error {
 		}
 	}
 
+	// Unmount the secrets dirs. They are found from the task directories
+	// rather than recorded, so they are unmounted after a restore as well.
+	for _, taskDir := range d.TaskDirs {
+		if err := d.unmountSecretsDir(filepath.Join(taskDir, TaskSecrets)); err != nil {
+			return fmt.Errorf("Failed to unmount secrets directory: %v", err)
+		}
+	}
+
 	return os.RemoveAll(d.AllocDir)
 }
 
@@ -69,7 +90,7 @@ func (d *AllocDir) Build(tasks []*structs.Task) error {
 	}
 
 	// Make the shared directory have non-root permissions.
-	if err := d.dropDirPermissions(d.SharedDir); err != nil {
+	if err := d.dropPermissions(d.SharedDir, 0777); err != nil {
 		return err
 	}
 
@@ -86,23 +107,38 @@ func (d *AllocDir) Build(tasks []*structs.Task) error {
 		if err := os.Mkdir(taskDir, 0777); err != nil {
 			return err
 		}
+		d.TaskDirs[t.Name] = taskDir
 
 		// Make the task directory have non-root permissions.
-		if err := d.dropDirPermissions(taskDir); err != nil {
+		if err := d.dropPermissions(taskDir, 0777); err != nil {
 			return err
 		}
 
-		// Create a local directory that each task can use.
-		local := filepath.Join(taskDir, TaskLocal)
-		if err := os.Mkdir(local, 0777); err != nil {
-			return err
+		// Create a local and a tmp directory that each task can use.
+		for _, dir := range []string{TaskLocal, TaskTmp} {
+			p := filepath.Join(taskDir, dir)
+			if err := os.Mkdir(p, 0777); err != nil {
+				return err
+			}
+
+			if err := d.dropPermissions(p, 0777); err != nil {
+				return err
+			}
 		}
 
-		if err := d.dropDirPermissions(local); err != nil {
+		// Create the secrets directory, which only the task may access.
+		secrets := filepath.Join(taskDir, TaskSecrets)
+		if err := os.Mkdir(secrets, 0700); err != nil {
 			return err
 		}
 
-		d.TaskDirs[t.Name] = taskDir
+		if err := d.mountSecretsDir(secrets); err != nil {
+			return fmt.Errorf("Failed to mount secrets directory for task %v: %v", t.Name, err)
+		}
+
+		if err := d.dropPermissions(secrets, 0700); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -175,9 +211,55 @@ func (d *AllocDir) Embed(task string, dirs map[string]string) error {
 	return nil
 }
 
+// LocalDir returns the local directory of the task.
+func (d *AllocDir) LocalDir(task string) string {
+	return filepath.Join(d.TaskDirs[task], TaskLocal)
+}
+
+// SecretsDir returns the secrets directory of the task.
+func (d *AllocDir) SecretsDir(task string) string {
+	return filepath.Join(d.TaskDirs[task], TaskSecrets)
+}
+
+// TmpDir returns the tmp directory of the task.
+func (d *AllocDir) TmpDir(task string) string {
+	return filepath.Join(d.TaskDirs[task], TaskTmp)
+}
+
+// WriteSecret writes the secret into the secrets directory of the task, where
+// only the task can read it.
+func (d *AllocDir) WriteSecret(task, name string, data []byte) error {
+	if _, ok := d.TaskDirs[task]; !ok {
+		return fmt.Errorf("No task directory exists for %v", task)
+	}
+
+	path := filepath.Join(d.SecretsDir(task), name)
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("Couldn't write secret %v: %v", name, err)
+	}
+
+	return d.dropPermissions(path, 0600)
+}
+
+// RemoveSecrets unmounts the secrets directory of the task and removes the
+// secrets in it once the task no longer needs them.
+func (d *AllocDir) RemoveSecrets(task string) error {
+	taskDir, ok := d.TaskDirs[task]
+	if !ok {
+		return nil
+	}
+
+	dir := filepath.Join(taskDir, TaskSecrets)
+	if err := d.unmountSecretsDir(dir); err != nil {
+		return fmt.Errorf("Failed to unmount secrets directory: %v", err)
+	}
+
+	return os.RemoveAll(dir)
+}
+
 // MountSharedDir mounts the shared directory into the specified task's
 // directory. Mount is documented at an OS level in their respective
-// implementation files.
+// implementation files. Mounting it again is a no-op.
 func (d *AllocDir) MountSharedDir(task string) error {
 	taskDir, ok := d.TaskDirs[task]
 	if !ok {
@@ -185,6 +267,11 @@ func (d *AllocDir) MountSharedDir(task string) error {
 	}
 
 	taskLoc := filepath.Join(taskDir, SharedAllocName)
+	for _, m := range d.mounted {
+		if m == taskLoc {
+			return nil
+		}
+	}
 	if err := d.mountSharedDir(taskLoc); err != nil {
 		return fmt.Errorf("Failed to mount shared directory for task %v: %v", task, err)
 	}
@@ -193,6 +280,45 @@ func (d *AllocDir) MountSharedDir(task string) error {
 	return nil
 }
 
+// UnmountSharedDir unmounts the shared directory from the specified task's
+// directory, such as once the task is killed, so the next run of the task
+// mounts it again. It is a no-op if it is not mounted.
+func (d *AllocDir) UnmountSharedDir(task string) error {
+	taskDir, ok := d.TaskDirs[task]
+	if !ok {
+		return fmt.Errorf("No task directory exists for %v", task)
+	}
+
+	taskLoc := filepath.Join(taskDir, SharedAllocName)
+	for i, m := range d.mounted {
+		if m != taskLoc {
+			continue
+		}
+		if err := d.unmountSharedDir(taskLoc); err != nil {
+			return fmt.Errorf("Failed to unmount shared directory for task %v: %v", task, err)
+		}
+		d.mounted = append(d.mounted[:i], d.mounted[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+// Chown makes the user and group the owners of the directories of the task,
+// so a task run as that user can write to them.
+func (d *AllocDir) Chown(task string, uid, gid int) error {
+	taskDir, ok := d.TaskDirs[task]
+	if !ok {
+		return fmt.Errorf("No task directory exists for %v", task)
+	}
+
+	for _, dir := range []string{"", TaskLocal, TaskTmp, TaskSecrets} {
+		if err := d.chown(filepath.Join(taskDir, dir), uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func fileCopy(src, dst string, perm os.FileMode) error {
 	// Do a simple copy.
 	srcFile, err := os.Open(src)
@@ -13,3 +13,12 @@ func (d *AllocDir) mountSharedDir(dir string) error {
 func (d *AllocDir) unmountSharedDir(dir string) error {
 	return syscall.Unlink(dir)
 }
+
+// Secrets are kept in a regular directory as there is no tmpfs.
+func (d *AllocDir) mountSecretsDir(dir string) error {
+	return nil
+}
+
+func (d *AllocDir) unmountSecretsDir(dir string) error {
+	return nil
+}
@@ -1,20 +1,62 @@
 package allocdir
 
 import (
+	"fmt"
 	"os"
 	"syscall"
 )
 
+// The size of the tmpfs mounted over the secrets directory of each task.
+const secretsDirSizeMB = 1
+
 // Bind mounts the shared directory into the task directory. Must be root to
-// run.
+// run. The mount point is left in place by an unmount, and the shared
+// directory may still be mounted on it, such as for a restored alloc dir.
 func (d *AllocDir) mountSharedDir(taskDir string) error {
-	if err := os.Mkdir(taskDir, 0777); err != nil {
+	if err := os.MkdirAll(taskDir, 0777); err != nil {
 		return err
 	}
 
+	// A bind mount is the same directory as its source
+	shared, err := os.Stat(d.SharedDir)
+	if err != nil {
+		return err
+	}
+	target, err := os.Stat(taskDir)
+	if err != nil {
+		return err
+	}
+	if os.SameFile(shared, target) {
+		return nil
+	}
+
 	return syscall.Mount(d.SharedDir, taskDir, "", syscall.MS_BIND, "")
 }
 
 func (d *AllocDir) unmountSharedDir(dir string) error {
 	return syscall.Unmount(dir, 0)
 }
+
+// Mounts a tmpfs over the secrets directory so secrets are never written to
+// disk. Mounting requires root, so the directory is left as is otherwise.
+func (d *AllocDir) mountSecretsDir(dir string) error {
+	if syscall.Geteuid() != 0 {
+		return nil
+	}
+
+	flags := uintptr(syscall.MS_NOEXEC | syscall.MS_NOSUID | syscall.MS_NODEV)
+	data := fmt.Sprintf("size=%dm,mode=0700", secretsDirSizeMB)
+	return syscall.Mount("tmpfs", dir, "tmpfs", flags, data)
+}
+
+// Unmounts the secrets directory. It is not an error if it is not mounted.
+func (d *AllocDir) unmountSecretsDir(dir string) error {
+	if syscall.Geteuid() != 0 {
+		return nil
+	}
+
+	if err := syscall.Unmount(dir, 0); err != nil && err != syscall.EINVAL && err != syscall.ENOENT {
+		return err
+	}
+	return nil
+}
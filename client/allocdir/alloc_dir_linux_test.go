@@ -0,0 +1,118 @@
+package allocdir
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/testutil"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// mountType returns the filesystem type mounted at the path, or the empty
+// string if nothing is mounted there.
+func mountType(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		// The mount point is the fifth field and the filesystem type follows
+		// the separator
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != path {
+			continue
+		}
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+func TestAllocDir_SecretsTmpfs(t *testing.T) {
+	testutil.MountCompatible(t)
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(tmp)
+	tasks := []*structs.Task{t1, t2}
+	if err := d.Build(tasks); err != nil {
+		t.Fatalf("Build(%v) failed: %v", tasks, err)
+	}
+
+	for _, task := range tasks {
+		secrets := d.SecretsDir(task.Name)
+		if fs := mountType(t, secrets); fs != "tmpfs" {
+			t.Fatalf("%v is mounted as %q; want tmpfs", secrets, fs)
+		}
+		fi, err := os.Stat(secrets)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if fi.Mode().Perm() != 0700 {
+			t.Fatalf("%v has permissions %v; want 0700", secrets, fi.Mode().Perm())
+		}
+	}
+
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	for _, task := range tasks {
+		if fs := mountType(t, d.SecretsDir(task.Name)); fs != "" {
+			t.Fatalf("secrets dir of %v still mounted", task.Name)
+		}
+	}
+}
+
+func TestAllocDir_MountSharedDir_Remount(t *testing.T) {
+	testutil.MountCompatible(t)
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(tmp)
+	defer d.Destroy()
+	tasks := []*structs.Task{t1}
+	if err := d.Build(tasks); err != nil {
+		t.Fatalf("Build(%v) failed: %v", tasks, err)
+	}
+
+	// Mounting again is a no-op
+	shared := filepath.Join(d.TaskDirs[t1.Name], SharedAllocName)
+	for i := 0; i < 2; i++ {
+		if err := d.MountSharedDir(t1.Name); err != nil {
+			t.Fatalf("MountSharedDir(%v) failed: %v", t1.Name, err)
+		}
+	}
+
+	// A restored alloc dir finds it already mounted
+	restored := NewAllocDir(tmp)
+	restored.TaskDirs = d.TaskDirs
+	if err := restored.MountSharedDir(t1.Name); err != nil {
+		t.Fatalf("MountSharedDir(%v) failed: %v", t1.Name, err)
+	}
+
+	// Once unmounted it is mounted again on the mount point left behind
+	if err := d.UnmountSharedDir(t1.Name); err != nil {
+		t.Fatalf("UnmountSharedDir(%v) failed: %v", t1.Name, err)
+	}
+	if fs := mountType(t, shared); fs != "" {
+		t.Fatalf("%v still mounted as %q", shared, fs)
+	}
+	if err := d.MountSharedDir(t1.Name); err != nil {
+		t.Fatalf("MountSharedDir(%v) failed: %v", t1.Name, err)
+	}
+	if fs := mountType(t, shared); fs == "" {
+		t.Fatalf("%v not mounted", shared)
+	}
+}
@@ -20,7 +20,9 @@ func (d *AllocDir) linkOrCopy(src, dst string, perm os.FileMode) error {
 	return fileCopy(src, dst, perm)
 }
 
-func (d *AllocDir) dropDirPermissions(path string) error {
+// dropPermissions makes the nobody user the owner of the file or directory
+// and sets its permissions.
+func (d *AllocDir) dropPermissions(path string, perm os.FileMode) error {
 	// Can't do anything if not root.
 	if syscall.Geteuid() != 0 {
 		return nil
@@ -45,10 +47,23 @@ func (d *AllocDir) dropDirPermissions(path string) error {
 		return fmt.Errorf("Couldn't change owner/group of %v to (uid: %v, gid: %v): %v", path, uid, gid, err)
 	}
 
-	if err := os.Chmod(path, 0777); err != nil {
-		return fmt.Errorf("Couldn't change owner/group of %v to (uid: %v, gid: %v): %v", path, uid, gid, err)
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("Couldn't change permissions of %v to %v: %v", path, perm, err)
+	}
+
+	return nil
+}
+
+// chown changes the owner of the file or directory to the user and group.
+func (d *AllocDir) chown(path string, uid, gid int) error {
+	// Can't do anything if not root.
+	if syscall.Geteuid() != 0 {
+		return nil
 	}
 
+	if err := os.Chown(path, uid, gid); err != nil {
+		return fmt.Errorf("Couldn't change owner/group of %v to (uid: %v, gid: %v): %v", path, uid, gid, err)
+	}
 	return nil
 }
 
@@ -5,6 +5,8 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"syscall"
 	"testing"
 
 	"github.com/hashicorp/nomad/client/testutil"
@@ -51,6 +53,7 @@ func TestAllocDir_BuildAlloc(t *testing.T) {
 	if err := d.Build(tasks); err != nil {
 		t.Fatalf("Build(%v) failed: %v", tasks, err)
 	}
+	defer d.Destroy()
 
 	// Check that the AllocDir and each of the task directories exist.
 	if _, err := os.Stat(d.AllocDir); os.IsNotExist(err) {
@@ -69,6 +72,125 @@ func TestAllocDir_BuildAlloc(t *testing.T) {
 	}
 }
 
+// Test that each task directory has its local, tmp and secrets directories
+// and that only the secrets directory is private.
+func TestAllocDir_TaskSubdirs(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(tmp)
+	tasks := []*structs.Task{t1, t2}
+	if err := d.Build(tasks); err != nil {
+		t.Fatalf("Build(%v) failed: %v", tasks, err)
+	}
+	defer d.Destroy()
+
+	for _, task := range tasks {
+		dirs := map[string]os.FileMode{
+			d.LocalDir(task.Name):   0777,
+			d.TmpDir(task.Name):     0777,
+			d.SecretsDir(task.Name): 0700,
+		}
+		for dir, perm := range dirs {
+			fi, err := os.Stat(dir)
+			if err != nil {
+				t.Fatalf("Build(%v) didn't create %v: %v", tasks, dir, err)
+			}
+			if !fi.IsDir() {
+				t.Fatalf("%v is not a directory", dir)
+			}
+			if runtime.GOOS == "windows" {
+				continue
+			}
+			if perm == 0700 && fi.Mode().Perm() != perm {
+				t.Fatalf("%v has permissions %v; want %v", dir, fi.Mode().Perm(), perm)
+			}
+			if perm == 0777 && fi.Mode().Perm()&0700 != 0700 {
+				t.Fatalf("%v has permissions %v", dir, fi.Mode().Perm())
+			}
+		}
+	}
+}
+
+// Test that destroying the alloc dir removes everything it built.
+func TestAllocDir_Destroy(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(filepath.Join(tmp, "alloc-id"))
+	tasks := []*structs.Task{t1, t2}
+	if err := d.Build(tasks); err != nil {
+		t.Fatalf("Build(%v) failed: %v", tasks, err)
+	}
+	for _, task := range tasks {
+		if err := ioutil.WriteFile(filepath.Join(d.SecretsDir(task.Name), "token"), []byte("secret"), 0600); err != nil {
+			t.Fatalf("Couldn't write secret: %v", err)
+		}
+	}
+	if runtime.GOOS != "windows" && syscall.Geteuid() == 0 {
+		for _, task := range tasks {
+			if err := d.MountSharedDir(task.Name); err != nil {
+				t.Fatalf("MountSharedDir(%v) failed: %v", task.Name, err)
+			}
+		}
+	}
+
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+	if _, err := os.Stat(d.AllocDir); !os.IsNotExist(err) {
+		t.Fatalf("Destroy() didn't remove %v: %v", d.AllocDir, err)
+	}
+}
+
+func TestAllocDir_WriteRemoveSecrets(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "AllocDir")
+	if err != nil {
+		t.Fatalf("Couldn't create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmp)
+
+	d := NewAllocDir(tmp)
+	tasks := []*structs.Task{t1}
+	if err := d.Build(tasks); err != nil {
+		t.Fatalf("Build(%v) failed: %v", tasks, err)
+	}
+	defer d.Destroy()
+
+	if err := d.WriteSecret(t1.Name, "token", []byte("secret")); err != nil {
+		t.Fatalf("WriteSecret() failed: %v", err)
+	}
+	path := filepath.Join(d.SecretsDir(t1.Name), "token")
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("secret not written: %v", err)
+	}
+	if runtime.GOOS != "windows" && fi.Mode().Perm() != 0600 {
+		t.Fatalf("secret has permissions %v; want 0600", fi.Mode().Perm())
+	}
+	if err := d.WriteSecret("missing", "token", nil); err == nil {
+		t.Fatalf("WriteSecret() for an unknown task should fail")
+	}
+
+	if err := d.RemoveSecrets(t1.Name); err != nil {
+		t.Fatalf("RemoveSecrets() failed: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("secret not removed: %v", err)
+	}
+
+	// Destroying afterwards still succeeds
+	if err := d.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+}
+
 func TestAllocDir_EmbedNonExistent(t *testing.T) {
 	tmp, err := ioutil.TempDir("", "AllocDir")
 	if err != nil {
@@ -81,6 +203,7 @@ func TestAllocDir_EmbedNonExistent(t *testing.T) {
 	if err := d.Build(tasks); err != nil {
 		t.Fatalf("Build(%v) failed: %v", tasks, err)
 	}
+	defer d.Destroy()
 
 	fakeDir := "/foobarbaz"
 	task := tasks[0].Name
@@ -102,6 +225,7 @@ func TestAllocDir_EmbedDirs(t *testing.T) {
 	if err := d.Build(tasks); err != nil {
 		t.Fatalf("Build(%v) failed: %v", tasks, err)
 	}
+	defer d.Destroy()
 
 	// Create a fake host directory, with a file, and a subfolder that contains
 	// a file.
@@ -162,6 +286,7 @@ func TestAllocDir_MountSharedAlloc(t *testing.T) {
 	if err := d.Build(tasks); err != nil {
 		t.Fatalf("Build(%v) failed: %v", tasks, err)
 	}
+	defer d.Destroy()
 
 	// Write a file to the shared dir.
 	exp := []byte{'f', 'o', 'o'}
@@ -15,7 +15,22 @@ func (d *AllocDir) mountSharedDir(dir string) error {
 }
 
 // The windows version does nothing currently.
-func (d *AllocDir) dropDirPermissions(path string) error {
+func (d *AllocDir) dropPermissions(path string, perm os.FileMode) error {
+	return nil
+}
+
+// The windows version does nothing currently.
+func (d *AllocDir) chown(path string, uid, gid int) error {
+	return nil
+}
+
+// The windows version does nothing currently.
+func (d *AllocDir) mountSecretsDir(dir string) error {
+	return nil
+}
+
+// The windows version does nothing currently.
+func (d *AllocDir) unmountSecretsDir(dir string) error {
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"sync"
 	"time"
@@ -15,6 +16,8 @@ import (
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
 	"github.com/hashicorp/nomad/client/fingerprint"
+	"github.com/hashicorp/nomad/client/getter"
+	"github.com/hashicorp/nomad/client/metrics"
 	"github.com/hashicorp/nomad/nomad"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -51,13 +54,40 @@ const (
 	// starting and the intial heartbeat. After the intial heartbeat,
 	// we switch to using the TTL specified by the servers.
 	initialHeartbeatStagger = 10 * time.Second
+
+	// defaultKillTimeout is the time tasks are given to exit after being
+	// asked to stop, unless configured otherwise
+	defaultKillTimeout = 5 * time.Second
+
+	// defaultMaxKillTimeout is the longest a task may ask to be given to
+	// exit after being asked to stop, unless configured otherwise
+	defaultMaxKillTimeout = 30 * time.Second
+
+	// metricsBufferSize is the number of metrics buffered for the metrics
+	// sink before new ones are dropped
+	metricsBufferSize = 512
+
+	// defaultStateGCRetention is how long orphaned state is kept before it
+	// is removed, unless configured otherwise
+	defaultStateGCRetention = 24 * time.Hour
+
+	// defaultMaxConcurrentDownloads is the number of artifacts downloaded
+	// at once, unless configured otherwise
+	defaultMaxConcurrentDownloads = 8
+
+	// defaultMaxArtifactCacheSize is the size in bytes of the artifact
+	// cache, unless configured otherwise
+	defaultMaxArtifactCacheSize = 1024 * 1024 * 1024
 )
 
 // DefaultConfig returns the default configuration
 func DefaultConfig() *config.Config {
 	return &config.Config{
-		LogOutput: os.Stderr,
-		Region:    "global",
+		LogOutput:        os.Stderr,
+		Region:           "global",
+		KillTimeout:      defaultKillTimeout,
+		MaxKillTimeout:   defaultMaxKillTimeout,
+		StateGCRetention: defaultStateGCRetention,
 	}
 }
 
@@ -79,12 +109,26 @@ type Client struct {
 
 	connPool *nomad.ConnPool
 
+	// metrics buffers the metrics of the task runners so a slow sink never
+	// blocks them
+	metrics *metrics.BufferedSink
+
+	// webhooks delivers the lifecycle transitions of tasks to the task
+	// webhooks, if the client created the notifier
+	webhooks *webhookNotifier
+
 	lastHeartbeat time.Time
 	heartbeatTTL  time.Duration
 
-	// allocs is the current set of allocations
+	// reregisterCh asks the run loop to register the node again, such as
+	// once a reload changed its reserved resources
+	reregisterCh chan struct{}
+
+	// allocs is the current set of allocations. New ones are rejected once
+	// the client is draining.
 	allocs    map[string]*AllocRunner
 	allocLock sync.RWMutex
+	draining  bool
 
 	shutdown     bool
 	shutdownCh   chan struct{}
@@ -93,17 +137,156 @@ type Client struct {
 
 // NewClient is used to create a new client from the given configuration
 func NewClient(cfg *config.Config) (*Client, error) {
+	if cfg.TaskUpdateBufferSize < 0 {
+		return nil, fmt.Errorf("task update buffer size must be positive, got %d", cfg.TaskUpdateBufferSize)
+	}
+	if cfg.MaxConcurrentDownloads < 0 {
+		return nil, fmt.Errorf("max concurrent downloads must be positive, got %d", cfg.MaxConcurrentDownloads)
+	}
+	if cfg.MaxPersistedTaskEvents < 0 {
+		return nil, fmt.Errorf("max persisted task events must not be negative, got %d", cfg.MaxPersistedTaskEvents)
+	}
+	if cfg.MaxTaskStateSize < 0 {
+		return nil, fmt.Errorf("max task state size must not be negative, got %d", cfg.MaxTaskStateSize)
+	}
+	if cfg.StateSaveInterval < 0 {
+		return nil, fmt.Errorf("state save interval must not be negative, got %v", cfg.StateSaveInterval)
+	}
+	if cfg.OversubscriptionFactor != 0 && cfg.OversubscriptionFactor < 1 {
+		return nil, fmt.Errorf("oversubscription factor must be at least 1, got %v", cfg.OversubscriptionFactor)
+	}
+	if cfg.MaxConcurrentStarts < 0 {
+		return nil, fmt.Errorf("max concurrent starts must not be negative, got %d", cfg.MaxConcurrentStarts)
+	}
+	if cfg.MaxArtifactCacheSize < 0 {
+		return nil, fmt.Errorf("max artifact cache size must not be negative, got %d", cfg.MaxArtifactCacheSize)
+	}
+	if cfg.MaxDownloadBandwidth < 0 {
+		return nil, fmt.Errorf("max download bandwidth must not be negative, got %d", cfg.MaxDownloadBandwidth)
+	}
+	if err := ValidateLogLevels(cfg); err != nil {
+		return nil, err
+	}
+
+	// Hand out the host ports of tasks from the dynamic port range
+	if cfg.PortAllocator == nil {
+		min, max := cfg.MinDynamicPort, cfg.MaxDynamicPort
+		if min == 0 {
+			min = structs.MinDynamicPort
+		}
+		if max == 0 {
+			max = structs.MaxDynamicPort
+		}
+		allocator, err := newPortAllocator(min, max)
+		if err != nil {
+			return nil, err
+		}
+		cfg.PortAllocator = allocator
+	}
+
+	// Pin tasks to the CPUs of the host
+	if cfg.CoreAllocator == nil {
+		cfg.CoreAllocator = newCoreAllocator(runtime.NumCPU())
+	}
+
+	// Queue the allocations that don't fit in the resources of the node.
+	// They are only known once the node is fingerprinted, so they are read
+	// as allocations are admitted.
+	if cfg.ResourceTracker == nil {
+		tracker := newResourceTracker(func() *structs.Resources {
+			return nodeCapacity(cfg.ReadNode())
+		})
+		if cfg.Oversubscribe {
+			tracker.oversubscription = cfg.OversubscriptionFactor
+			if tracker.oversubscription == 0 {
+				tracker.oversubscription = defaultOversubscriptionFactor
+			}
+		}
+		cfg.ResourceTracker = tracker
+	}
+
+	// Bound the artifact downloads running at once across all tasks
+	if cfg.DownloadLimiter == nil {
+		limit := cfg.MaxConcurrentDownloads
+		if limit == 0 {
+			limit = defaultMaxConcurrentDownloads
+		}
+		cfg.DownloadLimiter = newDownloadLimiter(limit)
+	}
+
+	// Bound the tasks started at once across all allocations
+	if cfg.StartLimiter == nil && cfg.MaxConcurrentStarts > 0 {
+		cfg.StartLimiter = newStartLimiter(cfg.MaxConcurrentStarts)
+	}
+
+	// Share the download bandwidth between all tasks
+	if cfg.DownloadRateLimiter == nil && cfg.MaxDownloadBandwidth > 0 {
+		cfg.DownloadRateLimiter = getter.NewRateLimiter(cfg.MaxDownloadBandwidth)
+	}
+
+	// Download the artifacts many tasks fetch once
+	if cfg.ArtifactCache == nil && cfg.StateDir != "" {
+		size := cfg.MaxArtifactCacheSize
+		if size == 0 {
+			size = defaultMaxArtifactCacheSize
+		}
+		cache, err := getter.NewCache(filepath.Join(cfg.StateDir, "cache"), size)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ArtifactCache = cache
+	}
+
+	// Register the services of tasks with the local Consul agent
+	if cfg.ServiceRegistry == nil {
+		registry, err := newConsulRegistry(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.ServiceRegistry = registry
+	}
+
+	// Render the keys templates read from the KV store of the same agent
+	if cfg.KVStore == nil {
+		store, err := newConsulKV(cfg)
+		if err != nil {
+			return nil, err
+		}
+		cfg.KVStore = store
+	}
+
 	// Create a logger
 	logger := log.New(cfg.LogOutput, "", log.LstdFlags)
 
+	// Never block the task runners on the metrics sink
+	var metricsSink *metrics.BufferedSink
+	if cfg.MetricsSink != nil {
+		metricsSink = metrics.NewBufferedSink(cfg.MetricsSink, metricsBufferSize)
+		cfg.MetricsSink = metricsSink
+	}
+
+	// Deliver the lifecycle transitions of tasks to the webhooks
+	var webhooks *webhookNotifier
+	if cfg.TaskNotifier == nil && len(cfg.TaskWebhooks) != 0 {
+		notifier, err := newWebhookNotifier(cfg.TaskWebhooks, logger)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = notifier
+		cfg.TaskNotifier = notifier
+	}
+
 	// Create the client
 	c := &Client{
-		config:     cfg,
-		start:      time.Now(),
-		connPool:   nomad.NewPool(cfg.LogOutput, clientRPCCache, clientMaxStreams, nil),
-		logger:     logger,
-		allocs:     make(map[string]*AllocRunner),
-		shutdownCh: make(chan struct{}),
+		config:       cfg,
+		start:        time.Now(),
+		connPool:     nomad.NewPool(cfg.LogOutput, clientRPCCache, clientMaxStreams, nil),
+		metrics:      metricsSink,
+		webhooks:     webhooks,
+		logger:       logger,
+		allocs:       make(map[string]*AllocRunner),
+		reregisterCh: make(chan struct{}, 1),
+		shutdownCh:   make(chan struct{}),
 	}
 
 	// Initialize the client
@@ -112,7 +295,8 @@ func NewClient(cfg *config.Config) (*Client, error) {
 	}
 
 	// Restore the state
-	if err := c.restoreState(); err != nil {
+	restored, err := c.restoreState()
+	if err != nil {
 		return nil, fmt.Errorf("failed to restore state: %v", err)
 	}
 
@@ -131,6 +315,14 @@ func NewClient(cfg *config.Config) (*Client, error) {
 		return nil, fmt.Errorf("driver setup failed: %v", err)
 	}
 
+	// Reap what the drivers left behind, then run the restored allocs. They
+	// only run once the orphans are gone, so no task they start is mistaken
+	// for one.
+	c.cleanupDrivers(restored)
+	for _, ar := range restored {
+		go ar.Run()
+	}
+
 	// Set up the known servers list
 	c.SetServers(c.config.Servers)
 
@@ -187,6 +379,18 @@ func (c *Client) Shutdown() error {
 	c.shutdown = true
 	close(c.shutdownCh)
 	c.connPool.Shutdown()
+
+	c.allocLock.RLock()
+	for _, ar := range c.allocs {
+		ar.Shutdown()
+	}
+	c.allocLock.RUnlock()
+	if c.metrics != nil {
+		c.metrics.Close()
+	}
+	if c.webhooks != nil {
+		c.webhooks.Close()
+	}
 	return c.saveState()
 }
 
@@ -300,36 +504,121 @@ func (c *Client) Node() *structs.Node {
 	return c.config.Node
 }
 
-// restoreState is used to restore our state from the data dir
-func (c *Client) restoreState() error {
+// restoreState is used to restore our state from the data dir. It returns
+// the restored alloc runners, which are left for the caller to run.
+func (c *Client) restoreState() ([]*AllocRunner, error) {
 	if c.config.DevMode {
-		return nil
+		return nil, nil
 	}
 
 	// Scan the directory
 	list, err := ioutil.ReadDir(filepath.Join(c.config.StateDir, "alloc"))
 	if err != nil && os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	} else if err != nil {
-		return fmt.Errorf("failed to list alloc state: %v", err)
+		return nil, fmt.Errorf("failed to list alloc state: %v", err)
 	}
 
-	// Load each alloc back
+	// Load each alloc back. Directories without alloc state are left
+	// behind by allocs removed while we were down, and are swept below.
 	var mErr multierror.Error
+	var restored []*AllocRunner
 	for _, entry := range list {
 		id := entry.Name()
 		alloc := &structs.Allocation{ID: id}
 		ar := NewAllocRunner(c.logger, c.config, c.updateAllocStatus, alloc)
+		if _, err := os.Stat(ar.stateFilePath()); os.IsNotExist(err) {
+			continue
+		}
 		c.allocs[id] = ar
 		if err := ar.RestoreState(); err != nil {
 			c.logger.Printf("[ERR] client: failed to restore state for alloc %s: %v",
 				id, err)
 			mErr.Errors = append(mErr.Errors, err)
 		} else {
-			go ar.Run()
+			restored = append(restored, ar)
 		}
 	}
-	return mErr.ErrorOrNil()
+
+	// Sweep before the allocs run so the state they own is settled
+	c.gcStateDirs()
+	return restored, mErr.ErrorOrNil()
+}
+
+// gcStateDirs removes the state directories that belong to neither a known
+// allocation nor one of its tasks, once they have not been modified for the
+// retention period. In dry-run mode they are only logged.
+func (c *Client) gcStateDirs() {
+	allocDir := filepath.Join(c.config.StateDir, "alloc")
+	var orphans []string
+	list, err := ioutil.ReadDir(allocDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			c.logger.Printf("[ERR] client: failed to list alloc state: %v", err)
+		}
+		return
+	}
+	for _, entry := range list {
+		path := filepath.Join(allocDir, entry.Name())
+		ar, ok := c.allocs[entry.Name()]
+		if !ok {
+			orphans = append(orphans, path)
+			continue
+		}
+
+		// Look for the state of tasks that are no longer part of the alloc
+		taskDirs := ar.taskStateDirs()
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			c.logger.Printf("[ERR] client: failed to list state of alloc %s: %v", entry.Name(), err)
+			continue
+		}
+		for _, e := range entries {
+			if _, ok := taskDirs[e.Name()]; e.IsDir() && !ok {
+				orphans = append(orphans, filepath.Join(path, e.Name()))
+			}
+		}
+	}
+
+	for _, path := range orphans {
+		modified, err := lastModified(path)
+		if err != nil {
+			c.logger.Printf("[ERR] client: failed to inspect orphaned state %s: %v", path, err)
+			continue
+		}
+		if age := time.Since(modified); age < c.config.StateGCRetention {
+			c.logger.Printf("[DEBUG] client: keeping orphaned state %s modified %v ago", path, age)
+			continue
+		}
+		if c.config.StateGCDryRun {
+			c.logger.Printf("[INFO] client: would remove orphaned state %s (dry run)", path)
+			continue
+		}
+		c.logger.Printf("[INFO] client: removing orphaned state %s", path)
+		if err := os.RemoveAll(path); err != nil {
+			c.logger.Printf("[ERR] client: failed to remove orphaned state %s: %v", path, err)
+		}
+	}
+}
+
+// lastModified returns the latest modification time of the regular files at
+// or below path. Directories are skipped as listing or sweeping them changes
+// their own times, which would keep orphans looking fresh.
+func lastModified(path string) (time.Time, error) {
+	var latest time.Time
+	err := filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest, err
 }
 
 // saveState is used to snapshot our state into the data dir
@@ -439,11 +728,36 @@ func (c *Client) fingerprint() error {
 	return nil
 }
 
+// cleanupDrivers has each available driver reap the resources it manages that
+// none of the handles of the restored allocs reference, such as containers
+// left behind by a crash. Failures are logged as they don't affect the tasks.
+func (c *Client) cleanupDrivers(restored []*AllocRunner) {
+	var active []string
+	for _, ar := range restored {
+		active = append(active, ar.handleIDs()...)
+	}
+
+	driverCtx := driver.NewDriverContext("", c.config, c.config.Node, c.logger)
+	for _, name := range driver.DriverNames(c.config) {
+		if !driver.Available(c.config.Node, name) {
+			continue
+		}
+		d, err := driver.NewDriver(name, driverCtx)
+		if err != nil {
+			c.logger.Printf("[ERR] client: failed to create driver '%s' for cleanup: %v", name, err)
+			continue
+		}
+		if err := d.Cleanup(active); err != nil {
+			c.logger.Printf("[WARN] client: failed to clean up orphans of driver '%s': %v", name, err)
+		}
+	}
+}
+
 // setupDrivers is used to find the available drivers
 func (c *Client) setupDrivers() error {
 	var avail []string
 	driverCtx := driver.NewDriverContext("", c.config, c.config.Node, c.logger)
-	for name := range driver.BuiltinDrivers {
+	for _, name := range driver.DriverNames(c.config) {
 		d, err := driver.NewDriver(name, driverCtx)
 		if err != nil {
 			return err
@@ -453,6 +767,8 @@ func (c *Client) setupDrivers() error {
 			return err
 		}
 		if applies {
+			// Advertise what the driver supports to the scheduler
+			driver.AdvertiseCapabilities(c.config.Node, name, d.Capabilities())
 			avail = append(avail, name)
 		}
 	}
@@ -518,6 +834,9 @@ func (c *Client) run() {
 				heartbeat = time.After(c.heartbeatTTL)
 			}
 
+		case <-c.reregisterCh:
+			c.registerNode()
+
 		case <-c.shutdownCh:
 			return
 		}
@@ -526,7 +845,7 @@ func (c *Client) run() {
 
 // registerNode is used to register the node or update the registration
 func (c *Client) registerNode() error {
-	node := c.Node()
+	node := c.config.ReadNode()
 	req := structs.NodeRegisterRequest{
 		Node:         node,
 		WriteRequest: structs.WriteRequest{Region: c.config.Region},
@@ -712,6 +1031,9 @@ func (c *Client) updateAlloc(exist, update *structs.Allocation) error {
 func (c *Client) addAlloc(alloc *structs.Allocation) error {
 	c.allocLock.Lock()
 	defer c.allocLock.Unlock()
+	if c.draining {
+		return fmt.Errorf("client is draining")
+	}
 	ar := NewAllocRunner(c.logger, c.config, c.updateAllocStatus, alloc)
 	c.allocs[alloc.ID] = ar
 	go ar.Run()
@@ -88,6 +88,32 @@ func TestClient_StartStop(t *testing.T) {
 	}
 }
 
+func TestClient_InvalidTaskUpdateBufferSize(t *testing.T) {
+	conf := DefaultConfig()
+	conf.DevMode = true
+	conf.TaskUpdateBufferSize = -1
+	if _, err := NewClient(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestClient_InvalidLimits(t *testing.T) {
+	for _, f := range []func(*config.Config){
+		func(c *config.Config) { c.MaxPersistedTaskEvents = -1 },
+		func(c *config.Config) { c.MaxTaskStateSize = -1 },
+		func(c *config.Config) { c.OversubscriptionFactor = 0.5 },
+		func(c *config.Config) { c.MaxArtifactCacheSize = -1 },
+		func(c *config.Config) { c.StateSaveInterval = -time.Second },
+	} {
+		conf := DefaultConfig()
+		conf.DevMode = true
+		f(conf)
+		if _, err := NewClient(conf); err == nil {
+			t.Fatalf("expected error")
+		}
+	}
+}
+
 func TestClient_RPC(t *testing.T) {
 	s1, addr := testServer(t, nil)
 	defer s1.Shutdown()
@@ -447,3 +473,79 @@ func TestClient_SetServers(t *testing.T) {
 		t.Fatalf("expect %v, got %v", expect, servers)
 	}
 }
+
+// writeStateDir creates a state directory with a state file, last modified
+// age ago
+func writeStateDir(t *testing.T, dir string, age time.Duration) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(path, []byte("{}"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	modified := time.Now().Add(-age)
+	for _, p := range []string{path, dir} {
+		if err := os.Chtimes(p, modified, modified); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+}
+
+func TestClient_GCStateDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := DefaultConfig()
+	conf.StateDir = dir
+	conf.StateGCRetention = time.Hour
+	conf.StateGCDryRun = true
+	logger := testLogger()
+	ar := NewAllocRunner(logger, conf, nil, &structs.Allocation{ID: "known"})
+	ar.tasks["web"] = NewTaskRunner(logger, conf, nil, nil, "known", &structs.Task{Name: "web"})
+	c := &Client{
+		config: conf,
+		logger: logger,
+		allocs: map[string]*AllocRunner{"known": ar},
+	}
+
+	allocDir := filepath.Join(dir, "alloc")
+	kept := []string{
+		filepath.Join(allocDir, "known", taskStateDir("web")),
+		filepath.Join(allocDir, "fresh", taskStateDir("db")),
+	}
+	stale := []string{
+		filepath.Join(allocDir, "known", taskStateDir("gone")),
+		filepath.Join(allocDir, "stale"),
+	}
+	writeStateDir(t, kept[0], 48*time.Hour)
+	writeStateDir(t, kept[1], time.Minute)
+	writeStateDir(t, stale[0], 48*time.Hour)
+	writeStateDir(t, filepath.Join(stale[1], taskStateDir("web")), 48*time.Hour)
+
+	// A dry run removes nothing
+	c.gcStateDirs()
+	for _, path := range append(kept, stale...) {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("dry run removed %s: %v", path, err)
+		}
+	}
+
+	// Orphaned state is removed once past the retention period, while the
+	// state of known tasks and recent orphans is kept
+	conf.StateGCDryRun = false
+	c.gcStateDirs()
+	for _, path := range kept {
+		if _, err := os.Stat(path); err != nil {
+			t.Fatalf("removed %s: %v", path, err)
+		}
+	}
+	for _, path := range stale {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Fatalf("should remove %s: %v", path, err)
+		}
+	}
+}
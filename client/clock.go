@@ -0,0 +1,22 @@
+package client
+
+import (
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+// wallClock is the config.Clock of the real time
+type wallClock struct{}
+
+func (wallClock) Now() time.Time                         { return time.Now() }
+func (wallClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (wallClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// clockOf returns the clock of the config, defaulting to the wall clock
+func clockOf(cfg *config.Config) config.Clock {
+	if cfg.Clock == nil {
+		return wallClock{}
+	}
+	return cfg.Clock
+}
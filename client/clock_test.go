@@ -0,0 +1,110 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a config.Clock whose time only passes when advanced, firing
+// the waiters whose deadlines it reaches
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, &fakeWaiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	<-c.After(d)
+}
+
+// Advance moves the time forward by d, firing the waiters it reaches
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	var waiters []*fakeWaiter
+	for _, w := range c.waiters {
+		if w.deadline.After(c.now) {
+			waiters = append(waiters, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = waiters
+}
+
+// Waiters returns how many waiters have yet to fire
+func (c *fakeClock) Waiters() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.waiters)
+}
+
+func TestFakeClock(t *testing.T) {
+	c := newFakeClock()
+	start := c.Now()
+	short, long := c.After(time.Second), c.After(time.Minute)
+	if n := c.Waiters(); n != 2 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	c.Advance(time.Second)
+	select {
+	case now := <-short:
+		if now.Sub(start) != time.Second {
+			t.Fatalf("bad: %v", now)
+		}
+	default:
+		t.Fatalf("short waiter should have fired")
+	}
+	select {
+	case <-long:
+		t.Fatalf("long waiter should not have fired")
+	default:
+	}
+
+	c.Advance(time.Hour)
+	select {
+	case <-long:
+	default:
+		t.Fatalf("long waiter should have fired")
+	}
+	if n := c.Waiters(); n != 0 {
+		t.Fatalf("bad: %d", n)
+	}
+
+	// Waits that are already over fire at once
+	select {
+	case <-c.After(0):
+	default:
+		t.Fatalf("zero wait should have fired")
+	}
+}
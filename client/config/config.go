@@ -2,6 +2,8 @@ package config
 
 import (
 	"io"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -13,6 +15,231 @@ type RPCHandler interface {
 	RPC(method string, args interface{}, reply interface{}) error
 }
 
+// MetricsSink receives the metrics emitted by the client. The labels further
+// identify what the metric is about, such as the task and its driver.
+type MetricsSink interface {
+	// IncrCounter adds val to the counter with the given key
+	IncrCounter(key []string, val float32, labels map[string]string)
+
+	// SetGauge sets the gauge with the given key to val
+	SetGauge(key []string, val float32, labels map[string]string)
+}
+
+// CoreAllocator keeps track of the CPU cores the tasks of the client are
+// pinned to, so that no core is dedicated to two tasks.
+type CoreAllocator interface {
+	// Allocate returns n cores no task is pinned to, and claims them
+	Allocate(n int) ([]int, error)
+
+	// Reserve claims the given cores, failing if any of them is already
+	// claimed
+	Reserve(cores []int) error
+
+	// Release frees the given cores
+	Release(cores []int)
+}
+
+// PortAllocator keeps track of the host ports used by the tasks of the client
+// on each of its addresses.
+type PortAllocator interface {
+	// Allocate returns n ports on the IP that are neither claimed by a task
+	// nor bound on the host, and claims them
+	Allocate(ip string, n int) ([]int, error)
+
+	// Reserve claims the given ports on the IP, failing if any of them is
+	// already claimed
+	Reserve(ip string, ports []int) error
+
+	// Release frees the given ports on the IP
+	Release(ip string, ports []int)
+}
+
+// ResourceTracker keeps track of the CPU and memory claimed by the allocations
+// of the client, so that the node is not overcommitted.
+type ResourceTracker interface {
+	// TryClaim claims the resources for the allocation if they fit in what
+	// is left of the node and no allocation is waiting ahead of it.
+	// Otherwise it returns why not, without claiming anything.
+	TryClaim(allocID string, resources *structs.Resources) error
+
+	// Claim blocks until the resources of the allocation fit, in the order
+	// allocations started waiting, and claims them. It returns false,
+	// without claiming anything, if abortCh is closed first.
+	Claim(allocID string, resources *structs.Resources, abortCh <-chan struct{}) bool
+
+	// Restore claims the resources of an allocation that was already
+	// running, even if they don't fit
+	Restore(allocID string, resources *structs.Resources)
+
+	// Release frees the resources claimed for the allocation
+	Release(allocID string)
+}
+
+// ServiceRegistry registers the services of running tasks with a service
+// catalog, such as the local Consul agent.
+type ServiceRegistry interface {
+	// Register registers the service, replacing any registration with the
+	// same ID
+	Register(service *ServiceRegistration) error
+
+	// Deregister removes the service with the given ID
+	Deregister(id string) error
+}
+
+// KVStore reads the keys of a key/value store, such as the KV store of the
+// local Consul agent, for the templates of tasks.
+type KVStore interface {
+	// Get returns the value of the key, nil if it doesn't exist, and the
+	// index of the store it was read at. A non-zero waitIndex makes it block
+	// until the index moves past waitIndex or abortCh is closed, though it
+	// may return the same index after a while, as Consul does.
+	Get(key string, waitIndex uint64, abortCh <-chan struct{}) ([]byte, uint64, error)
+}
+
+// SecretProvider reads the secrets of tasks from a secret store, such as
+// Vault.
+type SecretProvider interface {
+	// Fetch returns the fields of the secret at the path and the duration of
+	// its lease, before the end of which it is fetched again to renew it. A
+	// zero lease never runs out.
+	Fetch(path string) (map[string]string, time.Duration, error)
+}
+
+// ServiceRegistration is a service of a task resolved to the address it is
+// reachable on.
+type ServiceRegistration struct {
+	ID      string
+	Name    string
+	Tags    []string
+	Address string
+	Port    int
+	Checks  []*structs.ServiceCheck
+}
+
+// DownloadLimiter bounds the number of artifact downloads of the client
+// running at once, across all of its tasks.
+type DownloadLimiter interface {
+	// TryAcquire takes a download slot if one is free, without blocking
+	TryAcquire() bool
+
+	// Acquire blocks until a download slot is free and takes it. It returns
+	// false, without taking a slot, if abortCh is closed first.
+	Acquire(abortCh <-chan struct{}) bool
+
+	// Release frees a download slot taken by TryAcquire or Acquire
+	Release()
+}
+
+// StartLimiter bounds the number of tasks of the client being started by
+// their drivers at once.
+type StartLimiter interface {
+	// TryAcquire takes a start slot if one is free, without blocking
+	TryAcquire() bool
+
+	// Acquire blocks until a start slot is free and takes it. It returns
+	// false, without taking a slot, if abortCh is closed first.
+	Acquire(abortCh <-chan struct{}) bool
+
+	// Release frees a start slot taken by TryAcquire or Acquire
+	Release()
+}
+
+// ResourceCeiling bounds the resources a task of a driver may request. A zero
+// value leaves that resource unbounded.
+type ResourceCeiling struct {
+	// CPU is the most MHz a task may request
+	CPU int
+
+	// MemoryMB is the most memory a task may request
+	MemoryMB int
+}
+
+// DownloadRateLimiter bounds the bandwidth of the artifact downloads of the
+// client, shared across all of its tasks.
+type DownloadRateLimiter interface {
+	// WaitN blocks until n more bytes may be downloaded. It returns false if
+	// abortCh is closed first.
+	WaitN(n int, abortCh <-chan struct{}) bool
+}
+
+// ArtifactCache keeps the artifacts downloaded by the tasks of the client by
+// their checksum, so an artifact fetched by many tasks is downloaded once.
+type ArtifactCache interface {
+	// Fetch returns the path of the file cached for the checksum and a func
+	// releasing it once it is no longer read. On a miss download is called
+	// to write the file to the path it is given. Concurrent fetches of a
+	// checksum share a single download. Closing abortCh stops waiting for
+	// the download of another fetch.
+	Fetch(checksum string, download func(path string) error, abortCh <-chan struct{}) (string, func(), error)
+}
+
+// Clock tells the time and waits for it to pass. The task runners keep time
+// for restart backoffs, kill timeouts and check grace periods with it, so
+// tests can advance a fake clock rather than wait for the wall clock.
+type Clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// After returns a channel the time is sent on once d has passed
+	After(d time.Duration) <-chan time.Time
+
+	// Sleep blocks until d has passed
+	Sleep(d time.Duration)
+}
+
+// TaskNotifier is told of the lifecycle transitions of tasks, such as to
+// deliver them to webhooks.
+type TaskNotifier interface {
+	// Notify queues the notification for delivery. It must not block.
+	Notify(n *TaskNotification)
+}
+
+const (
+	// TaskTransitionStarted is a task that was started or restarted
+	TaskTransitionStarted = "started"
+
+	// TaskTransitionHealthy is a task whose checks first passed
+	TaskTransitionHealthy = "healthy"
+
+	// TaskTransitionRestarting is a task about to be restarted
+	TaskTransitionRestarting = "restarting"
+
+	// TaskTransitionDead is a task that will not be run again
+	TaskTransitionDead = "dead"
+)
+
+// TaskNotification describes a lifecycle transition of a task. It is the
+// JSON body webhooks are sent.
+type TaskNotification struct {
+	AllocID    string
+	Task       string
+	Transition string
+
+	// Event is the task event the transition was recorded with
+	Event *structs.TaskEvent
+}
+
+// TaskWebhook is an HTTP endpoint notified of the lifecycle transitions of
+// tasks.
+type TaskWebhook struct {
+	// URL is the http or https URL the notifications are POSTed to
+	URL string
+
+	// Transitions are the TaskTransition constants the webhook is notified
+	// of. If empty, it is notified of all of them.
+	Transitions []string
+}
+
+const (
+	// StateFormatMsgpack stores the client state as msgpack. It is the
+	// default.
+	StateFormatMsgpack = "msgpack"
+
+	// StateFormatJSON stores the client state as JSON, which is easier to
+	// inspect by hand
+	StateFormatJSON = "json"
+)
+
 // Config is used to parameterize and configure the behavior of the client
 type Config struct {
 	// DevMode controls if we are in a development mode which
@@ -22,12 +249,36 @@ type Config struct {
 	// StateDir is where we store our state
 	StateDir string
 
+	// StateFormat is the encoding used for new state files, one of the
+	// StateFormat constants. Defaults to msgpack. State files written in
+	// any format can always be read back.
+	StateFormat string
+
+	// StateGCRetention is how long state left behind by allocations and
+	// tasks that no longer exist is kept before it is removed on startup.
+	// Zero removes it right away.
+	StateGCRetention time.Duration
+
+	// StateGCDryRun only logs the orphaned state that would be removed
+	StateGCDryRun bool
+
 	// AllocDir is where we store data for allocations
 	AllocDir string
 
 	// LogOutput is the destination for logs
 	LogOutput io.Writer
 
+	// TaskLogLevel is the minimum level of the logs of task runners, one of
+	// TRACE, DEBUG, INFO, WARN or ERR. If empty, every level is logged.
+	TaskLogLevel string
+
+	// TaskLogLevels overrides TaskLogLevel for tasks by name
+	TaskLogLevels map[string]string
+
+	// LogJSON writes the logs of task runners as JSON objects, carrying the
+	// alloc ID, task and driver as fields
+	LogJSON bool
+
 	// Region is the clients region
 	Region string
 
@@ -41,15 +292,225 @@ type Config struct {
 	// Node provides the base node
 	Node *structs.Node
 
+	// KillTimeout is the time a task is given to exit after being asked to
+	// stop, for tasks that do not specify their own.
+	KillTimeout time.Duration
+
+	// MaxKillTimeout is the upper bound on the kill timeout of any task,
+	// regardless of what the task requests. Zero means no bound.
+	MaxKillTimeout time.Duration
+
+	// VolumeWhitelist are the host directories tasks may mount volumes
+	// from, including anything below them. If empty, tasks may not mount
+	// host volumes.
+	VolumeWhitelist []string
+
+	// ResourceCeilings are the most resources a task may request, keyed by
+	// driver. Tasks requesting more are refused before they start, so a
+	// misconfigured job can't claim the whole node. Drivers without a
+	// ceiling are unbounded.
+	ResourceCeilings map[string]*ResourceCeiling
+
+	// ChrootEnv maps the host directories that make up the chroot of exec
+	// tasks to the paths they are mounted at within it. If nil, a default
+	// set of system directories is used.
+	ChrootEnv map[string]string
+
 	// Options provides arbitrary key-value configuration for nomad internals,
 	// like fingerprinters and drivers. The format is:
 	//
 	//	namespace.option = value
 	Options map[string]string
+
+	// TaskUpdateBufferSize is the number of updates buffered per task
+	// before pending ones are coalesced. Defaults to 8 and must not be
+	// negative.
+	TaskUpdateBufferSize int
+
+	// MetricsSink receives metrics about the lifecycle of tasks, if set
+	MetricsSink MetricsSink
+
+	// MinDynamicPort and MaxDynamicPort bound the ports handed out by the
+	// port allocator. They default to the range the scheduler assigns
+	// dynamic ports from.
+	MinDynamicPort int
+	MaxDynamicPort int
+
+	// PortAllocator tracks the host ports claimed by tasks. If nil, the
+	// client creates one for the dynamic port range.
+	PortAllocator PortAllocator
+
+	// CoreAllocator tracks the CPU cores tasks are pinned to. If nil, the
+	// client creates one for the CPUs of the host.
+	CoreAllocator CoreAllocator
+
+	// ResourceTracker admits allocations as long as the CPU and memory of
+	// the node allow, queueing the others. If nil, the client creates one
+	// for the fingerprinted resources of the node less the reserved ones.
+	ResourceTracker ResourceTracker
+
+	// ServiceRegistry registers the services of tasks. If nil, the client
+	// registers them with the Consul agent at the consul.address option.
+	ServiceRegistry ServiceRegistry
+
+	// KVStore is read by the templates of tasks. If nil, the client reads
+	// the KV store of the Consul agent at the consul.address option.
+	KVStore KVStore
+
+	// SecretProvider is read for the provider secrets of tasks. If nil,
+	// tasks with provider secrets fail to start.
+	SecretProvider SecretProvider
+
+	// MaxConcurrentDownloads is the number of artifacts the client
+	// downloads at once across all tasks, the others waiting for a slot.
+	// Defaults to 8 and must not be negative.
+	MaxConcurrentDownloads int
+
+	// DownloadLimiter gates the artifact downloads of tasks. If nil, the
+	// client creates one allowing MaxConcurrentDownloads at once.
+	DownloadLimiter DownloadLimiter
+
+	// MaxDownloadBandwidth is the bytes per second the client downloads
+	// artifacts at, shared across all tasks. Zero leaves the downloads
+	// unlimited, and it must not be negative.
+	MaxDownloadBandwidth int64
+
+	// DownloadRateLimiter bounds the bandwidth of the artifact downloads of
+	// tasks. If nil, the client creates one allowing MaxDownloadBandwidth
+	// if set.
+	DownloadRateLimiter DownloadRateLimiter
+
+	// MaxArtifactCacheSize is the size in bytes the artifacts kept in the
+	// cache of the client add up to once no task is fetching them, the
+	// least recently used being evicted first. Defaults to 1GB if zero, and
+	// it must not be negative.
+	MaxArtifactCacheSize int64
+
+	// ArtifactCache keeps the artifacts of tasks that have a checksum. If
+	// nil, the client creates one in the cache directory of the state dir
+	// holding up to MaxArtifactCacheSize, unless it has no state dir.
+	ArtifactCache ArtifactCache
+
+	// MaxPersistedTaskEvents is the number of the latest events of a task
+	// saved with its state, of those kept in memory. Zero saves every event
+	// kept in memory, and it must not be negative.
+	MaxPersistedTaskEvents int
+
+	// MaxTaskStateSize is the size in bytes the state saved for a task may
+	// grow to before its oldest events are left out. Defaults to 1MB if
+	// zero, and it must not be negative.
+	MaxTaskStateSize int
+
+	// StateSaveInterval is the least time between two saves of the state of
+	// a task, which is saved as its events are recorded. The events recorded
+	// in between are saved together once it has passed, while the exit of
+	// the task is saved at once. Zero saves each event at once, and it must
+	// not be negative.
+	StateSaveInterval time.Duration
+
+	// Oversubscribe lets the allocations of the client claim more CPU and
+	// memory than the node has, up to OversubscriptionFactor times its
+	// capacity, betting that they don't all use what they ask for at once.
+	// Tasks are then given an oom_score_adj and CPU shares by the priority
+	// of their job, so the lowest priority ones are the first killed and
+	// throttled under contention. A task setting its own oom_score_adj
+	// keeps it.
+	Oversubscribe bool
+
+	// OversubscriptionFactor is how many times its capacity an
+	// oversubscribed node may be claimed. Defaults to 1.5 if zero, and must
+	// not be below one otherwise.
+	OversubscriptionFactor float64
+
+	// MaxConcurrentStarts is the number of tasks the client starts at once,
+	// such as when restoring many allocations, the others waiting for a
+	// slot. Zero leaves the starts unlimited, and it must not be negative.
+	MaxConcurrentStarts int
+
+	// StartLimiter gates the starts of tasks. If nil, the client creates one
+	// allowing MaxConcurrentStarts at once if set.
+	StartLimiter StartLimiter
+
+	// DiskQuotaKill kills tasks whose local dir grows past their disk
+	// resources. Otherwise the breach is only recorded as an event.
+	DiskQuotaKill bool
+
+	// TaskWebhooks are notified of the lifecycle transitions of tasks.
+	// Deliveries are retried a few times before being dropped.
+	TaskWebhooks []*TaskWebhook
+
+	// TaskNotifier is told of the lifecycle transitions of tasks. If nil,
+	// the client creates one delivering them to the TaskWebhooks.
+	TaskNotifier TaskNotifier
+
+	// Clock keeps the time of the tasks. If nil, the wall clock is used.
+	Clock Clock
+
+	// reloadLock guards the fields Reload changes while the client runs,
+	// which are read through the accessors below once it has started
+	reloadLock sync.RWMutex
+}
+
+// Copy returns a shallow copy of the config. Unlike copying the struct it
+// doesn't copy the lock, under which the fields Reload changes are read.
+func (c *Config) Copy() *Config {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	return &Config{
+		DevMode:                c.DevMode,
+		StateDir:               c.StateDir,
+		StateFormat:            c.StateFormat,
+		StateGCRetention:       c.StateGCRetention,
+		StateGCDryRun:          c.StateGCDryRun,
+		AllocDir:               c.AllocDir,
+		LogOutput:              c.LogOutput,
+		TaskLogLevel:           c.TaskLogLevel,
+		TaskLogLevels:          c.TaskLogLevels,
+		LogJSON:                c.LogJSON,
+		Region:                 c.Region,
+		Servers:                c.Servers,
+		RPCHandler:             c.RPCHandler,
+		Node:                   c.Node,
+		KillTimeout:            c.KillTimeout,
+		MaxKillTimeout:         c.MaxKillTimeout,
+		VolumeWhitelist:        c.VolumeWhitelist,
+		ResourceCeilings:       c.ResourceCeilings,
+		ChrootEnv:              c.ChrootEnv,
+		Options:                c.Options,
+		TaskUpdateBufferSize:   c.TaskUpdateBufferSize,
+		MetricsSink:            c.MetricsSink,
+		MinDynamicPort:         c.MinDynamicPort,
+		MaxDynamicPort:         c.MaxDynamicPort,
+		PortAllocator:          c.PortAllocator,
+		CoreAllocator:          c.CoreAllocator,
+		ResourceTracker:        c.ResourceTracker,
+		ServiceRegistry:        c.ServiceRegistry,
+		KVStore:                c.KVStore,
+		SecretProvider:         c.SecretProvider,
+		MaxConcurrentDownloads: c.MaxConcurrentDownloads,
+		DownloadLimiter:        c.DownloadLimiter,
+		MaxDownloadBandwidth:   c.MaxDownloadBandwidth,
+		DownloadRateLimiter:    c.DownloadRateLimiter,
+		MaxArtifactCacheSize:   c.MaxArtifactCacheSize,
+		ArtifactCache:          c.ArtifactCache,
+		MaxPersistedTaskEvents: c.MaxPersistedTaskEvents,
+		MaxTaskStateSize:       c.MaxTaskStateSize,
+		StateSaveInterval:      c.StateSaveInterval,
+		Oversubscribe:          c.Oversubscribe,
+		OversubscriptionFactor: c.OversubscriptionFactor,
+		MaxConcurrentStarts:    c.MaxConcurrentStarts,
+		StartLimiter:           c.StartLimiter,
+		DiskQuotaKill:          c.DiskQuotaKill,
+		TaskWebhooks:           c.TaskWebhooks,
+		TaskNotifier:           c.TaskNotifier,
+		Clock:                  c.Clock,
+	}
 }
 
 // Read returns the specified configuration value or "".
 func (c *Config) Read(id string) string {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
 	val, ok := c.Options[id]
 	if !ok {
 		return ""
@@ -66,3 +527,59 @@ func (c *Config) ReadDefault(id string, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// ReadOptions returns a copy of the options
+func (c *Config) ReadOptions() map[string]string {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	options := make(map[string]string, len(c.Options))
+	for k, v := range c.Options {
+		options[k] = v
+	}
+	return options
+}
+
+// ReadTaskLogLevel returns the log level of the named task, which is empty
+// if every level is logged
+func (c *Config) ReadTaskLogLevel(task string) string {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	if level, ok := c.TaskLogLevels[task]; ok {
+		return level
+	}
+	return c.TaskLogLevel
+}
+
+// ReadNode returns a shallow copy of the node, whose reserved resources are
+// not changed by a reload meanwhile
+func (c *Config) ReadNode() *structs.Node {
+	c.reloadLock.RLock()
+	defer c.reloadLock.RUnlock()
+	if c.Node == nil {
+		return nil
+	}
+	node := *c.Node
+	return &node
+}
+
+// Reload sets the fields of the config that can be changed while the client
+// runs to those of the other config: the options, the task log levels and
+// the resources reserved on the node, unless the other config has no node.
+// The other fields are left as they are.
+func (c *Config) Reload(other *Config) {
+	c.reloadLock.Lock()
+	defer c.reloadLock.Unlock()
+	c.Options = other.ReadOptions()
+	c.TaskLogLevel = other.TaskLogLevel
+	c.TaskLogLevels = make(map[string]string, len(other.TaskLogLevels))
+	for task, level := range other.TaskLogLevels {
+		c.TaskLogLevels[task] = level
+	}
+	if c.Node != nil && other.Node != nil {
+		c.Node.Reserved = nil
+		if other.Node.Reserved != nil {
+			reserved := *other.Node.Reserved
+			c.Node.Reserved = &reserved
+		}
+	}
+}
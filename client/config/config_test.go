@@ -1,6 +1,11 @@
 package config
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
 
 func TestConfigRead(t *testing.T) {
 	config := Config{}
@@ -34,3 +39,88 @@ func TestConfigReadDefault(t *testing.T) {
 		t.Errorf("Expected %s, found %s", expected, actual)
 	}
 }
+
+func TestConfigReload(t *testing.T) {
+	config := &Config{
+		StateDir:     "/var/lib/nomad",
+		TaskLogLevel: "WARN",
+		Options:      map[string]string{"cake": "vanilla"},
+		Node:         &structs.Node{ID: "foo"},
+	}
+	other := &Config{
+		StateDir:      "/tmp",
+		TaskLogLevels: map[string]string{"web": "DEBUG"},
+		Options:       map[string]string{"cake": "chocolate"},
+		Node:          &structs.Node{Reserved: &structs.Resources{CPU: 100}},
+	}
+	config.Reload(other)
+
+	if config.Read("cake") != "chocolate" {
+		t.Errorf("Expected the options to be reloaded, found %v", config.Options)
+	}
+	if level := config.ReadTaskLogLevel("web"); level != "DEBUG" {
+		t.Errorf("Expected DEBUG, found %s", level)
+	}
+	if level := config.ReadTaskLogLevel("db"); level != "" {
+		t.Errorf("Expected no level, found %s", level)
+	}
+	if node := config.ReadNode(); node.ID != "foo" || node.Reserved.CPU != 100 {
+		t.Errorf("Expected the reservations to be reloaded, found %#v", node)
+	}
+	if config.StateDir != "/var/lib/nomad" {
+		t.Errorf("Expected the state dir to be kept, found %s", config.StateDir)
+	}
+
+	// Changing the other config afterwards doesn't change the reloaded one
+	other.Options["cake"] = "lemon"
+	other.Node.Reserved.CPU = 200
+	if config.Read("cake") != "chocolate" || config.ReadNode().Reserved.CPU != 100 {
+		t.Errorf("Expected the reloaded fields to be copied")
+	}
+}
+
+func TestConfigCopy(t *testing.T) {
+	// Every exported field that can be made non-zero is set, so a field
+	// added but left out of the copy is caught
+	config := &Config{}
+	v := reflect.ValueOf(config).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		if !field.CanSet() {
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Bool:
+			field.SetBool(true)
+		case reflect.String:
+			field.SetString("foo")
+		case reflect.Int, reflect.Int64:
+			field.SetInt(1)
+		case reflect.Float64:
+			field.SetFloat(1.5)
+		case reflect.Map:
+			field.Set(reflect.MakeMap(field.Type()))
+		case reflect.Slice:
+			field.Set(reflect.MakeSlice(field.Type(), 1, 1))
+		case reflect.Ptr:
+			field.Set(reflect.New(field.Type().Elem()))
+		}
+	}
+
+	copied := config.Copy()
+	c := reflect.ValueOf(copied).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if !v.Field(i).CanSet() {
+			continue
+		}
+		if !reflect.DeepEqual(v.Field(i).Interface(), c.Field(i).Interface()) {
+			t.Errorf("Expected %s to be copied, found %v", v.Type().Field(i).Name, c.Field(i).Interface())
+		}
+	}
+
+	// The copy is reloaded on its own
+	copied.Reload(&Config{Options: map[string]string{"cake": "chocolate"}})
+	if config.Read("cake") != "" || copied.Read("cake") != "chocolate" {
+		t.Errorf("Expected only the copy to be reloaded")
+	}
+}
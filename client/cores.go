@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+)
+
+// coreAllocator tracks the CPU cores the tasks of the client are pinned to.
+// Cores are handed out lowest first so tasks are packed onto the same cores
+// after others are released.
+type coreAllocator struct {
+	numCores int
+
+	claimed map[int]struct{}
+	lock    sync.Mutex
+}
+
+// newCoreAllocator returns an allocator handing out the cores 0 to n-1
+func newCoreAllocator(n int) *coreAllocator {
+	return &coreAllocator{
+		numCores: n,
+		claimed:  make(map[int]struct{}),
+	}
+}
+
+// Allocate returns the n lowest cores that are not claimed, and claims them
+func (a *coreAllocator) Allocate(n int) ([]int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	cores := make([]int, 0, n)
+	for core := 0; core < a.numCores && len(cores) < n; core++ {
+		if _, ok := a.claimed[core]; !ok {
+			cores = append(cores, core)
+		}
+	}
+	if len(cores) < n {
+		return nil, fmt.Errorf("only %d of %d cores available to pin the task to", len(cores), n)
+	}
+	a.claim(cores)
+	return cores, nil
+}
+
+// Reserve claims the given cores, failing without claiming any of them if one
+// is already claimed or does not exist
+func (a *coreAllocator) Reserve(cores []int) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, core := range cores {
+		if core < 0 || core >= a.numCores {
+			return fmt.Errorf("core %d does not exist", core)
+		}
+		if _, ok := a.claimed[core]; ok {
+			return fmt.Errorf("core %d is already claimed by another task", core)
+		}
+	}
+	a.claim(cores)
+	return nil
+}
+
+// Release frees the given cores
+func (a *coreAllocator) Release(cores []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, core := range cores {
+		delete(a.claimed, core)
+	}
+}
+
+// claim marks the cores as claimed. The lock must be held.
+func (a *coreAllocator) claim(cores []int) {
+	for _, core := range cores {
+		a.claimed[core] = struct{}{}
+	}
+}
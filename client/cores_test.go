@@ -0,0 +1,55 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+var _ config.CoreAllocator = &coreAllocator{}
+
+func TestCoreAllocator(t *testing.T) {
+	a := newCoreAllocator(4)
+
+	first, err := a.Allocate(2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(first, []int{0, 1}) {
+		t.Fatalf("bad: %v", first)
+	}
+
+	// Claimed cores are never handed out twice
+	if err := a.Reserve([]int{1}); err == nil || !strings.Contains(err.Error(), "already claimed") {
+		t.Fatalf("expected claimed error: %v", err)
+	}
+	if err := a.Reserve([]int{3}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := a.Allocate(2); err == nil || !strings.Contains(err.Error(), "only 1 of 2 cores") {
+		t.Fatalf("expected exhausted error: %v", err)
+	}
+	second, err := a.Allocate(1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(second, []int{2}) {
+		t.Fatalf("bad: %v", second)
+	}
+
+	// Released cores are handed out again, lowest first
+	a.Release(first)
+	third, err := a.Allocate(2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(third, []int{0, 1}) {
+		t.Fatalf("bad: %v", third)
+	}
+
+	if err := a.Reserve([]int{4}); err == nil || !strings.Contains(err.Error(), "does not exist") {
+		t.Fatalf("expected missing core error: %v", err)
+	}
+}
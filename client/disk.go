@@ -0,0 +1,115 @@
+package client
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// taskDiskQuotaInterval is how often the disk usage of the local dir of
+	// a running task is measured against its quota
+	taskDiskQuotaInterval = 30 * time.Second
+
+	// bytesPerMB converts the disk resources of tasks to bytes
+	bytesPerMB = 1024 * 1024
+)
+
+// dirUsage returns the number of bytes used by the files below dir. A dir
+// backed by its own filesystem, such as a loopback or quota-backed mount, is
+// measured by the filesystem where supported, and otherwise by walking it.
+func dirUsage(dir string) (int64, error) {
+	if used, ok := mountUsage(dir); ok {
+		return used, nil
+	}
+	return walkUsage(dir)
+}
+
+// walkUsage sums the size of the files below dir, ignoring those removed
+// while it is walked
+func walkUsage(dir string) (int64, error) {
+	var used int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			used += info.Size()
+		}
+		return nil
+	})
+	return used, err
+}
+
+// diskQuota returns the quota of the local dir of the task in bytes, or
+// zero if it has none
+func diskQuota(task *structs.Task) int64 {
+	if task.Resources == nil || task.Resources.DiskMB <= 0 {
+		return 0
+	}
+	return int64(task.Resources.DiskMB) * bytesPerMB
+}
+
+// watchDiskQuota measures the disk usage of the local dir of the task every
+// interval, until the task runner exits or is destroyed. A breach of the
+// quota is recorded once, until the usage falls back below the quota. If
+// the client kills tasks exceeding their quota, the usage is sent on the
+// returned channel, which is nil for a task without a quota.
+func (r *TaskRunner) watchDiskQuota() <-chan int64 {
+	quota := diskQuota(r.task)
+	if quota == 0 {
+		return nil
+	}
+
+	breachCh := make(chan int64, 1)
+	dir := r.ctx.AllocDir.LocalDir(r.task.Name)
+	go func() {
+		ticker := time.NewTicker(r.diskQuotaInterval)
+		defer ticker.Stop()
+		breached := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-r.waitCh:
+				return
+			case <-r.destroyCh:
+				return
+			}
+
+			used, err := dirUsage(dir)
+			if err != nil {
+				r.logger.Printf("[DEBUG] client: failed to measure disk usage of task '%s' for alloc '%s': %v",
+					r.task.Name, r.allocID, err)
+				continue
+			}
+			if used <= quota {
+				breached = false
+				continue
+			}
+			if breached {
+				continue
+			}
+			breached = true
+
+			msg := fmt.Sprintf("local dir uses %d MB, exceeding the disk quota of %d MB",
+				used/bytesPerMB, quota/bytesPerMB)
+			r.logger.Printf("[WARN] client: task '%s' for alloc '%s' %s",
+				r.task.Name, r.allocID, msg)
+			r.recordEvent(structs.NewTaskEvent(structs.TaskDiskQuotaExceeded).SetMessage(msg))
+			r.incrCounter("disk_quota_exceeded")
+			if r.config.DiskQuotaKill {
+				select {
+				case breachCh <- used:
+				default:
+				}
+			}
+		}
+	}()
+	return breachCh
+}
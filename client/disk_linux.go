@@ -0,0 +1,24 @@
+package client
+
+import (
+	"path/filepath"
+	"syscall"
+)
+
+// mountUsage returns the bytes used on the filesystem mounted at dir, if dir
+// is the root of its own filesystem
+func mountUsage(dir string) (int64, bool) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return 0, false
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil || st.Dev == parent.Dev {
+		return 0, false
+	}
+
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, false
+	}
+	return int64(fs.Blocks-fs.Bfree) * int64(fs.Bsize), true
+}
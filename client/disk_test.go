@@ -0,0 +1,38 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWalkUsage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := os.MkdirAll(filepath.Join(dir, "a", "b"), 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for path, size := range map[string]int{"one": 100, "a/two": 200, "a/b/three": 300} {
+		if err := ioutil.WriteFile(filepath.Join(dir, path), make([]byte, size), 0666); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+
+	used, err := walkUsage(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if used != 600 {
+		t.Fatalf("bad: %d", used)
+	}
+
+	// A dir that is not its own filesystem is walked
+	if used, err := dirUsage(dir); err != nil || used != 600 {
+		t.Fatalf("bad: %d %v", used, err)
+	}
+}
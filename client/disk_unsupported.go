@@ -0,0 +1,9 @@
+// +build !linux
+
+package client
+
+// mountUsage is only implemented on Linux, so other platforms always walk the
+// dir.
+func mountUsage(dir string) (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,46 @@
+package client
+
+// downloadLimiter is a semaphore bounding the artifact downloads of the
+// client running at once. Tasks waiting for a slot are not served in any
+// particular order.
+type downloadLimiter struct {
+	slots chan struct{}
+}
+
+// newDownloadLimiter returns a limiter allowing limit downloads at once
+func newDownloadLimiter(limit int) *downloadLimiter {
+	return &downloadLimiter{slots: make(chan struct{}, limit)}
+}
+
+func (l *downloadLimiter) TryAcquire() bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l *downloadLimiter) Acquire(abortCh <-chan struct{}) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-abortCh:
+		return false
+	}
+}
+
+func (l *downloadLimiter) Release() {
+	<-l.slots
+}
+
+// startLimiter is a semaphore bounding the tasks of the client being started
+// at once, which works like the download limiter
+type startLimiter struct {
+	downloadLimiter
+}
+
+// newStartLimiter returns a limiter allowing limit starts at once
+func newStartLimiter(limit int) *startLimiter {
+	return &startLimiter{*newDownloadLimiter(limit)}
+}
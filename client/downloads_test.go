@@ -0,0 +1,79 @@
+package client
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+var _ config.DownloadLimiter = &downloadLimiter{}
+var _ config.StartLimiter = &startLimiter{}
+
+func TestDownloadLimiter(t *testing.T) {
+	l := newDownloadLimiter(3)
+
+	// Run more downloads than the limit, tracking how many run at once
+	var lock sync.Mutex
+	var running, max int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if !l.Acquire(nil) {
+				t.Errorf("acquire aborted")
+				return
+			}
+			defer l.Release()
+
+			lock.Lock()
+			running++
+			if running > max {
+				max = running
+			}
+			lock.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			lock.Lock()
+			running--
+			lock.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if max != 3 {
+		t.Fatalf("bad: %d downloads ran at once", max)
+	}
+}
+
+func TestDownloadLimiter_Abort(t *testing.T) {
+	l := newDownloadLimiter(1)
+	if !l.TryAcquire() {
+		t.Fatalf("expected a free slot")
+	}
+	if l.TryAcquire() {
+		t.Fatalf("expected no free slot")
+	}
+
+	// A waiter gives up once aborted, without taking a slot
+	abortCh := make(chan struct{})
+	resultCh := make(chan bool)
+	go func() {
+		resultCh <- l.Acquire(abortCh)
+	}()
+	close(abortCh)
+	select {
+	case ok := <-resultCh:
+		if ok {
+			t.Fatalf("aborted acquire took a slot")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+
+	l.Release()
+	if !l.TryAcquire() {
+		t.Fatalf("expected a free slot after release")
+	}
+}
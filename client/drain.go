@@ -0,0 +1,59 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// nodeDrain is the reason the tasks are killed for when the node is drained
+var nodeDrain = KillReason{Kind: structs.TaskKillReasonNodeDrain, Message: "node is draining"}
+
+// Drain gracefully stops all the allocations of the client, as when the node
+// is drained for maintenance. The tasks of every allocation are stopped in
+// parallel, each given its shutdown delay and kill timeout, and Drain returns
+// once they all stopped or the context is done, with an error naming the
+// allocations still running. New allocations are rejected from the first
+// call on, so calling it again waits for the remaining ones.
+func (c *Client) Drain(ctx context.Context) error {
+	c.allocLock.Lock()
+	c.draining = true
+	runners := make([]*AllocRunner, 0, len(c.allocs))
+	for _, ar := range c.allocs {
+		runners = append(runners, ar)
+	}
+	c.allocLock.Unlock()
+
+	c.logger.Printf("[INFO] client: draining %d allocs", len(runners))
+	for _, ar := range runners {
+		ar.Kill(nodeDrain)
+	}
+
+	// Once the context is done the remaining allocs are only checked
+	var running []string
+	timedOut := false
+	for _, ar := range runners {
+		if !timedOut {
+			select {
+			case <-ar.WaitCh():
+				continue
+			case <-ctx.Done():
+				timedOut = true
+			}
+		}
+		select {
+		case <-ar.WaitCh():
+		default:
+			running = append(running, ar.Alloc().ID)
+		}
+	}
+	if len(running) != 0 {
+		sort.Strings(running)
+		return fmt.Errorf("%d allocs not stopped (%v): %s", len(running), ctx.Err(), strings.Join(running, ", "))
+	}
+	c.logger.Printf("[INFO] client: drained all allocs")
+	return nil
+}
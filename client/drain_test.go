@@ -0,0 +1,160 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// allocUpdateHandler accepts the status updates of allocs, so the runners of
+// a client without servers finish once their final status is synced. Any
+// other RPC fails as it would without servers.
+type allocUpdateHandler struct{}
+
+func (allocUpdateHandler) RPC(method string, args interface{}, reply interface{}) error {
+	if method == "Node.UpdateAlloc" {
+		return nil
+	}
+	return fmt.Errorf("no known servers")
+}
+
+// testDrainClient returns a client running an alloc of the mock driver per
+// task config, along with a function removing its dirs
+func testDrainClient(t *testing.T, configs ...map[string]string) (*Client, []*AllocRunner, func()) {
+	dir, err := ioutil.TempDir("", "nomad-drain")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	c := testClient(t, func(c *config.Config) {
+		c.StateDir = dir
+		c.AllocDir = dir
+		c.RPCHandler = allocUpdateHandler{}
+	})
+
+	var runners []*AllocRunner
+	for i, conf := range configs {
+		// Each alloc reserves its own port, as the mock ones all claim the
+		// same one
+		alloc := mock.Alloc()
+		task := alloc.Job.TaskGroups[0].Tasks[0]
+		alloc.TaskResources[task.Name].Networks[0].ReservedPorts = []int{5000 + i}
+		task.Driver = "mock_driver"
+		task.Config = conf
+		task.ShutdownDelay = 100 * time.Millisecond
+		task.KillTimeout = 10 * time.Second
+		if err := c.addAlloc(alloc); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		c.allocLock.RLock()
+		ar := c.allocs[alloc.ID]
+		c.allocLock.RUnlock()
+		startedAt(t, taskRunner(t, ar, task.Name))
+		runners = append(runners, ar)
+	}
+	return c, runners, func() {
+		c.Shutdown()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestClient_Drain(t *testing.T) {
+	conf := map[string]string{"run_for": "10s"}
+	c, runners, cleanup := testDrainClient(t, conf, conf, conf)
+	defer cleanup()
+
+	// The allocs are drained in parallel, so their shutdown delays overlap
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := c.Drain(ctx); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 250*time.Millisecond {
+		t.Fatalf("drain took %v; allocs not stopped in parallel", elapsed)
+	}
+
+	for _, ar := range runners {
+		select {
+		case <-ar.WaitCh():
+		default:
+			t.Fatalf("alloc '%s' not stopped", ar.Alloc().ID)
+		}
+		for name, tr := range ar.tasks {
+			events := tr.Events()
+			if last := events[len(events)-1]; last.Type != structs.TaskKilled ||
+				last.KillReason != structs.TaskKillReasonNodeDrain {
+				t.Fatalf("task '%s': bad: %#v", name, last)
+			}
+			var draining bool
+			for _, e := range events {
+				draining = draining || e.Type == structs.TaskDraining
+			}
+			if !draining {
+				t.Fatalf("task '%s' not given its shutdown delay: %#v", name, events)
+			}
+		}
+	}
+
+	// New allocs are rejected while draining
+	if err := c.addAlloc(mock.Alloc()); err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Fatalf("expected draining error: %v", err)
+	}
+
+	// Draining again is a no-op
+	if err := c.Drain(ctx); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestClient_Drain_Deadline(t *testing.T) {
+	c, runners, cleanup := testDrainClient(t,
+		map[string]string{"run_for": "10s"},
+		map[string]string{"run_for": "10s", "ignore_kill": "true"})
+	defer cleanup()
+
+	// The alloc ignoring the kill is still running at the deadline
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	err := c.Drain(ctx)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("drain waited %v past its deadline", elapsed)
+	}
+	stuck := runners[1].Alloc().ID
+	if err == nil || !strings.Contains(err.Error(), "1 allocs not stopped") ||
+		!strings.Contains(err.Error(), context.DeadlineExceeded.Error()) || !strings.Contains(err.Error(), stuck) {
+		t.Fatalf("expected deadline error naming '%s': %v", stuck, err)
+	}
+
+	select {
+	case <-runners[0].WaitCh():
+	default:
+		t.Fatalf("alloc '%s' not stopped", runners[0].Alloc().ID)
+	}
+}
+
+func TestClient_Drain_Canceled(t *testing.T) {
+	c, runners, cleanup := testDrainClient(t,
+		map[string]string{"run_for": "10s", "ignore_kill": "true"})
+	defer cleanup()
+
+	// Canceling the drain stops waiting for the allocs
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		cancel()
+	}()
+	err := c.Drain(ctx)
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) ||
+		!strings.Contains(err.Error(), runners[0].Alloc().ID) {
+		t.Fatalf("expected canceled error: %v", err)
+	}
+}
@@ -27,16 +27,16 @@ func ParseAndReplace(args string, env map[string]string) ([]string, error) {
 
 	replaced := make([]string, len(parsed))
 	for i, arg := range parsed {
-		replaced[i] = replaceEnv(arg, env)
+		replaced[i] = ReplaceEnv(arg, env)
 	}
 
 	return replaced, nil
 }
 
-// replaceEnv takes an arg and replaces all occurences of environment variables.
+// ReplaceEnv takes an arg and replaces all occurences of environment variables.
 // If the variable is found in the passed map it is replaced, otherwise the
 // original string is returned.
-func replaceEnv(arg string, env map[string]string) string {
+func ReplaceEnv(arg string, env map[string]string) string {
 	return envRe.ReplaceAllStringFunc(arg, func(arg string) string {
 		stripped := arg[1:]
 		if stripped[0] == '{' {
@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// FSIsolationNone is for drivers running tasks on the filesystem of the
+	// host
+	FSIsolationNone = "none"
+
+	// FSIsolationChroot is for drivers running tasks in a chroot of the
+	// task directory
+	FSIsolationChroot = "chroot"
+
+	// FSIsolationImage is for drivers running tasks in their own image,
+	// such as a container or a VM
+	FSIsolationImage = "image"
+)
+
+const (
+	// NetworkModeHost is for tasks sharing the network namespace of the
+	// host, binding their ports on it directly
+	NetworkModeHost = structs.NetworkModeHost
+
+	// NetworkModeBridge is for tasks in their own network, whose ports are
+	// mapped to those of the host
+	NetworkModeBridge = structs.NetworkModeBridge
+)
+
+// DriverCapabilities are the features a driver supports. They are checked
+// before a task is started and advertised as node attributes, so a task
+// asking for more than its driver supports fails early.
+type DriverCapabilities struct {
+	// Exec is whether commands can be run inside the tasks, as script
+	// checks do
+	Exec bool
+
+	// Signals is whether the tasks can be sent signals
+	Signals bool
+
+	// FSIsolation is how the filesystem of the tasks is isolated from the
+	// host, one of the FSIsolation constants
+	FSIsolation string
+
+	// NetworkModes are the NetworkMode constants the tasks can run in
+	NetworkModes []string
+}
+
+// SupportsNetworkMode returns whether the tasks can run in the network mode
+func (c *DriverCapabilities) SupportsNetworkMode(mode string) bool {
+	for _, m := range c.NetworkModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// NetworkMode returns the network mode the task asks for, or the default of
+// the driver, its first network mode, if it asks for none
+func (c *DriverCapabilities) NetworkMode(task *structs.Task) string {
+	if mode := requestedNetworkMode(task); mode != "" {
+		return mode
+	}
+	if len(c.NetworkModes) != 0 {
+		return c.NetworkModes[0]
+	}
+	return ""
+}
+
+// requestedNetworkMode returns the network mode set on the network of the
+// task, if any
+func requestedNetworkMode(task *structs.Task) string {
+	if task.Resources == nil || len(task.Resources.Networks) == 0 {
+		return ""
+	}
+	return task.Resources.Networks[0].Mode
+}
+
+// capabilityAttribute returns the node attribute advertising the named
+// capability of the driver
+func capabilityAttribute(driver, capability string) string {
+	return fmt.Sprintf("driver.%s.capabilities.%s", driver, capability)
+}
+
+// AdvertiseCapabilities sets the capabilities of the named driver as
+// attributes of the node, such as "driver.docker.capabilities.exec".
+func AdvertiseCapabilities(node *structs.Node, name string, caps *DriverCapabilities) {
+	modes := append([]string(nil), caps.NetworkModes...)
+	sort.Strings(modes)
+	node.Attributes[capabilityAttribute(name, "exec")] = strconv.FormatBool(caps.Exec)
+	node.Attributes[capabilityAttribute(name, "signals")] = strconv.FormatBool(caps.Signals)
+	node.Attributes[capabilityAttribute(name, "fs_isolation")] = caps.FSIsolation
+	node.Attributes[capabilityAttribute(name, "network_modes")] = strings.Join(modes, ",")
+}
+
+// fingerprintedCapabilities returns the capabilities of the named driver
+// advertised on the node. A driver that advertised none is taken to support
+// nothing.
+func fingerprintedCapabilities(node *structs.Node, name string) *DriverCapabilities {
+	caps := &DriverCapabilities{FSIsolation: FSIsolationNone}
+	if node == nil {
+		return caps
+	}
+	caps.Exec, _ = strconv.ParseBool(node.Attributes[capabilityAttribute(name, "exec")])
+	caps.Signals, _ = strconv.ParseBool(node.Attributes[capabilityAttribute(name, "signals")])
+	if fs := node.Attributes[capabilityAttribute(name, "fs_isolation")]; fs != "" {
+		caps.FSIsolation = fs
+	}
+	if modes := node.Attributes[capabilityAttribute(name, "network_modes")]; modes != "" {
+		caps.NetworkModes = strings.Split(modes, ",")
+	}
+	return caps
+}
+
+// CheckCapabilities returns an error if the task asks for a feature the
+// capabilities of the named driver lack.
+func CheckCapabilities(name string, caps *DriverCapabilities, task *structs.Task) error {
+	if len(task.Volumes) != 0 && caps.FSIsolation == FSIsolationNone {
+		return fmt.Errorf("driver '%s' can't mount volumes as it doesn't isolate the filesystem of tasks", name)
+	}
+	if !caps.Exec {
+		for _, check := range task.Checks {
+			if check.Type == structs.TaskCheckTypeScript {
+				return fmt.Errorf("driver '%s' can't run script check '%s' as it doesn't support exec", name, check.Name)
+			}
+		}
+	}
+	if mode := requestedNetworkMode(task); mode != "" && !caps.SupportsNetworkMode(mode) {
+		return fmt.Errorf("driver '%s' doesn't support network mode '%s'", name, mode)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package driver
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestCheckCapabilities(t *testing.T) {
+	driverCtx := testDriverContext("web")
+	docker := NewDockerDriver(driverCtx).Capabilities()
+	rawExec := NewRawExecDriver(driverCtx).Capabilities()
+	qemu := NewQemuDriver(driverCtx).Capabilities()
+
+	// Volumes need the filesystem of the task to be isolated
+	task := &structs.Task{
+		Name:    "web",
+		Volumes: []*structs.TaskVolume{{Source: "/srv/data", Destination: "/data"}},
+	}
+	if err := CheckCapabilities("docker", docker, task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := CheckCapabilities("raw_exec", rawExec, task)
+	if err == nil || !strings.Contains(err.Error(), "driver 'raw_exec' can't mount volumes") {
+		t.Fatalf("expected volumes to be refused: %v", err)
+	}
+
+	// Script checks need exec
+	task = &structs.Task{
+		Name:   "web",
+		Checks: []*structs.TaskCheck{{Name: "alive", Type: structs.TaskCheckTypeScript}},
+	}
+	for name, caps := range map[string]*DriverCapabilities{"docker": docker, "raw_exec": rawExec} {
+		if err := CheckCapabilities(name, caps, task); err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+	}
+	err = CheckCapabilities("qemu", qemu, task)
+	if err == nil || !strings.Contains(err.Error(), "script check 'alive'") {
+		t.Fatalf("expected script check to be refused: %v", err)
+	}
+	// The network mode must be one the driver supports
+	task = &structs.Task{
+		Name: "web",
+		Resources: &structs.Resources{
+			Networks: []*structs.NetworkResource{{Mode: NetworkModeHost}},
+		},
+	}
+	for name, caps := range map[string]*DriverCapabilities{"docker": docker, "raw_exec": rawExec} {
+		if err := CheckCapabilities(name, caps, task); err != nil {
+			t.Fatalf("%s: err: %v", name, err)
+		}
+	}
+	err = CheckCapabilities("qemu", qemu, task)
+	if err == nil || !strings.Contains(err.Error(), "doesn't support network mode 'host'") {
+		t.Fatalf("expected network mode to be refused: %v", err)
+	}
+}
+
+func TestDriverCapabilities_NetworkMode(t *testing.T) {
+	caps := &DriverCapabilities{NetworkModes: []string{NetworkModeBridge, NetworkModeHost}}
+	task := &structs.Task{Name: "web", Resources: &structs.Resources{}}
+	if mode := caps.NetworkMode(task); mode != NetworkModeBridge {
+		t.Fatalf("bad: %q", mode)
+	}
+	task.Resources.Networks = []*structs.NetworkResource{{Mode: NetworkModeHost}}
+	if mode := caps.NetworkMode(task); mode != NetworkModeHost {
+		t.Fatalf("bad: %q", mode)
+	}
+}
+
+func TestAdvertiseCapabilities(t *testing.T) {
+	node := &structs.Node{Attributes: make(map[string]string)}
+	caps := &DriverCapabilities{
+		Exec:         true,
+		FSIsolation:  FSIsolationImage,
+		NetworkModes: []string{NetworkModeHost, NetworkModeBridge},
+	}
+	AdvertiseCapabilities(node, "docker", caps)
+	if node.Attributes["driver.docker.capabilities.fs_isolation"] != "image" ||
+		node.Attributes["driver.docker.capabilities.network_modes"] != "bridge,host" {
+		t.Fatalf("bad: %v", node.Attributes)
+	}
+
+	// The advertised capabilities are read back, and a driver that
+	// advertised none supports nothing
+	exp := &DriverCapabilities{
+		Exec:         true,
+		FSIsolation:  FSIsolationImage,
+		NetworkModes: []string{NetworkModeBridge, NetworkModeHost},
+	}
+	if act := fingerprintedCapabilities(node, "docker"); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("got %#v; want %#v", act, exp)
+	}
+	if act := fingerprintedCapabilities(node, "lxc"); !reflect.DeepEqual(act, &DriverCapabilities{FSIsolation: FSIsolationNone}) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
@@ -0,0 +1,50 @@
+package driver
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// taskCores returns the number of cores a task pinned to dedicated cores
+// needs for its CPU resources: its MHz over the frequency of the cores of the
+// node, rounded up.
+func taskCores(node *structs.Node, resources *structs.Resources) (int, error) {
+	if resources == nil || resources.CPU <= 0 {
+		return 0, fmt.Errorf("task must request CPU to be pinned to cores")
+	}
+	if node == nil {
+		return 0, fmt.Errorf("CPU frequency of the node is unknown")
+	}
+	mhz, err := strconv.ParseFloat(node.Attributes["cpu.frequency"], 64)
+	if err != nil || mhz <= 0 {
+		return 0, fmt.Errorf("CPU frequency of the node is unknown")
+	}
+	return int(math.Ceil(float64(resources.CPU) / mhz)), nil
+}
+
+// formatCpuset formats the cores in the list format of the cpuset cgroup,
+// such as "0-2,5"
+func formatCpuset(cores []int) string {
+	sorted := append([]int(nil), cores...)
+	sort.Ints(sorted)
+
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] == sorted[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, strconv.Itoa(sorted[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
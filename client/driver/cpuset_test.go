@@ -0,0 +1,40 @@
+package driver
+
+import (
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestTaskCores(t *testing.T) {
+	node := &structs.Node{Attributes: map[string]string{"cpu.frequency": "2500.000000"}}
+	for cpu, exp := range map[int]int{1: 1, 2500: 1, 2501: 2, 10000: 4} {
+		n, err := taskCores(node, &structs.Resources{CPU: cpu})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if n != exp {
+			t.Fatalf("%d MHz: got %d cores; want %d", cpu, n, exp)
+		}
+	}
+
+	if _, err := taskCores(node, &structs.Resources{}); err == nil {
+		t.Fatalf("expected error without CPU")
+	}
+	if _, err := taskCores(&structs.Node{}, &structs.Resources{CPU: 100}); err == nil {
+		t.Fatalf("expected error without frequency")
+	}
+}
+
+func TestFormatCpuset(t *testing.T) {
+	for set, cores := range map[string][]int{
+		"0":       {0},
+		"0-2":     {2, 0, 1},
+		"0-2,5":   {0, 1, 2, 5},
+		"1,3,5-6": {1, 3, 5, 6},
+	} {
+		if act := formatCpuset(cores); act != set {
+			t.Fatalf("formatCpuset(%v) = %q; want %q", cores, act, set)
+		}
+	}
+}
@@ -1,22 +1,37 @@
 package driver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
 
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+// dockerNodeLabel is the label of the containers started by a client, set to
+// the ID of its node, so the ones it no longer references can be reaped
+const dockerNodeLabel = "com.hashicorp.nomad.node_id"
+
 type DockerDriver struct {
 	DriverContext
 }
 
+// dockerHandleVersion is the version of the encoding of docker handles
+const dockerHandleVersion = 1
+
 type dockerPID struct {
 	ImageID     string
 	ContainerID string
@@ -29,7 +44,7 @@ type dockerHandle struct {
 	cleanupImage     bool
 	imageID          string
 	containerID      string
-	waitCh           chan error
+	waitCh           chan *WaitResult
 	doneCh           chan struct{}
 }
 
@@ -71,6 +86,30 @@ func (d *DockerDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool
 	return true, nil
 }
 
+// Version returns the version of the docker daemon, which may have been
+// upgraded since the node was fingerprinted
+func (d *DockerDriver) Version() (string, error) {
+	dockerEndpoint := d.config.ReadDefault("docker.endpoint", "unix:///var/run/docker.sock")
+	client, err := docker.NewClient(dockerEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("Failed to connect to docker.endpoint (%s): %s", dockerEndpoint, err)
+	}
+	env, err := client.Version()
+	if err != nil {
+		return "", fmt.Errorf("Failed to read docker version: %s", err)
+	}
+	return env.Get("Version"), nil
+}
+
+func (d *DockerDriver) Capabilities() *DriverCapabilities {
+	return &DriverCapabilities{
+		Exec:         true,
+		Signals:      true,
+		FSIsolation:  FSIsolationImage,
+		NetworkModes: []string{NetworkModeBridge, NetworkModeHost},
+	}
+}
+
 // We have to call this when we create the container AND when we start it so
 // we'll make a function.
 func createHostConfig(task *structs.Task) *docker.HostConfig {
@@ -104,8 +143,81 @@ func createHostConfig(task *structs.Task) *docker.HostConfig {
 		// See:
 		//  - https://www.kernel.org/doc/Documentation/scheduler/sched-bwc.txt
 		//  - https://www.kernel.org/doc/Documentation/scheduler/sched-design-CFS.txt
-		CPUShares: int64(task.Resources.CPU),
+		CPUShares: int64(task.Resources.Shares()),
+
+		// Tasks with a higher score are killed first when the host runs out
+		// of memory
+		OomScoreAdj: task.Resources.OOMScoreAdj,
+	}
+}
+
+// createBinds parses the volumes of the task config into docker binds
+// (equivalent to -v on docker CLI). Volumes are comma separated in the form
+// host:container[:ro|rw]. Relative host paths are resolved against the task
+// directory.
+func createBinds(ctx *ExecContext, task *structs.Task) ([]string, error) {
+	volumes, err := parseBinds(task.Config["volumes"])
+	if err != nil {
+		return nil, err
+	}
+
+	var binds []string
+	for _, parts := range volumes {
+		if !filepath.IsAbs(parts[0]) {
+			taskDir, ok := ctx.AllocDir.TaskDirs[task.Name]
+			if !ok {
+				return nil, fmt.Errorf("task directory doesn't exist for task %v", task.Name)
+			}
+			parts[0] = filepath.Join(taskDir, parts[0])
+		}
+		binds = append(binds, strings.Join(parts, ":"))
+	}
+	return binds, nil
+}
+
+// allocDirBind mounts the shared alloc dir into the container, so the tasks of
+// the group can share files with each other.
+func allocDirBind(ctx *ExecContext) string {
+	return ctx.AllocDir.SharedDir + ":/" + allocdir.SharedAllocName
+}
+
+// parseBinds splits the volumes of the task config into their host path,
+// container path and optional mode
+func parseBinds(raw string) ([][]string, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+
+	var volumes [][]string
+	for _, volume := range strings.Split(raw, ",") {
+		volume = strings.TrimSpace(volume)
+		parts := strings.Split(volume, ":")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid volume '%s'", volume)
+		}
+		if !filepath.IsAbs(parts[1]) {
+			return nil, fmt.Errorf("invalid volume '%s': container path must be absolute", volume)
+		}
+		if len(parts) == 3 && parts[2] != "ro" && parts[2] != "rw" {
+			return nil, fmt.Errorf("invalid volume '%s': unknown mode '%s'", volume, parts[2])
+		}
+		volumes = append(volumes, parts)
+	}
+	return volumes, nil
+}
+
+// volumeBinds converts the host volumes of the task into docker binds
+func volumeBinds(volumes []*structs.TaskVolume) []string {
+	var binds []string
+	for _, v := range volumes {
+		bind := v.Source + ":" + v.Destination
+		if v.ReadOnly {
+			bind += ":ro"
+		}
+		binds = append(binds, bind)
 	}
+	return binds
 }
 
 // createContainer initializes a struct needed to call docker.client.CreateContainer()
@@ -118,9 +230,20 @@ func createContainer(ctx *ExecContext, task *structs.Task, logger *log.Logger) d
 	logger.Printf("[DEBUG] driver.docker: using %d bytes memory for %s", hostConfig.Memory, task.Config["image"])
 	logger.Printf("[DEBUG] driver.docker: using %d cpu shares for %s", hostConfig.CPUShares, task.Config["image"])
 
+	// Tasks in host mode share the network of the host (equivalent to
+	// --net=host on docker CLI), binding their ports on it directly so
+	// there is nothing to map
+	mode := ctx.TaskNetworkMode(task.Name)
+	if mode == "" {
+		mode = requestedNetworkMode(task)
+	}
+
 	// Setup port mapping (equivalent to -p on docker CLI). Ports must already be
 	// exposed in the container.
-	if len(task.Resources.Networks) == 0 {
+	if mode == NetworkModeHost {
+		hostConfig.NetworkMode = "host"
+		logger.Printf("[DEBUG] driver.docker: using host network for %s", task.Config["image"])
+	} else if len(task.Resources.Networks) == 0 {
 		logger.Print("[WARN] driver.docker: No networks are available for port mapping")
 	} else {
 		network := task.Resources.Networks[0]
@@ -132,7 +255,7 @@ func createContainer(ctx *ExecContext, task *structs.Task, logger *log.Logger) d
 			logger.Printf("[DEBUG] driver.docker: allocated port %s:%d -> %d (static) %s\n", network.IP, port, port)
 		}
 
-		for label, port := range network.MapDynamicPorts() {
+		for label, port := range taskPortMap(ctx, task, network) {
 			// If the label is numeric we expect that there is a service
 			// listening on that port inside the container. In this case we'll
 			// setup a mapping from our random host port to the label port.
@@ -153,8 +276,11 @@ func createContainer(ctx *ExecContext, task *structs.Task, logger *log.Logger) d
 		hostConfig.PortBindings = dockerPorts
 	}
 
+	// The alloc dir is at its path within the container
+	env := TaskEnvironmentVariables(ctx, task)
+	env.SetAllocDir("/" + allocdir.SharedAllocName)
 	config := &docker.Config{
-		Env:   TaskEnvironmentVariables(ctx, task).List(),
+		Env:   env.List(),
 		Image: task.Config["image"],
 	}
 
@@ -169,21 +295,34 @@ func createContainer(ctx *ExecContext, task *structs.Task, logger *log.Logger) d
 	}
 }
 
-func (d *DockerDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
-	// Get the image from config
-	image, ok := task.Config["image"]
-	if !ok || image == "" {
-		return nil, fmt.Errorf("Image not specified")
+// Validate checks that the task has an image, memory and CPU limits and well
+// formed volumes
+func (d *DockerDriver) Validate(task *structs.Task) error {
+	var mErr multierror.Error
+	if task.Config["image"] == "" {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Image not specified: set 'image' in the task config"))
 	}
 	if task.Resources == nil {
-		return nil, fmt.Errorf("Resources are not specified")
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Resources are not specified"))
+	} else {
+		if task.Resources.MemoryMB == 0 {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Memory limit cannot be zero"))
+		}
+		if task.Resources.CPU == 0 {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("CPU limit cannot be zero"))
+		}
 	}
-	if task.Resources.MemoryMB == 0 {
-		return nil, fmt.Errorf("Memory limit cannot be zero")
+	if _, err := parseBinds(task.Config["volumes"]); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
 	}
-	if task.Resources.CPU == 0 {
-		return nil, fmt.Errorf("CPU limit cannot be zero")
+	return mErr.ErrorOrNil()
+}
+
+func (d *DockerDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
 	}
+	image := task.Config["image"]
 
 	cleanupContainer, err := strconv.ParseBool(d.config.ReadDefault("docker.cleanup.container", "true"))
 	if err != nil {
@@ -216,15 +355,20 @@ func (d *DockerDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle
 		dockerImage, err = client.InspectImage(image)
 	}
 
-	// Download the image
+	// Download the image. The pull, which may take long for large images,
+	// is aborted if the start is cancelled.
 	if dockerImage == nil {
 		pullOptions := docker.PullImageOptions{
 			Repository: repo,
 			Tag:        tag,
+			Context:    ctx,
 		}
 		// TODO add auth configuration for private repos
 		authOptions := docker.AuthConfiguration{}
 		err = client.PullImage(pullOptions, authOptions)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		if err != nil {
 			d.logger.Printf("[ERR] driver.docker: pulling container %s", err)
 			return nil, fmt.Errorf("Failed to pull `%s`: %s", image, err)
@@ -241,8 +385,30 @@ func (d *DockerDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle
 	d.logger.Printf("[DEBUG] driver.docker: using image %s", dockerImage.ID)
 	d.logger.Printf("[INFO] driver.docker: identified image %s as %s", image, dockerImage.ID)
 
+	binds, err := createBinds(execCtx, task)
+	if err != nil {
+		return nil, err
+	}
+	volumes, err := d.taskVolumes(task)
+	if err != nil {
+		return nil, err
+	}
+	binds = append([]string{allocDirBind(execCtx)}, binds...)
+	binds = append(binds, volumeBinds(volumes)...)
+
 	// Create a container
-	container, err := client.CreateContainer(createContainer(ctx, task, d.logger))
+	containerOpts := createContainer(execCtx, task, d.logger)
+	containerOpts.HostConfig.Binds = binds
+	containerOpts.Config.Labels = containerLabels(d.node)
+	containerOpts.Context = ctx
+	container, err := client.CreateContainer(containerOpts)
+	if ctx.Err() != nil {
+		// The container is removed as no handle will reference it
+		if err == nil {
+			client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true, RemoveVolumes: true})
+		}
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		d.logger.Printf("[ERR] driver.docker: %s", err)
 		return nil, fmt.Errorf("Failed to create container from image %s", image)
@@ -250,7 +416,14 @@ func (d *DockerDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle
 	d.logger.Printf("[INFO] driver.docker: created container %s", container.ID)
 
 	// Start the container
-	err = client.StartContainer(container.ID, createHostConfig(task))
+	hostConfig := createHostConfig(task)
+	hostConfig.Binds = binds
+	hostConfig.NetworkMode = containerOpts.HostConfig.NetworkMode
+	err = client.StartContainerWithContext(container.ID, hostConfig, ctx)
+	if ctx.Err() != nil {
+		client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true, RemoveVolumes: true})
+		return nil, ctx.Err()
+	}
 	if err != nil {
 		d.logger.Printf("[ERR] driver.docker: starting container %s", container.ID)
 		return nil, fmt.Errorf("Failed to start container %s", container.ID)
@@ -266,13 +439,13 @@ func (d *DockerDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle
 		imageID:          dockerImage.ID,
 		containerID:      container.ID,
 		doneCh:           make(chan struct{}),
-		waitCh:           make(chan error, 1),
+		waitCh:           make(chan *WaitResult, 1),
 	}
 	go h.run()
 	return h, nil
 }
 
-func (d *DockerDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+func (d *DockerDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
 	cleanupContainer, err := strconv.ParseBool(d.config.ReadDefault("docker.cleanup.container", "true"))
 	if err != nil {
 		return nil, fmt.Errorf("Unable to parse docker.cleanup.container: %s", err)
@@ -283,11 +456,9 @@ func (d *DockerDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, er
 	}
 
 	// Split the handle
-	pidBytes := []byte(strings.TrimPrefix(handleID, "DOCKER:"))
-	pid := &dockerPID{}
-	err = json.Unmarshal(pidBytes, pid)
+	pid, err := parseDockerHandleID(handleID)
 	if err != nil {
-		return nil, fmt.Errorf("Failed to parse handle '%s': %v", handleID, err)
+		return nil, err
 	}
 	d.logger.Printf("[INFO] driver.docker: re-attaching to docker process: %s", handleID)
 
@@ -303,6 +474,7 @@ func (d *DockerDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, er
 		Filters: map[string][]string{
 			"id": []string{pid.ContainerID},
 		},
+		Context: ctx,
 	})
 	if err != nil {
 		return nil, fmt.Errorf("Failed to query for container %s: %v", pid.ContainerID, err)
@@ -315,7 +487,7 @@ func (d *DockerDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, er
 		}
 	}
 	if !found {
-		return nil, fmt.Errorf("Failed to find container %s: %v", pid.ContainerID, err)
+		return nil, &TaskLostError{Reason: fmt.Sprintf("container %s is not running", pid.ContainerID)}
 	}
 
 	// Return a driver handle
@@ -327,12 +499,88 @@ func (d *DockerDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, er
 		imageID:          pid.ImageID,
 		containerID:      pid.ContainerID,
 		doneCh:           make(chan struct{}),
-		waitCh:           make(chan error, 1),
+		waitCh:           make(chan *WaitResult, 1),
 	}
 	go h.run()
 	return h, nil
 }
 
+// Cleanup removes the containers labeled with the node of the client that
+// none of the handles reference, along with their volumes
+func (d *DockerDriver) Cleanup(activeHandleIDs []string) error {
+	labels := containerLabels(d.node)
+	if labels == nil {
+		return nil
+	}
+
+	dockerEndpoint := d.config.ReadDefault("docker.endpoint", "unix:///var/run/docker.sock")
+	client, err := docker.NewClient(dockerEndpoint)
+	if err != nil {
+		return fmt.Errorf("Failed to connect to docker.endpoint (%s): %s", dockerEndpoint, err)
+	}
+	containers, err := client.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"label": []string{dockerNodeLabel + "=" + labels[dockerNodeLabel]},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Failed to list containers: %v", err)
+	}
+
+	orphans, err := orphanedContainers(containers, labels[dockerNodeLabel], activeHandleIDs)
+	if err != nil {
+		return fmt.Errorf("Not removing orphaned containers: %v", err)
+	}
+	var mErr multierror.Error
+	for _, id := range orphans {
+		d.logger.Printf("[INFO] driver.docker: removing orphaned container %s", id)
+		err := client.RemoveContainer(docker.RemoveContainerOptions{ID: id, Force: true, RemoveVolumes: true})
+		if err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Failed to remove container %s: %v", id, err))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// containerLabels returns the labels identifying the containers started on
+// the node, or nil if the node is unknown
+func containerLabels(node *structs.Node) map[string]string {
+	if node == nil || node.ID == "" {
+		return nil
+	}
+	return map[string]string{dockerNodeLabel: node.ID}
+}
+
+// orphanedContainers returns the IDs of the containers labeled with the node
+// that none of the handles reference. The handles of other drivers reference
+// no container, while a docker handle that can't be parsed, such as one of a
+// newer version, may reference any of them, so none is an orphan then.
+func orphanedContainers(containers []docker.APIContainers, nodeID string, activeHandleIDs []string) ([]string, error) {
+	active := make(map[string]struct{}, len(activeHandleIDs))
+	for _, handleID := range activeHandleIDs {
+		if !strings.HasPrefix(handleID, "docker:") && !strings.HasPrefix(handleID, "DOCKER:") {
+			continue
+		}
+		pid, err := parseDockerHandleID(handleID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to tell the container of a handle: %v", err)
+		}
+		active[pid.ContainerID] = struct{}{}
+	}
+
+	var orphans []string
+	for _, container := range containers {
+		if container.Labels[dockerNodeLabel] != nodeID {
+			continue
+		}
+		if _, ok := active[container.ID]; !ok {
+			orphans = append(orphans, container.ID)
+		}
+	}
+	return orphans, nil
+}
+
 func (h *dockerHandle) ID() string {
 	// Return a handle to the PID
 	pid := dockerPID{
@@ -343,10 +591,23 @@ func (h *dockerHandle) ID() string {
 	if err != nil {
 		h.logger.Printf("[ERR] driver.docker: failed to marshal docker PID to JSON: %s", err)
 	}
-	return fmt.Sprintf("DOCKER:%s", string(data))
+	return formatHandleID("docker", dockerHandleVersion, string(data))
+}
+
+// parseDockerHandleID returns the container of the handle ID
+func parseDockerHandleID(handleID string) (*dockerPID, error) {
+	handle, _, err := parseHandleID(handleID, "docker", "DOCKER:", dockerHandleVersion)
+	if err != nil {
+		return nil, err
+	}
+	pid := &dockerPID{}
+	if err := json.Unmarshal([]byte(handle), pid); err != nil {
+		return nil, fmt.Errorf("Failed to parse handle '%s': %v", handleID, err)
+	}
+	return pid, nil
 }
 
-func (h *dockerHandle) WaitCh() chan error {
+func (h *dockerHandle) WaitCh() chan *WaitResult {
 	return h.waitCh
 }
 
@@ -364,10 +625,26 @@ func (h *dockerHandle) Kill() error {
 		return fmt.Errorf("Failed to stop container %s: %s", h.containerID, err)
 	}
 	log.Printf("[INFO] driver.docker: stopped container %s", h.containerID)
+	return h.cleanup()
+}
+
+// ForceKill is used to terminate the task immediately. This uses docker kill
+func (h *dockerHandle) ForceKill() error {
+	err := h.client.KillContainer(docker.KillContainerOptions{ID: h.containerID})
+	if err != nil {
+		log.Printf("[ERR] driver.docker: failed killing container %s", h.containerID)
+		return fmt.Errorf("Failed to kill container %s: %s", h.containerID, err)
+	}
+	log.Printf("[INFO] driver.docker: killed container %s", h.containerID)
+	return h.cleanup()
+}
 
+// cleanup removes the container and image once the container has stopped,
+// if configured to do so
+func (h *dockerHandle) cleanup() error {
 	// Cleanup container
 	if h.cleanupContainer {
-		err = h.client.RemoveContainer(docker.RemoveContainerOptions{
+		err := h.client.RemoveContainer(docker.RemoveContainerOptions{
 			ID:            h.containerID,
 			RemoveVolumes: true,
 		})
@@ -381,7 +658,7 @@ func (h *dockerHandle) Kill() error {
 	// Cleanup image. This operation may fail if the image is in use by another
 	// job. That is OK. Will we log a message but continue.
 	if h.cleanupImage {
-		err = h.client.RemoveImage(h.imageID)
+		err := h.client.RemoveImage(h.imageID)
 		if err != nil {
 			containers, err := h.client.ListContainers(docker.ListContainersOptions{
 				All: true,
@@ -405,6 +682,59 @@ func (h *dockerHandle) Kill() error {
 	return nil
 }
 
+func (h *dockerHandle) Stats() (*TaskResourceUsage, error) {
+	return nil, &NotSupportedError{Driver: "docker", Operation: "stats"}
+}
+
+func (h *dockerHandle) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return h.client.KillContainer(docker.KillContainerOptions{
+		ID:     h.containerID,
+		Signal: docker.Signal(s),
+	})
+}
+
+// Exec runs the command in the container. Docker has no API to kill an exec'd
+// process, so a command outliving the timeout is left running until it exits
+// or the container stops.
+func (h *dockerHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	exec, err := h.client.CreateExec(docker.CreateExecOptions{
+		Container:    h.containerID,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create exec: %v", err)
+	}
+
+	var out bytes.Buffer
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- h.client.StartExec(exec.ID, docker.StartExecOptions{
+			OutputStream: &out,
+			ErrorStream:  &out,
+		})
+	}()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to start exec: %v", err)
+		}
+	case <-time.After(timeout):
+		return nil, -1, fmt.Errorf("command timed out after %v", timeout)
+	}
+
+	inspect, err := h.client.InspectExec(exec.ID)
+	if err != nil {
+		return out.Bytes(), -1, fmt.Errorf("failed to inspect exec: %v", err)
+	}
+	return out.Bytes(), inspect.ExitCode, nil
+}
+
 func (h *dockerHandle) run() {
 	// Wait for it...
 	exitCode, err := h.client.WaitContainer(h.containerID)
@@ -412,13 +742,16 @@ func (h *dockerHandle) run() {
 		h.logger.Printf("[ERR] driver.docker: unable to wait for %s; container already terminated", h.containerID)
 	}
 
-	if exitCode != 0 {
-		err = fmt.Errorf("Docker container exited with non-zero exit code: %d", exitCode)
+	// A container killed for running out of memory exits like one sent
+	// SIGKILL, so ask docker which it was
+	result := NewWaitResult(exitCode, 0, err)
+	if err == nil {
+		if container, err := h.client.InspectContainer(h.containerID); err == nil {
+			result.OOMKilled = container.State.OOMKilled
+		}
 	}
 
 	close(h.doneCh)
-	if err != nil {
-		h.waitCh <- err
-	}
+	h.waitCh <- result
 	close(h.waitCh)
 }
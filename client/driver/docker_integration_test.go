@@ -0,0 +1,178 @@
+//go:build docker_integration
+// +build docker_integration
+
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// These tests exercise a real local docker daemon. Run them with
+//
+//	go test -tags docker_integration ./client/driver
+
+func TestDockerDriver_Integration_ExitCode(t *testing.T) {
+	task := &structs.Task{
+		Name: "exit",
+		Config: map[string]string{
+			"image":   "busybox",
+			"command": "false",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewDockerDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.ExitCode != 1 {
+			t.Fatalf("expected exit code 1: %v", res)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestDockerDriver_Integration_Volumes(t *testing.T) {
+	task := &structs.Task{
+		Name: "volumes",
+		Config: map[string]string{
+			"image":   "busybox",
+			"command": "touch /data/written",
+			"volumes": "data:/data",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewDockerDriver(driverCtx)
+
+	dataDir := filepath.Join(ctx.AllocDir.TaskDirs[task.Name], "data")
+	if err := os.MkdirAll(dataDir, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 || files[0].Name() != "written" {
+		t.Fatalf("volume was not bound: %v", files)
+	}
+}
+
+func TestDockerDriver_Integration_Reattach(t *testing.T) {
+	task := &structs.Task{
+		Name: "reattach",
+		Config: map[string]string{
+			"image":   "busybox",
+			"command": "sleep 30",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewDockerDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Re-open the container as a restarted client would and kill it
+	// through the new handle
+	handle2, err := d.Open(context.Background(), ctx, handle.ID())
+	if err != nil {
+		handle.Kill()
+		t.Fatalf("err: %v", err)
+	}
+	if err := handle2.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case <-handle2.WaitCh():
+	case <-time.After(30 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The container has been removed
+	if _, err := d.Open(context.Background(), ctx, handle.ID()); err == nil {
+		t.Fatalf("container should have been removed")
+	}
+}
+
+func TestDockerDriver_Integration_Cleanup(t *testing.T) {
+	task := &structs.Task{
+		Name: "cleanup",
+		Config: map[string]string{
+			"image":   "busybox",
+			"command": "sleep 30",
+		},
+		Resources: basicResources,
+	}
+
+	// A node of its own keeps the containers of other tests out of reach
+	cfg := testConfig()
+	driverCtx := NewDriverContext(task.Name, cfg, &structs.Node{ID: structs.GenerateUUID()}, testLogger())
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewDockerDriver(driverCtx)
+
+	active, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer active.Kill()
+	orphan, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The container no handle references is removed, the other one is left
+	if err := d.Cleanup([]string{active.ID()}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := d.Open(context.Background(), ctx, orphan.ID()); err == nil {
+		t.Fatalf("orphaned container should have been removed")
+	}
+	if _, err := d.Open(context.Background(), ctx, active.ID()); err != nil {
+		t.Fatalf("active container removed: %v", err)
+	}
+}
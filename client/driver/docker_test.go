@@ -1,10 +1,17 @@
 package driver
 
 import (
+	"context"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	docker "github.com/fsouza/go-dockerclient"
+
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -21,16 +28,206 @@ func TestDockerDriver_Handle(t *testing.T) {
 		imageID:     "imageid",
 		containerID: "containerid",
 		doneCh:      make(chan struct{}),
-		waitCh:      make(chan error, 1),
+		waitCh:      make(chan *WaitResult, 1),
 	}
 
 	actual := h.ID()
-	expected := `DOCKER:{"ImageID":"imageid","ContainerID":"containerid"}`
+	expected := `docker:v1:{"ImageID":"imageid","ContainerID":"containerid"}`
 	if actual != expected {
 		t.Errorf("Expected `%s`, found `%s`", expected, actual)
 	}
 }
 
+func TestDockerDriver_Validate(t *testing.T) {
+	d := NewDockerDriver(testDriverContext("web"))
+	task := &structs.Task{
+		Name: "web",
+		Config: map[string]string{
+			"image":   "redis",
+			"volumes": "/etc/ssl:/etc/ssl:ro",
+		},
+		Resources: basicResources,
+	}
+	if err := d.Validate(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Every problem with the task is reported
+	task.Config = map[string]string{"volumes": "/foo:bar"}
+	task.Resources = &structs.Resources{}
+	err := d.Validate(task)
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+	for _, msg := range []string{"Image not specified", "Memory limit cannot be zero", "CPU limit cannot be zero", "container path must be absolute"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Fatalf("missing %q: %v", msg, err)
+		}
+	}
+
+	task.Resources = nil
+	if err := d.Validate(task); err == nil || !strings.Contains(err.Error(), "Resources are not specified") {
+		t.Fatalf("expected missing resources: %v", err)
+	}
+}
+
+func TestDockerDriver_AllocDir(t *testing.T) {
+	task := &structs.Task{
+		Name:      "web",
+		Config:    map[string]string{"image": "redis"},
+		Resources: basicResources,
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+
+	// The shared alloc dir is mounted into the container, with the
+	// environment pointing at it
+	if bind, exp := allocDirBind(ctx), ctx.AllocDir.SharedDir+":/alloc"; bind != exp {
+		t.Fatalf("got %q; want %q", bind, exp)
+	}
+	opts := createContainer(ctx, task, testLogger())
+	var found bool
+	for _, kv := range opts.Config.Env {
+		found = found || kv == "NOMAD_ALLOC_DIR=/"+allocdir.SharedAllocName
+	}
+	if !found {
+		t.Fatalf("alloc dir not in environment: %v", opts.Config.Env)
+	}
+}
+
+func TestDockerDriver_NetworkMode(t *testing.T) {
+	task := &structs.Task{
+		Name:   "web",
+		Config: map[string]string{"image": "redis"},
+		Resources: &structs.Resources{
+			MemoryMB: 256,
+			CPU:      512,
+			Networks: []*structs.NetworkResource{
+				&structs.NetworkResource{
+					IP:            "127.0.0.1",
+					ReservedPorts: []int{8080},
+					DynamicPorts:  []string{"http"},
+				},
+			},
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	ctx.SetTaskPorts(task.Name, map[string]int{"http": 23456})
+
+	// Bridged tasks publish their ports on the host
+	ctx.SetTaskNetworkMode(task.Name, NetworkModeBridge)
+	opts := createContainer(ctx, task, testLogger())
+	if opts.HostConfig.NetworkMode != "" {
+		t.Fatalf("bad network mode: %q", opts.HostConfig.NetworkMode)
+	}
+	for _, port := range []docker.Port{"8080/tcp", "23456/tcp"} {
+		if _, ok := opts.HostConfig.PortBindings[port]; !ok {
+			t.Fatalf("port %s not published: %v", port, opts.HostConfig.PortBindings)
+		}
+	}
+
+	// Tasks on the host network bind their ports directly
+	ctx.SetTaskNetworkMode(task.Name, NetworkModeHost)
+	opts = createContainer(ctx, task, testLogger())
+	if opts.HostConfig.NetworkMode != "host" {
+		t.Fatalf("bad network mode: %q", opts.HostConfig.NetworkMode)
+	}
+	if len(opts.HostConfig.PortBindings) != 0 {
+		t.Fatalf("ports should not be published: %v", opts.HostConfig.PortBindings)
+	}
+}
+
+func TestDockerDriver_CreateBinds(t *testing.T) {
+	task := &structs.Task{
+		Name: "web",
+		Config: map[string]string{
+			"volumes": "/etc/ssl:/etc/ssl:ro, data:/data",
+		},
+		Resources: basicResources,
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+
+	binds, err := createBinds(ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []string{
+		"/etc/ssl:/etc/ssl:ro",
+		filepath.Join(ctx.AllocDir.TaskDirs[task.Name], "data") + ":/data",
+	}
+	if !reflect.DeepEqual(binds, exp) {
+		t.Fatalf("got %v; want %v", binds, exp)
+	}
+
+	for _, volume := range []string{"/foo", "/foo:bar", "/foo:/bar:rx", ":/bar", "/a:/b:ro:x"} {
+		task.Config["volumes"] = volume
+		if _, err := createBinds(ctx, task); err == nil {
+			t.Fatalf("expected error for %s", volume)
+		}
+	}
+}
+
+func TestDockerDriver_VolumeBinds(t *testing.T) {
+	volumes := []*structs.TaskVolume{
+		{Source: "/srv/data", Destination: "/data"},
+		{Source: "/etc/ssl", Destination: "/etc/ssl", ReadOnly: true},
+	}
+	exp := []string{"/srv/data:/data", "/etc/ssl:/etc/ssl:ro"}
+	if binds := volumeBinds(volumes); !reflect.DeepEqual(binds, exp) {
+		t.Fatalf("got %v; want %v", binds, exp)
+	}
+}
+
+func TestDockerDriver_ContainerLabels(t *testing.T) {
+	if labels := containerLabels(nil); labels != nil {
+		t.Fatalf("unknown node labeled: %v", labels)
+	}
+	labels := containerLabels(&structs.Node{ID: "node1"})
+	if exp := map[string]string{dockerNodeLabel: "node1"}; !reflect.DeepEqual(labels, exp) {
+		t.Fatalf("got %v; want %v", labels, exp)
+	}
+}
+
+func TestDockerDriver_OrphanedContainers(t *testing.T) {
+	active := &dockerHandle{imageID: "image", containerID: "active"}
+	containers := []docker.APIContainers{
+		{ID: "active", Labels: map[string]string{dockerNodeLabel: "node1"}},
+		{ID: "orphan", Labels: map[string]string{dockerNodeLabel: "node1"}},
+		{ID: "other-node", Labels: map[string]string{dockerNodeLabel: "node2"}},
+		{ID: "unlabeled"},
+	}
+	legacy := &dockerHandle{imageID: "image", containerID: "legacy"}
+	containers = append(containers, docker.APIContainers{ID: "legacy", Labels: map[string]string{dockerNodeLabel: "node1"}})
+	handleIDs := []string{
+		active.ID(),
+		strings.Replace(legacy.ID(), "docker:v1:", "DOCKER:", 1),
+		`exec:v1:{"ContainerID":"orphan"}`,
+	}
+
+	// Only the containers of the node that no handle references are orphans
+	orphans, err := orphanedContainers(containers, "node1", handleIDs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exp := []string{"orphan"}; !reflect.DeepEqual(orphans, exp) {
+		t.Fatalf("got %v; want %v", orphans, exp)
+	}
+
+	// A docker handle that can't be parsed may reference any container, so
+	// none is an orphan
+	for _, handleID := range []string{`docker:v2:{"ContainerID":"active"}`, "DOCKER:garbage"} {
+		orphans, err := orphanedContainers(containers, "node1", append(handleIDs, handleID))
+		if err == nil || len(orphans) != 0 {
+			t.Fatalf("%s: expected error, got %v", handleID, orphans)
+		}
+	}
+}
+
 // The fingerprinter test should always pass, even if Docker is not installed.
 func TestDockerDriver_Fingerprint(t *testing.T) {
 	d := NewDockerDriver(testDriverContext(""))
@@ -68,7 +265,7 @@ func TestDockerDriver_StartOpen_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewDockerDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -78,13 +275,7 @@ func TestDockerDriver_StartOpen_Wait(t *testing.T) {
 	defer handle.Kill()
 
 	// Attempt to open
-	handle2, err := d.Open(ctx, handle.ID())
-	if err != nil {
-		t.Fatalf("err: %v", err)
-	}
-	if handle2 == nil {
-		t.Fatalf("missing handle")
-	}
+	testOpenHandleID(t, d, ctx, "docker", handle)
 }
 
 func TestDockerDriver_Start_Wait(t *testing.T) {
@@ -109,7 +300,7 @@ func TestDockerDriver_Start_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewDockerDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -125,9 +316,9 @@ func TestDockerDriver_Start_Wait(t *testing.T) {
 	}
 
 	select {
-	case err := <-handle.WaitCh():
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
 		}
 	case <-time.After(5 * time.Second):
 		t.Fatalf("timeout")
@@ -153,7 +344,7 @@ func TestDockerDriver_Start_Kill_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewDockerDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -171,15 +362,55 @@ func TestDockerDriver_Start_Kill_Wait(t *testing.T) {
 	}()
 
 	select {
-	case err := <-handle.WaitCh():
-		if err == nil {
-			t.Fatalf("should err: %v", err)
+	case res := <-handle.WaitCh():
+		if res.Successful() {
+			t.Fatalf("should err: %v", res)
 		}
 	case <-time.After(10 * time.Second):
 		t.Fatalf("timeout")
 	}
 }
 
+func TestDockerDriver_Exec(t *testing.T) {
+	if !dockerLocated() {
+		t.SkipNow()
+	}
+
+	task := &structs.Task{
+		Name: "redis-demo",
+		Config: map[string]string{
+			"image": "redis",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewDockerDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	out, code, err := handle.Exec([]string{"/bin/sh", "-c", "echo hello; echo oops >&2; exit 2"}, 10*time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 2 {
+		t.Fatalf("bad exit code: %d", code)
+	}
+	if !strings.Contains(string(out), "hello") || !strings.Contains(string(out), "oops") {
+		t.Fatalf("bad output: %q", out)
+	}
+
+	if _, _, err := handle.Exec([]string{"sleep", "10"}, 100*time.Millisecond); err == nil {
+		t.Fatalf("expected timeout")
+	}
+}
+
 func taskTemplate() *structs.Task {
 	return &structs.Task{
 		Config: map[string]string{
@@ -224,7 +455,7 @@ func TestDocker_StartN(t *testing.T) {
 		defer ctx.AllocDir.Destroy()
 		d := NewDockerDriver(driverCtx)
 
-		handles[idx], err = d.Start(ctx, task)
+		handles[idx], err = d.Start(context.Background(), ctx, task)
 		if err != nil {
 			t.Errorf("Failed starting task #%d: %s", idx+1, err)
 		}
@@ -270,7 +501,7 @@ func TestDocker_StartNVersions(t *testing.T) {
 		defer ctx.AllocDir.Destroy()
 		d := NewDockerDriver(driverCtx)
 
-		handles[idx], err = d.Start(ctx, task)
+		handles[idx], err = d.Start(context.Background(), ctx, task)
 		if err != nil {
 			t.Errorf("Failed starting task #%d: %s", idx+1, err)
 		}
@@ -1,13 +1,26 @@
 package driver
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/environment"
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/client/executor"
 	"github.com/hashicorp/nomad/client/fingerprint"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -15,19 +28,25 @@ import (
 // BuiltinDrivers contains the built in registered drivers
 // which are available for allocation handling
 var BuiltinDrivers = map[string]Factory{
-	"docker": NewDockerDriver,
-	"exec":   NewExecDriver,
-	"java":   NewJavaDriver,
-	"qemu":   NewQemuDriver,
+	"docker":   NewDockerDriver,
+	"exec":     NewExecDriver,
+	"java":     NewJavaDriver,
+	"qemu":     NewQemuDriver,
+	"raw_exec": NewRawExecDriver,
+	"rkt":      NewRktDriver,
 }
 
 // NewDriver is used to instantiate and return a new driver
-// given the name and a logger
+// given the name and a logger. Names that are not built in are resolved to
+// the driver plugins registered with the options of the client.
 func NewDriver(name string, ctx *DriverContext) (Driver, error) {
 	// Lookup the factory function
 	factory, ok := BuiltinDrivers[name]
 	if !ok {
-		return nil, fmt.Errorf("unknown driver '%s'", name)
+		if path := pluginPath(ctx.config, name); path != "" {
+			return newPluginDriver(name, path, ctx), nil
+		}
+		return nil, &UnknownDriverError{Name: name, Available: availableDrivers(ctx)}
 	}
 
 	// Instantiate the driver
@@ -35,6 +54,111 @@ func NewDriver(name string, ctx *DriverContext) (Driver, error) {
 	return f, nil
 }
 
+// UnknownDriverError is returned by NewDriver for a name that is neither a
+// built in driver nor a registered driver plugin.
+type UnknownDriverError struct {
+	Name string
+
+	// Available are the sorted names of the drivers that can be used
+	// instead
+	Available []string
+}
+
+func (e *UnknownDriverError) Error() string {
+	if len(e.Available) == 0 {
+		return fmt.Sprintf("unknown driver '%s'; no drivers are available", e.Name)
+	}
+	return fmt.Sprintf("unknown driver '%s'; available drivers: %s", e.Name, strings.Join(e.Available, ", "))
+}
+
+// TaskLostError is returned by Open when the task of the handle is gone, such
+// as a process that exited or was killed while the client was not running.
+// The task is then handed to its restart policy rather than restored.
+type TaskLostError struct {
+	Reason string
+}
+
+func (e *TaskLostError) Error() string {
+	return fmt.Sprintf("task is lost: %s", e.Reason)
+}
+
+// DriverNames returns the sorted names of the built in drivers and of the
+// driver plugins registered with the options of the client.
+func DriverNames(cfg *config.Config) []string {
+	names := make([]string, 0, len(BuiltinDrivers))
+	for name := range BuiltinDrivers {
+		names = append(names, name)
+	}
+	if cfg != nil {
+		names = append(names, PluginNames(cfg)...)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// availableDrivers returns the sorted names of the drivers fingerprinting
+// detected on the node of the context. All the drivers are returned if the
+// node is unknown or has not been fingerprinted yet.
+func availableDrivers(ctx *DriverContext) []string {
+	names := DriverNames(ctx.config)
+	if ctx.node == nil {
+		return names
+	}
+	var detected []string
+	for _, name := range names {
+		if Available(ctx.node, name) {
+			detected = append(detected, name)
+		}
+	}
+	if len(detected) == 0 {
+		return names
+	}
+	return detected
+}
+
+// ValidateTask checks the task against the rules of its driver. As it needs
+// no client it can also be used to reject tasks when they are submitted.
+func ValidateTask(task *structs.Task) error {
+	ctx := NewDriverContext(task.Name, &config.Config{}, nil, log.New(ioutil.Discard, "", 0))
+	d, err := NewDriver(task.Driver, ctx)
+	if err != nil {
+		return err
+	}
+	return d.Validate(task)
+}
+
+// TaskVolumes returns the host volumes of the task with their sources
+// resolved, failing if one is not within the volume whitelist of the client.
+func TaskVolumes(config *config.Config, task *structs.Task) ([]*structs.TaskVolume, error) {
+	ctx := NewDriverContext(task.Name, config, nil, log.New(ioutil.Discard, "", 0))
+	return ctx.taskVolumes(task)
+}
+
+// CheckResourceCeiling returns an error if the task requests more resources
+// than the ceiling of the named driver allows.
+func CheckResourceCeiling(name string, config *config.Config, task *structs.Task) error {
+	ceiling := config.ResourceCeilings[name]
+	if ceiling == nil || task.Resources == nil {
+		return nil
+	}
+	if ceiling.CPU > 0 && task.Resources.CPU > ceiling.CPU {
+		return fmt.Errorf("task requests %d MHz of CPU, more than the %d MHz allowed for driver '%s'",
+			task.Resources.CPU, ceiling.CPU, name)
+	}
+	if ceiling.MemoryMB > 0 && task.Resources.MemoryMB > ceiling.MemoryMB {
+		return fmt.Errorf("task requests %d MB of memory, more than the %d MB allowed for driver '%s'",
+			task.Resources.MemoryMB, ceiling.MemoryMB, name)
+	}
+	return nil
+}
+
+// Available returns whether fingerprinting detected the named driver on the
+// node. Drivers that are detected set the "driver.<name>" attribute, along
+// with attributes such as their version.
+func Available(node *structs.Node, name string) bool {
+	return node.Attributes["driver."+name] != ""
+}
+
 // Factory is used to instantiate a new Driver
 type Factory func(*DriverContext) Driver
 
@@ -45,11 +169,34 @@ type Driver interface {
 	// Drivers must support the fingerprint interface for detection
 	fingerprint.Fingerprint
 
-	// Start is used to being task execution
-	Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error)
+	// Validate checks the config of the task before anything is run,
+	// returning what must be fixed if the driver can't run it
+	Validate(task *structs.Task) error
+
+	// Start is used to being task execution. It returns the error of the
+	// context promptly once the context is cancelled, e.g. while pulling an
+	// image, having stopped anything it started.
+	Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error)
+
+	// Open is used to re-open a handle to a task from its ID, accepting
+	// exactly what the ID of a handle of the driver returns, including that
+	// of older versions of the driver. It returns a TaskLostError if the
+	// task is known to be gone, and an IncompatibleHandleError if the ID is
+	// of a version the driver can't read. Like Start, it gives up once the
+	// context is cancelled.
+	Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error)
 
-	// Open is used to re-open a handle to a task
-	Open(ctx *ExecContext, handleID string) (DriverHandle, error)
+	// Version returns the version of the runtime the driver runs tasks
+	// with, or a NotSupportedError if the driver has no such runtime
+	Version() (string, error)
+
+	// Capabilities returns the features the driver supports
+	Capabilities() *DriverCapabilities
+
+	// Cleanup is called once when the client starts, before any task is
+	// run, to reap the resources the driver manages that none of the active
+	// handles reference, such as those left behind by a crash
+	Cleanup(activeHandleIDs []string) error
 }
 
 // DriverContext is a means to inject dependencies such as loggers, configs, and
@@ -75,20 +222,185 @@ func NewDriverContext(taskName string, config *config.Config, node *structs.Node
 	}
 }
 
+// fingerprintedVersion returns the version of the named driver detected when
+// fingerprinting the node
+func (d *DriverContext) fingerprintedVersion(name string) (string, error) {
+	if d.node != nil {
+		if version := d.node.Attributes[fmt.Sprintf("driver.%s.version", name)]; version != "" {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("version of driver '%s' was not fingerprinted", name)
+}
+
+// taskVolumes returns the host volumes of the task with their sources
+// resolved. Every source must be within one of the directories of the volume
+// whitelist of the client.
+func (d *DriverContext) taskVolumes(task *structs.Task) ([]*structs.TaskVolume, error) {
+	var volumes []*structs.TaskVolume
+	for _, v := range task.Volumes {
+		// Resolve symlinks so they can't be used to escape the whitelist
+		source, err := filepath.EvalSymlinks(v.Source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid volume source '%s': %v", v.Source, err)
+		}
+		if !volumeAllowed(d.config.VolumeWhitelist, source) {
+			return nil, fmt.Errorf("volume source '%s' is not within the allowed volume paths %v",
+				v.Source, d.config.VolumeWhitelist)
+		}
+		volumes = append(volumes, &structs.TaskVolume{
+			Source:      source,
+			Destination: v.Destination,
+			ReadOnly:    v.ReadOnly,
+		})
+	}
+	return volumes, nil
+}
+
+// volumeAllowed returns whether the resolved source is one of the whitelisted
+// directories or below one of them
+func volumeAllowed(whitelist []string, source string) bool {
+	for _, dir := range whitelist {
+		if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = resolved
+		}
+		rel, err := filepath.Rel(dir, source)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
 // DriverHandle is an opaque handle into a driver used for task
 // manipulation
 type DriverHandle interface {
-	// Returns an opaque handle that can be used to re-open the handle
+	// ID returns an opaque ID the handle is re-opened from by Open after a
+	// client restart. It names the driver and the version of the encoding
+	// of the handle, so a driver can tell handles it can't read from
+	// corrupt ones.
 	ID() string
 
-	// WaitCh is used to return a channel used wait for task completion
-	WaitCh() chan error
+	// WaitCh is used to return a channel used wait for task completion.
+	// The result of the task is sent once it exits.
+	WaitCh() chan *WaitResult
 
 	// Update is used to update the task if possible
 	Update(task *structs.Task) error
 
-	// Kill is used to stop the task
+	// Kill is used to gracefully stop the task. It does not wait for the
+	// task to exit; callers should use WaitCh for that.
 	Kill() error
+
+	// ForceKill is used to stop the task immediately without giving it
+	// a chance to clean up. It is used when Kill fails to stop the task.
+	ForceKill() error
+
+	// Stats returns the current resource usage of the task. Drivers that
+	// can not report usage return a *NotSupportedError.
+	Stats() (*TaskResourceUsage, error)
+
+	// Signal delivers the signal to the task, e.g. to make it reload its
+	// configuration. Drivers that can not signal tasks return a
+	// *NotSupportedError.
+	Signal(sig os.Signal) error
+
+	// Exec runs a one-off command inside the task, such as to debug it,
+	// returning its combined output and exit code. The command is killed if
+	// it outlives the timeout. Drivers that can not exec into tasks return a
+	// *NotSupportedError.
+	Exec(cmd []string, timeout time.Duration) ([]byte, int, error)
+}
+
+// WaitResult is how a task exited. A task that exits non-zero or is killed
+// by a signal has its exit code and signal set, while Err is set for other
+// failures such as the task being lost.
+type WaitResult struct {
+	ExitCode int
+	Signal   int
+	Err      error
+
+	// OOMKilled is whether the task was killed for running out of memory,
+	// for drivers that can tell
+	OOMKilled bool
+}
+
+// NewWaitResult returns the result of a task that exited with the code and
+// signal, or failed with the error
+func NewWaitResult(code, signal int, err error) *WaitResult {
+	return &WaitResult{ExitCode: code, Signal: signal, Err: err}
+}
+
+// Successful returns whether the task exited with code zero of its own accord
+func (r *WaitResult) Successful() bool {
+	return r.ExitCode == 0 && r.Signal == 0 && r.Err == nil
+}
+
+func (r *WaitResult) String() string {
+	switch {
+	case r.Err != nil:
+		return r.Err.Error()
+	case r.OOMKilled:
+		return fmt.Sprintf("killed for running out of memory with exit code %d", r.ExitCode)
+	case r.Signal != 0:
+		return fmt.Sprintf("killed by signal %d", r.Signal)
+	default:
+		return fmt.Sprintf("exit code %d", r.ExitCode)
+	}
+}
+
+// waitResult returns the result of the error waiting for a process
+// returned, taking the exit code and signal from its wait status
+func waitResult(err error) *WaitResult {
+	if err == nil {
+		return NewWaitResult(0, 0, nil)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			// Like shells, a task killed by a signal exits with 128 + signal
+			if status.Signaled() {
+				signal := int(status.Signal())
+				return NewWaitResult(128+signal, signal, nil)
+			}
+			return NewWaitResult(status.ExitStatus(), 0, nil)
+		}
+	}
+	return NewWaitResult(0, 0, err)
+}
+
+// runExec runs the command to completion with its combined output captured,
+// killing it along with its children if it outlives the timeout. A command
+// that exits non-zero is not an error; its exit code is returned instead.
+func runExec(cmd *exec.Cmd, timeout time.Duration) ([]byte, int, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return nil, 0, fmt.Errorf("failed to start command: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- cmd.Wait()
+	}()
+	var err error
+	select {
+	case err = <-errCh:
+	case <-time.After(timeout):
+		killProcessGroup(cmd.Process, true)
+		<-errCh
+		return out.Bytes(), -1, fmt.Errorf("command timed out after %v", timeout)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			return out.Bytes(), status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		return out.Bytes(), -1, err
+	}
+	return out.Bytes(), 0, nil
 }
 
 // ExecContext is shared between drivers within an allocation
@@ -97,6 +409,18 @@ type ExecContext struct {
 
 	// AllocDir contains information about the alloc directory structure.
 	AllocDir *allocdir.AllocDir
+
+	// taskEnvs is the environment built by the client for each task. It
+	// is rebuilt before each start and so is not persisted.
+	taskEnvs map[string]map[string]string
+
+	// taskPorts are the host ports of each task by label. Like the
+	// environment they are set before each start and not persisted.
+	taskPorts map[string]map[string]int
+
+	// taskNetworkModes are the network modes the tasks run in, resolved
+	// against the capabilities of their driver before each start
+	taskNetworkModes map[string]string
 }
 
 // NewExecContext is used to create a new execution context
@@ -104,14 +428,164 @@ func NewExecContext(alloc *allocdir.AllocDir) *ExecContext {
 	return &ExecContext{AllocDir: alloc}
 }
 
-// TaskEnvironmentVariables converts exec context and task configuration into a
-// TaskEnvironment.
+// SetTaskEnv is used to set the environment the task is started with.
+func (ctx *ExecContext) SetTaskEnv(taskName string, env map[string]string) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.taskEnvs == nil {
+		ctx.taskEnvs = make(map[string]map[string]string)
+	}
+	ctx.taskEnvs[taskName] = env
+}
+
+// TaskEnv returns the environment set for the task or nil if none was set.
+func (ctx *ExecContext) TaskEnv(taskName string) map[string]string {
+	ctx.Lock()
+	defer ctx.Unlock()
+	return ctx.taskEnvs[taskName]
+}
+
+// TaskChroot returns the root of the filesystem of the task when its driver
+// runs it in a chroot, which is the task directory.
+func (ctx *ExecContext) TaskChroot(taskName string) string {
+	return ctx.AllocDir.TaskDirs[taskName]
+}
+
+// SetTaskPorts is used to set the host ports of the task by label.
+func (ctx *ExecContext) SetTaskPorts(taskName string, ports map[string]int) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.taskPorts == nil {
+		ctx.taskPorts = make(map[string]map[string]int)
+	}
+	ctx.taskPorts[taskName] = ports
+}
+
+// TaskPorts returns the ports set for the task or nil if none were set.
+func (ctx *ExecContext) TaskPorts(taskName string) map[string]int {
+	ctx.Lock()
+	defer ctx.Unlock()
+	return ctx.taskPorts[taskName]
+}
+
+// SetTaskNetworkMode is used to set the network mode the task runs in.
+func (ctx *ExecContext) SetTaskNetworkMode(taskName, mode string) {
+	ctx.Lock()
+	defer ctx.Unlock()
+	if ctx.taskNetworkModes == nil {
+		ctx.taskNetworkModes = make(map[string]string)
+	}
+	ctx.taskNetworkModes[taskName] = mode
+}
+
+// TaskNetworkMode returns the network mode set for the task or the empty
+// string if none was set.
+func (ctx *ExecContext) TaskNetworkMode(taskName string) string {
+	ctx.Lock()
+	defer ctx.Unlock()
+	return ctx.taskNetworkModes[taskName]
+}
+
+// taskPortMap returns the host ports of the task by label. These are the
+// ports set on the exec context by the client if there are any, and
+// otherwise the dynamic ports of the network.
+func taskPortMap(ctx *ExecContext, task *structs.Task, network *structs.NetworkResource) map[string]int {
+	if ports := ctx.TaskPorts(task.Name); ports != nil {
+		return ports
+	}
+	return network.MapDynamicPorts()
+}
+
+// LogPaths returns the paths the stdout and stderr of the task are written
+// to. The files are rotated by suffixing the paths with an increasing index,
+// e.g. <task>.stdout.0.
+func (ctx *ExecContext) LogPaths(taskName string) (stdout, stderr string) {
+	dir := filepath.Join(ctx.AllocDir.SharedDir, allocdir.SharedLogsName)
+	stdout = filepath.Join(dir, fmt.Sprintf("%s.stdout", taskName))
+	stderr = filepath.Join(dir, fmt.Sprintf("%s.stderr", taskName))
+	return
+}
+
+// taskSyslog returns where the output of the task is forwarded to in syslog,
+// or nil if it isn't. The tag defaults to the name of the task.
+func taskSyslog(task *structs.Task) *logging.SyslogConfig {
+	if task.LogConfig == nil || task.LogConfig.Syslog == nil {
+		return nil
+	}
+	s := task.LogConfig.Syslog
+	network, addr := s.Endpoint()
+	c := &logging.SyslogConfig{Network: network, Address: addr, Facility: s.Facility, Tag: s.Tag}
+	if c.Tag == "" {
+		c.Tag = task.Name
+	}
+	return c
+}
+
+// openTaskLogs opens the writers the stdout and stderr of a task run by the
+// driver itself are captured by: rotated files in the alloc dir, owned by the
+// user if not nil, and syslog if the task forwards its output there.
+func openTaskLogs(execCtx *ExecContext, task *structs.Task, user *executor.TaskUser) (stdout, stderr io.WriteCloser, err error) {
+	logConfig := task.LogConfig
+	if logConfig == nil {
+		logConfig = structs.DefaultLogConfig()
+	}
+
+	if logConfig.Syslog == nil || !logConfig.Syslog.DisableFiles {
+		maxFileSize := int64(logConfig.MaxFileSizeMB) * 1024 * 1024
+		stdoutPath, stderrPath := execCtx.LogPaths(task.Name)
+		stdoutRotator, err := logging.NewFileRotator(stdoutPath, logConfig.MaxFiles, maxFileSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open stdout log: %v", err)
+		}
+		stderrRotator, err := logging.NewFileRotator(stderrPath, logConfig.MaxFiles, maxFileSize)
+		if err != nil {
+			stdoutRotator.Close()
+			return nil, nil, fmt.Errorf("failed to open stderr log: %v", err)
+		}
+
+		// The log files are owned by the user of the task as well
+		if user != nil {
+			for _, r := range []*logging.FileRotator{stdoutRotator, stderrRotator} {
+				if err := r.SetOwner(user.Uid, user.Gid); err != nil {
+					stdoutRotator.Close()
+					stderrRotator.Close()
+					return nil, nil, err
+				}
+			}
+		}
+		stdout, stderr = stdoutRotator, stderrRotator
+	}
+
+	if syslog := taskSyslog(task); syslog != nil {
+		stdout, stderr, err = logging.ForwardSyslog(syslog, stdout, stderr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to forward logs to syslog: %v", err)
+		}
+	}
+	return stdout, stderr, nil
+}
+
+// TaskEnvironmentVariables returns the environment the task should be started
+// with. This is the environment set on the exec context by the client if there
+// is one and otherwise the runtime environment of the task.
 func TaskEnvironmentVariables(ctx *ExecContext, task *structs.Task) environment.TaskEnvironment {
+	if taskEnv := ctx.TaskEnv(task.Name); taskEnv != nil {
+		env := environment.NewTaskEnivornment()
+		env.SetEnv(taskEnv)
+		return env
+	}
+	return TaskRuntimeEnvironment(ctx, task)
+}
+
+// TaskRuntimeEnvironment converts exec context and task configuration into a
+// TaskEnvironment.
+func TaskRuntimeEnvironment(ctx *ExecContext, task *structs.Task) environment.TaskEnvironment {
 	env := environment.NewTaskEnivornment()
 	env.SetMeta(task.Meta)
 
 	if ctx.AllocDir != nil {
-		env.SetAllocDir(ctx.AllocDir.AllocDir)
+		env.SetAllocDir(ctx.AllocDir.SharedDir)
+		env.SetSecretsDir(ctx.AllocDir.SecretsDir(task.Name))
 	}
 
 	if task.Resources != nil {
@@ -120,8 +594,10 @@ func TaskEnvironmentVariables(ctx *ExecContext, task *structs.Task) environment.
 
 		if len(task.Resources.Networks) > 0 {
 			network := task.Resources.Networks[0]
+			ports := taskPortMap(ctx, task, network)
 			env.SetTaskIp(network.IP)
-			env.SetPorts(network.MapDynamicPorts())
+			env.SetPorts(ports)
+			env.SetPortAddrs(network.IP, ports)
 		}
 	}
 
@@ -1,10 +1,16 @@
 package driver
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/hashicorp/nomad/client/allocdir"
@@ -47,6 +53,157 @@ func testDriverExecContext(task *structs.Task, driverCtx *DriverContext) *ExecCo
 	return ctx
 }
 
+// testOpenHandleID reopens the handle from its ID, which must name the
+// driver, and returns the reopened handle
+func testOpenHandleID(t *testing.T, d Driver, ctx *ExecContext, driver string, handle DriverHandle) DriverHandle {
+	id := handle.ID()
+	if !strings.HasPrefix(id, driver+":v") {
+		t.Fatalf("ID %q doesn't name the %s driver", id, driver)
+	}
+	handle2, err := d.Open(context.Background(), ctx, id)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle2.ID() != id {
+		t.Fatalf("reopened handle has ID %q; want %q", handle2.ID(), id)
+	}
+	return handle2
+}
+
+func TestDriver_Available(t *testing.T) {
+	node := &structs.Node{Attributes: map[string]string{
+		"driver.docker":         "true",
+		"driver.docker.version": "1.8.1",
+		"driver.exec":           "1",
+	}}
+	for name, exp := range map[string]bool{"docker": true, "exec": true, "java": false} {
+		if act := Available(node, name); act != exp {
+			t.Fatalf("%s: got %v; want %v", name, act, exp)
+		}
+	}
+}
+
+func TestDriver_ValidateTask(t *testing.T) {
+	task := &structs.Task{
+		Name:   "web",
+		Driver: "exec",
+		Config: map[string]string{"command": "/bin/date"},
+	}
+	if err := ValidateTask(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	delete(task.Config, "command")
+	if err := ValidateTask(task); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	task.Driver = "unknown"
+	if err := ValidateTask(task); err == nil || !strings.Contains(err.Error(), "unknown driver") {
+		t.Fatalf("expected unknown driver: %v", err)
+	}
+}
+
+func TestNewDriver_Unknown(t *testing.T) {
+	driverCtx := testDriverContext("web")
+	driverCtx.config.Options = map[string]string{"driver.plugin.sleep": "/bin/sleep"}
+	driverCtx.node = nil
+
+	// All the drivers are listed when the node isn't known
+	_, err := NewDriver("dokcer", driverCtx)
+	uerr, ok := err.(*UnknownDriverError)
+	if !ok {
+		t.Fatalf("expected unknown driver error: %v", err)
+	}
+	if uerr.Name != "dokcer" {
+		t.Fatalf("bad: %#v", uerr)
+	}
+	if act, exp := strings.Join(uerr.Available, ","), strings.Join(DriverNames(driverCtx.config), ","); act != exp {
+		t.Fatalf("got %s; want %s", act, exp)
+	}
+	for _, name := range []string{"docker", "exec", "raw_exec", "sleep"} {
+		if !strings.Contains(err.Error(), name) {
+			t.Fatalf("error doesn't name driver '%s': %v", name, err)
+		}
+	}
+
+	// Only the drivers detected are listed once the node is fingerprinted
+	driverCtx.node = &structs.Node{Attributes: map[string]string{
+		"driver.raw_exec": "1",
+		"driver.exec":     "1",
+	}}
+	_, err = NewDriver("dokcer", driverCtx)
+	if act := err.Error(); act != "unknown driver 'dokcer'; available drivers: exec, raw_exec" {
+		t.Fatalf("bad: %s", act)
+	}
+}
+
+func TestDriver_TaskVolumes(t *testing.T) {
+	allowed, err := ioutil.TempDir("", "nomad-volumes")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(allowed)
+	denied, err := ioutil.TempDir("", "nomad-volumes")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(denied)
+
+	data := filepath.Join(allowed, "data")
+	if err := os.Mkdir(data, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	sibling := allowed + "-other"
+	if err := os.Mkdir(sibling, 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(sibling)
+	escape := filepath.Join(allowed, "escape")
+	if err := os.Symlink(denied, escape); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	driverCtx := testDriverContext("web")
+	driverCtx.config.VolumeWhitelist = []string{allowed}
+
+	task := &structs.Task{
+		Name:    "web",
+		Volumes: []*structs.TaskVolume{{Source: data, Destination: "/data", ReadOnly: true}},
+	}
+	volumes, err := driverCtx.taskVolumes(task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	resolved, _ := filepath.EvalSymlinks(data)
+	exp := []*structs.TaskVolume{{Source: resolved, Destination: "/data", ReadOnly: true}}
+	if !reflect.DeepEqual(volumes, exp) {
+		t.Fatalf("got %#v; want %#v", volumes[0], exp[0])
+	}
+
+	// Sources outside the whitelist, including through symlinks or relative
+	// segments, are rejected
+	for _, source := range []string{denied, escape, allowed + "/../" + filepath.Base(denied), sibling} {
+		task.Volumes[0].Source = source
+		if _, err := driverCtx.taskVolumes(task); err == nil {
+			t.Fatalf("expected error for %s", source)
+		}
+	}
+
+	// Sources that don't exist are rejected
+	task.Volumes[0].Source = filepath.Join(allowed, "missing")
+	if _, err := driverCtx.taskVolumes(task); err == nil || !strings.Contains(err.Error(), "invalid volume source") {
+		t.Fatalf("expected invalid source: %v", err)
+	}
+
+	// No volumes are allowed without a whitelist
+	task.Volumes[0].Source = data
+	driverCtx.config.VolumeWhitelist = nil
+	if _, err := driverCtx.taskVolumes(task); err == nil || !strings.Contains(err.Error(), "not within the allowed volume paths") {
+		t.Fatalf("expected denied source: %v", err)
+	}
+}
+
 func TestDriver_TaskEnvironmentVariables(t *testing.T) {
 	ctx := &ExecContext{}
 	task := &structs.Task{
@@ -74,6 +231,8 @@ func TestDriver_TaskEnvironmentVariables(t *testing.T) {
 		"NOMAD_IP":              "1.2.3.4",
 		"NOMAD_PORT_admin":      "8080",
 		"NOMAD_PORT_5000":       "12345",
+		"NOMAD_ADDR_admin":      "1.2.3.4:8080",
+		"NOMAD_ADDR_5000":       "1.2.3.4:12345",
 		"NOMAD_META_CHOCOLATE":  "cake",
 		"NOMAD_META_STRAWBERRY": "icecream",
 	}
@@ -83,3 +242,73 @@ func TestDriver_TaskEnvironmentVariables(t *testing.T) {
 		t.Fatalf("TaskEnvironmentVariables(%#v, %#v) returned %#v; want %#v", ctx, task, act, exp)
 	}
 }
+
+func TestDriver_TaskEnvironmentVariables_Ports(t *testing.T) {
+	ctx := &ExecContext{}
+	task := &structs.Task{
+		Name: "web",
+		Resources: &structs.Resources{
+			Networks: []*structs.NetworkResource{
+				&structs.NetworkResource{
+					IP:            "1.2.3.4",
+					ReservedPorts: []int{8080},
+					DynamicPorts:  []string{"http"},
+				},
+			},
+		},
+	}
+
+	// The ports set by the client take precedence over the network
+	ctx.SetTaskPorts("web", map[string]int{"http": 9090})
+	env := TaskEnvironmentVariables(ctx, task).Map()
+	if env["NOMAD_PORT_http"] != "9090" || env["NOMAD_ADDR_http"] != "1.2.3.4:9090" {
+		t.Fatalf("bad: %#v", env)
+	}
+}
+
+func TestDriver_TaskEnvironmentVariables_TaskEnv(t *testing.T) {
+	ctx := &ExecContext{}
+	task := &structs.Task{
+		Name: "web",
+		Meta: map[string]string{"chocolate": "cake"},
+	}
+
+	// The environment built by the client replaces the runtime environment
+	exp := map[string]string{"FOO": "bar"}
+	ctx.SetTaskEnv("web", exp)
+	if act := TaskEnvironmentVariables(ctx, task).Map(); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("TaskEnvironmentVariables returned %#v; want %#v", act, exp)
+	}
+
+	// Other tasks are unaffected
+	task.Name = "db"
+	exp = map[string]string{"NOMAD_META_CHOCOLATE": "cake"}
+	if act := TaskEnvironmentVariables(ctx, task).Map(); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("TaskEnvironmentVariables returned %#v; want %#v", act, exp)
+	}
+}
+
+func TestDriver_WaitResult(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh not available on windows; skipping")
+	}
+
+	if res := waitResult(exec.Command("sh", "-c", "exit 0").Run()); !res.Successful() {
+		t.Fatalf("expected success: %v", res)
+	}
+	if res := waitResult(exec.Command("sh", "-c", "exit 3").Run()); res.ExitCode != 3 || res.Signal != 0 || res.Err != nil {
+		t.Fatalf("expected exit code 3: %#v", res)
+	}
+	res := waitResult(exec.Command("sh", "-c", "kill -9 $$").Run())
+	if res.Signal != 9 || res.ExitCode != 137 || res.String() != "killed by signal 9" {
+		t.Fatalf("expected signal 9: %#v", res)
+	}
+	res = &WaitResult{ExitCode: 137, OOMKilled: true}
+	if res.Successful() || res.String() != "killed for running out of memory with exit code 137" {
+		t.Fatalf("expected oom: %#v", res)
+	}
+	res = waitResult(fmt.Errorf("lost"))
+	if res.Err == nil || res.Successful() || res.String() != "lost" {
+		t.Fatalf("expected error: %#v", res)
+	}
+}
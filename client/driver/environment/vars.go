@@ -2,6 +2,8 @@ package environment
 
 import (
 	"fmt"
+	"net"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -12,12 +14,18 @@ const (
 	// group.
 	AllocDir = "NOMAD_ALLOC_DIR"
 
+	// The path to the directory holding the secrets of the task.
+	SecretsDir = "NOMAD_SECRETS_DIR"
+
 	// The tasks memory limit in MBs.
 	MemLimit = "NOMAD_MEMORY_LIMIT"
 
 	// The tasks limit in MHz.
 	CpuLimit = "NOMAD_CPU_LIMIT"
 
+	// The CPUs the task is pinned to, e.g. 0-1,4.
+	Cpuset = "NOMAD_CPUSET"
+
 	// The IP address for the task.
 	TaskIP = "NOMAD_IP"
 
@@ -26,10 +34,28 @@ const (
 	// E.g. $NOMAD_PORT_1 or $NOMAD_PORT_http
 	PortPrefix = "NOMAD_PORT_"
 
+	// Prefix for passing the address, IP and port, of each labelled port.
+	// E.g. $NOMAD_ADDR_http
+	AddrPrefix = "NOMAD_ADDR_"
+
 	// Prefix for passing task meta data.
 	MetaPrefix = "NOMAD_META_"
+
+	// The ID of the allocation the task belongs to.
+	AllocID = "NOMAD_ALLOC_ID"
+
+	// The name of the task.
+	TaskName = "NOMAD_TASK_NAME"
+
+	// Prefix for passing the attributes of the node.
+	// E.g. $NOMAD_ATTR_KERNEL_NAME
+	AttrPrefix = "NOMAD_ATTR_"
 )
 
+// SecretRefPrefix prefixes the names of references to secrets of the task
+// rather than to variables, e.g. ${secret:db_password}
+const SecretRefPrefix = "secret:"
+
 type TaskEnvironment map[string]string
 
 func NewTaskEnivornment() TaskEnvironment {
@@ -70,6 +96,10 @@ func (t TaskEnvironment) SetAllocDir(dir string) {
 	t[AllocDir] = dir
 }
 
+func (t TaskEnvironment) SetSecretsDir(dir string) {
+	t[SecretsDir] = dir
+}
+
 func (t TaskEnvironment) SetMemLimit(limit int) {
 	t[MemLimit] = strconv.Itoa(limit)
 }
@@ -78,6 +108,10 @@ func (t TaskEnvironment) SetCpuLimit(limit int) {
 	t[CpuLimit] = strconv.Itoa(limit)
 }
 
+func (t TaskEnvironment) SetCpuset(cpus string) {
+	t[Cpuset] = cpus
+}
+
 func (t TaskEnvironment) SetTaskIp(ip string) {
 	t[TaskIP] = ip
 }
@@ -89,6 +123,151 @@ func (t TaskEnvironment) SetPorts(ports map[string]int) {
 	}
 }
 
+// Takes the IP of the task and a map of port labels to their port value.
+func (t TaskEnvironment) SetPortAddrs(ip string, ports map[string]int) {
+	for label, port := range ports {
+		t[fmt.Sprintf("%s%s", AddrPrefix, label)] = net.JoinHostPort(ip, strconv.Itoa(port))
+	}
+}
+
+func (t TaskEnvironment) SetAllocID(id string) {
+	t[AllocID] = id
+}
+
+func (t TaskEnvironment) SetTaskName(name string) {
+	t[TaskName] = name
+}
+
+// Takes a map of node attributes. The keys are capitalized and characters
+// other than letters, digits and underscores are replaced by underscores.
+func (t TaskEnvironment) SetNodeAttributes(attrs map[string]string) {
+	for k, v := range attrs {
+		key := strings.Map(func(r rune) rune {
+			switch {
+			case 'a' <= r && r <= 'z', 'A' <= r && r <= 'Z', '0' <= r && r <= '9', r == '_':
+				return r
+			default:
+				return '_'
+			}
+		}, strings.ToUpper(k))
+		t[AttrPrefix+key] = v
+	}
+}
+
+// Takes a map of environment variables to be passed to the task as is.
+func (t TaskEnvironment) SetEnv(env map[string]string) {
+	for k, v := range env {
+		t[k] = v
+	}
+}
+
+// Interpolate replaces references of the form ${NAME} in the values with the
+// value of the named variable, which may itself contain references. A
+// reference to a variable that is not set or that refers back to itself is
+// left as is. The names of those variables are returned. References to
+// secrets are left for ResolveSecrets.
+func (t TaskEnvironment) Interpolate() []string {
+	resolved := make(map[string]string, len(t))
+	unresolved := make(map[string]struct{})
+	visiting := make(map[string]bool)
+
+	var resolve func(key string) string
+	resolve = func(key string) string {
+		if v, ok := resolved[key]; ok {
+			return v
+		}
+
+		visiting[key] = true
+		v := replaceRefs(t[key], func(name string) (string, bool) {
+			if strings.HasPrefix(name, SecretRefPrefix) {
+				return "", false
+			}
+			if _, ok := t[name]; !ok || visiting[name] {
+				unresolved[name] = struct{}{}
+				return "", false
+			}
+			return resolve(name), true
+		})
+		visiting[key] = false
+
+		resolved[key] = v
+		return v
+	}
+
+	// Resolve in a stable order so cycles are always broken at the same place
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		resolve(k)
+	}
+	for k, v := range resolved {
+		t[k] = v
+	}
+
+	var names []string
+	for name := range unresolved {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ResolveSecrets replaces references of the form ${secret:NAME} in the values
+// with the secret of that name. References to unknown secrets are left as is
+// and their names returned.
+func (t TaskEnvironment) ResolveSecrets(secrets map[string]string) []string {
+	unknown := make(map[string]struct{})
+	for k, v := range t {
+		t[k] = replaceRefs(v, func(name string) (string, bool) {
+			if !strings.HasPrefix(name, SecretRefPrefix) {
+				return "", false
+			}
+			name = strings.TrimPrefix(name, SecretRefPrefix)
+			secret, ok := secrets[name]
+			if !ok {
+				unknown[name] = struct{}{}
+			}
+			return secret, ok
+		})
+	}
+
+	var names []string
+	for name := range unknown {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// replaceRefs replaces each ${NAME} in s using lookup. If lookup does not
+// resolve the name the reference is kept.
+func replaceRefs(s string, lookup func(name string) (string, bool)) string {
+	var out []byte
+	for {
+		start := strings.Index(s, "${")
+		if start == -1 {
+			break
+		}
+		end := strings.Index(s[start:], "}")
+		if end == -1 {
+			break
+		}
+		end += start
+
+		out = append(out, s[:start]...)
+		if v, ok := lookup(s[start+2 : end]); ok {
+			out = append(out, v...)
+		} else {
+			out = append(out, s[start:end+1]...)
+		}
+		s = s[end+1:]
+	}
+	return string(append(out, s...))
+}
+
 // Takes a map of meta values to be passed to the task. The keys are capatilized
 // when the environent variable is set.
 func (t TaskEnvironment) SetMeta(m map[string]string) {
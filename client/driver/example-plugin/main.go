@@ -0,0 +1,185 @@
+// The example plugin is a driver plugin running simulated tasks that sleep
+// for the duration of their config, then exit with their exit code. It shows
+// the surface a driver plugin implements and is used to test the plugin
+// protocol. Register it on a client with the option
+//
+//	driver.plugin.sleep = /path/to/example-plugin
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const version = "0.1.0"
+
+// The handle versions of the plugin are read from the environment, so tests
+// can simulate an upgrade of the plugin to one that does or doesn't
+// understand the handles of the old one
+const (
+	handleVersionEnv    = "SLEEP_HANDLE_VERSION"
+	minHandleVersionEnv = "SLEEP_MIN_HANDLE_VERSION"
+)
+
+func main() {
+	if err := driver.ServePlugin(newSleepDriver); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+type sleepDriver struct {
+	ctx *driver.DriverContext
+}
+
+// sleepTask is the task behind a handle. It is the ID of the handle, so the
+// task can be reopened by a new plugin after a client restart.
+type sleepTask struct {
+	End      time.Time
+	ExitCode int
+
+	// Crash makes the plugin crash when the task ends, to test that crashes
+	// fail the task
+	Crash bool
+}
+
+type sleepHandle struct {
+	task   sleepTask
+	timer  *time.Timer
+	killCh chan struct{}
+	waitCh chan *driver.WaitResult
+	once   sync.Once
+}
+
+func newSleepDriver(ctx *driver.DriverContext) driver.Driver {
+	return &sleepDriver{ctx: ctx}
+}
+
+func (d *sleepDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	node.Attributes["driver.sleep.version"] = version
+	return true, nil
+}
+
+func (d *sleepDriver) Validate(task *structs.Task) error {
+	if _, err := time.ParseDuration(task.Config["duration"]); err != nil {
+		return fmt.Errorf("invalid duration %q: %v", task.Config["duration"], err)
+	}
+	if code := task.Config["exit_code"]; code != "" {
+		if _, err := strconv.Atoi(code); err != nil {
+			return fmt.Errorf("invalid exit_code %q: %v", code, err)
+		}
+	}
+	return nil
+}
+
+func (d *sleepDriver) Version() (string, error) {
+	return version, nil
+}
+
+func (d *sleepDriver) Capabilities() *driver.DriverCapabilities {
+	return &driver.DriverCapabilities{Exec: true, FSIsolation: driver.FSIsolationNone}
+}
+
+func (d *sleepDriver) Cleanup(activeHandleIDs []string) error {
+	return nil
+}
+
+func (d *sleepDriver) HandleVersion() int {
+	v, _ := strconv.Atoi(os.Getenv(handleVersionEnv))
+	return v
+}
+
+func (d *sleepDriver) MinHandleVersion() int {
+	v, _ := strconv.Atoi(os.Getenv(minHandleVersionEnv))
+	return v
+}
+
+func (d *sleepDriver) Start(ctx context.Context, execCtx *driver.ExecContext, task *structs.Task) (driver.DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
+	}
+	duration, _ := time.ParseDuration(task.Config["duration"])
+	code, _ := strconv.Atoi(task.Config["exit_code"])
+	return newSleepHandle(sleepTask{
+		End:      time.Now().Add(duration),
+		ExitCode: code,
+		Crash:    task.Config["crash"] == "true",
+	}), nil
+}
+
+func (d *sleepDriver) Open(ctx context.Context, execCtx *driver.ExecContext, handleID string) (driver.DriverHandle, error) {
+	var task sleepTask
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(handleID, "SLEEP:")), &task); err != nil {
+		return nil, fmt.Errorf("failed to parse handle '%s': %v", handleID, err)
+	}
+	return newSleepHandle(task), nil
+}
+
+func newSleepHandle(task sleepTask) *sleepHandle {
+	h := &sleepHandle{
+		task:   task,
+		timer:  time.NewTimer(task.End.Sub(time.Now())),
+		killCh: make(chan struct{}),
+		waitCh: make(chan *driver.WaitResult, 1),
+	}
+	go h.run()
+	return h
+}
+
+func (h *sleepHandle) run() {
+	select {
+	case <-h.timer.C:
+		if h.task.Crash {
+			os.Exit(2)
+		}
+		h.waitCh <- driver.NewWaitResult(h.task.ExitCode, 0, nil)
+	case <-h.killCh:
+		h.waitCh <- driver.NewWaitResult(0, 0, fmt.Errorf("task killed"))
+	}
+	close(h.waitCh)
+}
+
+func (h *sleepHandle) ID() string {
+	data, _ := json.Marshal(h.task)
+	return "SLEEP:" + string(data)
+}
+
+func (h *sleepHandle) WaitCh() chan *driver.WaitResult {
+	return h.waitCh
+}
+
+func (h *sleepHandle) Update(task *structs.Task) error {
+	return nil
+}
+
+func (h *sleepHandle) Kill() error {
+	h.once.Do(func() { close(h.killCh) })
+	return nil
+}
+
+func (h *sleepHandle) ForceKill() error {
+	return h.Kill()
+}
+
+func (h *sleepHandle) Stats() (*driver.TaskResourceUsage, error) {
+	return nil, &driver.NotSupportedError{Driver: "sleep", Operation: "stats"}
+}
+
+func (h *sleepHandle) Signal(sig os.Signal) error {
+	return &driver.NotSupportedError{Driver: "sleep", Operation: "signals"}
+}
+
+// Exec echoes the command, as there is nothing to run it in
+func (h *sleepHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	return []byte(strings.Join(cmd, " ")), 0, nil
+}
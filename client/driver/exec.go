@@ -1,8 +1,16 @@
 package driver
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,10 +25,87 @@ type ExecDriver struct {
 	DriverContext
 }
 
+// execHandleVersion is the version of the encoding of exec handles. Their
+// handle was the ID of the executor in version 1 and is an execID since
+// version 2.
+const execHandleVersion = 2
+
+// execID is the handle of an exec task. Besides the ID of the executor it
+// records the identity of the process of the executor, so that a PID recycled
+// while the client was down is not mistaken for the task. The process is nil
+// if its identity could not be read when the task was started.
+type execID struct {
+	ExecutorID string
+	Process    *processIdentity
+}
+
+// processIdentity tells a process apart from those later given the same PID:
+// its start time, the inodes of its namespaces by type, such as "mnt" or
+// "pid", and the cgroups it is in as listed by the kernel. The namespaces and
+// cgroups are only known on Linux.
+type processIdentity struct {
+	Pid        int
+	StartTime  string
+	Namespaces map[string]uint64 `json:",omitempty"`
+	Cgroup     string            `json:",omitempty"`
+}
+
+// readProcessIdentity returns the identity of the process with the PID
+func readProcessIdentity(pid int) (*processIdentity, error) {
+	startTime, err := processStartTime(pid)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := processNamespaces(pid)
+	if err != nil {
+		return nil, err
+	}
+	cgroup, err := processCgroup(pid)
+	if err != nil {
+		return nil, err
+	}
+	return &processIdentity{Pid: pid, StartTime: startTime, Namespaces: namespaces, Cgroup: cgroup}, nil
+}
+
+// verify returns a TaskLostError unless the process with the PID is still the
+// one identified
+func (p *processIdentity) verify() error {
+	cur, err := readProcessIdentity(p.Pid)
+	if err != nil {
+		return &TaskLostError{Reason: fmt.Sprintf("failed to find PID %d: %v", p.Pid, err)}
+	}
+	if cur.StartTime != p.StartTime {
+		return &TaskLostError{Reason: fmt.Sprintf("PID %d no longer belongs to the task", p.Pid)}
+	}
+	for ns, inode := range p.Namespaces {
+		if cur.Namespaces[ns] != inode {
+			return &TaskLostError{Reason: fmt.Sprintf("PID %d no longer belongs to the task, it is in another %s namespace", p.Pid, ns)}
+		}
+	}
+	if cur.Cgroup != p.Cgroup {
+		return &TaskLostError{Reason: fmt.Sprintf("PID %d no longer belongs to the task, it is in other cgroups", p.Pid)}
+	}
+	return nil
+}
+
 // execHandle is returned from Start/Open as a handle to the PID
 type execHandle struct {
-	cmd    executor.Executor
-	waitCh chan error
+	cmd executor.Executor
+
+	// process is the identity of the process of the executor, if known
+	process *processIdentity
+
+	// taskDir is the chroot of the task and env its environment, which
+	// commands exec'd into the task run with
+	taskDir string
+	env     []string
+
+	// cores are the CPU cores the task is pinned to, released to the
+	// allocator once it exits
+	cores     []int
+	allocator config.CoreAllocator
+
+	waitCh chan *WaitResult
 	doneCh chan struct{}
 }
 
@@ -40,15 +125,132 @@ func (d *ExecDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool,
 	return true, nil
 }
 
-func (d *ExecDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
-	// Get the command
-	command, ok := task.Config["command"]
-	if !ok || command == "" {
-		return nil, fmt.Errorf("missing command for exec driver")
+// Version is not supported as tasks run directly on the host
+func (d *ExecDriver) Version() (string, error) {
+	return "", &NotSupportedError{Driver: "exec", Operation: "version"}
+}
+
+func (d *ExecDriver) Capabilities() *DriverCapabilities {
+	// Tasks are only chrooted on Linux
+	fs := FSIsolationNone
+	if runtime.GOOS == "linux" {
+		fs = FSIsolationChroot
+	}
+	return &DriverCapabilities{
+		Exec:         true,
+		Signals:      true,
+		FSIsolation:  fs,
+		NetworkModes: []string{NetworkModeHost},
+	}
+}
+
+// Cleanup kills the tasks left in cgroups that none of the exec and java
+// handles reference, as both run their tasks with the executor, and unmounts
+// their chroots. Tasks that ran without cgroups are only known by the PID in
+// their handle, so those whose handle was lost can't be found.
+func (d *ExecDriver) Cleanup(activeHandleIDs []string) error {
+	ids, err := executorIDs(activeHandleIDs)
+	if err != nil {
+		return fmt.Errorf("Not reaping orphaned cgroups: %v", err)
+	}
+	return executor.ReapOrphanedCgroups(d.config.AllocDir, ids)
+}
+
+// executorIDs returns the IDs of the executors of the exec and java handles.
+// Their handles of before versioning are the executor ID itself. An exec or
+// java handle that can't be parsed may reference any cgroup, so an error is
+// returned then.
+func executorIDs(handleIDs []string) ([]string, error) {
+	var ids []string
+	for _, handleID := range handleIDs {
+		switch {
+		case strings.HasPrefix(handleID, "exec:"):
+			handle, version, err := parseHandleID(handleID, "exec", "", execHandleVersion)
+			if err != nil {
+				return nil, fmt.Errorf("unable to tell the executor of a handle: %v", err)
+			}
+			id := &execID{ExecutorID: handle}
+			if version >= 2 {
+				id = &execID{}
+				if err := json.Unmarshal([]byte(handle), id); err != nil {
+					return nil, fmt.Errorf("unable to tell the executor of handle '%s': %v", handleID, err)
+				}
+			}
+			ids = append(ids, id.ExecutorID)
+		case strings.HasPrefix(handleID, "java:"):
+			handle, _, err := parseHandleID(handleID, "java", "", javaHandleVersion)
+			if err != nil {
+				return nil, fmt.Errorf("unable to tell the executor of a handle: %v", err)
+			}
+			ids = append(ids, handle)
+		case !versionedHandleID.MatchString(handleID):
+			ids = append(ids, handleID)
+		}
+	}
+	return ids, nil
+}
+
+// Validate checks that the task has a command to run
+func (d *ExecDriver) Validate(task *structs.Task) error {
+	if task.Config["command"] == "" {
+		return fmt.Errorf("missing command for exec driver: set 'command' in the task config")
+	}
+	if pin := task.Config["pin_cpus"]; pin != "" {
+		if _, err := strconv.ParseBool(pin); err != nil {
+			return fmt.Errorf("invalid pin_cpus %q: %v", pin, err)
+		}
+	}
+	if image := task.Config["image"]; image != "" {
+		clean := filepath.Clean(image)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("invalid image %q: must be a directory within the task directory", image)
+		}
+	}
+	return nil
+}
+
+// pinCores claims dedicated cores for the task if its config asks for them
+// with pin_cpus, as many as its CPU resources need. Nil is returned for a
+// task that is not pinned.
+func (d *ExecDriver) pinCores(task *structs.Task) ([]int, error) {
+	if pin, _ := strconv.ParseBool(task.Config["pin_cpus"]); !pin {
+		return nil, nil
+	}
+	if d.config.CoreAllocator == nil {
+		return nil, fmt.Errorf("client does not pin tasks to cores")
+	}
+	n, err := taskCores(d.node, task.Resources)
+	if err != nil {
+		return nil, err
+	}
+	cores, err := d.config.CoreAllocator.Allocate(n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pin task to %d cores: %v", n, err)
+	}
+	return cores, nil
+}
+
+func (d *ExecDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
 	}
+	command := task.Config["command"]
 
 	// Get the environment variables.
-	envVars := TaskEnvironmentVariables(ctx, task)
+	envVars := TaskEnvironmentVariables(execCtx, task)
+
+	// Claim the cores the task is pinned to, releasing them if it fails to
+	// start
+	cores, err := d.pinCores(task)
+	if err != nil {
+		return nil, err
+	}
+	started := false
+	defer func() {
+		if cores != nil && !started {
+			d.config.CoreAllocator.Release(cores)
+		}
+	}()
 
 	// Look for arguments
 	var args []string
@@ -61,51 +263,154 @@ func (d *ExecDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle,
 	if err := cmd.Limit(task.Resources); err != nil {
 		return nil, fmt.Errorf("failed to constrain resources: %s", err)
 	}
+	if cores != nil {
+		cpuset := formatCpuset(cores)
+		cmd.Command().Cpuset = cpuset
+		envVars.SetCpuset(cpuset)
+		d.logger.Printf("[DEBUG] driver.exec: pinning task '%s' to CPUs %s", d.taskName, cpuset)
+	}
 
 	// Populate environment variables
 	cmd.Command().Env = envVars.List()
+	cmd.Command().RunAs = task.User
+	cmd.Command().RunAsGroup = task.Group
 
-	if err := cmd.ConfigureTaskDir(d.taskName, ctx.AllocDir); err != nil {
+	// Mount the host volumes into the chroot of the task
+	volumes, err := d.taskVolumes(task)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Command().Volumes = volumes
+	cmd.Command().ChrootEnv = d.config.ChrootEnv
+
+	// A task run from an image, typically fetched as an artifact, is rooted
+	// in the filesystem assembled from it
+	root := execCtx.TaskChroot(d.taskName)
+	if image := task.Config["image"]; image != "" {
+		cmd.Command().Image = filepath.Join(root, image)
+		root = filepath.Join(root, executor.ImageRootDir)
+	}
+
+	// Capture the output into rotated files in the alloc dir, forwarding it to
+	// syslog if configured
+	logConfig := task.LogConfig
+	if logConfig == nil {
+		logConfig = structs.DefaultLogConfig()
+	}
+	stdout, stderr := execCtx.LogPaths(d.taskName)
+	cmd.Command().Logs = &executor.LogConfig{
+		StdoutPath:   stdout,
+		StderrPath:   stderr,
+		MaxFiles:     logConfig.MaxFiles,
+		MaxFileSize:  int64(logConfig.MaxFileSizeMB) * 1024 * 1024,
+		Syslog:       taskSyslog(task),
+		DisableFiles: logConfig.Syslog != nil && logConfig.Syslog.DisableFiles,
+	}
+
+	if err := cmd.ConfigureTaskDir(d.taskName, execCtx.AllocDir); err != nil {
+		d.cleanChroot(execCtx)
 		return nil, fmt.Errorf("failed to configure task directory: %v", err)
 	}
 
 	if err := cmd.Start(); err != nil {
+		d.cleanChroot(execCtx)
 		return nil, fmt.Errorf("failed to start command: %v", err)
 	}
 
+	// Record the identity of the process so it can be verified when it is
+	// reopened
+	var process *processIdentity
+	if pid, err := cmd.Pid(); err == nil {
+		if process, err = readProcessIdentity(pid); err != nil {
+			d.logger.Printf("[WARN] driver.exec: failed to read the identity of pid %d: %v", pid, err)
+		}
+	}
+
 	// Return a driver handle
+	started = true
 	h := &execHandle{
-		cmd:    cmd,
-		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		cmd:       cmd,
+		process:   process,
+		taskDir:   root,
+		env:       cmd.Command().Env,
+		cores:     cores,
+		allocator: d.config.CoreAllocator,
+		doneCh:    make(chan struct{}),
+		waitCh:    make(chan *WaitResult, 1),
 	}
 	go h.run()
 	return h, nil
 }
 
-func (d *ExecDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+func (d *ExecDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
+	// Parse the handle
+	handle, version, err := parseHandleID(handleID, "exec", "", execHandleVersion)
+	if err != nil {
+		d.cleanChroot(execCtx)
+		return nil, err
+	}
+	id := &execID{ExecutorID: handle}
+	if version >= 2 {
+		id = &execID{}
+		if err := json.Unmarshal([]byte(handle), id); err != nil {
+			d.cleanChroot(execCtx)
+			return nil, fmt.Errorf("failed to parse exec handle '%s': %v", handleID, err)
+		}
+	}
+
+	// Make sure the PID still belongs to the process that was started, as
+	// the executor would otherwise adopt, or kill, whichever process was
+	// given the PID since. Handles of version 1 can't be verified.
+	if id.Process != nil {
+		if err := id.Process.verify(); err != nil {
+			d.cleanChroot(execCtx)
+			return nil, err
+		}
+	}
+
 	// Find the process
-	cmd, err := executor.OpenId(handleID)
+	cmd, err := executor.OpenId(id.ExecutorID)
 	if err != nil {
+		// The task won't be waited on, so nothing else would unmount the
+		// chroot it was started in before the client restarted
+		d.cleanChroot(execCtx)
 		return nil, fmt.Errorf("failed to open ID %v: %v", handleID, err)
 	}
 
 	// Return a driver handle
 	h := &execHandle{
-		cmd:    cmd,
-		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		cmd:     cmd,
+		process: id.Process,
+		taskDir: execCtx.TaskChroot(d.taskName),
+		doneCh:  make(chan struct{}),
+		waitCh:  make(chan *WaitResult, 1),
 	}
 	go h.run()
 	return h, nil
 }
 
+// cleanChroot unmounts the chroot of a task that is not running. Failures are
+// only logged as the task has already failed.
+func (d *ExecDriver) cleanChroot(ctx *ExecContext) {
+	root := ctx.TaskChroot(d.taskName)
+	if root == "" {
+		return
+	}
+	if err := executor.CleanTaskDir(root); err != nil {
+		d.logger.Printf("[ERR] driver.exec: failed to clean up the chroot of task '%s': %v", d.taskName, err)
+	}
+}
+
 func (h *execHandle) ID() string {
-	id, _ := h.cmd.ID()
-	return id
+	executorID, _ := h.cmd.ID()
+	data, err := json.Marshal(&execID{ExecutorID: executorID, Process: h.process})
+	if err != nil {
+		log.Printf("[ERR] driver.exec: failed to marshal the handle to JSON: %s", err)
+	}
+	return formatHandleID("exec", execHandleVersion, string(data))
 }
 
-func (h *execHandle) WaitCh() chan error {
+func (h *execHandle) WaitCh() chan *WaitResult {
 	return h.waitCh
 }
 
@@ -115,20 +420,35 @@ func (h *execHandle) Update(task *structs.Task) error {
 }
 
 func (h *execHandle) Kill() error {
-	h.cmd.Shutdown()
-	select {
-	case <-h.doneCh:
-		return nil
-	case <-time.After(5 * time.Second):
-		return h.cmd.ForceStop()
-	}
+	return h.cmd.Shutdown()
+}
+
+func (h *execHandle) ForceKill() error {
+	return h.cmd.ForceStop()
+}
+
+func (h *execHandle) Stats() (*TaskResourceUsage, error) {
+	return nil, &NotSupportedError{Driver: "exec", Operation: "stats"}
+}
+
+func (h *execHandle) Signal(sig os.Signal) error {
+	return h.cmd.Signal(sig)
+}
+
+// Exec runs the command within the chroot of the task.
+func (h *execHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Env = h.env
+	chrootCmd(c, h.taskDir)
+	return runExec(c, timeout)
 }
 
 func (h *execHandle) run() {
 	err := h.cmd.Wait()
-	close(h.doneCh)
-	if err != nil {
-		h.waitCh <- err
+	if h.cores != nil {
+		h.allocator.Release(h.cores)
 	}
+	close(h.doneCh)
+	h.waitCh <- waitResult(err)
 	close(h.waitCh)
 }
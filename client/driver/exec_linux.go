@@ -0,0 +1,48 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// namespaceTypes are the types of the namespaces that identify a process
+var namespaceTypes = []string{"ipc", "mnt", "net", "pid", "user", "uts"}
+
+// processNamespaces returns the inodes of the namespaces of the process by
+// type. Types the kernel doesn't have are left out.
+func processNamespaces(pid int) (map[string]uint64, error) {
+	dir := fmt.Sprintf("/proc/%d/ns", pid)
+	if _, err := os.Stat(dir); err != nil {
+		return nil, err
+	}
+
+	namespaces := make(map[string]uint64, len(namespaceTypes))
+	for _, ns := range namespaceTypes {
+		// The link reads as the type and the inode, e.g. "mnt:[4026531840]"
+		link, err := os.Readlink(fmt.Sprintf("%s/%s", dir, ns))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		inode := strings.TrimSuffix(strings.TrimPrefix(link, ns+":["), "]")
+		namespaces[ns], err = strconv.ParseUint(inode, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("malformed %s namespace '%s' of pid %d", ns, link, pid)
+		}
+	}
+	return namespaces, nil
+}
+
+// processCgroup returns the cgroups of the process as listed by the kernel.
+func processCgroup(pid int) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
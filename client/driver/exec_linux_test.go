@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"syscall"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestProcessIdentity(t *testing.T) {
+	id, err := readProcessIdentity(os.Getpid())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if id.StartTime == "" || id.Cgroup == "" {
+		t.Fatalf("incomplete identity: %#v", id)
+	}
+	for _, ns := range []string{"mnt", "pid"} {
+		if id.Namespaces[ns] == 0 {
+			t.Fatalf("missing %s namespace: %#v", ns, id.Namespaces)
+		}
+	}
+	if err := id.verify(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecDriver_Open_RecycledPid(t *testing.T) {
+	// A process given the PID of the task while the client was down
+	cmd := exec.Command("/bin/sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cmd.Process.Kill()
+	pid := cmd.Process.Pid
+
+	spoofs := map[string]func(*processIdentity){
+		"start time": func(p *processIdentity) { p.StartTime += "1" },
+		"namespace":  func(p *processIdentity) { p.Namespaces["mnt"]++ },
+		"cgroup":     func(p *processIdentity) { p.Cgroup += "/task" },
+		"gone":       func(p *processIdentity) { p.Pid = 1 << 30 },
+	}
+	for name, spoof := range spoofs {
+		process, err := readProcessIdentity(pid)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		spoof(process)
+		data, err := json.Marshal(&execID{ExecutorID: "{}", Process: process})
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		task := &structs.Task{Name: "sleep", Resources: basicResources}
+		driverCtx := testDriverContext(task.Name)
+		ctx := testDriverExecContext(task, driverCtx)
+		d := NewExecDriver(driverCtx)
+		_, err = d.Open(context.Background(), ctx, formatHandleID("exec", execHandleVersion, string(data)))
+		ctx.AllocDir.Destroy()
+		if _, ok := err.(*TaskLostError); !ok {
+			t.Fatalf("%s: got %v; want a TaskLostError", name, err)
+		}
+
+		// The process holding the PID is left alone
+		if err := cmd.Process.Signal(syscall.Signal(0)); err != nil {
+			t.Fatalf("%s: process was signalled: %v", name, err)
+		}
+	}
+}
@@ -1,21 +1,90 @@
 package driver
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
+	"os"
 	"path/filepath"
 	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver/environment"
+	"github.com/hashicorp/nomad/client/executor"
 	"github.com/hashicorp/nomad/nomad/structs"
 
 	ctestutils "github.com/hashicorp/nomad/client/testutil"
 )
 
+func TestExecDriver_Validate(t *testing.T) {
+	d := NewExecDriver(testDriverContext("sleep"))
+	task := &structs.Task{
+		Name:      "sleep",
+		Config:    map[string]string{"command": "/bin/sleep", "args": "1"},
+		Resources: basicResources,
+	}
+	if err := d.Validate(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	task.Config = map[string]string{"args": "1"}
+	if err := d.Validate(task); err == nil || !strings.Contains(err.Error(), "missing command") {
+		t.Fatalf("expected missing command: %v", err)
+	}
+
+	task.Config = map[string]string{"command": "/bin/sleep", "pin_cpus": "sometimes"}
+	if err := d.Validate(task); err == nil || !strings.Contains(err.Error(), "invalid pin_cpus") {
+		t.Fatalf("expected invalid pin_cpus: %v", err)
+	}
+	for _, image := range []string{"/srv/rootfs", "../other/rootfs", "local/../../rootfs"} {
+		task.Config = map[string]string{"command": "/bin/sleep", "image": image}
+		if err := d.Validate(task); err == nil || !strings.Contains(err.Error(), "invalid image") {
+			t.Fatalf("%s: expected invalid image: %v", image, err)
+		}
+	}
+	task.Config = map[string]string{"args": "1"}
+
+	// Invalid tasks are rejected before anything is run
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	if _, err := d.Start(context.Background(), ctx, task); err == nil || !strings.Contains(err.Error(), "missing command") {
+		t.Fatalf("expected missing command: %v", err)
+	}
+}
+
+func TestExecDriver_ExecutorIDs(t *testing.T) {
+	handleIDs := []string{
+		`exec:v2:{"ExecutorID":"CGROUP:{\"name\":\"a\"}","Process":{"Pid":1,"StartTime":"42"}}`,
+		"exec:v1:PID:123",
+		"java:v1:CGROUP:{}",
+		"PID:124",
+		`docker:v1:{"ContainerID":"abc"}`,
+	}
+	ids, err := executorIDs(handleIDs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []string{`CGROUP:{"name":"a"}`, "PID:123", "CGROUP:{}", "PID:124"}
+	if !reflect.DeepEqual(ids, exp) {
+		t.Fatalf("got %v; want %v", ids, exp)
+	}
+
+	// A handle that can't be parsed may reference any cgroup
+	for _, handleID := range []string{"exec:v3:PID:1", "exec:v2:garbage", "java:v2:PID:1"} {
+		if ids, err := executorIDs(append(handleIDs, handleID)); err == nil {
+			t.Fatalf("%s: expected error, got %v", handleID, ids)
+		}
+	}
+}
+
 func TestExecDriver_Fingerprint(t *testing.T) {
 	ctestutils.ExecCompatible(t)
 	d := NewExecDriver(testDriverContext(""))
@@ -61,7 +130,7 @@ func TestExecDriver_StartOpen_Wait(t *testing.T) {
 	task.Resources.CPU = 0.5
 	task.Resources.MemoryMB = 2
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -70,7 +139,7 @@ func TestExecDriver_StartOpen_Wait(t *testing.T) {
 	}
 
 	// Attempt to open
-	handle2, err := d.Open(ctx, handle.ID())
+	handle2, err := d.Open(context.Background(), ctx, handle.ID())
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -96,7 +165,7 @@ func TestExecDriver_Start_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewExecDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -112,15 +181,52 @@ func TestExecDriver_Start_Wait(t *testing.T) {
 
 	// Task should terminate quickly
 	select {
-	case err := <-handle.WaitCh():
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
 		}
 	case <-time.After(2 * time.Second):
 		t.Fatalf("timeout")
 	}
 }
 
+func TestExecDriver_Start_Open(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+
+	// The handle is reopened from its ID, as is the bare executor ID older
+	// clients saved
+	testOpenHandleID(t, d, ctx, "exec", handle)
+	legacyID := strings.TrimPrefix(handle.ID(), "exec:v1:")
+	if _, err := d.Open(context.Background(), ctx, legacyID); err != nil {
+		t.Fatalf("failed to open legacy ID %q: %v", legacyID, err)
+	}
+
+	if _, err := d.Open(context.Background(), ctx, "exec:v2:"+legacyID); err == nil {
+		t.Fatalf("should not open a handle of a newer version")
+	} else if _, ok := err.(*IncompatibleHandleError); !ok {
+		t.Fatalf("bad error: %v", err)
+	}
+}
+
 func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
 	ctestutils.ExecCompatible(t)
 
@@ -140,7 +246,7 @@ func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewExecDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -150,9 +256,9 @@ func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
 
 	// Task should terminate quickly
 	select {
-	case err := <-handle.WaitCh():
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
 		}
 	case <-time.After(2 * time.Second):
 		t.Fatalf("timeout")
@@ -170,6 +276,364 @@ func TestExecDriver_Start_Wait_AllocDir(t *testing.T) {
 	}
 }
 
+func TestExecDriver_Start_Wait_Volumes(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	source, err := ioutil.TempDir("", "nomad-volume")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(source)
+	exp := []byte{'w', 'i', 'n'}
+	if err := ioutil.WriteFile(filepath.Join(source, "input.txt"), exp, 0666); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	file := "output.txt"
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/bash",
+			"args":    fmt.Sprintf("-c \"cat /data/input.txt > $%s/%s\"", environment.AllocDir, file),
+		},
+		Volumes:   []*structs.TaskVolume{{Source: source, Destination: "/data", ReadOnly: true}},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	driverCtx.config.VolumeWhitelist = []string{source}
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task read the file through the mounted volume
+	outputFile := filepath.Join(ctx.AllocDir.AllocDir, allocdir.SharedAllocName, file)
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("Command outputted %v; want %v", act, exp)
+	}
+
+	// The volume is unmounted once the task exits
+	if _, err := os.Stat(filepath.Join(ctx.AllocDir.TaskDirs[task.Name], "data", "input.txt")); !os.IsNotExist(err) {
+		t.Fatalf("volume still mounted: %v", err)
+	}
+}
+
+func TestExecDriver_Start_Volumes_Denied(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+		},
+		Volumes:   []*structs.TaskVolume{{Source: "/etc", Destination: "/etc"}},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	if _, err := d.Start(context.Background(), ctx, task); err == nil || !strings.Contains(err.Error(), "not within the allowed volume paths") {
+		t.Fatalf("expected denied volume: %v", err)
+	}
+}
+
+func TestExecDriver_Start_Wait_Chroot(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	// A host directory that is not part of the chroot
+	hidden, err := ioutil.TempDir("", "nomad-hidden")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(hidden)
+
+	file := "output.txt"
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/bash",
+			"args":    fmt.Sprintf("-c \"test -d %s || echo -n isolated > $%s/%s\"", hidden, environment.AllocDir, file),
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	outputFile := filepath.Join(ctx.AllocDir.AllocDir, allocdir.SharedAllocName, file)
+	act, err := ioutil.ReadFile(outputFile)
+	if err != nil {
+		t.Fatalf("Couldn't read expected output: %v", err)
+	}
+	if string(act) != "isolated" {
+		t.Fatalf("task could see the host directory %s", hidden)
+	}
+
+	// The chroot is unmounted once the task exits
+	if mounts := chrootMounts(t, ctx.TaskChroot(task.Name)); len(mounts) != 0 {
+		t.Fatalf("mounts left in chroot: %v", mounts)
+	}
+}
+
+func TestExecDriver_Open_CleanChroot(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	// Leave the chroot mounted as if the client restarted while the task was
+	// running
+	cmd := executor.Command("/bin/sleep", "1")
+	if err := cmd.ConfigureTaskDir(task.Name, ctx.AllocDir); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	root := ctx.TaskChroot(task.Name)
+	if mounts := chrootMounts(t, root); len(mounts) == 0 {
+		t.Fatalf("chroot not mounted")
+	}
+
+	// Reopening fails, and must not leak the mounts
+	if _, err := d.Open(context.Background(), ctx, "PID:2147483647"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if mounts := chrootMounts(t, root); len(mounts) != 0 {
+		t.Fatalf("mounts left in chroot: %v", mounts)
+	}
+}
+
+func TestExecDriver_Open_CleanImage(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+			"image":   "local/image",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	// Leave the image root mounted as if the client restarted while the
+	// task was running
+	root := ctx.TaskChroot(task.Name)
+	image := filepath.Join(root, "local", "image")
+	if err := os.MkdirAll(image, 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	cmd := executor.Command("/bin/sleep", "1")
+	cmd.Command().Image = image
+	if err := cmd.ConfigureTaskDir(task.Name, ctx.AllocDir); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mounts := chrootMounts(t, filepath.Join(root, executor.ImageRootDir)); len(mounts) == 0 {
+		t.Fatalf("image root not mounted")
+	}
+
+	// Reopening fails, and must not leak the image root or its mounts
+	if _, err := d.Open(context.Background(), ctx, "PID:2147483647"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if mounts := chrootMounts(t, root); len(mounts) != 0 {
+		t.Fatalf("mounts left in chroot: %v", mounts)
+	}
+}
+
+func TestExecDriver_Start_Image_Missing(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+			"image":   "local/missing",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	// The task fails to start without leaving anything mounted
+	if _, err := d.Start(context.Background(), ctx, task); err == nil || !strings.Contains(err.Error(), "image") {
+		t.Fatalf("expected missing image error: %v", err)
+	}
+	if mounts := chrootMounts(t, ctx.TaskChroot(task.Name)); len(mounts) != 0 {
+		t.Fatalf("mounts left in chroot: %v", mounts)
+	}
+}
+
+// chrootMounts returns the mount points within the chroot other than the
+// shared alloc dir and the secrets dir
+func chrootMounts(t *testing.T, root string) []string {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	shared := filepath.Join(root, allocdir.SharedAllocName)
+	secrets := filepath.Join(root, allocdir.TaskSecrets)
+	var mounts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] == shared || fields[4] == secrets {
+			continue
+		}
+		if strings.HasPrefix(fields[4], root+"/") {
+			mounts = append(mounts, fields[4])
+		}
+	}
+	return mounts
+}
+
+func TestExecDriver_Start_Wait_Logs(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/bash",
+			"args":    "-c \"echo -n out; echo -n err 1>&2\"",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Check that the output was captured in the first log files
+	stdout, stderr := ctx.LogPaths(task.Name)
+	for path, exp := range map[string]string{stdout: "out", stderr: "err"} {
+		act, err := ioutil.ReadFile(path + ".0")
+		if err != nil {
+			t.Fatalf("Couldn't read log file: %v", err)
+		}
+		if string(act) != exp {
+			t.Fatalf("Log file %s contains %q; want %q", path, act, exp)
+		}
+	}
+}
+
+func TestExecDriver_Start_Wait_User(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	daemon, err := executor.LookupTaskUser("daemon", "")
+	if err != nil {
+		t.Skipf("no daemon user: %v", err)
+	}
+
+	task := &structs.Task{
+		Name:  "id",
+		User:  "daemon",
+		Group: "0",
+		Config: map[string]string{
+			"command": "/bin/bash",
+			"args":    "-c \"id -u; id -g\"",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task ran as daemon in the root group rather than as nobody
+	stdout, _ := ctx.LogPaths(task.Name)
+	act, err := ioutil.ReadFile(stdout + ".0")
+	if err != nil {
+		t.Fatalf("Couldn't read log file: %v", err)
+	}
+	if exp := fmt.Sprintf("%d\n0\n", daemon.Uid); string(act) != exp {
+		t.Fatalf("Task ran as %q; want %q", act, exp)
+	}
+}
+
 func TestExecDriver_Start_Kill_Wait(t *testing.T) {
 	ctestutils.ExecCompatible(t)
 	task := &structs.Task{
@@ -186,7 +650,7 @@ func TestExecDriver_Start_Kill_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewExecDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -204,11 +668,253 @@ func TestExecDriver_Start_Kill_Wait(t *testing.T) {
 
 	// Task should terminate quickly
 	select {
-	case err := <-handle.WaitCh():
-		if err == nil {
+	case res := <-handle.WaitCh():
+		if res.Successful() {
 			t.Fatal("should err")
 		}
 	case <-time.After(2 * time.Second):
 		t.Fatalf("timeout")
 	}
 }
+
+func TestExecDriver_Start_Wait_OOM(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limits are only enforced on Linux")
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/memory"); err != nil {
+		t.Skip("memory cgroup not available")
+	}
+
+	// tail buffers /dev/zero looking for a newline until it is killed
+	task := &structs.Task{
+		Name: "hog",
+		Config: map[string]string{
+			"command": "/usr/bin/tail",
+			"args":    "/dev/zero",
+		},
+		Resources: &structs.Resources{
+			CPU:      100,
+			MemoryMB: 16,
+		},
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if _, ok := res.Err.(*executor.OOMKilledError); !ok {
+			t.Fatalf("expected an OOM kill; got %v", res)
+		}
+	case <-time.After(10 * time.Second):
+		handle.ForceKill()
+		t.Fatalf("task was not killed at its memory limit")
+	}
+}
+
+// testCoreAllocator hands out cores in order, tracking the claimed ones
+type testCoreAllocator struct {
+	lock    sync.Mutex
+	next    int
+	claimed map[int]bool
+}
+
+func (a *testCoreAllocator) Allocate(n int) ([]int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	var cores []int
+	for i := 0; i < n; i++ {
+		cores = append(cores, a.next)
+		a.claimed[a.next] = true
+		a.next++
+	}
+	return cores, nil
+}
+
+func (a *testCoreAllocator) Reserve(cores []int) error {
+	return fmt.Errorf("not supported")
+}
+
+func (a *testCoreAllocator) Release(cores []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, c := range cores {
+		delete(a.claimed, c)
+	}
+}
+
+func (a *testCoreAllocator) numClaimed() int {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.claimed)
+}
+
+func TestExecDriver_ResourceCeiling(t *testing.T) {
+	cfg := testConfig()
+	cfg.ResourceCeilings = map[string]*config.ResourceCeiling{
+		"exec": {CPU: 500, MemoryMB: 256},
+	}
+	task := &structs.Task{
+		Name:      "sleep",
+		Driver:    "exec",
+		Config:    map[string]string{"command": "/bin/sleep", "args": "1"},
+		Resources: &structs.Resources{CPU: 500, MemoryMB: 256},
+	}
+
+	// A task up to the ceiling is accepted
+	if err := CheckResourceCeiling("exec", cfg, task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A task above it is refused, naming what it asked for
+	task.Resources.MemoryMB = 1024
+	err := CheckResourceCeiling("exec", cfg, task)
+	if err == nil || !strings.Contains(err.Error(), "1024 MB of memory, more than the 256 MB allowed for driver 'exec'") {
+		t.Fatalf("expected memory above ceiling: %v", err)
+	}
+	task.Resources.MemoryMB = 256
+	task.Resources.CPU = 2000
+	if err := CheckResourceCeiling("exec", cfg, task); err == nil || !strings.Contains(err.Error(), "2000 MHz of CPU") {
+		t.Fatalf("expected CPU above ceiling: %v", err)
+	}
+
+	// Unset ceilings leave the resource unbounded
+	cfg.ResourceCeilings["exec"].CPU = 0
+	if err := CheckResourceCeiling("exec", cfg, task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	task.Resources.MemoryMB = 1024
+	if err := CheckResourceCeiling("raw_exec", cfg, task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestExecDriver_Start_Wait_Cpuset(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	if runtime.GOOS != "linux" {
+		t.Skip("tasks are only pinned to cores on Linux")
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/cpuset"); err != nil {
+		t.Skip("cpuset cgroup not available")
+	}
+
+	task := &structs.Task{
+		Name: "pinned",
+		Config: map[string]string{
+			"command":  "/bin/bash",
+			"args":     "-c \"grep Cpus_allowed_list /proc/self/status; echo cpuset: $NOMAD_CPUSET\"",
+			"pin_cpus": "true",
+		},
+		Resources: &structs.Resources{
+			CPU:      1000,
+			MemoryMB: 256,
+		},
+	}
+
+	allocator := &testCoreAllocator{claimed: make(map[int]bool)}
+	driverCtx := testDriverContext(task.Name)
+	driverCtx.config.CoreAllocator = allocator
+	driverCtx.node = &structs.Node{Attributes: map[string]string{"cpu.frequency": "1000"}}
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := allocator.numClaimed(); n != 1 {
+		t.Fatalf("task claimed %d cores; want 1", n)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task only ran on its core and was told about it
+	stdout, _ := ctx.LogPaths(task.Name)
+	out, err := ioutil.ReadFile(stdout + ".0")
+	if err != nil {
+		t.Fatalf("Couldn't read log file: %v", err)
+	}
+	for _, exp := range []string{"Cpus_allowed_list:\t0\n", "cpuset: 0\n"} {
+		if !strings.Contains(string(out), exp) {
+			t.Fatalf("output %q doesn't contain %q", out, exp)
+		}
+	}
+
+	// The core is released once the task exits
+	if n := allocator.numClaimed(); n != 0 {
+		t.Fatalf("%d cores not released", n)
+	}
+}
+
+func TestExecDriver_Start_Signal_Wait(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name: "trap",
+		Config: map[string]string{
+			"command": "/bin/bash",
+			"args":    "-c \"trap 'echo -n hup > local/signal; exit 0' HUP; touch local/ready; while true; do sleep 0.1; done\"",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.ForceKill()
+
+	// Wait for the trap to be installed
+	local := filepath.Join(ctx.AllocDir.TaskDirs[task.Name], allocdir.TaskLocal)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(local, "ready")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("task not started")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := handle.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(local, "signal"))
+	if err != nil {
+		t.Fatalf("signal not received: %v", err)
+	}
+	if string(out) != "hup" {
+		t.Fatalf("bad output: %q", out)
+	}
+}
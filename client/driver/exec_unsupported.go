@@ -0,0 +1,14 @@
+// +build !linux
+
+package driver
+
+// processNamespaces is only implemented on Linux, so reopened exec tasks are
+// verified by their start time alone.
+func processNamespaces(pid int) (map[string]uint64, error) {
+	return nil, nil
+}
+
+// processCgroup is only implemented on Linux.
+func processCgroup(pid int) (string, error) {
+	return "", nil
+}
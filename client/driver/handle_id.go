@@ -0,0 +1,44 @@
+package driver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionedHandleID matches the IDs formatted by formatHandleID
+var versionedHandleID = regexp.MustCompile(`^[a-z_]+:v[0-9]+:`)
+
+// formatHandleID returns the ID of a handle of a built-in driver, made of the
+// name of the driver, the version of the encoding of its handles and the
+// handle itself, such as `exec:v1:PID:1234`. The ID describes itself so a
+// driver can tell a handle it can't read from one it doesn't know.
+func formatHandleID(driver string, version int, handle string) string {
+	return fmt.Sprintf("%s:v%d:%s", driver, version, handle)
+}
+
+// parseHandleID returns the handle encoded in the ID of a handle of the
+// driver, and the version it is encoded with. IDs written before handles
+// were versioned are of version zero and must start with the legacy prefix
+// of the driver, which is stripped. The ID of a handle of another driver is
+// an error, and one of a version above maxVersion an IncompatibleHandleError.
+func parseHandleID(id, driver, legacyPrefix string, maxVersion int) (string, int, error) {
+	prefix := driver + ":v"
+	if !strings.HasPrefix(id, prefix) {
+		if !strings.HasPrefix(id, legacyPrefix) || versionedHandleID.MatchString(id) {
+			return "", 0, fmt.Errorf("handle '%s' is not a handle of the %s driver", id, driver)
+		}
+		return strings.TrimPrefix(id, legacyPrefix), 0, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(id, prefix), ":", 2)
+	version, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || version <= 0 {
+		return "", 0, fmt.Errorf("malformed handle '%s' of the %s driver", id, driver)
+	}
+	if version > maxVersion {
+		return "", 0, &IncompatibleHandleError{Version: version, MaxVersion: maxVersion}
+	}
+	return parts[1], version, nil
+}
@@ -0,0 +1,57 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestHandleID_RoundTrip(t *testing.T) {
+	id := formatHandleID("raw_exec", 2, `{"Pid":1:2}`)
+	if id != `raw_exec:v2:{"Pid":1:2}` {
+		t.Fatalf("bad: %s", id)
+	}
+	handle, version, err := parseHandleID(id, "raw_exec", "RAW_EXEC:", 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle != `{"Pid":1:2}` || version != 2 {
+		t.Fatalf("got %q at version %d", handle, version)
+	}
+}
+
+func TestHandleID_Legacy(t *testing.T) {
+	// IDs saved before versioning are of version zero
+	handle, version, err := parseHandleID(`RAW_EXEC:{"Pid":1}`, "raw_exec", "RAW_EXEC:", 1)
+	if err != nil || handle != `{"Pid":1}` || version != 0 {
+		t.Fatalf("got %q at version %d: %v", handle, version, err)
+	}
+	if _, _, err := parseHandleID(`QEMU:{"Pid":1}`, "raw_exec", "RAW_EXEC:", 1); err == nil {
+		t.Fatalf("expected error for a handle of another driver")
+	}
+
+	// Drivers whose IDs had no prefix take any legacy ID as is
+	handle, version, err = parseHandleID("PID:1234", "exec", "", 1)
+	if err != nil || handle != "PID:1234" || version != 0 {
+		t.Fatalf("got %q at version %d: %v", handle, version, err)
+	}
+	if _, _, err := parseHandleID("java:v1:PID:1234", "exec", "", 1); err == nil {
+		t.Fatalf("expected error for a handle of another driver")
+	}
+}
+
+func TestHandleID_Invalid(t *testing.T) {
+	for _, id := range []string{"exec:v", "exec:v1", "exec:vx:PID:1", "exec:v0:PID:1", "exec:v-1:PID:1", "docker:v1:{}"} {
+		if _, _, err := parseHandleID(id, "exec", "EXEC:", 1); err == nil {
+			t.Fatalf("expected error for %q", id)
+		}
+	}
+
+	// Handles of newer versions can't be read
+	_, _, err := parseHandleID("exec:v3:PID:1", "exec", "", 2)
+	incompatible, ok := err.(*IncompatibleHandleError)
+	if !ok {
+		t.Fatalf("bad error: %v", err)
+	}
+	if incompatible.Version != 3 || incompatible.MaxVersion != 2 {
+		t.Fatalf("bad: %#v", incompatible)
+	}
+}
@@ -2,9 +2,9 @@ package driver
 
 import (
 	"bytes"
+	"context"
 	"fmt"
-	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path"
@@ -17,6 +17,7 @@ import (
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/executor"
+	"github.com/hashicorp/nomad/client/getter"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
@@ -26,10 +27,14 @@ type JavaDriver struct {
 	DriverContext
 }
 
+// javaHandleVersion is the version of the encoding of java handles, whose
+// handle is the ID of the executor
+const javaHandleVersion = 1
+
 // javaHandle is returned from Start/Open as a handle to the PID
 type javaHandle struct {
 	cmd    executor.Executor
-	waitCh chan error
+	waitCh chan *WaitResult
 	doneCh chan struct{}
 }
 
@@ -90,67 +95,123 @@ func (d *JavaDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool,
 	return true, nil
 }
 
-func (d *JavaDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
-	// Get the jar source
-	source, ok := task.Config["jar_source"]
-	if !ok || source == "" {
-		return nil, fmt.Errorf("missing jar source for Java Jar driver")
+// Version returns the version of Java detected when fingerprinting
+func (d *JavaDriver) Version() (string, error) {
+	return d.fingerprintedVersion("java")
+}
+
+func (d *JavaDriver) Capabilities() *DriverCapabilities {
+	// Tasks are only chrooted on Linux
+	fs := FSIsolationNone
+	if runtime.GOOS == "linux" {
+		fs = FSIsolationChroot
 	}
+	return &DriverCapabilities{
+		Signals:      true,
+		FSIsolation:  fs,
+		NetworkModes: []string{NetworkModeHost},
+	}
+}
 
-	// Attempt to download the thing
-	// Should be extracted to some kind of Http Fetcher
-	// Right now, assume publicly accessible HTTP url
-	resp, err := http.Get(source)
+// Cleanup kills the tasks left in cgroups that no handle references, the way
+// the exec driver does as both run their tasks with the executor. Either
+// driver may be the only one available.
+func (d *JavaDriver) Cleanup(activeHandleIDs []string) error {
+	ids, err := executorIDs(activeHandleIDs)
 	if err != nil {
-		return nil, fmt.Errorf("Error downloading source for Java driver: %s", err)
+		return fmt.Errorf("Not reaping orphaned cgroups: %v", err)
+	}
+	return executor.ReapOrphanedCgroups(d.config.AllocDir, ids)
+}
+
+// Validate checks that exactly one of jar_source and jar_path locates the jar
+func (d *JavaDriver) Validate(task *structs.Task) error {
+	source := task.Config["jar_source"]
+	jarPath := task.Config["jar_path"]
+	switch {
+	case source != "" && jarPath != "":
+		return fmt.Errorf("only one of jar_source and jar_path may be set for Java Jar driver")
+	case source != "":
+		if _, err := url.Parse(source); err != nil {
+			return fmt.Errorf("invalid jar_source %q: %v", source, err)
+		}
+	case jarPath != "":
+		rel := filepath.Clean(jarPath)
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("jar_path %q must be relative to the task directory", jarPath)
+		}
+	default:
+		return fmt.Errorf("missing jar source for Java Jar driver: set 'jar_source' or 'jar_path' in the task config")
+	}
+	return nil
+}
+
+func (d *JavaDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
+	}
+
+	// Fail early with a clear error rather than an exec failure
+	if _, err := exec.LookPath("java"); err != nil {
+		return nil, fmt.Errorf("java not found on the host: %v", err)
 	}
 
 	// Get the tasks local directory.
-	taskDir, ok := ctx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	taskDir, ok := execCtx.AllocDir.TaskDirs[d.DriverContext.taskName]
 	if !ok {
 		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
 	}
-	taskLocal := filepath.Join(taskDir, allocdir.TaskLocal)
 
-	// Create a location to download the binary.
-	fName := path.Base(source)
-	fPath := filepath.Join(taskLocal, fName)
-	f, err := os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY, 0666)
+	// Locate the jar, downloading it if it is hosted
+	jarPath, err := d.jarPath(ctx, taskDir, task)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening file to download to: %s", err)
-	}
-
-	defer f.Close()
-	defer resp.Body.Close()
-
-	// Copy remote file to local directory for execution
-	// TODO: a retry of sort if io.Copy fails, for large binaries
-	_, ioErr := io.Copy(f, resp.Body)
-	if ioErr != nil {
-		return nil, fmt.Errorf("Error copying jar from source: %s", ioErr)
+		return nil, err
 	}
 
 	// Get the environment variables.
-	envVars := TaskEnvironmentVariables(ctx, task)
+	envVars := TaskEnvironmentVariables(execCtx, task)
 
-	// Build the argument list.
-	args := []string{"-jar", filepath.Join(allocdir.TaskLocal, fName)}
+	// Build the argument list. JVM options must come before the jar.
+	var args []string
+	if jvmOpts, ok := task.Config["jvm_options"]; ok && jvmOpts != "" {
+		args = append(args, strings.Fields(jvmOpts)...)
+	}
+	if class, ok := task.Config["class"]; ok && class != "" {
+		args = append(args, "-cp", jarPath, class)
+	} else {
+		args = append(args, "-jar", jarPath)
+	}
 	if argRaw, ok := task.Config["args"]; ok {
 		args = append(args, argRaw)
 	}
 
 	// Setup the command
-	// Assumes Java is in the $PATH, but could probably be detected
 	cmd := executor.Command("java", args...)
 
 	// Populate environment variables
 	cmd.Command().Env = envVars.List()
 
+	// Capture the output into rotated files in the alloc dir, forwarding it to
+	// syslog if configured
+	logConfig := task.LogConfig
+	if logConfig == nil {
+		logConfig = structs.DefaultLogConfig()
+	}
+	stdout, stderr := execCtx.LogPaths(d.taskName)
+	cmd.Command().Logs = &executor.LogConfig{
+		StdoutPath:   stdout,
+		StderrPath:   stderr,
+		MaxFiles:     logConfig.MaxFiles,
+		MaxFileSize:  int64(logConfig.MaxFileSizeMB) * 1024 * 1024,
+		Syslog:       taskSyslog(task),
+		DisableFiles: logConfig.Syslog != nil && logConfig.Syslog.DisableFiles,
+	}
+
 	if err := cmd.Limit(task.Resources); err != nil {
 		return nil, fmt.Errorf("failed to constrain resources: %s", err)
 	}
 
-	if err := cmd.ConfigureTaskDir(d.taskName, ctx.AllocDir); err != nil {
+	if err := cmd.ConfigureTaskDir(d.taskName, execCtx.AllocDir); err != nil {
 		return nil, fmt.Errorf("failed to configure task directory: %v", err)
 	}
 
@@ -162,16 +223,56 @@ func (d *JavaDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle,
 	h := &javaHandle{
 		cmd:    cmd,
 		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		waitCh: make(chan *WaitResult, 1),
 	}
 
 	go h.run()
 	return h, nil
 }
 
-func (d *JavaDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+// jarPath returns the path of the jar to run, relative to the task directory.
+// The jar is either downloaded from jar_source into the local directory or
+// is an existing file given by jar_path, such as one fetched as an artifact.
+func (d *JavaDriver) jarPath(ctx context.Context, taskDir string, task *structs.Task) (string, error) {
+	source := task.Config["jar_source"]
+	jarPath := task.Config["jar_path"]
+	switch {
+	case source != "" && jarPath != "":
+		return "", fmt.Errorf("only one of jar_source and jar_path may be set for Java Jar driver")
+	case source != "":
+		u, err := url.Parse(source)
+		if err != nil {
+			return "", fmt.Errorf("invalid jar_source %q: %v", source, err)
+		}
+		artifact := &structs.TaskArtifact{Source: source}
+		if err := getter.GetArtifact(artifact, taskDir, ctx.Done()); err != nil {
+			if ctx.Err() != nil {
+				return "", ctx.Err()
+			}
+			return "", fmt.Errorf("Error downloading source for Java driver: %s", err)
+		}
+		return filepath.Join(allocdir.TaskLocal, path.Base(u.Path)), nil
+	case jarPath != "":
+		rel := filepath.Clean(jarPath)
+		if filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("jar_path %q must be relative to the task directory", jarPath)
+		}
+		if _, err := os.Stat(filepath.Join(taskDir, rel)); err != nil {
+			return "", fmt.Errorf("failed to find jar %q: %v", jarPath, err)
+		}
+		return rel, nil
+	default:
+		return "", fmt.Errorf("missing jar source for Java Jar driver")
+	}
+}
+
+func (d *JavaDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
 	// Find the process
-	cmd, err := executor.OpenId(handleID)
+	id, _, err := parseHandleID(handleID, "java", "", javaHandleVersion)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := executor.OpenId(id)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open ID %v: %v", handleID, err)
 	}
@@ -180,7 +281,7 @@ func (d *JavaDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 	h := &javaHandle{
 		cmd:    cmd,
 		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		waitCh: make(chan *WaitResult, 1),
 	}
 
 	go h.run()
@@ -189,10 +290,10 @@ func (d *JavaDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 
 func (h *javaHandle) ID() string {
 	id, _ := h.cmd.ID()
-	return id
+	return formatHandleID("java", javaHandleVersion, id)
 }
 
-func (h *javaHandle) WaitCh() chan error {
+func (h *javaHandle) WaitCh() chan *WaitResult {
 	return h.waitCh
 }
 
@@ -202,20 +303,28 @@ func (h *javaHandle) Update(task *structs.Task) error {
 }
 
 func (h *javaHandle) Kill() error {
-	h.cmd.Shutdown()
-	select {
-	case <-h.doneCh:
-		return nil
-	case <-time.After(5 * time.Second):
-		return h.cmd.ForceStop()
-	}
+	return h.cmd.Shutdown()
+}
+
+func (h *javaHandle) ForceKill() error {
+	return h.cmd.ForceStop()
+}
+
+func (h *javaHandle) Stats() (*TaskResourceUsage, error) {
+	return nil, &NotSupportedError{Driver: "java", Operation: "stats"}
+}
+
+func (h *javaHandle) Signal(sig os.Signal) error {
+	return h.cmd.Signal(sig)
+}
+
+func (h *javaHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	return nil, 0, &NotSupportedError{Driver: "java", Operation: "exec"}
 }
 
 func (h *javaHandle) run() {
 	err := h.cmd.Wait()
 	close(h.doneCh)
-	if err != nil {
-		h.waitCh <- err
-	}
+	h.waitCh <- waitResult(err)
 	close(h.waitCh)
 }
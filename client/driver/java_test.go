@@ -1,10 +1,16 @@
 package driver
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
 
@@ -17,6 +23,21 @@ func javaLocated() bool {
 	return err == nil
 }
 
+// copyDemoJar copies the bundled demo jar into the local directory of the
+// task and returns its path relative to the task directory.
+func copyDemoJar(t *testing.T, ctx *ExecContext, taskName string) string {
+	data, err := ioutil.ReadFile(filepath.Join("test-resources", "java", "demoapp.jar"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	rel := filepath.Join(allocdir.TaskLocal, "demoapp.jar")
+	dst := filepath.Join(ctx.AllocDir.TaskDirs[taskName], rel)
+	if err := ioutil.WriteFile(dst, data, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return rel
+}
+
 // The fingerprinter test should always pass, even if Java is not installed.
 func TestJavaDriver_Fingerprint(t *testing.T) {
 	ctestutils.ExecCompatible(t)
@@ -62,7 +83,7 @@ func TestJavaDriver_StartOpen_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewJavaDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -71,7 +92,7 @@ func TestJavaDriver_StartOpen_Wait(t *testing.T) {
 	}
 
 	// Attempt to open
-	handle2, err := d.Open(ctx, handle.ID())
+	handle2, err := d.Open(context.Background(), ctx, handle.ID())
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -109,7 +130,7 @@ func TestJavaDriver_Start_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewJavaDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -119,9 +140,9 @@ func TestJavaDriver_Start_Wait(t *testing.T) {
 
 	// Task should terminate quickly
 	select {
-	case err := <-handle.WaitCh():
-		if err != nil {
-			t.Fatalf("err: %v", err)
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
 		}
 	case <-time.After(2 * time.Second):
 		// expect the timeout b/c it's a long lived process
@@ -135,6 +156,33 @@ func TestJavaDriver_Start_Wait(t *testing.T) {
 	}
 }
 
+func TestJavaDriver_Start_Open(t *testing.T) {
+	if !javaLocated() {
+		t.Skip("Java not found; skipping")
+	}
+
+	ctestutils.ExecCompatible(t)
+	task := &structs.Task{
+		Name: "demo-app",
+		Config: map[string]string{
+			"jar_source": "https://dl.dropboxusercontent.com/u/47675/jar_thing/demoapp.jar",
+		},
+		Resources: basicResources,
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewJavaDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+	testOpenHandleID(t, d, ctx, "java", handle)
+}
+
 func TestJavaDriver_Start_Kill_Wait(t *testing.T) {
 	if !javaLocated() {
 		t.Skip("Java not found; skipping")
@@ -156,7 +204,7 @@ func TestJavaDriver_Start_Kill_Wait(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewJavaDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -174,8 +222,8 @@ func TestJavaDriver_Start_Kill_Wait(t *testing.T) {
 
 	// Task should terminate quickly
 	select {
-	case err := <-handle.WaitCh():
-		if err == nil {
+	case res := <-handle.WaitCh():
+		if res.Successful() {
 			t.Fatal("should err")
 		}
 	case <-time.After(2 * time.Second):
@@ -188,3 +236,103 @@ func TestJavaDriver_Start_Kill_Wait(t *testing.T) {
 		t.Fatalf("Error: %s", err)
 	}
 }
+
+func TestJavaDriver_JarPath(t *testing.T) {
+	taskDir, err := ioutil.TempDir("", "nomad-java")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(taskDir)
+	if err := os.Mkdir(filepath.Join(taskDir, allocdir.TaskLocal), 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	jar := filepath.Join(allocdir.TaskLocal, "app.jar")
+	if err := ioutil.WriteFile(filepath.Join(taskDir, jar), nil, 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	d := NewJavaDriver(testDriverContext("")).(*JavaDriver)
+	cases := []struct {
+		config map[string]string
+		path   string
+		err    string
+	}{
+		{map[string]string{"jar_path": "local/./app.jar"}, jar, ""},
+		{map[string]string{"jar_path": "local/missing.jar"}, "", "failed to find jar"},
+		{map[string]string{"jar_path": "../app.jar"}, "", "must be relative"},
+		{map[string]string{"jar_path": "/local/app.jar"}, "", "must be relative"},
+		{map[string]string{"jar_path": jar, "jar_source": "http://foo/app.jar"}, "", "only one of"},
+		{map[string]string{}, "", "missing jar source"},
+	}
+	for _, c := range cases {
+		path, err := d.jarPath(context.Background(), taskDir, &structs.Task{Config: c.config})
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Fatalf("jarPath(%v) returned error %v; want %q", c.config, err, c.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("jarPath(%v) failed: %v", c.config, err)
+		}
+		if path != c.path {
+			t.Fatalf("jarPath(%v) returned %q; want %q", c.config, path, c.path)
+		}
+	}
+}
+
+func TestJavaDriver_Start_JarPath_Kill_Wait(t *testing.T) {
+	if !javaLocated() {
+		t.Skip("Java not found; skipping")
+	}
+
+	ctestutils.ExecCompatible(t)
+	for _, config := range []map[string]string{
+		{"jvm_options": "-Xmx64m -Xms32m"},
+		{"class": "Hello"},
+	} {
+		task := &structs.Task{
+			Name:      "demo-app",
+			Config:    config,
+			Resources: basicResources,
+		}
+
+		driverCtx := testDriverContext(task.Name)
+		ctx := testDriverExecContext(task, driverCtx)
+		defer ctx.AllocDir.Destroy()
+		d := NewJavaDriver(driverCtx)
+		task.Config["jar_path"] = copyDemoJar(t, ctx, task.Name)
+
+		handle, err := d.Start(context.Background(), ctx, task)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// The demo app prints every second
+		stdout, _ := ctx.LogPaths(task.Name)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			out, _ := ioutil.ReadFile(stdout + ".0")
+			if strings.Contains(string(out), "Hi") {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("config %v: no output from the jar: %q", config, out)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if err := handle.Kill(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		select {
+		case res := <-handle.WaitCh():
+			if res.Successful() {
+				t.Fatal("should err")
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
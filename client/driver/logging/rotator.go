@@ -0,0 +1,423 @@
+// Package logging provides helpers for capturing the output of tasks.
+package logging
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errClosed = fmt.Errorf("file rotator is closed")
+
+var (
+	// compressMinSize is the size below which rotated files are left
+	// uncompressed, as compressing them saves little
+	compressMinSize int64 = 64 * 1024
+
+	// compressRate is how many bytes per second of rotated files are
+	// compressed, so compression doesn't compete with the tasks for IO
+	compressRate int64 = 4 * 1024 * 1024
+
+	// compressChunkSize is how much is compressed between the pauses
+	// throttling the compression
+	compressChunkSize = 32 * 1024
+)
+
+// compressedExt is appended to the name of a rotated file once compressed
+const compressedExt = ".gz"
+
+// FileRotator is an io.WriteCloser that writes to a series of files named
+// <path>.<index>. Once the current file reaches the maximum size a new file
+// with the next index is started and the oldest files are removed so that at
+// most maxFiles are retained. Files rotated out are gzip compressed in the
+// background, becoming <path>.<index>.gz, while the current file is kept
+// uncompressed.
+type FileRotator struct {
+	path        string
+	maxFiles    int
+	maxFileSize int64
+
+	// owned is set once SetOwner is called, making uid and gid the owners
+	// of the files opened after.
+	owned    bool
+	uid, gid int
+
+	f      *os.File
+	index  int
+	size   int64
+	closed bool
+	lock   sync.Mutex
+
+	// compressCh wakes the compressor once a file is rotated out. stopCh
+	// is closed on Close, and compressDone once the compressor exits.
+	compressCh   chan struct{}
+	stopCh       chan struct{}
+	compressDone chan struct{}
+}
+
+// NewFileRotator returns a FileRotator writing to files prefixed by path. If
+// files from a previous rotator exist, writing continues in the newest one.
+func NewFileRotator(path string, maxFiles int, maxFileSize int64) (*FileRotator, error) {
+	if maxFiles < 1 {
+		return nil, fmt.Errorf("max files must be at least one")
+	}
+	if maxFileSize < 1 {
+		return nil, fmt.Errorf("max file size must be positive")
+	}
+
+	r := &FileRotator{
+		path:         path,
+		maxFiles:     maxFiles,
+		maxFileSize:  maxFileSize,
+		compressCh:   make(chan struct{}, 1),
+		stopCh:       make(chan struct{}),
+		compressDone: make(chan struct{}),
+	}
+
+	indexes, err := r.indexes()
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) != 0 {
+		r.index = indexes[len(indexes)-1]
+	}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	// Files rotated out by a previous rotator may not have been compressed
+	go r.compressLoop()
+	r.wakeCompressor()
+	return r, nil
+}
+
+// Write writes p to the current file, rotating as often as needed so that no
+// file grows beyond the maximum size.
+func (r *FileRotator) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.f == nil {
+		return 0, errClosed
+	}
+
+	var written int
+	for len(p) > 0 {
+		if r.size >= r.maxFileSize {
+			if err := r.rotate(); err != nil {
+				return written, err
+			}
+		}
+
+		chunk := p
+		if remaining := r.maxFileSize - r.size; int64(len(chunk)) > remaining {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := r.f.Write(chunk)
+		written += n
+		r.size += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the current file and stops the compression of rotated files,
+// which the next rotator at the path resumes.
+func (r *FileRotator) Close() error {
+	r.lock.Lock()
+	if r.closed {
+		r.lock.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.stopCh)
+
+	var err error
+	if r.f != nil {
+		err = r.f.Close()
+		r.f = nil
+	}
+	r.lock.Unlock()
+
+	<-r.compressDone
+	return err
+}
+
+// SetOwner makes the user and group the owners of the current file and of
+// those the rotator opens after.
+func (r *FileRotator) SetOwner(uid, gid int) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.owned, r.uid, r.gid = true, uid, gid
+	if r.f == nil {
+		return nil
+	}
+	if err := r.f.Chown(uid, gid); err != nil {
+		return fmt.Errorf("failed to change the owner of log file: %v", err)
+	}
+	return nil
+}
+
+// FileName returns the name of the file with the given index.
+func (r *FileRotator) FileName(index int) string {
+	return fileName(r.path, index)
+}
+
+// open opens the file with the current index for appending.
+func (r *FileRotator) open() error {
+	f, err := os.OpenFile(r.FileName(r.index), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %v", err)
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to stat log file: %v", err)
+	}
+
+	if r.owned {
+		if err := f.Chown(r.uid, r.gid); err != nil {
+			f.Close()
+			return fmt.Errorf("failed to change the owner of log file: %v", err)
+		}
+	}
+
+	r.f = f
+	r.size = fi.Size()
+	return nil
+}
+
+// rotate closes the current file, starts the next one and removes the
+// files that are no longer retained.
+func (r *FileRotator) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+
+	r.index++
+	if err := r.open(); err != nil {
+		return err
+	}
+	r.wakeCompressor()
+	return r.purge()
+}
+
+// purge removes all the files older than the retained ones.
+func (r *FileRotator) purge() error {
+	indexes, err := r.indexes()
+	if err != nil {
+		return err
+	}
+
+	oldest := r.index - r.maxFiles + 1
+	for _, index := range indexes {
+		if index >= oldest {
+			break
+		}
+		name := r.FileName(index)
+		for _, n := range []string{name, name + compressedExt, name + compressedExt + ".tmp"} {
+			if err := os.Remove(n); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// wakeCompressor has the compressor look for rotated files to compress.
+func (r *FileRotator) wakeCompressor() {
+	select {
+	case r.compressCh <- struct{}{}:
+	default:
+	}
+}
+
+// compressLoop compresses the files rotated out whenever woken, until the
+// rotator is closed.
+func (r *FileRotator) compressLoop() {
+	defer close(r.compressDone)
+	for {
+		select {
+		case <-r.stopCh:
+			return
+		case <-r.compressCh:
+		}
+
+		for _, index := range r.compressible() {
+			// A file failing to compress is left as it is, as it can
+			// still be read uncompressed.
+			if err := r.compress(index); err == errClosed {
+				return
+			}
+		}
+	}
+}
+
+// compressible returns the indexes of the uncompressed files rotated out
+// that are large enough to be worth compressing.
+func (r *FileRotator) compressible() []int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	indexes, err := r.indexes()
+	if err != nil {
+		return nil
+	}
+	var out []int
+	for _, index := range indexes {
+		if index >= r.index {
+			break
+		}
+		fi, err := os.Stat(r.FileName(index))
+		if err != nil || fi.Size() < compressMinSize {
+			continue
+		}
+		out = append(out, index)
+	}
+	return out
+}
+
+// compress replaces the file with the index by its compressed copy, pacing
+// the reads to the compression rate. It returns errClosed if the rotator is
+// closed meanwhile.
+func (r *FileRotator) compress(index int) error {
+	r.lock.Lock()
+	owned, uid, gid := r.owned, r.uid, r.gid
+	r.lock.Unlock()
+
+	name := r.FileName(index)
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := name + compressedExt + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+	if owned {
+		if err := out.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+
+	zw := gzip.NewWriter(out)
+	buf := make([]byte, compressChunkSize)
+	for {
+		n, err := in.Read(buf)
+		if n > 0 {
+			if _, err := zw.Write(buf[:n]); err != nil {
+				return err
+			}
+			pause := time.Duration(int64(n) * int64(time.Second) / compressRate)
+			select {
+			case <-r.stopCh:
+				return errClosed
+			case <-time.After(pause):
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// The file may have been purged while it was being compressed. Streams
+	// reading it keep reading the uncompressed file they have open, while
+	// those opening it after find the compressed one.
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if index < r.index-r.maxFiles+1 {
+		return nil
+	}
+	if err := os.Rename(tmp, name+compressedExt); err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil {
+		os.Remove(name + compressedExt)
+		return err
+	}
+	return nil
+}
+
+// indexes returns the sorted indexes of the existing files.
+func (r *FileRotator) indexes() ([]int, error) {
+	return fileIndexes(r.path)
+}
+
+// fileIndexes returns the sorted indexes of the files rotated at path,
+// whether compressed or not.
+func fileIndexes(path string) ([]int, error) {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	names, err := readDirNames(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]struct{})
+	var indexes []int
+	for _, name := range names {
+		if !strings.HasPrefix(name, base+".") {
+			continue
+		}
+		suffix := strings.TrimSuffix(strings.TrimPrefix(name, base+"."), compressedExt)
+		index, err := strconv.Atoi(suffix)
+		if err != nil || index < 0 {
+			continue
+		}
+
+		// Both copies exist for a moment while a file is compressed
+		if _, ok := seen[index]; ok {
+			continue
+		}
+		seen[index] = struct{}{}
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	return indexes, nil
+}
+
+// fileName returns the name of the file rotated at path with the index.
+func fileName(path string, index int) string {
+	return fmt.Sprintf("%s.%d", path, index)
+}
+
+// readDirNames returns the names of the entries of the directory.
+func readDirNames(dir string) ([]string, error) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+	return d.Readdirnames(-1)
+}
@@ -0,0 +1,304 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRotator(t *testing.T, maxFiles int, maxFileSize int64) (string, *FileRotator) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	r, err := NewFileRotator(filepath.Join(dir, "web.stdout"), maxFiles, maxFileSize)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("err: %v", err)
+	}
+	return dir, r
+}
+
+func dirContents(t *testing.T, dir string) map[string]string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	out := make(map[string]string)
+	for _, f := range files {
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		out[f.Name()] = string(b)
+	}
+	return out
+}
+
+func TestFileRotator_Invalid(t *testing.T) {
+	if _, err := NewFileRotator("foo", 0, 10); err == nil {
+		t.Fatalf("expected error for max files")
+	}
+	if _, err := NewFileRotator("foo", 1, 0); err == nil {
+		t.Fatalf("expected error for max file size")
+	}
+}
+
+func TestFileRotator_Write(t *testing.T) {
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	if n, err := r.Write([]byte("hello")); err != nil || n != 5 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+
+	exp := map[string]string{"web.stdout.0": "hello"}
+	if act := dirContents(t, dir); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestFileRotator_Rotate(t *testing.T) {
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	// A single write larger than the max size is split across files
+	if n, err := r.Write([]byte("0123456789abcdefghijXY")); err != nil || n != 22 {
+		t.Fatalf("bad: %d %v", n, err)
+	}
+	if _, err := r.Write([]byte("Z")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	exp := map[string]string{
+		"web.stdout.0": "0123456789",
+		"web.stdout.1": "abcdefghij",
+		"web.stdout.2": "XYZ",
+	}
+	if act := dirContents(t, dir); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestFileRotator_Purge(t *testing.T) {
+	dir, r := testRotator(t, 2, 4)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	if _, err := r.Write([]byte(strings.Repeat("a", 4) + strings.Repeat("b", 4) + "cc")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	exp := map[string]string{
+		"web.stdout.1": "bbbb",
+		"web.stdout.2": "cc",
+	}
+	if act := dirContents(t, dir); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestFileRotator_Resume(t *testing.T) {
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+
+	if _, err := r.Write([]byte("0123456789abc")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := r.Write([]byte("foo")); err == nil {
+		t.Fatalf("expected error writing to closed rotator")
+	}
+
+	// A new rotator continues in the newest file
+	r2, err := NewFileRotator(filepath.Join(dir, "web.stdout"), 5, 10)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r2.Close()
+	if _, err := r2.Write([]byte("defghijk")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	exp := map[string]string{
+		"web.stdout.0": "0123456789",
+		"web.stdout.1": "abcdefghij",
+		"web.stdout.2": "k",
+	}
+	if act := dirContents(t, dir); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+// testCompression sets the size threshold and rate of compression, returning
+// a func restoring them.
+func testCompression(minSize, rate int64) func() {
+	oldSize, oldRate := compressMinSize, compressRate
+	compressMinSize, compressRate = minSize, rate
+	return func() {
+		compressMinSize, compressRate = oldSize, oldRate
+	}
+}
+
+// waitCompressed waits for the files to be replaced by their compressed
+// copies.
+func waitCompressed(t *testing.T, names ...string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for _, name := range names {
+		for {
+			_, plainErr := os.Stat(name)
+			_, gzErr := os.Stat(name + compressedExt)
+			if os.IsNotExist(plainErr) && gzErr == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %v to be compressed", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// gunzipFile returns the decompressed contents of the file.
+func gunzipFile(t *testing.T, name string) string {
+	f, err := os.Open(name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	b, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(b)
+}
+
+func TestFileRotator_Compress(t *testing.T) {
+	defer testCompression(1, 1<<30)()
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	if _, err := r.Write([]byte("0123456789abcdefghijXY")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The rotated files are compressed while the current one is not
+	path := filepath.Join(dir, "web.stdout")
+	waitCompressed(t, r.FileName(0), r.FileName(1))
+	if act := gunzipFile(t, r.FileName(0)+compressedExt); act != "0123456789" {
+		t.Fatalf("bad: %q", act)
+	}
+	if act := gunzipFile(t, r.FileName(1)+compressedExt); act != "abcdefghij" {
+		t.Fatalf("bad: %q", act)
+	}
+	if act := dirContents(t, dir)["web.stdout.2"]; act != "XY" {
+		t.Fatalf("bad: %q", act)
+	}
+	if indexes, err := fileIndexes(path); err != nil || !reflect.DeepEqual(indexes, []int{0, 1, 2}) {
+		t.Fatalf("bad: %v %v", indexes, err)
+	}
+
+	// Compressed files are purged like the others
+	if _, err := r.Write([]byte(strings.Repeat("z", 48))); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, index := range []int{0, 1} {
+		if _, err := os.Stat(r.FileName(index) + compressedExt); !os.IsNotExist(err) {
+			t.Fatalf("file %d not purged: %v", index, err)
+		}
+	}
+}
+
+func TestFileRotator_Compress_MinSize(t *testing.T) {
+	defer testCompression(10, 1<<30)()
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Files left uncompressed by a previous rotator are compressed, except
+	// those below the threshold
+	path := filepath.Join(dir, "web.stdout")
+	for name, contents := range map[string]string{
+		"web.stdout.0": "0123456789",
+		"web.stdout.1": "abc",
+		"web.stdout.2": "def",
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	r, err := NewFileRotator(path, 5, 10)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+
+	waitCompressed(t, r.FileName(0))
+	act := dirContents(t, dir)
+	delete(act, "web.stdout.0"+compressedExt)
+	exp := map[string]string{
+		"web.stdout.1": "abc",
+		"web.stdout.2": "def",
+	}
+	if !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
+
+func TestFileRotator_Compress_Close(t *testing.T) {
+	// Throttled to a byte a second, compressing the file takes longer than
+	// the test
+	defer testCompression(1, 1)()
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+
+	if _, err := r.Write([]byte("0123456789a")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tmp := r.FileName(0) + compressedExt + ".tmp"
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, err := os.Stat(tmp); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for compression to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Closing the rotator abandons the compression, leaving the file as it
+	// was
+	start := time.Now()
+	if err := r.Close(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Close() waited for the compression")
+	}
+	exp := map[string]string{
+		"web.stdout.0": "0123456789",
+		"web.stdout.1": "a",
+	}
+	if act := dirContents(t, dir); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("bad: %#v", act)
+	}
+}
@@ -0,0 +1,366 @@
+package logging
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+var (
+	// streamPollInterval is how often a followed stream checks for new data
+	streamPollInterval = 250 * time.Millisecond
+
+	// streamBufferSize is the maximum size of each chunk sent on a stream
+	streamBufferSize = 32 * 1024
+)
+
+const (
+	// MarkerRotated marks where a stream moved on from a file to the file
+	// rotated in after it
+	MarkerRotated = "rotated"
+
+	// MarkerTruncated marks where a stream started over at the beginning of
+	// a file that was truncated below what had been read of it, or replaced
+	MarkerTruncated = "truncated"
+)
+
+// Frame is a chunk of a stream of the files rotated at a path. It carries
+// either the Data read from the files or a Marker, so that the boundaries of
+// the files and the output lost to truncations are never silent.
+type Frame struct {
+	Data   []byte
+	Marker *Marker
+}
+
+// Marker is a boundary in a stream. From is the position the stream left,
+// past the last byte it read there, and To the position it resumed at. A
+// rotation to a file whose index is more than one above that of From means
+// the files in between were removed before being read.
+type Marker struct {
+	Kind string
+	From Position
+	To   Position
+}
+
+// StreamFiles sends the contents of the files rotated at path on the returned
+// channel, starting with the oldest file. Compressed files are decompressed
+// as they are read. If follow is false the channel is
+// closed once the existing contents have been sent. Otherwise it starts at the
+// end of the newest file and sends data as it is appended, moving on to newer
+// files as they are rotated in and starting over if the current file is
+// truncated or replaced. A marker frame is sent each time the stream moves on
+// to another file or starts over.
+//
+// Closing stopCh closes the stream immediately, while closing drainCh closes it
+// once the data written so far has been sent.
+func StreamFiles(path string, follow bool, stopCh, drainCh <-chan struct{}) <-chan *Frame {
+	s := &fileStream{
+		path:    path,
+		follow:  follow,
+		ch:      make(chan *Frame),
+		stopCh:  stopCh,
+		drainCh: drainCh,
+		index:   -1,
+	}
+	go s.run()
+	return s.ch
+}
+
+// Position is a position within the files rotated at a path
+type Position struct {
+	Index  int
+	Offset int64
+}
+
+// EndPosition returns the position at the end of the newest file rotated at
+// path. If there are no files yet, the position is the start of the first
+// one.
+func EndPosition(path string) Position {
+	indexes, err := fileIndexes(path)
+	if err != nil || len(indexes) == 0 {
+		return Position{Index: -1}
+	}
+	index := indexes[len(indexes)-1]
+	fi, err := os.Stat(fileName(path, index))
+	if err != nil {
+		return Position{Index: index}
+	}
+	return Position{Index: index, Offset: fi.Size()}
+}
+
+// FollowFilesFrom follows the files rotated at path like StreamFiles, but
+// starting at the position rather than the end of the newest file, so
+// nothing written since the position was taken is missed. The stream starts
+// over at the beginning of the file if it was truncated below the position,
+// sending a marker from the position.
+func FollowFilesFrom(path string, pos Position, stopCh, drainCh <-chan struct{}) <-chan *Frame {
+	s := &fileStream{
+		path:    path,
+		follow:  true,
+		from:    &pos,
+		ch:      make(chan *Frame),
+		stopCh:  stopCh,
+		drainCh: drainCh,
+		index:   -1,
+	}
+	go s.run()
+	return s.ch
+}
+
+// fileStream is the state of a single StreamFiles call
+type fileStream struct {
+	path    string
+	follow  bool
+	ch      chan *Frame
+	stopCh  <-chan struct{}
+	drainCh <-chan struct{}
+
+	// from is where a followed stream starts, if not at the end of the
+	// newest file
+	from *Position
+
+	// r reads the current file f, decompressing it if compressed is set.
+	// The offset is within the uncompressed contents.
+	f          *os.File
+	r          io.Reader
+	compressed bool
+	index      int
+	offset     int64
+}
+
+func (s *fileStream) run() {
+	defer close(s.ch)
+	defer s.close()
+
+	indexes, err := fileIndexes(s.path)
+	if err != nil {
+		return
+	}
+
+	// Pick the file to start from
+	if s.from != nil {
+		if s.from.Index >= 0 {
+			err := s.open(s.from.Index)
+			if err != nil && !os.IsNotExist(err) {
+				return
+			}
+			if err == nil {
+				if err := s.seek(s.from.Offset); err != nil {
+					return
+				}
+				if s.offset != s.from.Offset && !s.mark(MarkerTruncated, *s.from) {
+					return
+				}
+			} else {
+				// The file was removed, which the marker of the
+				// rotation to the next one tells
+				s.offset = s.from.Offset
+			}
+		}
+	} else if len(indexes) != 0 {
+		if !s.follow {
+			if err := s.open(indexes[0]); err != nil {
+				return
+			}
+		} else {
+			if err := s.open(indexes[len(indexes)-1]); err != nil {
+				return
+			}
+			if s.offset, err = s.f.Seek(0, os.SEEK_END); err != nil {
+				return
+			}
+		}
+	}
+
+	draining := false
+	buf := make([]byte, streamBufferSize)
+	for {
+		if !s.send(buf) {
+			return
+		}
+
+		// Move on to the next file if it has been rotated in. Anything
+		// appended to the current file before the rotation is sent first.
+		next, err := s.next()
+		if err != nil {
+			return
+		}
+		if next != -1 {
+			if s.f != nil && !s.send(buf) {
+				return
+			}
+			from := s.position()
+			if err := s.open(next); err != nil {
+				return
+			}
+			if from.Index != -1 && from.Index != next && !s.mark(MarkerRotated, from) {
+				return
+			}
+			continue
+		}
+
+		if !s.follow || draining {
+			return
+		}
+
+		// Start over if the current file was truncated or replaced
+		if s.f != nil && s.replaced() {
+			from := s.position()
+			if err := s.open(s.index); err != nil && !os.IsNotExist(err) {
+				return
+			}
+			if !s.mark(MarkerTruncated, from) {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-s.stopCh:
+			return
+		case <-s.drainCh:
+			draining = true
+		case <-time.After(streamPollInterval):
+		}
+	}
+}
+
+// send sends everything that can be read from the current file, returning
+// false if the stream should be closed.
+func (s *fileStream) send(buf []byte) bool {
+	if s.f == nil {
+		return true
+	}
+
+	for {
+		n, err := s.r.Read(buf)
+		if n > 0 {
+			data := make([]byte, n)
+			copy(data, buf[:n])
+			select {
+			case s.ch <- &Frame{Data: data}:
+				s.offset += int64(n)
+			case <-s.stopCh:
+				return false
+			}
+		}
+		if err == io.EOF {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+	}
+}
+
+// mark sends a marker of the kind from the position to the current one,
+// returning false if the stream should be closed.
+func (s *fileStream) mark(kind string, from Position) bool {
+	marker := &Marker{Kind: kind, From: from, To: s.position()}
+	select {
+	case s.ch <- &Frame{Marker: marker}:
+		return true
+	case <-s.stopCh:
+		return false
+	}
+}
+
+// position returns the position of the stream in the current file
+func (s *fileStream) position() Position {
+	return Position{Index: s.index, Offset: s.offset}
+}
+
+// next returns the index of the file after the current one or -1 if there is
+// no newer file. If the current file could not be opened its index is
+// returned again once it exists.
+func (s *fileStream) next() (int, error) {
+	indexes, err := fileIndexes(s.path)
+	if err != nil {
+		return -1, err
+	}
+	for _, index := range indexes {
+		if index > s.index || (s.f == nil && index == s.index) {
+			return index, nil
+		}
+	}
+	return -1, nil
+}
+
+// replaced returns if the file at the current path is no longer the one being
+// read or has been truncated.
+func (s *fileStream) replaced() bool {
+	if s.compressed {
+		return false
+	}
+	fi, err := os.Stat(fileName(s.path, s.index))
+	if err != nil {
+		return false
+	}
+	cur, err := s.f.Stat()
+	if err != nil {
+		return true
+	}
+	return !os.SameFile(fi, cur) || fi.Size() < s.offset
+}
+
+// open opens the file with the given index from the start, falling back to
+// its compressed copy once it has been compressed.
+func (s *fileStream) open(index int) error {
+	s.close()
+	s.index = index
+	s.offset = 0
+
+	name := fileName(s.path, index)
+	f, err := os.Open(name)
+	if err == nil {
+		s.f, s.r = f, f
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err = os.Open(name + compressedExt)
+	if err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.r, s.compressed = f, zr, true
+	return nil
+}
+
+// seek moves to the offset in the current file, unless the file has since
+// been truncated below it. Compressed files are read up to the offset.
+func (s *fileStream) seek(offset int64) error {
+	if s.compressed {
+		n, err := io.CopyN(ioutil.Discard, s.r, offset)
+		if err == io.EOF {
+			return s.open(s.index)
+		}
+		s.offset = n
+		return err
+	}
+
+	fi, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < offset {
+		return nil
+	}
+	s.offset, err = s.f.Seek(offset, os.SEEK_SET)
+	return err
+}
+
+func (s *fileStream) close() {
+	if s.f != nil {
+		s.f.Close()
+		s.f, s.r, s.compressed = nil, nil, false
+	}
+}
@@ -0,0 +1,354 @@
+package logging
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	streamPollInterval = 10 * time.Millisecond
+}
+
+// collect reads from the stream until it has received exp or times out,
+// returning the markers received meanwhile.
+func collect(t *testing.T, ch <-chan *Frame, exp string) []*Marker {
+	var buf bytes.Buffer
+	var markers []*Marker
+	timeout := time.After(2 * time.Second)
+	for buf.String() != exp {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				t.Fatalf("stream closed after %q; want %q", buf.String(), exp)
+			}
+			if frame.Marker != nil {
+				markers = append(markers, frame.Marker)
+			}
+			buf.Write(frame.Data)
+		case <-timeout:
+			t.Fatalf("timeout after %q; want %q", buf.String(), exp)
+		}
+	}
+	return markers
+}
+
+func waitClosed(t *testing.T, ch <-chan *Frame) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+			if frame.Marker == nil {
+				t.Fatalf("unexpected data: %q", frame.Data)
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for stream to close")
+		}
+	}
+}
+
+func TestStreamFiles_NoFollow(t *testing.T) {
+	dir, r := testRotator(t, 5, 4)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	if _, err := r.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), false, nil, nil)
+	collect(t, ch, "0123456789")
+	waitClosed(t, ch)
+}
+
+func TestStreamFiles_NoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	waitClosed(t, StreamFiles(filepath.Join(dir, "web.stdout"), false, nil, nil))
+}
+
+func TestStreamFiles_Follow(t *testing.T) {
+	dir, r := testRotator(t, 5, 4)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	// Existing contents are skipped when following
+	if _, err := r.Write([]byte("old")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), true, stopCh, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	// Writes spanning several rotations are streamed in order
+	if _, err := r.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	collect(t, ch, "0123456789")
+
+	close(stopCh)
+	waitClosed(t, ch)
+}
+
+func TestStreamFiles_Follow_Replaced(t *testing.T) {
+	dir, r := testRotator(t, 5, 100)
+	defer os.RemoveAll(dir)
+
+	if _, err := r.Write([]byte("foo")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), false, stopCh, nil)
+	collect(t, ch, "foo")
+	waitClosed(t, ch)
+
+	ch = StreamFiles(filepath.Join(dir, "web.stdout"), true, stopCh, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	// Replace the file as a restarted task would
+	r.Close()
+	if err := os.Remove(r.FileName(0)); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	r2, err := NewFileRotator(filepath.Join(dir, "web.stdout"), 5, 100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r2.Close()
+	if _, err := r2.Write([]byte("restarted")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	collect(t, ch, "restarted")
+}
+
+func TestStreamFiles_Drain(t *testing.T) {
+	dir, r := testRotator(t, 5, 100)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	drainCh := make(chan struct{})
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), true, nil, drainCh)
+	time.Sleep(50 * time.Millisecond)
+
+	// Data written before draining is still sent
+	if _, err := r.Write([]byte("last words")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	close(drainCh)
+	collect(t, ch, "last words")
+	waitClosed(t, ch)
+}
+
+func TestFollowFilesFrom(t *testing.T) {
+	dir, r := testRotator(t, 5, 4)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+	path := filepath.Join(dir, "web.stdout")
+
+	if _, err := r.Write([]byte("old")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pos := EndPosition(path)
+
+	// What is written after the position was taken is streamed, even if it
+	// was written before the stream started and spans several rotations
+	if _, err := r.Write([]byte("0123456789")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	stopCh := make(chan struct{})
+	ch := FollowFilesFrom(path, pos, stopCh, nil)
+	collect(t, ch, "0123456789")
+
+	if _, err := r.Write([]byte("new")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	collect(t, ch, "new")
+
+	close(stopCh)
+	waitClosed(t, ch)
+}
+
+func TestFollowFilesFrom_NoFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "web.stdout")
+
+	// The stream starts at the first file once it is created
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch := FollowFilesFrom(path, EndPosition(path), stopCh, nil)
+	r, err := NewFileRotator(path, 5, 100)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer r.Close()
+	if _, err := r.Write([]byte("started")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	collect(t, ch, "started")
+}
+
+func TestStreamFiles_Compressed(t *testing.T) {
+	defer testCompression(1, 1<<30)()
+	dir, r := testRotator(t, 5, 10)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	data := "0123456789abcdefghijklmnopqrstuvwxyzABCD"
+	if _, err := r.Write([]byte(data[:25])); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	waitCompressed(t, r.FileName(0), r.FileName(1))
+
+	// The file rotated out next may or may not be compressed yet by the
+	// time it is read
+	if _, err := r.Write([]byte(data[25:])); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, "web.stdout")
+
+	// The stream reassembles the files across compressed and uncompressed
+	// ones
+	ch := StreamFiles(path, false, nil, nil)
+	collect(t, ch, data)
+	waitClosed(t, ch)
+
+	waitCompressed(t, r.FileName(2))
+	ch = StreamFiles(path, false, nil, nil)
+	collect(t, ch, data)
+	waitClosed(t, ch)
+
+	// Following from within a compressed file starts at the offset
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch = FollowFilesFrom(path, Position{Index: 1, Offset: 4}, stopCh, nil)
+	collect(t, ch, data[14:])
+}
+
+// nextFrame returns the next frame of the stream
+func nextFrame(t *testing.T, ch <-chan *Frame) *Frame {
+	select {
+	case frame, ok := <-ch:
+		if !ok {
+			t.Fatalf("stream closed")
+		}
+		return frame
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout waiting for a frame")
+	}
+	return nil
+}
+
+// expectMarker fails unless the frame is the marker
+func expectMarker(t *testing.T, frame *Frame, exp Marker) {
+	if frame.Marker == nil {
+		t.Fatalf("got data %q; want marker %#v", frame.Data, exp)
+	}
+	if *frame.Marker != exp {
+		t.Fatalf("got marker %#v; want %#v", frame.Marker, exp)
+	}
+}
+
+func TestStreamFiles_Marker_Rotated(t *testing.T) {
+	dir, r := testRotator(t, 5, 4)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), true, stopCh, nil)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := r.Write([]byte("0123")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if markers := collect(t, ch, "0123"); len(markers) != 0 {
+		t.Fatalf("unexpected markers: %#v", markers)
+	}
+
+	// The rotation is marked between the contents of the two files
+	if _, err := r.Write([]byte("4567")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectMarker(t, nextFrame(t, ch), Marker{
+		Kind: MarkerRotated,
+		From: Position{Index: 0, Offset: 4},
+		To:   Position{Index: 1, Offset: 0},
+	})
+	if markers := collect(t, ch, "4567"); len(markers) != 0 {
+		t.Fatalf("unexpected markers: %#v", markers)
+	}
+}
+
+func TestStreamFiles_Marker_Truncated(t *testing.T) {
+	dir, r := testRotator(t, 5, 100)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch := StreamFiles(filepath.Join(dir, "web.stdout"), true, stopCh, nil)
+	time.Sleep(50 * time.Millisecond)
+	if _, err := r.Write([]byte("foo bar")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	collect(t, ch, "foo bar")
+
+	// The stream starts over at the truncation, marking what was read
+	if err := os.Truncate(r.FileName(0), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := r.Write([]byte("baz")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	expectMarker(t, nextFrame(t, ch), Marker{
+		Kind: MarkerTruncated,
+		From: Position{Index: 0, Offset: 7},
+		To:   Position{Index: 0, Offset: 0},
+	})
+	collect(t, ch, "baz")
+}
+
+func TestFollowFilesFrom_Marker_Truncated(t *testing.T) {
+	dir, r := testRotator(t, 5, 100)
+	defer os.RemoveAll(dir)
+	defer r.Close()
+	path := filepath.Join(dir, "web.stdout")
+
+	if _, err := r.Write([]byte("foo bar")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	pos := EndPosition(path)
+	if err := os.Truncate(r.FileName(0), 0); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := r.Write([]byte("new")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Following from beyond the end of the truncated file starts over
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	ch := FollowFilesFrom(path, pos, stopCh, nil)
+	expectMarker(t, nextFrame(t, ch), Marker{
+		Kind: MarkerTruncated,
+		From: Position{Index: 0, Offset: 7},
+		To:   Position{Index: 0, Offset: 0},
+	})
+	collect(t, ch, "new")
+}
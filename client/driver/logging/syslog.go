@@ -0,0 +1,346 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errSyslogClosed = fmt.Errorf("syslog writer is closed")
+
+// Severities lines of output are forwarded to syslog with
+const (
+	SeverityErr     = 3
+	SeverityWarning = 4
+	SeverityInfo    = 6
+)
+
+// syslogFacilities maps the names of the syslog facilities to their codes
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var (
+	// localSyslogPaths are the sockets the local syslog daemon is looked up
+	// at, in order
+	localSyslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+	// syslogQueueSize is how many lines are buffered while the syslog
+	// server is slow or unreachable before lines are dropped
+	syslogQueueSize = 1024
+
+	// syslogMaxLine is the length of the longest line forwarded. Longer
+	// lines are split.
+	syslogMaxLine = 8 * 1024
+
+	// syslogRedialInterval is how long forwarding waits after failing to
+	// connect before connecting again, dropping the lines meanwhile
+	syslogRedialInterval = 5 * time.Second
+
+	// syslogWriteTimeout is how long a line may take to be sent
+	syslogWriteTimeout = 5 * time.Second
+
+	// syslogCloseTimeout is how long closing waits for the buffered lines
+	// to be sent
+	syslogCloseTimeout = 2 * time.Second
+
+	// dialSyslog connects to a remote syslog server
+	dialSyslog = net.DialTimeout
+)
+
+// SyslogConfig configures forwarding a stream of output to syslog.
+type SyslogConfig struct {
+	// Network is "udp" or "tcp" for a remote syslog server at Address. If
+	// empty, the local syslog daemon is used.
+	Network string
+	Address string
+
+	// Facility is the name of the facility lines are forwarded with.
+	// Defaults to user.
+	Facility string
+
+	// Tag identifies the sender of the lines.
+	Tag string
+}
+
+// SyslogWriter is an io.WriteCloser forwarding each line written to it to
+// syslog in the RFC 3164 format. Writes never block on the syslog server:
+// lines are buffered and sent in the background, and once the buffer is full
+// further lines are dropped and counted. After lines were dropped a notice
+// of how many is sent ahead of the next line.
+type SyslogWriter struct {
+	priority int
+	warning  int
+	tag      string
+	hostname string
+	local    bool
+	dial     func() (net.Conn, error)
+
+	// partial is the start of a line not yet terminated
+	partial []byte
+	closed  bool
+	lock    sync.Mutex
+
+	lines   chan []byte
+	dropped uint64
+
+	// stopCh is closed once closing gave up waiting for the buffered lines,
+	// and doneCh once the forwarder exits.
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewSyslogWriter returns a writer forwarding lines to syslog with the
+// severity. Connecting is left to the first line, so a syslog server that is
+// down only causes lines to be dropped until it is back.
+func NewSyslogWriter(c *SyslogConfig, severity int) (*SyslogWriter, error) {
+	name := c.Facility
+	if name == "" {
+		name = "user"
+	}
+	facility, ok := syslogFacilities[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", c.Facility)
+	}
+
+	w := &SyslogWriter{
+		priority: facility<<3 | severity,
+		warning:  facility<<3 | SeverityWarning,
+		tag:      c.Tag,
+		lines:    make(chan []byte, syslogQueueSize),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+	if w.tag == "" {
+		w.tag = "nomad"
+	}
+
+	switch c.Network {
+	case "":
+		if runtime.GOOS == "windows" {
+			return nil, fmt.Errorf("there is no local syslog on %s", runtime.GOOS)
+		}
+		w.local = true
+		w.dial = dialLocalSyslog
+	case "udp", "tcp":
+		network, addr := c.Network, c.Address
+		w.dial = func() (net.Conn, error) {
+			return dialSyslog(network, addr, syslogWriteTimeout)
+		}
+		w.hostname, _ = os.Hostname()
+		if w.hostname == "" {
+			w.hostname = "localhost"
+		}
+	default:
+		return nil, fmt.Errorf("unsupported syslog network %q", c.Network)
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// dialLocalSyslog connects to the socket of the local syslog daemon
+func dialLocalSyslog() (net.Conn, error) {
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range localSyslogPaths {
+			if conn, err := net.Dial(network, path); err == nil {
+				return conn, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no local syslog socket found")
+}
+
+// Write queues each line of p to be forwarded. The end of p that is not
+// terminated by a newline is held until it is.
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed {
+		return 0, errSyslogClosed
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		i := 0
+		for i < len(p) && p[i] != '\n' {
+			i++
+		}
+		if i == len(p) {
+			w.partial = append(w.partial, p...)
+			break
+		}
+		w.enqueue(append(w.partial, p[:i]...))
+		w.partial = nil
+		p = p[i+1:]
+	}
+	for len(w.partial) >= syslogMaxLine {
+		w.enqueue(w.partial[:syslogMaxLine])
+		w.partial = append([]byte(nil), w.partial[syslogMaxLine:]...)
+	}
+	return n, nil
+}
+
+// enqueue queues a line, dropping it if the queue is full
+func (w *SyslogWriter) enqueue(line []byte) {
+	for len(line) > syslogMaxLine {
+		w.enqueue(line[:syslogMaxLine])
+		line = line[syslogMaxLine:]
+	}
+	select {
+	case w.lines <- append([]byte(nil), line...):
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Dropped returns how many lines were dropped since the writer was created
+func (w *SyslogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Close forwards the line held, if any, and waits a while for the buffered
+// lines to be sent.
+func (w *SyslogWriter) Close() error {
+	w.lock.Lock()
+	if w.closed {
+		w.lock.Unlock()
+		return nil
+	}
+	w.closed = true
+	if len(w.partial) != 0 {
+		w.enqueue(w.partial)
+		w.partial = nil
+	}
+	close(w.lines)
+	w.lock.Unlock()
+
+	select {
+	case <-w.doneCh:
+	case <-time.After(syslogCloseTimeout):
+		close(w.stopCh)
+		<-w.doneCh
+	}
+	return nil
+}
+
+// run sends the queued lines until the writer is closed, connecting again
+// after the connection failed. The lines that can't be sent are dropped.
+func (w *SyslogWriter) run() {
+	defer close(w.doneCh)
+
+	var conn net.Conn
+	var redialAt time.Time
+	var reported uint64
+	defer func() {
+		if conn != nil {
+			conn.Close()
+		}
+	}()
+
+	for line := range w.lines {
+		select {
+		case <-w.stopCh:
+			return
+		default:
+		}
+
+		if conn == nil {
+			if time.Now().Before(redialAt) {
+				atomic.AddUint64(&w.dropped, 1)
+				continue
+			}
+			c, err := w.dial()
+			if err != nil {
+				redialAt = time.Now().Add(syslogRedialInterval)
+				atomic.AddUint64(&w.dropped, 1)
+				continue
+			}
+			conn = c
+		}
+
+		if dropped := w.Dropped(); dropped != reported {
+			notice := fmt.Sprintf("dropped %d lines of output", dropped-reported)
+			if err := w.send(conn, w.warning, []byte(notice)); err == nil {
+				reported = dropped
+			}
+		}
+		if err := w.send(conn, w.priority, line); err != nil {
+			conn.Close()
+			conn = nil
+			atomic.AddUint64(&w.dropped, 1)
+		}
+	}
+}
+
+// send writes a line to the connection. Lines sent to the local daemon omit
+// the hostname, like those of the syslog package.
+func (w *SyslogWriter) send(conn net.Conn, priority int, line []byte) error {
+	timestamp := time.Now().Format(time.Stamp)
+	var msg string
+	if w.local {
+		msg = fmt.Sprintf("<%d>%s %s[%d]: %s\n", priority, timestamp, w.tag, os.Getpid(), line)
+	} else {
+		msg = fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", priority, timestamp, w.hostname, w.tag, os.Getpid(), line)
+	}
+	conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+	_, err := io.WriteString(conn, msg)
+	return err
+}
+
+// ForwardSyslog returns writers forwarding stdout and stderr to syslog, with
+// the info and err severities, as well as writing them to the given writers.
+// If those are nil the output is only forwarded. They are closed if the
+// syslog writers can't be created.
+func ForwardSyslog(c *SyslogConfig, stdout, stderr io.WriteCloser) (io.WriteCloser, io.WriteCloser, error) {
+	stdoutSyslog, err := NewSyslogWriter(c, SeverityInfo)
+	if err != nil {
+		closeWriters(stdout, stderr)
+		return nil, nil, err
+	}
+	stderrSyslog, err := NewSyslogWriter(c, SeverityErr)
+	if err != nil {
+		closeWriters(stdoutSyslog, stdout, stderr)
+		return nil, nil, err
+	}
+	return &syslogTee{stdout, stdoutSyslog}, &syslogTee{stderr, stderrSyslog}, nil
+}
+
+// closeWriters closes the writers that aren't nil
+func closeWriters(writers ...io.WriteCloser) {
+	for _, w := range writers {
+		if w != nil {
+			w.Close()
+		}
+	}
+}
+
+// syslogTee writes to a file, if any, and forwards to syslog
+type syslogTee struct {
+	file   io.WriteCloser
+	syslog *SyslogWriter
+}
+
+func (t *syslogTee) Write(p []byte) (int, error) {
+	t.syslog.Write(p)
+	if t.file == nil {
+		return len(p), nil
+	}
+	return t.file.Write(p)
+}
+
+func (t *syslogTee) Close() error {
+	t.syslog.Close()
+	if t.file == nil {
+		return nil
+	}
+	return t.file.Close()
+}
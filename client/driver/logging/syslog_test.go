@@ -0,0 +1,281 @@
+package logging
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSyslog is a syslog server receiving the lines sent to it over UDP, TCP
+// or a unix datagram socket
+type fakeSyslog struct {
+	network string
+	addr    string
+	lines   chan string
+	close   func()
+}
+
+func newFakeSyslog(t *testing.T, network string) *fakeSyslog {
+	s := &fakeSyslog{network: network, lines: make(chan string, 100)}
+	switch network {
+	case "tcp":
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.addr, s.close = l.Addr().String(), func() { l.Close() }
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					scanner := bufio.NewScanner(conn)
+					for scanner.Scan() {
+						s.lines <- scanner.Text()
+					}
+				}()
+			}
+		}()
+	case "udp", "unixgram":
+		addr := "127.0.0.1:0"
+		if network == "unixgram" {
+			dir, err := ioutil.TempDir("", "nomad")
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			addr = filepath.Join(dir, "log")
+		}
+		conn, err := net.ListenPacket(network, addr)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		s.addr = conn.LocalAddr().String()
+		s.close = func() {
+			conn.Close()
+			if network == "unixgram" {
+				os.RemoveAll(filepath.Dir(addr))
+			}
+		}
+		go func() {
+			buf := make([]byte, 64*1024)
+			for {
+				n, _, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				s.lines <- strings.TrimSuffix(string(buf[:n]), "\n")
+			}
+		}()
+	}
+	return s
+}
+
+// next returns the next line received
+func (s *fakeSyslog) next(t *testing.T) string {
+	select {
+	case line := <-s.lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatalf("no line received")
+		return ""
+	}
+}
+
+// expectLine checks that a line has the priority, tag and message
+func expectLine(t *testing.T, line string, priority int, tag, msg string) {
+	exp := fmt.Sprintf(`^<%d>[A-Z][a-z]{2} [ 0-9]\d \d{2}:\d{2}:\d{2} (\S+ )?%s\[%d\]: %s$`,
+		priority, regexp.QuoteMeta(tag), os.Getpid(), regexp.QuoteMeta(msg))
+	if !regexp.MustCompile(exp).MatchString(line) {
+		t.Fatalf("line %q doesn't match %q", line, exp)
+	}
+}
+
+func TestSyslogWriter(t *testing.T) {
+	for _, network := range []string{"udp", "tcp"} {
+		s := newFakeSyslog(t, network)
+		defer s.close()
+
+		w, err := NewSyslogWriter(&SyslogConfig{Network: network, Address: s.addr, Facility: "local3", Tag: "web"}, SeverityInfo)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+
+		// Each line is forwarded on its own, holding the unterminated end
+		// until it is
+		w.Write([]byte("hello\nwor"))
+		w.Write([]byte("ld\n\nbye"))
+		exp := []string{"hello", "world", ""}
+		for i, msg := range exp {
+			line := s.next(t)
+			expectLine(t, line, 19<<3|SeverityInfo, "web", msg)
+
+			// Remote servers are sent the hostname
+			hostname, _ := os.Hostname()
+			if i == 0 && hostname != "" && !strings.Contains(line, " "+hostname+" web[") {
+				t.Fatalf("%s: hostname missing: %q", network, line)
+			}
+		}
+
+		// Closing forwards the unterminated end
+		if err := w.Close(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		expectLine(t, s.next(t), 19<<3|SeverityInfo, "web", "bye")
+		if _, err := w.Write([]byte("late\n")); err == nil {
+			t.Fatalf("write after close succeeded")
+		}
+		if n := w.Dropped(); n != 0 {
+			t.Fatalf("%s: dropped %d lines", network, n)
+		}
+	}
+}
+
+func TestSyslogWriter_LongLines(t *testing.T) {
+	s := newFakeSyslog(t, "tcp")
+	defer s.close()
+
+	w, err := NewSyslogWriter(&SyslogConfig{Network: "tcp", Address: s.addr}, SeverityErr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	// Lines longer than the limit are split, whether they are terminated or
+	// not
+	long := strings.Repeat("a", syslogMaxLine) + "b"
+	w.Write([]byte(long + "\n"))
+	w.Write([]byte(long))
+	for _, msg := range []string{long[:syslogMaxLine], "b", long[:syslogMaxLine]} {
+		expectLine(t, s.next(t), 1<<3|SeverityErr, "nomad", msg)
+	}
+}
+
+func TestSyslogWriter_Dropped(t *testing.T) {
+	s := newFakeSyslog(t, "tcp")
+	defer s.close()
+
+	// The server is stalled while connecting
+	releaseCh := make(chan struct{})
+	defer func(dial func(string, string, time.Duration) (net.Conn, error), size int) {
+		dialSyslog, syslogQueueSize = dial, size
+	}(dialSyslog, syslogQueueSize)
+	dialSyslog = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		<-releaseCh
+		return net.DialTimeout(network, addr, timeout)
+	}
+	syslogQueueSize = 4
+
+	w, err := NewSyslogWriter(&SyslogConfig{Network: "tcp", Address: s.addr, Tag: "web"}, SeverityInfo)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	// Writes don't block once the queue is full, the lines are dropped
+	// instead
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			fmt.Fprintf(w, "line %d\n", i)
+		}
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("write blocked")
+	}
+	dropped := w.Dropped()
+	if dropped < 100-uint64(syslogQueueSize)-1 {
+		t.Fatalf("dropped %d lines", dropped)
+	}
+
+	// Once the server is back, the lines buffered are sent after a notice
+	// of the lines dropped
+	close(releaseCh)
+	expectLine(t, s.next(t), 1<<3|SeverityWarning, "web", fmt.Sprintf("dropped %d lines of output", dropped))
+	kept := int(100 - dropped)
+	for i := 0; i < kept; i++ {
+		line := s.next(t)
+		if !strings.HasSuffix(line, fmt.Sprintf("]: line %d", i)) {
+			t.Fatalf("bad line %d: %q", i, line)
+		}
+	}
+	w.Write([]byte("after\n"))
+	expectLine(t, s.next(t), 1<<3|SeverityInfo, "web", "after")
+}
+
+func TestSyslogWriter_Local(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := NewSyslogWriter(&SyslogConfig{}, SeverityInfo); err == nil {
+			t.Fatalf("expected error without local syslog")
+		}
+		return
+	}
+
+	s := newFakeSyslog(t, "unixgram")
+	defer s.close()
+	defer func(paths []string) {
+		localSyslogPaths = paths
+	}(localSyslogPaths)
+	localSyslogPaths = []string{filepath.Join(filepath.Dir(s.addr), "missing"), s.addr}
+
+	w, err := NewSyslogWriter(&SyslogConfig{Facility: "daemon", Tag: "web"}, SeverityErr)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+
+	// The local daemon isn't sent the hostname
+	w.Write([]byte("oops\n"))
+	line := s.next(t)
+	expectLine(t, line, 3<<3|SeverityErr, "web", "oops")
+	if !regexp.MustCompile(`^<\d+>.{15} web\[`).MatchString(line) {
+		t.Fatalf("bad line: %q", line)
+	}
+}
+
+func TestSyslogWriter_InvalidConfig(t *testing.T) {
+	for _, c := range []*SyslogConfig{
+		&SyslogConfig{Network: "tcp", Address: "127.0.0.1:514", Facility: "bogus"},
+		&SyslogConfig{Network: "http", Address: "127.0.0.1:514"},
+	} {
+		if _, err := NewSyslogWriter(c, SeverityInfo); err == nil {
+			t.Fatalf("expected error for %#v", c)
+		}
+	}
+}
+
+func TestForwardSyslog(t *testing.T) {
+	s := newFakeSyslog(t, "udp")
+	defer s.close()
+	dir, r := testRotator(t, 2, 1024)
+	defer os.RemoveAll(dir)
+
+	// The output is written to the file and forwarded
+	c := &SyslogConfig{Network: "udp", Address: s.addr, Tag: "web"}
+	stdout, stderr, err := ForwardSyslog(c, r, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fmt.Fprintln(stdout, "out")
+	expectLine(t, s.next(t), 1<<3|SeverityInfo, "web", "out")
+	fmt.Fprintln(stderr, "err")
+	expectLine(t, s.next(t), 1<<3|SeverityErr, "web", "err")
+
+	stdout.Close()
+	stderr.Close()
+	if contents := dirContents(t, dir); contents["web.stdout.0"] != "out\n" {
+		t.Fatalf("bad files: %#v", contents)
+	}
+}
@@ -0,0 +1,543 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// pluginOptionPrefix is the prefix of the client options that register
+	// driver plugins, e.g. driver.plugin.lxc = /opt/nomad/lxc-driver
+	pluginOptionPrefix = "driver.plugin."
+
+	// pluginCookieEnv and pluginCookie are set in the environment of plugins
+	// so they can tell they were launched by the client
+	pluginCookieEnv = "NOMAD_DRIVER_PLUGIN_COOKIE"
+	pluginCookie    = "0c0b1b5e5a4f4e7c9a5b1d8f3e2a6c47"
+
+	// pluginProtocolVersion is the version of the RPC protocol between the
+	// client and plugins
+	pluginProtocolVersion = 1
+
+	// pluginHandleVersionPrefix prefixes the handle IDs of plugins that
+	// version them with the version, e.g. "plugin-handle-v2:<id>"
+	pluginHandleVersionPrefix = "plugin-handle-v"
+)
+
+var (
+	// pluginStartTimeout bounds how long a plugin may take to listen for
+	// the client
+	pluginStartTimeout = 10 * time.Second
+
+	// pluginStopTimeout is how long a plugin is given to exit once the
+	// client closes its stdin before it is killed
+	pluginStopTimeout = 2 * time.Second
+)
+
+// PluginNames returns the names of the driver plugins registered with the
+// options of the client
+func PluginNames(cfg *config.Config) []string {
+	var names []string
+	for key, path := range cfg.ReadOptions() {
+		if strings.HasPrefix(key, pluginOptionPrefix) && path != "" {
+			names = append(names, strings.TrimPrefix(key, pluginOptionPrefix))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// pluginPath returns the path of the binary of the named plugin or an empty
+// string if no such plugin is registered
+func pluginPath(cfg *config.Config, name string) string {
+	if cfg == nil {
+		return ""
+	}
+	return cfg.Read(pluginOptionPrefix + name)
+}
+
+// HandleVersioner is implemented by the drivers of plugins whose handle IDs
+// change format across versions of the plugin. The version is encoded in the
+// handle IDs, so a plugin upgraded while its tasks run can tell whether it
+// is able to reattach to them. Drivers that don't implement it are at version
+// zero and only open handles of version zero.
+type HandleVersioner interface {
+	// HandleVersion is the version of the handle IDs the driver returns
+	HandleVersion() int
+
+	// MinHandleVersion is the oldest version of handle IDs Open understands
+	MinHandleVersion() int
+}
+
+// handleVersions returns the range of handle versions the driver opens
+func handleVersions(d Driver) (min, max int) {
+	if v, ok := d.(HandleVersioner); ok {
+		return v.MinHandleVersion(), v.HandleVersion()
+	}
+	return 0, 0
+}
+
+// IncompatibleHandleError is returned by Open for a handle of a version the
+// driver is unable to reattach to, such as one started by an older plugin
+// before an upgrade or by a newer client before a downgrade. The task is
+// then started again rather than restored.
+type IncompatibleHandleError struct {
+	Version    int
+	MinVersion int
+	MaxVersion int
+}
+
+func (e *IncompatibleHandleError) Error() string {
+	return fmt.Sprintf("handle version %d is incompatible with the driver, which opens versions %d to %d",
+		e.Version, e.MinVersion, e.MaxVersion)
+}
+
+// formatPluginHandleID encodes the version in the handle ID. Handles of
+// version zero are left as they are, as they were before versioning.
+func formatPluginHandleID(version int, id string) string {
+	if version == 0 {
+		return id
+	}
+	return fmt.Sprintf("%s%d:%s", pluginHandleVersionPrefix, version, id)
+}
+
+// parsePluginHandleID returns the version and the ID of the plugin encoded in
+// the handle ID
+func parsePluginHandleID(handleID string) (int, string) {
+	if !strings.HasPrefix(handleID, pluginHandleVersionPrefix) {
+		return 0, handleID
+	}
+	parts := strings.SplitN(strings.TrimPrefix(handleID, pluginHandleVersionPrefix), ":", 2)
+	version, err := strconv.Atoi(parts[0])
+	if len(parts) != 2 || err != nil || version <= 0 {
+		return 0, handleID
+	}
+	return version, parts[1]
+}
+
+// pluginDriver is a driver implemented by a plugin binary that is launched
+// by the client and called over RPC. Each handle has its own plugin process
+// that lives as long as the task, while the other calls launch a plugin just
+// for the call. A plugin that crashes fails its task rather than the client.
+type pluginDriver struct {
+	DriverContext
+	name string
+	path string
+}
+
+// pluginHandle is a handle to a task of a plugin. The ID of the plugin is
+// reported with the handle version of the plugin encoded in it.
+type pluginHandle struct {
+	plugin  *pluginClient
+	handle  int
+	id      string
+	version int
+	waitCh  chan *WaitResult
+	doneCh  chan struct{}
+	lock    sync.Mutex
+}
+
+func newPluginDriver(name, path string, ctx *DriverContext) Driver {
+	return &pluginDriver{DriverContext: *ctx, name: name, path: path}
+}
+
+func (d *pluginDriver) context() PluginContext {
+	return PluginContext{TaskName: d.taskName, Options: d.config.ReadOptions(), Node: d.node}
+}
+
+// call runs the method of the driver in a plugin launched for the call
+func (d *pluginDriver) call(method string, args *PluginArgs, reply interface{}) error {
+	plugin, err := launchPlugin(d.name, d.path, d.DriverContext)
+	if err != nil {
+		return err
+	}
+	defer plugin.stop()
+	return plugin.call(method, args, reply)
+}
+
+func (d *pluginDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	args := &PluginArgs{Context: PluginContext{Options: cfg.ReadOptions(), Node: node}}
+	var reply PluginFingerprintReply
+	if err := d.call("Fingerprint", args, &reply); err != nil {
+		d.logger.Printf("[WARN] driver.plugin.%s: failed to fingerprint: %v", d.name, err)
+		return false, nil
+	}
+	if err := reply.err(); err != nil {
+		return false, err
+	}
+	if !reply.Applies {
+		return false, nil
+	}
+	for k, v := range reply.Attributes {
+		node.Attributes[k] = v
+	}
+	if node.Attributes["driver."+d.name] == "" {
+		node.Attributes["driver."+d.name] = "1"
+	}
+	if reply.Capabilities != nil {
+		AdvertiseCapabilities(node, d.name, reply.Capabilities)
+	}
+	return true, nil
+}
+
+func (d *pluginDriver) Validate(task *structs.Task) error {
+	var reply PluginReply
+	if err := d.call("Validate", &PluginArgs{Context: d.context(), Task: task}, &reply); err != nil {
+		return err
+	}
+	return reply.err()
+}
+
+func (d *pluginDriver) Version() (string, error) {
+	var reply PluginVersionReply
+	if err := d.call("Version", &PluginArgs{Context: d.context()}, &reply); err != nil {
+		return "", err
+	}
+	return reply.Version, reply.err()
+}
+
+// Capabilities returns those the plugin advertised when fingerprinted, as
+// asking a plugin launched for the call would be too slow
+func (d *pluginDriver) Capabilities() *DriverCapabilities {
+	return fingerprintedCapabilities(d.node, d.name)
+}
+
+func (d *pluginDriver) Cleanup(activeHandleIDs []string) error {
+	var reply PluginReply
+	if err := d.call("Cleanup", &PluginArgs{Context: d.context(), HandleIDs: activeHandleIDs}, &reply); err != nil {
+		return err
+	}
+	return reply.err()
+}
+
+func (d *pluginDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	return d.open(ctx, "Start", &PluginArgs{Context: d.context(), Task: task, Exec: d.execContext(execCtx)})
+}
+
+// Open reattaches to the task of the handle, failing with an
+// IncompatibleHandleError if the plugin doesn't understand its version
+func (d *pluginDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
+	version, id := parsePluginHandleID(handleID)
+	return d.open(ctx, "Open", &PluginArgs{
+		Context:       d.context(),
+		Exec:          d.execContext(execCtx),
+		HandleID:      id,
+		HandleVersion: version,
+	})
+}
+
+// open launches the plugin the handle returned by the method belongs to.
+// Cancelling the context stops the plugin, which cancels the call in the
+// plugin in turn.
+func (d *pluginDriver) open(ctx context.Context, method string, args *PluginArgs) (DriverHandle, error) {
+	plugin, err := launchPlugin(d.name, d.path, d.DriverContext)
+	if err != nil {
+		return nil, err
+	}
+	var reply PluginHandleReply
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- plugin.call(method, args, &reply)
+	}()
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		plugin.stop()
+		<-errCh
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		plugin.stop()
+		return nil, err
+	}
+	if err := reply.err(); err != nil {
+		plugin.stop()
+		return nil, err
+	}
+
+	h := &pluginHandle{
+		plugin:  plugin,
+		handle:  reply.Handle,
+		id:      reply.ID,
+		version: reply.Version,
+		doneCh:  make(chan struct{}),
+		waitCh:  make(chan *WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (d *pluginDriver) execContext(ctx *ExecContext) *PluginExecContext {
+	return &PluginExecContext{
+		AllocDir:        ctx.AllocDir,
+		TaskEnv:         ctx.TaskEnv(d.taskName),
+		TaskPorts:       ctx.TaskPorts(d.taskName),
+		TaskNetworkMode: ctx.TaskNetworkMode(d.taskName),
+	}
+}
+
+// ID returns the ID of the handle in the plugin, which is opened by the
+// plugin again after a client restart. The last known ID is returned if the
+// plugin is gone.
+func (h *pluginHandle) ID() string {
+	var reply PluginHandleReply
+	err := h.plugin.call("ID", &PluginHandleArgs{Handle: h.handle}, &reply)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if err == nil && reply.err() == nil {
+		h.id = reply.ID
+	}
+	return formatPluginHandleID(h.version, h.id)
+}
+
+func (h *pluginHandle) WaitCh() chan *WaitResult {
+	return h.waitCh
+}
+
+func (h *pluginHandle) Update(task *structs.Task) error {
+	return h.call("Update", &PluginHandleArgs{Handle: h.handle, Task: task})
+}
+
+func (h *pluginHandle) Kill() error {
+	return h.call("Kill", &PluginHandleArgs{Handle: h.handle})
+}
+
+func (h *pluginHandle) ForceKill() error {
+	return h.call("ForceKill", &PluginHandleArgs{Handle: h.handle})
+}
+
+func (h *pluginHandle) Stats() (*TaskResourceUsage, error) {
+	var reply PluginStatsReply
+	if err := h.plugin.call("Stats", &PluginHandleArgs{Handle: h.handle}, &reply); err != nil {
+		return nil, err
+	}
+	return reply.Usage, reply.err()
+}
+
+func (h *pluginHandle) Signal(sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if !ok {
+		return fmt.Errorf("unsupported signal %v", sig)
+	}
+	return h.call("Signal", &PluginHandleArgs{Handle: h.handle, Signal: int(s)})
+}
+
+func (h *pluginHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	var reply PluginExecReply
+	args := &PluginHandleArgs{Handle: h.handle, Cmd: cmd, Timeout: timeout}
+	if err := h.plugin.call("Exec", args, &reply); err != nil {
+		return nil, 0, err
+	}
+	return reply.Output, reply.Code, reply.err()
+}
+
+func (h *pluginHandle) call(method string, args *PluginHandleArgs) error {
+	var reply PluginReply
+	if err := h.plugin.call(method, args, &reply); err != nil {
+		return err
+	}
+	return reply.err()
+}
+
+// run waits for the task to exit, or for the plugin to crash, then stops the
+// plugin
+func (h *pluginHandle) run() {
+	var reply PluginWaitReply
+	result := NewWaitResult(0, 0, h.plugin.call("Wait", &PluginHandleArgs{Handle: h.handle}, &reply))
+	if result.Err == nil {
+		result = NewWaitResult(reply.ExitCode, reply.Signal, reply.err())
+		result.OOMKilled = reply.OOMKilled
+	}
+	close(h.doneCh)
+	h.waitCh <- result
+	close(h.waitCh)
+	h.plugin.stop()
+}
+
+// pluginClient is a launched plugin process and the RPC client connected to
+// it
+type pluginClient struct {
+	name   string
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	rpc    *rpc.Client
+	exitCh chan struct{}
+
+	// exitErr is why the plugin exited, which is set before exitCh is
+	// closed
+	exitErr error
+}
+
+// launchPlugin starts the plugin binary and connects to the address it
+// announces on its first line of output
+func launchPlugin(name, path string, ctx DriverContext) (*pluginClient, error) {
+	addrCh := make(chan string, 1)
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(), pluginCookieEnv+"="+pluginCookie)
+	cmd.Stdout = &pluginHandshake{lineCh: addrCh}
+	cmd.Stderr = &pluginLogger{ctx: ctx, name: name}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to launch driver plugin '%s': %v", name, err)
+	}
+
+	p := &pluginClient{
+		name:   name,
+		cmd:    cmd,
+		stdin:  stdin,
+		exitCh: make(chan struct{}),
+	}
+	go func() {
+		p.exitErr = cmd.Wait()
+		close(p.exitCh)
+	}()
+
+	var line string
+	select {
+	case line = <-addrCh:
+	case <-p.exitCh:
+		return nil, fmt.Errorf("%v before it started", p.exited())
+	case <-time.After(pluginStartTimeout):
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("driver plugin '%s' did not start within %v", name, pluginStartTimeout)
+	}
+
+	network, addr, err := parsePluginHandshake(line)
+	if err == nil {
+		var conn net.Conn
+		if conn, err = net.Dial(network, addr); err == nil {
+			p.rpc = rpc.NewClient(conn)
+		}
+	}
+	if err != nil {
+		p.stop()
+		return nil, fmt.Errorf("failed to connect to driver plugin '%s': %v", name, err)
+	}
+	return p, nil
+}
+
+// parsePluginHandshake parses the line a plugin announces its address with,
+// of the form <protocol version>|<network>|<address>
+func parsePluginHandshake(line string) (string, string, error) {
+	parts := strings.Split(strings.TrimSpace(line), "|")
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("invalid handshake %q", line)
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", "", fmt.Errorf("invalid handshake %q", line)
+	}
+	if version != pluginProtocolVersion {
+		return "", "", fmt.Errorf("plugin protocol version %d is not supported, want %d", version, pluginProtocolVersion)
+	}
+	return parts[1], parts[2], nil
+}
+
+// call calls the plugin, turning a failure to reach it into an error saying
+// the plugin crashed
+func (p *pluginClient) call(method string, args, reply interface{}) error {
+	err := p.rpc.Call("Plugin."+method, args, reply)
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(rpc.ServerError); ok {
+		return err
+	}
+
+	// The connection is lost when the plugin exits, which may be noticed
+	// before the process is reaped
+	select {
+	case <-p.exitCh:
+		return p.exited()
+	case <-time.After(pluginStopTimeout):
+		return fmt.Errorf("lost connection to driver plugin '%s': %v", p.name, err)
+	}
+}
+
+// exited returns the error the plugin exited with, once exitCh is closed
+func (p *pluginClient) exited() error {
+	if p.exitErr != nil {
+		return fmt.Errorf("driver plugin '%s' exited: %v", p.name, p.exitErr)
+	}
+	return fmt.Errorf("driver plugin '%s' exited", p.name)
+}
+
+// stop closes the stdin of the plugin so it exits, killing it if it does not
+func (p *pluginClient) stop() {
+	if p.rpc != nil {
+		p.rpc.Close()
+	}
+	p.stdin.Close()
+	select {
+	case <-p.exitCh:
+	case <-time.After(pluginStopTimeout):
+		p.cmd.Process.Kill()
+		<-p.exitCh
+	}
+}
+
+// pluginHandshake captures the first line the plugin writes to stdout and
+// discards the rest
+type pluginHandshake struct {
+	buf    bytes.Buffer
+	lineCh chan string
+	sent   bool
+}
+
+func (w *pluginHandshake) Write(p []byte) (int, error) {
+	if w.sent {
+		return len(p), nil
+	}
+	w.buf.Write(p)
+	if i := bytes.IndexByte(w.buf.Bytes(), '\n'); i >= 0 {
+		w.lineCh <- string(w.buf.Bytes()[:i])
+		w.sent = true
+		w.buf.Reset()
+	}
+	return len(p), nil
+}
+
+// pluginLogger logs the lines the plugin writes to stderr. Lines logged by
+// the driver of the plugin already carry their level.
+type pluginLogger struct {
+	ctx  DriverContext
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *pluginLogger) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Keep the partial line for the next write
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			return len(p), nil
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "[") {
+			w.ctx.logger.Print(line)
+		} else {
+			w.ctx.logger.Printf("[DEBUG] driver.plugin.%s: %s", w.name, line)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/rpc"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// The types below are the arguments and replies of the RPC protocol between
+// the client and driver plugins. They must be exported for net/rpc.
+
+// PluginContext is the driver context the plugin creates its driver with
+type PluginContext struct {
+	TaskName string
+	Options  map[string]string
+	Node     *structs.Node
+}
+
+// PluginExecContext is the part of the exec context sent to the plugin
+type PluginExecContext struct {
+	AllocDir        *allocdir.AllocDir
+	TaskEnv         map[string]string
+	TaskPorts       map[string]int
+	TaskNetworkMode string
+}
+
+// PluginArgs are the arguments of the calls to the driver of the plugin
+type PluginArgs struct {
+	Context  PluginContext
+	Task     *structs.Task
+	Exec     *PluginExecContext
+	HandleID string
+
+	// HandleVersion is the version of the handle passed to Open
+	HandleVersion int
+
+	// HandleIDs are the active handles passed to Cleanup
+	HandleIDs []string
+}
+
+// PluginHandleArgs are the arguments of the calls to a handle of the plugin,
+// which is identified by the number the plugin assigned it
+type PluginHandleArgs struct {
+	Handle  int
+	Task    *structs.Task
+	Signal  int
+	Cmd     []string
+	Timeout time.Duration
+}
+
+// PluginReply carries the error of a call. Errors are sent in the reply
+// rather than returned so a NotSupportedError, IncompatibleHandleError or
+// TaskLostError keeps its type.
+type PluginReply struct {
+	Error              string
+	NotSupported       *NotSupportedError
+	IncompatibleHandle *IncompatibleHandleError
+	TaskLost           *TaskLostError
+}
+
+// PluginFingerprintReply is the reply to Fingerprint with the attributes the
+// driver set on the node and its capabilities
+type PluginFingerprintReply struct {
+	PluginReply
+	Applies      bool
+	Attributes   map[string]string
+	Capabilities *DriverCapabilities
+}
+
+// PluginVersionReply is the reply to Version
+type PluginVersionReply struct {
+	PluginReply
+	Version string
+}
+
+// PluginHandleReply is the reply to Start, Open and ID. Version is the
+// handle version of the driver that started or opened the handle.
+type PluginHandleReply struct {
+	PluginReply
+	Handle  int
+	ID      string
+	Version int
+}
+
+// PluginWaitReply is the reply to Wait with how the task exited
+type PluginWaitReply struct {
+	PluginReply
+	ExitCode  int
+	Signal    int
+	OOMKilled bool
+}
+
+// PluginStatsReply is the reply to Stats
+type PluginStatsReply struct {
+	PluginReply
+	Usage *TaskResourceUsage
+}
+
+// PluginExecReply is the reply to Exec
+type PluginExecReply struct {
+	PluginReply
+	Output []byte
+	Code   int
+}
+
+func (r *PluginReply) setError(err error) {
+	if err == nil {
+		return
+	}
+	switch e := err.(type) {
+	case *NotSupportedError:
+		r.NotSupported = e
+	case *IncompatibleHandleError:
+		r.IncompatibleHandle = e
+	case *TaskLostError:
+		r.TaskLost = e
+	default:
+		r.Error = err.Error()
+	}
+}
+
+func (r *PluginReply) err() error {
+	if r.NotSupported != nil {
+		return r.NotSupported
+	}
+	if r.IncompatibleHandle != nil {
+		return r.IncompatibleHandle
+	}
+	if r.TaskLost != nil {
+		return r.TaskLost
+	}
+	if r.Error != "" {
+		return fmt.Errorf("%s", r.Error)
+	}
+	return nil
+}
+
+// ServePlugin serves the driver created by the factory to the client that
+// launched the plugin. It is called from the main function of plugin binaries
+// and returns once the client goes away, which closes the stdin of the
+// plugin.
+func ServePlugin(factory Factory) error {
+	if os.Getenv(pluginCookieEnv) != pluginCookie {
+		return fmt.Errorf("This binary is a Nomad driver plugin and is launched by the Nomad client. " +
+			"Configure it with the driver.plugin.<name> client option.")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	defer l.Close()
+
+	// The calls of the client are cancelled once it goes away
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	srv := rpc.NewServer()
+	plugin := &pluginServer{
+		ctx:     ctx,
+		factory: factory,
+		logger:  log.New(os.Stderr, "", 0),
+		handles: make(map[int]DriverHandle),
+	}
+	if err := srv.RegisterName("Plugin", plugin); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%d|tcp|%s\n", pluginProtocolVersion, l.Addr())
+
+	// The client holds the stdin of the plugin open while it is alive
+	go func() {
+		io.Copy(ioutil.Discard, os.Stdin)
+		cancel()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil
+		}
+		go srv.ServeConn(conn)
+	}
+}
+
+// pluginServer serves the calls of the client to the driver of the plugin
+// and the handles it returned
+type pluginServer struct {
+	ctx     context.Context
+	factory Factory
+	logger  *log.Logger
+
+	handles    map[int]DriverHandle
+	lastHandle int
+	lock       sync.Mutex
+}
+
+func (s *pluginServer) driver(ctx PluginContext) Driver {
+	cfg := &config.Config{Options: ctx.Options, Node: ctx.Node}
+	return s.factory(NewDriverContext(ctx.TaskName, cfg, ctx.Node, s.logger))
+}
+
+func (s *pluginServer) execContext(args *PluginArgs) *ExecContext {
+	if args.Exec == nil {
+		return NewExecContext(nil)
+	}
+	ctx := NewExecContext(args.Exec.AllocDir)
+	if args.Exec.TaskEnv != nil {
+		ctx.SetTaskEnv(args.Context.TaskName, args.Exec.TaskEnv)
+	}
+	if args.Exec.TaskPorts != nil {
+		ctx.SetTaskPorts(args.Context.TaskName, args.Exec.TaskPorts)
+	}
+	if args.Exec.TaskNetworkMode != "" {
+		ctx.SetTaskNetworkMode(args.Context.TaskName, args.Exec.TaskNetworkMode)
+	}
+	return ctx
+}
+
+func (s *pluginServer) handle(n int) (DriverHandle, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	h, ok := s.handles[n]
+	if !ok {
+		return nil, fmt.Errorf("unknown handle %d", n)
+	}
+	return h, nil
+}
+
+func (s *pluginServer) addHandle(h DriverHandle, reply *PluginHandleReply) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastHandle++
+	s.handles[s.lastHandle] = h
+	reply.Handle = s.lastHandle
+	reply.ID = h.ID()
+}
+
+func (s *pluginServer) Fingerprint(args PluginArgs, reply *PluginFingerprintReply) error {
+	node := args.Context.Node
+	if node == nil {
+		node = &structs.Node{}
+	}
+	if node.Attributes == nil {
+		node.Attributes = make(map[string]string)
+	}
+	cfg := &config.Config{Options: args.Context.Options, Node: node}
+	d := s.driver(args.Context)
+	applies, err := d.Fingerprint(cfg, node)
+	reply.setError(err)
+	reply.Applies = applies
+	reply.Attributes = node.Attributes
+	if applies {
+		reply.Capabilities = d.Capabilities()
+	}
+	return nil
+}
+
+func (s *pluginServer) Validate(args PluginArgs, reply *PluginReply) error {
+	reply.setError(s.driver(args.Context).Validate(args.Task))
+	return nil
+}
+
+func (s *pluginServer) Version(args PluginArgs, reply *PluginVersionReply) error {
+	version, err := s.driver(args.Context).Version()
+	reply.setError(err)
+	reply.Version = version
+	return nil
+}
+
+func (s *pluginServer) Cleanup(args PluginArgs, reply *PluginReply) error {
+	reply.setError(s.driver(args.Context).Cleanup(args.HandleIDs))
+	return nil
+}
+
+func (s *pluginServer) Start(args PluginArgs, reply *PluginHandleReply) error {
+	d := s.driver(args.Context)
+	h, err := d.Start(s.ctx, s.execContext(&args), args.Task)
+	if err != nil {
+		reply.setError(err)
+		return nil
+	}
+	s.addHandle(h, reply)
+	_, reply.Version = handleVersions(d)
+	return nil
+}
+
+// Open reattaches to the handle if the driver understands its version
+func (s *pluginServer) Open(args PluginArgs, reply *PluginHandleReply) error {
+	d := s.driver(args.Context)
+	min, max := handleVersions(d)
+	if args.HandleVersion < min || args.HandleVersion > max {
+		reply.setError(&IncompatibleHandleError{Version: args.HandleVersion, MinVersion: min, MaxVersion: max})
+		return nil
+	}
+	h, err := d.Open(s.ctx, s.execContext(&args), args.HandleID)
+	if err != nil {
+		reply.setError(err)
+		return nil
+	}
+	s.addHandle(h, reply)
+	reply.Version = max
+	return nil
+}
+
+func (s *pluginServer) ID(args PluginHandleArgs, reply *PluginHandleReply) error {
+	h, err := s.handle(args.Handle)
+	if err != nil {
+		reply.setError(err)
+		return nil
+	}
+	reply.Handle = args.Handle
+	reply.ID = h.ID()
+	return nil
+}
+
+// Wait blocks until the task of the handle exits, then forgets the handle
+func (s *pluginServer) Wait(args PluginHandleArgs, reply *PluginWaitReply) error {
+	h, err := s.handle(args.Handle)
+	if err != nil {
+		reply.setError(err)
+		return nil
+	}
+	result := <-h.WaitCh()
+	reply.ExitCode, reply.Signal = result.ExitCode, result.Signal
+	reply.OOMKilled = result.OOMKilled
+	reply.setError(result.Err)
+
+	s.lock.Lock()
+	delete(s.handles, args.Handle)
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *pluginServer) Update(args PluginHandleArgs, reply *PluginReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		err = h.Update(args.Task)
+	}
+	reply.setError(err)
+	return nil
+}
+
+func (s *pluginServer) Kill(args PluginHandleArgs, reply *PluginReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		err = h.Kill()
+	}
+	reply.setError(err)
+	return nil
+}
+
+func (s *pluginServer) ForceKill(args PluginHandleArgs, reply *PluginReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		err = h.ForceKill()
+	}
+	reply.setError(err)
+	return nil
+}
+
+func (s *pluginServer) Stats(args PluginHandleArgs, reply *PluginStatsReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		reply.Usage, err = h.Stats()
+	}
+	reply.setError(err)
+	return nil
+}
+
+func (s *pluginServer) Signal(args PluginHandleArgs, reply *PluginReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		err = h.Signal(syscall.Signal(args.Signal))
+	}
+	reply.setError(err)
+	return nil
+}
+
+func (s *pluginServer) Exec(args PluginHandleArgs, reply *PluginExecReply) error {
+	h, err := s.handle(args.Handle)
+	if err == nil {
+		reply.Output, reply.Code, err = h.Exec(args.Cmd, args.Timeout)
+	}
+	reply.setError(err)
+	return nil
+}
@@ -0,0 +1,305 @@
+package driver
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// buildExamplePlugin builds the example plugin, returning the path of the
+// binary and the directory to remove once done
+func buildExamplePlugin(t *testing.T) (string, string) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not found; skipping")
+	}
+	dir, err := ioutil.TempDir("", "nomad-plugin")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(dir, "example-plugin")
+	if runtime.GOOS == "windows" {
+		path += ".exe"
+	}
+	out, err := exec.Command("go", "build", "-o", path, "github.com/hashicorp/nomad/client/driver/example-plugin").CombinedOutput()
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("failed to build example plugin: %v\n%s", err, out)
+	}
+	return path, dir
+}
+
+// testPluginDriver returns the example plugin registered as the sleep driver
+func testPluginDriver(t *testing.T, task *structs.Task) (Driver, *ExecContext, func()) {
+	path, dir := buildExamplePlugin(t)
+	driverCtx := testDriverContext(task.Name)
+	driverCtx.config.Options = map[string]string{"driver.plugin.sleep": path}
+	ctx := testDriverExecContext(task, driverCtx)
+	d, err := NewDriver("sleep", driverCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return d, ctx, func() {
+		ctx.AllocDir.Destroy()
+		os.RemoveAll(dir)
+	}
+}
+
+func sleepTask(config map[string]string) *structs.Task {
+	return &structs.Task{Name: "sleep", Driver: "sleep", Config: config}
+}
+
+func TestPluginNames(t *testing.T) {
+	cfg := &config.Config{Options: map[string]string{
+		"driver.plugin.sleep":    "/opt/sleep",
+		"driver.plugin.lxc":      "/opt/lxc",
+		"driver.plugin.disabled": "",
+		"driver.raw_exec.enable": "1",
+	}}
+	names := PluginNames(cfg)
+	if len(names) != 2 || names[0] != "lxc" || names[1] != "sleep" {
+		t.Fatalf("bad: %v", names)
+	}
+}
+
+func TestPluginHandshake_Parse(t *testing.T) {
+	network, addr, err := parsePluginHandshake("1|tcp|127.0.0.1:4242\n")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if network != "tcp" || addr != "127.0.0.1:4242" {
+		t.Fatalf("bad: %s %s", network, addr)
+	}
+	for _, line := range []string{"", "1|tcp", "x|tcp|127.0.0.1:4242", "2|tcp|127.0.0.1:4242"} {
+		if _, _, err := parsePluginHandshake(line); err == nil {
+			t.Fatalf("%q: expected error", line)
+		}
+	}
+}
+
+func TestPluginDriver_Unregistered(t *testing.T) {
+	driverCtx := testDriverContext("sleep")
+	if _, err := NewDriver("sleep", driverCtx); err == nil || !strings.Contains(err.Error(), "unknown driver") {
+		t.Fatalf("expected unknown driver error: %v", err)
+	}
+
+	// A plugin that can not be launched is not fingerprinted
+	driverCtx.config.Options = map[string]string{"driver.plugin.sleep": "/nonexistent/plugin"}
+	d, err := NewDriver("sleep", driverCtx)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if apply, err := d.Fingerprint(driverCtx.config, node); apply || err != nil {
+		t.Fatalf("bad: %v %v", apply, err)
+	}
+}
+
+func TestPluginDriver_RoundTrip(t *testing.T) {
+	task := sleepTask(map[string]string{"duration": "1s"})
+	d, ctx, cleanup := testPluginDriver(t, task)
+	defer cleanup()
+
+	node := &structs.Node{Attributes: make(map[string]string)}
+	apply, err := d.Fingerprint(&config.Config{}, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply || node.Attributes["driver.sleep"] != "1" || node.Attributes["driver.sleep.version"] != "0.1.0" {
+		t.Fatalf("bad fingerprint: %v %v", apply, node.Attributes)
+	}
+	if caps := fingerprintedCapabilities(node, "sleep"); !caps.Exec || caps.Signals || caps.FSIsolation != FSIsolationNone {
+		t.Fatalf("bad capabilities: %#v", caps)
+	}
+	if version, err := d.Version(); err != nil || version != "0.1.0" {
+		t.Fatalf("bad version: %q %v", version, err)
+	}
+	if err := d.Validate(sleepTask(map[string]string{})); err == nil || !strings.Contains(err.Error(), "invalid duration") {
+		t.Fatalf("expected validation error: %v", err)
+	}
+	if err := d.Cleanup(nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !strings.HasPrefix(handle.ID(), "SLEEP:") {
+		t.Fatalf("bad ID: %s", handle.ID())
+	}
+
+	// Errors keep their type across the plugin
+	if _, err := handle.Stats(); !IsNotSupported(err) {
+		t.Fatalf("expected not supported error: %v", err)
+	}
+	out, code, err := handle.Exec([]string{"echo", "hi"}, time.Second)
+	if err != nil || code != 0 || string(out) != "echo hi" {
+		t.Fatalf("bad exec: %q %d %v", out, code, err)
+	}
+
+	// The task is reopened by a new plugin
+	handle2, err := d.Open(context.Background(), ctx, handle.ID())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle2.ID() != handle.ID() {
+		t.Fatalf("reopened handle differs: %s != %s", handle2.ID(), handle.ID())
+	}
+
+	for _, h := range []DriverHandle{handle, handle2} {
+		select {
+		case res := <-h.WaitCh():
+			if !res.Successful() {
+				t.Fatalf("err: %v", res)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestPluginDriver_ExitCode(t *testing.T) {
+	task := sleepTask(map[string]string{"duration": "100ms", "exit_code": "3"})
+	d, ctx, cleanup := testPluginDriver(t, task)
+	defer cleanup()
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-handle.WaitCh():
+		if res.ExitCode != 3 || res.Err != nil {
+			t.Fatalf("expected exit code 3: %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestPluginDriver_Kill(t *testing.T) {
+	task := sleepTask(map[string]string{"duration": "10s"})
+	d, ctx, cleanup := testPluginDriver(t, task)
+	defer cleanup()
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-handle.WaitCh():
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "killed") {
+			t.Fatalf("expected kill error: %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestPluginDriver_Crash(t *testing.T) {
+	task := sleepTask(map[string]string{"duration": "100ms", "crash": "true"})
+	d, ctx, cleanup := testPluginDriver(t, task)
+	defer cleanup()
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The crash fails the task
+	select {
+	case res := <-handle.WaitCh():
+		if res.Err == nil || !strings.Contains(res.Err.Error(), "driver plugin 'sleep' exited") {
+			t.Fatalf("expected plugin exit error: %v", res)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Calls to the handle fail rather than hang
+	if err := handle.Kill(); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestPluginHandleID_Version(t *testing.T) {
+	if id := formatPluginHandleID(0, "SLEEP:{}"); id != "SLEEP:{}" {
+		t.Fatalf("bad: %s", id)
+	}
+	id := formatPluginHandleID(2, "SLEEP:{}")
+	if id != "plugin-handle-v2:SLEEP:{}" {
+		t.Fatalf("bad: %s", id)
+	}
+	if version, inner := parsePluginHandleID(id); version != 2 || inner != "SLEEP:{}" {
+		t.Fatalf("bad: %d %s", version, inner)
+	}
+
+	// IDs without a valid version are of version zero
+	for _, id := range []string{"SLEEP:{}", "plugin-handle-vx:SLEEP:{}", "plugin-handle-v2"} {
+		if version, inner := parsePluginHandleID(id); version != 0 || inner != id {
+			t.Fatalf("%s: bad: %d %s", id, version, inner)
+		}
+	}
+}
+
+func TestPluginDriver_Open_Upgrade(t *testing.T) {
+	defer os.Unsetenv("SLEEP_HANDLE_VERSION")
+	defer os.Unsetenv("SLEEP_MIN_HANDLE_VERSION")
+	task := sleepTask(map[string]string{"duration": "10s"})
+	d, ctx, cleanup := testPluginDriver(t, task)
+	defer cleanup()
+
+	// The task is started by the old plugin
+	os.Setenv("SLEEP_HANDLE_VERSION", "1")
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.Kill()
+	oldID := handle.ID()
+	if !strings.HasPrefix(oldID, "plugin-handle-v1:SLEEP:") {
+		t.Fatalf("bad ID: %s", oldID)
+	}
+
+	// A new plugin that still understands the old handles reattaches,
+	// reporting the handle in its own version
+	os.Setenv("SLEEP_HANDLE_VERSION", "2")
+	os.Setenv("SLEEP_MIN_HANDLE_VERSION", "1")
+	handle2, err := d.Open(context.Background(), ctx, oldID)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle2.Kill()
+	if !strings.HasPrefix(handle2.ID(), "plugin-handle-v2:SLEEP:") {
+		t.Fatalf("bad ID: %s", handle2.ID())
+	}
+
+	// One that doesn't refuses them with an error that survives the plugin
+	os.Setenv("SLEEP_HANDLE_VERSION", "3")
+	os.Setenv("SLEEP_MIN_HANDLE_VERSION", "2")
+	_, err = d.Open(context.Background(), ctx, oldID)
+	incompatible, ok := err.(*IncompatibleHandleError)
+	if !ok {
+		t.Fatalf("expected incompatible handle error: %v", err)
+	}
+	if incompatible.Version != 1 || incompatible.MinVersion != 2 || incompatible.MaxVersion != 3 {
+		t.Fatalf("bad: %#v", incompatible)
+	}
+
+	// Handles from before the plugin versioned them are of version zero
+	if _, err := d.Open(context.Background(), ctx, strings.TrimPrefix(oldID, "plugin-handle-v1:")); err == nil {
+		t.Fatalf("expected error")
+	}
+}
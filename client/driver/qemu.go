@@ -2,23 +2,27 @@ package driver
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
+	"github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
@@ -26,6 +30,20 @@ import (
 
 var (
 	reQemuVersion = regexp.MustCompile("QEMU emulator version ([\\d\\.]+).+")
+
+	// qemuMonitorTimeout bounds connecting to and writing to the monitor
+	// socket of a VM.
+	qemuMonitorTimeout = time.Second
+)
+
+const (
+	// qemuMonitorSock is the name of the monitor socket of the VM in the
+	// local directory of the task.
+	qemuMonitorSock = "qemu-monitor.sock"
+
+	// qemuMHzPerCore is the CPU resources, in MHz, given to each virtual
+	// CPU of the VM.
+	qemuMHzPerCore = 1000
 )
 
 // QemuDriver is a driver for running images via Qemu
@@ -37,17 +55,27 @@ type QemuDriver struct {
 
 // qemuHandle is returned from Start/Open as a handle to the PID
 type qemuHandle struct {
-	proc   *os.Process
-	vmID   string
-	waitCh chan error
-	doneCh chan struct{}
+	// cmd is set if the VM was started by this client rather than reopened
+	cmd         *exec.Cmd
+	proc        *os.Process
+	startTime   string
+	vmID        string
+	monitorPath string
+	stats       *pidStats
+	waitCh      chan *WaitResult
+	doneCh      chan struct{}
 }
 
+// qemuHandleVersion is the version of the encoding of Qemu handles
+const qemuHandleVersion = 1
+
 // qemuPID is a struct to map the pid running the process to the vm image on
-// disk
+// disk and the monitor socket used to shut it down
 type qemuPID struct {
-	Pid  int
-	VmID string
+	Pid         int
+	StartTime   string `json:",omitempty"`
+	VmID        string
+	MonitorPath string `json:",omitempty"`
 }
 
 // NewQemuDriver is used to create a new exec driver
@@ -79,60 +107,128 @@ func (d *QemuDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool,
 	return true, nil
 }
 
-// Run an existing Qemu image. Start() will pull down an existing, valid Qemu
-// image and save it to the Drivers Allocation Dir
-func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle, error) {
-	// Get the image source
-	source, ok := task.Config["image_source"]
-	if !ok || source == "" {
-		return nil, fmt.Errorf("Missing source image Qemu driver")
+// Version returns the version of Qemu detected when fingerprinting
+func (d *QemuDriver) Version() (string, error) {
+	return d.fingerprintedVersion("qemu")
+}
+
+func (d *QemuDriver) Capabilities() *DriverCapabilities {
+	return &DriverCapabilities{
+		FSIsolation:  FSIsolationImage,
+		NetworkModes: []string{NetworkModeBridge},
+	}
+}
+
+// Cleanup quits the VMs whose monitor socket is left in the local directory
+// of a task that none of the handles reference. VMs started without a
+// monitor can't be found once their handle is lost.
+func (d *QemuDriver) Cleanup(activeHandleIDs []string) error {
+	orphans, err := orphanedQemuMonitors(d.config.AllocDir, activeHandleIDs)
+	if err != nil {
+		return fmt.Errorf("Not stopping orphaned VMs: %v", err)
+	}
+	for _, path := range orphans {
+		// The socket outlives a VM that exited, so failing to connect
+		// means there is nothing to stop
+		if err := sendQemuMonitor(path, "quit"); err != nil {
+			d.logger.Printf("[DEBUG] driver.qemu: not stopping orphaned VM of %s: %v", path, err)
+			continue
+		}
+		d.logger.Printf("[INFO] driver.qemu: stopped orphaned VM of %s", path)
+	}
+	return nil
+}
+
+// orphanedQemuMonitors returns the paths of the monitor sockets in the task
+// directories of the alloc dir that none of the handles reference. A qemu
+// handle that can't be parsed may reference any of them, so none is an
+// orphan then.
+func orphanedQemuMonitors(allocDir string, activeHandleIDs []string) ([]string, error) {
+	active := make(map[string]struct{}, len(activeHandleIDs))
+	for _, handleID := range activeHandleIDs {
+		if !strings.HasPrefix(handleID, "qemu:") && !strings.HasPrefix(handleID, "QEMU:") {
+			continue
+		}
+		handle, _, err := parseHandleID(handleID, "qemu", "QEMU:", qemuHandleVersion)
+		if err != nil {
+			return nil, fmt.Errorf("unable to tell the VM of a handle: %v", err)
+		}
+		qpid := &qemuPID{}
+		if err := json.Unmarshal([]byte(handle), qpid); err != nil {
+			return nil, fmt.Errorf("unable to tell the VM of handle '%s': %v", handleID, err)
+		}
+		if qpid.MonitorPath != "" {
+			active[filepath.Clean(qpid.MonitorPath)] = struct{}{}
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(allocDir, "*", "*", allocdir.TaskLocal, qemuMonitorSock))
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, path := range paths {
+		if _, ok := active[path]; !ok {
+			orphans = append(orphans, path)
+		}
+	}
+	return orphans, nil
+}
+
+// Validate checks that the task has an image, memory and guest ports matching
+// its reserved ports
+func (d *QemuDriver) Validate(task *structs.Task) error {
+	var mErr multierror.Error
+	image := task.Config["image_path"]
+	if image == "" && task.Config["image_source"] == "" {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Missing image for Qemu driver: set 'image_path' or 'image_source' in the task config"))
+	}
+	if rel := filepath.Clean(image); image != "" && (filepath.IsAbs(rel) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Qemu image path '%s' escapes the task directory", image))
 	}
 
 	// Qemu defaults to 128M of RAM for a given VM. Instead, we force users to
 	// supply a memory size in the tasks resources
 	if task.Resources == nil || task.Resources.MemoryMB == 0 {
-		return nil, fmt.Errorf("Missing required Task Resource: Memory")
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Missing required Task Resource: Memory"))
+	} else if guestPorts := task.Config["guest_ports"]; guestPorts != "" {
+		var reserved int
+		if len(task.Resources.Networks) > 0 {
+			reserved = len(task.Resources.Networks[0].ReservedPorts)
+		}
+		if len(strings.Split(guestPorts, ",")) != reserved {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("guest_ports must match the %d reserved ports of the task", reserved))
+		}
 	}
+	return mErr.ErrorOrNil()
+}
 
-	// Attempt to download the thing
-	// Should be extracted to some kind of Http Fetcher
-	// Right now, assume publicly accessible HTTP url
-	resp, err := http.Get(source)
-	if err != nil {
-		return nil, fmt.Errorf("Error downloading source for Qemu driver: %s", err)
+// Run an existing Qemu image. Start() boots the image at image_path within
+// the task directory, usually fetched as an artifact, or pulls down the image
+// at image_source and saves it to the Drivers Allocation Dir
+func (d *QemuDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
 	}
 
 	// Get the tasks local directory.
-	taskDir, ok := ctx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	taskDir, ok := execCtx.AllocDir.TaskDirs[d.DriverContext.taskName]
 	if !ok {
 		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
 	}
 	taskLocal := filepath.Join(taskDir, allocdir.TaskLocal)
 
-	// Create a location in the local directory to download and store the image.
-	// TODO: Caching
-	vmID := fmt.Sprintf("qemu-vm-%s-%s", structs.GenerateUUID(), filepath.Base(source))
-	fPath := filepath.Join(taskLocal, vmID)
-	vmPath, err := os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY, 0666)
+	vmPath, err := d.qemuImage(ctx, task, taskDir)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening file to download to: %s", err)
-	}
-
-	defer vmPath.Close()
-	defer resp.Body.Close()
-
-	// Copy remote file to local AllocDir for execution
-	// TODO: a retry of sort if io.Copy fails, for large binaries
-	_, ioErr := io.Copy(vmPath, resp.Body)
-	if ioErr != nil {
-		return nil, fmt.Errorf("Error copying Qemu image from source: %s", ioErr)
+		return nil, err
 	}
+	vmID := filepath.Base(vmPath)
 
 	// compute and check checksum
 	if check, ok := task.Config["checksum"]; ok {
 		d.logger.Printf("[DEBUG] Running checksum on (%s)", vmID)
 		hasher := sha256.New()
-		file, err := os.Open(vmPath.Name())
+		file, err := os.Open(vmPath)
 		if err != nil {
 			return nil, fmt.Errorf("Failed to open file for checksum")
 		}
@@ -163,53 +259,38 @@ func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle,
 		"-machine", "type=pc,accel=" + accelerator,
 		"-name", vmID,
 		"-m", mem,
-		"-drive", "file=" + vmPath.Name(),
+		"-smp", strconv.Itoa(qemuCores(task.Resources.CPU)),
+		"-drive", "file=" + vmPath,
 		"-nodefconfig",
 		"-nodefaults",
 		"-nographic",
 	}
 
+	// The monitor socket is used to ask the VM to shut down. Windows has no
+	// unix sockets so the VM is interrupted instead.
+	var monitorPath string
+	if runtime.GOOS != "windows" {
+		monitorPath = filepath.Join(taskLocal, qemuMonitorSock)
+		args = append(args, "-monitor", fmt.Sprintf("unix:%s,server,nowait", monitorPath))
+	}
+
 	// Check the Resources required Networks to add port mappings. If no resources
 	// are required, we assume the VM is a purely compute job and does not require
 	// the outside world to be able to reach it. VMs ran without port mappings can
 	// still reach out to the world, but without port mappings it is effectively
 	// firewalled
 	if len(task.Resources.Networks) > 0 {
-		// TODO: Consolidate these into map of host/guest port when we have HCL
-		// Note: Host port must be open and available
-		// Get and split guest ports. The guest_ports configuration must match up with
-		// the Reserved ports in the Task Resources
-		// Users can supply guest_hosts as a list of posts to map on the guest vm.
-		// These map 1:1 with the requested Reserved Ports from the hostmachine.
-		ports := strings.Split(task.Config["guest_ports"], ",")
-		if len(ports) == 0 {
-			return nil, fmt.Errorf("[ERR] driver.qemu: Error parsing required Guest Ports")
-		}
-
-		// TODO: support more than a single, default Network
-		if len(ports) != len(task.Resources.Networks[0].ReservedPorts) {
-			return nil, fmt.Errorf("[ERR] driver.qemu: Error matching Guest Ports with Reserved ports")
-		}
-
-		// Loop through the reserved ports and construct the hostfwd string, to map
-		// reserved ports to the ports listenting in the VM
-		// Ex:
-		//    hostfwd=tcp::22000-:22,hostfwd=tcp::80-:8080
-		reservedPorts := task.Resources.Networks[0].ReservedPorts
-		var forwarding string
-		for i, p := range ports {
-			forwarding = fmt.Sprintf("%s,hostfwd=tcp::%s-:%s", forwarding, strconv.Itoa(reservedPorts[i]), p)
+		forwarding, err := qemuPortForwards(execCtx, task)
+		if err != nil {
+			return nil, err
 		}
-
-		if "" == forwarding {
-			return nil, fmt.Errorf("[ERR] driver.qemu:  Error constructing port forwarding")
+		if forwarding != "" {
+			args = append(args,
+				"-netdev",
+				fmt.Sprintf("user,id=user.0%s", forwarding),
+				"-device", "virtio-net,netdev=user.0",
+			)
 		}
-
-		args = append(args,
-			"-netdev",
-			fmt.Sprintf("user,id=user.0%s", forwarding),
-			"-device", "virtio-net,netdev=user.0",
-		)
 	}
 
 	// If using KVM, add optimization args
@@ -237,26 +318,50 @@ func (d *QemuDriver) Start(ctx *ExecContext, task *structs.Task) (DriverHandle,
 
 	d.logger.Printf("[INFO] Started new QemuVM: %s", vmID)
 
+	// Record the start time so the PID can be verified when reopened
+	startTime, err := processStartTime(cmd.Process.Pid)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, fmt.Errorf("failed to determine start time of Qemu: %v", err)
+	}
+
 	// Create and Return Handle
 	h := &qemuHandle{
-		proc:   cmd.Process,
-		vmID:   vmPath.Name(),
-		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		cmd:         cmd,
+		proc:        cmd.Process,
+		startTime:   startTime,
+		vmID:        vmPath,
+		monitorPath: monitorPath,
+		stats:       newPidStats("qemu", cmd.Process.Pid),
+		doneCh:      make(chan struct{}),
+		waitCh:      make(chan *WaitResult, 1),
 	}
 
 	go h.run()
 	return h, nil
 }
 
-func (d *QemuDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, error) {
+func (d *QemuDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
 	// Parse the handle
-	pidBytes := []byte(strings.TrimPrefix(handleID, "QEMU:"))
+	handle, _, err := parseHandleID(handleID, "qemu", "QEMU:", qemuHandleVersion)
+	if err != nil {
+		return nil, err
+	}
 	qpid := &qemuPID{}
-	if err := json.Unmarshal(pidBytes, qpid); err != nil {
+	if err := json.Unmarshal([]byte(handle), qpid); err != nil {
 		return nil, fmt.Errorf("failed to parse Qemu handle '%s': %v", handleID, err)
 	}
 
+	// Make sure the PID still belongs to the VM that was started and has
+	// not been recycled.
+	startTime, err := processStartTime(qpid.Pid)
+	if err != nil {
+		return nil, &TaskLostError{Reason: fmt.Sprintf("failed to find Qemu PID %d: %v", qpid.Pid, err)}
+	}
+	if qpid.StartTime != "" && startTime != qpid.StartTime {
+		return nil, &TaskLostError{Reason: fmt.Sprintf("Qemu PID %d no longer belongs to the task", qpid.Pid)}
+	}
+
 	// Find the process
 	proc, err := os.FindProcess(qpid.Pid)
 	if proc == nil || err != nil {
@@ -265,10 +370,13 @@ func (d *QemuDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 
 	// Return a driver handle
 	h := &qemuHandle{
-		proc:   proc,
-		vmID:   qpid.VmID,
-		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		proc:        proc,
+		startTime:   startTime,
+		vmID:        qpid.VmID,
+		monitorPath: qpid.MonitorPath,
+		stats:       newPidStats("qemu", proc.Pid),
+		doneCh:      make(chan struct{}),
+		waitCh:      make(chan *WaitResult, 1),
 	}
 
 	go h.run()
@@ -278,17 +386,19 @@ func (d *QemuDriver) Open(ctx *ExecContext, handleID string) (DriverHandle, erro
 func (h *qemuHandle) ID() string {
 	// Return a handle to the PID
 	pid := &qemuPID{
-		Pid:  h.proc.Pid,
-		VmID: h.vmID,
+		Pid:         h.proc.Pid,
+		StartTime:   h.startTime,
+		VmID:        h.vmID,
+		MonitorPath: h.monitorPath,
 	}
 	data, err := json.Marshal(pid)
 	if err != nil {
 		log.Printf("[ERR] failed to marshal Qemu PID to JSON: %s", err)
 	}
-	return fmt.Sprintf("QEMU:%s", string(data))
+	return formatHandleID("qemu", qemuHandleVersion, string(data))
 }
 
-func (h *qemuHandle) WaitCh() chan error {
+func (h *qemuHandle) WaitCh() chan *WaitResult {
 	return h.waitCh
 }
 
@@ -297,28 +407,161 @@ func (h *qemuHandle) Update(task *structs.Task) error {
 	return nil
 }
 
-// Kill is used to terminate the task. We send an Interrupt
-// and then provide a 5 second grace period before doing a Kill.
-//
-// TODO: allow a 'shutdown_command' that can be executed over a ssh connection
-// to the VM
+// Kill is used to terminate the task. The guest is sent an ACPI shutdown
+// through the monitor socket, falling back to interrupting the emulator, and
+// the caller relies on ForceKill if the VM does not shut down in time.
 func (h *qemuHandle) Kill() error {
-	h.proc.Signal(os.Interrupt)
-	select {
-	case <-h.doneCh:
-		return nil
-	case <-time.After(5 * time.Second):
-		return h.proc.Kill()
+	if h.monitorPath != "" {
+		err := sendQemuMonitor(h.monitorPath, "system_powerdown")
+		if err == nil {
+			return nil
+		}
+		log.Printf("[WARN] driver.qemu: failed to shut down VM %s gracefully: %v", h.vmID, err)
 	}
+	return h.proc.Signal(os.Interrupt)
+}
+
+func (h *qemuHandle) ForceKill() error {
+	return h.proc.Kill()
+}
+
+func (h *qemuHandle) Stats() (*TaskResourceUsage, error) {
+	return h.stats.Stats()
+}
+
+// Signal is not supported as signals would be delivered to the emulator
+// rather than the guest operating system.
+func (h *qemuHandle) Signal(sig os.Signal) error {
+	return &NotSupportedError{Driver: "qemu", Operation: "signals"}
+}
+
+func (h *qemuHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	return nil, 0, &NotSupportedError{Driver: "qemu", Operation: "exec"}
 }
 
 func (h *qemuHandle) run() {
-	ps, err := h.proc.Wait()
+	var err error
+	if h.cmd != nil {
+		err = h.cmd.Wait()
+	} else {
+		// A reopened process is not our child so its exit status can not be
+		// retrieved.
+		err = waitProcess(h.proc)
+	}
 	close(h.doneCh)
+	h.waitCh <- waitResult(err)
+	close(h.waitCh)
+}
+
+// qemuImage returns the path of the image to boot. The image is either a
+// file in the task directory, usually downloaded as an artifact, or
+// downloaded from a URL into the local directory of the task.
+func (d *QemuDriver) qemuImage(ctx context.Context, task *structs.Task, taskDir string) (string, error) {
+	if image, ok := task.Config["image_path"]; ok && image != "" {
+		path := filepath.Join(taskDir, image)
+		if rel, err := filepath.Rel(taskDir, path); err != nil || strings.HasPrefix(rel, "..") {
+			return "", fmt.Errorf("Qemu image path '%s' escapes the task directory", image)
+		}
+		if _, err := os.Stat(path); err != nil {
+			return "", fmt.Errorf("Qemu image not found: %v", err)
+		}
+		return path, nil
+	}
+
+	// Get the image source
+	source, ok := task.Config["image_source"]
+	if !ok || source == "" {
+		return "", fmt.Errorf("Missing image_path or image_source for Qemu driver")
+	}
+
+	// Attempt to download the thing, giving up if the start is cancelled
+	// Right now, assume publicly accessible HTTP url
+	req, err := http.NewRequest("GET", source, nil)
 	if err != nil {
-		h.waitCh <- err
-	} else if !ps.Success() {
-		h.waitCh <- fmt.Errorf("task exited with error")
+		return "", fmt.Errorf("Invalid image source for Qemu driver: %s", err)
 	}
-	close(h.waitCh)
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", fmt.Errorf("Error downloading source for Qemu driver: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// Create a location in the local directory to download and store the image.
+	vmID := fmt.Sprintf("qemu-vm-%s-%s", structs.GenerateUUID(), filepath.Base(source))
+	fPath := filepath.Join(taskDir, allocdir.TaskLocal, vmID)
+	vmFile, err := os.OpenFile(fPath, os.O_CREATE|os.O_WRONLY, 0666)
+	if err != nil {
+		return "", fmt.Errorf("Error opening file to download to: %s", err)
+	}
+	defer vmFile.Close()
+
+	// Copy remote file to local AllocDir for execution
+	if _, err := io.Copy(vmFile, resp.Body); err != nil {
+		return "", fmt.Errorf("Error copying Qemu image from source: %s", err)
+	}
+	return fPath, nil
+}
+
+// qemuCores returns the number of virtual CPUs given to a VM with the CPU
+// resources in MHz.
+func qemuCores(cpu int) int {
+	cores := (cpu + qemuMHzPerCore - 1) / qemuMHzPerCore
+	if cores < 1 {
+		return 1
+	}
+	return cores
+}
+
+// qemuPortForwards returns the hostfwd options forwarding host ports to the
+// guest. The reserved ports are forwarded to the guest_ports of the task
+// config, which map 1:1. The host ports of the task labeled with a numeric
+// port are forwarded to that port in the guest and the others to the same
+// port in the guest.
+func qemuPortForwards(ctx *ExecContext, task *structs.Task) (string, error) {
+	network := task.Resources.Networks[0]
+	var forwarding string
+
+	if guestPorts := task.Config["guest_ports"]; guestPorts != "" {
+		// TODO: support more than a single, default Network
+		ports := strings.Split(guestPorts, ",")
+		if len(ports) != len(network.ReservedPorts) {
+			return "", fmt.Errorf("[ERR] driver.qemu: Error matching Guest Ports with Reserved ports")
+		}
+
+		// Ex:
+		//    hostfwd=tcp::22000-:22,hostfwd=tcp::80-:8080
+		for i, p := range ports {
+			forwarding = fmt.Sprintf("%s,hostfwd=tcp::%d-:%s", forwarding, network.ReservedPorts[i], strings.TrimSpace(p))
+		}
+	}
+
+	ports := taskPortMap(ctx, task, network)
+	labels := make([]string, 0, len(ports))
+	for label := range ports {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		guest := strconv.Itoa(ports[label])
+		if _, err := strconv.Atoi(label); err == nil {
+			guest = label
+		}
+		forwarding = fmt.Sprintf("%s,hostfwd=tcp::%d-:%s", forwarding, ports[label], guest)
+	}
+	return forwarding, nil
+}
+
+// sendQemuMonitor sends a command to the monitor of a VM.
+func sendQemuMonitor(path, command string) error {
+	conn, err := net.DialTimeout("unix", path, qemuMonitorTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to monitor: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(qemuMonitorTimeout))
+	if _, err := conn.Write([]byte(command + "\n")); err != nil {
+		return fmt.Errorf("failed to send %q to monitor: %v", command, err)
+	}
+	return nil
 }
@@ -1,11 +1,23 @@
 package driver
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
 
@@ -25,14 +37,165 @@ func TestQemuDriver_Handle(t *testing.T) {
 		proc:   &os.Process{Pid: 123},
 		vmID:   "vmid",
 		doneCh: make(chan struct{}),
-		waitCh: make(chan error, 1),
+		waitCh: make(chan *WaitResult, 1),
 	}
 
 	actual := h.ID()
-	expected := `QEMU:{"Pid":123,"VmID":"vmid"}`
+	expected := `qemu:v1:{"Pid":123,"VmID":"vmid"}`
 	if actual != expected {
 		t.Errorf("Expected `%s`, found `%s`", expected, actual)
 	}
+
+	h.startTime = "42"
+	h.monitorPath = "/tmp/qemu-monitor.sock"
+	actual = h.ID()
+	expected = `qemu:v1:{"Pid":123,"StartTime":"42","VmID":"vmid","MonitorPath":"/tmp/qemu-monitor.sock"}`
+	if actual != expected {
+		t.Errorf("Expected `%s`, found `%s`", expected, actual)
+	}
+}
+
+func TestQemuDriver_OrphanedMonitors(t *testing.T) {
+	allocDir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(allocDir)
+	paths := make(map[string]string)
+	for _, task := range []string{"active", "orphan"} {
+		local := filepath.Join(allocDir, "alloc1", task, allocdir.TaskLocal)
+		if err := os.MkdirAll(local, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		paths[task] = filepath.Join(local, qemuMonitorSock)
+		if err := ioutil.WriteFile(paths[task], nil, 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	active := &qemuHandle{proc: &os.Process{Pid: 123}, vmID: "vmid", monitorPath: paths["active"]}
+	handleIDs := []string{active.ID(), `QEMU:{"Pid":124,"VmID":"legacy"}`}
+
+	// Only the monitors that no handle references are orphans
+	orphans, err := orphanedQemuMonitors(allocDir, handleIDs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exp := []string{paths["orphan"]}; !reflect.DeepEqual(orphans, exp) {
+		t.Fatalf("got %v; want %v", orphans, exp)
+	}
+
+	// A qemu handle that can't be parsed may reference any monitor
+	for _, handleID := range []string{`qemu:v2:{"Pid":123}`, "QEMU:garbage"} {
+		orphans, err := orphanedQemuMonitors(allocDir, append(handleIDs, handleID))
+		if err == nil || len(orphans) != 0 {
+			t.Fatalf("%s: expected error, got %v", handleID, orphans)
+		}
+	}
+}
+
+func TestQemuCores(t *testing.T) {
+	for cpu, exp := range map[int]int{0: 1, 500: 1, 1000: 1, 1001: 2, 4000: 4} {
+		if act := qemuCores(cpu); act != exp {
+			t.Fatalf("%d MHz: got %d cores; want %d", cpu, act, exp)
+		}
+	}
+}
+
+func TestQemuDriver_PortForwards(t *testing.T) {
+	task := &structs.Task{
+		Name:   "linux",
+		Config: map[string]string{"guest_ports": "22, 8080"},
+		Resources: &structs.Resources{
+			MemoryMB: 512,
+			Networks: []*structs.NetworkResource{
+				&structs.NetworkResource{
+					ReservedPorts: []int{22000, 80},
+					DynamicPorts:  []string{"http", "443"},
+				},
+			},
+		},
+	}
+	ctx := NewExecContext(nil)
+	ctx.SetTaskPorts(task.Name, map[string]int{"http": 20000, "443": 20001})
+
+	forwarding, err := qemuPortForwards(ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := ",hostfwd=tcp::22000-:22,hostfwd=tcp::80-:8080,hostfwd=tcp::20001-:443,hostfwd=tcp::20000-:20000"
+	if forwarding != exp {
+		t.Fatalf("got %q; want %q", forwarding, exp)
+	}
+
+	// Guest ports must match the reserved ports
+	task.Config["guest_ports"] = "22"
+	if _, err := qemuPortForwards(ctx, task); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestQemuDriver_ImagePath_Invalid(t *testing.T) {
+	task := &structs.Task{
+		Name:      "linux",
+		Config:    map[string]string{"image_path": "../../linux.img"},
+		Resources: &structs.Resources{MemoryMB: 512},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewQemuDriver(driverCtx)
+
+	if _, err := d.Start(context.Background(), ctx, task); err == nil || !strings.Contains(err.Error(), "escapes the task directory") {
+		t.Fatalf("expected escape error: %v", err)
+	}
+
+	task.Config["image_path"] = "local/missing.img"
+	if _, err := d.Start(context.Background(), ctx, task); err == nil || !strings.Contains(err.Error(), "image not found") {
+		t.Fatalf("expected missing image error: %v", err)
+	}
+}
+
+func TestQemuHandle_Kill_Monitor(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets are not available on windows")
+	}
+	dir, err := ioutil.TempDir("", "nomad-qemu")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, qemuMonitorSock)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+
+	cmdCh := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		cmdCh <- line
+	}()
+
+	// The emulator itself must not be signalled when the monitor is reachable
+	h := &qemuHandle{proc: &os.Process{Pid: -1}, vmID: "vmid", monitorPath: path}
+	if err := h.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case cmd := <-cmdCh:
+		if cmd != "system_powerdown\n" {
+			t.Fatalf("bad monitor command: %q", cmd)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("monitor command not received")
+	}
 }
 
 // The fingerprinter test should always pass, even if QEMU is not installed.
@@ -86,7 +249,7 @@ func TestQemuDriver_Start(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewQemuDriver(driverCtx)
 
-	handle, err := d.Start(ctx, task)
+	handle, err := d.Start(context.Background(), ctx, task)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -95,7 +258,7 @@ func TestQemuDriver_Start(t *testing.T) {
 	}
 
 	// Attempt to open
-	handle2, err := d.Open(ctx, handle.ID())
+	handle2, err := d.Open(context.Background(), ctx, handle.ID())
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
@@ -109,6 +272,77 @@ func TestQemuDriver_Start(t *testing.T) {
 	}
 }
 
+// qemuTestImage is a tiny cloud image booted by the tests
+const qemuTestImage = "http://download.cirros-cloud.net/0.3.4/cirros-0.3.4-x86_64-disk.img"
+
+func TestQemuDriver_Start_ImagePath(t *testing.T) {
+	if !qemuLocated() {
+		t.Skip("QEMU not found; skipping")
+	}
+	ctestutils.QemuCompatible(t)
+
+	task := &structs.Task{
+		Name: "linux",
+		Config: map[string]string{
+			"image_path":  "local/cirros.img",
+			"accelerator": "tcg",
+		},
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 128,
+			Networks: []*structs.NetworkResource{
+				&structs.NetworkResource{
+					DynamicPorts: []string{"22"},
+				},
+			},
+		},
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	ctx.SetTaskPorts(task.Name, map[string]int{"22": 22022})
+	d := NewQemuDriver(driverCtx)
+
+	// Fetch the image into the task directory as an artifact would
+	resp, err := http.Get(qemuTestImage)
+	if err != nil {
+		t.Skipf("failed to download test image: %v", err)
+	}
+	defer resp.Body.Close()
+	image, err := os.Create(filepath.Join(ctx.AllocDir.TaskDirs[task.Name], "local", "cirros.img"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := io.Copy(image, resp.Body); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	image.Close()
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The VM can be reopened through its PID and monitor socket
+	testOpenHandleID(t, d, ctx, "qemu", handle)
+
+	// Give the monitor socket a moment to be created, then shut the VM down
+	time.Sleep(2 * time.Second)
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case <-handle.WaitCh():
+	case <-time.After(30 * time.Second):
+		// The guest may not handle ACPI before it has booted
+		if err := handle.ForceKill(); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		<-handle.WaitCh()
+	}
+}
+
 func TestQemuDriver_RequiresMemory(t *testing.T) {
 	if !qemuLocated() {
 		t.Skip("QEMU not found; skipping")
@@ -132,7 +366,7 @@ func TestQemuDriver_RequiresMemory(t *testing.T) {
 	defer ctx.AllocDir.Destroy()
 	d := NewQemuDriver(driverCtx)
 
-	_, err := d.Start(ctx, task)
+	_, err := d.Start(context.Background(), ctx, task)
 	if err == nil {
 		t.Fatalf("Expected error when not specifying memory")
 	}
@@ -0,0 +1,304 @@
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver/args"
+	"github.com/hashicorp/nomad/client/executor"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// rawExecConfigOption is the client configuration option that must be
+	// set to enable the raw_exec driver.
+	rawExecConfigOption = "driver.raw_exec.enable"
+)
+
+// RawExecDriver is a privileged version of the exec driver. It provides no
+// resource isolation and just fork/execs. The Exec driver should be preferred
+// and this should only be used when explicitly needed.
+type RawExecDriver struct {
+	DriverContext
+}
+
+// rawExecHandle is returned from Start/Open as a handle to the PID
+type rawExecHandle struct {
+	proc      *os.Process
+	startTime string
+	stats     *pidStats
+
+	// taskDir and env are what commands exec'd into the task run with. The
+	// environment of a reopened task is not known.
+	taskDir string
+	env     []string
+
+	// cmd is the started command. It is nil if the process was reopened.
+	cmd  *exec.Cmd
+	logs []io.Closer
+
+	waitCh chan *WaitResult
+	doneCh chan struct{}
+}
+
+// rawExecHandleVersion is the version of the encoding of raw_exec handles
+const rawExecHandleVersion = 1
+
+// rawExecPID is used to identify the process across client restarts. The
+// start time guards against reattaching to a recycled PID.
+type rawExecPID struct {
+	Pid       int
+	StartTime string
+}
+
+// NewRawExecDriver is used to create a new raw exec driver
+func NewRawExecDriver(ctx *DriverContext) Driver {
+	return &RawExecDriver{*ctx}
+}
+
+func (d *RawExecDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	// The driver runs tasks without isolation so it must be explicitly enabled.
+	enabled, err := strconv.ParseBool(cfg.ReadDefault(rawExecConfigOption, "false"))
+	if err != nil {
+		return false, fmt.Errorf("Failed to parse %v option: %v", rawExecConfigOption, err)
+	}
+	if !enabled {
+		return false, nil
+	}
+
+	node.Attributes["driver.raw_exec"] = "1"
+	return true, nil
+}
+
+// Version is not supported as tasks run directly on the host
+func (d *RawExecDriver) Version() (string, error) {
+	return "", &NotSupportedError{Driver: "raw_exec", Operation: "version"}
+}
+
+func (d *RawExecDriver) Capabilities() *DriverCapabilities {
+	// Windows processes can only be killed
+	return &DriverCapabilities{
+		Exec:         true,
+		Signals:      runtime.GOOS != "windows",
+		FSIsolation:  FSIsolationNone,
+		NetworkModes: []string{NetworkModeHost},
+	}
+}
+
+// Cleanup reaps nothing. The process group of a task is only recorded in its
+// handle, so one whose handle was lost can't be told apart from the other
+// processes of the host, and the groups of the tasks reopened are killed by
+// their handle once the task exits.
+func (d *RawExecDriver) Cleanup(activeHandleIDs []string) error {
+	return nil
+}
+
+// Validate checks that the task has a command to run
+func (d *RawExecDriver) Validate(task *structs.Task) error {
+	if task.Config["command"] == "" {
+		return fmt.Errorf("missing command for raw_exec driver: set 'command' in the task config")
+	}
+	return nil
+}
+
+func (d *RawExecDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
+	}
+	command := task.Config["command"]
+
+	// Get the tasks directory.
+	taskDir, ok := execCtx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+	}
+
+	// Get the environment variables.
+	envVars := TaskEnvironmentVariables(execCtx, task)
+
+	// Look for arguments
+	var cmdArgs []string
+	if argRaw, ok := task.Config["args"]; ok {
+		parsed, err := args.ParseAndReplace(argRaw, envVars.Map())
+		if err != nil {
+			return nil, err
+		}
+		cmdArgs = parsed
+	}
+
+	// Setup the command
+	cmd := exec.Command(command, cmdArgs...)
+	cmd.Dir = taskDir
+	cmd.Env = envVars.List()
+
+	// Run the task in its own process group so it can be killed along with
+	// any children it forks.
+	setProcessGroup(cmd)
+
+	// Run the task as its user, who owns the directories of the task
+	var user *executor.TaskUser
+	if task.User != "" || task.Group != "" {
+		u, err := executor.LookupTaskUser(task.User, task.Group)
+		if err != nil {
+			return nil, err
+		}
+		if err := executor.SetTaskUser(cmd, u); err != nil {
+			return nil, err
+		}
+		if err := execCtx.AllocDir.Chown(d.taskName, u.Uid, u.Gid); err != nil {
+			return nil, err
+		}
+		user = u
+	}
+
+	// Capture the output into rotated files in the alloc dir, forwarding it to
+	// syslog if configured
+	stdout, stderr, err := openTaskLogs(execCtx, task, user)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, fmt.Errorf("failed to start command: %v", err)
+	}
+
+	startTime, err := processStartTime(cmd.Process.Pid)
+	if err != nil {
+		d.logger.Printf("[WARN] driver.raw_exec: failed to read start time of pid %d: %v", cmd.Process.Pid, err)
+	}
+
+	// Return a driver handle
+	h := &rawExecHandle{
+		taskDir:   taskDir,
+		env:       cmd.Env,
+		proc:      cmd.Process,
+		startTime: startTime,
+		stats:     newPidStats("raw_exec", cmd.Process.Pid),
+		cmd:       cmd,
+		logs:      []io.Closer{stdout, stderr},
+		doneCh:    make(chan struct{}),
+		waitCh:    make(chan *WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (d *RawExecDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
+	// Parse the handle
+	handle, _, err := parseHandleID(handleID, "raw_exec", "RAW_EXEC:", rawExecHandleVersion)
+	if err != nil {
+		return nil, err
+	}
+	pid := &rawExecPID{}
+	if err := json.Unmarshal([]byte(handle), pid); err != nil {
+		return nil, fmt.Errorf("failed to parse raw_exec handle '%s': %v", handleID, err)
+	}
+
+	// Make sure the PID still belongs to the process that was started and
+	// has not been recycled.
+	startTime, err := processStartTime(pid.Pid)
+	if err != nil {
+		return nil, &TaskLostError{Reason: fmt.Sprintf("failed to find PID %d: %v", pid.Pid, err)}
+	}
+	if startTime != pid.StartTime {
+		return nil, &TaskLostError{Reason: fmt.Sprintf("PID %d no longer belongs to the task", pid.Pid)}
+	}
+
+	// Find the process
+	proc, err := os.FindProcess(pid.Pid)
+	if proc == nil || err != nil {
+		return nil, fmt.Errorf("failed to find PID %d: %v", pid.Pid, err)
+	}
+
+	// Return a driver handle
+	h := &rawExecHandle{
+		taskDir:   execCtx.AllocDir.TaskDirs[d.DriverContext.taskName],
+		proc:      proc,
+		startTime: startTime,
+		stats:     newPidStats("raw_exec", proc.Pid),
+		doneCh:    make(chan struct{}),
+		waitCh:    make(chan *WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (h *rawExecHandle) ID() string {
+	// Return a handle to the PID
+	pid := &rawExecPID{
+		Pid:       h.proc.Pid,
+		StartTime: h.startTime,
+	}
+	data, err := json.Marshal(pid)
+	if err != nil {
+		log.Printf("[ERR] driver.raw_exec: failed to marshal PID to JSON: %s", err)
+	}
+	return formatHandleID("raw_exec", rawExecHandleVersion, string(data))
+}
+
+func (h *rawExecHandle) WaitCh() chan *WaitResult {
+	return h.waitCh
+}
+
+func (h *rawExecHandle) Update(task *structs.Task) error {
+	// Update is not possible
+	return nil
+}
+
+// Kill asks the process group of the task to terminate and relies on the
+// caller to use ForceKill if it does not exit in time.
+func (h *rawExecHandle) Kill() error {
+	return killProcessGroup(h.proc, false)
+}
+
+func (h *rawExecHandle) ForceKill() error {
+	return killProcessGroup(h.proc, true)
+}
+
+func (h *rawExecHandle) Stats() (*TaskResourceUsage, error) {
+	return h.stats.Stats()
+}
+
+func (h *rawExecHandle) Signal(sig os.Signal) error {
+	return h.proc.Signal(sig)
+}
+
+func (h *rawExecHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	c := exec.Command(cmd[0], cmd[1:]...)
+	c.Dir = h.taskDir
+	c.Env = h.env
+	return runExec(c, timeout)
+}
+
+func (h *rawExecHandle) run() {
+	var err error
+	if h.cmd != nil {
+		err = h.cmd.Wait()
+		for _, l := range h.logs {
+			l.Close()
+		}
+	} else {
+		// A reopened process is not our child so its exit status can not be
+		// retrieved.
+		err = waitProcess(h.proc)
+	}
+
+	// Reap any children that outlived the task
+	killProcessGroup(h.proc, true)
+
+	close(h.doneCh)
+	h.waitCh <- waitResult(err)
+	close(h.waitCh)
+}
@@ -0,0 +1,25 @@
+package driver
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// chrootCmd runs the command with the directory as its root.
+func chrootCmd(cmd *exec.Cmd, dir string) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Chroot = dir
+	cmd.Dir = "/"
+}
+
+// processStartTime returns the start time of the process, in clock ticks
+// since boot, as recorded by the kernel.
+func processStartTime(pid int) (string, error) {
+	fields, err := readProcStat(pid)
+	if err != nil {
+		return "", err
+	}
+	return fields[19], nil
+}
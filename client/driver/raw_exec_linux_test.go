@@ -0,0 +1,73 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/executor"
+	"github.com/hashicorp/nomad/nomad/structs"
+
+	ctestutils "github.com/hashicorp/nomad/client/testutil"
+)
+
+func TestRawExecDriver_Start_Wait_User(t *testing.T) {
+	ctestutils.ExecCompatible(t)
+	nobody, err := executor.LookupTaskUser("nobody", "")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	task := &structs.Task{
+		Name:  "id",
+		User:  "nobody",
+		Group: "0",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "-c \"id -u; id -g\"",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task ran as nobody in the root group
+	stdout, stderr := ctx.LogPaths(task.Name)
+	act, err := ioutil.ReadFile(stdout + ".0")
+	if err != nil {
+		t.Fatalf("Couldn't read log file: %v", err)
+	}
+	if exp := fmt.Sprintf("%d\n0\n", nobody.Uid); string(act) != exp {
+		t.Fatalf("Task ran as %q; want %q", act, exp)
+	}
+
+	// Its directories and log files are owned by the user
+	for _, path := range []string{ctx.AllocDir.TaskDirs[task.Name], ctx.AllocDir.SecretsDir(task.Name), stdout + ".0", stderr + ".0"} {
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if st := fi.Sys().(*syscall.Stat_t); int(st.Uid) != nobody.Uid || st.Gid != 0 {
+			t.Fatalf("%s is owned by %d:%d; want %d:0", path, st.Uid, st.Gid, nobody.Uid)
+		}
+	}
+}
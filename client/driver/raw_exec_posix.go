@@ -0,0 +1,41 @@
+// +build !windows
+
+package driver
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// reattachPollInterval is how often a reopened process is checked for exit.
+var reattachPollInterval = time.Second
+
+// setProcessGroup makes the command the leader of a new process group.
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup signals every process in the group led by the process,
+// with SIGKILL if force is set and SIGTERM otherwise.
+func killProcessGroup(p *os.Process, force bool) error {
+	sig := syscall.SIGTERM
+	if force {
+		sig = syscall.SIGKILL
+	}
+	return syscall.Kill(-p.Pid, sig)
+}
+
+// waitProcess blocks until a process that is not a child of this one exits.
+func waitProcess(p *os.Process) error {
+	for {
+		if err := p.Signal(syscall.Signal(0)); err != nil && err != syscall.EPERM {
+			return nil
+		}
+		time.Sleep(reattachPollInterval)
+	}
+}
@@ -0,0 +1,529 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestRawExecDriver_Fingerprint(t *testing.T) {
+	d := NewRawExecDriver(testDriverContext(""))
+	node := &structs.Node{
+		Attributes: make(map[string]string),
+	}
+
+	// Disabled by default
+	cfg := &config.Config{Options: map[string]string{}}
+	apply, err := d.Fingerprint(cfg, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if apply {
+		t.Fatalf("should not apply")
+	}
+	if node.Attributes["driver.raw_exec"] != "" {
+		t.Fatalf("driver incorrectly enabled")
+	}
+
+	// Enable it
+	cfg.Options[rawExecConfigOption] = "true"
+	apply, err = d.Fingerprint(cfg, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !apply {
+		t.Fatalf("should apply")
+	}
+	if node.Attributes["driver.raw_exec"] != "1" {
+		t.Fatalf("driver not enabled")
+	}
+}
+
+func TestRawExecDriver_StartOpen_Wait(t *testing.T) {
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "1",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if handle == nil {
+		t.Fatalf("missing handle")
+	}
+
+	// Attempt to open, also from the ID older clients saved
+	handle2 := testOpenHandleID(t, d, ctx, "raw_exec", handle)
+	legacyID := strings.Replace(handle.ID(), "raw_exec:v1:", "RAW_EXEC:", 1)
+	if _, err := d.Open(context.Background(), ctx, legacyID); err != nil {
+		t.Fatalf("failed to open legacy ID %q: %v", legacyID, err)
+	}
+
+	// Both handles should see the task exit
+	for _, h := range []DriverHandle{handle, handle2} {
+		select {
+		case res := <-h.WaitCh():
+			if !res.Successful() {
+				t.Fatalf("err: %v", res)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestRawExecDriver_Open_RecycledPid(t *testing.T) {
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "10",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.ForceKill()
+
+	// A handle recorded for a different process with the same PID must not
+	// be adopted.
+	pid := handle.(*rawExecHandle).proc.Pid
+	if runtime.GOOS != "windows" {
+		id := fmt.Sprintf(`RAW_EXEC:{"Pid":%d,"StartTime":"bogus"}`, pid)
+		if _, err := d.Open(context.Background(), ctx, id); err == nil {
+			t.Fatalf("should not reattach to a recycled pid")
+		}
+	}
+
+	if _, err := d.Open(context.Background(), ctx, "RAW_EXEC:garbage"); err == nil {
+		t.Fatalf("should not open an invalid handle")
+	}
+}
+
+func TestRawExecDriver_Start_Wait_Logs(t *testing.T) {
+	task := &structs.Task{
+		Name: "echo",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "-c \"echo -n out; echo -n err 1>&2\"",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Check that the output was captured in the first log files
+	stdout, stderr := ctx.LogPaths(task.Name)
+	for path, exp := range map[string]string{stdout: "out", stderr: "err"} {
+		act, err := ioutil.ReadFile(path + ".0")
+		if err != nil {
+			t.Fatalf("Couldn't read log file: %v", err)
+		}
+		if string(act) != exp {
+			t.Fatalf("Log file %s contains %q; want %q", path, act, exp)
+		}
+	}
+}
+
+func TestRawExecDriver_Start_Wait_Syslog(t *testing.T) {
+	// A syslog server receiving the forwarded lines
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+	linesCh := make(chan string, 10)
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			linesCh <- string(buf[:n])
+		}
+	}()
+
+	task := &structs.Task{
+		Name: "echo",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "-c \"echo out; echo err 1>&2\"",
+		},
+		LogConfig: structs.DefaultLogConfig(),
+	}
+	task.LogConfig.Syslog = &structs.SyslogLogConfig{
+		Address:      "udp://" + conn.LocalAddr().String(),
+		Facility:     "local0",
+		DisableFiles: true,
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The lines are forwarded with the severity of their stream, tagged with
+	// the name of the task
+	var received []string
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-linesCh:
+			received = append(received, line)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("lines not forwarded: %q", received)
+		}
+	}
+	sort.Strings(received)
+	for i, exp := range []string{`^<131>.* echo\[\d+\]: err\n$`, `^<134>.* echo\[\d+\]: out\n$`} {
+		if !regexp.MustCompile(exp).MatchString(received[i]) {
+			t.Fatalf("line %q doesn't match %q", received[i], exp)
+		}
+	}
+
+	// And not written to the log files
+	stdout, _ := ctx.LogPaths(task.Name)
+	if _, err := os.Stat(stdout + ".0"); !os.IsNotExist(err) {
+		t.Fatalf("log file written: %v", err)
+	}
+}
+
+func TestRawExecDriver_AllocDir_Shared(t *testing.T) {
+	// One task writes a file to the shared alloc dir and the other reads it
+	writer := &structs.Task{
+		Name: "writer",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "-c \"echo -n hello > $NOMAD_ALLOC_DIR/data/greeting\"",
+		},
+	}
+	reader := &structs.Task{
+		Name: "reader",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "-c \"test $(cat $NOMAD_ALLOC_DIR/data/greeting) = hello\"",
+		},
+	}
+	driverCtx := testDriverContext(writer.Name)
+	allocDir := allocdir.NewAllocDir(filepath.Join(driverCtx.config.AllocDir, structs.GenerateUUID()))
+	if err := allocDir.Build([]*structs.Task{writer, reader}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer allocDir.Destroy()
+	ctx := NewExecContext(allocDir)
+
+	for _, task := range []*structs.Task{writer, reader} {
+		d := NewRawExecDriver(testDriverContext(task.Name))
+		handle, err := d.Start(context.Background(), ctx, task)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		select {
+		case res := <-handle.WaitCh():
+			if !res.Successful() {
+				t.Fatalf("task '%s' failed: %v", task.Name, res)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout")
+		}
+	}
+}
+
+func TestRawExecDriver_Start_UnknownUser(t *testing.T) {
+	task := &structs.Task{
+		Name: "echo",
+		User: "nomad-no-such-user",
+		Config: map[string]string{
+			"command": "/bin/echo",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	// The task isn't started as someone else
+	_, err := d.Start(context.Background(), ctx, task)
+	if err == nil || !strings.Contains(err.Error(), "Failed to identify user to run as") {
+		t.Fatalf("expected unknown user error: %v", err)
+	}
+}
+
+func TestRawExecDriver_Start_Kill_Children(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not support process groups")
+	}
+
+	task := &structs.Task{
+		Name: "forker",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "local/fork.sh",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	// The script forks two children that ignore the parent exiting and
+	// records their PIDs.
+	taskDir := ctx.AllocDir.TaskDirs[task.Name]
+	script := "sleep 100 &\necho $! >> local/pids\nsleep 100 &\necho $! >> local/pids\nwait\n"
+	if err := ioutil.WriteFile(filepath.Join(taskDir, allocdir.TaskLocal, "fork.sh"), []byte(script), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Wait for both children to be forked
+	var pids []int
+	deadline := time.Now().Add(5 * time.Second)
+	for len(pids) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("children not started")
+		}
+		time.Sleep(50 * time.Millisecond)
+		data, _ := ioutil.ReadFile(filepath.Join(taskDir, allocdir.TaskLocal, "pids"))
+		pids = pids[:0]
+		for _, line := range strings.Fields(string(data)) {
+			pid, err := strconv.Atoi(line)
+			if err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			pids = append(pids, pid)
+		}
+	}
+
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if res.Successful() {
+			t.Fatal("should err")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The children are reparented once the script dies so they may take a
+	// moment to be reaped.
+	for _, pid := range pids {
+		proc, _ := os.FindProcess(pid)
+		deadline := time.Now().Add(5 * time.Second)
+		for proc.Signal(syscall.Signal(0)) == nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("child %d still running after kill", pid)
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+}
+
+func TestRawExecDriver_Stats(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process stats are only supported on Linux")
+	}
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "10",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.ForceKill()
+
+	usage, err := handle.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if usage.MemoryRSS == 0 {
+		t.Fatalf("missing memory usage: %#v", usage)
+	}
+}
+
+func TestRawExecDriver_Signal(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows does not support signals")
+	}
+
+	task := &structs.Task{
+		Name: "trap",
+		Config: map[string]string{
+			"command": "/bin/sh",
+			"args":    "local/trap.sh",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	local := filepath.Join(ctx.AllocDir.TaskDirs[task.Name], allocdir.TaskLocal)
+	script := "trap 'echo -n hup > local/signal; exit 0' HUP\ntouch local/ready\nwhile true; do sleep 0.1; done\n"
+	if err := ioutil.WriteFile(filepath.Join(local, "trap.sh"), []byte(script), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.ForceKill()
+
+	// Wait for the trap to be installed
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(filepath.Join(local, "ready")); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("script not started")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if err := handle.Signal(syscall.SIGHUP); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	out, err := ioutil.ReadFile(filepath.Join(local, "signal"))
+	if err != nil {
+		t.Fatalf("signal not received: %v", err)
+	}
+	if string(out) != "hup" {
+		t.Fatalf("bad output: %q", out)
+	}
+}
+
+func TestRawExecDriver_Exec(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("test requires a POSIX shell")
+	}
+
+	task := &structs.Task{
+		Name: "sleep",
+		Config: map[string]string{
+			"command": "/bin/sleep",
+			"args":    "10",
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRawExecDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer handle.ForceKill()
+
+	// Commands run in the task dir with the output of both streams and the
+	// exit code returned
+	out, code, err := handle.Exec([]string{"/bin/sh", "-c", "pwd; echo oops >&2; exit 3"}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if code != 3 {
+		t.Fatalf("bad exit code: %d", code)
+	}
+	taskDir, _ := filepath.EvalSymlinks(ctx.AllocDir.TaskDirs[task.Name])
+	if exp := taskDir + "\noops\n"; string(out) != exp {
+		t.Fatalf("bad output: %q; want %q", out, exp)
+	}
+
+	// Commands outliving the timeout are killed along with their children
+	start := time.Now()
+	_, _, err = handle.Exec([]string{"/bin/sh", "-c", "sleep 10 & sleep 10"}, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("command not killed after %v", elapsed)
+	}
+
+	if _, _, err := handle.Exec([]string{"/does/not/exist"}, time.Second); err == nil {
+		t.Fatalf("missing command should fail")
+	}
+}
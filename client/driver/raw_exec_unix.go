@@ -0,0 +1,24 @@
+// +build !linux,!windows
+
+package driver
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// chrootCmd runs the command in the directory. Tasks are not chrooted on this
+// platform.
+func chrootCmd(cmd *exec.Cmd, dir string) {
+	cmd.Dir = dir
+}
+
+// processStartTime returns the start time of the process as reported by ps.
+func processStartTime(pid int) (string, error) {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
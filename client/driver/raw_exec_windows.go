@@ -0,0 +1,36 @@
+package driver
+
+import (
+	"os"
+	"os/exec"
+)
+
+// chrootCmd runs the command in the directory as tasks are not chrooted on
+// Windows.
+func chrootCmd(cmd *exec.Cmd, dir string) {
+	cmd.Dir = dir
+}
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills the process. Windows has no process groups that
+// can be signalled so its children are not killed.
+func killProcessGroup(p *os.Process, force bool) error {
+	return p.Kill()
+}
+
+// waitProcess blocks until the process exits.
+func waitProcess(p *os.Process) error {
+	_, err := p.Wait()
+	return err
+}
+
+// processStartTime is not available on Windows so reopened PIDs can not be
+// verified.
+func processStartTime(pid int) (string, error) {
+	if _, err := os.FindProcess(pid); err != nil {
+		return "", err
+	}
+	return "", nil
+}
@@ -0,0 +1,507 @@
+package driver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver/environment"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+var (
+	reRktVersion  = regexp.MustCompile(`rkt [vV]ersion:? ([\d\.]+)`)
+	reAppcVersion = regexp.MustCompile(`appc [vV]ersion:? ([\d\.]+)`)
+
+	// rktUUIDTimeout bounds how long rkt may take to fetch the image and
+	// prepare the pod before its UUID is written
+	rktUUIDTimeout = 5 * time.Minute
+
+	// rktStatusInterval is how often the status of a reopened pod is polled
+	rktStatusInterval = time.Second
+)
+
+const (
+	// rktUUIDFile is the name of the file in the local directory of the
+	// task that rkt writes the UUID of the pod to
+	rktUUIDFile = "rkt.uuid"
+)
+
+// RktDriver is a driver for running images with rkt. Each task runs as a
+// single app in its own pod.
+type RktDriver struct {
+	DriverContext
+}
+
+// rktHandle is returned from Start/Open as a handle to the pod
+type rktHandle struct {
+	// cmd is set if the pod was started by this client rather than reopened
+	cmd     *exec.Cmd
+	logs    []io.Closer
+	uuid    string
+	appName string
+	waitCh  chan *WaitResult
+	doneCh  chan struct{}
+}
+
+// rktHandleVersion is the version of the encoding of rkt handles
+const rktHandleVersion = 1
+
+// rktPod maps the handle to the pod running the task
+type rktPod struct {
+	UUID    string
+	AppName string
+}
+
+// NewRktDriver is used to create a new rkt driver
+func NewRktDriver(ctx *DriverContext) Driver {
+	return &RktDriver{*ctx}
+}
+
+func (d *RktDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	// rkt only runs on Linux and needs root to run pods
+	if runtime.GOOS != "linux" {
+		return false, nil
+	}
+	if syscall.Geteuid() != 0 {
+		d.logger.Printf("[DEBUG] driver.rkt: must run as root user, disabling")
+		return false, nil
+	}
+
+	outBytes, err := exec.Command("rkt", "version").Output()
+	if err != nil {
+		return false, nil
+	}
+	rktVersion, appcVersion, err := parseRktVersion(string(outBytes))
+	if err != nil {
+		return false, err
+	}
+
+	node.Attributes["driver.rkt"] = "1"
+	node.Attributes["driver.rkt.version"] = rktVersion
+	node.Attributes["driver.rkt.appc.version"] = appcVersion
+	return true, nil
+}
+
+// parseRktVersion returns the rkt and appc versions from the output of
+// `rkt version`
+func parseRktVersion(out string) (string, string, error) {
+	rkt := reRktVersion.FindStringSubmatch(out)
+	appc := reAppcVersion.FindStringSubmatch(out)
+	if len(rkt) != 2 || len(appc) != 2 {
+		return "", "", fmt.Errorf("Unable to parse rkt version string: %q", out)
+	}
+	return rkt[1], appc[1], nil
+}
+
+// Version returns the version of rkt detected when fingerprinting
+func (d *RktDriver) Version() (string, error) {
+	return d.fingerprintedVersion("rkt")
+}
+
+func (d *RktDriver) Capabilities() *DriverCapabilities {
+	return &DriverCapabilities{
+		Exec:         true,
+		FSIsolation:  FSIsolationImage,
+		NetworkModes: []string{NetworkModeBridge},
+	}
+}
+
+// Cleanup stops the running pods whose UUID rkt wrote to the local directory
+// of a task that none of the handles reference. Exited pods are left to the
+// garbage collection of rkt.
+func (d *RktDriver) Cleanup(activeHandleIDs []string) error {
+	orphans, err := orphanedRktPods(d.config.AllocDir, activeHandleIDs)
+	if err != nil {
+		return fmt.Errorf("Not stopping orphaned pods: %v", err)
+	}
+	var mErr multierror.Error
+	for _, uuid := range orphans {
+		// Pods that exited or that rkt no longer knows need no stopping
+		if exited, _, err := rktStatus(uuid, ""); exited || err != nil {
+			continue
+		}
+		d.logger.Printf("[INFO] driver.rkt: stopping orphaned pod %s", uuid)
+		h := &rktHandle{uuid: uuid}
+		if err := h.stop(true); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// orphanedRktPods returns the UUIDs written to the task directories of the
+// alloc dir that none of the handles reference. A rkt handle that can't be
+// parsed may reference any of them, so none is an orphan then.
+func orphanedRktPods(allocDir string, activeHandleIDs []string) ([]string, error) {
+	active := make(map[string]struct{}, len(activeHandleIDs))
+	for _, handleID := range activeHandleIDs {
+		if !strings.HasPrefix(handleID, "rkt:") && !strings.HasPrefix(handleID, "RKT:") {
+			continue
+		}
+		handle, _, err := parseHandleID(handleID, "rkt", "RKT:", rktHandleVersion)
+		if err != nil {
+			return nil, fmt.Errorf("unable to tell the pod of a handle: %v", err)
+		}
+		pod := &rktPod{}
+		if err := json.Unmarshal([]byte(handle), pod); err != nil {
+			return nil, fmt.Errorf("unable to tell the pod of handle '%s': %v", handleID, err)
+		}
+		active[pod.UUID] = struct{}{}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(allocDir, "*", "*", allocdir.TaskLocal, rktUUIDFile))
+	if err != nil {
+		return nil, err
+	}
+	var orphans []string
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		uuid := strings.TrimSpace(string(data))
+		if _, ok := active[uuid]; !ok && uuid != "" {
+			orphans = append(orphans, uuid)
+		}
+	}
+	return orphans, nil
+}
+
+// Validate checks that the task has an image
+func (d *RktDriver) Validate(task *structs.Task) error {
+	if task.Config["image"] == "" {
+		return fmt.Errorf("Missing image for rkt driver: set 'image' in the task config")
+	}
+	return nil
+}
+
+// Start runs the image in a new pod. Images are fetched by rkt and must be
+// trusted, either beforehand or with the trust_prefix of the task config.
+func (d *RktDriver) Start(ctx context.Context, execCtx *ExecContext, task *structs.Task) (DriverHandle, error) {
+	if err := d.Validate(task); err != nil {
+		return nil, err
+	}
+
+	// Get the tasks local directory.
+	taskDir, ok := execCtx.AllocDir.TaskDirs[d.DriverContext.taskName]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", d.DriverContext.taskName)
+	}
+
+	if prefix := task.Config["trust_prefix"]; prefix != "" {
+		out, err := exec.CommandContext(ctx, "rkt", "trust", "--skip-fingerprint-review=true", "--prefix="+prefix).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("Error trusting rkt image prefix '%s': %v\n\nOutput: %s", prefix, err, out)
+		}
+	}
+
+	volumes, err := d.taskVolumes(task)
+	if err != nil {
+		return nil, err
+	}
+
+	// The UUID is written once the image is fetched and the pod prepared
+	uuidPath := filepath.Join(taskDir, allocdir.TaskLocal, rktUUIDFile)
+	os.Remove(uuidPath)
+	args, err := rktRunArgs(execCtx, task, volumes, uuidPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Capture the output into rotated files in the alloc dir, forwarding it to
+	// syslog if configured
+	stdout, stderr, err := openTaskLogs(execCtx, task, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command("rkt", args...)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	d.logger.Printf("[DEBUG] driver.rkt: starting rkt command: %q", strings.Join(cmd.Args, " "))
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		return nil, fmt.Errorf("Error running rkt: %v", err)
+	}
+
+	h := &rktHandle{
+		cmd:     cmd,
+		appName: rktAppName(task.Config["image"]),
+		logs:    []io.Closer{stdout, stderr},
+		doneCh:  make(chan struct{}),
+		waitCh:  make(chan *WaitResult, 1),
+	}
+	go h.run()
+
+	uuid, err := waitRktUUID(ctx, uuidPath, h.doneCh, rktUUIDTimeout)
+	if err != nil {
+		cmd.Process.Kill()
+		return nil, err
+	}
+	h.uuid = uuid
+	d.logger.Printf("[INFO] driver.rkt: started pod %s for task '%s'", uuid, d.taskName)
+	return h, nil
+}
+
+// rktRunArgs returns the arguments of `rkt run` for the task. The alloc and
+// local directories of the task are mounted into the pod along with its host
+// volumes, and the host ports of the task are forwarded to the ports of the
+// image with the same names.
+func rktRunArgs(ctx *ExecContext, task *structs.Task, volumes []*structs.TaskVolume, uuidPath string) ([]string, error) {
+	taskDir, ok := ctx.AllocDir.TaskDirs[task.Name]
+	if !ok {
+		return nil, fmt.Errorf("Could not find task directory for task: %v", task.Name)
+	}
+
+	args := []string{"run", "--uuid-file-save=" + uuidPath}
+
+	// Mount the alloc and local directories, then the host volumes
+	mounts := []*structs.TaskVolume{
+		{Source: ctx.AllocDir.SharedDir, Destination: "/" + allocdir.SharedAllocName},
+		{Source: filepath.Join(taskDir, allocdir.TaskLocal), Destination: "/" + allocdir.TaskLocal},
+	}
+	names := []string{allocdir.SharedAllocName, allocdir.TaskLocal}
+	for i, v := range volumes {
+		mounts = append(mounts, v)
+		names = append(names, fmt.Sprintf("volume-%d", i))
+	}
+	for i, m := range mounts {
+		args = append(args,
+			fmt.Sprintf("--volume=%s,kind=host,source=%s,readOnly=%t", names[i], m.Source, m.ReadOnly),
+			fmt.Sprintf("--mount=volume=%s,target=%s", names[i], m.Destination))
+	}
+
+	// Forward the host ports by label
+	if task.Resources != nil && len(task.Resources.Networks) > 0 {
+		ports := taskPortMap(ctx, task, task.Resources.Networks[0])
+		labels := make([]string, 0, len(ports))
+		for label := range ports {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		for _, label := range labels {
+			args = append(args, fmt.Sprintf("--port=%s:%d", label, ports[label]))
+		}
+	}
+
+	// The paths of the environment are those within the pod
+	env := TaskEnvironmentVariables(ctx, task).Map()
+	env[environment.AllocDir] = "/" + allocdir.SharedAllocName
+	keys := make([]string, 0, len(env))
+	for k := range env {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, fmt.Sprintf("--set-env=%s=%s", k, env[k]))
+	}
+
+	// The image and the options of its app
+	args = append(args, task.Config["image"])
+	if task.Resources != nil {
+		if task.Resources.MemoryMB > 0 {
+			args = append(args, fmt.Sprintf("--memory=%dM", task.Resources.MemoryMB))
+		}
+		if task.Resources.CPU > 0 {
+			// rkt limits CPU in millicores, taking a core to be 1000 MHz
+			args = append(args, fmt.Sprintf("--cpu=%dm", task.Resources.CPU))
+		}
+	}
+	if command := task.Config["command"]; command != "" {
+		args = append(args, "--exec="+command)
+	}
+	if appArgs := strings.Fields(task.Config["args"]); len(appArgs) > 0 {
+		args = append(args, "--")
+		args = append(args, appArgs...)
+	}
+	return args, nil
+}
+
+// rktAppName returns the name rkt gives the app of the image, which is the
+// last component of its name without the version
+func rktAppName(image string) string {
+	name := image
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, ":"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// waitRktUUID waits for rkt to write the UUID of the pod, failing if rkt
+// exits, the timeout expires or the context is cancelled first
+func waitRktUUID(ctx context.Context, path string, doneCh chan struct{}, timeout time.Duration) (string, error) {
+	deadline := time.After(timeout)
+	for {
+		if data, err := ioutil.ReadFile(path); err == nil {
+			if uuid := strings.TrimSpace(string(data)); uuid != "" {
+				return uuid, nil
+			}
+		}
+		select {
+		case <-doneCh:
+			return "", fmt.Errorf("rkt exited before the pod was started")
+		case <-deadline:
+			return "", fmt.Errorf("rkt did not start the pod within %v", timeout)
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+func (d *RktDriver) Open(ctx context.Context, execCtx *ExecContext, handleID string) (DriverHandle, error) {
+	// Parse the handle
+	handle, _, err := parseHandleID(handleID, "rkt", "RKT:", rktHandleVersion)
+	if err != nil {
+		return nil, err
+	}
+	pod := &rktPod{}
+	if err := json.Unmarshal([]byte(handle), pod); err != nil {
+		return nil, fmt.Errorf("failed to parse rkt handle '%s': %v", handleID, err)
+	}
+
+	// Make sure the pod still exists
+	if _, _, err := rktStatus(pod.UUID, pod.AppName); err != nil {
+		return nil, fmt.Errorf("failed to find rkt pod %s: %v", pod.UUID, err)
+	}
+
+	h := &rktHandle{
+		uuid:    pod.UUID,
+		appName: pod.AppName,
+		doneCh:  make(chan struct{}),
+		waitCh:  make(chan *WaitResult, 1),
+	}
+	go h.run()
+	return h, nil
+}
+
+func (h *rktHandle) ID() string {
+	data, err := json.Marshal(&rktPod{UUID: h.uuid, AppName: h.appName})
+	if err != nil {
+		log.Printf("[ERR] failed to marshal rkt pod to JSON: %s", err)
+	}
+	return formatHandleID("rkt", rktHandleVersion, string(data))
+}
+
+func (h *rktHandle) WaitCh() chan *WaitResult {
+	return h.waitCh
+}
+
+func (h *rktHandle) Update(task *structs.Task) error {
+	// Update is not possible
+	return nil
+}
+
+// Kill stops the pod, giving its app a chance to exit
+func (h *rktHandle) Kill() error {
+	return h.stop(false)
+}
+
+func (h *rktHandle) ForceKill() error {
+	return h.stop(true)
+}
+
+func (h *rktHandle) stop(force bool) error {
+	out, err := exec.Command("rkt", "stop", fmt.Sprintf("--force=%t", force), h.uuid).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to stop rkt pod %s: %v: %s", h.uuid, err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+func (h *rktHandle) Stats() (*TaskResourceUsage, error) {
+	return nil, &NotSupportedError{Driver: "rkt", Operation: "stats"}
+}
+
+func (h *rktHandle) Signal(sig os.Signal) error {
+	return &NotSupportedError{Driver: "rkt", Operation: "signals"}
+}
+
+// Exec runs the command in the app of the pod
+func (h *rktHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	args := append([]string{"enter", "--app=" + h.appName, h.uuid}, cmd...)
+	return runExec(exec.Command("rkt", args...), timeout)
+}
+
+func (h *rktHandle) run() {
+	var result *WaitResult
+	if h.cmd != nil {
+		// rkt run exits with the exit status of the app
+		result = waitResult(h.cmd.Wait())
+		for _, l := range h.logs {
+			l.Close()
+		}
+	} else {
+		// A reopened pod is not our child so its status is polled
+		for {
+			exited, code, err := rktStatus(h.uuid, h.appName)
+			if err != nil {
+				result = NewWaitResult(0, 0, err)
+				break
+			}
+			if exited {
+				result = NewWaitResult(code, 0, nil)
+				break
+			}
+			time.Sleep(rktStatusInterval)
+		}
+	}
+	close(h.doneCh)
+	h.waitCh <- result
+	close(h.waitCh)
+}
+
+// rktStatus returns whether the pod exited and the exit code of its app
+func rktStatus(uuid, appName string) (bool, int, error) {
+	out, err := exec.Command("rkt", "status", uuid).Output()
+	if err != nil {
+		return false, 0, err
+	}
+	return parseRktStatus(string(out), appName)
+}
+
+// parseRktStatus parses the output of `rkt status`, which lists key=value
+// pairs such as state=exited and app-<name>=<exit code>
+func parseRktStatus(out, appName string) (bool, int, error) {
+	status := make(map[string]string)
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) == 2 {
+			status[parts[0]] = parts[1]
+		}
+	}
+
+	state, ok := status["state"]
+	if !ok {
+		return false, 0, fmt.Errorf("unable to parse rkt status: %q", out)
+	}
+	if state != "exited" {
+		return false, 0, nil
+	}
+	code, err := strconv.Atoi(status["app-"+appName])
+	if err != nil {
+		return true, 0, fmt.Errorf("unable to parse exit code of app '%s': %q", appName, out)
+	}
+	return true, code, nil
+}
@@ -0,0 +1,305 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+
+	ctestutils "github.com/hashicorp/nomad/client/testutil"
+)
+
+// rktLocated looks to see whether rkt is available on this system before we
+// try to run tests.
+func rktLocated() bool {
+	_, err := exec.Command("rkt", "version").CombinedOutput()
+	return err == nil
+}
+
+// rktTestImage is a minimal image run by the tests. Its signing key is trusted
+// through the prefix.
+const (
+	rktTestImage       = "coreos.com/etcd:v2.0.4"
+	rktTestTrustPrefix = "coreos.com/etcd"
+)
+
+func TestRktDriver_Handle(t *testing.T) {
+	h := &rktHandle{
+		uuid:    "6ff87e53-b4c5-4a6d-a0b6-b2b3bd4a3c2f",
+		appName: "etcd",
+		doneCh:  make(chan struct{}),
+		waitCh:  make(chan *WaitResult, 1),
+	}
+
+	actual := h.ID()
+	expected := `rkt:v1:{"UUID":"6ff87e53-b4c5-4a6d-a0b6-b2b3bd4a3c2f","AppName":"etcd"}`
+	if actual != expected {
+		t.Errorf("Expected `%s`, found `%s`", expected, actual)
+	}
+}
+
+func TestRktDriver_OrphanedPods(t *testing.T) {
+	allocDir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(allocDir)
+	for task, uuid := range map[string]string{"active": "uuid-active", "orphan": "uuid-orphan\n"} {
+		local := filepath.Join(allocDir, "alloc1", task, allocdir.TaskLocal)
+		if err := os.MkdirAll(local, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(local, rktUUIDFile), []byte(uuid), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	active := &rktHandle{uuid: "uuid-active", appName: "etcd"}
+	handleIDs := []string{active.ID(), `exec:v1:{"UUID":"uuid-orphan"}`}
+
+	// Only the pods that no handle references are orphans
+	orphans, err := orphanedRktPods(allocDir, handleIDs)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exp := []string{"uuid-orphan"}; !reflect.DeepEqual(orphans, exp) {
+		t.Fatalf("got %v; want %v", orphans, exp)
+	}
+
+	// A rkt handle that can't be parsed may reference any pod
+	for _, handleID := range []string{`rkt:v2:{"UUID":"uuid-active"}`, "RKT:garbage"} {
+		orphans, err := orphanedRktPods(allocDir, append(handleIDs, handleID))
+		if err == nil || len(orphans) != 0 {
+			t.Fatalf("%s: expected error, got %v", handleID, orphans)
+		}
+	}
+}
+
+func TestRktDriver_Validate(t *testing.T) {
+	d := NewRktDriver(testDriverContext("etcd"))
+	if err := d.Validate(&structs.Task{Name: "etcd", Config: map[string]string{}}); err == nil {
+		t.Fatalf("expected missing image error")
+	}
+	task := &structs.Task{Name: "etcd", Config: map[string]string{"image": rktTestImage}}
+	if err := d.Validate(task); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRktVersion_Parse(t *testing.T) {
+	out := "rkt Version: 1.30.0\nappc Version: 0.8.11\nGo Version: go1.9.2\n"
+	rkt, appc, err := parseRktVersion(out)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if rkt != "1.30.0" || appc != "0.8.11" {
+		t.Fatalf("bad versions: %q, %q", rkt, appc)
+	}
+	if _, _, err := parseRktVersion("unknown"); err == nil {
+		t.Fatalf("expected error")
+	}
+}
+
+func TestRktAppName(t *testing.T) {
+	for image, exp := range map[string]string{
+		"coreos.com/etcd:v2.0.4":  "etcd",
+		"example.com/app":         "app",
+		"docker://busybox:latest": "busybox",
+	} {
+		if act := rktAppName(image); act != exp {
+			t.Fatalf("%s: got %q; want %q", image, act, exp)
+		}
+	}
+}
+
+func TestRktStatus_Parse(t *testing.T) {
+	exited, code, err := parseRktStatus("state=running\nnetworks=default:ip4=172.16.28.2\n", "etcd")
+	if err != nil || exited {
+		t.Fatalf("bad: exited %v, err %v", exited, err)
+	}
+
+	exited, code, err = parseRktStatus("state=exited\ncreated=2016-01-01\napp-etcd=3\n", "etcd")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !exited || code != 3 {
+		t.Fatalf("bad: exited %v, code %d", exited, code)
+	}
+
+	if _, _, err := parseRktStatus("garbage", "etcd"); err == nil {
+		t.Fatalf("expected error")
+	}
+	if _, _, err := parseRktStatus("state=exited\n", "etcd"); err == nil {
+		t.Fatalf("expected missing exit code error")
+	}
+}
+
+func TestRktDriver_RunArgs(t *testing.T) {
+	task := &structs.Task{
+		Name: "etcd",
+		Config: map[string]string{
+			"image":   rktTestImage,
+			"command": "/etcd",
+			"args":    "--version --debug",
+		},
+		Resources: &structs.Resources{
+			CPU:      500,
+			MemoryMB: 128,
+			Networks: []*structs.NetworkResource{
+				&structs.NetworkResource{
+					DynamicPorts: []string{"client", "peer"},
+				},
+			},
+		},
+	}
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	ctx.SetTaskPorts(task.Name, map[string]int{"client": 20000, "peer": 20001})
+	ctx.SetTaskEnv(task.Name, map[string]string{"NOMAD_ALLOC_DIR": "/host/alloc", "FOO": "bar"})
+
+	volumes := []*structs.TaskVolume{{Source: "/srv/data", Destination: "/data", ReadOnly: true}}
+	args, err := rktRunArgs(ctx, task, volumes, "/tmp/rkt.uuid")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	local := filepath.Join(ctx.AllocDir.TaskDirs[task.Name], "local")
+	exp := []string{
+		"run",
+		"--uuid-file-save=/tmp/rkt.uuid",
+		fmt.Sprintf("--volume=alloc,kind=host,source=%s,readOnly=false", ctx.AllocDir.SharedDir),
+		"--mount=volume=alloc,target=/alloc",
+		fmt.Sprintf("--volume=local,kind=host,source=%s,readOnly=false", local),
+		"--mount=volume=local,target=/local",
+		"--volume=volume-0,kind=host,source=/srv/data,readOnly=true",
+		"--mount=volume=volume-0,target=/data",
+		"--port=client:20000",
+		"--port=peer:20001",
+		"--set-env=FOO=bar",
+		"--set-env=NOMAD_ALLOC_DIR=/alloc",
+		rktTestImage,
+		"--memory=128M",
+		"--cpu=500m",
+		"--exec=/etcd",
+		"--",
+		"--version",
+		"--debug",
+	}
+	if !reflect.DeepEqual(args, exp) {
+		t.Fatalf("got:\n%s\nwant:\n%s", strings.Join(args, "\n"), strings.Join(exp, "\n"))
+	}
+}
+
+// The fingerprinter test should always pass, even if rkt is not installed.
+func TestRktDriver_Fingerprint(t *testing.T) {
+	ctestutils.RktCompatible(t)
+	d := NewRktDriver(testDriverContext(""))
+	node := &structs.Node{
+		Attributes: make(map[string]string),
+	}
+	apply, err := d.Fingerprint(&config.Config{}, node)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if apply != rktLocated() {
+		t.Fatalf("should apply if rkt is installed")
+	}
+	if apply && node.Attributes["driver.rkt.version"] == "" {
+		t.Fatalf("Missing rkt driver version")
+	}
+}
+
+func TestRktDriver_Start_Wait(t *testing.T) {
+	if !rktLocated() {
+		t.Skip("rkt not found; skipping")
+	}
+	ctestutils.RktCompatible(t)
+
+	task := &structs.Task{
+		Name: "etcd",
+		Config: map[string]string{
+			"image":        rktTestImage,
+			"trust_prefix": rktTestTrustPrefix,
+			"command":      "/etcd",
+			"args":         "--version",
+		},
+		Resources: &structs.Resources{
+			MemoryMB: 128,
+			CPU:      100,
+		},
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRktDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The app prints its version and exits successfully
+	select {
+	case res := <-handle.WaitCh():
+		if !res.Successful() {
+			t.Fatalf("err: %v", res)
+		}
+	case <-time.After(time.Minute):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestRktDriver_Start_Open_Kill(t *testing.T) {
+	if !rktLocated() {
+		t.Skip("rkt not found; skipping")
+	}
+	ctestutils.RktCompatible(t)
+
+	task := &structs.Task{
+		Name: "etcd",
+		Config: map[string]string{
+			"image":        rktTestImage,
+			"trust_prefix": rktTestTrustPrefix,
+			"command":      "/etcd",
+		},
+		Resources: &structs.Resources{
+			MemoryMB: 128,
+			CPU:      100,
+		},
+	}
+
+	driverCtx := testDriverContext(task.Name)
+	ctx := testDriverExecContext(task, driverCtx)
+	defer ctx.AllocDir.Destroy()
+	d := NewRktDriver(driverCtx)
+
+	handle, err := d.Start(context.Background(), ctx, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The pod can be reopened through its UUID
+	handle2 := testOpenHandleID(t, d, ctx, "rkt", handle)
+
+	if err := handle.Kill(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, h := range []DriverHandle{handle, handle2} {
+		select {
+		case <-h.WaitCh():
+		case <-time.After(30 * time.Second):
+			t.Fatalf("timeout waiting for pod to stop")
+		}
+	}
+}
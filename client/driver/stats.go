@@ -0,0 +1,97 @@
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// errStatsNotSupported is returned when the resource usage of a process can
+// not be read on this platform.
+var errStatsNotSupported = errors.New("process stats are not supported on this platform")
+
+// TaskResourceUsage is the resource usage of a task at a point in time.
+type TaskResourceUsage struct {
+	// CPUPercent is the percentage of a single core used since the previous
+	// sample, or over the lifetime of the task for the first sample.
+	CPUPercent float64
+
+	// MemoryRSS is the resident memory of the task in bytes.
+	MemoryRSS uint64
+
+	// Uptime is how long the task has been running.
+	Uptime time.Duration
+
+	// Timestamp is when the usage was sampled.
+	Timestamp time.Time
+}
+
+// NotSupportedError is returned by drivers for operations they can not
+// perform, so that callers can distinguish it from a failure.
+type NotSupportedError struct {
+	Driver    string
+	Operation string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s driver does not support %s", e.Driver, e.Operation)
+}
+
+// IsNotSupported returns whether the error indicates an operation is not
+// supported by the driver.
+func IsNotSupported(err error) bool {
+	_, ok := err.(*NotSupportedError)
+	return ok
+}
+
+// procUsage is the raw resource usage of a process.
+type procUsage struct {
+	cpu    time.Duration
+	rss    uint64
+	uptime time.Duration
+}
+
+// pidStats computes the resource usage of a process from successive samples.
+type pidStats struct {
+	driver string
+	pid    int
+
+	lock       sync.Mutex
+	lastCPU    time.Duration
+	lastSample time.Time
+}
+
+func newPidStats(driver string, pid int) *pidStats {
+	return &pidStats{driver: driver, pid: pid}
+}
+
+// Stats samples the resource usage of the process.
+func (s *pidStats) Stats() (*TaskResourceUsage, error) {
+	usage, err := readProcUsage(s.pid)
+	if err == errStatsNotSupported {
+		return nil, &NotSupportedError{Driver: s.driver, Operation: "stats"}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read stats of pid %d: %v", s.pid, err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	now := time.Now()
+	var percent float64
+	if s.lastSample.IsZero() {
+		if usage.uptime > 0 {
+			percent = float64(usage.cpu) / float64(usage.uptime) * 100
+		}
+	} else if elapsed := now.Sub(s.lastSample); elapsed > 0 {
+		percent = float64(usage.cpu-s.lastCPU) / float64(elapsed) * 100
+	}
+	s.lastCPU, s.lastSample = usage.cpu, now
+
+	return &TaskResourceUsage{
+		CPUPercent: percent,
+		MemoryRSS:  usage.rss,
+		Uptime:     usage.uptime,
+		Timestamp:  now,
+	}, nil
+}
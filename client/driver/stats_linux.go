@@ -0,0 +1,83 @@
+package driver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is the unit of the times in /proc/<pid>/stat. The kernel
+// always reports them in USER_HZ, which is 100 on all supported platforms.
+const clockTicks = 100
+
+// readProcStat returns the fields of /proc/<pid>/stat following the command
+// name, so that the state of the process is the first field.
+func readProcStat(pid int) ([]string, error) {
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return nil, err
+	}
+
+	// The command name is in parentheses and may contain spaces, so the
+	// fields are counted from its end.
+	end := strings.LastIndex(string(stat), ")")
+	if end < 0 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return nil, fmt.Errorf("malformed stat for pid %d", pid)
+	}
+	return fields, nil
+}
+
+// readProcUsage reads the resource usage of the process from /proc.
+func readProcUsage(pid int) (*procUsage, error) {
+	fields, err := readProcStat(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	// Indexes are the field numbers of proc(5) less three.
+	var ticks [3]uint64
+	for i, idx := range []int{11, 12, 19} {
+		if ticks[i], err = strconv.ParseUint(fields[idx], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed stat for pid %d: %v", pid, err)
+		}
+	}
+	utime, stime, start := ticks[0], ticks[1], ticks[2]
+	rssPages, err := strconv.ParseUint(fields[21], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed stat for pid %d: %v", pid, err)
+	}
+
+	raw, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		return nil, err
+	}
+	uptimeFields := strings.Fields(string(raw))
+	if len(uptimeFields) == 0 {
+		return nil, fmt.Errorf("malformed /proc/uptime")
+	}
+	sinceBoot, err := strconv.ParseFloat(uptimeFields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed /proc/uptime: %v", err)
+	}
+
+	uptime := time.Duration(sinceBoot*float64(time.Second)) - ticksToDuration(start)
+	if uptime < 0 {
+		uptime = 0
+	}
+	return &procUsage{
+		cpu:    ticksToDuration(utime + stime),
+		rss:    rssPages * uint64(os.Getpagesize()),
+		uptime: uptime,
+	}, nil
+}
+
+func ticksToDuration(ticks uint64) time.Duration {
+	return time.Duration(ticks) * time.Second / clockTicks
+}
@@ -0,0 +1,67 @@
+package driver
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestPidStats(t *testing.T) {
+	stats := newPidStats("test", os.Getpid())
+	usage, err := stats.Stats()
+	if runtime.GOOS != "linux" {
+		if !IsNotSupported(err) {
+			t.Fatalf("expected a not supported error; got %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if usage.MemoryRSS == 0 {
+		t.Fatalf("missing memory usage: %#v", usage)
+	}
+	if usage.Uptime <= 0 {
+		t.Fatalf("missing uptime: %#v", usage)
+	}
+
+	// Burn some CPU so the next sample has usage to report
+	for i := 0; i < 10000000; i++ {
+		runtime.Gosched()
+	}
+	next, err := stats.Stats()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if next.CPUPercent <= 0 {
+		t.Fatalf("missing cpu usage: %#v", next)
+	}
+	if !next.Timestamp.After(usage.Timestamp) {
+		t.Fatalf("timestamp did not advance: %v then %v", usage.Timestamp, next.Timestamp)
+	}
+}
+
+func TestPidStats_MissingProcess(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("process stats are only supported on Linux")
+	}
+
+	// PIDs are capped well below this
+	if _, err := newPidStats("test", 1<<30).Stats(); err == nil || IsNotSupported(err) {
+		t.Fatalf("expected a failure; got %v", err)
+	}
+}
+
+func TestIsNotSupported(t *testing.T) {
+	err := &NotSupportedError{Driver: "docker", Operation: "stats"}
+	if !IsNotSupported(err) {
+		t.Fatalf("should be not supported")
+	}
+	if err.Error() != "docker driver does not support stats" {
+		t.Fatalf("bad message: %v", err)
+	}
+	if IsNotSupported(errors.New("docker driver does not support stats")) {
+		t.Fatalf("should not be not supported")
+	}
+}
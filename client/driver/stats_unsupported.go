@@ -0,0 +1,8 @@
+// +build !linux
+
+package driver
+
+// readProcUsage is only implemented on Linux.
+func readProcUsage(pid int) (*procUsage, error) {
+	return nil, errStatsNotSupported
+}
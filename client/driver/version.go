@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+// parseVersion returns the leading numeric components of a version, e.g.
+// [1 9 1] for "1.9.1-cs2" or [1 8 0] for "1.8.0_45". Parsing stops at the
+// first component that does not start with a digit or carries a suffix, so
+// vendor suffixes are ignored. It returns nil if the version does not start
+// with a number.
+func parseVersion(version string) []int {
+	version = strings.TrimPrefix(strings.TrimSpace(version), "v")
+	var parts []int
+	for _, part := range strings.Split(version, ".") {
+		end := 0
+		for end < len(part) && part[end] >= '0' && part[end] <= '9' {
+			end++
+		}
+		if end == 0 {
+			break
+		}
+		n, err := strconv.Atoi(part[:end])
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+		if end != len(part) {
+			break
+		}
+	}
+	return parts
+}
+
+// CompareVersions returns -1, 0 or 1 if version a is lower than, equal to or
+// higher than b. Missing components count as zero, so "1.9" equals "1.9.0",
+// and suffixes are ignored, so "1.10.0-rc1" equals "1.10.0".
+func CompareVersions(a, b string) int {
+	pa, pb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+	}
+	return 0
+}
+
+// CheckVersion returns an error if the version of the named driver is lower
+// than the minimum set by the "driver.<name>.min_version" option. Drivers
+// that do not report their version only pass if no minimum is set.
+func CheckVersion(d Driver, name string, config *config.Config) error {
+	min := config.Read(fmt.Sprintf("driver.%s.min_version", name))
+	if min == "" {
+		return nil
+	}
+	if parseVersion(min) == nil {
+		return fmt.Errorf("invalid minimum version '%s' for driver '%s'", min, name)
+	}
+
+	version, err := d.Version()
+	if err != nil {
+		return fmt.Errorf("failed to check %s version against required %s: %v", name, min, err)
+	}
+	if parseVersion(version) == nil {
+		return fmt.Errorf("failed to check %s version against required %s: invalid version '%s'", name, min, version)
+	}
+	if CompareVersions(version, min) < 0 {
+		return fmt.Errorf("%s %s < required %s", name, version, min)
+	}
+	return nil
+}
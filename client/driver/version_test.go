@@ -0,0 +1,84 @@
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		version string
+		exp     int
+	}{
+		{"1.8.3", -1},
+		{"1.8.99", -1},
+		{"1.9", 0},
+		{"1.9.0", 0},
+		{"v1.9.0", 0},
+		{"1.9.0-rc1", 0},
+		{"1.9.0-dev", 0},
+		{"1.9.1", 1},
+		{"1.9.1-cs2", 1},
+		{"1.10.0", 1},
+		{"2", 1},
+		{"1", -1},
+	}
+	for _, c := range cases {
+		if got := CompareVersions(c.version, "1.9"); got != c.exp {
+			t.Fatalf("compare %s to 1.9: got %d; want %d", c.version, got, c.exp)
+		}
+	}
+
+	// Java versions carry the update after an underscore
+	if got := CompareVersions("1.8.0_45", "1.8.0"); got != 0 {
+		t.Fatalf("bad: %d", got)
+	}
+	if got := CompareVersions("1.7.0_80", "1.8"); got != -1 {
+		t.Fatalf("bad: %d", got)
+	}
+}
+
+// versionDriver is a driver reporting a fixed version
+type versionDriver struct {
+	Driver
+	version string
+	err     error
+}
+
+func (d *versionDriver) Version() (string, error) {
+	return d.version, d.err
+}
+
+func TestCheckVersion(t *testing.T) {
+	conf := &config.Config{Options: map[string]string{"driver.docker.min_version": "1.9"}}
+
+	if err := CheckVersion(&versionDriver{version: "1.9.1"}, "docker", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := CheckVersion(&versionDriver{version: "1.6"}, "docker", conf)
+	if err == nil || err.Error() != "docker 1.6 < required 1.9" {
+		t.Fatalf("bad: %v", err)
+	}
+
+	// The version must be known to be checked
+	err = CheckVersion(&versionDriver{err: errors.New("daemon down")}, "docker", conf)
+	if err == nil || !strings.Contains(err.Error(), "daemon down") {
+		t.Fatalf("bad: %v", err)
+	}
+	if err := CheckVersion(&versionDriver{version: "unknown"}, "docker", conf); err == nil {
+		t.Fatalf("expected error")
+	}
+
+	// Without a minimum the version is not read
+	if err := CheckVersion(&versionDriver{err: errors.New("daemon down")}, "exec", conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf.Options["driver.docker.min_version"] = "latest"
+	if err := CheckVersion(&versionDriver{version: "1.9.1"}, "docker", conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
@@ -0,0 +1,106 @@
+package client
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// TaskPlan is what a task would be started with, as resolved by DryRunTask
+type TaskPlan struct {
+	// Env is the environment the task is started with
+	Env map[string]string
+
+	// Ports maps the labels of the dynamic ports of the task to the host
+	// ports
+	Ports map[string]int
+
+	// NetworkMode is the network mode the task runs in
+	NetworkMode string
+
+	// Files maps the destinations of the templates, relative to the task
+	// directory, to the rendered outputs
+	Files map[string][]byte
+
+	// Volumes are the host volumes mounted into the task, with their sources
+	// resolved
+	Volumes []*structs.TaskVolume
+}
+
+// DryRunTask resolves what the task of the allocation would be started with,
+// going through the same steps as the task runner: the driver is created and
+// validates the task, then the ports and environment are resolved and the
+// templates rendered. The task is never started and nothing is written to
+// disk, so the paths in the plan refer to an alloc dir that does not exist.
+// The provider secrets aren't fetched either, as that would lease them, so
+// references to secrets are left unresolved when the task has any of them.
+func DryRunTask(logger *log.Logger, config *config.Config, allocID string, task *structs.Task) (*TaskPlan, error) {
+	allocDir := allocdir.NewAllocDir(filepath.Join(config.AllocDir, allocID))
+	allocDir.TaskDirs[task.Name] = filepath.Join(allocDir.AllocDir, task.Name)
+	ctx := driver.NewExecContext(allocDir)
+	r := NewTaskRunner(logger, config, func(string, string, string, *structs.TaskExit) {}, ctx, allocID, task)
+	r.dryRun = true
+
+	if node := config.Node; node != nil && !driver.Available(node, task.Driver) {
+		return nil, fmt.Errorf("driver '%s' is not available on this node", task.Driver)
+	}
+	d, err := r.createDriver()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Validate(task); err != nil {
+		return nil, fmt.Errorf("invalid task config: %v", err)
+	}
+	if err := driver.CheckCapabilities(task.Driver, d.Capabilities(), task); err != nil {
+		return nil, err
+	}
+	if err := driver.CheckResourceCeiling(task.Driver, config, task); err != nil {
+		return nil, err
+	}
+	if err := driver.CheckVersion(d, task.Driver, config); err != nil {
+		return nil, err
+	}
+
+	var volumes []*structs.TaskVolume
+	if len(task.Volumes) != 0 {
+		if volumes, err = driver.TaskVolumes(config, task); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := r.setupPorts(); err != nil {
+		return nil, err
+	}
+	env, err := r.templateEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Render the templates in memory, checking their destinations like
+	// templateDest does apart from the symlinks, as nothing exists yet
+	files := make(map[string][]byte, len(task.Templates))
+	for _, tmpl := range task.Templates {
+		dest := filepath.Join(allocDir.TaskDirs[task.Name], tmpl.DestPath)
+		if filepath.IsAbs(tmpl.DestPath) || !withinDir(allocDir.AllocDir, dest) {
+			return nil, fmt.Errorf("invalid template destination '%s'", tmpl.DestPath)
+		}
+		out, err := renderTemplate(tmpl, env, r.templateKeys.get)
+		if err != nil {
+			return nil, fmt.Errorf("failed to render template '%s': %v", tmpl.DestPath, err)
+		}
+		files[tmpl.DestPath] = out
+	}
+
+	return &TaskPlan{
+		Env:         env,
+		Ports:       ctx.TaskPorts(task.Name),
+		NetworkMode: d.Capabilities().NetworkMode(task),
+		Files:       files,
+		Volumes:     volumes,
+	}, nil
+}
@@ -0,0 +1,126 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestDryRunTask(t *testing.T) {
+	allowed, err := ioutil.TempDir("", "nomad-volumes")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(allowed)
+	source, err := filepath.EvalSymlinks(allowed)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf := DefaultConfig()
+	conf.StateDir = os.TempDir()
+	conf.AllocDir = os.TempDir()
+	conf.VolumeWhitelist = []string{allowed}
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+
+	// Starting the task would fail, so the plan is only returned if it is not
+	task.Config = map[string]string{"start_err": "task was started"}
+	task.Resources.Networks[0].ReservedPorts = []int{8080}
+	task.Env = map[string]string{"ADDR": "${NOMAD_IP}:${NOMAD_PORT_http}"}
+	task.Templates = []*structs.Template{{
+		EmbeddedTmpl: "listen {{.ADDR}}",
+		DestPath:     "local/app.conf",
+	}}
+	task.Volumes = []*structs.TaskVolume{{Source: allowed, Destination: "/data", ReadOnly: true}}
+
+	plan, err := DryRunTask(testLogger(), conf, alloc.ID, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	addr := fmt.Sprintf("%s:8080", task.Resources.Networks[0].IP)
+	if plan.Env["ADDR"] != addr || plan.Env["NOMAD_ALLOC_ID"] != alloc.ID {
+		t.Fatalf("bad env: %#v", plan.Env)
+	}
+	if exp := map[string]int{"http": 8080}; !reflect.DeepEqual(plan.Ports, exp) {
+		t.Fatalf("got ports %v; want %v", plan.Ports, exp)
+	}
+	if out := string(plan.Files["local/app.conf"]); out != "listen "+addr {
+		t.Fatalf("bad rendered template: %q", out)
+	}
+	exp := []*structs.TaskVolume{{Source: source, Destination: "/data", ReadOnly: true}}
+	if !reflect.DeepEqual(plan.Volumes, exp) {
+		t.Fatalf("got volumes %#v; want %#v", plan.Volumes, exp)
+	}
+
+	// Nothing was written for the allocation
+	if _, err := os.Stat(filepath.Join(conf.AllocDir, alloc.ID)); !os.IsNotExist(err) {
+		t.Fatalf("alloc dir created: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(conf.StateDir, "alloc", alloc.ID)); !os.IsNotExist(err) {
+		t.Fatalf("state written: %v", err)
+	}
+}
+
+func TestDryRunTask_Invalid(t *testing.T) {
+	conf := DefaultConfig()
+	conf.AllocDir = os.TempDir()
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]string{"validate_err": "missing image"}
+
+	_, err := DryRunTask(testLogger(), conf, alloc.ID, task)
+	if err == nil || !strings.Contains(err.Error(), "missing image") {
+		t.Fatalf("expected validation error: %v", err)
+	}
+
+	// The dynamic ports must have been allocated
+	task.Config = nil
+	if _, err := DryRunTask(testLogger(), conf, alloc.ID, task); err == nil || !strings.Contains(err.Error(), "allocated only 0 ports") {
+		t.Fatalf("expected unallocated ports error: %v", err)
+	}
+
+	// Templates must stay within the alloc dir
+	task.Resources.Networks[0].ReservedPorts = []int{8080}
+	task.Templates = []*structs.Template{{EmbeddedTmpl: "x", DestPath: "../../escape"}}
+	if _, err := DryRunTask(testLogger(), conf, alloc.ID, task); err == nil || !strings.Contains(err.Error(), "invalid template destination") {
+		t.Fatalf("expected template destination error: %v", err)
+	}
+}
+
+func TestDryRunTask_ProviderSecrets(t *testing.T) {
+	provider := newFakeSecretProvider(time.Hour)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	conf := DefaultConfig()
+	conf.AllocDir = os.TempDir()
+	conf.SecretProvider = provider
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Resources.Networks[0].ReservedPorts = []int{8080}
+	task.ProviderSecrets = []*structs.ProviderSecret{&structs.ProviderSecret{Path: "secret/db"}}
+	task.Env = map[string]string{"DB_PASSWORD": "${secret:password}"}
+
+	// The secrets aren't leased, leaving the references to them as is
+	plan, err := DryRunTask(testLogger(), conf, alloc.ID, task)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := provider.fetchCount(); n != 0 {
+		t.Fatalf("fetched %d secrets", n)
+	}
+	if v := plan.Env["DB_PASSWORD"]; v != "${secret:password}" {
+		t.Fatalf("bad env: %q", v)
+	}
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// maxEnvFileLine is the longest line an env file may have
+const maxEnvFileLine = 64 * 1024
+
+// parseEnvFile parses the KEY=VALUE lines of an env file. Blank lines and
+// lines starting with # are skipped, keys may be prefixed with "export" and
+// values may be single or double quoted. Double quoted values are unquoted
+// like Go strings. A later line overrides an earlier one with the same key.
+func parseEnvFile(r io.Reader) (map[string]string, error) {
+	vars := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxEnvFileLine)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "export ") {
+			line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		}
+		idx := strings.Index(line, "=")
+		if idx == -1 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", n)
+		}
+		key, value := strings.TrimSpace(line[:idx]), strings.TrimSpace(line[idx+1:])
+		if !validEnvKey(key) {
+			return nil, fmt.Errorf("line %d: invalid key %q", n, key)
+		}
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value: %v", n, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+			return nil, fmt.Errorf("line %d: unterminated quoted value", n)
+		}
+		vars[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return vars, nil
+}
+
+// validEnvKey returns whether the key is a valid name of an environment
+// variable: letters, digits and underscores, not starting with a digit
+func validEnvKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for i, c := range key {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// loadEnvFiles reads the env files of the task into envFileVars, later files
+// overriding earlier ones. The files are resolved like template destinations
+// so they can't be read from outside the alloc dir.
+func (r *TaskRunner) loadEnvFiles() error {
+	vars := make(map[string]string)
+	for _, name := range r.task.EnvFiles {
+		path, err := templateDest(r.ctx.AllocDir, r.task.Name, name)
+		if err != nil {
+			return fmt.Errorf("invalid env file: %v", err)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to read env file '%s': %v", name, err)
+		}
+		fileVars, err := parseEnvFile(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to parse env file '%s': %v", name, err)
+		}
+		for k, v := range fileVars {
+			vars[k] = v
+		}
+	}
+	r.envFileVars = vars
+	return nil
+}
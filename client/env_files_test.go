@@ -0,0 +1,200 @@
+package client
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	in := `
+# a comment
+FOO=bar
+export EXPORTED = spaced
+EMPTY=
+DOUBLE="a \"quoted\" value\n"
+SINGLE='a ${RAW} value'
+REF=${FOO}-baz
+FOO=overridden
+`
+	vars, err := parseEnvFile(strings.NewReader(in))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := map[string]string{
+		"FOO":      "overridden",
+		"EXPORTED": "spaced",
+		"EMPTY":    "",
+		"DOUBLE":   "a \"quoted\" value\n",
+		"SINGLE":   "a ${RAW} value",
+		"REF":      "${FOO}-baz",
+	}
+	if !reflect.DeepEqual(vars, exp) {
+		t.Fatalf("got %v; want %v", vars, exp)
+	}
+}
+
+func TestParseEnvFile_Malformed(t *testing.T) {
+	for in, exp := range map[string]string{
+		"FOO=bar\nno separator\n":    "line 2: expected KEY=VALUE",
+		"\n\n=bar\n":                 "line 3: invalid key",
+		"1FOO=bar\n":                 "line 1: invalid key",
+		"FOO-BAR=baz\n":              "line 1: invalid key",
+		"# comment\nFOO=\"open\n":    "line 2: unterminated quoted value",
+		"FOO=bar\nBAR=\"bad \\q\"\n": "line 2: invalid quoted value",
+	} {
+		if _, err := parseEnvFile(strings.NewReader(in)); err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("%q: expected %q error: %v", in, exp, err)
+		}
+	}
+}
+
+func TestTaskRunner_BuildEnv_Precedence(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	tr.task.Env = map[string]string{
+		"INLINE":  "inline",
+		"SHARED":  "inline",
+		"DB_URL":  "postgres://app:${secret:db_password}@db/app",
+		"FROM_FS": "${FILE_ONLY}",
+	}
+	tr.task.Secrets = map[string]string{"db_password": "hunter2"}
+	tr.envFileVars = map[string]string{
+		"SHARED":          "file",
+		"FILE_ONLY":       "file",
+		"NOMAD_TASK_NAME": "foo",
+		"TOKEN":           "${secret:db_password}",
+	}
+
+	// Env files override the inline env but not the runtime values, and
+	// their variables can be referenced and reference secrets
+	env, err := tr.buildEnv()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := map[string]string{
+		"INLINE":          "inline",
+		"SHARED":          "file",
+		"FILE_ONLY":       "file",
+		"FROM_FS":         "file",
+		"NOMAD_TASK_NAME": tr.task.Name,
+		"DB_URL":          "postgres://app:hunter2@db/app",
+		"TOKEN":           "hunter2",
+	}
+	for k, v := range exp {
+		if env[k] != v {
+			t.Fatalf("%s is %q; want %q", k, env[k], v)
+		}
+	}
+
+	// Templates don't see the env files
+	env, err = tr.templateEnv()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if env["SHARED"] != "inline" || env["FROM_FS"] != "${FILE_ONLY}" {
+		t.Fatalf("env files in the template env: %v", env)
+	}
+
+	// Unknown secrets are an error
+	tr.task.Env["MISSING"] = "${secret:nope}"
+	if _, err := tr.buildEnv(); err == nil || !strings.Contains(err.Error(), "references unknown secrets: nope") {
+		t.Fatalf("expected unknown secret error: %v", err)
+	}
+}
+
+func TestTaskRunner_EnvFiles(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Env = map[string]string{"GREETING": "hello", "NAME": "inline"}
+	tr.task.Templates = []*structs.Template{
+		{EmbeddedTmpl: "NAME=first\nPORT=8080\n", DestPath: "local/first.env"},
+		{EmbeddedTmpl: "NAME=second\n", DestPath: "local/second.env"},
+	}
+	tr.task.EnvFiles = []string{"local/first.env", "local/second.env"}
+	go tr.Run()
+	defer tr.Destroy()
+
+	waitDescription(t, upd, "task started")
+
+	// The task is started with the variables of the env files, the later
+	// file overriding the earlier one
+	env := tr.ctx.TaskEnv(tr.task.Name)
+	for k, v := range map[string]string{"GREETING": "hello", "NAME": "second", "PORT": "8080"} {
+		if env[k] != v {
+			t.Fatalf("%s is %q; want %q", k, env[k], v)
+		}
+	}
+}
+
+func TestTaskRunner_EnvFiles_Malformed(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Templates = []*structs.Template{
+		{EmbeddedTmpl: "FOO=bar\n# ok\nnot a variable\n", DestPath: "local/app.env"},
+	}
+	tr.task.EnvFiles = []string{"local/app.env"}
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task fails naming the file and the offending line
+	events := tr.Events()
+	last := events[len(events)-1]
+	if last.Type != structs.TaskEnvFileFailure || last.Hook != "env_files" ||
+		!strings.Contains(last.Message, "env file 'local/app.env'") || !strings.Contains(last.Message, "line 3") {
+		t.Fatalf("bad: %#v", last)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestTaskRunner_EnvFiles_Missing(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.EnvFiles = []string{"local/missing.env"}
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskEnvFileFailure ||
+		!strings.Contains(last.Message, "failed to read env file 'local/missing.env'") {
+		t.Fatalf("bad: %#v", last)
+	}
+}
+
+func TestTaskRunner_Env_UnknownSecret(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Env = map[string]string{"TOKEN": "${secret:token}"}
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskSecretsFailure || last.Hook != "env" ||
+		!strings.Contains(last.Message, "unknown secrets: token") {
+		t.Fatalf("bad: %#v", last)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
+}
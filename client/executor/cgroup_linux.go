@@ -0,0 +1,269 @@
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	cgroupFs "github.com/opencontainers/runc/libcontainer/cgroups/fs"
+	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
+)
+
+const (
+	// cgroupV1 is the hierarchy of a mount per subsystem, e.g.
+	// /sys/fs/cgroup/memory
+	cgroupV1 = 1
+
+	// cgroupV2 is the unified hierarchy, a single mount holding the control
+	// files of every controller
+	cgroupV2 = 2
+)
+
+// cgroupV2Parent is the cgroup the cgroups of the tasks are created in on
+// the unified hierarchy, relative to its mount
+const cgroupV2Parent = "nomad"
+
+// detectCgroupVersion returns the version of the cgroups mounted at the
+// mount point, or zero if none are. Hosts mounting both, with the unified
+// hierarchy beneath the v1 mounts, use v1 as the controllers are there.
+func detectCgroupVersion(mount string) int {
+	if _, err := os.Stat(filepath.Join(mount, "cgroup.controllers")); err == nil {
+		return cgroupV2
+	}
+	if _, err := os.Stat(mount); err == nil {
+		return cgroupV1
+	}
+	return 0
+}
+
+// cgroupManager creates the cgroup of a task with its limits, places
+// processes in it and removes it, hiding the version of cgroups the host
+// runs.
+type cgroupManager interface {
+	// Apply creates the cgroup and places the process in it
+	Apply(pid int) error
+
+	// GetPids returns the processes in the cgroup
+	GetPids() ([]int, error)
+
+	// Destroy removes the cgroup once its processes are killed
+	Destroy() error
+
+	// MemoryPath returns the directory of the memory control files of the
+	// cgroup of the process
+	MemoryPath(pid int) (string, error)
+
+	// OOMKilled returns whether the kernel killed a process in the memory
+	// cgroup at the path for exceeding the memory limit
+	OOMKilled(path string) bool
+}
+
+// newCgroupManager returns the manager of the cgroup for the version of
+// cgroups mounted at the mount point
+func newCgroupManager(version int, mount string, groups *cgroupConfig.Cgroup) (cgroupManager, error) {
+	switch version {
+	case cgroupV1:
+		return &cgroupV1Manager{mount: mount, manager: cgroupFs.Manager{Cgroups: groups}}, nil
+	case cgroupV2:
+		return &cgroupV2Manager{dir: filepath.Join(mount, cgroupV2Parent, groups.Name), groups: groups}, nil
+	default:
+		return nil, fmt.Errorf("no cgroups mounted at %v", mount)
+	}
+}
+
+// cgroupV1Manager manages a cgroup spread over the hierarchies of the v1
+// subsystems
+type cgroupV1Manager struct {
+	mount   string
+	manager cgroupFs.Manager
+}
+
+func (m *cgroupV1Manager) Apply(pid int) error {
+	return m.manager.Apply(pid)
+}
+
+func (m *cgroupV1Manager) GetPids() ([]int, error) {
+	return m.manager.GetPids()
+}
+
+func (m *cgroupV1Manager) Destroy() error {
+	return m.manager.Destroy()
+}
+
+func (m *cgroupV1Manager) MemoryPath(pid int) (string, error) {
+	path, err := processCgroup(pid, "memory")
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(m.mount, "memory", path), nil
+}
+
+func (m *cgroupV1Manager) OOMKilled(path string) bool {
+	// Newer kernels count the OOM kills in the cgroup.
+	control, err := ioutil.ReadFile(filepath.Join(path, "memory.oom_control"))
+	if err != nil {
+		return false
+	}
+	if n, ok := cgroupKeyedValue(string(control), "oom_kill"); ok {
+		return n > 0
+	}
+
+	// Otherwise fall back to whether the limit was ever hit.
+	failcnt, err := ioutil.ReadFile(filepath.Join(path, "memory.failcnt"))
+	if err != nil {
+		return false
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(string(failcnt)))
+	return err == nil && n > 0
+}
+
+// cgroupV2Manager manages a cgroup of the unified hierarchy, whose control
+// files are all in its directory
+type cgroupV2Manager struct {
+	dir    string
+	groups *cgroupConfig.Cgroup
+}
+
+func (m *cgroupV2Manager) Apply(pid int) error {
+	// The controllers limiting the cgroup must be enabled in the subtrees of
+	// its ancestors for its control files to exist
+	var controllers []string
+	if m.groups.Memory > 0 {
+		controllers = append(controllers, "memory")
+	}
+	if m.groups.CpuShares > 0 {
+		controllers = append(controllers, "cpu")
+	}
+	if m.groups.CpusetCpus != "" {
+		controllers = append(controllers, "cpuset")
+	}
+	parent := filepath.Dir(m.dir)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return fmt.Errorf("Failed to create the cgroup %v: %v", parent, err)
+	}
+	for _, dir := range []string{filepath.Dir(parent), parent} {
+		for _, c := range controllers {
+			if err := writeCgroupFile(dir, "cgroup.subtree_control", "+"+c); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.Mkdir(m.dir, 0755); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("Failed to create the cgroup %v: %v", m.dir, err)
+	}
+
+	// The reservation is protected from reclaim the way the v1 soft limit
+	// is reclaimed down to, and cpu.weight is the counterpart of the v1
+	// cpu.shares. The IOPS limit is left out as io.max throttles named
+	// devices only.
+	limits := make(map[string]string)
+	if m.groups.Memory > 0 {
+		limits["memory.max"] = strconv.FormatInt(m.groups.Memory, 10)
+		if m.groups.MemoryReservation > 0 {
+			limits["memory.low"] = strconv.FormatInt(m.groups.MemoryReservation, 10)
+		}
+	}
+	if m.groups.CpuShares > 0 {
+		limits["cpu.weight"] = strconv.FormatUint(cpuSharesToWeight(m.groups.CpuShares), 10)
+	}
+	if m.groups.CpusetCpus != "" {
+		limits["cpuset.cpus"] = m.groups.CpusetCpus
+	}
+	for name, value := range limits {
+		if err := writeCgroupFile(m.dir, name, value); err != nil {
+			return err
+		}
+	}
+
+	// Swap is disabled where it is accounted
+	if m.groups.Memory > 0 {
+		if _, err := os.Stat(filepath.Join(m.dir, "memory.swap.max")); err == nil {
+			if err := writeCgroupFile(m.dir, "memory.swap.max", "0"); err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeCgroupFile(m.dir, "cgroup.procs", strconv.Itoa(pid))
+}
+
+func (m *cgroupV2Manager) GetPids() ([]int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(m.dir, "cgroup.procs"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var pids []int
+	for _, line := range strings.Fields(string(data)) {
+		pid, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to parse pid %q in %v: %v", line, m.dir, err)
+		}
+		pids = append(pids, pid)
+	}
+	return pids, nil
+}
+
+func (m *cgroupV2Manager) Destroy() error {
+	// The cgroup can only be removed once the killed processes are reaped,
+	// which may take a moment
+	var err error
+	for i := 0; i < 10; i++ {
+		if err = os.Remove(m.dir); err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
+
+func (m *cgroupV2Manager) MemoryPath(pid int) (string, error) {
+	return m.dir, nil
+}
+
+func (m *cgroupV2Manager) OOMKilled(path string) bool {
+	events, err := ioutil.ReadFile(filepath.Join(path, "memory.events"))
+	if err != nil {
+		return false
+	}
+	n, ok := cgroupKeyedValue(string(events), "oom_kill")
+	return ok && n > 0
+}
+
+// cpuSharesToWeight converts v1 cpu.shares, from 2 to 262144, to the range
+// of the v2 cpu.weight, from 1 to 10000.
+func cpuSharesToWeight(shares int64) uint64 {
+	if shares < 2 {
+		shares = 2
+	} else if shares > 262144 {
+		shares = 262144
+	}
+	return uint64(1 + ((shares-2)*9999)/262142)
+}
+
+// cgroupKeyedValue returns the value of the key in the contents of a control
+// file of "<key> <value>" lines, such as memory.events.
+func cgroupKeyedValue(contents, key string) (int, bool) {
+	for _, line := range strings.Split(contents, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == key {
+			n, err := strconv.Atoi(fields[1])
+			return n, err == nil
+		}
+	}
+	return 0, false
+}
+
+// writeCgroupFile writes the value to the control file of the cgroup
+func writeCgroupFile(dir, name, value string) error {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(value), 0644); err != nil {
+		return fmt.Errorf("Failed to write %q to %v: %v", value, path, err)
+	}
+	return nil
+}
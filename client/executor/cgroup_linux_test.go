@@ -0,0 +1,212 @@
+package executor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
+)
+
+// fakeCgroupMount returns a directory laid out like a cgroup mount of the
+// version, which has no mount at all if zero
+func fakeCgroupMount(t *testing.T, version int) string {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mount := filepath.Join(dir, "cgroup")
+	switch version {
+	case cgroupV1:
+		for _, subsystem := range []string{"cpu", "memory", "unified"} {
+			if err := os.MkdirAll(filepath.Join(mount, subsystem), 0755); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+	case cgroupV2:
+		if err := os.MkdirAll(mount, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(mount, "cgroup.controllers"), []byte("cpuset cpu io memory pids"), 0644); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	return mount
+}
+
+func TestCgroup_DetectVersion(t *testing.T) {
+	for _, version := range []int{0, cgroupV1, cgroupV2} {
+		mount := fakeCgroupMount(t, version)
+		defer os.RemoveAll(filepath.Dir(mount))
+		if act := detectCgroupVersion(mount); act != version {
+			t.Fatalf("detected version %d; want %d", act, version)
+		}
+	}
+}
+
+func TestCgroup_NewManager(t *testing.T) {
+	groups := &cgroupConfig.Cgroup{Name: "web"}
+	for version, exp := range map[int]cgroupManager{
+		cgroupV1: &cgroupV1Manager{},
+		cgroupV2: &cgroupV2Manager{},
+	} {
+		mount := fakeCgroupMount(t, version)
+		defer os.RemoveAll(filepath.Dir(mount))
+		manager, err := newCgroupManager(detectCgroupVersion(mount), mount, groups)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if reflect.TypeOf(manager) != reflect.TypeOf(exp) {
+			t.Fatalf("got %T for version %d; want %T", manager, version, exp)
+		}
+	}
+
+	mount := fakeCgroupMount(t, 0)
+	defer os.RemoveAll(filepath.Dir(mount))
+	if _, err := newCgroupManager(detectCgroupVersion(mount), mount, groups); err == nil {
+		t.Fatalf("expected an error without cgroups")
+	}
+}
+
+func TestCgroup_V2Apply(t *testing.T) {
+	mount := fakeCgroupMount(t, cgroupV2)
+	defer os.RemoveAll(filepath.Dir(mount))
+	groups := &cgroupConfig.Cgroup{
+		Name:              "web",
+		Memory:            32 * 1024 * 1024,
+		MemoryReservation: 16 * 1024 * 1024,
+		CpuShares:         1024,
+	}
+	manager, err := newCgroupManager(cgroupV2, mount, groups)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := manager.Apply(1234); err != nil {
+		t.Fatalf("Apply() failed: %v", err)
+	}
+
+	// The limits are written to the v2 control files of the group
+	dir := filepath.Join(mount, cgroupV2Parent, "web")
+	for name, exp := range map[string]string{
+		"memory.max":   strconv.Itoa(32 * 1024 * 1024),
+		"memory.low":   strconv.Itoa(16 * 1024 * 1024),
+		"cpu.weight":   "39",
+		"cgroup.procs": "1234",
+	} {
+		act, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("Couldn't read %v: %v", name, err)
+		}
+		if strings.TrimSpace(string(act)) != exp {
+			t.Fatalf("%v is %s; want %s", name, act, exp)
+		}
+	}
+	for _, d := range []string{mount, filepath.Dir(dir)} {
+		if _, err := os.Stat(filepath.Join(d, "cgroup.subtree_control")); err != nil {
+			t.Fatalf("controllers not enabled in %v: %v", d, err)
+		}
+	}
+
+	pids, err := manager.GetPids()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(pids, []int{1234}) {
+		t.Fatalf("bad: %v", pids)
+	}
+	if path, err := manager.MemoryPath(1234); err != nil || path != dir {
+		t.Fatalf("bad memory path %v: %v", path, err)
+	}
+}
+
+func TestCgroup_OOMKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		manager cgroupManager
+		files   map[string]string
+		killed  bool
+	}{
+		{&cgroupV2Manager{}, map[string]string{"memory.events": "low 0\nhigh 0\nmax 4\noom 1\noom_kill 1\n"}, true},
+		{&cgroupV2Manager{}, map[string]string{"memory.events": "low 0\nhigh 0\nmax 0\noom 0\noom_kill 0\n"}, false},
+		{&cgroupV1Manager{}, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\noom_kill 2\n"}, true},
+		{&cgroupV1Manager{}, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\noom_kill 0\n"}, false},
+
+		// Older v1 kernels only count how often the limit was hit
+		{&cgroupV1Manager{}, map[string]string{"memory.oom_control": "oom_kill_disable 0\nunder_oom 0\n", "memory.failcnt": "3\n"}, true},
+	}
+	for i, c := range cases {
+		path := filepath.Join(dir, strconv.Itoa(i))
+		if err := os.Mkdir(path, 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		for name, contents := range c.files {
+			if err := ioutil.WriteFile(filepath.Join(path, name), []byte(contents), 0644); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		if act := c.manager.OOMKilled(path); act != c.killed {
+			t.Fatalf("case %d: got %v; want %v", i, act, c.killed)
+		}
+	}
+}
+
+func TestCgroup_ReapOrphaned(t *testing.T) {
+	mount := fakeCgroupMount(t, cgroupV2)
+	defer os.RemoveAll(filepath.Dir(mount))
+	for _, name := range []string{"active", "orphan"} {
+		if err := os.MkdirAll(filepath.Join(mount, cgroupV2Parent, name), 0755); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	data, err := json.Marshal(&cgroupConfig.Cgroup{Name: "active"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	active := "CGROUP:" + string(data)
+
+	// A cgroup ID that can't be parsed may be of any of the cgroups
+	if err := reapOrphanedCgroups(mount, "", []string{active, "CGROUP:garbage"}); err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, name := range []string{"active", "orphan"} {
+		if _, err := os.Stat(filepath.Join(mount, cgroupV2Parent, name)); err != nil {
+			t.Fatalf("cgroup %s removed: %v", name, err)
+		}
+	}
+
+	// Only the cgroups that no ID references are removed
+	if err := reapOrphanedCgroups(mount, "", []string{active, "PID:123"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, cgroupV2Parent, "active")); err != nil {
+		t.Fatalf("active cgroup removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(mount, cgroupV2Parent, "orphan")); !os.IsNotExist(err) {
+		t.Fatalf("orphaned cgroup not removed: %v", err)
+	}
+
+	// There is nothing to reap without the unified hierarchy
+	v1 := fakeCgroupMount(t, cgroupV1)
+	defer os.RemoveAll(filepath.Dir(v1))
+	if err := reapOrphanedCgroups(v1, "", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestCgroup_CpuSharesToWeight(t *testing.T) {
+	for shares, exp := range map[int64]uint64{0: 1, 2: 1, 1024: 39, 262144: 10000, 1 << 20: 10000} {
+		if act := cpuSharesToWeight(shares); act != exp {
+			t.Fatalf("weight of %d shares is %d; want %d", shares, act, exp)
+		}
+	}
+}
@@ -19,15 +19,34 @@ package executor
 
 import (
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"path/filepath"
 
 	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/driver/logging"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
 var errNoResources = fmt.Errorf("No resources are associated with this task")
 
+// ImageRootDir is the directory within the task directory the root
+// filesystem of a task run from an image is assembled in. It replaces the
+// task directory as the root of the chroot.
+const ImageRootDir = "rootfs"
+
+// OOMKilledError is returned by Wait when the task was killed for exceeding
+// its memory limit.
+type OOMKilledError struct {
+	// MemoryLimit is the limit that was exceeded in bytes.
+	MemoryLimit int64
+}
+
+func (e *OOMKilledError) Error() string {
+	return fmt.Sprintf("task was killed after exceeding its memory limit of %d MB", e.MemoryLimit/1024/1024)
+}
+
 // Executor is an interface that any platform- or capability-specific exec
 // wrapper must implement. You should not need to implement a Java executor.
 // Rather, you would implement a cgroups executor that the Java driver will use.
@@ -56,6 +75,10 @@ type Executor interface {
 	// Returns a handle that is executor specific for use in reopening.
 	ID() (string, error)
 
+	// Pid returns the PID of the process started or reopened, which is the
+	// one Wait waits on and Signal signals.
+	Pid() (int, error)
+
 	// Shutdown should use a graceful stop mechanism so the application can
 	// perform checkpointing or cleanup, if such a mechanism is available.
 	// If such a mechanism is not available, Shutdown() should call ForceStop().
@@ -65,6 +88,9 @@ type Executor interface {
 	// implementations must provide this.
 	ForceStop() error
 
+	// Signal delivers the signal to the user's command.
+	Signal(os.Signal) error
+
 	// Command provides access the underlying Cmd struct in case the Executor
 	// interface doesn't expose the functionality you need.
 	Command() *cmd
@@ -110,4 +136,80 @@ type cmd struct {
 
 	// RunAs may be a username or Uid. The implementation will decide how to use it.
 	RunAs string
+
+	// RunAsGroup may be a group name or Gid the process runs as. If empty
+	// the primary group of the RunAs user is used.
+	RunAsGroup string
+
+	// Logs configures the files the output of the process is written to. If
+	// nil, the implementation decides where the output goes.
+	Logs *LogConfig
+
+	// Volumes are host paths bind mounted into the task directory when it
+	// is configured. Implementations that can't mount them return an error.
+	Volumes []*structs.TaskVolume
+
+	// Cpuset is the list of CPUs, such as "0-1,4", the process is pinned
+	// to. If empty it may run on all of them. Implementations that can't pin
+	// processes return an error from Start.
+	Cpuset string
+
+	// ChrootEnv maps the host directories that are bind mounted read-only
+	// into the task directory when it is used as a chroot to their paths
+	// within it. If nil, the implementation's default set is used.
+	ChrootEnv map[string]string
+
+	// Image is the host directory of a base image the root filesystem of
+	// the task is made from instead of the ChrootEnv. The image is left
+	// unmodified; the task writes to its own layer that is discarded when
+	// the task directory is next configured. Implementations that can't
+	// run images return an error.
+	Image string
+}
+
+// LogConfig describes the rotated files the stdout and stderr of the process
+// are written to.
+type LogConfig struct {
+	// StdoutPath and StderrPath are the paths the log files are created at,
+	// suffixed with the index of the file.
+	StdoutPath string
+	StderrPath string
+
+	// MaxFiles is the number of files retained per stream.
+	MaxFiles int
+
+	// MaxFileSize is the size in bytes a file may grow to before it is
+	// rotated.
+	MaxFileSize int64
+
+	// Syslog, if set, forwards the lines of output to syslog as well. If
+	// DisableFiles is set too, the output is only forwarded.
+	Syslog       *logging.SyslogConfig
+	DisableFiles bool
+}
+
+// openLogs returns the writers the stdout and stderr of the process are
+// captured by.
+func (l *LogConfig) openLogs() (stdout, stderr io.WriteCloser, err error) {
+	if l.Syslog == nil || !l.DisableFiles {
+		stdoutRotator, err := logging.NewFileRotator(l.StdoutPath, l.MaxFiles, l.MaxFileSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to create stdout logger: %v", err)
+		}
+
+		stderrRotator, err := logging.NewFileRotator(l.StderrPath, l.MaxFiles, l.MaxFileSize)
+		if err != nil {
+			stdoutRotator.Close()
+			return nil, nil, fmt.Errorf("failed to create stderr logger: %v", err)
+		}
+		stdout, stderr = stdoutRotator, stderrRotator
+	}
+
+	if l.Syslog != nil {
+		stdout, stderr, err = logging.ForwardSyslog(l.Syslog, stdout, stderr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to forward logs to syslog: %v", err)
+		}
+	}
+	return stdout, stderr, nil
 }
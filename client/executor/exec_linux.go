@@ -1,15 +1,18 @@
 package executor
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -22,7 +25,6 @@ import (
 	"github.com/hashicorp/nomad/helper/discover"
 	"github.com/hashicorp/nomad/nomad/structs"
 
-	cgroupFs "github.com/opencontainers/runc/libcontainer/cgroups/fs"
 	cgroupConfig "github.com/opencontainers/runc/libcontainer/configs"
 )
 
@@ -31,8 +33,8 @@ const (
 )
 
 var (
-	// A mapping of directories on the host OS to attempt to embed inside each
-	// task's chroot.
+	// A mapping of directories on the host OS to bind mount inside each
+	// task's chroot if none are configured.
 	chrootEnv = map[string]string{
 		"/bin":     "/bin",
 		"/etc":     "/etc",
@@ -50,10 +52,9 @@ func NewExecutor() Executor {
 	// TODO: In a follow-up PR make it so this only happens once per client.
 	// Fingerprinting shouldn't happen per task.
 
-	// Check that cgroups are available.
-	if _, err := os.Stat(cgroupMount); err == nil {
-		e.cgroupEnabled = true
-	}
+	// Check that cgroups are available, and which version.
+	e.cgroupVersion = detectCgroupVersion(cgroupMount)
+	e.cgroupEnabled = e.cgroupVersion != 0
 
 	return &e
 }
@@ -65,12 +66,27 @@ type LinuxExecutor struct {
 
 	// Finger print capabilities.
 	cgroupEnabled bool
+	cgroupVersion int
 
 	// Isolation configurations.
-	groups   *cgroupConfig.Cgroup
-	alloc    *allocdir.AllocDir
-	taskName string
-	taskDir  string
+	groups *cgroupConfig.Cgroup
+
+	// oomScoreAdj is the oom_score_adj the task is started with.
+	oomScoreAdj int
+
+	// memoryCgroup is the path of the memory cgroup the task runs in, used
+	// to detect if the task was killed for running out of memory.
+	memoryCgroup string
+	alloc        *allocdir.AllocDir
+	taskName     string
+	taskDir      string
+
+	// rootDir is the root of the chroot of the task. It is the task
+	// directory unless the task runs from an image.
+	rootDir string
+
+	// overlay is set while the image root is mounted as an overlay.
+	overlay bool
 
 	// Tracking of child process.
 	spawnChild        exec.Cmd
@@ -79,6 +95,10 @@ type LinuxExecutor struct {
 
 	// Track whether there are filesystems mounted in the task dir.
 	mounts bool
+
+	// bindMounts are the mount points of the chroot directories and host
+	// volumes, in the order they were mounted.
+	bindMounts []string
 }
 
 func (e *LinuxExecutor) Limit(resources *structs.Resources) error {
@@ -89,6 +109,7 @@ func (e *LinuxExecutor) Limit(resources *structs.Resources) error {
 	if e.cgroupEnabled {
 		e.configureCgroups(resources)
 	}
+	e.oomScoreAdj = resources.OOMScoreAdj
 
 	return nil
 }
@@ -100,19 +121,42 @@ func (e *LinuxExecutor) ConfigureTaskDir(taskName string, alloc *allocdir.AllocD
 		fmt.Errorf("Couldn't find task directory for task %v", taskName)
 	}
 	e.taskDir = taskDir
+	e.rootDir = taskDir
 
 	if err := alloc.MountSharedDir(taskName); err != nil {
 		return err
 	}
 
-	if err := alloc.Embed(taskName, chrootEnv); err != nil {
-		return err
+	// Bind mount the host directories of the chroot read-only, which saves
+	// copying them and keeps them from being modified through the chroot.
+	// Mounts are recorded as they are made so a failure part way through
+	// still unmounts the earlier ones. A task run from an image gets its
+	// root filesystem from the image instead.
+	e.alloc = alloc
+	e.mounts = true
+	if e.Image != "" {
+		if err := e.mountImage(); err != nil {
+			return err
+		}
+	} else {
+		dirs := e.ChrootEnv
+		if dirs == nil {
+			dirs = chrootEnv
+		}
+		for _, volume := range chrootVolumes(dirs) {
+			if _, err := os.Stat(volume.Source); os.IsNotExist(err) {
+				continue
+			}
+			if err := e.mountVolume(volume); err != nil {
+				return err
+			}
+		}
 	}
 
-	// Mount dev
-	dev := filepath.Join(taskDir, "dev")
-	if err := os.Mkdir(dev, 0777); err != nil {
-		return fmt.Errorf("Mkdir(%v) failed: %v", dev)
+	// Mount dev, which an image may already have a directory for
+	dev := filepath.Join(e.rootDir, "dev")
+	if err := os.MkdirAll(dev, 0777); err != nil {
+		return fmt.Errorf("Mkdir(%v) failed: %v", dev, err)
 	}
 
 	if err := syscall.Mount("", dev, "devtmpfs", syscall.MS_RDONLY, ""); err != nil {
@@ -120,28 +164,236 @@ func (e *LinuxExecutor) ConfigureTaskDir(taskName string, alloc *allocdir.AllocD
 	}
 
 	// Mount proc
-	proc := filepath.Join(taskDir, "proc")
-	if err := os.Mkdir(proc, 0777); err != nil {
-		return fmt.Errorf("Mkdir(%v) failed: %v", proc)
+	proc := filepath.Join(e.rootDir, "proc")
+	if err := os.MkdirAll(proc, 0777); err != nil {
+		return fmt.Errorf("Mkdir(%v) failed: %v", proc, err)
 	}
 
 	if err := syscall.Mount("", proc, "proc", syscall.MS_RDONLY, ""); err != nil {
 		return fmt.Errorf("Couldn't mount /proc to %v: %v", proc, err)
 	}
 
-	// Set the tasks AllocDir environment variable.
+	// Bind mount the host volumes
+	for _, volume := range e.Volumes {
+		if err := e.mountVolume(volume); err != nil {
+			return err
+		}
+	}
+
+	// Set the tasks AllocDir and SecretsDir environment variables to their
+	// paths within the chroot.
 	env, err := environment.ParseFromList(e.Cmd.Env)
 	if err != nil {
 		return err
 	}
 	env.SetAllocDir(filepath.Join("/", allocdir.SharedAllocName))
+	env.SetSecretsDir(filepath.Join("/", allocdir.TaskSecrets))
 	e.Cmd.Env = env.List()
+	return nil
+}
 
-	e.alloc = alloc
-	e.mounts = true
+// chrootVolumes returns the read-only volumes the chroot is made of, sorted
+// by destination so that parents are mounted before the directories within
+// them.
+func chrootVolumes(dirs map[string]string) []*structs.TaskVolume {
+	volumes := make([]*structs.TaskVolume, 0, len(dirs))
+	for source, dest := range dirs {
+		volumes = append(volumes, &structs.TaskVolume{Source: source, Destination: dest, ReadOnly: true})
+	}
+	sort.Sort(volumesByDestination(volumes))
+	return volumes
+}
+
+type volumesByDestination []*structs.TaskVolume
+
+func (v volumesByDestination) Len() int           { return len(v) }
+func (v volumesByDestination) Less(i, j int) bool { return v[i].Destination < v[j].Destination }
+func (v volumesByDestination) Swap(i, j int)      { v[i], v[j] = v[j], v[i] }
+
+// mountVolume bind mounts the host volume at its destination inside the
+// root of the task
+func (e *LinuxExecutor) mountVolume(volume *structs.TaskVolume) error {
+	target := filepath.Join(e.rootDir, volume.Destination)
+	info, err := os.Stat(volume.Source)
+	if err != nil {
+		return fmt.Errorf("Couldn't stat volume source %v: %v", volume.Source, err)
+	}
+
+	// The mount point must be of the same kind as the source
+	if info.IsDir() {
+		err = os.MkdirAll(target, 0777)
+	} else if err = os.MkdirAll(filepath.Dir(target), 0777); err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(target, os.O_CREATE, 0666); err == nil {
+			f.Close()
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Couldn't create mount point %v: %v", target, err)
+	}
+
+	if err := syscall.Mount(volume.Source, target, "", syscall.MS_BIND, ""); err != nil {
+		return fmt.Errorf("Couldn't mount volume %v to %v: %v", volume.Source, target, err)
+	}
+	e.bindMounts = append(e.bindMounts, target)
+
+	// Bind mounts only become read-only once remounted
+	if volume.ReadOnly {
+		flags := uintptr(syscall.MS_BIND | syscall.MS_REMOUNT | syscall.MS_RDONLY)
+		if err := syscall.Mount("", target, "", flags, ""); err != nil {
+			return fmt.Errorf("Couldn't make volume %v read-only: %v", target, err)
+		}
+	}
 	return nil
 }
 
+// CleanTaskDir unmounts everything that was mounted into the task directory,
+// except the shared alloc dir which the AllocDir unmounts when destroyed. The
+// mounts are found by scanning the mount table so that the task directory of
+// a task started before the client restarted can be cleaned up as well.
+func CleanTaskDir(taskDir string) error {
+	mounts, err := taskDirMounts(taskDir)
+	if err != nil {
+		return err
+	}
+
+	// Unmount in reverse so nested mounts go first
+	errs := new(multierror.Error)
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(mounts[i], 0); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount (%v): %v", mounts[i], err))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// mountInfoUnescaper reverses the octal escaping of mount points in
+// /proc/self/mountinfo
+var mountInfoUnescaper = strings.NewReplacer(`\040`, " ", `\011`, "\t", `\012`, "\n", `\134`, `\`)
+
+// taskDirMounts returns the mount points within the task directory in the
+// order they were mounted, excluding the shared alloc dir and the secrets dir
+// as those are managed by the alloc dir.
+func taskDirMounts(taskDir string) ([]string, error) {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read the mount table: %v", err)
+	}
+	defer f.Close()
+
+	taskDir = filepath.Clean(taskDir)
+	shared := filepath.Join(taskDir, allocdir.SharedAllocName)
+	secrets := filepath.Join(taskDir, allocdir.TaskSecrets)
+	var mounts []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// The mount point is the fifth field
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		point := mountInfoUnescaper.Replace(fields[4])
+		if point == shared || point == secrets || !strings.HasPrefix(point, taskDir+string(filepath.Separator)) {
+			continue
+		}
+		mounts = append(mounts, point)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read the mount table: %v", err)
+	}
+	return mounts, nil
+}
+
+// ReapOrphanedCgroups kills the processes of the task cgroups that none of
+// the executor IDs reference and removes the cgroups, unmounting the chroot
+// of the task the processes ran in if it is within the alloc dir. Only the
+// unified hierarchy is scanned, as there the cgroups of the tasks are all
+// created within the same parent. On v1 they are created relative to the
+// cgroup of the client, which may have changed since they were created.
+func ReapOrphanedCgroups(allocDir string, activeIDs []string) error {
+	return reapOrphanedCgroups(cgroupMount, allocDir, activeIDs)
+}
+
+func reapOrphanedCgroups(mount, allocDir string, activeIDs []string) error {
+	if detectCgroupVersion(mount) != cgroupV2 {
+		return nil
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(mount, cgroupV2Parent))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to list the cgroups of the tasks: %v", err)
+	}
+
+	active := make(map[string]struct{}, len(activeIDs))
+	for _, id := range activeIDs {
+		if !strings.HasPrefix(id, "CGROUP:") {
+			continue
+		}
+		var groups cgroupConfig.Cgroup
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(id, "CGROUP:")), &groups); err != nil {
+			// The cgroup of an ID that can't be parsed can't be told apart
+			// from those of orphans, so none are reaped
+			return fmt.Errorf("Failed to parse the cgroup of executor %v: %v", id, err)
+		}
+		active[groups.Name] = struct{}{}
+	}
+
+	errs := new(multierror.Error)
+	for _, entry := range entries {
+		if _, ok := active[entry.Name()]; ok || !entry.IsDir() {
+			continue
+		}
+		manager := &cgroupV2Manager{dir: filepath.Join(mount, cgroupV2Parent, entry.Name())}
+		pids, err := manager.GetPids()
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+
+		// The chroot is found from the root of the processes before they
+		// are killed. The spawn-daemon itself is not chrooted.
+		taskDirs := make(map[string]struct{})
+		for _, pid := range pids {
+			if taskDir := processTaskDir(pid, allocDir); taskDir != "" {
+				taskDirs[taskDir] = struct{}{}
+			}
+			if err := syscall.Kill(pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+				errs = multierror.Append(errs, fmt.Errorf("Failed to kill Pid %v: %v", pid, err))
+			}
+		}
+		if err := manager.Destroy(); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to delete the cgroup %v: %v", manager.dir, err))
+		}
+		for taskDir := range taskDirs {
+			if err := CleanTaskDir(taskDir); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+// processTaskDir returns the task directory within the alloc dir that the
+// root of the process is in, or an empty string if it is outside of it.
+func processTaskDir(pid int, allocDir string) string {
+	root, err := os.Readlink(fmt.Sprintf("/proc/%d/root", pid))
+	if err != nil || allocDir == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(filepath.Clean(allocDir), root)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+
+	// The alloc dir holds a directory per alloc with one per task within
+	parts := strings.SplitN(rel, string(filepath.Separator), 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return filepath.Join(allocDir, parts[0], parts[1])
+}
+
 func (e *LinuxExecutor) cleanTaskDir() error {
 	if e.alloc == nil {
 		return errors.New("ConfigureTaskDir() must be called before Start()")
@@ -151,19 +403,42 @@ func (e *LinuxExecutor) cleanTaskDir() error {
 		return nil
 	}
 
-	// Unmount dev.
+	// Unmount dev and proc before the bind mounts they may be within.
 	errs := new(multierror.Error)
-	dev := filepath.Join(e.taskDir, "dev")
+
+	// Unmount dev.
+	dev := filepath.Join(e.rootDir, "dev")
 	if err := syscall.Unmount(dev, 0); err != nil {
 		errs = multierror.Append(errs, fmt.Errorf("Failed to unmount dev (%v): %v", dev, err))
 	}
 
 	// Unmount proc.
-	proc := filepath.Join(e.taskDir, "proc")
+	proc := filepath.Join(e.rootDir, "proc")
 	if err := syscall.Unmount(proc, 0); err != nil {
 		errs = multierror.Append(errs, fmt.Errorf("Failed to unmount proc (%v): %v", proc, err))
 	}
 
+	// Unmount the chroot and volumes, most recent first.
+	for i := len(e.bindMounts) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(e.bindMounts[i], 0); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount (%v): %v", e.bindMounts[i], err))
+		}
+	}
+	e.bindMounts = nil
+
+	// Unmount the image root the others were mounted within.
+	if e.overlay {
+		if err := syscall.Unmount(e.rootDir, 0); err != nil {
+			errs = multierror.Append(errs, fmt.Errorf("Failed to unmount image root (%v): %v", e.rootDir, err))
+		}
+		e.overlay = false
+	}
+
+	// Unmount the shared alloc dir so the next run mounts it again.
+	if err := e.alloc.UnmountSharedDir(e.taskName); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+
 	e.mounts = false
 	return errs.ErrorOrNil()
 }
@@ -183,14 +458,20 @@ func (e *LinuxExecutor) configureCgroups(resources *structs.Resources) {
 	//		2028
 	//   $ cat /sys/fs/cgroup/memory/user/1000.user/4.session/<uuid>/memory.limit_in_bytes
 	//		2097152
+	// On the unified hierarchy of cgroups v2 they are instead all within the
+	// same group, limited by its cpu.weight and memory.max.
 	e.groups.Name = structs.GenerateUUID()
 
 	// TODO: verify this is needed for things like network access
 	e.groups.AllowAllDevices = true
 
 	if resources.MemoryMB > 0 {
-		// Total amount of memory allowed to consume
-		e.groups.Memory = int64(resources.MemoryMB * 1024 * 1024)
+		// Total amount of memory allowed to consume, and the reservation the
+		// kernel reclaims down to under memory pressure if it can burst past
+		// it.
+		soft, hard := resources.MemoryLimits()
+		e.groups.Memory = hard
+		e.groups.MemoryReservation = soft
 		// Disable swap to avoid issues on the machine
 		e.groups.MemorySwap = int64(-1)
 	}
@@ -201,7 +482,7 @@ func (e *LinuxExecutor) configureCgroups(resources *structs.Resources) {
 		// given process will have at least that amount of resources, but likely
 		// more since it is (probably) rare that the machine will run at 100%
 		// CPU. This scale will cease to work if a node is overprovisioned.
-		e.groups.CpuShares = int64(resources.CPU)
+		e.groups.CpuShares = int64(resources.Shares())
 	}
 
 	if resources.IOPS > 0 {
@@ -237,17 +518,34 @@ func (e *LinuxExecutor) runAs(userid string) error {
 }
 
 func (e *LinuxExecutor) Start() error {
-	// Run as "nobody" user so we don't leak root privilege to the
-	// spawned process.
-	if err := e.runAs("nobody"); err == nil && e.user != nil {
-		e.cmd.SetUID(e.user.Uid)
-		e.cmd.SetGID(e.user.Gid)
-	}
-
 	if e.alloc == nil {
 		return errors.New("ConfigureTaskDir() must be called before Start()")
 	}
 
+	if e.RunAs != "" || e.RunAsGroup != "" {
+		// Run as the configured user, which must exist, owning the task
+		// directory so it can write to it. A group alone applies to nobody.
+		name := e.RunAs
+		if name == "" {
+			name = "nobody"
+		}
+		u, err := LookupTaskUser(name, e.RunAsGroup)
+		if err != nil {
+			return err
+		}
+		if err := SetTaskUser(&e.cmd.Cmd, u); err != nil {
+			return err
+		}
+		if err := e.alloc.Chown(e.taskName, u.Uid, u.Gid); err != nil {
+			return err
+		}
+	} else if err := e.runAs("nobody"); err == nil && e.user != nil {
+		// Run as "nobody" user so we don't leak root privilege to the
+		// spawned process.
+		e.cmd.SetUID(e.user.Uid)
+		e.cmd.SetGID(e.user.Gid)
+	}
+
 	// Parse the commands arguments and replace instances of Nomad environment
 	// variables.
 	envVars, err := environment.ParseFromList(e.Cmd.Env)
@@ -262,6 +560,13 @@ func (e *LinuxExecutor) Start() error {
 	}
 	e.Cmd.Args = parsed
 
+	if e.Cpuset != "" {
+		if e.groups == nil {
+			return errors.New("Pinning to CPUs requires cgroups")
+		}
+		e.groups.CpusetCpus = e.Cpuset
+	}
+
 	return e.spawnDaemon()
 }
 
@@ -280,11 +585,19 @@ func (e *LinuxExecutor) spawnDaemon() error {
 
 	c := command.DaemonConfig{
 		Cmd:        e.cmd.Cmd,
-		Chroot:     e.taskDir,
+		Chroot:     e.rootDir,
 		StdoutFile: filepath.Join(e.taskDir, allocdir.TaskLocal, fmt.Sprintf("%v.stdout", e.taskName)),
 		StderrFile: filepath.Join(e.taskDir, allocdir.TaskLocal, fmt.Sprintf("%v.stderr", e.taskName)),
 		StdinFile:  "/dev/null",
 	}
+	if e.Logs != nil {
+		c.StdoutFile = e.Logs.StdoutPath
+		c.StderrFile = e.Logs.StderrPath
+		c.MaxLogFiles = e.Logs.MaxFiles
+		c.MaxLogFileSize = e.Logs.MaxFileSize
+		c.Syslog = e.Logs.Syslog
+		c.DisableLogFiles = e.Logs.DisableFiles
+	}
 	if err := enc.Encode(c); err != nil {
 		return fmt.Errorf("Failed to serialize daemon configuration: %v", err)
 	}
@@ -311,52 +624,148 @@ func (e *LinuxExecutor) spawnDaemon() error {
 	}
 
 	if err := spawn.Start(); err != nil {
-		fmt.Errorf("Failed to call spawn-daemon on nomad executable: %v", err)
+		return fmt.Errorf("Failed to call spawn-daemon on nomad executable: %v", err)
 	}
 
 	// Join the spawn-daemon to the cgroup.
 	if e.groups != nil {
-		manager := cgroupFs.Manager{}
-		manager.Cgroups = e.groups
+		manager, err := e.cgroupManager()
+		if err != nil {
+			return e.abortSpawn(spawnStdIn, err)
+		}
 
 		// Apply will place the current pid into the tasks file for each of the
 		// created cgroups:
 		//  /sys/fs/cgroup/memory/user/1000.user/4.session/<uuid>/tasks
+		// or into the cgroup.procs file of the unified hierarchy:
+		//  /sys/fs/cgroup/nomad/<uuid>/cgroup.procs
 		//
 		// Apply requires superuser permissions, and may fail if Nomad is not run with
 		// the required permissions
 		if err := manager.Apply(spawn.Process.Pid); err != nil {
 			errs := new(multierror.Error)
-			errs = multierror.Append(errs, fmt.Errorf("Failed to join spawn-daemon to the cgroup (config => %+v): %v", manager.Cgroups, err))
+			errs = multierror.Append(errs, fmt.Errorf("Failed to join spawn-daemon to the cgroup (config => %+v): %v", e.groups, err))
 
 			if err := sendAbortCommand(spawnStdIn); err != nil {
 				errs = multierror.Append(errs, err)
 			}
 
+			if err := e.destroyCgroup(); err != nil {
+				errs = multierror.Append(errs, err)
+			}
+
 			return errs
 		}
+
+		// Record the memory cgroup while the spawn-daemon is in it
+		if e.groups.Memory > 0 {
+			path, err := manager.MemoryPath(spawn.Process.Pid)
+			if err != nil {
+				return e.abortSpawn(spawnStdIn, fmt.Errorf("Failed to find the memory cgroup: %v", err))
+			}
+			e.memoryCgroup = path
+		}
+	}
+
+	// The user command inherits the oom_score_adj of the spawn-daemon.
+	if e.oomScoreAdj != 0 {
+		if err := setOOMScoreAdj(spawn.Process.Pid, e.oomScoreAdj); err != nil {
+			return e.abortSpawn(spawnStdIn, err)
+		}
 	}
 
 	// Tell it to start.
 	if err := sendStartCommand(spawnStdIn); err != nil {
-		return err
+		return e.abortSpawn(nil, err)
 	}
 
 	// Parse the response.
 	dec := json.NewDecoder(e.spawnOutputReader)
 	var resp command.SpawnStartStatus
 	if err := dec.Decode(&resp); err != nil {
-		return fmt.Errorf("Failed to parse spawn-daemon start response: %v", err)
+		return e.abortSpawn(nil, fmt.Errorf("Failed to parse spawn-daemon start response: %v", err))
 	}
 
 	if resp.ErrorMsg != "" {
-		return fmt.Errorf("Failed to execute user command: %s", resp.ErrorMsg)
+		return e.abortSpawn(nil, fmt.Errorf("Failed to execute user command: %s", resp.ErrorMsg))
 	}
 
 	e.spawnChild = *spawn
 	return nil
 }
 
+// setOOMScoreAdj sets the oom_score_adj of the process, which its children
+// inherit.
+func setOOMScoreAdj(pid, adj int) error {
+	path := filepath.Join("/proc", strconv.Itoa(pid), "oom_score_adj")
+	if err := ioutil.WriteFile(path, []byte(strconv.Itoa(adj)), 0644); err != nil {
+		return fmt.Errorf("Failed to set the oom_score_adj to %d: %v", adj, err)
+	}
+	return nil
+}
+
+// abortSpawn cleans up after the spawn-daemon failed to start the task. If
+// stdin is given the spawn-daemon is told to abort first. The passed error is
+// returned along with any errors cleaning up.
+func (e *LinuxExecutor) abortSpawn(stdin io.Writer, err error) error {
+	errs := new(multierror.Error)
+	errs = multierror.Append(errs, err)
+	if stdin != nil {
+		if err := sendAbortCommand(stdin); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	if e.groups != nil {
+		if err := e.destroyCgroup(); err != nil {
+			errs = multierror.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// processCgroup returns the path of the cgroup of the process for the
+// subsystem, relative to the mount point of the subsystem.
+func processCgroup(pid int, subsystem string) (string, error) {
+	data, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+
+	// Lines are of the form "<id>:<subsystems>:<path>"
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		for _, s := range strings.Split(parts[1], ",") {
+			if s == subsystem {
+				return parts[2], nil
+			}
+		}
+	}
+	return "", fmt.Errorf("process %d is not in a %s cgroup", pid, subsystem)
+}
+
+// oomKilled returns whether the kernel killed a process in the memory cgroup
+// of the task for exceeding the memory limit. It must be called before the
+// cgroup is destroyed.
+func (e *LinuxExecutor) oomKilled() bool {
+	if e.memoryCgroup == "" {
+		return false
+	}
+	manager, err := e.cgroupManager()
+	if err != nil {
+		return false
+	}
+	return manager.OOMKilled(e.memoryCgroup)
+}
+
+// cgroupManager returns the manager of the cgroup of the task for the version
+// of cgroups on the host.
+func (e *LinuxExecutor) cgroupManager() (cgroupManager, error) {
+	return newCgroupManager(e.cgroupVersion, cgroupMount, e.groups)
+}
+
 func sendStartCommand(w io.Writer) error {
 	enc := json.NewEncoder(w)
 	if err := enc.Encode(true); err != nil {
@@ -415,8 +824,8 @@ func (e *LinuxExecutor) Open(id string) error {
 		if err := e.destroyCgroup(); err != nil {
 			return err
 		}
-		// TODO: cleanTaskDir is a little more complicated here because the OS
-		// may have already unmounted in the case of a restart. Need to scan.
+		// The task directory is left to the driver, which can clean it up
+		// with CleanTaskDir.
 	default:
 		return fmt.Errorf("Invalid id type: %v", parts[0])
 	}
@@ -433,8 +842,17 @@ func (e *LinuxExecutor) Wait() error {
 	defer e.spawnOutputReader.Close()
 
 	errs := new(multierror.Error)
-	if err := e.spawnChild.Wait(); err != nil {
-		errs = multierror.Append(errs, fmt.Errorf("Wait failed on pid %v: %v", e.spawnChild.Process.Pid, err))
+	waitErr := e.spawnChild.Wait()
+	if waitErr != nil {
+		errs = multierror.Append(errs, fmt.Errorf("Wait failed on pid %v: %v", e.spawnChild.Process.Pid, waitErr))
+	}
+
+	// The failure is surfaced as an OOM kill if the kernel killed the task
+	// for exceeding its memory limit. This must be checked before the cgroup
+	// is destroyed.
+	var oomErr error
+	if waitErr != nil && e.oomKilled() {
+		oomErr = &OOMKilledError{MemoryLimit: e.groups.Memory}
 	}
 
 	// If they fork/exec and then exit, wait will return but they will be still
@@ -449,6 +867,15 @@ func (e *LinuxExecutor) Wait() error {
 		errs = multierror.Append(errs, err)
 	}
 
+	if oomErr != nil {
+		return oomErr
+	}
+
+	// The spawn-daemon exits with the exit code of the task, which is
+	// returned as is so the driver can report it.
+	if _, ok := waitErr.(*exec.ExitError); ok && len(errs.Errors) == 1 {
+		return waitErr
+	}
 	return errs.ErrorOrNil()
 }
 
@@ -475,6 +902,14 @@ func (e *LinuxExecutor) ID() (string, error) {
 	return "", fmt.Errorf("Process has finished or was never started")
 }
 
+// Pid returns the PID of the spawn-daemon, which runs the user's command.
+func (e *LinuxExecutor) Pid() (int, error) {
+	if e.spawnChild.Process == nil {
+		return 0, errors.New("Process has finished or was never started")
+	}
+	return e.spawnChild.Process.Pid, nil
+}
+
 func (e *LinuxExecutor) Shutdown() error {
 	return e.ForceStop()
 }
@@ -488,11 +923,13 @@ func (e *LinuxExecutor) ForceStop() error {
 		e.spawnOutputWriter.Close()
 	}
 
-	// If the task is not running inside a cgroup then just the spawn-daemon child is killed.
-	// TODO: Find a good way to kill the children of the spawn-daemon.
+	// If the task is not running inside a cgroup then the process group of the
+	// spawn-daemon is killed. The spawn-daemon is a session leader so this
+	// includes any children the task forked.
 	if e.groups == nil {
-		if err := e.spawnChild.Process.Kill(); err != nil {
-			return fmt.Errorf("Failed to kill child (%v): %v", e.spawnChild.Process.Pid, err)
+		pid := e.spawnChild.Process.Pid
+		if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil {
+			return fmt.Errorf("Failed to kill child (%v): %v", pid, err)
 		}
 
 		return nil
@@ -512,13 +949,24 @@ func (e *LinuxExecutor) ForceStop() error {
 	return errs.ErrorOrNil()
 }
 
+// Signal sends the signal to the spawn-daemon, which forwards it to the
+// user's command.
+func (e *LinuxExecutor) Signal(sig os.Signal) error {
+	if e.spawnChild.Process == nil {
+		return errors.New("Can not find child to signal")
+	}
+	return e.spawnChild.Process.Signal(sig)
+}
+
 func (e *LinuxExecutor) destroyCgroup() error {
 	if e.groups == nil {
 		return errors.New("Can't destroy: cgroup configuration empty")
 	}
 
-	manager := cgroupFs.Manager{}
-	manager.Cgroups = e.groups
+	manager, err := e.cgroupManager()
+	if err != nil {
+		return err
+	}
 	pids, err := manager.GetPids()
 	if err != nil {
 		return fmt.Errorf("Failed to get pids in the cgroup %v: %v", e.groups.Name, err)
@@ -5,12 +5,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
 
 	ctestutil "github.com/hashicorp/nomad/client/testutil"
 )
@@ -214,3 +218,192 @@ func TestExecutorLinux_Open(t *testing.T) {
 		t.Fatalf("Stat(%v) should have failed: task not killed", filePath)
 	}
 }
+
+func TestExecutorLinux_Start_Wait_OOM(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+
+	// tail buffers its input until a newline, which /dev/zero never sends,
+	// so it grows until it is killed.
+	e := Command("/usr/bin/tail", "/dev/zero")
+
+	// This test can only be run if cgroups are enabled.
+	if !e.(*LinuxExecutor).cgroupEnabled {
+		t.SkipNow()
+	}
+
+	resources := &structs.Resources{
+		CPU:      100,
+		MemoryMB: 16,
+	}
+	if err := e.Limit(resources); err != nil {
+		t.Fatalf("Limit() failed: %v", err)
+	}
+
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+
+	if err := e.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- e.Wait()
+	}()
+
+	select {
+	case err := <-errCh:
+		oom, ok := err.(*OOMKilledError)
+		if !ok {
+			t.Fatalf("Wait() should have failed with an OOM kill; got %v", err)
+		}
+		if oom.MemoryLimit != 16*1024*1024 {
+			t.Fatalf("OOM kill reported the wrong limit: %d", oom.MemoryLimit)
+		}
+	case <-time.After(10 * time.Second):
+		e.ForceStop()
+		t.Fatalf("task was not killed at its memory limit")
+	}
+}
+
+func TestExecutorLinux_Start_MemoryLimits(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+
+	file := filepath.Join(allocdir.TaskLocal, "oom_score_adj")
+	cmd := fmt.Sprintf(`"cat /proc/self/oom_score_adj > %v; sleep 5"`, file)
+	e := Command("/bin/bash", "-c", cmd)
+
+	// This test can only be run if cgroups are enabled.
+	if !e.(*LinuxExecutor).cgroupEnabled {
+		t.SkipNow()
+	}
+
+	resources := &structs.Resources{
+		CPU:         100,
+		MemoryMB:    16,
+		MemoryMaxMB: 32,
+		OOMScoreAdj: 500,
+	}
+	if err := e.Limit(resources); err != nil {
+		t.Fatalf("Limit() failed: %v", err)
+	}
+
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+
+	if err := e.Start(); err != nil {
+		t.Fatalf("Start() failed: %v", err)
+	}
+	defer e.ForceStop()
+
+	// The reservation is the soft limit and the max the hard limit
+	memoryCgroup := e.(*LinuxExecutor).memoryCgroup
+	limits := map[string]string{
+		"memory.soft_limit_in_bytes": strconv.Itoa(16 * 1024 * 1024),
+		"memory.limit_in_bytes":      strconv.Itoa(32 * 1024 * 1024),
+	}
+	if e.(*LinuxExecutor).cgroupVersion == cgroupV2 {
+		limits = map[string]string{
+			"memory.low": strconv.Itoa(16 * 1024 * 1024),
+			"memory.max": strconv.Itoa(32 * 1024 * 1024),
+		}
+	}
+	for name, exp := range limits {
+		act, err := ioutil.ReadFile(filepath.Join(memoryCgroup, name))
+		if err != nil {
+			t.Fatalf("Couldn't read %v: %v", name, err)
+		}
+		if strings.TrimSpace(string(act)) != exp {
+			t.Fatalf("%v is %s; want %s", name, act, exp)
+		}
+	}
+
+	// The task inherited the oom_score_adj
+	path := filepath.Join(alloc.TaskDirs[task], file)
+	testutil.WaitForResult(func() (bool, error) {
+		act, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if adj := strings.TrimSpace(string(act)); adj != "500" {
+			return false, fmt.Errorf("oom_score_adj is %s; want 500", adj)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestExecutorLinux_ConfigureTaskDir_Chroot(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+	taskDir := alloc.TaskDirs[task]
+
+	e := Command("/bin/sleep", "1")
+	e.Command().ChrootEnv = map[string]string{
+		"/bin":            "/bin",
+		"/does/not/exist": "/missing",
+	}
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+	defer CleanTaskDir(taskDir)
+
+	// Only the configured directories that exist are mounted, read-only
+	mounts, err := taskDirMounts(taskDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []string{
+		filepath.Join(taskDir, "bin"),
+		filepath.Join(taskDir, "dev"),
+		filepath.Join(taskDir, "proc"),
+	}
+	if !reflect.DeepEqual(mounts, exp) {
+		t.Fatalf("got %v; want %v", mounts, exp)
+	}
+	if _, err := os.Stat(filepath.Join(taskDir, "missing")); !os.IsNotExist(err) {
+		t.Fatalf("missing directory should not be mounted: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(taskDir, "bin", "nomad-test"), nil, 0666); err == nil {
+		os.Remove("/bin/nomad-test")
+		t.Fatalf("chroot directory should be read-only")
+	}
+}
+
+func TestExecutorLinux_CleanTaskDir(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+	taskDir := alloc.TaskDirs[task]
+
+	// Mount the task directory without starting the task, as if the client
+	// had restarted while it was running
+	e := Command("/bin/sleep", "1")
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+
+	if err := CleanTaskDir(taskDir); err != nil {
+		t.Fatalf("CleanTaskDir() failed: %v", err)
+	}
+	mounts, err := taskDirMounts(taskDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Fatalf("mounts left in task directory: %v", mounts)
+	}
+
+	// The shared alloc dir is still mounted and unmounted on destroy
+	if err := alloc.Destroy(); err != nil {
+		t.Fatalf("Destroy() failed: %v", err)
+	}
+}
@@ -4,7 +4,9 @@ package executor
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"runtime"
 	"strconv"
 
 	"github.com/hashicorp/nomad/client/allocdir"
@@ -19,6 +21,14 @@ func NewExecutor() Executor {
 // any resource restrictions or runas capabilities.
 type UniversalExecutor struct {
 	cmd
+
+	// Rotated log files the output is written to, if configured.
+	stdout io.WriteCloser
+	stderr io.WriteCloser
+
+	// reattached is set when the process was found by Open rather than
+	// started by this executor.
+	reattached bool
 }
 
 func (e *UniversalExecutor) Limit(resources *structs.Resources) error {
@@ -28,14 +38,61 @@ func (e *UniversalExecutor) Limit(resources *structs.Resources) error {
 	return nil
 }
 
+// CleanTaskDir is a no-op as nothing is mounted into the task directory.
+func CleanTaskDir(taskDir string) error {
+	return nil
+}
+
+// ReapOrphanedCgroups is a no-op as tasks are not run in cgroups.
+func ReapOrphanedCgroups(allocDir string, activeIDs []string) error {
+	return nil
+}
+
 func (e *UniversalExecutor) ConfigureTaskDir(taskName string, alloc *allocdir.AllocDir) error {
-	// No-op
+	if len(e.Volumes) != 0 {
+		return fmt.Errorf("volumes are not supported on %s", runtime.GOOS)
+	}
+	if e.Image != "" {
+		return fmt.Errorf("images are not supported on %s", runtime.GOOS)
+	}
 	return nil
 }
 
 func (e *UniversalExecutor) Start() error {
+	if e.Cpuset != "" {
+		return fmt.Errorf("pinning to CPUs is not supported on %s", runtime.GOOS)
+	}
+	if e.RunAs != "" || e.RunAsGroup != "" {
+		return fmt.Errorf("running as another user is not supported on %s", runtime.GOOS)
+	}
+	if e.Logs != nil {
+		stdout, stderr, err := e.Logs.openLogs()
+		if err != nil {
+			return err
+		}
+		e.stdout, e.stderr = stdout, stderr
+		e.cmd.Stdout, e.cmd.Stderr = stdout, stderr
+	}
+
+	// Run the task in its own process group so that it can be killed along
+	// with any children it forks.
+	setProcessGroup(&e.cmd)
+
 	// We don't want to call ourself. We want to call Start on our embedded Cmd
-	return e.cmd.Start()
+	if err := e.cmd.Start(); err != nil {
+		e.closeLogs()
+		return err
+	}
+	return nil
+}
+
+func (e *UniversalExecutor) closeLogs() {
+	if e.stdout != nil {
+		e.stdout.Close()
+	}
+	if e.stderr != nil {
+		e.stderr.Close()
+	}
 }
 
 func (e *UniversalExecutor) Open(pid string) error {
@@ -49,11 +106,19 @@ func (e *UniversalExecutor) Open(pid string) error {
 		return fmt.Errorf("Failed to reopen pid %d: %v", pidNum, err)
 	}
 	e.Process = process
+	e.reattached = true
 	return nil
 }
 
 func (e *UniversalExecutor) Wait() error {
+	// A reopened process is not our child so the embedded Cmd can not wait on
+	// it.
+	if e.reattached {
+		return waitProcess(e.Process)
+	}
+
 	// We don't want to call ourself. We want to call Start on our embedded Cmd
+	defer e.closeLogs()
 	return e.cmd.Wait()
 }
 
@@ -65,12 +130,23 @@ func (e *UniversalExecutor) ID() (string, error) {
 	}
 }
 
+func (e *UniversalExecutor) Pid() (int, error) {
+	if e.cmd.Process == nil {
+		return 0, fmt.Errorf("Process has finished or was never started")
+	}
+	return e.cmd.Process.Pid, nil
+}
+
 func (e *UniversalExecutor) Shutdown() error {
 	return e.ForceStop()
 }
 
 func (e *UniversalExecutor) ForceStop() error {
-	return e.Process.Kill()
+	return killProcessGroup(e.Process)
+}
+
+func (e *UniversalExecutor) Signal(sig os.Signal) error {
+	return e.Process.Signal(sig)
 }
 
 func (e *UniversalExecutor) Command() *cmd {
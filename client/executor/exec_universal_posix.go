@@ -0,0 +1,40 @@
+// +build !linux,!windows
+
+package executor
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// reattachPollInterval is how often a reopened process is checked for exit.
+var reattachPollInterval = time.Second
+
+// setProcessGroup makes the command the leader of a new process group.
+func setProcessGroup(c *cmd) {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the process group led by the process. If the process
+// is not a group leader, only the process itself is killed.
+func killProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+	return p.Kill()
+}
+
+// waitProcess blocks until a process that is not a child of this one exits.
+// The exit status of such a process can not be retrieved.
+func waitProcess(p *os.Process) error {
+	for {
+		if err := p.Signal(syscall.Signal(0)); err != nil && err != syscall.EPERM {
+			return nil
+		}
+		time.Sleep(reattachPollInterval)
+	}
+}
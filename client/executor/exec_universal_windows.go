@@ -0,0 +1,20 @@
+package executor
+
+import (
+	"os"
+)
+
+// setProcessGroup is a no-op on Windows.
+func setProcessGroup(c *cmd) {}
+
+// killProcessGroup kills the process.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+// waitProcess blocks until the process exits. Windows allows waiting on any
+// process that could be opened.
+func waitProcess(p *os.Process) error {
+	_, err := p.Wait()
+	return err
+}
@@ -0,0 +1,174 @@
+package executor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// imageLayerDir is the directory within the task directory holding the
+// writable layer of the root filesystem when it is an overlay of the image.
+const imageLayerDir = ".rootfs-layer"
+
+// mountImage assembles the root filesystem of the task from its image. The
+// image is the read-only lower layer of an overlay whose writable upper layer
+// is in the task directory, so each run of the task starts from a clean copy
+// of the image that costs nothing to make. If overlayfs isn't available the
+// image is copied instead. The directories of the task are then bind mounted
+// into the root filesystem.
+func (e *LinuxExecutor) mountImage() error {
+	info, err := os.Stat(e.Image)
+	if err != nil {
+		return fmt.Errorf("Couldn't stat image %v: %v", e.Image, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("Image %v is not a directory", e.Image)
+	}
+
+	// Discard what a previous run of the task left behind. The removal would
+	// reach into anything still mounted there, so that is refused.
+	root := filepath.Join(e.taskDir, ImageRootDir)
+	layer := filepath.Join(e.taskDir, imageLayerDir)
+	mounts, err := taskDirMounts(e.taskDir)
+	if err != nil {
+		return err
+	}
+	for _, mount := range mounts {
+		if mount == root || strings.HasPrefix(mount, root+string(filepath.Separator)) {
+			return fmt.Errorf("Image root %v is still mounted", root)
+		}
+	}
+	upper := filepath.Join(layer, "upper")
+	work := filepath.Join(layer, "work")
+	for _, dir := range []string{root, layer} {
+		if err := os.RemoveAll(dir); err != nil {
+			return fmt.Errorf("Couldn't remove %v: %v", dir, err)
+		}
+	}
+	for _, dir := range []string{root, upper, work} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("Mkdir(%v) failed: %v", dir, err)
+		}
+	}
+
+	// The mount options can't escape separators in the paths, and the
+	// filesystem of the task directory may not support being an upper
+	// layer, in which cases the image is copied.
+	if overlaySupported() && !strings.ContainsAny(e.Image+upper+work, ",:") {
+		opts := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", e.Image, upper, work)
+		if err := syscall.Mount("overlay", root, "overlay", 0, opts); err == nil {
+			e.overlay = true
+		}
+	}
+	if !e.overlay {
+		if err := copyTree(e.Image, root); err != nil {
+			return fmt.Errorf("Couldn't copy image %v: %v", e.Image, err)
+		}
+	}
+	e.rootDir = root
+
+	for _, dir := range []string{allocdir.SharedAllocName, allocdir.TaskLocal, allocdir.TaskSecrets, allocdir.TaskTmp} {
+		volume := &structs.TaskVolume{Source: filepath.Join(e.taskDir, dir), Destination: "/" + dir}
+		if err := e.mountVolume(volume); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// overlaySupported returns whether the kernel supports overlayfs.
+func overlaySupported() bool {
+	f, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	// Lines are of the form "[nodev]\t<name>"
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 0 && fields[len(fields)-1] == "overlay" {
+			return true
+		}
+	}
+	return false
+}
+
+// copyTree copies the directories, regular files and symlinks within src into
+// dst, keeping their permissions. Other files such as devices are skipped.
+func copyTree(src, dst string) error {
+	// Directories are made writable until their contents are copied
+	var dirs []string
+	modes := make(map[string]os.FileMode)
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			if err := os.MkdirAll(target, 0700); err != nil {
+				return err
+			}
+			dirs = append(dirs, target)
+			modes[target] = mode.Perm()
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case mode.IsRegular():
+			return copyFile(path, target, mode.Perm())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chmod(dirs[i], modes[dirs[i]]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyFile copies the regular file src to dst with the permissions.
+func copyFile(src, dst string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	// The permissions given on creation are masked by the umask
+	return os.Chmod(dst, perm)
+}
@@ -0,0 +1,191 @@
+package executor
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+
+	ctestutil "github.com/hashicorp/nomad/client/testutil"
+)
+
+// testImage creates a base image holding etc/base, returning its
+// directory. The name of the directory is given as it decides whether the
+// image can be overlayed.
+func testImage(t *testing.T, parent, name string) string {
+	image := filepath.Join(parent, name)
+	if err := os.MkdirAll(filepath.Join(image, "etc"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(image, "etc", "base"), []byte("base"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return image
+}
+
+func TestCopyTree(t *testing.T) {
+	src, err := ioutil.TempDir("", "nomad-image")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(src)
+	dst, err := ioutil.TempDir("", "nomad-rootfs")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(dst)
+
+	if err := os.MkdirAll(filepath.Join(src, "usr", "bin"), 0755); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "usr", "bin", "app"), []byte("app"), 0750); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Symlink("usr/bin", filepath.Join(src, "bin")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := os.Chmod(filepath.Join(src, "usr"), 0555); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Chmod(filepath.Join(src, "usr"), 0755)
+
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.Chmod(filepath.Join(dst, "usr"), 0755)
+
+	// The files, links and permissions are copied, even within read-only
+	// directories
+	data, err := ioutil.ReadFile(filepath.Join(dst, "bin", "app"))
+	if err != nil || string(data) != "app" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "bin")); err != nil || link != "usr/bin" {
+		t.Fatalf("bad link: %q %v", link, err)
+	}
+	for path, exp := range map[string]os.FileMode{
+		"usr":         0555,
+		"usr/bin":     0755,
+		"usr/bin/app": 0750,
+	} {
+		info, err := os.Stat(filepath.Join(dst, path))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if info.Mode().Perm() != exp {
+			t.Fatalf("%s has mode %v; want %v", path, info.Mode().Perm(), exp)
+		}
+	}
+}
+
+func TestExecutorLinux_ConfigureTaskDir_Image(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	if !overlaySupported() {
+		t.Skip("overlayfs not available")
+	}
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+	taskDir := alloc.TaskDirs[task]
+	image := testImage(t, filepath.Join(taskDir, allocdir.TaskLocal), "image")
+
+	e := Command("/bin/sleep", "1")
+	e.Command().Image = image
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+	defer CleanTaskDir(taskDir)
+	le := e.(*LinuxExecutor)
+	if !le.overlay {
+		// The copy is covered by the fallback test
+		t.Skip("filesystem of the task directory can't be an upper layer")
+	}
+	root := filepath.Join(taskDir, ImageRootDir)
+	if le.rootDir != root {
+		t.Fatalf("chroot is %v; want %v", le.rootDir, root)
+	}
+
+	// The task sees the image and its own directories
+	base := filepath.Join(root, "etc", "base")
+	if data, err := ioutil.ReadFile(base); err != nil || string(data) != "base" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+	for _, dir := range []string{allocdir.SharedAllocName, allocdir.TaskLocal, allocdir.TaskSecrets, "dev", "proc"} {
+		if _, err := os.Stat(filepath.Join(root, dir)); err != nil {
+			t.Fatalf("%s not in the image root: %v", dir, err)
+		}
+	}
+
+	// Writes go to the task's layer, leaving the image as is
+	if err := ioutil.WriteFile(base, []byte("modified"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(image, "etc", "base")); err != nil || string(data) != "base" {
+		t.Fatalf("image modified: %q %v", data, err)
+	}
+
+	// Killing the task unmounts the overlay and what is within it
+	if err := le.cleanTaskDir(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	mounts, err := taskDirMounts(taskDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Fatalf("mounts left in task directory: %v", mounts)
+	}
+
+	// The next run starts from a clean copy of the image
+	e = Command("/bin/sleep", "1")
+	e.Command().Image = image
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+	if data, err := ioutil.ReadFile(base); err != nil || string(data) != "base" {
+		t.Fatalf("bad: %q %v", data, err)
+	}
+	if err := CleanTaskDir(taskDir); err != nil {
+		t.Fatalf("CleanTaskDir() failed: %v", err)
+	}
+}
+
+func TestExecutorLinux_ConfigureTaskDir_Image_Copy(t *testing.T) {
+	ctestutil.ExecCompatible(t)
+	task, alloc := mockAllocDir(t)
+	defer alloc.Destroy()
+	taskDir := alloc.TaskDirs[task]
+
+	// Separators in the path can't be passed to overlayfs, so the image is
+	// copied as it would be without overlayfs
+	image := testImage(t, filepath.Join(taskDir, allocdir.TaskLocal), "image:copy")
+	e := Command("/bin/sleep", "1")
+	e.Command().Image = image
+	if err := e.ConfigureTaskDir(task, alloc); err != nil {
+		t.Fatalf("ConfigureTaskDir(%v, %v) failed: %v", task, alloc, err)
+	}
+	defer CleanTaskDir(taskDir)
+	if e.(*LinuxExecutor).overlay {
+		t.Fatalf("image should have been copied")
+	}
+
+	base := filepath.Join(taskDir, ImageRootDir, "etc", "base")
+	if err := ioutil.WriteFile(base, []byte("modified"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(image, "etc", "base")); err != nil || string(data) != "base" {
+		t.Fatalf("image modified: %q %v", data, err)
+	}
+
+	if err := CleanTaskDir(taskDir); err != nil {
+		t.Fatalf("CleanTaskDir() failed: %v", err)
+	}
+	mounts, err := taskDirMounts(taskDir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(mounts) != 0 {
+		t.Fatalf("mounts left in task directory: %v", mounts)
+	}
+}
@@ -4,10 +4,21 @@ package executor
 
 import (
 	"fmt"
+	"os/exec"
 	"strconv"
 	"syscall"
 )
 
+// SetTaskUser makes the command setuid and setgid to the user before it is
+// exec'd, dropping any supplementary groups.
+func SetTaskUser(c *exec.Cmd, u *TaskUser) error {
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(u.Uid), Gid: uint32(u.Gid)}
+	return nil
+}
+
 // SetUID changes the Uid for this command (must be set before starting)
 func (c *cmd) SetUID(userid string) error {
 	uid, err := strconv.ParseUint(userid, 10, 32)
@@ -1,5 +1,16 @@
 package executor
 
+import (
+	"errors"
+	"os/exec"
+)
+
+// SetTaskUser is not supported as Windows processes can't be started as
+// another user without their credentials.
+func SetTaskUser(c *exec.Cmd, u *TaskUser) error {
+	return errors.New("running tasks as another user is not supported on windows")
+}
+
 // SetUID changes the Uid for this command (must be set before starting)
 func (c *cmd) SetUID(userid string) error {
 	// TODO implement something for windows
@@ -0,0 +1,60 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+)
+
+// TaskUser is the user and group a task runs as.
+type TaskUser struct {
+	Uid int
+	Gid int
+}
+
+// LookupTaskUser resolves the user and group, each given by name or id, to
+// their ids on the host. The group defaults to the primary group of the user
+// and the user to the one running the client. An error is returned if either
+// doesn't exist.
+func LookupTaskUser(userName, groupName string) (*TaskUser, error) {
+	u := &TaskUser{Uid: os.Getuid(), Gid: os.Getgid()}
+	if userName != "" {
+		found, err := lookupUser(userName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to identify user to run as: %v", err)
+		}
+		if u.Uid, err = strconv.Atoi(found.Uid); err != nil {
+			return nil, fmt.Errorf("Unable to convert Uid of user %v to an int: %v", userName, err)
+		}
+		if u.Gid, err = strconv.Atoi(found.Gid); err != nil {
+			return nil, fmt.Errorf("Unable to convert Gid of user %v to an int: %v", userName, err)
+		}
+	}
+	if groupName != "" {
+		found, err := lookupGroup(groupName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to identify group to run as: %v", err)
+		}
+		if u.Gid, err = strconv.Atoi(found.Gid); err != nil {
+			return nil, fmt.Errorf("Unable to convert Gid of group %v to an int: %v", groupName, err)
+		}
+	}
+	return u, nil
+}
+
+// lookupUser finds the user by uid, and then by name.
+func lookupUser(name string) (*user.User, error) {
+	if u, err := user.LookupId(name); err == nil {
+		return u, nil
+	}
+	return user.Lookup(name)
+}
+
+// lookupGroup finds the group by gid, and then by name.
+func lookupGroup(name string) (*user.Group, error) {
+	if g, err := user.LookupGroupId(name); err == nil {
+		return g, nil
+	}
+	return user.LookupGroup(name)
+}
@@ -0,0 +1,31 @@
+package executor
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestLookupTaskUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Windows has no uids")
+	}
+
+	// Users and groups are found by name and by id
+	for _, name := range []string{"root", "0"} {
+		u, err := LookupTaskUser(name, name)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if u.Uid != 0 || u.Gid != 0 {
+			t.Fatalf("bad user for %s: %#v", name, u)
+		}
+	}
+
+	if _, err := LookupTaskUser("nomad-no-such-user", ""); err == nil || !strings.Contains(err.Error(), "Failed to identify user") {
+		t.Fatalf("expected unknown user error: %v", err)
+	}
+	if _, err := LookupTaskUser("", "nomad-no-such-group"); err == nil || !strings.Contains(err.Error(), "Failed to identify group") {
+		t.Fatalf("expected unknown group error: %v", err)
+	}
+}
@@ -23,6 +23,7 @@ func TestNetworkFingerprint_basic(t *testing.T) {
 	}
 
 	assertNodeAttributeContains(t, node, "network.ip-address")
+	assertNodeAttributeContains(t, node, "network.interface")
 
 	ip := node.Attributes["network.ip-address"]
 	match := net.ParseIP(ip)
@@ -10,7 +10,6 @@ import (
 	"os"
 	"os/exec"
 	"regexp"
-	"runtime"
 	"strconv"
 	"strings"
 
@@ -31,25 +30,29 @@ func NewNetworkFingerprinter(logger *log.Logger) Fingerprint {
 }
 
 func (f *NetworkFingerprint) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
-	// newNetwork is populated and addded to the Nodes resources
-	newNetwork := &structs.NetworkResource{}
-
-	// eth0 is the default device for Linux, and en0 is default for OS X
-	defaultDevice := "eth0"
-	if "darwin" == runtime.GOOS {
-		defaultDevice = "en0"
+	// Use the configured interface, or else the one with the default route
+	device := cfg.Read("network.interface")
+	if device == "" {
+		device = defaultRouteInterface()
+	}
+	intf, ip, err := primaryInterface(device)
+	if err != nil {
+		f.logger.Printf("[WARN] fingerprint.network: %s", err)
+		return false, nil
 	}
 
-	newNetwork.Device = defaultDevice
-
-	if ip := f.ifConfig(defaultDevice); ip != "" {
-		node.Attributes["network.ip-address"] = ip
-		newNetwork.IP = ip
-		newNetwork.CIDR = newNetwork.IP + "/32"
+	// newNetwork is populated and addded to the Nodes resources
+	newNetwork := &structs.NetworkResource{
+		Device: intf.Name,
+		IP:     ip.String(),
+		CIDR:   ip.String() + "/32",
 	}
+	node.Attributes["network.interface"] = intf.Name
+	node.Attributes["network.ip-address"] = newNetwork.IP
 
-	if throughput := f.linkSpeed("eth0"); throughput > 0 {
+	if throughput := f.linkSpeed(intf.Name); throughput > 0 {
 		newNetwork.MBits = throughput
+		node.Attributes["network.speed"] = strconv.Itoa(throughput)
 	}
 
 	if node.Resources == nil {
@@ -62,6 +65,87 @@ func (f *NetworkFingerprint) Fingerprint(cfg *config.Config, node *structs.Node)
 	return true, nil
 }
 
+// defaultRouteInterface returns the interface of the default IPv4 route, or
+// an empty string if it can not be determined, as on OS X
+func defaultRouteInterface() string {
+	content, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	return parseDefaultRoute(string(content))
+}
+
+// parseDefaultRoute returns the interface of the default route in the
+// contents of /proc/net/route, whose destination is 00000000
+func parseDefaultRoute(content string) string {
+	for _, line := range strings.Split(content, "\n")[1:] {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
+
+// primaryInterface returns the named interface and its IPv4 address. If no
+// name is given, the first interface that is up and has a routable IPv4
+// address is returned.
+func primaryInterface(name string) (*net.Interface, net.IP, error) {
+	if name != "" {
+		intf, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find interface %s: %v", name, err)
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read addresses of interface %s: %v", name, err)
+		}
+		ip := interfaceIPv4(addrs)
+		if ip == nil {
+			return nil, nil, fmt.Errorf("interface %s has no IPv4 address", name)
+		}
+		return intf, ip, nil
+	}
+
+	intfs, err := net.Interfaces()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list interfaces: %v", err)
+	}
+	for i := range intfs {
+		intf := &intfs[i]
+		if intf.Flags&net.FlagUp == 0 || intf.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := intf.Addrs()
+		if err != nil {
+			continue
+		}
+		if ip := interfaceIPv4(addrs); ip != nil {
+			return intf, ip, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("no interface with an IPv4 address found")
+}
+
+// interfaceIPv4 returns the first IPv4 address that is neither loopback nor
+// link-local, or nil if there is none
+func interfaceIPv4(addrs []net.Addr) net.IP {
+	for _, addr := range addrs {
+		var ip net.IP
+		switch v := addr.(type) {
+		case *net.IPNet:
+			ip = v.IP
+		case *net.IPAddr:
+			ip = v.IP
+		}
+		if ip = ip.To4(); ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+			continue
+		}
+		return ip
+	}
+	return nil
+}
+
 // LinkSpeed attempts to determine link speed, first by checking if any tools
 // exist that can return the speed (ethtool for now). If no tools are found,
 // fall back to /sys/class/net speed file, if it exists.
@@ -148,46 +232,3 @@ func (f *NetworkFingerprint) linkSpeedEthtool(path, device string) int {
 	f.logger.Printf("[ERR] fingerprint.network: Error calling ethtool (%s): %s", path, err)
 	return 0
 }
-
-// ifConfig returns the IP Address for this node according to ifConfig, for the
-// specified device.
-func (f *NetworkFingerprint) ifConfig(device string) string {
-	ifConfigPath, _ := exec.LookPath("ifconfig")
-	if ifConfigPath != "" {
-		outBytes, err := exec.Command(ifConfigPath, device).Output()
-		if err == nil {
-			// Parse out the IP address returned from ifconfig for this device
-			// Tested on Ubuntu, the matching part of ifconfig output for eth0 is like
-			// so:
-			//   inet addr:10.0.2.15  Bcast:10.0.2.255  Mask:255.255.255.0
-			// For OS X and en0, we have:
-			//  inet 192.168.0.7 netmask 0xffffff00 broadcast 192.168.0.255
-			output := strings.TrimSpace(string(outBytes))
-
-			// re is a regular expression, which can vary based on the OS
-			var re *regexp.Regexp
-
-			if "darwin" == runtime.GOOS {
-				re = regexp.MustCompile("inet [0-9].+")
-			} else {
-				re = regexp.MustCompile("inet addr:[0-9].+")
-			}
-			args := strings.Split(re.FindString(output), " ")
-
-			var ip string
-			if len(args) > 1 {
-				ip = strings.TrimPrefix(args[1], "addr:")
-			}
-
-			// validate what we've sliced out is a valid IP
-			if net.ParseIP(ip) != nil {
-				return ip
-			}
-		}
-		f.logger.Printf("[ERR] fingerprint.network: Error calling ifconfig (%s): %s", ifConfigPath, err)
-		return ""
-	}
-
-	f.logger.Println("[WARN] fingerprint.network: Ethtool not found")
-	return ""
-}
@@ -0,0 +1,68 @@
+// +build linux darwin
+
+package fingerprint
+
+import (
+	"net"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestNetworkFingerprint_Interface(t *testing.T) {
+	f := NewNetworkFingerprinter(testLogger())
+
+	// The configured interface must exist
+	cfg := &config.Config{Options: map[string]string{"network.interface": "nomad-missing0"}}
+	node := &structs.Node{Attributes: make(map[string]string)}
+	if ok, err := f.Fingerprint(cfg, node); err != nil || ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+
+	// Configuring the detected interface finds the same address
+	node = &structs.Node{Attributes: make(map[string]string)}
+	if ok, err := f.Fingerprint(&config.Config{}, node); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	name := node.Attributes["network.interface"]
+	cfg.Options["network.interface"] = name
+	node2 := &structs.Node{Attributes: make(map[string]string)}
+	if ok, err := f.Fingerprint(cfg, node2); err != nil || !ok {
+		t.Fatalf("bad: %v %v", ok, err)
+	}
+	if node2.Attributes["network.ip-address"] != node.Attributes["network.ip-address"] ||
+		node2.Resources.Networks[0].Device != name {
+		t.Fatalf("bad: %#v", node2.Attributes)
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	content := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+enp3s0	00000000	0102A8C0	0003	0	0	100	00000000	0	0	0
+enp3s0	0002A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+`
+	if iface := parseDefaultRoute(content); iface != "enp3s0" {
+		t.Fatalf("bad: %q", iface)
+	}
+	if iface := parseDefaultRoute("Iface\tDestination\n"); iface != "" {
+		t.Fatalf("bad: %q", iface)
+	}
+}
+
+func TestInterfaceIPv4(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.1/8")
+	addrs := []net.Addr{
+		loopback,
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("169.254.1.1"), Mask: net.CIDRMask(16, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.2.15"), Mask: net.CIDRMask(24, 32)},
+	}
+	if ip := interfaceIPv4(addrs); !ip.Equal(net.ParseIP("10.0.2.15")) {
+		t.Fatalf("bad: %v", ip)
+	}
+	if ip := interfaceIPv4(addrs[:3]); ip != nil {
+		t.Fatalf("bad: %v", ip)
+	}
+}
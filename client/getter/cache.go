@@ -0,0 +1,211 @@
+package getter
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// cacheTmpSuffix is the suffix of the files being downloaded into the cache
+const cacheTmpSuffix = ".tmp"
+
+// Cache keeps downloaded artifacts by their checksum, so an artifact fetched
+// by many tasks is only downloaded once.
+type Cache interface {
+	// Fetch returns the path of the file cached for the checksum, such as
+	// "sha256:<digest>", and a func releasing it once it is no longer read,
+	// until which it is not evicted. On a miss download is called to write
+	// the file to the path it is given. Concurrent fetches of a checksum
+	// share a single download, and its error. Closing abortCh stops waiting
+	// for the download of another fetch, returning ErrAborted.
+	Fetch(checksum string, download func(path string) error, abortCh <-chan struct{}) (string, func(), error)
+}
+
+// lruCache is a Cache of the files in a directory, evicting the least
+// recently used files that no fetch is reading once they add up to more than
+// the maximum size. Files cached before a restart are kept, ordered by when
+// they were downloaded.
+type lruCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	entries map[string]*cacheEntry
+	size    int64
+
+	// clock orders the uses of the entries
+	clock uint64
+}
+
+// cacheEntry is a file of the cache. doneCh is closed once it is
+// downloaded, with err set if that failed.
+type cacheEntry struct {
+	name  string
+	size  int64
+	used  uint64
+	refs  int
+	ready bool
+
+	doneCh chan struct{}
+	err    error
+}
+
+// NewCache returns a cache of the files in dir, which is created if needed,
+// holding up to maxSize bytes of files that are not being read
+func NewCache(dir string, maxSize int64) (Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create artifact cache: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read artifact cache: %v", err)
+	}
+	sort.Sort(byModTime(files))
+
+	c := &lruCache{dir: dir, maxSize: maxSize, entries: make(map[string]*cacheEntry)}
+	for _, fi := range files {
+		// Downloads interrupted by a restart are discarded
+		if !fi.Mode().IsRegular() || strings.HasSuffix(fi.Name(), cacheTmpSuffix) {
+			os.RemoveAll(filepath.Join(dir, fi.Name()))
+			continue
+		}
+		c.clock++
+		e := &cacheEntry{name: fi.Name(), size: fi.Size(), used: c.clock, ready: true, doneCh: make(chan struct{})}
+		close(e.doneCh)
+		c.entries[e.name] = e
+		c.size += e.size
+	}
+	c.evict()
+	return c, nil
+}
+
+func (c *lruCache) Fetch(checksum string, download func(path string) error, abortCh <-chan struct{}) (string, func(), error) {
+	name, err := cacheName(checksum)
+	if err != nil {
+		return "", nil, err
+	}
+
+	c.lock.Lock()
+	e, ok := c.entries[name]
+	if !ok {
+		e = &cacheEntry{name: name, doneCh: make(chan struct{})}
+		c.entries[name] = e
+	}
+	e.refs++
+	c.clock++
+	e.used = c.clock
+	c.lock.Unlock()
+
+	if !ok {
+		c.download(e, download)
+	} else {
+		select {
+		case <-e.doneCh:
+		case <-abortCh:
+			c.release(e)
+			return "", nil, ErrAborted
+		}
+	}
+	if e.err != nil {
+		c.release(e)
+		return "", nil, e.err
+	}
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() { c.release(e) })
+	}
+	return filepath.Join(c.dir, name), release, nil
+}
+
+// download downloads the file of the entry into a temporary file it is then
+// renamed from. A failed download is not cached, so the next fetch tries
+// again.
+func (c *lruCache) download(e *cacheEntry, download func(path string) error) {
+	path := filepath.Join(c.dir, e.name)
+	tmp := path + cacheTmpSuffix
+	err := download(tmp)
+	var fi os.FileInfo
+	if err == nil {
+		fi, err = os.Stat(tmp)
+	}
+	if err == nil {
+		// Cached files are linked into the tasks, which must not modify them
+		err = os.Chmod(tmp, 0555)
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.err = err
+	if err != nil {
+		delete(c.entries, e.name)
+	} else {
+		e.size = fi.Size()
+		e.ready = true
+		c.size += e.size
+		c.evict()
+	}
+	close(e.doneCh)
+}
+
+// release ends a fetch of the entry, evicting files if the cache is over
+// its size now that the entry may be
+func (c *lruCache) release(e *cacheEntry) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	e.refs--
+	c.evict()
+}
+
+// evict removes the least recently used files no fetch is reading until the
+// cache is within its size. The lock must be held.
+func (c *lruCache) evict() {
+	for c.size > c.maxSize {
+		var victim *cacheEntry
+		for _, e := range c.entries {
+			if e.ready && e.refs == 0 && (victim == nil || e.used < victim.used) {
+				victim = e
+			}
+		}
+		if victim == nil {
+			return
+		}
+		os.Remove(filepath.Join(c.dir, victim.name))
+		delete(c.entries, victim.name)
+		c.size -= victim.size
+	}
+}
+
+// cacheName returns the file name of the checksum in the cache, which is
+// made of the hash type and the hex digest
+func cacheName(checksum string) (string, error) {
+	parts := strings.SplitN(checksum, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid checksum '%s'", checksum)
+	}
+	for _, part := range parts {
+		for _, r := range part {
+			if !('a' <= r && r <= 'z' || '0' <= r && r <= '9') {
+				return "", fmt.Errorf("invalid checksum '%s'", checksum)
+			}
+		}
+	}
+	return parts[0] + "-" + parts[1], nil
+}
+
+// byModTime sorts files from the least recently modified
+type byModTime []os.FileInfo
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
@@ -0,0 +1,234 @@
+package getter
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testCache(t *testing.T, maxSize int64) (*lruCache, string) {
+	dir := testTaskDir(t)
+	cache, err := NewCache(filepath.Join(dir, "cache"), maxSize)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return cache.(*lruCache), dir
+}
+
+// writeDownload returns a download writing the contents, counting its calls
+func writeDownload(contents string, calls *int32) func(string) error {
+	return func(path string) error {
+		atomic.AddInt32(calls, 1)
+		return ioutil.WriteFile(path, []byte(contents), 0644)
+	}
+}
+
+// cached returns whether the cache holds a file for the checksum
+func cached(c *lruCache, checksum string) bool {
+	name, _ := cacheName(checksum)
+	_, err := os.Stat(filepath.Join(c.dir, name))
+	return err == nil
+}
+
+func TestCache_HitMiss(t *testing.T) {
+	c, dir := testCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	// A miss downloads the file, and a hit reads it from the cache
+	var calls int32
+	for i := 0; i < 2; i++ {
+		path, release, err := c.Fetch("sha256:aa", writeDownload("hello", &calls), nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if act := readFile(t, path); act != "hello" {
+			t.Fatalf("bad: %q", act)
+		}
+		release()
+		release()
+	}
+	if calls != 1 {
+		t.Fatalf("downloaded %d times", calls)
+	}
+
+	// A failed download is not cached
+	if _, _, err := c.Fetch("sha256:bb", func(string) error { return errors.New("boom") }, nil); err == nil {
+		t.Fatalf("expected error")
+	}
+	if cached(c, "sha256:bb") {
+		t.Fatalf("failed download cached")
+	}
+	if _, release, err := c.Fetch("sha256:bb", writeDownload("world", &calls), nil); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		release()
+	}
+
+	// Checksums that aren't a hash type and digest are refused
+	for _, checksum := range []string{"", "sha256", "sha256:", "sha256:../../etc", "SHA256:aa"} {
+		if _, _, err := c.Fetch(checksum, writeDownload("x", &calls), nil); err == nil {
+			t.Fatalf("expected error for %q", checksum)
+		}
+	}
+}
+
+func TestCache_Coalesce(t *testing.T) {
+	c, dir := testCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	// Concurrent fetches of a checksum share one download
+	var calls int32
+	startCh := make(chan struct{})
+	download := func(path string) error {
+		atomic.AddInt32(&calls, 1)
+		<-startCh
+		return ioutil.WriteFile(path, []byte("hello"), 0644)
+	}
+	var wg sync.WaitGroup
+	errCh := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path, release, err := c.Fetch("sha256:aa", download, nil)
+			if err == nil {
+				defer release()
+				if data, _ := ioutil.ReadFile(path); string(data) != "hello" {
+					err = errors.New("bad contents: " + string(data))
+				}
+			}
+			errCh <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(startCh)
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("downloaded %d times", calls)
+	}
+}
+
+func TestCache_Coalesce_Abort(t *testing.T) {
+	c, dir := testCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	startCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		_, release, err := c.Fetch("sha256:aa", func(path string) error {
+			<-startCh
+			return ioutil.WriteFile(path, []byte("hello"), 0644)
+		}, nil)
+		if err == nil {
+			release()
+		}
+		errCh <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	// Waiting for the download of another fetch can be aborted
+	abortCh := make(chan struct{})
+	close(abortCh)
+	var calls int32
+	if _, _, err := c.Fetch("sha256:aa", writeDownload("x", &calls), abortCh); err != ErrAborted {
+		t.Fatalf("got %v; want ErrAborted", err)
+	}
+	close(startCh)
+	if err := <-errCh; err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if calls != 0 {
+		t.Fatalf("downloaded %d times", calls)
+	}
+}
+
+func TestCache_Evict(t *testing.T) {
+	c, dir := testCache(t, 10)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	fetch := func(checksum string) func() {
+		_, release, err := c.Fetch(checksum, writeDownload("12345", &calls), nil)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		return release
+	}
+	fetch("sha256:aa")()
+	fetch("sha256:bb")()
+	fetch("sha256:aa")()
+
+	// Going over the size evicts the least recently used file
+	fetch("sha256:cc")()
+	if !cached(c, "sha256:aa") || cached(c, "sha256:bb") || !cached(c, "sha256:cc") {
+		t.Fatalf("bad eviction")
+	}
+
+	// Files being read are kept until they are released, even if the cache
+	// is over its size meanwhile
+	releaseA := fetch("sha256:aa")
+	releaseD := fetch("sha256:dd")
+	releaseE := fetch("sha256:ee")
+	if !cached(c, "sha256:aa") || cached(c, "sha256:cc") || !cached(c, "sha256:dd") || !cached(c, "sha256:ee") {
+		t.Fatalf("bad eviction")
+	}
+	releaseA()
+	if cached(c, "sha256:aa") || !cached(c, "sha256:dd") || !cached(c, "sha256:ee") {
+		t.Fatalf("bad eviction")
+	}
+	releaseD()
+	releaseE()
+	if c.size != 10 {
+		t.Fatalf("cache size is %d", c.size)
+	}
+}
+
+func TestCache_Restore(t *testing.T) {
+	c, dir := testCache(t, 1024)
+	defer os.RemoveAll(dir)
+
+	var calls int32
+	if _, release, err := c.Fetch("sha256:aa", writeDownload("hello", &calls), nil); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		release()
+	}
+	if err := ioutil.WriteFile(filepath.Join(c.dir, "sha256-bb"+cacheTmpSuffix), []byte("partial"), 0644); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The files cached before a restart are kept, and partial ones dropped
+	cache, err := NewCache(c.dir, 1024)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, release, err := cache.Fetch("sha256:aa", writeDownload("hello", &calls), nil); err != nil {
+		t.Fatalf("err: %v", err)
+	} else {
+		release()
+	}
+	if calls != 1 {
+		t.Fatalf("downloaded %d times", calls)
+	}
+	files, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, fi := range files {
+		if strings.HasSuffix(fi.Name(), cacheTmpSuffix) {
+			t.Fatalf("partial download kept: %s", fi.Name())
+		}
+	}
+}
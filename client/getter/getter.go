@@ -0,0 +1,433 @@
+// Package getter is used to download the artifacts of a task.
+package getter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+var (
+	// retryAttempts is the number of times a download is attempted before
+	// giving up on transient errors
+	retryAttempts = 3
+
+	// retryBackoff is the wait before the first retry, doubling on each
+	// subsequent one
+	retryBackoff = time.Second
+
+	// ErrAborted is returned if the download was aborted
+	ErrAborted = errors.New("artifact download aborted")
+)
+
+// transientError wraps errors that may succeed on retry
+type transientError struct {
+	error
+}
+
+// Options tune the download of an artifact
+type Options struct {
+	// RateLimiter, if set, bounds the bandwidth of the download. It may be
+	// shared with concurrent downloads.
+	RateLimiter RateLimiter
+
+	// Logger, if set, is given the progress of long downloads
+	Logger *log.Logger
+
+	// Cache, if set, keeps artifacts that have a checksum so they are only
+	// downloaded once. It may be shared with concurrent downloads.
+	Cache Cache
+}
+
+// GetArtifact downloads the artifact into its destination inside the task
+// directory. The checksum of the artifact is verified if set, archives are
+// extracted and other files are made executable. Transient failures such as
+// network and server errors are retried with backoff. Closing abortCh aborts
+// the download, in which case ErrAborted is returned.
+func GetArtifact(artifact *structs.TaskArtifact, taskDir string, abortCh <-chan struct{}) error {
+	return GetArtifactWithOptions(artifact, taskDir, abortCh, nil)
+}
+
+// GetArtifactWithOptions is GetArtifact tuned by the options, which may be
+// nil.
+func GetArtifactWithOptions(artifact *structs.TaskArtifact, taskDir string, abortCh <-chan struct{}, opts *Options) error {
+	if opts == nil {
+		opts = &Options{}
+	}
+	dest, err := destDir(taskDir, artifact.Destination)
+	if err != nil {
+		return err
+	}
+	name, err := artifactName(artifact.Source)
+	if err != nil {
+		return err
+	}
+	_, expected, err := checksum(artifact.Checksum)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dest, 0777); err != nil {
+		return fmt.Errorf("failed to create artifact destination: %v", err)
+	}
+
+	if opts.Cache != nil && artifact.Checksum != "" {
+		path, release, err := fetchCached(artifact, expected, abortCh, opts)
+		if err != nil {
+			return err
+		}
+		defer release()
+		return install(path, name, dest, true)
+	}
+
+	// Download into a temporary file next to the destination
+	tmp, err := ioutil.TempFile(dest, ".artifact")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+	if err := downloadWithRetry(artifact, tmp.Name(), abortCh, opts); err != nil {
+		return err
+	}
+	return install(tmp.Name(), name, dest, false)
+}
+
+// fetchCached returns the cached file of the artifact, downloading it on a
+// miss. A download shared with a fetch that was aborted is tried again.
+func fetchCached(artifact *structs.TaskArtifact, digest string, abortCh <-chan struct{}, opts *Options) (string, func(), error) {
+	key := strings.SplitN(artifact.Checksum, ":", 2)[0] + ":" + digest
+	for {
+		path, release, err := opts.Cache.Fetch(key, func(path string) error {
+			return downloadWithRetry(artifact, path, abortCh, opts)
+		}, abortCh)
+		if err == ErrAborted && !aborted(abortCh) {
+			continue
+		}
+		return path, release, err
+	}
+}
+
+// downloadWithRetry downloads the artifact to path, retrying transient
+// failures with backoff
+func downloadWithRetry(artifact *structs.TaskArtifact, path string, abortCh <-chan struct{}, opts *Options) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := download(artifact, path, abortCh, opts)
+		if err == nil {
+			return nil
+		}
+
+		terr, ok := err.(transientError)
+		if !ok {
+			return err
+		}
+		if attempt >= retryAttempts {
+			return terr.error
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-abortCh:
+			return ErrAborted
+		}
+		backoff *= 2
+	}
+}
+
+// destDir returns the directory the artifact is placed in, making sure it is
+// inside the task directory.
+func destDir(taskDir, dest string) (string, error) {
+	if dest == "" {
+		dest = allocdir.TaskLocal
+	}
+	if filepath.IsAbs(dest) {
+		return "", fmt.Errorf("artifact destination '%s' must be relative to the task directory", dest)
+	}
+
+	dir := filepath.Join(taskDir, dest)
+	if !withinDir(taskDir, dir) {
+		return "", fmt.Errorf("artifact destination '%s' escapes the task directory", dest)
+	}
+	return dir, nil
+}
+
+// artifactName returns the file name of the artifact at the source
+func artifactName(source string) (string, error) {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact source: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("unsupported artifact source '%s'", source)
+	}
+	name := path.Base(u.Path)
+	if name == "." || name == "/" {
+		return "", fmt.Errorf("unable to determine the file name of artifact '%s'", source)
+	}
+	return name, nil
+}
+
+// download makes a single attempt at fetching the artifact into the file at
+// path, verifying its checksum.
+func download(artifact *structs.TaskArtifact, path string, abortCh <-chan struct{}, opts *Options) error {
+	h, expected, err := checksum(artifact.Checksum)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", artifact.Source, nil)
+	if err != nil {
+		return err
+	}
+	req.Cancel = abortCh
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		if aborted(abortCh) {
+			return ErrAborted
+		}
+		return transientError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("unexpected response code %d", resp.StatusCode)
+		if resp.StatusCode >= 500 || resp.StatusCode == 429 {
+			return transientError{err}
+		}
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	var w io.Writer = f
+	if h != nil {
+		w = io.MultiWriter(f, h)
+	}
+	var body io.Reader = resp.Body
+	if opts.RateLimiter != nil {
+		body = &rateLimitedReader{r: body, limiter: opts.RateLimiter, abortCh: abortCh}
+	}
+	if opts.Logger != nil {
+		body = newProgressReader(body, artifact.Source, resp.ContentLength, opts.Logger)
+	}
+	_, err = io.Copy(w, body)
+	f.Close()
+	if err != nil {
+		if aborted(abortCh) {
+			return ErrAborted
+		}
+		return transientError{err}
+	}
+
+	if h != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("checksum mismatch: expected %s, got %s", expected, actual)
+		}
+	}
+	return nil
+}
+
+// install places the downloaded file of the artifact into dest, extracting
+// archives. Other files are made executable and moved into dest, or linked
+// if they are cached, falling back to a copy where the cache is on another
+// device.
+func install(file, name, dest string, cached bool) error {
+	switch {
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return extractTarGz(file, dest)
+	case strings.HasSuffix(name, ".zip"):
+		return extractZip(file, dest)
+	}
+
+	target := filepath.Join(dest, name)
+	if !cached {
+		if err := os.Chmod(file, 0755); err != nil {
+			return err
+		}
+		return os.Rename(file, target)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Link(file, target); err == nil {
+		return nil
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFile(target, f, 0755)
+}
+
+// checksum returns the hash and expected digest for the checksum of an
+// artifact, or a nil hash if there is none.
+func checksum(raw string) (hash.Hash, string, error) {
+	if raw == "" {
+		return nil, "", nil
+	}
+
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) != 2 {
+		return nil, "", fmt.Errorf("invalid checksum '%s'", raw)
+	}
+	expected := strings.ToLower(parts[1])
+	switch parts[0] {
+	case "sha256":
+		return sha256.New(), expected, nil
+	case "sha512":
+		return sha512.New(), expected, nil
+	default:
+		return nil, "", fmt.Errorf("unsupported checksum type '%s'", parts[0])
+	}
+}
+
+// extractTarGz extracts the directories and regular files of the archive
+// into dest.
+func extractTarGz(archive, dest string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+
+		target, err := archivePath(dest, hdr.Name)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			if err := writeFile(target, tr, os.FileMode(hdr.Mode).Perm()); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// extractZip extracts the directories and regular files of the archive into
+// dest.
+func extractZip(archive, dest string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+	defer zr.Close()
+
+	for _, f := range zr.File {
+		target, err := archivePath(dest, f.Name)
+		if err != nil {
+			return err
+		}
+
+		fi := f.FileInfo()
+		if fi.IsDir() {
+			if err := os.MkdirAll(target, 0777); err != nil {
+				return err
+			}
+			continue
+		}
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %v", err)
+		}
+		err = writeFile(target, rc, fi.Mode().Perm())
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archivePath returns where an archive entry is extracted to, rejecting
+// entries that would be placed outside of dest.
+func archivePath(dest, name string) (string, error) {
+	target := filepath.Join(dest, name)
+	if !withinDir(dest, target) {
+		return "", fmt.Errorf("archive entry '%s' escapes the destination", name)
+	}
+	return target, nil
+}
+
+// writeFile writes the contents of r to path, creating its parents.
+func writeFile(path string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// withinDir returns if the path is the directory or inside of it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// aborted returns if the abort channel has been closed.
+func aborted(abortCh <-chan struct{}) bool {
+	select {
+	case <-abortCh:
+		return true
+	default:
+		return false
+	}
+}
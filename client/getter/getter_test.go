@@ -0,0 +1,328 @@
+package getter
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func init() {
+	retryBackoff = 10 * time.Millisecond
+}
+
+// testServer serves the given files, keyed by path
+func testServer(files map[string][]byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+}
+
+func testTaskDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return dir
+}
+
+func sha256Sum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func readFile(t *testing.T, path string) string {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(data)
+}
+
+func TestGetArtifact_Checksum(t *testing.T) {
+	good := []byte("#!/bin/sh\necho hello\n")
+	corrupt := []byte("#!/bin/sh\necho h3llo\n")
+	ts := testServer(map[string][]byte{"/good.sh": good, "/corrupt.sh": corrupt})
+	defer ts.Close()
+
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	// A file matching its checksum is placed in the local dir and is executable
+	artifact := &structs.TaskArtifact{Source: ts.URL + "/good.sh", Checksum: sha256Sum(good)}
+	if err := GetArtifact(artifact, taskDir, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := filepath.Join(taskDir, "local", "good.sh")
+	if act := readFile(t, path); act != string(good) {
+		t.Fatalf("bad: %q", act)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm()&0100 == 0 {
+		t.Fatalf("artifact should be executable: %v %v", fi.Mode(), err)
+	}
+
+	sum := sha512.Sum512(good)
+	artifact = &structs.TaskArtifact{
+		Source:      ts.URL + "/good.sh",
+		Checksum:    "sha512:" + hex.EncodeToString(sum[:]),
+		Destination: "bin",
+	}
+	if err := GetArtifact(artifact, taskDir, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if act := readFile(t, filepath.Join(taskDir, "bin", "good.sh")); act != string(good) {
+		t.Fatalf("bad: %q", act)
+	}
+
+	// A corrupted file is rejected and not left behind
+	artifact = &structs.TaskArtifact{Source: ts.URL + "/corrupt.sh", Checksum: sha256Sum(good)}
+	err := GetArtifact(artifact, taskDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Fatalf("expected checksum mismatch: %v", err)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(taskDir, "local"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("corrupt artifact left behind: %v", files)
+	}
+}
+
+func TestGetArtifact_Archives(t *testing.T) {
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "conf/", Typeflag: tar.TypeDir, Mode: 0755})
+	tw.WriteHeader(&tar.Header{Name: "conf/app.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("foo"))
+	tw.Close()
+	gw.Close()
+
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("bin/tool")
+	w.Write([]byte("bar"))
+	zw.Close()
+
+	ts := testServer(map[string][]byte{"/app.tar.gz": tgz.Bytes(), "/tool.zip": zipped.Bytes()})
+	defer ts.Close()
+
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	for _, src := range []string{"/app.tar.gz", "/tool.zip"} {
+		if err := GetArtifact(&structs.TaskArtifact{Source: ts.URL + src}, taskDir, nil); err != nil {
+			t.Fatalf("%s: %v", src, err)
+		}
+	}
+
+	if act := readFile(t, filepath.Join(taskDir, "local", "conf", "app.conf")); act != "foo" {
+		t.Fatalf("bad: %q", act)
+	}
+	if act := readFile(t, filepath.Join(taskDir, "local", "bin", "tool")); act != "bar" {
+		t.Fatalf("bad: %q", act)
+	}
+}
+
+func TestGetArtifact_Cache(t *testing.T) {
+	script := []byte("#!/bin/sh\necho hello\n")
+	var tgz bytes.Buffer
+	gw := gzip.NewWriter(&tgz)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Name: "app.conf", Typeflag: tar.TypeReg, Mode: 0644, Size: 3})
+	tw.Write([]byte("foo"))
+	tw.Close()
+	gw.Close()
+
+	var lock sync.Mutex
+	requests := make(map[string]int)
+	files := map[string][]byte{"/hello.sh": script, "/app.tar.gz": tgz.Bytes()}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		requests[r.URL.Path]++
+		lock.Unlock()
+		w.Write(files[r.URL.Path])
+	}))
+	defer ts.Close()
+
+	cacheDir := testTaskDir(t)
+	defer os.RemoveAll(cacheDir)
+	cache, err := NewCache(cacheDir, 1024)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each artifact with a checksum is downloaded once for all the tasks
+	opts := &Options{Cache: cache}
+	for i := 0; i < 3; i++ {
+		taskDir := testTaskDir(t)
+		defer os.RemoveAll(taskDir)
+		for src, data := range files {
+			artifact := &structs.TaskArtifact{Source: ts.URL + src, Checksum: sha256Sum(data)}
+			if err := GetArtifactWithOptions(artifact, taskDir, nil, opts); err != nil {
+				t.Fatalf("%s: %v", src, err)
+			}
+		}
+		path := filepath.Join(taskDir, "local", "hello.sh")
+		if act := readFile(t, path); act != string(script) {
+			t.Fatalf("bad: %q", act)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm()&0100 == 0 {
+			t.Fatalf("artifact should be executable: %v %v", fi.Mode(), err)
+		}
+		if act := readFile(t, filepath.Join(taskDir, "local", "app.conf")); act != "foo" {
+			t.Fatalf("bad: %q", act)
+		}
+	}
+	for src, n := range requests {
+		if n != 1 {
+			t.Fatalf("%s downloaded %d times", src, n)
+		}
+	}
+
+	// Artifacts without a checksum are downloaded every time
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+	for i := 0; i < 2; i++ {
+		if err := GetArtifactWithOptions(&structs.TaskArtifact{Source: ts.URL + "/hello.sh"}, taskDir, nil, opts); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	if n := requests["/hello.sh"]; n != 3 {
+		t.Fatalf("downloaded %d times", n)
+	}
+}
+
+func TestGetArtifact_ArchiveEscape(t *testing.T) {
+	var zipped bytes.Buffer
+	zw := zip.NewWriter(&zipped)
+	w, _ := zw.Create("../../evil")
+	w.Write([]byte("evil"))
+	zw.Close()
+
+	ts := testServer(map[string][]byte{"/evil.zip": zipped.Bytes()})
+	defer ts.Close()
+
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	err := GetArtifact(&structs.TaskArtifact{Source: ts.URL + "/evil.zip"}, taskDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Fatalf("expected error: %v", err)
+	}
+
+	err = GetArtifact(&structs.TaskArtifact{Source: ts.URL + "/evil.zip", Destination: "../.."}, taskDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "escapes") {
+		t.Fatalf("expected error: %v", err)
+	}
+}
+
+func TestGetArtifact_Retry(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case requests < 3:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte("ok"))
+		}
+	}))
+	defer ts.Close()
+
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	// Server errors are retried
+	if err := GetArtifact(&structs.TaskArtifact{Source: ts.URL + "/flaky"}, taskDir, nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if requests != 3 {
+		t.Fatalf("expected 3 requests, got %d", requests)
+	}
+
+	// Client errors are not
+	requests = 0
+	err := GetArtifact(&structs.TaskArtifact{Source: ts.URL + "/missing"}, taskDir, nil)
+	if err == nil || !strings.Contains(err.Error(), "404") {
+		t.Fatalf("expected error: %v", err)
+	}
+	if requests != 1 {
+		t.Fatalf("expected 1 request, got %d", requests)
+	}
+}
+
+func TestGetArtifact_Abort(t *testing.T) {
+	doneCh := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		<-doneCh
+	}))
+	defer ts.Close()
+	defer close(doneCh)
+
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	abortCh := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- GetArtifact(&structs.TaskArtifact{Source: ts.URL + "/slow"}, taskDir, abortCh)
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	close(abortCh)
+
+	select {
+	case err := <-errCh:
+		if err != ErrAborted {
+			t.Fatalf("expected abort, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if _, err := os.Stat(filepath.Join(taskDir, "local", "slow")); !os.IsNotExist(err) {
+		t.Fatalf("aborted artifact left behind: %v", err)
+	}
+}
+
+func TestGetArtifact_InvalidSource(t *testing.T) {
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	for _, src := range []string{"ftp://example.com/foo", "http://example.com/"} {
+		err := GetArtifact(&structs.TaskArtifact{Source: src}, taskDir, nil)
+		if err == nil {
+			t.Fatalf("expected error for %s", src)
+		}
+	}
+
+}
@@ -0,0 +1,121 @@
+package getter
+
+import (
+	"io"
+	"log"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// progressInterval is how often the progress of a download is logged
+	progressInterval = 10 * time.Second
+)
+
+// rateLimitChunk is the most a rate limited download reads at once, so the
+// bandwidth is shared fairly between concurrent downloads
+const rateLimitChunk = 32 * 1024
+
+// RateLimiter bounds the bandwidth of downloads
+type RateLimiter interface {
+	// WaitN blocks until n more bytes may be downloaded. It returns false if
+	// abortCh is closed first.
+	WaitN(n int, abortCh <-chan struct{}) bool
+}
+
+// tokenBucket is a RateLimiter allowing a number of bytes per second, with
+// bursts of up to a second worth of bytes. A download taking more than is
+// available is let through, but the ones after it wait until the debt is
+// paid off, so the average rate holds regardless of the reads.
+type tokenBucket struct {
+	rate float64
+
+	lock   sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a limiter allowing bytesPerSec across all of the
+// downloads using it.
+func NewRateLimiter(bytesPerSec int64) RateLimiter {
+	return &tokenBucket{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+func (b *tokenBucket) WaitN(n int, abortCh <-chan struct{}) bool {
+	b.lock.Lock()
+	now := time.Now()
+	b.tokens = math.Min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	wait := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.lock.Unlock()
+	if wait <= 0 {
+		return true
+	}
+
+	select {
+	case <-time.After(wait):
+		return true
+	case <-abortCh:
+		// Hand back what wasn't downloaded
+		b.lock.Lock()
+		b.tokens += float64(n)
+		b.lock.Unlock()
+		return false
+	}
+}
+
+// rateLimitedReader reads no faster than its limiter allows.
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter RateLimiter
+	abortCh <-chan struct{}
+}
+
+func (r *rateLimitedReader) Read(p []byte) (int, error) {
+	if len(p) > rateLimitChunk {
+		p = p[:rateLimitChunk]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 && !r.limiter.WaitN(n, r.abortCh) {
+		return n, ErrAborted
+	}
+	return n, err
+}
+
+// progressReader logs the progress of a download every progressInterval.
+type progressReader struct {
+	r      io.Reader
+	source string
+	size   int64
+	logger *log.Logger
+
+	read int64
+	next time.Time
+}
+
+func newProgressReader(r io.Reader, source string, size int64, logger *log.Logger) *progressReader {
+	return &progressReader{
+		r:      r,
+		source: source,
+		size:   size,
+		logger: logger,
+		next:   time.Now().Add(progressInterval),
+	}
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.read += int64(n)
+	if now := time.Now(); now.After(r.next) {
+		r.next = now.Add(progressInterval)
+		if r.size > 0 {
+			r.logger.Printf("[INFO] client: downloaded %d of %d bytes (%d%%) of artifact '%s'",
+				r.read, r.size, r.read*100/r.size, r.source)
+		} else {
+			r.logger.Printf("[INFO] client: downloaded %d bytes of artifact '%s'", r.read, r.source)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,93 @@
+package getter
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestGetArtifact_RateLimit(t *testing.T) {
+	defer func(d time.Duration) { progressInterval = d }(progressInterval)
+	progressInterval = 100 * time.Millisecond
+
+	data := bytes.Repeat([]byte("x"), 512*1024)
+	ts := testServer(map[string][]byte{"/big.bin": data})
+	defer ts.Close()
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	// Half a MiB at a MiB per second takes half a second
+	var logs bytes.Buffer
+	opts := &Options{
+		RateLimiter: NewRateLimiter(1024 * 1024),
+		Logger:      log.New(&logs, "", 0),
+	}
+	artifact := &structs.TaskArtifact{Source: ts.URL + "/big.bin"}
+	start := time.Now()
+	if err := GetArtifactWithOptions(artifact, taskDir, nil, opts); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("download took %v; want about 500ms", elapsed)
+	}
+
+	// The progress was logged along the way
+	if !strings.Contains(logs.String(), "downloaded ") {
+		t.Fatalf("progress not logged: %q", logs.String())
+	}
+}
+
+func TestGetArtifact_RateLimit_Shared(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 256*1024)
+	ts := testServer(map[string][]byte{"/a.bin": data, "/b.bin": data})
+	defer ts.Close()
+
+	// Concurrent downloads share the bandwidth, taking as long together as
+	// one download of both would
+	opts := &Options{RateLimiter: NewRateLimiter(1024 * 1024)}
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, name := range []string{"/a.bin", "/b.bin"} {
+		taskDir := testTaskDir(t)
+		defer os.RemoveAll(taskDir)
+		wg.Add(1)
+		go func(source, taskDir string) {
+			defer wg.Done()
+			artifact := &structs.TaskArtifact{Source: source}
+			if err := GetArtifactWithOptions(artifact, taskDir, nil, opts); err != nil {
+				t.Errorf("err: %v", err)
+			}
+		}(ts.URL+name, taskDir)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 1500*time.Millisecond {
+		t.Fatalf("downloads took %v; want about 500ms", elapsed)
+	}
+}
+
+func TestGetArtifact_RateLimit_Abort(t *testing.T) {
+	data := bytes.Repeat([]byte("x"), 256*1024)
+	ts := testServer(map[string][]byte{"/big.bin": data})
+	defer ts.Close()
+	taskDir := testTaskDir(t)
+	defer os.RemoveAll(taskDir)
+
+	// A download waiting on the limiter is aborted promptly
+	abortCh := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(abortCh) })
+	opts := &Options{RateLimiter: NewRateLimiter(1024)}
+	artifact := &structs.TaskArtifact{Source: ts.URL + "/big.bin"}
+	start := time.Now()
+	if err := GetArtifactWithOptions(artifact, taskDir, abortCh, opts); err != ErrAborted {
+		t.Fatalf("expected abort: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("abort took %v", elapsed)
+	}
+}
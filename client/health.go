@@ -0,0 +1,396 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/hashicorp/nomad/client/driver/args"
+	"github.com/hashicorp/nomad/client/driver/environment"
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// checkStatusPassing and checkStatusFailing are the states a check
+	// moves to once it crosses its success or failure threshold. A check
+	// that has crossed neither yet has no status.
+	checkStatusPassing = "passing"
+	checkStatusFailing = "failing"
+
+	// taskHealthy and taskUnhealthy are the aggregate health of a task. A
+	// task is healthy once all of its checks pass and unhealthy as soon as
+	// one of them fails.
+	taskHealthy   = "healthy"
+	taskUnhealthy = "unhealthy"
+
+	// maxLogCheckLine is the longest line a log check buffers. A longer
+	// line is matched in pieces of this size.
+	maxLogCheckLine = 64 * 1024
+)
+
+// checkState tracks the consecutive results of a single check
+type checkState struct {
+	successes int
+	failures  int
+	status    string
+}
+
+// checkTimeout returns how long a single run of the check may take
+func checkTimeout(check *structs.TaskCheck) time.Duration {
+	if check.Timeout > 0 {
+		return check.Timeout
+	}
+	return check.Interval
+}
+
+// checkThresholds returns the success and failure thresholds of the check,
+// defaulting to one. A log check passes or fails on its single run.
+func checkThresholds(check *structs.TaskCheck) (int, int) {
+	if check.Type == structs.TaskCheckTypeLog {
+		return 1, 1
+	}
+	return checkThreshold(check.SuccessThreshold), checkThreshold(check.FailureThreshold)
+}
+
+// checkThreshold returns the configured threshold, defaulting to one
+func checkThreshold(threshold int) int {
+	if threshold <= 0 {
+		return 1
+	}
+	return threshold
+}
+
+// lineMatcher matches a pattern against the lines of a log fed to it in
+// arbitrary chunks, buffering a partial line until the rest of it is fed.
+type lineMatcher struct {
+	re      *regexp.Regexp
+	partial []byte
+}
+
+func newLineMatcher(re *regexp.Regexp) *lineMatcher {
+	return &lineMatcher{re: re}
+}
+
+// feed adds data to the log and returns whether a line completed by it
+// matches the pattern
+func (m *lineMatcher) feed(data []byte) bool {
+	m.partial = append(m.partial, data...)
+	for {
+		i := bytes.IndexByte(m.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := bytes.TrimSuffix(m.partial[:i], []byte("\r"))
+		m.partial = m.partial[i+1:]
+		if m.re.Match(line) {
+			return true
+		}
+	}
+
+	if len(m.partial) >= maxLogCheckLine {
+		line := m.partial
+		m.partial = nil
+		return m.re.Match(line)
+	}
+	return false
+}
+
+// reset drops the partial line, such as one cut short by a truncation
+func (m *lineMatcher) reset() {
+	m.partial = nil
+}
+
+// runCheck runs the check once and returns why it failed, if it did. The
+// address, URL, command and arguments are interpolated with the environment
+// of the task and scripts are run from the task directory.
+func runCheck(check *structs.TaskCheck, taskDir string, env map[string]string) error {
+	timeout := checkTimeout(check)
+	switch check.Type {
+	case structs.TaskCheckTypeTCP:
+		conn, err := net.DialTimeout("tcp", args.ReplaceEnv(check.Address, env), timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+
+	case structs.TaskCheckTypeHTTP:
+		client := &http.Client{Timeout: timeout}
+		resp, err := client.Get(args.ReplaceEnv(check.URL, env))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		expected := check.ExpectedStatus
+		if expected == 0 {
+			expected = http.StatusOK
+		}
+		if resp.StatusCode != expected {
+			return fmt.Errorf("unexpected status %d, expected %d", resp.StatusCode, expected)
+		}
+		return nil
+
+	case structs.TaskCheckTypeScript:
+		parsed, err := args.ParseAndReplace(check.Args, env)
+		if err != nil {
+			return err
+		}
+		cmd := exec.Command(args.ReplaceEnv(check.Command, env), parsed...)
+		cmd.Dir = taskDir
+		cmd.Env = environment.TaskEnvironment(env).List()
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+
+		errCh := make(chan error, 1)
+		go func() {
+			errCh <- cmd.Wait()
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(timeout):
+			cmd.Process.Kill()
+			<-errCh
+			return fmt.Errorf("timed out after %v", timeout)
+		}
+
+	default:
+		return fmt.Errorf("unsupported check type '%s'", check.Type)
+	}
+}
+
+// Healthy returns whether all the checks of the running task are passing. A
+// task without checks is never reported healthy.
+func (r *TaskRunner) Healthy() bool {
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+	return r.health == taskHealthy
+}
+
+// startChecks starts running the checks of the task against the current
+// handle.
+func (r *TaskRunner) startChecks() {
+	if len(r.task.Checks) == 0 {
+		return
+	}
+
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+	if r.checksStopCh != nil {
+		return
+	}
+	r.checksStopCh = make(chan struct{})
+	r.checkStates = make(map[string]*checkState, len(r.task.Checks))
+	for _, check := range r.task.Checks {
+		r.checkStates[check.Name] = &checkState{}
+	}
+
+	// A restored task is only matched against what it logs from now on
+	if r.logPositions == nil {
+		r.markLogPositions()
+	}
+
+	taskDir := r.ctx.AllocDir.TaskDirs[r.task.Name]
+	// Unknown secrets already failed the start of the task
+	env, _ := r.buildEnv()
+	for _, check := range r.task.Checks {
+		if check.Type == structs.TaskCheckTypeLog {
+			pos := r.logPositions[structs.TaskCheckLogStdout]
+			if check.Log == structs.TaskCheckLogStderr {
+				pos = r.logPositions[structs.TaskCheckLogStderr]
+			}
+			go r.watchLogCheck(r.task.Name, check, pos, r.checksStopCh)
+			continue
+		}
+		go r.watchCheck(r.task.Name, check, taskDir, env, r.checksStopCh)
+	}
+}
+
+// markLogPositions records where the logs of the run of the task about to
+// be started begin, so its log checks don't match lines of previous runs
+func (r *TaskRunner) markLogPositions() {
+	hasLogCheck := false
+	for _, check := range r.task.Checks {
+		hasLogCheck = hasLogCheck || check.Type == structs.TaskCheckTypeLog
+	}
+	if !hasLogCheck {
+		r.logPositions = nil
+		return
+	}
+
+	stdout, stderr := r.ctx.LogPaths(r.task.Name)
+	r.logPositions = map[string]logging.Position{
+		structs.TaskCheckLogStdout: logging.EndPosition(stdout),
+		structs.TaskCheckLogStderr: logging.EndPosition(stderr),
+	}
+}
+
+// stopChecks stops the checks and resets the health of the task. No health
+// status is emitted once it returns.
+func (r *TaskRunner) stopChecks() {
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+	if r.checksStopCh == nil {
+		return
+	}
+	close(r.checksStopCh)
+	r.checksStopCh = nil
+	r.checkStates = nil
+	r.health = ""
+}
+
+// watchCheck runs the check every interval, after waiting out its grace
+// period, until stopCh is closed or the task runner exits or is destroyed.
+func (r *TaskRunner) watchCheck(taskName string, check *structs.TaskCheck,
+	taskDir string, env map[string]string, stopCh chan struct{}) {
+	wait := check.GracePeriod
+	for {
+		select {
+		case <-r.clock.After(wait):
+		case <-stopCh:
+			return
+		case <-r.waitCh:
+			return
+		case <-r.destroyCh:
+			return
+		}
+
+		err := runCheck(check, taskDir, env)
+		if err != nil {
+			r.logger.Printf("[DEBUG] client: check '%s' of task '%s' for alloc '%s' failed: %v",
+				check.Name, taskName, r.allocID, err)
+		}
+		r.setCheckResult(taskName, check, err, stopCh)
+		wait = check.Interval
+	}
+}
+
+// watchLogCheck tails the log of the task from the position the current run
+// started at, passing the check once a line matches its pattern. The check
+// fails if the timeout, counted from the end of the grace period, passes
+// first.
+func (r *TaskRunner) watchLogCheck(taskName string, check *structs.TaskCheck,
+	pos logging.Position, stopCh chan struct{}) {
+	re, err := regexp.Compile(check.Pattern)
+	if err != nil {
+		r.setCheckResult(taskName, check, fmt.Errorf("invalid pattern: %v", err), stopCh)
+		return
+	}
+
+	stdout, stderr := r.ctx.LogPaths(taskName)
+	path := stdout
+	if check.Log == structs.TaskCheckLogStderr {
+		path = stderr
+	}
+	streamStopCh := make(chan struct{})
+	defer close(streamStopCh)
+	logCh := logging.FollowFilesFrom(path, pos, streamStopCh, nil)
+
+	var timeoutCh <-chan time.Time
+	if check.Timeout > 0 {
+		timeoutCh = r.clock.After(check.GracePeriod + check.Timeout)
+	}
+
+	matcher := newLineMatcher(re)
+	for {
+		select {
+		case frame, ok := <-logCh:
+			if !ok {
+				return
+			}
+			if frame.Marker != nil && frame.Marker.Kind == logging.MarkerTruncated {
+				matcher.reset()
+			}
+			if matcher.feed(frame.Data) {
+				r.setCheckResult(taskName, check, nil, stopCh)
+				return
+			}
+		case <-timeoutCh:
+			err := fmt.Errorf("no line of %s matched '%s' within %v",
+				path, check.Pattern, check.GracePeriod+check.Timeout)
+			r.logger.Printf("[DEBUG] client: check '%s' of task '%s' for alloc '%s' failed: %v",
+				check.Name, taskName, r.allocID, err)
+			r.setCheckResult(taskName, check, err, stopCh)
+			return
+		case <-stopCh:
+			return
+		case <-r.waitCh:
+			return
+		case <-r.destroyCh:
+			return
+		}
+	}
+}
+
+// setCheckResult records the result of a run of the check and updates the
+// status of the task if its health changed as a result.
+func (r *TaskRunner) setCheckResult(taskName string, check *structs.TaskCheck,
+	err error, stopCh chan struct{}) {
+	r.healthLock.Lock()
+	defer r.healthLock.Unlock()
+
+	// Ignore results that race with the checks being stopped
+	select {
+	case <-stopCh:
+		return
+	default:
+	}
+
+	state := r.checkStates[check.Name]
+	successThreshold, failureThreshold := checkThresholds(check)
+	if err == nil {
+		state.successes++
+		state.failures = 0
+		if state.successes >= successThreshold {
+			state.status = checkStatusPassing
+		}
+	} else {
+		state.failures++
+		state.successes = 0
+		if state.failures >= failureThreshold {
+			state.status = checkStatusFailing
+		}
+	}
+
+	// The task is unhealthy if any check is failing and healthy only once
+	// all of them pass
+	health := taskHealthy
+	for _, s := range r.checkStates {
+		if s.status == checkStatusFailing {
+			health = taskUnhealthy
+			break
+		}
+		if s.status != checkStatusPassing {
+			health = ""
+		}
+	}
+	if health == "" || health == r.health {
+		return
+	}
+	r.health = health
+
+	if health == taskHealthy {
+		r.logger.Printf("[INFO] client: task '%s' for alloc '%s' is healthy",
+			taskName, r.allocID)
+		r.recordEvent(structs.NewTaskEvent(structs.TaskHealthy).SetMessage("task is healthy"))
+		r.markReady()
+		select {
+		case r.healthyCh <- struct{}{}:
+		default:
+		}
+		r.updater(taskName, structs.AllocClientStatusRunning, "task is healthy", nil)
+		return
+	}
+	r.logger.Printf("[WARN] client: task '%s' for alloc '%s' is unhealthy: check '%s' failed: %v",
+		taskName, r.allocID, check.Name, err)
+	event := structs.NewTaskEvent(structs.TaskUnhealthy).
+		SetMessage(fmt.Sprintf("task is unhealthy: check '%s' failed: %v", check.Name, err))
+	r.recordEvent(event)
+	r.updater(taskName, structs.AllocClientStatusRunning, event.Message, nil)
+}
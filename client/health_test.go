@@ -0,0 +1,319 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+// toggleServer is an HTTP server whose status code can be changed while it is
+// running
+type toggleServer struct {
+	*httptest.Server
+	status int
+	lock   sync.Mutex
+}
+
+func newToggleServer(status int) *toggleServer {
+	s := &toggleServer{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	return s
+}
+
+func (s *toggleServer) setStatus(status int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.status = status
+}
+
+// waitDescription waits until a status update with the given description
+// prefix has been made
+func waitDescription(t *testing.T, upd *MockTaskStateUpdater, prefix string) {
+	testutil.WaitForResult(func() (bool, error) {
+		upd.lock.Lock()
+		defer upd.lock.Unlock()
+		for _, desc := range upd.Description {
+			if strings.HasPrefix(desc, prefix) {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("no update '%s': %#v", prefix, upd.Description)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestRunCheck_HTTP(t *testing.T) {
+	srv := newToggleServer(http.StatusOK)
+	defer srv.Close()
+
+	check := &structs.TaskCheck{
+		Type:     structs.TaskCheckTypeHTTP,
+		URL:      "${ADDR}/health",
+		Interval: time.Second,
+	}
+	env := map[string]string{"ADDR": srv.URL}
+	if err := runCheck(check, "", env); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	srv.setStatus(http.StatusInternalServerError)
+	if err := runCheck(check, "", env); err == nil {
+		t.Fatalf("check should fail")
+	}
+
+	check.ExpectedStatus = http.StatusInternalServerError
+	if err := runCheck(check, "", env); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestRunCheck_TCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	addr := l.Addr().String()
+
+	check := &structs.TaskCheck{
+		Type:     structs.TaskCheckTypeTCP,
+		Address:  addr,
+		Interval: time.Second,
+	}
+	if err := runCheck(check, "", nil); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	l.Close()
+	if err := runCheck(check, "", nil); err == nil {
+		t.Fatalf("check should fail")
+	}
+}
+
+func TestRunCheck_Script(t *testing.T) {
+	check := &structs.TaskCheck{
+		Type:     structs.TaskCheckTypeScript,
+		Command:  "/bin/sh",
+		Args:     `-c "exit $CODE"`,
+		Interval: time.Second,
+	}
+	if err := runCheck(check, "", map[string]string{"CODE": "0"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := runCheck(check, "", map[string]string{"CODE": "1"}); err == nil {
+		t.Fatalf("check should fail")
+	}
+
+	// Scripts that outlive the timeout are killed
+	check.Args = `-c "sleep 10"`
+	check.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if err := runCheck(check, "", nil); err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected timeout: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("script not killed after %v", elapsed)
+	}
+}
+
+func TestTaskRunner_Checks(t *testing.T) {
+	srv := newToggleServer(http.StatusOK)
+	defer srv.Close()
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:             "alive",
+		Type:             structs.TaskCheckTypeHTTP,
+		URL:              srv.URL,
+		Interval:         10 * time.Millisecond,
+		SuccessThreshold: 3,
+		FailureThreshold: 2,
+	}}
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task is healthy")
+	if !tr.Healthy() {
+		t.Fatalf("task should be healthy")
+	}
+
+	srv.setStatus(http.StatusInternalServerError)
+	waitDescription(t, upd, "task is unhealthy: check 'alive' failed")
+	if tr.Healthy() {
+		t.Fatalf("task should be unhealthy")
+	}
+
+	// The task recovers once the check passes again
+	srv.setStatus(http.StatusOK)
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.Healthy(), nil
+	}, func(err error) {
+		t.Fatalf("task did not recover")
+	})
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if tr.Healthy() {
+		t.Fatalf("destroyed task should not be healthy")
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+}
+
+func TestTaskRunner_Checks_GracePeriod(t *testing.T) {
+	srv := newToggleServer(http.StatusInternalServerError)
+	defer srv.Close()
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:        "alive",
+		Type:        structs.TaskCheckTypeHTTP,
+		URL:         srv.URL,
+		Interval:    10 * time.Millisecond,
+		GracePeriod: 300 * time.Millisecond,
+	}}
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// The failing check is not run during the grace period
+	time.Sleep(100 * time.Millisecond)
+	if status, desc := upd.lastStatus(); desc != "task started" {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+
+	// The task is healthy if it becomes ready before the grace period ends
+	srv.setStatus(http.StatusOK)
+	waitDescription(t, upd, "task is healthy")
+
+	upd.lock.Lock()
+	defer upd.lock.Unlock()
+	for _, desc := range upd.Description {
+		if strings.HasPrefix(desc, "task is unhealthy") {
+			t.Fatalf("task reported unhealthy during grace period: %#v", upd.Description)
+		}
+	}
+}
+
+func TestLineMatcher(t *testing.T) {
+	m := newLineMatcher(regexp.MustCompile(`^Server started on :\d+$`))
+
+	// Lines are matched once complete, even if split across reads
+	if m.feed([]byte("booting\r\nServer sta")) {
+		t.Fatalf("partial line matched")
+	}
+	if m.feed([]byte("rted on :80")) {
+		t.Fatalf("partial line matched")
+	}
+	if !m.feed([]byte("80\r\nready\n")) {
+		t.Fatalf("line not matched")
+	}
+
+	// Overlong lines are matched in pieces rather than buffered
+	m = newLineMatcher(regexp.MustCompile(`x$`))
+	if !m.feed([]byte(strings.Repeat("x", maxLogCheckLine))) {
+		t.Fatalf("overlong line not matched")
+	}
+	if len(m.partial) != 0 {
+		t.Fatalf("overlong line buffered: %d bytes", len(m.partial))
+	}
+}
+
+// testLogWriter returns a writer appending to the stdout of the task
+func testLogWriter(t *testing.T, tr *TaskRunner) io.WriteCloser {
+	stdout, _ := tr.ctx.LogPaths(tr.task.Name)
+	if err := os.MkdirAll(filepath.Dir(stdout), 0777); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	w, err := logging.NewFileRotator(stdout, 2, 1024*1024)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return w
+}
+
+func TestTaskRunner_Checks_Log(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:    "started",
+		Type:    structs.TaskCheckTypeLog,
+		Pattern: "Server started",
+		Timeout: 5 * time.Second,
+	}}
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Lines logged before the task started are ignored
+	w := testLogWriter(t, tr)
+	defer w.Close()
+	fmt.Fprintln(w, "Server started")
+
+	go tr.Run()
+	defer tr.Destroy()
+	waitDescription(t, upd, "task started")
+
+	fmt.Fprint(w, "booting\nServer ")
+	time.Sleep(100 * time.Millisecond)
+	if tr.Healthy() {
+		t.Fatalf("task healthy before the line was logged")
+	}
+
+	// The task is healthy once the line is completed
+	fmt.Fprintln(w, "started on :8080")
+	waitDescription(t, upd, "task is healthy")
+	if !tr.Healthy() {
+		t.Fatalf("task should be healthy")
+	}
+}
+
+func TestTaskRunner_Checks_Log_Timeout(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:    "started",
+		Type:    structs.TaskCheckTypeLog,
+		Pattern: "Server started",
+		Timeout: 200 * time.Millisecond,
+	}}
+	defer tr.ctx.AllocDir.Destroy()
+	w := testLogWriter(t, tr)
+	defer w.Close()
+
+	go tr.Run()
+	defer tr.Destroy()
+	fmt.Fprintln(w, "Server failed to bind")
+
+	// The task fails its check once the timeout passes without a match
+	waitDescription(t, upd, "task is unhealthy: check 'started' failed")
+	if tr.Healthy() {
+		t.Fatalf("task should be unhealthy")
+	}
+
+	// Matches after the timeout are ignored
+	fmt.Fprintln(w, "Server started")
+	time.Sleep(100 * time.Millisecond)
+	if tr.Healthy() {
+		t.Fatalf("task should stay unhealthy")
+	}
+}
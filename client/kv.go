@@ -0,0 +1,219 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+const (
+	// templateKeyDebounce is how long the keys the templates of a task read
+	// must stay unchanged before the templates are rendered again, so a
+	// burst of changes causes a single reload or restart
+	templateKeyDebounce = 5 * time.Second
+
+	// templateKeyRetryInterval is how long watching a key waits after the
+	// store failed before trying again
+	templateKeyRetryInterval = 10 * time.Second
+)
+
+// consulKV reads the KV store of the local Consul agent
+type consulKV struct {
+	kv *consul.KV
+}
+
+// newConsulKV returns a store for the Consul agent at the consul.address
+// option of the config
+func newConsulKV(cfg *config.Config) (*consulKV, error) {
+	consulConfig := consul.DefaultConfig()
+	consulConfig.Address = cfg.ReadDefault("consul.address", "127.0.0.1:8500")
+	consulClient, err := consul.NewClient(consulConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize consul client: %v", err)
+	}
+	return &consulKV{kv: consulClient.KV()}, nil
+}
+
+// Get reads the key with a blocking query, which returns within the wait
+// time of the agent if the key doesn't change
+func (c *consulKV) Get(key string, waitIndex uint64, abortCh <-chan struct{}) ([]byte, uint64, error) {
+	type result struct {
+		pair *consul.KVPair
+		meta *consul.QueryMeta
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		pair, meta, err := c.kv.Get(key, &consul.QueryOptions{WaitIndex: waitIndex})
+		resultCh <- result{pair, meta, err}
+	}()
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			return nil, 0, res.err
+		}
+		if res.pair == nil {
+			return nil, res.meta.LastIndex, nil
+		}
+
+		// An empty value still exists
+		value := res.pair.Value
+		if value == nil {
+			value = []byte{}
+		}
+		return value, res.meta.LastIndex, nil
+	case <-abortCh:
+		return nil, waitIndex, nil
+	}
+}
+
+// templateKeys holds the values of the keys the templates of a task read, so
+// they are rendered the same until a key changes, and watches the keys for
+// changes while the task runs.
+type templateKeys struct {
+	store  config.KVStore
+	logger *log.Logger
+	clock  config.Clock
+
+	// retryInterval is how long watching a key waits after the store failed
+	retryInterval time.Duration
+
+	values map[string]*templateKey
+	lock   sync.Mutex
+
+	// stopCh is set once watching starts, and ends the watches once closed.
+	// changeCh receives once a watched key changes.
+	stopCh   <-chan struct{}
+	changeCh chan struct{}
+}
+
+// templateKey is a key read by a template, at the index it was last read at
+type templateKey struct {
+	value []byte
+	index uint64
+}
+
+func newTemplateKeys(store config.KVStore, logger *log.Logger, clock config.Clock) *templateKeys {
+	return &templateKeys{
+		store:         store,
+		logger:        logger,
+		clock:         clock,
+		retryInterval: templateKeyRetryInterval,
+		values:        make(map[string]*templateKey),
+		changeCh:      make(chan struct{}, 1),
+	}
+}
+
+// get returns the value of the key, reading it from the store the first time
+// and watching it from then on if the watch is started. A key that doesn't
+// exist is an error.
+func (k *templateKeys) get(key string) (string, error) {
+	k.lock.Lock()
+	cached, ok := k.values[key]
+	k.lock.Unlock()
+	if !ok {
+		if k.store == nil {
+			return "", fmt.Errorf("no key/value store to read key '%s' from", key)
+		}
+		value, index, err := k.store.Get(key, 0, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed to read key '%s': %v", key, err)
+		}
+
+		k.lock.Lock()
+		if cached, ok = k.values[key]; !ok {
+			cached = &templateKey{value: value, index: index}
+			k.values[key] = cached
+			if k.stopCh != nil {
+				go k.watchKey(key, index, k.stopCh)
+			}
+		}
+		k.lock.Unlock()
+	}
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if cached.value == nil {
+		return "", fmt.Errorf("key '%s' doesn't exist", key)
+	}
+	return string(cached.value), nil
+}
+
+// watch watches the keys read so far and those read after until stopCh is
+// closed. The returned channel receives once the keys have changed and then
+// stayed unchanged for the debounce interval.
+func (k *templateKeys) watch(debounce time.Duration, stopCh <-chan struct{}) <-chan struct{} {
+	k.lock.Lock()
+	k.stopCh = stopCh
+	for key, cached := range k.values {
+		go k.watchKey(key, cached.index, stopCh)
+	}
+	k.lock.Unlock()
+
+	renderCh := make(chan struct{}, 1)
+	go func() {
+		var quietCh <-chan time.Time
+		for {
+			select {
+			case <-stopCh:
+				return
+			case <-k.changeCh:
+				quietCh = k.clock.After(debounce)
+			case <-quietCh:
+				quietCh = nil
+				select {
+				case renderCh <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return renderCh
+}
+
+// watchKey updates the value of the key as it changes in the store. While the
+// store fails the last value read is kept, so the templates keep rendering
+// what they last did.
+func (k *templateKeys) watchKey(key string, index uint64, stopCh <-chan struct{}) {
+	for {
+		value, newIndex, err := k.store.Get(key, index, stopCh)
+		select {
+		case <-stopCh:
+			return
+		default:
+		}
+		if err != nil {
+			k.logger.Printf("[WARN] client: failed to watch template key '%s', keeping its last value: %v", key, err)
+			select {
+			case <-stopCh:
+				return
+			case <-k.clock.After(k.retryInterval):
+			}
+			continue
+		}
+		if newIndex == index {
+			continue
+		}
+		index = newIndex
+
+		k.lock.Lock()
+		cached := k.values[key]
+		changed := !bytes.Equal(cached.value, value) || (cached.value == nil) != (value == nil)
+		cached.value, cached.index = value, index
+		k.lock.Unlock()
+		if changed {
+			k.logger.Printf("[DEBUG] client: template key '%s' changed", key)
+			select {
+			case k.changeCh <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+var _ config.KVStore = &consulKV{}
+
+// fakeKV is a KV store in memory whose index moves on with every change
+type fakeKV struct {
+	values map[string][]byte
+	index  uint64
+	err    error
+	reads  int
+	lock   sync.Mutex
+
+	// changeCh is closed and replaced on every change
+	changeCh chan struct{}
+}
+
+func newFakeKV(values map[string]string) *fakeKV {
+	kv := &fakeKV{values: make(map[string][]byte), index: 1, changeCh: make(chan struct{})}
+	for k, v := range values {
+		kv.values[k] = []byte(v)
+	}
+	return kv
+}
+
+func (kv *fakeKV) Get(key string, waitIndex uint64, abortCh <-chan struct{}) ([]byte, uint64, error) {
+	for {
+		kv.lock.Lock()
+		kv.reads++
+		if err := kv.err; err != nil {
+			kv.lock.Unlock()
+			return nil, 0, err
+		}
+		if waitIndex == 0 || kv.index > waitIndex {
+			value, index := kv.values[key], kv.index
+			kv.lock.Unlock()
+			return value, index, nil
+		}
+		changeCh := kv.changeCh
+		kv.lock.Unlock()
+
+		select {
+		case <-changeCh:
+		case <-abortCh:
+			return nil, waitIndex, nil
+		}
+	}
+}
+
+// set changes the key, deleting it if the value is nil
+func (kv *fakeKV) set(key string, value []byte) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	if value == nil {
+		delete(kv.values, key)
+	} else {
+		kv.values[key] = value
+	}
+	kv.index++
+	close(kv.changeCh)
+	kv.changeCh = make(chan struct{})
+}
+
+// fail makes the store fail with the error, or recover if nil
+func (kv *fakeKV) fail(err error) {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	kv.err = err
+	kv.index++
+	close(kv.changeCh)
+	kv.changeCh = make(chan struct{})
+}
+
+func (kv *fakeKV) readCount() int {
+	kv.lock.Lock()
+	defer kv.lock.Unlock()
+	return kv.reads
+}
+
+// testKVTaskRunner returns a mock task runner rendering a template of the
+// app/port key of the store
+func testKVTaskRunner(kv config.KVStore) *TaskRunner {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.config.KVStore = kv
+	tr.templateKeys = newTemplateKeys(kv, tr.logger, tr.clock)
+	tr.templateKeys.retryInterval = 10 * time.Millisecond
+	tr.keyDebounce = 100 * time.Millisecond
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: `port={{key "app/port"}}`,
+			DestPath:     "local/app.conf",
+		},
+	}
+	return tr
+}
+
+func TestTemplateKeys_Get(t *testing.T) {
+	kv := newFakeKV(map[string]string{"app/port": "80", "app/empty": ""})
+	keys := newTemplateKeys(kv, testLogger(), wallClock{})
+
+	// Keys are read from the store once
+	for i := 0; i < 2; i++ {
+		if v, err := keys.get("app/port"); err != nil || v != "80" {
+			t.Fatalf("got %q: %v", v, err)
+		}
+	}
+	if n := kv.readCount(); n != 1 {
+		t.Fatalf("store read %d times", n)
+	}
+	if v, err := keys.get("app/empty"); err != nil || v != "" {
+		t.Fatalf("got %q: %v", v, err)
+	}
+	if _, err := keys.get("app/missing"); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Fatalf("expected error for missing key: %v", err)
+	}
+
+	kv.fail(errors.New("connection refused"))
+	if _, err := keys.get("app/other"); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected error for failed store: %v", err)
+	}
+
+	// Without a store templates can't read keys
+	if _, err := newTemplateKeys(nil, testLogger(), wallClock{}).get("app/port"); err == nil {
+		t.Fatalf("expected error without store")
+	}
+}
+
+func TestTaskRunner_TemplateKeys_Debounced(t *testing.T) {
+	kv := newFakeKV(map[string]string{"app/port": "80"})
+	tr := testKVTaskRunner(kv)
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+	defer tr.Destroy()
+
+	path := filepath.Join(tr.ctx.AllocDir.TaskDirs[tr.getTask().Name], "local", "app.conf")
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	if out, err := ioutil.ReadFile(path); err != nil || string(out) != "port=80" {
+		t.Fatalf("got %q: %v", out, err)
+	}
+	handle := tr.getHandle().(*mockHandle)
+
+	// Toggling the key faster than the debounce interval renders the
+	// template once it settles, signaling the task once
+	for _, port := range []string{"81", "80", "81", "80", "82"} {
+		kv.set("app/port", []byte(port))
+		time.Sleep(20 * time.Millisecond)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if string(out) != "port=82" {
+			return false, fmt.Errorf("got %q", out)
+		}
+		sigs := handle.receivedSignals()
+		return reflect.DeepEqual(sigs, []os.Signal{syscall.SIGHUP}), fmt.Errorf("got signals %v", sigs)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	time.Sleep(200 * time.Millisecond)
+	if sigs := handle.receivedSignals(); len(sigs) != 1 {
+		t.Fatalf("got signals %v", sigs)
+	}
+}
+
+func TestTaskRunner_TemplateKeys_Unavailable(t *testing.T) {
+	kv := newFakeKV(map[string]string{"app/port": "80"})
+	tr := testKVTaskRunner(kv)
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+	defer tr.Destroy()
+
+	path := filepath.Join(tr.ctx.AllocDir.TaskDirs[tr.getTask().Name], "local", "app.conf")
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	// While the store fails the last rendered output is kept
+	kv.fail(errors.New("connection refused"))
+	time.Sleep(300 * time.Millisecond)
+	if out, err := ioutil.ReadFile(path); err != nil || string(out) != "port=80" {
+		t.Fatalf("got %q: %v", out, err)
+	}
+
+	// So it is when the key is deleted, which fails the render
+	kv.fail(nil)
+	kv.set("app/port", nil)
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskTemplateFailure) == 1, fmt.Errorf("events: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if out, err := ioutil.ReadFile(path); err != nil || string(out) != "port=80" {
+		t.Fatalf("got %q: %v", out, err)
+	}
+	if sigs := handle.receivedSignals(); len(sigs) != 0 {
+		t.Fatalf("unexpected signals: %v", sigs)
+	}
+}
@@ -0,0 +1,173 @@
+// Package metrics provides the sinks the client emits its metrics to.
+package metrics
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+// sanitizer replaces the characters that are not allowed within a segment of
+// a flattened metric name
+var sanitizer = strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_", " ", "_")
+
+// flattenKey returns the name of the metric with the given key and labels.
+// The labels are appended to the key in sorted order as name and value
+// segments, e.g. client.task.started.driver.exec.task.web.
+func flattenKey(key []string, labels map[string]string) string {
+	parts := make([]string, 0, len(key)+2*len(labels))
+	for _, k := range key {
+		parts = append(parts, sanitizer.Replace(k))
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, sanitizer.Replace(name), sanitizer.Replace(labels[name]))
+	}
+	return strings.Join(parts, ".")
+}
+
+// InmemSink keeps the latest value of every metric in memory. It is mostly
+// useful for testing.
+type InmemSink struct {
+	counters map[string]float32
+	gauges   map[string]float32
+	lock     sync.Mutex
+}
+
+// NewInmemSink returns an empty in-memory sink
+func NewInmemSink() *InmemSink {
+	return &InmemSink{
+		counters: make(map[string]float32),
+		gauges:   make(map[string]float32),
+	}
+}
+
+// IncrCounter adds val to the counter
+func (i *InmemSink) IncrCounter(key []string, val float32, labels map[string]string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.counters[flattenKey(key, labels)] += val
+}
+
+// SetGauge sets the gauge to val
+func (i *InmemSink) SetGauge(key []string, val float32, labels map[string]string) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.gauges[flattenKey(key, labels)] = val
+}
+
+// Counter returns the value of the counter, or zero if it was never
+// incremented
+func (i *InmemSink) Counter(key []string, labels map[string]string) float32 {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.counters[flattenKey(key, labels)]
+}
+
+// Gauge returns the value of the gauge and whether it was ever set
+func (i *InmemSink) Gauge(key []string, labels map[string]string) (float32, bool) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	val, ok := i.gauges[flattenKey(key, labels)]
+	return val, ok
+}
+
+// sample is a metric waiting to be passed on by a BufferedSink
+type sample struct {
+	gauge  bool
+	key    []string
+	val    float32
+	labels map[string]string
+}
+
+// BufferedSink passes metrics on to another sink from a background
+// goroutine, so emitting a metric never blocks the caller. Metrics emitted
+// while the buffer is full are dropped.
+type BufferedSink struct {
+	sink    config.MetricsSink
+	ch      chan sample
+	dropped uint64
+
+	stopCh   chan struct{}
+	doneCh   chan struct{}
+	stopOnce sync.Once
+}
+
+// NewBufferedSink returns a sink buffering up to size metrics for the given
+// sink. Close must be called to stop it.
+func NewBufferedSink(sink config.MetricsSink, size int) *BufferedSink {
+	b := &BufferedSink{
+		sink:   sink,
+		ch:     make(chan sample, size),
+		stopCh: make(chan struct{}),
+		doneCh: make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// IncrCounter queues the counter increment
+func (b *BufferedSink) IncrCounter(key []string, val float32, labels map[string]string) {
+	b.enqueue(sample{key: key, val: val, labels: labels})
+}
+
+// SetGauge queues the gauge update
+func (b *BufferedSink) SetGauge(key []string, val float32, labels map[string]string) {
+	b.enqueue(sample{gauge: true, key: key, val: val, labels: labels})
+}
+
+// Dropped returns the number of metrics dropped because the buffer was full
+func (b *BufferedSink) Dropped() uint64 {
+	return atomic.LoadUint64(&b.dropped)
+}
+
+// Close passes on the metrics that are already buffered and stops the sink.
+// Metrics emitted afterwards are discarded.
+func (b *BufferedSink) Close() {
+	b.stopOnce.Do(func() { close(b.stopCh) })
+	<-b.doneCh
+}
+
+func (b *BufferedSink) enqueue(s sample) {
+	select {
+	case b.ch <- s:
+	default:
+		atomic.AddUint64(&b.dropped, 1)
+	}
+}
+
+func (b *BufferedSink) run() {
+	defer close(b.doneCh)
+	for {
+		select {
+		case s := <-b.ch:
+			b.emit(s)
+		case <-b.stopCh:
+			// Flush what was emitted before the sink was closed
+			for {
+				select {
+				case s := <-b.ch:
+					b.emit(s)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (b *BufferedSink) emit(s sample) {
+	if s.gauge {
+		b.sink.SetGauge(s.key, s.val, s.labels)
+	} else {
+		b.sink.IncrCounter(s.key, s.val, s.labels)
+	}
+}
@@ -0,0 +1,120 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+var _ config.MetricsSink = &InmemSink{}
+var _ config.MetricsSink = &BufferedSink{}
+var _ config.MetricsSink = &StatsdSink{}
+
+func TestFlattenKey(t *testing.T) {
+	key := []string{"client", "task", "started"}
+	labels := map[string]string{"task": "web.1", "driver": "exec"}
+	if name := flattenKey(key, labels); name != "client.task.started.driver.exec.task.web_1" {
+		t.Fatalf("bad: %s", name)
+	}
+	if name := flattenKey(key, nil); name != "client.task.started" {
+		t.Fatalf("bad: %s", name)
+	}
+}
+
+func TestInmemSink(t *testing.T) {
+	s := NewInmemSink()
+	key := []string{"restarts"}
+	web := map[string]string{"task": "web"}
+	db := map[string]string{"task": "db"}
+
+	s.IncrCounter(key, 1, web)
+	s.IncrCounter(key, 2, web)
+	s.IncrCounter(key, 1, db)
+	if c := s.Counter(key, web); c != 3 {
+		t.Fatalf("bad: %v", c)
+	}
+	if c := s.Counter(key, db); c != 1 {
+		t.Fatalf("bad: %v", c)
+	}
+
+	if _, ok := s.Gauge(key, web); ok {
+		t.Fatalf("gauge should not be set")
+	}
+	s.SetGauge(key, 5, web)
+	s.SetGauge(key, 4, web)
+	if g, ok := s.Gauge(key, web); !ok || g != 4 {
+		t.Fatalf("bad: %v %v", g, ok)
+	}
+}
+
+// blockingSink blocks every metric until it is released
+type blockingSink struct {
+	*InmemSink
+	releaseCh chan struct{}
+}
+
+func (b *blockingSink) IncrCounter(key []string, val float32, labels map[string]string) {
+	<-b.releaseCh
+	b.InmemSink.IncrCounter(key, val, labels)
+}
+
+func TestBufferedSink_NeverBlocks(t *testing.T) {
+	inner := &blockingSink{InmemSink: NewInmemSink(), releaseCh: make(chan struct{})}
+	b := NewBufferedSink(inner, 2)
+
+	// Emitting must return even though the sink is stuck and the buffer
+	// overflows
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			b.IncrCounter([]string{"c"}, 1, nil)
+		}
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+	case <-time.After(time.Second):
+		t.Fatalf("emitting blocked")
+	}
+	if b.Dropped() == 0 {
+		t.Fatalf("expected dropped metrics")
+	}
+
+	// The buffered metrics are passed on once the sink recovers
+	close(inner.releaseCh)
+	b.Close()
+	c := inner.Counter([]string{"c"}, nil)
+	if c == 0 || float32(b.Dropped())+c != 10 {
+		t.Fatalf("bad: %v passed on, %d dropped", c, b.Dropped())
+	}
+}
+
+func TestBufferedSink_Close(t *testing.T) {
+	inner := NewInmemSink()
+	b := NewBufferedSink(inner, 16)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.IncrCounter([]string{"c"}, 1, nil)
+		}()
+	}
+	b.SetGauge([]string{"g"}, 3, nil)
+	wg.Wait()
+
+	// Closing flushes everything emitted before
+	b.Close()
+	if c := inner.Counter([]string{"c"}, nil); c != 8 {
+		t.Fatalf("bad: %v", c)
+	}
+	if g, _ := inner.Gauge([]string{"g"}, nil); g != 3 {
+		t.Fatalf("bad: %v", g)
+	}
+
+	// Closing twice is safe
+	b.Close()
+}
@@ -0,0 +1,48 @@
+package metrics
+
+import (
+	"fmt"
+	"net"
+)
+
+// StatsdSink sends metrics to a statsd server over UDP. Statsd has no notion
+// of labels, so they are flattened into the name of the metric.
+type StatsdSink struct {
+	prefix string
+	conn   net.Conn
+}
+
+// NewStatsdSink returns a sink sending to the statsd server at addr. The
+// names of the metrics are prefixed with prefix, if set.
+func NewStatsdSink(addr, prefix string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to statsd at %s: %v", addr, err)
+	}
+	return &StatsdSink{prefix: prefix, conn: conn}, nil
+}
+
+// IncrCounter sends the counter increment
+func (s *StatsdSink) IncrCounter(key []string, val float32, labels map[string]string) {
+	s.send(key, labels, fmt.Sprintf("%f|c", val))
+}
+
+// SetGauge sends the gauge value
+func (s *StatsdSink) SetGauge(key []string, val float32, labels map[string]string) {
+	s.send(key, labels, fmt.Sprintf("%f|g", val))
+}
+
+// Close closes the connection to the statsd server
+func (s *StatsdSink) Close() error {
+	return s.conn.Close()
+}
+
+// send writes a single metric. Errors are ignored as metrics are best
+// effort.
+func (s *StatsdSink) send(key []string, labels map[string]string, value string) {
+	name := flattenKey(key, labels)
+	if s.prefix != "" {
+		name = s.prefix + "." + name
+	}
+	s.conn.Write([]byte(name + ":" + value))
+}
@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer conn.Close()
+
+	s, err := NewStatsdSink(conn.LocalAddr().String(), "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer s.Close()
+
+	labels := map[string]string{"task": "web", "driver": "exec"}
+	s.IncrCounter([]string{"client", "task", "restarts"}, 1, labels)
+	s.SetGauge([]string{"client", "task", "running"}, 0, labels)
+
+	exp := []string{
+		"nomad.client.task.restarts.driver.exec.task.web:1.000000|c",
+		"nomad.client.task.running.driver.exec.task.web:0.000000|g",
+	}
+	buf := make([]byte, 512)
+	for _, e := range exp {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if got := string(buf[:n]); got != e {
+			t.Fatalf("got %q; want %q", got, e)
+		}
+	}
+}
@@ -0,0 +1,335 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func init() {
+	driver.BuiltinDrivers["mock_driver"] = newMockDriver
+}
+
+// mockDriver is a driver used to test the task runner without depending
+// on the host. Its behavior is controlled by the task config:
+//
+//	run_for:   how long the task runs before exiting, e.g. "10ms"
+//	exit_err:  the error returned on the wait channel when the task exits
+//	exit_code: the exit code of the task when it exits
+//	exit_signal: the signal the task is killed by when it exits
+//	oom_killed: if set, the task exits as if killed for running out of memory
+//	validate_err: the error returned by Validate
+//	start_err: the error returned by Start
+//	start_delay: how long Start takes, e.g. "10ms", unless it is cancelled
+//	open_err:  the error returned by Open when re-attaching
+//	update_err: the error returned by Update when set on the updated task
+//	open_lost: if set, Open fails as if the task had exited while the client
+//	           was down
+//	open_incompatible: if set, Open fails as if the handle were of a version
+//	           the driver doesn't understand
+//	ignore_kill: if set, Kill does not stop the task; only ForceKill does
+//	stats:     the CPU percent and RSS returned by successive calls to Stats,
+//	           e.g. "10:1024,20:2048"; the last sample repeats
+//	stats_unsupported: if set, Stats returns a not supported error
+//	signal_unsupported: if set, Signal returns a not supported error
+//	exec_unsupported: if set, Exec returns a not supported error
+//	exec_exit_code: the exit code of exec'd commands, whose output is the
+//	           command itself
+//	write_local: the number of bytes the task writes into local/data once
+//	           started
+type mockDriver struct {
+	driver.DriverContext
+}
+
+// mockDriverVersion is the version reported by the mock driver
+var mockDriverVersion = "1.0.0"
+
+// mockDriverFSIsolation is the filesystem isolation the mock driver claims
+var mockDriverFSIsolation = driver.FSIsolationChroot
+
+func newMockDriver(ctx *driver.DriverContext) driver.Driver {
+	return &mockDriver{*ctx}
+}
+
+// Fingerprint detects the mock driver unless the "driver.mock_driver.absent"
+// option is set
+func (d *mockDriver) Fingerprint(cfg *config.Config, node *structs.Node) (bool, error) {
+	if cfg.Read("driver.mock_driver.absent") != "" {
+		return false, nil
+	}
+	node.Attributes["driver.mock_driver"] = "1"
+	node.Attributes["driver.mock_driver.version"] = "0.1.0"
+	return true, nil
+}
+
+func (d *mockDriver) Version() (string, error) {
+	return mockDriverVersion, nil
+}
+
+func (d *mockDriver) Capabilities() *driver.DriverCapabilities {
+	return &driver.DriverCapabilities{
+		Exec:         true,
+		Signals:      true,
+		FSIsolation:  mockDriverFSIsolation,
+		NetworkModes: []string{driver.NetworkModeHost},
+	}
+}
+
+func (d *mockDriver) Cleanup(activeHandleIDs []string) error {
+	return nil
+}
+
+func (d *mockDriver) Validate(task *structs.Task) error {
+	if msg := task.Config["validate_err"]; msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// mockStarts counts the mock tasks with a start delay being started at once,
+// and the most ever started at once
+var mockStarts struct {
+	sync.Mutex
+	running, max int
+}
+
+func (d *mockDriver) Start(ctx context.Context, execCtx *driver.ExecContext, task *structs.Task) (driver.DriverHandle, error) {
+	if raw := task.Config["start_delay"]; raw != "" {
+		delay, err := time.ParseDuration(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid start_delay '%s': %v", raw, err)
+		}
+		mockStarts.Lock()
+		mockStarts.running++
+		if mockStarts.running > mockStarts.max {
+			mockStarts.max = mockStarts.running
+		}
+		mockStarts.Unlock()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+		mockStarts.Lock()
+		mockStarts.running--
+		mockStarts.Unlock()
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if msg := task.Config["start_err"]; msg != "" {
+		return nil, errors.New(msg)
+	}
+	if raw := task.Config["write_local"]; raw != "" {
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid write_local '%s': %v", raw, err)
+		}
+		path := filepath.Join(execCtx.AllocDir.LocalDir(task.Name), "data")
+		if err := ioutil.WriteFile(path, make([]byte, n), 0666); err != nil {
+			return nil, err
+		}
+	}
+	return newMockHandle(task.Config)
+}
+
+func (d *mockDriver) Open(ctx context.Context, execCtx *driver.ExecContext, handleID string) (driver.DriverHandle, error) {
+	var conf map[string]string
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(handleID, "MOCK:")), &conf); err != nil {
+		return nil, fmt.Errorf("failed to parse handle '%s': %v", handleID, err)
+	}
+	if msg := conf["open_err"]; msg != "" {
+		return nil, errors.New(msg)
+	}
+	if conf["open_lost"] != "" {
+		return nil, &driver.TaskLostError{Reason: "process was killed"}
+	}
+	if conf["open_incompatible"] != "" {
+		return nil, &driver.IncompatibleHandleError{Version: 1, MinVersion: 2, MaxVersion: 2}
+	}
+	return newMockHandle(conf)
+}
+
+// mockHandle is the handle returned by the mock driver
+type mockHandle struct {
+	config   map[string]string
+	waitCh   chan *driver.WaitResult
+	killCh   chan struct{}
+	killOnce sync.Once
+
+	// killedAt is when Kill was first called
+	killedAt time.Time
+	killLock sync.Mutex
+
+	// signals records the signals sent to the task
+	signals    []os.Signal
+	signalLock sync.Mutex
+
+	// statsCalls counts the calls to Stats
+	statsCalls int
+	statsLock  sync.Mutex
+
+	// updates records the tasks passed to Update
+	updates    []*structs.Task
+	updateLock sync.Mutex
+}
+
+func newMockHandle(conf map[string]string) (*mockHandle, error) {
+	var runFor time.Duration
+	if raw := conf["run_for"]; raw != "" {
+		var err error
+		if runFor, err = time.ParseDuration(raw); err != nil {
+			return nil, fmt.Errorf("invalid run_for '%s': %v", raw, err)
+		}
+	}
+
+	h := &mockHandle{
+		config: conf,
+		waitCh: make(chan *driver.WaitResult, 1),
+		killCh: make(chan struct{}),
+	}
+	go h.run(runFor)
+	return h, nil
+}
+
+func (h *mockHandle) ID() string {
+	data, _ := json.Marshal(h.config)
+	return fmt.Sprintf("MOCK:%s", data)
+}
+
+func (h *mockHandle) WaitCh() chan *driver.WaitResult {
+	return h.waitCh
+}
+
+func (h *mockHandle) Update(task *structs.Task) error {
+	if msg := task.Config["update_err"]; msg != "" {
+		return errors.New(msg)
+	}
+	h.updateLock.Lock()
+	defer h.updateLock.Unlock()
+	h.updates = append(h.updates, task)
+	return nil
+}
+
+func (h *mockHandle) Kill() error {
+	h.killLock.Lock()
+	if h.killedAt.IsZero() {
+		h.killedAt = time.Now()
+	}
+	h.killLock.Unlock()
+	if h.config["ignore_kill"] != "" {
+		return nil
+	}
+	return h.ForceKill()
+}
+
+func (h *mockHandle) ForceKill() error {
+	h.killOnce.Do(func() { close(h.killCh) })
+	return nil
+}
+
+func (h *mockHandle) Signal(sig os.Signal) error {
+	if h.config["signal_unsupported"] != "" {
+		return &driver.NotSupportedError{Driver: "mock_driver", Operation: "signals"}
+	}
+	h.signalLock.Lock()
+	defer h.signalLock.Unlock()
+	h.signals = append(h.signals, sig)
+	return nil
+}
+
+func (h *mockHandle) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	if h.config["exec_unsupported"] != "" {
+		return nil, 0, &driver.NotSupportedError{Driver: "mock_driver", Operation: "exec"}
+	}
+	code := 0
+	if c := h.config["exec_exit_code"]; c != "" {
+		var err error
+		if code, err = strconv.Atoi(c); err != nil {
+			return nil, 0, fmt.Errorf("invalid exec_exit_code '%s': %v", c, err)
+		}
+	}
+	return []byte(strings.Join(cmd, " ")), code, nil
+}
+
+func (h *mockHandle) Stats() (*driver.TaskResourceUsage, error) {
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+	h.statsCalls++
+	if h.config["stats_unsupported"] != "" {
+		return nil, &driver.NotSupportedError{Driver: "mock_driver", Operation: "stats"}
+	}
+
+	samples := strings.Split(h.config["stats"], ",")
+	idx := h.statsCalls - 1
+	if idx >= len(samples) {
+		idx = len(samples) - 1
+	}
+	var cpu float64
+	var rss uint64
+	if _, err := fmt.Sscanf(samples[idx], "%g:%d", &cpu, &rss); err != nil {
+		return nil, fmt.Errorf("invalid stats sample '%s': %v", samples[idx], err)
+	}
+	return &driver.TaskResourceUsage{
+		CPUPercent: cpu,
+		MemoryRSS:  rss,
+		Timestamp:  time.Now(),
+	}, nil
+}
+
+// numStatsCalls returns the number of calls to Stats so far
+func (h *mockHandle) numStatsCalls() int {
+	h.statsLock.Lock()
+	defer h.statsLock.Unlock()
+	return h.statsCalls
+}
+
+// killTime returns when Kill was first called, or the zero time
+func (h *mockHandle) killTime() time.Time {
+	h.killLock.Lock()
+	defer h.killLock.Unlock()
+	return h.killedAt
+}
+
+// receivedSignals returns the signals sent to the task so far
+func (h *mockHandle) receivedSignals() []os.Signal {
+	h.signalLock.Lock()
+	defer h.signalLock.Unlock()
+	return append([]os.Signal(nil), h.signals...)
+}
+
+// receivedUpdates returns the tasks passed to Update so far
+func (h *mockHandle) receivedUpdates() []*structs.Task {
+	h.updateLock.Lock()
+	defer h.updateLock.Unlock()
+	return append([]*structs.Task(nil), h.updates...)
+}
+
+func (h *mockHandle) run(runFor time.Duration) {
+	select {
+	case <-time.After(runFor):
+		var err error
+		if msg := h.config["exit_err"]; msg != "" {
+			err = errors.New(msg)
+		}
+		code, _ := strconv.Atoi(h.config["exit_code"])
+		signal, _ := strconv.Atoi(h.config["exit_signal"])
+		res := driver.NewWaitResult(code, signal, err)
+		res.OOMKilled = h.config["oom_killed"] != ""
+		h.waitCh <- res
+	case <-h.killCh:
+		h.waitCh <- driver.NewWaitResult(0, 0, errors.New("killed"))
+	}
+	close(h.waitCh)
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+// statePersister saves a state at most once per interval, however often it
+// changes. A change within the interval of the last save is saved once the
+// interval is over, along with the changes that follow it meanwhile, while a
+// flush saves the state at once. The saves are serialized by its lock.
+type statePersister struct {
+	save     func() error
+	interval time.Duration
+	clock    config.Clock
+	logger   *log.Logger
+
+	// name identifies the state in logs
+	name string
+
+	// last is when the state was last saved, and pending whether a save
+	// is scheduled after it. Once stopped the state is no longer saved.
+	last    time.Time
+	pending bool
+	stopped bool
+	lock    sync.Mutex
+}
+
+// newStatePersister returns a persister saving the state with save at most
+// once per interval. A zero interval saves each change at once.
+func newStatePersister(name string, save func() error, interval time.Duration, clock config.Clock, logger *log.Logger) *statePersister {
+	return &statePersister{
+		name:     name,
+		save:     save,
+		interval: interval,
+		clock:    clock,
+		logger:   logger,
+	}
+}
+
+// persist records a change of the state, saving it now if the interval since
+// the last save is over and once it is otherwise
+func (p *statePersister) persist() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped || p.pending {
+		return
+	}
+	if wait := p.last.Add(p.interval).Sub(p.clock.Now()); wait > 0 {
+		p.pending = true
+		go p.saveAfter(wait)
+		return
+	}
+	p.saveLocked()
+}
+
+// saveAfter saves the pending changes once wait has passed, unless a flush
+// saved them meanwhile
+func (p *statePersister) saveAfter(wait time.Duration) {
+	<-p.clock.After(wait)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.pending && !p.stopped {
+		p.saveLocked()
+	}
+}
+
+// flush saves the state now, along with any pending changes, such as once
+// the task exits so its final state is never lost
+func (p *statePersister) flush() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.stopped {
+		return nil
+	}
+	return p.saveLocked()
+}
+
+// stop stops saving the state, dropping the pending changes, such as once
+// the state is destroyed
+func (p *statePersister) stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.stopped = true
+	p.pending = false
+}
+
+// saveLocked saves the state. The lock must be held.
+func (p *statePersister) saveLocked() error {
+	p.pending = false
+	p.last = p.clock.Now()
+	err := p.save()
+	if err != nil {
+		p.logger.Printf("[ERR] client: failed to save state of %s: %v", p.name, err)
+	}
+	return err
+}
@@ -0,0 +1,194 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+// saveCounter counts the saves of a persister
+type saveCounter struct {
+	saves int
+	lock  sync.Mutex
+}
+
+func (c *saveCounter) save() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.saves++
+	return nil
+}
+
+func (c *saveCounter) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.saves
+}
+
+func TestStatePersister(t *testing.T) {
+	clock := newFakeClock()
+	var c saveCounter
+	p := newStatePersister("test", c.save, time.Second, clock, testLogger())
+
+	// The first change is saved at once, and the ones following it within
+	// the interval once it is over
+	for i := 0; i < 100; i++ {
+		p.persist()
+	}
+	if n := c.count(); n != 1 {
+		t.Fatalf("saved %d times", n)
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		return clock.Waiters() == 1, nil
+	}, func(err error) {
+		t.Fatalf("save not scheduled")
+	})
+	clock.Advance(time.Second)
+	testutil.WaitForResult(func() (bool, error) {
+		return c.count() == 2, nil
+	}, func(err error) {
+		t.Fatalf("saved %d times", c.count())
+	})
+
+	// A flush saves at once, including the pending changes
+	p.persist()
+	if err := p.flush(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := c.count(); n != 3 {
+		t.Fatalf("saved %d times", n)
+	}
+	clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := c.count(); n != 3 {
+		t.Fatalf("saved %d times", n)
+	}
+
+	// Once stopped nothing is saved
+	p.stop()
+	p.persist()
+	p.flush()
+	clock.Advance(time.Second)
+	time.Sleep(50 * time.Millisecond)
+	if n := c.count(); n != 3 {
+		t.Fatalf("saved %d times", n)
+	}
+
+	// A zero interval saves each change at once
+	p = newStatePersister("test", c.save, 0, clock, testLogger())
+	p.persist()
+	p.persist()
+	if n := c.count(); n != 5 {
+		t.Fatalf("saved %d times", n)
+	}
+	if n := clock.Waiters(); n != 0 {
+		t.Fatalf("%d saves scheduled", n)
+	}
+}
+
+func TestTaskRunner_StateSaveInterval(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "100ms"})
+	tr.config.StateSaveInterval = time.Hour
+
+	// The saves are counted, along with the last event of the state saved
+	var c saveCounter
+	var lastSaved string
+	tr.persister = newStatePersister("test", func() error {
+		c.save()
+		if err := tr.saveState(); err != nil {
+			return err
+		}
+		buf, err := ioutil.ReadFile(tr.stateFilePath())
+		if err != nil {
+			return err
+		}
+		var snap taskRunnerState
+		if err := decodeState(buf, &snap); err != nil {
+			return err
+		}
+		c.lock.Lock()
+		lastSaved = snap.Events[len(snap.Events)-1].Type
+		c.lock.Unlock()
+		return nil
+	}, time.Hour, tr.clock, tr.logger)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskStarted) == 1, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	// The events recorded in quick succession are saved once
+	for i := 0; i < 50; i++ {
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetMessage("test"))
+	}
+	if n := c.count(); n != 1 {
+		t.Fatalf("saved %d times", n)
+	}
+
+	// The exit of the task is saved at once, and the state is destroyed
+	// once the runner is done
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if n := c.count(); n != 2 {
+		t.Fatalf("saved %d times", n)
+	}
+	c.lock.Lock()
+	last := lastSaved
+	c.lock.Unlock()
+	if last != structs.TaskTerminated {
+		t.Fatalf("exit not saved, last event saved: %s", last)
+	}
+	if _, err := os.Stat(tr.stateFilePath()); !os.IsNotExist(err) {
+		t.Fatalf("state not destroyed: %v", err)
+	}
+
+	// Nothing is saved once the state is destroyed
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := c.count(); n != 2 {
+		t.Fatalf("saved %d times", n)
+	}
+}
+
+func TestTaskRunner_StateSaveInterval_Zero(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskStarted) == 1, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	// Without an interval each event is saved as it is recorded
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetMessage("test"))
+	buf, err := ioutil.ReadFile(tr.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var snap taskRunnerState
+	if err := decodeState(buf, &snap); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if last := snap.Events[len(snap.Events)-1]; last.Type != structs.TaskSignaling {
+		t.Fatalf("event not saved: %#v", snap.Events)
+	}
+	if snap.HandleID == "" {
+		t.Fatalf("handle not saved")
+	}
+}
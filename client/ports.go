@@ -0,0 +1,107 @@
+package client
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+)
+
+// portAllocator tracks the host ports claimed by the tasks of the client on
+// each of its addresses. Ports are handed out from a range, skipping those
+// already claimed by a task or bound by another process on the host.
+type portAllocator struct {
+	min, max int
+
+	// claimed are the claimed ports by IP
+	claimed map[string]map[int]struct{}
+	lock    sync.Mutex
+
+	// inUse returns whether the port is bound on the host
+	inUse func(ip string, port int) bool
+}
+
+// newPortAllocator returns an allocator handing out ports from min to max,
+// both included
+func newPortAllocator(min, max int) (*portAllocator, error) {
+	if min <= 0 || max > 65535 || min > max {
+		return nil, fmt.Errorf("invalid port range %d-%d", min, max)
+	}
+	return &portAllocator{
+		min:     min,
+		max:     max,
+		claimed: make(map[string]map[int]struct{}),
+		inUse:   addrInUse,
+	}, nil
+}
+
+// Allocate returns n ports on the IP that are neither claimed nor bound on
+// the host, and claims them. The range is scanned from a random port so
+// allocations are spread over it.
+func (a *portAllocator) Allocate(ip string, n int) ([]int, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	claimed := a.claimed[ip]
+	size := a.max - a.min + 1
+	start := rand.Intn(size)
+	ports := make([]int, 0, n)
+	for i := 0; i < size && len(ports) < n; i++ {
+		port := a.min + (start+i)%size
+		if _, ok := claimed[port]; ok {
+			continue
+		}
+		if a.inUse(ip, port) {
+			continue
+		}
+		ports = append(ports, port)
+	}
+	if len(ports) < n {
+		return nil, fmt.Errorf("only %d of %d ports available in %d-%d on %s",
+			len(ports), n, a.min, a.max, ip)
+	}
+
+	a.claim(ip, ports)
+	return ports, nil
+}
+
+// Reserve claims the given ports on the IP, failing without claiming any of
+// them if one is already claimed
+func (a *portAllocator) Reserve(ip string, ports []int) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	claimed := a.claimed[ip]
+	for _, port := range ports {
+		if _, ok := claimed[port]; ok {
+			return fmt.Errorf("port %d on %s is already claimed by another task", port, ip)
+		}
+	}
+	a.claim(ip, ports)
+	return nil
+}
+
+// Release frees the given ports on the IP
+func (a *portAllocator) Release(ip string, ports []int) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	claimed := a.claimed[ip]
+	for _, port := range ports {
+		delete(claimed, port)
+	}
+	if len(claimed) == 0 {
+		delete(a.claimed, ip)
+	}
+}
+
+// claim marks the ports as claimed on the IP. The lock must be held.
+func (a *portAllocator) claim(ip string, ports []int) {
+	claimed, ok := a.claimed[ip]
+	if !ok {
+		claimed = make(map[int]struct{}, len(ports))
+		a.claimed[ip] = claimed
+	}
+	for _, port := range ports {
+		claimed[port] = struct{}{}
+	}
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+var _ config.PortAllocator = &portAllocator{}
+
+func TestPortAllocator_Allocate(t *testing.T) {
+	a, err := newPortAllocator(20000, 20999)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a.inUse = func(string, int) bool { return false }
+
+	// Allocate concurrently until the range is exhausted
+	var lock sync.Mutex
+	seen := make(map[int]struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ports, err := a.Allocate("10.0.0.1", 100)
+			if err != nil {
+				t.Errorf("err: %v", err)
+				return
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			for _, port := range ports {
+				if port < 20000 || port > 20999 {
+					t.Errorf("port %d out of range", port)
+				}
+				if _, ok := seen[port]; ok {
+					t.Errorf("port %d allocated twice", port)
+				}
+				seen[port] = struct{}{}
+			}
+		}()
+	}
+	wg.Wait()
+	if len(seen) != 1000 {
+		t.Fatalf("bad: %d ports", len(seen))
+	}
+	if _, err := a.Allocate("10.0.0.1", 1); err == nil {
+		t.Fatalf("expected exhausted range")
+	}
+
+	// Ports are claimed per address
+	if _, err := a.Allocate("10.0.0.2", 1000); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Released ports are handed out again
+	a.Release("10.0.0.1", []int{20500, 20501})
+	ports, err := a.Allocate("10.0.0.1", 2)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !(ports[0] == 20500 && ports[1] == 20501) && !(ports[0] == 20501 && ports[1] == 20500) {
+		t.Fatalf("bad: %v", ports)
+	}
+}
+
+func TestPortAllocator_Bound(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// The only other port of the range is handed out
+	a, err := newPortAllocator(port, port+1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	ports, err := a.Allocate("127.0.0.1", 1)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if ports[0] != port+1 {
+		t.Fatalf("bound port %d allocated", ports[0])
+	}
+	if _, err := a.Allocate("127.0.0.1", 1); err == nil {
+		t.Fatalf("expected exhausted range")
+	}
+}
+
+func TestPortAllocator_Reserve(t *testing.T) {
+	a, err := newPortAllocator(20000, 20009)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	a.inUse = func(string, int) bool { return false }
+
+	if err := a.Reserve("10.0.0.1", []int{22, 20000}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err = a.Reserve("10.0.0.1", []int{8080, 22})
+	if err == nil || !strings.Contains(err.Error(), "port 22") {
+		t.Fatalf("expected conflict: %v", err)
+	}
+
+	// A failed reservation claims nothing
+	if err := a.Reserve("10.0.0.1", []int{8080}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Reserved ports are not allocated
+	ports, err := a.Allocate("10.0.0.1", 9)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, port := range ports {
+		if port == 20000 {
+			t.Fatalf("reserved port allocated: %v", ports)
+		}
+	}
+
+	if _, err := newPortAllocator(30000, 20000); err == nil {
+		t.Fatalf("expected invalid range")
+	}
+}
+
+func TestTaskRunner_PortReservation(t *testing.T) {
+	allocator, err := newPortAllocator(structs.MinDynamicPort, structs.MaxDynamicPort)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	upd1, tr1 := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr1.ctx.AllocDir.Destroy()
+	tr1.config.PortAllocator = allocator
+	go tr1.Run()
+	waitDescription(t, upd1, "task started")
+
+	// Another task claiming the same ports on the node fails
+	upd2, tr2 := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr2.ctx.AllocDir.Destroy()
+	tr2.config.PortAllocator = allocator
+	tr2.task.Resources = tr1.task.Resources
+	go tr2.Run()
+	select {
+	case <-tr2.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd2.lastStatus(); status != structs.AllocClientStatusFailed {
+		t.Fatalf("bad: %s", status)
+	}
+	if n := countEvents(tr2, structs.TaskPortConflict); n != 1 {
+		t.Fatalf("bad: %#v", tr2.Events())
+	}
+
+	// The ports are released once the task runner exits
+	tr1.Destroy()
+	<-tr1.WaitCh()
+	network := tr1.task.Resources.Networks[0]
+	if err := allocator.Reserve(network.IP, network.ReservedPorts); err != nil {
+		t.Fatalf("ports not released: %v", err)
+	}
+}
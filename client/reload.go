@@ -0,0 +1,71 @@
+package client
+
+import (
+	"reflect"
+
+	"github.com/hashicorp/nomad/client/config"
+)
+
+// Reload applies the changes of the config to the running client, leaving
+// its tasks running. The options of the drivers and fingerprinters, the task
+// log levels and the resources reserved on the node are reloaded: tasks log
+// at their new level right away and use the new options the next time they
+// are started, and allocations are admitted within the new reservations,
+// which the node is registered again with. Changes to the other fields it
+// checks, such as the state dir, only apply once the client is restarted and
+// are ignored with a warning.
+func (c *Client) Reload(newConfig *config.Config) error {
+	if err := ValidateLogLevels(newConfig); err != nil {
+		return err
+	}
+	for _, field := range restartRequired(c.config, newConfig) {
+		c.logger.Printf("[WARN] client: ignoring the change of %s on reload, which requires a restart", field)
+	}
+
+	reregister := false
+	if newConfig.Node != nil {
+		reregister = !reflect.DeepEqual(c.config.ReadNode().Reserved, newConfig.Node.Reserved)
+	}
+	c.config.Reload(newConfig)
+
+	c.allocLock.RLock()
+	for _, ar := range c.allocs {
+		ar.Reload()
+	}
+	c.allocLock.RUnlock()
+
+	if reregister {
+		select {
+		case c.reregisterCh <- struct{}{}:
+		default:
+		}
+	}
+	c.logger.Printf("[INFO] client: reloaded config")
+	return nil
+}
+
+// restartRequired returns the fields that changed in the new config which
+// can't be changed while the client runs
+func restartRequired(old, new *config.Config) []string {
+	var fields []string
+	if old.DevMode != new.DevMode {
+		fields = append(fields, "dev mode")
+	}
+	if old.StateDir != new.StateDir {
+		fields = append(fields, "state dir")
+	}
+	if old.StateFormat != new.StateFormat {
+		fields = append(fields, "state format")
+	}
+	// The client picks an alloc dir if it is given none
+	if new.AllocDir != "" && old.AllocDir != new.AllocDir {
+		fields = append(fields, "alloc dir")
+	}
+	if old.Region != new.Region {
+		fields = append(fields, "region")
+	}
+	if old.LogJSON != new.LogJSON {
+		fields = append(fields, "JSON logging")
+	}
+	return fields
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// lockedBuffer is a buffer logs can be written to concurrently
+type lockedBuffer struct {
+	buf  bytes.Buffer
+	lock sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestClient_Reload(t *testing.T) {
+	var out lockedBuffer
+	c := testClient(t, func(c *config.Config) {
+		c.LogOutput = &out
+		c.TaskLogLevel = "WARN"
+	})
+	defer c.Shutdown()
+
+	// Run a task in an alloc of the client
+	alloc := mock.Alloc()
+	task := alloc.Job.TaskGroups[0].Tasks[0]
+	task.Driver = "mock_driver"
+	task.Config = map[string]string{"run_for": "10s"}
+	ar := NewAllocRunner(testLogger(), c.config, (&MockAllocStateUpdater{}).Update, alloc)
+	c.allocLock.Lock()
+	c.allocs[alloc.ID] = ar
+	c.allocLock.Unlock()
+	go ar.Run()
+	defer ar.Destroy()
+	tr := taskRunner(t, ar, task.Name)
+	started := startedAt(t, tr)
+
+	tr.logger.Printf("[DEBUG] client: before reload")
+	if strings.Contains(out.String(), "before reload") {
+		t.Fatalf("logged below the task log level: %s", out.String())
+	}
+
+	newConf := DefaultConfig()
+	newConf.DevMode = true
+	newConf.TaskLogLevel = "DEBUG"
+	newConf.Options = map[string]string{"driver.mock_driver.foo": "bar"}
+	newConf.StateDir = "/nonexistent"
+	newConf.Node = &structs.Node{Reserved: &structs.Resources{CPU: 100}}
+	if err := c.Reload(newConf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The running task logs at the new level
+	tr.logger.Printf("[DEBUG] client: after reload")
+	if !strings.Contains(out.String(), "after reload") {
+		t.Fatalf("not logged at the reloaded level: %s", out.String())
+	}
+
+	// It was left running
+	select {
+	case <-tr.WaitCh():
+		t.Fatalf("task stopped")
+	default:
+	}
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskStarted && e.Time != started {
+			t.Fatalf("task restarted: %#v", tr.Events())
+		}
+	}
+
+	// The options and reservations are reloaded, and the state dir is not
+	if v := c.config.Read("driver.mock_driver.foo"); v != "bar" {
+		t.Fatalf("option not reloaded: %q", v)
+	}
+	if reserved := c.config.ReadNode().Reserved; reserved == nil || reserved.CPU != 100 {
+		t.Fatalf("reservations not reloaded: %#v", reserved)
+	}
+	if c.config.StateDir == "/nonexistent" {
+		t.Fatalf("state dir reloaded")
+	}
+	if !strings.Contains(out.String(), "ignoring the change of state dir") {
+		t.Fatalf("change of state dir not logged: %s", out.String())
+	}
+}
+
+func TestClient_Reload_InvalidLogLevel(t *testing.T) {
+	c := testClient(t, func(c *config.Config) {
+		c.TaskLogLevel = "WARN"
+	})
+	defer c.Shutdown()
+
+	newConf := DefaultConfig()
+	newConf.TaskLogLevel = "LOUD"
+	if err := c.Reload(newConf); err == nil {
+		t.Fatalf("expected error")
+	}
+	if level := c.config.ReadTaskLogLevel("web"); level != "WARN" {
+		t.Fatalf("log level changed to %q", level)
+	}
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// defaultOversubscriptionFactor is how many times its capacity an
+// oversubscribed node may be claimed if the client does not configure it
+const defaultOversubscriptionFactor = 1.5
+
+// resourceTracker tracks the CPU and memory claimed by the allocations of the
+// client against the capacity of the node. Allocations that don't fit wait in
+// a queue and are admitted in arrival order as others release theirs. Those
+// that exceed the capacity of the whole node never fit, so they are passed
+// over rather than holding up the queue.
+type resourceTracker struct {
+	// capacity returns the resources of the node available to allocations.
+	// A zero value leaves that resource untracked.
+	capacity func() *structs.Resources
+
+	// oversubscription is how many times the capacity the allocations may
+	// claim together, with each still fitting in the capacity. The
+	// capacity is claimed once if zero.
+	oversubscription float64
+
+	lock    sync.Mutex
+	claimed map[string]*structs.Resources
+	queue   []*resourceWaiter
+}
+
+// resourceWaiter is an allocation queued for resources. readyCh is closed
+// once its resources are claimed.
+type resourceWaiter struct {
+	allocID   string
+	resources *structs.Resources
+	readyCh   chan struct{}
+}
+
+// newResourceTracker returns a tracker of the resources returned by capacity,
+// which is called whenever the free resources are computed
+func newResourceTracker(capacity func() *structs.Resources) *resourceTracker {
+	return &resourceTracker{
+		capacity: capacity,
+		claimed:  make(map[string]*structs.Resources),
+	}
+}
+
+// nodeCapacity returns the resources of the node left to allocations once
+// the reserved ones are taken out
+func nodeCapacity(node *structs.Node) *structs.Resources {
+	capacity := &structs.Resources{}
+	if node == nil || node.Resources == nil {
+		return capacity
+	}
+	capacity.CPU = node.Resources.CPU
+	capacity.MemoryMB = node.Resources.MemoryMB
+	if node.Reserved != nil {
+		capacity.CPU -= node.Reserved.CPU
+		capacity.MemoryMB -= node.Reserved.MemoryMB
+	}
+	return capacity
+}
+
+func (t *resourceTracker) TryClaim(allocID string, resources *structs.Resources) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	capacity := t.capacity()
+	ahead := 0
+	for _, w := range t.queue {
+		if exceeds(w.resources, capacity) == nil {
+			ahead++
+		}
+	}
+	if ahead != 0 {
+		return fmt.Errorf("%d allocations are waiting for resources ahead of it", ahead)
+	}
+	if err := t.fits(resources); err != nil {
+		return err
+	}
+	t.claimed[allocID] = resources
+	return nil
+}
+
+func (t *resourceTracker) Claim(allocID string, resources *structs.Resources, abortCh <-chan struct{}) bool {
+	w := &resourceWaiter{allocID: allocID, resources: resources, readyCh: make(chan struct{})}
+	t.lock.Lock()
+	t.queue = append(t.queue, w)
+	t.admit()
+	t.lock.Unlock()
+
+	select {
+	case <-w.readyCh:
+		return true
+	case <-abortCh:
+	}
+
+	// The resources may have been claimed in the meantime, in which case
+	// they are handed back
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	select {
+	case <-w.readyCh:
+		delete(t.claimed, allocID)
+	default:
+		for i, queued := range t.queue {
+			if queued == w {
+				t.queue = append(t.queue[:i], t.queue[i+1:]...)
+				break
+			}
+		}
+	}
+	t.admit()
+	return false
+}
+
+func (t *resourceTracker) Restore(allocID string, resources *structs.Resources) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.claimed[allocID] = resources
+}
+
+func (t *resourceTracker) Release(allocID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.claimed, allocID)
+	t.admit()
+}
+
+// admit claims the resources of the queued allocations that fit, in order,
+// stopping at the first one that doesn't. The lock must be held.
+func (t *resourceTracker) admit() {
+	capacity := t.capacity()
+	var queue []*resourceWaiter
+	blocked := false
+	for _, w := range t.queue {
+		if blocked || exceeds(w.resources, capacity) != nil {
+			queue = append(queue, w)
+			continue
+		}
+		if t.fits(w.resources) != nil {
+			blocked = true
+			queue = append(queue, w)
+			continue
+		}
+		t.claimed[w.allocID] = w.resources
+		close(w.readyCh)
+	}
+	t.queue = queue
+}
+
+// fits returns why the resources don't fit in what is left of the capacity,
+// if they don't. The lock must be held.
+func (t *resourceTracker) fits(resources *structs.Resources) error {
+	capacity := t.capacity()
+	if err := exceeds(resources, capacity); err != nil {
+		return err
+	}
+	free := *capacity
+	if t.oversubscription > 1 {
+		free.CPU = int(float64(free.CPU) * t.oversubscription)
+		free.MemoryMB = int(float64(free.MemoryMB) * t.oversubscription)
+	}
+	for _, claimed := range t.claimed {
+		free.CPU -= claimed.CPU
+		free.MemoryMB -= claimed.MemoryMB
+	}
+	if capacity.CPU > 0 && resources.CPU > free.CPU {
+		return fmt.Errorf("not enough CPU: %d MHz requested, %d MHz free", resources.CPU, free.CPU)
+	}
+	if capacity.MemoryMB > 0 && resources.MemoryMB > free.MemoryMB {
+		return fmt.Errorf("not enough memory: %d MB requested, %d MB free", resources.MemoryMB, free.MemoryMB)
+	}
+	return nil
+}
+
+// exceeds returns an error if the resources are more than the capacity of the
+// node, so they never fit
+func exceeds(resources, capacity *structs.Resources) error {
+	if capacity.CPU > 0 && resources.CPU > capacity.CPU {
+		return fmt.Errorf("%d MHz of CPU requested exceeds the %d MHz of the node", resources.CPU, capacity.CPU)
+	}
+	if capacity.MemoryMB > 0 && resources.MemoryMB > capacity.MemoryMB {
+		return fmt.Errorf("%d MB of memory requested exceeds the %d MB of the node", resources.MemoryMB, capacity.MemoryMB)
+	}
+	return nil
+}
+
+// priorityOOMScoreAdj returns the oom_score_adj of the tasks of a job of
+// the priority on an oversubscribed node, from 490 at the lowest priority to
+// -500 at the highest, so the lowest priority tasks are killed first when
+// the node runs out of memory. The default priority gets zero.
+func priorityOOMScoreAdj(priority int) int {
+	if priority <= 0 {
+		priority = structs.JobDefaultPriority
+	}
+	return (structs.JobDefaultPriority - priority) * 10
+}
+
+// priorityCPUShares returns the CPU shares of a task of the CPU in MHz and
+// the priority of its job on an oversubscribed node, weighting the CPU by
+// the priority relative to the default so lower priority tasks are
+// throttled more when the CPU is contended
+func priorityCPUShares(cpu, priority int) int {
+	if priority <= 0 {
+		priority = structs.JobDefaultPriority
+	}
+	shares := cpu * priority / structs.JobDefaultPriority
+	if shares < 2 {
+		// The lowest number of shares cgroups allow
+		shares = 2
+	}
+	return shares
+}
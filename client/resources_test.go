@@ -0,0 +1,218 @@
+package client
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+var _ config.ResourceTracker = &resourceTracker{}
+
+func testResourceTracker(cpu, memoryMB int) *resourceTracker {
+	return newResourceTracker(func() *structs.Resources {
+		return &structs.Resources{CPU: cpu, MemoryMB: memoryMB}
+	})
+}
+
+// claimAsync claims the resources in the background, returning a channel
+// receiving whether they were claimed
+func claimAsync(tracker *resourceTracker, allocID string, resources *structs.Resources, abortCh <-chan struct{}) <-chan bool {
+	doneCh := make(chan bool, 1)
+	go func() {
+		doneCh <- tracker.Claim(allocID, resources, abortCh)
+	}()
+	return doneCh
+}
+
+func TestResourceTracker_TryClaim(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	if err := tracker.TryClaim("a", &structs.Resources{CPU: 600, MemoryMB: 512}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// What is left is not enough for either resource
+	err := tracker.TryClaim("b", &structs.Resources{CPU: 600, MemoryMB: 256})
+	if err == nil || !strings.Contains(err.Error(), "not enough CPU: 600 MHz requested, 400 MHz free") {
+		t.Fatalf("err: %v", err)
+	}
+	err = tracker.TryClaim("b", &structs.Resources{CPU: 100, MemoryMB: 1024})
+	if err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Releasing frees the resources again
+	tracker.Release("a")
+	if err := tracker.TryClaim("b", &structs.Resources{CPU: 1000, MemoryMB: 1024}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A resource the node has none of is not tracked
+	tracker = testResourceTracker(0, 1024)
+	if err := tracker.TryClaim("a", &structs.Resources{CPU: 5000, MemoryMB: 512}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestResourceTracker_Claim_Order(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	tracker.Restore("running", &structs.Resources{CPU: 1000})
+
+	// The waiting allocations are admitted in the order they arrived, even
+	// if a later one would fit sooner
+	big := claimAsync(tracker, "big", &structs.Resources{CPU: 800}, nil)
+	time.Sleep(50 * time.Millisecond)
+	small := claimAsync(tracker, "small", &structs.Resources{CPU: 200}, nil)
+	time.Sleep(50 * time.Millisecond)
+	if err := tracker.TryClaim("other", &structs.Resources{CPU: 1}); err == nil ||
+		!strings.Contains(err.Error(), "2 allocations are waiting") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tracker.Release("running")
+	for name, ch := range map[string]<-chan bool{"big": big, "small": small} {
+		select {
+		case ok := <-ch:
+			if !ok {
+				t.Fatalf("%s not claimed", name)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%s still blocked", name)
+		}
+	}
+}
+
+func TestResourceTracker_Claim_HeadOfLine(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	tracker.Restore("running", &structs.Resources{CPU: 600})
+
+	// The small one waits behind the big one although it would fit
+	big := claimAsync(tracker, "big", &structs.Resources{CPU: 800}, nil)
+	time.Sleep(50 * time.Millisecond)
+	small := claimAsync(tracker, "small", &structs.Resources{CPU: 200}, nil)
+	select {
+	case <-small:
+		t.Fatalf("admitted ahead of an earlier alloc")
+	case <-big:
+		t.Fatalf("admitted without enough resources")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	tracker.Release("running")
+	for _, ch := range []<-chan bool{big, small} {
+		select {
+		case <-ch:
+		case <-time.After(time.Second):
+			t.Fatalf("still blocked")
+		}
+	}
+}
+
+func TestResourceTracker_Claim_Abort(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	tracker.Restore("running", &structs.Resources{CPU: 1000})
+
+	// An aborted claim leaves the queue, letting the ones behind it in
+	abortCh := make(chan struct{})
+	aborted := claimAsync(tracker, "aborted", &structs.Resources{CPU: 800}, abortCh)
+	time.Sleep(50 * time.Millisecond)
+	waiting := claimAsync(tracker, "waiting", &structs.Resources{CPU: 200}, nil)
+	time.Sleep(50 * time.Millisecond)
+	close(abortCh)
+	if ok := <-aborted; ok {
+		t.Fatalf("aborted claim succeeded")
+	}
+	tracker.Release("running")
+	select {
+	case <-waiting:
+	case <-time.After(time.Second):
+		t.Fatalf("still blocked")
+	}
+	if err := tracker.TryClaim("rest", &structs.Resources{CPU: 800}); err != nil {
+		t.Fatalf("aborted claim kept its resources: %v", err)
+	}
+}
+
+func TestResourceTracker_Claim_ExceedsNode(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	err := tracker.TryClaim("huge", &structs.Resources{MemoryMB: 4096})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 1024 MB of the node") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// An alloc that never fits doesn't hold up the ones behind it
+	abortCh := make(chan struct{})
+	defer close(abortCh)
+	claimAsync(tracker, "huge", &structs.Resources{MemoryMB: 4096}, abortCh)
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-claimAsync(tracker, "small", &structs.Resources{MemoryMB: 256}, nil):
+	case <-time.After(time.Second):
+		t.Fatalf("blocked behind an alloc that never fits")
+	}
+}
+
+func TestNodeCapacity(t *testing.T) {
+	node := &structs.Node{
+		Resources: &structs.Resources{CPU: 4000, MemoryMB: 8192},
+		Reserved:  &structs.Resources{CPU: 500, MemoryMB: 1024},
+	}
+	if capacity := nodeCapacity(node); capacity.CPU != 3500 || capacity.MemoryMB != 7168 {
+		t.Fatalf("bad: %#v", capacity)
+	}
+	if capacity := nodeCapacity(&structs.Node{}); capacity.CPU != 0 || capacity.MemoryMB != 0 {
+		t.Fatalf("bad: %#v", capacity)
+	}
+}
+
+func TestResourceTracker_Oversubscribe(t *testing.T) {
+	tracker := testResourceTracker(1000, 1024)
+	tracker.oversubscription = 1.5
+	if err := tracker.TryClaim("a", &structs.Resources{CPU: 800, MemoryMB: 768}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Allocs are admitted beyond the capacity of the node up to the factor
+	if err := tracker.TryClaim("b", &structs.Resources{CPU: 600, MemoryMB: 768}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	err := tracker.TryClaim("c", &structs.Resources{CPU: 200, MemoryMB: 128})
+	if err == nil || !strings.Contains(err.Error(), "not enough CPU: 200 MHz requested, 100 MHz free") {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Each alloc must still fit in the node
+	err = tracker.TryClaim("d", &structs.Resources{CPU: 100, MemoryMB: 1200})
+	if err == nil || !strings.Contains(err.Error(), "exceeds the 1024 MB of the node") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestPriorityWeights(t *testing.T) {
+	// The lower the priority, the sooner a task is killed for memory and the
+	// fewer CPU shares it gets
+	low, def, high := 10, structs.JobDefaultPriority, structs.JobMaxPriority
+	if !(priorityOOMScoreAdj(low) > priorityOOMScoreAdj(def) && priorityOOMScoreAdj(def) > priorityOOMScoreAdj(high)) {
+		t.Fatalf("bad oom_score_adj: %d, %d, %d", priorityOOMScoreAdj(low), priorityOOMScoreAdj(def), priorityOOMScoreAdj(high))
+	}
+	if adj := priorityOOMScoreAdj(def); adj != 0 {
+		t.Fatalf("default priority has oom_score_adj %d", adj)
+	}
+	for _, p := range []int{0, structs.JobMinPriority, structs.JobMaxPriority} {
+		if adj := priorityOOMScoreAdj(p); adj < -1000 || adj > 1000 {
+			t.Fatalf("priority %d has oom_score_adj %d", p, adj)
+		}
+	}
+
+	if shares := priorityCPUShares(500, def); shares != 500 {
+		t.Fatalf("default priority has %d shares", shares)
+	}
+	if !(priorityCPUShares(500, low) < priorityCPUShares(500, high)) {
+		t.Fatalf("bad shares: %d, %d", priorityCPUShares(500, low), priorityCPUShares(500, high))
+	}
+	if shares := priorityCPUShares(1, structs.JobMinPriority); shares != 2 {
+		t.Fatalf("got %d shares", shares)
+	}
+}
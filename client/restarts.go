@@ -0,0 +1,143 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// restartMaxDelay is the cap on the exponential backoff applied
+	// between consecutive restarts of a failing task
+	restartMaxDelay = 5 * time.Minute
+)
+
+// restartTracker is used to decide if and when a failed task should be
+// restarted, based on the restart policy of the task.
+type restartTracker struct {
+	policy *structs.RestartPolicy
+
+	// count is the number of restarts in the current interval
+	count int
+
+	// startTime is the beginning of the current interval
+	startTime time.Time
+
+	// rand jitters the delays. Tests seed it to get deterministic delays.
+	rand *rand.Rand
+
+	// clock times the intervals
+	clock config.Clock
+}
+
+// newRestartTracker is used to create a restart tracker for the given policy,
+// timing its intervals with the clock. A nil policy never restarts.
+func newRestartTracker(policy *structs.RestartPolicy, clock config.Clock) *restartTracker {
+	return &restartTracker{
+		policy: policy,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+		clock:  clock,
+	}
+}
+
+// mode returns the mode of the policy, defaulting to stop
+func (t *restartTracker) mode() string {
+	if t.policy == nil || t.policy.Mode == "" {
+		return structs.RestartPolicyModeStop
+	}
+	return t.policy.Mode
+}
+
+// window returns how long ago the current interval started
+func (t *restartTracker) window() time.Duration {
+	if t.startTime.IsZero() {
+		return 0
+	}
+	return t.clock.Now().Sub(t.startTime)
+}
+
+// jitter randomizes the delay by up to the jitter factor of the policy in
+// either direction
+func (t *restartTracker) jitter(delay time.Duration) time.Duration {
+	if t.policy.Jitter <= 0 {
+		return delay
+	}
+	offset := (2*t.rand.Float64() - 1) * t.policy.Jitter
+	return time.Duration(float64(delay) * (1 + offset))
+}
+
+// restore rehydrates the tracker from a snapshot of its count and the start
+// of its interval. The count is reset if the interval has elapsed since. A
+// count without a start, such as one saved by an older client, is kept within
+// an interval starting now.
+func (t *restartTracker) restore(count int, start time.Time) {
+	now := t.clock.Now()
+	if start.IsZero() && count > 0 {
+		start = now
+	}
+	if start.IsZero() || t.policy != nil && now.Sub(start) >= t.policy.Interval {
+		t.count = 0
+		t.startTime = time.Time{}
+		return
+	}
+	t.count = count
+	t.startTime = start
+}
+
+// healthyRun resets the attempts if the task ran for at least the min
+// healthy time of the policy. It returns whether the run was shorter, in
+// which case the exit counts as a failure.
+func (t *restartTracker) healthyRun(ran time.Duration) bool {
+	if t.policy == nil || t.policy.MinHealthyTime <= 0 {
+		return true
+	}
+	if ran < t.policy.MinHealthyTime {
+		return false
+	}
+	t.count = 0
+	t.startTime = time.Time{}
+	return true
+}
+
+// nextRestart is invoked when the task fails. It returns if the task should
+// be restarted and how long to wait before starting it again.
+func (t *restartTracker) nextRestart() (bool, time.Duration) {
+	if t.policy == nil {
+		return false, 0
+	}
+
+	// Start a new interval if this is the first failure or the
+	// previous interval has elapsed
+	now := t.clock.Now()
+	if t.startTime.IsZero() || now.Sub(t.startTime) >= t.policy.Interval {
+		t.startTime = now
+		t.count = 0
+	}
+
+	// Check if the attempts within this interval are exhausted
+	if t.count >= t.policy.Attempts {
+		if t.mode() != structs.RestartPolicyModeDelay {
+			return false, 0
+		}
+
+		// Wait out the remainder of the interval, at which point
+		// the restart counts against the next interval
+		wait := t.startTime.Add(t.policy.Interval).Sub(now)
+		t.startTime = now.Add(wait)
+		t.count = 1
+		return true, wait
+	}
+
+	// Double the delay on each consecutive restart up to the cap
+	delay := t.policy.Delay
+	for i := 0; i < t.count && delay < restartMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > restartMaxDelay {
+		delay = restartMaxDelay
+	}
+	t.count++
+	return true, t.jitter(delay)
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestRestartTracker_NoPolicy(t *testing.T) {
+	rt := newRestartTracker(nil, wallClock{})
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("should not restart")
+	}
+}
+
+func TestRestartTracker_Backoff(t *testing.T) {
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts: 12,
+		Interval: time.Hour,
+		Delay:    time.Second,
+	}, wallClock{})
+
+	exp := []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		8 * time.Second,
+		16 * time.Second,
+		32 * time.Second,
+		64 * time.Second,
+		128 * time.Second,
+		256 * time.Second,
+		restartMaxDelay,
+		restartMaxDelay,
+		restartMaxDelay,
+	}
+	for i, e := range exp {
+		restart, wait := rt.nextRestart()
+		if !restart {
+			t.Fatalf("attempt %d should restart", i)
+		}
+		if wait != e {
+			t.Fatalf("attempt %d: got %v; want %v", i, wait, e)
+		}
+	}
+
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("attempts should be exhausted")
+	}
+}
+
+func TestRestartTracker_IntervalReset(t *testing.T) {
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    time.Second,
+	}, wallClock{})
+
+	if restart, _ := rt.nextRestart(); !restart {
+		t.Fatalf("should restart")
+	}
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("attempts should be exhausted")
+	}
+
+	// Move the interval into the past
+	rt.startTime = rt.startTime.Add(-2 * time.Minute)
+	restart, wait := rt.nextRestart()
+	if !restart || wait != time.Second {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+}
+
+func TestRestartTracker_Clock(t *testing.T) {
+	clock := newFakeClock()
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts: 2,
+		Interval: 10 * time.Minute,
+		Delay:    time.Minute,
+		Mode:     structs.RestartPolicyModeDelay,
+	}, clock)
+
+	// The backoffs are taken, then the rest of the interval is waited out
+	for i, e := range []time.Duration{time.Minute, 2 * time.Minute, 7 * time.Minute} {
+		restart, wait := rt.nextRestart()
+		if !restart || wait != e {
+			t.Fatalf("attempt %d: got %v %v; want %v", i, restart, wait, e)
+		}
+		clock.Advance(wait)
+	}
+
+	// Once the interval has elapsed the attempts start over
+	clock.Advance(10 * time.Minute)
+	restart, wait := rt.nextRestart()
+	if !restart || wait != time.Minute {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+}
+
+func TestRestartTracker_Window(t *testing.T) {
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    time.Second,
+	}, wallClock{})
+	if w := rt.window(); w != 0 {
+		t.Fatalf("bad: %v", w)
+	}
+
+	rt.nextRestart()
+	rt.startTime = rt.startTime.Add(-10 * time.Second)
+	if w := rt.window(); w < 10*time.Second || w > 11*time.Second {
+		t.Fatalf("bad: %v", w)
+	}
+}
+
+func TestRestartTracker_ModeDelay(t *testing.T) {
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    time.Second,
+		Mode:     structs.RestartPolicyModeDelay,
+	}, wallClock{})
+
+	if restart, _ := rt.nextRestart(); !restart {
+		t.Fatalf("should restart")
+	}
+
+	// Exhausted attempts should wait out the interval
+	restart, wait := rt.nextRestart()
+	if !restart {
+		t.Fatalf("should restart")
+	}
+	if wait <= 50*time.Second || wait > time.Minute {
+		t.Fatalf("bad: %v", wait)
+	}
+}
+
+func TestRestartTracker_Jitter(t *testing.T) {
+	policy := &structs.RestartPolicy{
+		Attempts: 6,
+		Interval: time.Hour,
+		Delay:    time.Second,
+		Jitter:   0.25,
+	}
+	rt := newRestartTracker(policy, wallClock{})
+	rt.rand = rand.New(rand.NewSource(42))
+	seeded := newRestartTracker(policy, wallClock{})
+	seeded.rand = rand.New(rand.NewSource(42))
+
+	var jittered bool
+	base := time.Second
+	for i := 0; i < policy.Attempts; i++ {
+		restart, wait := rt.nextRestart()
+		if !restart {
+			t.Fatalf("attempt %d should restart", i)
+		}
+		min, max := base*3/4, base*5/4
+		if wait < min || wait > max {
+			t.Fatalf("attempt %d: %v not within [%v, %v]", i, wait, min, max)
+		}
+		jittered = jittered || wait != base
+
+		// The same seed yields the same delays
+		if _, other := seeded.nextRestart(); other != wait {
+			t.Fatalf("attempt %d: got %v and %v with the same seed", i, wait, other)
+		}
+		base *= 2
+	}
+	if !jittered {
+		t.Fatalf("no delay was jittered")
+	}
+}
+
+func TestRestartTracker_Mode(t *testing.T) {
+	for _, mode := range []string{"", structs.RestartPolicyModeStop, structs.RestartPolicyModeFail} {
+		rt := newRestartTracker(&structs.RestartPolicy{
+			Attempts: 1,
+			Interval: time.Minute,
+			Delay:    time.Second,
+			Mode:     mode,
+		}, wallClock{})
+		rt.nextRestart()
+		if restart, _ := rt.nextRestart(); restart {
+			t.Fatalf("mode %q: attempts should be exhausted", mode)
+		}
+	}
+
+	if mode := newRestartTracker(nil, wallClock{}).mode(); mode != structs.RestartPolicyModeStop {
+		t.Fatalf("bad default mode: %q", mode)
+	}
+}
+
+func TestRestartTracker_HealthyRun(t *testing.T) {
+	rt := newRestartTracker(&structs.RestartPolicy{
+		Attempts:       1,
+		Interval:       time.Hour,
+		Delay:          time.Second,
+		MinHealthyTime: time.Minute,
+	}, wallClock{})
+
+	// A quick exit counts against the attempts
+	if rt.healthyRun(time.Second) {
+		t.Fatalf("run should not be healthy")
+	}
+	if restart, _ := rt.nextRestart(); !restart {
+		t.Fatalf("should restart")
+	}
+	if rt.healthyRun(time.Second) {
+		t.Fatalf("run should not be healthy")
+	}
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("attempts should be exhausted")
+	}
+
+	// A long run resets them
+	if !rt.healthyRun(time.Hour) {
+		t.Fatalf("run should be healthy")
+	}
+	if rt.count != 0 {
+		t.Fatalf("bad: %d", rt.count)
+	}
+	if restart, wait := rt.nextRestart(); !restart || wait != time.Second {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+
+	// Without a min healthy time every run is healthy and nothing is reset
+	rt = newRestartTracker(&structs.RestartPolicy{Attempts: 1, Interval: time.Hour}, wallClock{})
+	rt.nextRestart()
+	if !rt.healthyRun(0) || rt.count != 1 {
+		t.Fatalf("bad: %d", rt.count)
+	}
+}
+
+func TestRestartTracker_Restore(t *testing.T) {
+	policy := &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Minute,
+		Delay:    time.Second,
+	}
+
+	// The budget carries over within the interval
+	start := time.Now().Add(-30 * time.Second)
+	rt := newRestartTracker(policy, wallClock{})
+	rt.restore(2, start)
+	if rt.count != 2 || !rt.startTime.Equal(start) {
+		t.Fatalf("bad: %d %v", rt.count, rt.startTime)
+	}
+	if restart, wait := rt.nextRestart(); !restart || wait != 4*time.Second {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("budget should be exhausted")
+	}
+
+	// It is reset once the interval has elapsed
+	rt = newRestartTracker(policy, wallClock{})
+	rt.restore(3, time.Now().Add(-2*time.Minute))
+	if rt.count != 0 || !rt.startTime.IsZero() {
+		t.Fatalf("bad: %d %v", rt.count, rt.startTime)
+	}
+	if restart, wait := rt.nextRestart(); !restart || wait != time.Second {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+
+	// A count saved without the start of its interval is kept within an
+	// interval starting now
+	clock := newFakeClock()
+	rt = newRestartTracker(policy, clock)
+	rt.restore(3, time.Time{})
+	if rt.count != 3 || !rt.startTime.Equal(clock.Now()) {
+		t.Fatalf("bad: %d %v", rt.count, rt.startTime)
+	}
+	if restart, _ := rt.nextRestart(); restart {
+		t.Fatalf("budget should be exhausted")
+	}
+	clock.Advance(time.Minute)
+	if restart, wait := rt.nextRestart(); !restart || wait != time.Second {
+		t.Fatalf("bad: %v %v", restart, wait)
+	}
+
+	// So is the count of a task without a policy
+	rt = newRestartTracker(nil, clock)
+	rt.restore(2, time.Time{})
+	if rt.count != 2 {
+		t.Fatalf("bad: %d", rt.count)
+	}
+}
@@ -0,0 +1,316 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+const (
+	// secretRenewFraction is the part of its lease after which a provider
+	// secret is renewed, leaving the rest to retry failed renewals
+	secretRenewFraction = 2.0 / 3
+
+	// secretRetryInterval is how long renewing a secret waits after the
+	// provider failed before trying again
+	secretRetryInterval = 10 * time.Second
+)
+
+// providerSecrets holds the secrets a task read from the secret provider and
+// renews them before their leases run out while the task runs.
+type providerSecrets struct {
+	provider config.SecretProvider
+	clock    config.Clock
+
+	// retryInterval is how long renewing a secret waits after a failure
+	retryInterval time.Duration
+
+	secrets map[string]*providerSecret
+	lock    sync.Mutex
+
+	// fetchedCh receives once the secrets are fetched again, so the watch
+	// reschedules their renewals
+	fetchedCh chan struct{}
+}
+
+// providerSecret is a secret read from the provider. The fields of a secret
+// tracked without being fetched, such as that of a restored task, are unknown
+// until it is renewed.
+type providerSecret struct {
+	fields  map[string]string
+	known   bool
+	renewAt time.Time
+}
+
+// secretRenewal is a renewal of a secret that changed it, or failed with err
+type secretRenewal struct {
+	path string
+	err  error
+}
+
+func newProviderSecrets(provider config.SecretProvider, clock config.Clock) *providerSecrets {
+	return &providerSecrets{
+		provider:      provider,
+		clock:         clock,
+		retryInterval: secretRetryInterval,
+		secrets:       make(map[string]*providerSecret),
+		fetchedCh:     make(chan struct{}, 1),
+	}
+}
+
+// fetch reads the secrets at the paths from the provider, replacing those
+// read before. Nothing is replaced if any of them fails.
+func (p *providerSecrets) fetch(paths []string) error {
+	secrets := make(map[string]*providerSecret, len(paths))
+	for _, path := range paths {
+		secret, err := p.read(path)
+		if err != nil {
+			return err
+		}
+		secrets[path] = secret
+	}
+
+	p.lock.Lock()
+	p.secrets = secrets
+	p.lock.Unlock()
+	p.rescheduled()
+	return nil
+}
+
+// track renews the secrets at the paths right away without having fetched
+// them, such as those a restored task was started with
+func (p *providerSecrets) track(paths []string) {
+	p.lock.Lock()
+	now := p.clock.Now()
+	p.secrets = make(map[string]*providerSecret, len(paths))
+	for _, path := range paths {
+		p.secrets[path] = &providerSecret{renewAt: now}
+	}
+	p.lock.Unlock()
+	p.rescheduled()
+}
+
+// read fetches the secret at the path, which must only have fields that are
+// file names
+func (p *providerSecrets) read(path string) (*providerSecret, error) {
+	if p.provider == nil {
+		return nil, fmt.Errorf("no secret provider to read secret '%s' from", path)
+	}
+	fields, lease, err := p.provider.Fetch(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch secret '%s': %v", path, err)
+	}
+	for name := range fields {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return nil, fmt.Errorf("field '%s' of secret '%s' is not a file name", name, path)
+		}
+	}
+
+	secret := &providerSecret{fields: fields, known: true}
+	if lease > 0 {
+		secret.renewAt = p.clock.Now().Add(time.Duration(float64(lease) * secretRenewFraction))
+	}
+	return secret, nil
+}
+
+// fields returns the fields of the secrets, which must not share a name with
+// each other or with the secrets of the task
+func (p *providerSecrets) fields(taskSecrets map[string]string) (map[string]string, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.secrets) == 0 {
+		return taskSecrets, nil
+	}
+
+	fields := make(map[string]string, len(taskSecrets))
+	owners := make(map[string]string)
+	for name, value := range taskSecrets {
+		fields[name] = value
+	}
+	for path, secret := range p.secrets {
+		for name, value := range secret.fields {
+			if _, ok := fields[name]; ok {
+				if owner, ok := owners[name]; ok {
+					return nil, fmt.Errorf("secrets '%s' and '%s' both have the field '%s'", owner, path, name)
+				}
+				return nil, fmt.Errorf("field '%s' of secret '%s' is already a secret of the task", name, path)
+			}
+			fields[name] = value
+			owners[name] = path
+		}
+	}
+	return fields, nil
+}
+
+// rescheduled wakes up the watch to schedule the renewals again
+func (p *providerSecrets) rescheduled() {
+	select {
+	case p.fetchedCh <- struct{}{}:
+	default:
+	}
+}
+
+// watch renews the secrets as they come due until stopCh is closed. The
+// returned channel receives the renewals that changed a secret or failed. A
+// failed renewal is retried after the retry interval, keeping the fields
+// last read.
+func (p *providerSecrets) watch(stopCh <-chan struct{}) <-chan *secretRenewal {
+	renewalCh := make(chan *secretRenewal)
+	go func() {
+		for {
+			var dueCh <-chan time.Time
+			if next, ok := p.nextRenewal(); ok {
+				dueCh = p.clock.After(next.Sub(p.clock.Now()))
+			}
+			select {
+			case <-stopCh:
+				return
+			case <-p.fetchedCh:
+				continue
+			case <-dueCh:
+			}
+
+			for _, renewal := range p.renewDue() {
+				select {
+				case renewalCh <- renewal:
+				case <-stopCh:
+					return
+				}
+			}
+		}
+	}()
+	return renewalCh
+}
+
+// nextRenewal returns when the next secret is due to be renewed, if any is
+func (p *providerSecrets) nextRenewal() (time.Time, bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	var next time.Time
+	for _, secret := range p.secrets {
+		if !secret.renewAt.IsZero() && (next.IsZero() || secret.renewAt.Before(next)) {
+			next = secret.renewAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// renewDue renews the secrets that are due, returning the renewals that
+// changed a secret or failed
+func (p *providerSecrets) renewDue() []*secretRenewal {
+	p.lock.Lock()
+	now := p.clock.Now()
+	var due []string
+	for path, secret := range p.secrets {
+		if !secret.renewAt.IsZero() && !secret.renewAt.After(now) {
+			due = append(due, path)
+		}
+	}
+	p.lock.Unlock()
+
+	var renewals []*secretRenewal
+	for _, path := range due {
+		renewed, err := p.read(path)
+
+		p.lock.Lock()
+		secret, ok := p.secrets[path]
+		if !ok {
+			// The secrets were fetched again meanwhile without this one
+			p.lock.Unlock()
+			continue
+		}
+		if err != nil {
+			secret.renewAt = p.clock.Now().Add(p.retryInterval)
+			renewals = append(renewals, &secretRenewal{path: path, err: err})
+		} else {
+			if secret.known && !reflect.DeepEqual(secret.fields, renewed.fields) {
+				renewals = append(renewals, &secretRenewal{path: path})
+			}
+			p.secrets[path] = renewed
+		}
+		p.lock.Unlock()
+	}
+	return renewals
+}
+
+// secretPaths returns the paths of the provider secrets of the task
+func (r *TaskRunner) secretPaths() []string {
+	paths := make([]string, 0, len(r.task.ProviderSecrets))
+	for _, secret := range r.task.ProviderSecrets {
+		paths = append(paths, secret.Path)
+	}
+	return paths
+}
+
+// taskSecrets returns the secrets of the task along with the fields of its
+// provider secrets
+func (r *TaskRunner) taskSecrets() (map[string]string, error) {
+	return r.providerSecrets.fields(r.task.Secrets)
+}
+
+// renewedSecret handles a renewal of a provider secret that changed it or
+// failed. A changed secret is rewritten, and the change mode of the secret
+// applies either way.
+func (r *TaskRunner) renewedSecret(renewal *secretRenewal) {
+	reason := fmt.Sprintf("secret '%s' changed", renewal.path)
+	if renewal.err != nil {
+		reason = fmt.Sprintf("failed to renew secret '%s': %v", renewal.path, renewal.err)
+	} else if err := r.writeSecrets(); err != nil {
+		reason = fmt.Sprintf("failed to write renewed secret '%s': %v", renewal.path, err)
+		renewal.err = err
+	}
+	if renewal.err != nil {
+		r.logger.Printf("[ERR] client: task '%s' for alloc '%s': %s", r.task.Name, r.allocID, reason)
+		r.emitEvent(structs.AllocClientStatusRunning,
+			structs.NewTaskEvent(structs.TaskSecretsFailure).SetMessage(reason))
+	} else {
+		r.logger.Printf("[DEBUG] client: secret '%s' of task '%s' for alloc '%s' changed",
+			renewal.path, r.task.Name, r.allocID)
+	}
+
+	// An update may have removed the secret since
+	var secret *structs.ProviderSecret
+	for _, s := range r.task.ProviderSecrets {
+		if s.Path == renewal.path {
+			secret = s
+		}
+	}
+	if secret == nil {
+		return
+	}
+
+	mode, name := secret.OnChange()
+	restart := mode == structs.SecretChangeModeRestart
+	if mode == structs.SecretChangeModeSignal {
+		sig, err := parseSignal(name)
+		if err == nil && r.caps != nil && !r.caps.Signals {
+			err = &driver.NotSupportedError{Driver: r.task.Driver, Operation: "signals"}
+		}
+		if err == nil {
+			r.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).
+				SetSignal(signalNumber(sig)).
+				SetMessage(reason))
+			err = r.handle.Signal(sig)
+		}
+		if err != nil && (driver.IsNotSupported(err) || sig == nil) {
+			r.logger.Printf("[WARN] client: can't send %s to task '%s' for alloc '%s' for secret '%s', restarting it instead",
+				name, r.task.Name, r.allocID, renewal.path)
+			restart = true
+		} else if err != nil {
+			r.logger.Printf("[ERR] client: failed to signal task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+		}
+	}
+	if restart {
+		if err := r.Restart(reason); err != nil {
+			r.logger.Printf("[ERR] client: failed to restart task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+// fakeSecretProvider is a secret provider in memory leasing every secret for
+// the same duration
+type fakeSecretProvider struct {
+	secrets map[string]map[string]string
+	lease   time.Duration
+	fails   int
+	fetches int
+	lock    sync.Mutex
+}
+
+func newFakeSecretProvider(lease time.Duration) *fakeSecretProvider {
+	return &fakeSecretProvider{secrets: make(map[string]map[string]string), lease: lease}
+}
+
+func (p *fakeSecretProvider) Fetch(path string) (map[string]string, time.Duration, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fetches++
+	if p.fails > 0 {
+		p.fails--
+		return nil, 0, errors.New("permission denied")
+	}
+	secret, ok := p.secrets[path]
+	if !ok {
+		return nil, 0, fmt.Errorf("no secret at %s", path)
+	}
+	fields := make(map[string]string, len(secret))
+	for k, v := range secret {
+		fields[k] = v
+	}
+	return fields, p.lease, nil
+}
+
+// set replaces the fields of the secret at the path
+func (p *fakeSecretProvider) set(path string, fields map[string]string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.secrets[path] = fields
+}
+
+// fail makes the next n fetches fail
+func (p *fakeSecretProvider) fail(n int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.fails = n
+}
+
+func (p *fakeSecretProvider) fetchCount() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.fetches
+}
+
+// testSecretsTaskRunner returns a mock task runner reading the secret/db
+// secret of the provider into its environment
+func testSecretsTaskRunner(provider *fakeSecretProvider, mode string) (*MockTaskStateUpdater, *TaskRunner) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.config.SecretProvider = provider
+	tr.providerSecrets = newProviderSecrets(provider, tr.clock)
+	tr.providerSecrets.retryInterval = 10 * time.Millisecond
+	tr.task.ProviderSecrets = []*structs.ProviderSecret{
+		&structs.ProviderSecret{Path: "secret/db", ChangeMode: mode},
+	}
+	tr.task.Env = map[string]string{"DB_PASSWORD": "${secret:password}"}
+	return upd, tr
+}
+
+// readSecret returns the contents of the named secret of the task
+func readSecret(t *testing.T, tr *TaskRunner, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(tr.ctx.AllocDir.SecretsDir(tr.task.Name), name))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	return string(data)
+}
+
+func TestProviderSecrets_Fetch(t *testing.T) {
+	provider := newFakeSecretProvider(0)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	provider.set("secret/api", map[string]string{"token": "abc"})
+	secrets := newProviderSecrets(provider, wallClock{})
+
+	// The fields of the secrets are added to those of the task
+	if err := secrets.fetch([]string{"secret/db", "secret/api"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	fields, err := secrets.fields(map[string]string{"key": "value"})
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := map[string]string{"key": "value", "password": "hunter2", "token": "abc"}
+	if !reflect.DeepEqual(fields, exp) {
+		t.Fatalf("got %#v", fields)
+	}
+	if _, ok := secrets.nextRenewal(); ok {
+		t.Fatalf("secrets without a lease scheduled for renewal")
+	}
+
+	// Fields may not clash with the secrets of the task
+	if _, err := secrets.fields(map[string]string{"token": "x"}); err == nil || !strings.Contains(err.Error(), "already a secret") {
+		t.Fatalf("expected clash: %v", err)
+	}
+
+	// A failed fetch keeps the secrets fetched before
+	provider.fail(1)
+	if err := secrets.fetch([]string{"secret/db"}); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected error: %v", err)
+	}
+	if fields, _ := secrets.fields(nil); len(fields) != 2 {
+		t.Fatalf("got %#v", fields)
+	}
+
+	// Fields must be file names
+	provider.set("secret/bad", map[string]string{"../passwd": "x"})
+	if err := secrets.fetch([]string{"secret/bad"}); err == nil || !strings.Contains(err.Error(), "not a file name") {
+		t.Fatalf("expected error: %v", err)
+	}
+
+	// Without a provider the secrets can't be fetched
+	if err := newProviderSecrets(nil, wallClock{}).fetch([]string{"secret/db"}); err == nil {
+		t.Fatalf("expected error without provider")
+	}
+}
+
+func TestTaskRunner_ProviderSecrets(t *testing.T) {
+	provider := newFakeSecretProvider(0)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	upd, tr := testSecretsTaskRunner(provider, "")
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// The secret is written and resolved in the environment before the task
+	// is started
+	waitDescription(t, upd, "task started")
+	if v := readSecret(t, tr, "password"); v != "hunter2" {
+		t.Fatalf("bad secret: %q", v)
+	}
+	if env := tr.ctx.TaskEnv(tr.getTask().Name); env["DB_PASSWORD"] != "hunter2" {
+		t.Fatalf("bad env: %q", env["DB_PASSWORD"])
+	}
+
+	// And it is not persisted
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state, err := ioutil.ReadFile(tr.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(string(state), "hunter2") {
+		t.Fatalf("secret persisted in task state: %s", state)
+	}
+}
+
+func TestTaskRunner_ProviderSecrets_FetchFailed(t *testing.T) {
+	provider := newFakeSecretProvider(0)
+	upd, tr := testSecretsTaskRunner(provider, "")
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed || !strings.Contains(desc, "no secret at secret/db") {
+		t.Fatalf("bad: %s %q", status, desc)
+	}
+	if n := countEvents(tr, structs.TaskSecretsFailure); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_ProviderSecrets_Renewal(t *testing.T) {
+	provider := newFakeSecretProvider(150 * time.Millisecond)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	upd, tr := testSecretsTaskRunner(provider, structs.SecretChangeModeSignal)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+	handle := tr.getHandle().(*mockHandle)
+
+	// The secret is renewed before its lease runs out, which changes
+	// nothing as long as it stays the same
+	testutil.WaitForResult(func() (bool, error) {
+		return provider.fetchCount() >= 3, fmt.Errorf("fetched %d times", provider.fetchCount())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if sigs := handle.receivedSignals(); len(sigs) != 0 {
+		t.Fatalf("unexpected signals: %v", sigs)
+	}
+
+	// A renewal changing it rewrites it and signals the task
+	provider.set("secret/db", map[string]string{"password": "rotated"})
+	testutil.WaitForResult(func() (bool, error) {
+		sigs := handle.receivedSignals()
+		return reflect.DeepEqual(sigs, []os.Signal{syscall.SIGHUP}), fmt.Errorf("got signals %v", sigs)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if v := readSecret(t, tr, "password"); v != "rotated" {
+		t.Fatalf("bad secret: %q", v)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 1 {
+		t.Fatalf("task restarted: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_ProviderSecrets_RenewalFailed(t *testing.T) {
+	provider := newFakeSecretProvider(150 * time.Millisecond)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	_, tr := testSecretsTaskRunner(provider, "")
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskStarted) == 1, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	// A failed renewal is recorded and restarts the task, which fetches the
+	// secret again
+	provider.fail(1)
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskStarted) == 2, fmt.Errorf("events: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if n := countEvents(tr, structs.TaskSecretsFailure); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	var reason string
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskRestarting {
+			reason = e.Message
+		}
+	}
+	if !strings.Contains(reason, "failed to renew secret 'secret/db': ") || !strings.Contains(reason, "permission denied") {
+		t.Fatalf("bad restart reason: %q", reason)
+	}
+}
+
+func TestTaskRunner_ProviderSecrets_RenewalFailed_Noop(t *testing.T) {
+	provider := newFakeSecretProvider(150 * time.Millisecond)
+	provider.set("secret/db", map[string]string{"password": "hunter2"})
+	upd, tr := testSecretsTaskRunner(provider, structs.SecretChangeModeNoop)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+
+	// Failed renewals are retried, keeping the secret last read and leaving
+	// the task running
+	provider.fail(2)
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskSecretsFailure) == 2, fmt.Errorf("events: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	provider.set("secret/db", map[string]string{"password": "rotated"})
+	testutil.WaitForResult(func() (bool, error) {
+		v := readSecret(t, tr, "password")
+		return v == "rotated", fmt.Errorf("got %q", v)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if n := countEvents(tr, structs.TaskStarted); n != 1 {
+		t.Fatalf("task restarted: %#v", tr.Events())
+	}
+}
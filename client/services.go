@@ -0,0 +1,170 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	consul "github.com/hashicorp/consul/api"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// consulRegistry registers the services of tasks with the local Consul agent
+type consulRegistry struct {
+	agent *consul.Agent
+}
+
+// newConsulRegistry returns a registry for the Consul agent at the
+// consul.address option of the config
+func newConsulRegistry(cfg *config.Config) (*consulRegistry, error) {
+	consulConfig := consul.DefaultConfig()
+	consulConfig.Address = cfg.ReadDefault("consul.address", "127.0.0.1:8500")
+	consulClient, err := consul.NewClient(consulConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize consul client: %v", err)
+	}
+	return &consulRegistry{agent: consulClient.Agent()}, nil
+}
+
+func (c *consulRegistry) Register(service *config.ServiceRegistration) error {
+	err := c.agent.ServiceRegister(&consul.AgentServiceRegistration{
+		ID:      service.ID,
+		Name:    service.Name,
+		Tags:    service.Tags,
+		Address: service.Address,
+		Port:    service.Port,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Checks are registered on their own so they keep their names. They are
+	// removed along with the service.
+	addr := net.JoinHostPort(service.Address, strconv.Itoa(service.Port))
+	for _, check := range service.Checks {
+		reg := &consul.AgentCheckRegistration{
+			ID:        service.ID + ":" + check.Name,
+			Name:      check.Name,
+			ServiceID: service.ID,
+		}
+		reg.Interval = check.Interval.String()
+		if check.Timeout > 0 {
+			reg.Timeout = check.Timeout.String()
+		}
+		switch check.Type {
+		case structs.TaskCheckTypeHTTP:
+			reg.HTTP = fmt.Sprintf("http://%s%s", addr, check.Path)
+		case structs.TaskCheckTypeTCP:
+			reg.TCP = addr
+		}
+		if err := c.agent.CheckRegister(reg); err != nil {
+			return fmt.Errorf("failed to register check '%s': %v", check.Name, err)
+		}
+	}
+	return nil
+}
+
+func (c *consulRegistry) Deregister(id string) error {
+	return c.agent.ServiceDeregister(id)
+}
+
+// serviceID returns the ID the service of the task is registered with, which
+// is unique to the allocation
+func serviceID(allocID, taskName string, service *structs.Service) string {
+	return fmt.Sprintf("nomad-%s-%s-%s", allocID, taskName, service.Name)
+}
+
+// serviceRegistrations resolves the services of the task to the IP of its
+// network and the host ports mapped to their port labels
+func (r *TaskRunner) serviceRegistrations() ([]*config.ServiceRegistration, error) {
+	if len(r.task.Services) == 0 {
+		return nil, nil
+	}
+	if r.task.Resources == nil || len(r.task.Resources.Networks) == 0 {
+		return nil, fmt.Errorf("task has services but no network")
+	}
+
+	network := r.task.Resources.Networks[0]
+	ports := r.ctx.TaskPorts(r.task.Name)
+	if ports == nil {
+		ports = network.MapDynamicPorts()
+	}
+	regs := make([]*config.ServiceRegistration, 0, len(r.task.Services))
+	for _, service := range r.task.Services {
+		port, ok := ports[service.PortLabel]
+		if !ok {
+			return nil, fmt.Errorf("port '%s' of service '%s' is not mapped", service.PortLabel, service.Name)
+		}
+		regs = append(regs, &config.ServiceRegistration{
+			ID:      serviceID(r.allocID, r.task.Name, service),
+			Name:    service.Name,
+			Tags:    service.Tags,
+			Address: network.IP,
+			Port:    port,
+			Checks:  service.Checks,
+		})
+	}
+	return regs, nil
+}
+
+// registerServices registers the services of the task, and deregisters the
+// ones registered before that the task no longer declares. It is called once
+// the task is ready and again on updates while it is registered.
+func (r *TaskRunner) registerServices() {
+	registry := r.config.ServiceRegistry
+	if registry == nil {
+		return
+	}
+	r.servicesRegistered = true
+
+	regs, err := r.serviceRegistrations()
+	if err != nil {
+		r.logger.Printf("[ERR] client: failed to resolve services of task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		return
+	}
+
+	current := make(map[string]struct{}, len(regs))
+	for _, reg := range regs {
+		// A failed registration is still deregistered later, as it may
+		// have been partially applied
+		current[reg.ID] = struct{}{}
+		if err := registry.Register(reg); err != nil {
+			r.logger.Printf("[ERR] client: failed to register service '%s' of task '%s' for alloc '%s': %v",
+				reg.Name, r.task.Name, r.allocID, err)
+		}
+	}
+	for id := range r.services {
+		if _, ok := current[id]; !ok {
+			r.deregisterService(id)
+		}
+	}
+	r.services = current
+}
+
+// deregisterServices deregisters every service registered for the task, so
+// no more traffic is routed to it
+func (r *TaskRunner) deregisterServices() {
+	r.servicesRegistered = false
+	for id := range r.services {
+		r.deregisterService(id)
+	}
+	r.services = nil
+}
+
+func (r *TaskRunner) deregisterService(id string) {
+	if err := r.config.ServiceRegistry.Deregister(id); err != nil {
+		r.logger.Printf("[ERR] client: failed to deregister service '%s' of task '%s' for alloc '%s': %v",
+			id, r.task.Name, r.allocID, err)
+	}
+}
+
+// startServices registers the services of a task without checks once it is
+// running. A task with checks is registered once it is healthy.
+func (r *TaskRunner) startServices() {
+	if len(r.task.Checks) == 0 {
+		r.registerServices()
+	}
+}
@@ -0,0 +1,189 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+var _ config.ServiceRegistry = &consulRegistry{}
+
+// fakeRegistry is a service registry keeping the registered services in
+// memory
+type fakeRegistry struct {
+	services     map[string]*config.ServiceRegistration
+	registers    int
+	deregisters  int
+	deregistered time.Time
+	lock         sync.Mutex
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{services: make(map[string]*config.ServiceRegistration)}
+}
+
+func (f *fakeRegistry) Register(service *config.ServiceRegistration) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.services[service.ID] = service
+	f.registers++
+	return nil
+}
+
+func (f *fakeRegistry) Deregister(id string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.services, id)
+	f.deregisters++
+	f.deregistered = time.Now()
+	return nil
+}
+
+func (f *fakeRegistry) service(id string) *config.ServiceRegistration {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.services[id]
+}
+
+func (f *fakeRegistry) count() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.services)
+}
+
+// waitServices waits until the given number of services are registered
+func waitServices(t *testing.T, registry *fakeRegistry, n int) {
+	testutil.WaitForResult(func() (bool, error) {
+		if count := registry.count(); count != n {
+			return false, fmt.Errorf("%d services registered, want %d", count, n)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func testServicesTaskRunner(conf map[string]string) (*MockTaskStateUpdater, *TaskRunner, *fakeRegistry) {
+	upd, tr := testMockTaskRunner(conf)
+	registry := newFakeRegistry()
+	tr.config.ServiceRegistry = registry
+
+	// The services are registered at the address of the allocated network
+	tr.task.Resources.Networks[0].IP = "192.168.0.100"
+	tr.task.Services = []*structs.Service{
+		{Name: "web", PortLabel: "http", Tags: []string{"v1"}},
+		{Name: "admin", PortLabel: "http"},
+	}
+	return upd, tr, registry
+}
+
+func TestTaskRunner_Services_Register(t *testing.T) {
+	_, tr, registry := testServicesTaskRunner(map[string]string{"run_for": "10s"})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitServices(t, registry, 2)
+	id := serviceID(tr.allocID, tr.getTask().Name, tr.getTask().Services[0])
+	exp := &config.ServiceRegistration{
+		ID:      id,
+		Name:    "web",
+		Tags:    []string{"v1"},
+		Address: "192.168.0.100",
+		Port:    80,
+	}
+	if reg := registry.service(id); !reflect.DeepEqual(reg, exp) {
+		t.Fatalf("got %#v; want %#v", reg, exp)
+	}
+
+	// Updates change the registrations and remove dropped services
+	update := new(structs.Task)
+	*update = *tr.getTask()
+	update.Services = []*structs.Service{{Name: "web", PortLabel: "http", Tags: []string{"v2"}}}
+	tr.Update(update)
+	testutil.WaitForResult(func() (bool, error) {
+		reg := registry.service(id)
+		return registry.count() == 1 && reg != nil && reflect.DeepEqual(reg.Tags, []string{"v2"}), nil
+	}, func(err error) {
+		t.Fatalf("services not updated")
+	})
+}
+
+func TestTaskRunner_Services_Exit(t *testing.T) {
+	_, tr, registry := testServicesTaskRunner(map[string]string{"run_for": "100ms"})
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.registers != 2 || registry.deregisters != 2 || len(registry.services) != 0 {
+		t.Fatalf("bad: %d registers, %d deregisters, %v registered",
+			registry.registers, registry.deregisters, registry.services)
+	}
+}
+
+func TestTaskRunner_Services_Destroy(t *testing.T) {
+	upd, tr, registry := testServicesTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.ShutdownDelay = 200 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitServices(t, registry, 2)
+	handle := tr.getHandle().(*mockHandle)
+
+	// The services are deregistered before the shutdown delay
+	tr.Destroy()
+	waitDescription(t, upd, "waiting 200ms before killing the task")
+	if n := registry.count(); n != 0 {
+		t.Fatalf("%d services registered while draining", n)
+	}
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if killed := handle.killTime(); !registry.deregistered.Before(killed) {
+		t.Fatalf("services deregistered at %v, after the task was killed at %v",
+			registry.deregistered, killed)
+	}
+}
+
+func TestTaskRunner_Services_Healthy(t *testing.T) {
+	srv := newToggleServer(http.StatusInternalServerError)
+	defer srv.Close()
+
+	upd, tr, registry := testServicesTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:     "alive",
+		Type:     structs.TaskCheckTypeHTTP,
+		URL:      srv.URL,
+		Interval: 10 * time.Millisecond,
+	}}
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// A task with checks is only registered once it is healthy
+	waitDescription(t, upd, "task is unhealthy")
+	if n := registry.count(); n != 0 {
+		t.Fatalf("%d services registered before the task is healthy", n)
+	}
+	srv.setStatus(http.StatusOK)
+	waitServices(t, registry, 2)
+}
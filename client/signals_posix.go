@@ -0,0 +1,25 @@
+// +build !windows
+
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalLookup maps signal names to the signals that can be sent to tasks
+var signalLookup = map[string]os.Signal{
+	"SIGABRT":  syscall.SIGABRT,
+	"SIGALRM":  syscall.SIGALRM,
+	"SIGCONT":  syscall.SIGCONT,
+	"SIGHUP":   syscall.SIGHUP,
+	"SIGINT":   syscall.SIGINT,
+	"SIGKILL":  syscall.SIGKILL,
+	"SIGQUIT":  syscall.SIGQUIT,
+	"SIGSTOP":  syscall.SIGSTOP,
+	"SIGTERM":  syscall.SIGTERM,
+	"SIGTSTP":  syscall.SIGTSTP,
+	"SIGUSR1":  syscall.SIGUSR1,
+	"SIGUSR2":  syscall.SIGUSR2,
+	"SIGWINCH": syscall.SIGWINCH,
+}
@@ -0,0 +1,15 @@
+package client
+
+import (
+	"os"
+	"syscall"
+)
+
+// signalLookup maps signal names to the signals that can be sent to tasks
+var signalLookup = map[string]os.Signal{
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGINT":  syscall.SIGINT,
+	"SIGKILL": syscall.SIGKILL,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGTERM": syscall.SIGTERM,
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"sync"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// subscriptionBuffer is how many events a subscriber can fall behind by
+// before its oldest undelivered events are dropped
+const subscriptionBuffer = 64
+
+// taskSubscriptions are the subscribers to the events of a task
+type taskSubscriptions struct {
+	lock   sync.Mutex
+	subs   map[chan *structs.TaskEvent]struct{}
+	closed bool
+}
+
+// Subscribe returns a channel receiving every event of the task as it is
+// recorded, and a func ending the subscription. Events are never blocked on:
+// a subscriber that falls behind loses its oldest undelivered events. The
+// channel is closed once the subscription ends or the task runner exits.
+func (r *TaskRunner) Subscribe() (<-chan *structs.TaskEvent, func()) {
+	ch := make(chan *structs.TaskEvent, subscriptionBuffer)
+	s := &r.subscriptions
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if s.subs == nil {
+		s.subs = make(map[chan *structs.TaskEvent]struct{})
+	}
+	s.subs[ch] = struct{}{}
+
+	cancel := func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// publish delivers the event to the subscribers, dropping the oldest event
+// of those whose buffer is full
+func (r *TaskRunner) publish(event *structs.TaskEvent) {
+	s := &r.subscriptions
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ch := range s.subs {
+		for {
+			select {
+			case ch <- event:
+			default:
+				select {
+				case <-ch:
+				default:
+				}
+				continue
+			}
+			break
+		}
+	}
+}
+
+// closeSubscriptions ends every subscription once the task runner exits, so
+// subscribing afterwards returns a closed channel
+func (r *TaskRunner) closeSubscriptions() {
+	s := &r.subscriptions
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for ch := range s.subs {
+		close(ch)
+	}
+	s.subs = nil
+	s.closed = true
+}
@@ -0,0 +1,104 @@
+package client
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// collectEvents returns the types of the events received on the channel
+// until it is closed
+func collectEvents(t *testing.T, ch <-chan *structs.TaskEvent) []string {
+	var types []string
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				return types
+			}
+			types = append(types, e.Type)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout; received %v", types)
+		}
+	}
+}
+
+func TestTaskRunner_Subscribe(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10ms",
+	})
+	defer tr.ctx.AllocDir.Destroy()
+	first, cancelFirst := tr.Subscribe()
+	defer cancelFirst()
+	second, cancelSecond := tr.Subscribe()
+	defer cancelSecond()
+	go tr.Run()
+	defer tr.Destroy()
+
+	// Both subscribers receive every event in order, and their channels are
+	// closed once the task runner exits
+	firstTypes, secondTypes := collectEvents(t, first), collectEvents(t, second)
+	var exp []string
+	for _, e := range tr.Events() {
+		exp = append(exp, e.Type)
+	}
+	if !reflect.DeepEqual(firstTypes, exp) || !reflect.DeepEqual(secondTypes, exp) {
+		t.Fatalf("got %v and %v; want %v", firstTypes, secondTypes, exp)
+	}
+
+	// Subscribing to an exited task runner gets nothing
+	late, cancelLate := tr.Subscribe()
+	defer cancelLate()
+	if types := collectEvents(t, late); len(types) != 0 {
+		t.Fatalf("bad: %v", types)
+	}
+}
+
+func TestTaskRunner_Subscribe_Cancel(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	kept, cancelKept := tr.Subscribe()
+	cancelled, cancel := tr.Subscribe()
+
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetSignal(1))
+	cancel()
+	cancel()
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetSignal(2))
+	cancelKept()
+
+	// Delivery stops once the subscription is cancelled
+	if types := collectEvents(t, cancelled); len(types) != 1 {
+		t.Fatalf("bad: %v", types)
+	}
+	if types := collectEvents(t, kept); len(types) != 2 {
+		t.Fatalf("bad: %v", types)
+	}
+
+	// Ending the task runner after the cancellations is fine
+	tr.closeSubscriptions()
+}
+
+func TestTaskRunner_Subscribe_Slow(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	ch, cancel := tr.Subscribe()
+	defer cancel()
+
+	// A subscriber that doesn't keep up loses its oldest events, without
+	// holding up the others
+	for i := 0; i < subscriptionBuffer+5; i++ {
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetSignal(i))
+	}
+	for i := 5; i < subscriptionBuffer+5; i++ {
+		if e := <-ch; e.Signal != i {
+			t.Fatalf("got event %#v; want signal %d", e, i)
+		}
+	}
+	select {
+	case e := <-ch:
+		t.Fatalf("unexpected event %#v", e)
+	default:
+	}
+}
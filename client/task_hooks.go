@@ -0,0 +1,270 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/client/getter"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// TaskHook is run by the task runner around the lifetime of a task. The
+// built-in hooks run first, followed by the registered ones in the order
+// they were registered.
+type TaskHook interface {
+	// Name identifies the hook in logs and events
+	Name() string
+
+	// Prestart is run before every start of the task, including restarts.
+	// An error fails the task without running the remaining hooks.
+	Prestart(ctx *TaskHookContext) error
+
+	// Poststop is run once the task runner exits, whether the task
+	// completed, failed or was destroyed. Every hook is run even if one
+	// fails.
+	Poststop(ctx *TaskHookContext) error
+}
+
+// TaskHookContext is what the hooks of a task may inspect and change. Changes
+// to the exec context, such as the environment of the task, are seen by the
+// driver when it starts the task.
+type TaskHookContext struct {
+	AllocID string
+	Task    *structs.Task
+	ExecCtx *driver.ExecContext
+
+	// DestroyCh is closed once the task is destroyed, so long running hooks
+	// can be aborted
+	DestroyCh <-chan struct{}
+}
+
+// hookFailure is returned by the built-in hooks to fail the task with their
+// own event type. A dead status means the hook was aborted rather than
+// failed.
+type hookFailure struct {
+	event  string
+	status string
+	err    error
+}
+
+func (f *hookFailure) Error() string {
+	return f.err.Error()
+}
+
+// RegisterHook adds a hook run after the built-in ones. It must be called
+// before the task runner is run.
+func (r *TaskRunner) RegisterHook(hook TaskHook) {
+	r.hooks = append(r.hooks, hook)
+}
+
+// builtinHooks returns the hooks every task runner runs, in order
+func builtinHooks(r *TaskRunner) []TaskHook {
+	return []TaskHook{
+		&artifactsHook{r},
+		&secretsHook{r},
+		&envHook{r},
+		&templatesHook{r},
+		&envFilesHook{r},
+		&servicesHook{r},
+	}
+}
+
+// hookContext returns the context the hooks of the task are run with
+func (r *TaskRunner) hookContext() *TaskHookContext {
+	return &TaskHookContext{
+		AllocID:   r.allocID,
+		Task:      r.task,
+		ExecCtx:   r.ctx,
+		DestroyCh: r.destroyCh,
+	}
+}
+
+// runPrestartHooks runs the prestart hooks in order, failing the task with
+// an event naming the first hook that fails
+func (r *TaskRunner) runPrestartHooks() error {
+	ctx := r.hookContext()
+	for _, hook := range r.hooks {
+		err := hook.Prestart(ctx)
+		if err == nil {
+			continue
+		}
+
+		r.logger.Printf("[ERR] client: prestart hook '%s' of task '%s' for alloc '%s' failed: %v",
+			hook.Name(), r.task.Name, r.allocID, err)
+		event := structs.NewTaskEvent(structs.TaskHookFailed).
+			SetMessage(fmt.Sprintf("prestart hook '%s' failed: %v", hook.Name(), err))
+		status := structs.AllocClientStatusFailed
+		if f, ok := err.(*hookFailure); ok {
+			event = structs.NewTaskEvent(f.event).SetMessage(f.Error())
+			if f.status != "" {
+				status = f.status
+			}
+		}
+		r.emitEvent(status, event.SetHook(hook.Name()))
+		if status != structs.AllocClientStatusDead {
+			r.incrCounter("failed")
+		}
+		return err
+	}
+	return nil
+}
+
+// runPoststopHooks runs every poststop hook in order, logging failures
+func (r *TaskRunner) runPoststopHooks() {
+	ctx := r.hookContext()
+	for _, hook := range r.hooks {
+		if err := hook.Poststop(ctx); err != nil {
+			r.logger.Printf("[ERR] client: poststop hook '%s' of task '%s' for alloc '%s' failed: %v",
+				hook.Name(), r.task.Name, r.allocID, err)
+		}
+	}
+}
+
+// artifactsHook fetches the artifacts of the task before anything that may
+// depend on them
+type artifactsHook struct {
+	r *TaskRunner
+}
+
+func (h *artifactsHook) Name() string {
+	return "artifacts"
+}
+
+func (h *artifactsHook) Prestart(ctx *TaskHookContext) error {
+	if err := h.r.downloadArtifacts(); err != nil {
+		failure := &hookFailure{event: structs.TaskArtifactDownloadFailed, err: err}
+		if err == getter.ErrAborted {
+			failure.status = structs.AllocClientStatusDead
+		}
+		return failure
+	}
+	return nil
+}
+
+func (h *artifactsHook) Poststop(ctx *TaskHookContext) error {
+	return nil
+}
+
+// secretsHook fetches the provider secrets of the task and writes its secrets
+// before anything that may read them, and removes them once the task no
+// longer runs
+type secretsHook struct {
+	r *TaskRunner
+}
+
+func (h *secretsHook) Name() string {
+	return "secrets"
+}
+
+func (h *secretsHook) Prestart(ctx *TaskHookContext) error {
+	if err := h.r.providerSecrets.fetch(h.r.secretPaths()); err != nil {
+		return &hookFailure{event: structs.TaskSecretsFailure, err: err}
+	}
+	if err := h.r.writeSecrets(); err != nil {
+		return &hookFailure{event: structs.TaskSecretsFailure, err: err}
+	}
+	return nil
+}
+
+func (h *secretsHook) Poststop(ctx *TaskHookContext) error {
+	h.r.removeSecrets()
+	return nil
+}
+
+// envHook reserves the ports of the task and sets the environment built
+// from them on the exec context, which the templates are rendered with. The
+// ports are released once the task runner exits.
+type envHook struct {
+	r *TaskRunner
+}
+
+func (h *envHook) Name() string {
+	return "env"
+}
+
+func (h *envHook) Prestart(ctx *TaskHookContext) error {
+	if err := h.r.reservePorts(); err != nil {
+		return &hookFailure{event: structs.TaskPortConflict, err: err}
+	}
+	if err := h.r.setupPorts(); err != nil {
+		return &hookFailure{event: structs.TaskPortConflict, err: err}
+	}
+	env, err := h.r.templateEnv()
+	if err != nil {
+		return &hookFailure{event: structs.TaskSecretsFailure, err: err}
+	}
+	ctx.ExecCtx.SetTaskEnv(ctx.Task.Name, env)
+	return nil
+}
+
+func (h *envHook) Poststop(ctx *TaskHookContext) error {
+	h.r.releasePorts()
+	return nil
+}
+
+// templatesHook renders the templates with the environment the task is
+// started with
+type templatesHook struct {
+	r *TaskRunner
+}
+
+func (h *templatesHook) Name() string {
+	return "templates"
+}
+
+func (h *templatesHook) Prestart(ctx *TaskHookContext) error {
+	if _, err := h.r.renderTemplates(ctx.ExecCtx.TaskEnv(ctx.Task.Name)); err != nil {
+		return &hookFailure{event: structs.TaskTemplateFailure, err: err}
+	}
+	return nil
+}
+
+func (h *templatesHook) Poststop(ctx *TaskHookContext) error {
+	return nil
+}
+
+// envFilesHook reads the env files of the task once the artifacts are
+// fetched and the templates rendered, and adds their variables to the
+// environment on the exec context
+type envFilesHook struct {
+	r *TaskRunner
+}
+
+func (h *envFilesHook) Name() string {
+	return "env_files"
+}
+
+func (h *envFilesHook) Prestart(ctx *TaskHookContext) error {
+	if err := h.r.loadEnvFiles(); err != nil {
+		return &hookFailure{event: structs.TaskEnvFileFailure, err: err}
+	}
+	env, err := h.r.buildEnv()
+	if err != nil {
+		return &hookFailure{event: structs.TaskSecretsFailure, err: err}
+	}
+	ctx.ExecCtx.SetTaskEnv(ctx.Task.Name, env)
+	return nil
+}
+
+func (h *envFilesHook) Poststop(ctx *TaskHookContext) error {
+	return nil
+}
+
+// servicesHook deregisters any service still registered for the task once
+// the task runner exits, e.g. if the task failed to restart
+type servicesHook struct {
+	r *TaskRunner
+}
+
+func (h *servicesHook) Name() string {
+	return "services"
+}
+
+func (h *servicesHook) Prestart(ctx *TaskHookContext) error {
+	return nil
+}
+
+func (h *servicesHook) Poststop(ctx *TaskHookContext) error {
+	h.r.deregisterServices()
+	return nil
+}
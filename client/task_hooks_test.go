@@ -0,0 +1,150 @@
+package client
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// hookRecorder records the invocations of the fake hooks of a test
+type hookRecorder struct {
+	calls []string
+	lock  sync.Mutex
+}
+
+func (r *hookRecorder) record(call string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *hookRecorder) invocations() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// fakeHook records its invocations and fails its prestart if prestartErr is
+// set
+type fakeHook struct {
+	name        string
+	recorder    *hookRecorder
+	prestartErr error
+}
+
+func (h *fakeHook) Name() string {
+	return h.name
+}
+
+func (h *fakeHook) Prestart(ctx *TaskHookContext) error {
+	h.recorder.record(h.name + ".prestart")
+	if h.prestartErr != nil {
+		return h.prestartErr
+	}
+
+	// The environment built by the built-in hooks can be changed
+	env := ctx.ExecCtx.TaskEnv(ctx.Task.Name)
+	env["HOOK_"+h.name] = "1"
+	ctx.ExecCtx.SetTaskEnv(ctx.Task.Name, env)
+	return nil
+}
+
+func (h *fakeHook) Poststop(ctx *TaskHookContext) error {
+	h.recorder.record(h.name + ".poststop")
+	return nil
+}
+
+func TestTaskRunner_Hooks(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10ms"})
+	defer tr.ctx.AllocDir.Destroy()
+	rec := &hookRecorder{}
+	tr.RegisterHook(&fakeHook{name: "first", recorder: rec})
+	tr.RegisterHook(&fakeHook{name: "second", recorder: rec})
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+
+	// The hooks run in the order they were registered, around the task
+	exp := []string{"first.prestart", "second.prestart", "first.poststop", "second.poststop"}
+	if calls := rec.invocations(); !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("got %v; want %v", calls, exp)
+	}
+	env := tr.ctx.TaskEnv(tr.task.Name)
+	if env["HOOK_first"] != "1" || env["HOOK_second"] != "1" || env["NOMAD_ALLOC_ID"] != tr.allocID {
+		t.Fatalf("bad env: %v", env)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_Hooks_Failed(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	rec := &hookRecorder{}
+	tr.RegisterHook(&fakeHook{name: "first", recorder: rec, prestartErr: errors.New("vault sealed")})
+	tr.RegisterHook(&fakeHook{name: "second", recorder: rec})
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The failing hook stops the following ones and the task from starting,
+	// but every hook is still stopped
+	exp := []string{"first.prestart", "first.poststop", "second.poststop"}
+	if calls := rec.invocations(); !reflect.DeepEqual(calls, exp) {
+		t.Fatalf("got %v; want %v", calls, exp)
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed ||
+		desc != "prestart hook 'first' failed: vault sealed" {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskHookFailed || last.Hook != "first" {
+		t.Fatalf("bad: %#v", last)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestTaskRunner_Hooks_Builtin(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Templates = []*structs.Template{{EmbeddedTmpl: "x", DestPath: "../../../escape"}}
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Built-in hooks keep their own events, naming the hook
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskTemplateFailure || last.Hook != "templates" {
+		t.Fatalf("bad: %#v", last)
+	}
+
+	var names []string
+	for _, hook := range tr.hooks {
+		names = append(names, hook.Name())
+	}
+	if exp := []string{"artifacts", "secrets", "env", "templates", "env_files", "services"}; !reflect.DeepEqual(names, exp) {
+		t.Fatalf("got %v; want %v", names, exp)
+	}
+}
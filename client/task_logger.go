@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// LogLevels are the levels of the client logs in increasing order of
+// severity
+var LogLevels = []string{"TRACE", "DEBUG", "INFO", "WARN", "ERR"}
+
+// logLevelIndex returns the position of the level in LogLevels, or -1 if it
+// is not one of them
+func logLevelIndex(level string) int {
+	for i, l := range LogLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidateLogLevels checks the task log levels of the config
+func ValidateLogLevels(config *config.Config) error {
+	if config.TaskLogLevel != "" && logLevelIndex(config.TaskLogLevel) < 0 {
+		return fmt.Errorf("invalid task log level '%s', must be one of %v", config.TaskLogLevel, LogLevels)
+	}
+	for task, level := range config.TaskLogLevels {
+		if logLevelIndex(level) < 0 {
+			return fmt.Errorf("invalid log level '%s' of task '%s', must be one of %v", level, task, LogLevels)
+		}
+	}
+	return nil
+}
+
+// taskLogWriter writes the logs of a task runner. Lines below the log level
+// of the task are dropped and the others are written as is, or as JSON
+// objects carrying the fields that identify the task.
+type taskLogWriter struct {
+	out      io.Writer
+	minLevel int
+	json     bool
+
+	allocID string
+	task    string
+	driver  string
+	lock    sync.Mutex
+}
+
+// jsonLogLine is a log line of a task runner written as JSON
+type jsonLogLine struct {
+	Timestamp string `json:"@timestamp"`
+	Level     string `json:"@level,omitempty"`
+	Message   string `json:"@message"`
+	AllocID   string `json:"alloc_id"`
+	Task      string `json:"task"`
+	Driver    string `json:"driver"`
+	Event     string `json:"event,omitempty"`
+}
+
+// newTaskLogger returns the logger of a task runner. The logger of the client
+// is used as is unless the task has a log level or logs are written as JSON,
+// in which case the writer of the returned logger is returned as well.
+func newTaskLogger(logger *log.Logger, config *config.Config, allocID string, task *structs.Task) (*log.Logger, *taskLogWriter) {
+	level := config.ReadTaskLogLevel(task.Name)
+	if level == "" && !config.LogJSON {
+		return logger, nil
+	}
+
+	out := config.LogOutput
+	if out == nil {
+		out = os.Stderr
+	}
+	w := &taskLogWriter{
+		out:      out,
+		minLevel: logLevelIndex(level),
+		json:     config.LogJSON,
+		allocID:  allocID,
+		task:     task.Name,
+		driver:   task.Driver,
+	}
+	return log.New(w, "", 0), w
+}
+
+// setDriver sets the driver logged for the task, e.g. once it is restored
+func (w *taskLogWriter) setDriver(driver string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.driver = driver
+}
+
+// setLevel sets the log level of the task, e.g. once the client is reloaded
+func (w *taskLogWriter) setLevel(level string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.minLevel = logLevelIndex(level)
+}
+
+// Write writes a line logged through the logger of the task runner, which
+// starts with the level in brackets, e.g. "[ERR] client: ...".
+func (w *taskLogWriter) Write(p []byte) (int, error) {
+	line := string(bytes.TrimRight(p, "\n"))
+	var level string
+	if strings.HasPrefix(line, "[") {
+		if end := strings.Index(line, "] "); end > 0 {
+			level, line = line[1:end], line[end+2:]
+		}
+	}
+	if err := w.writeEntry(level, line, ""); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeEntry writes the message if its level is not below the log level of
+// the task. Messages without a known level are always written.
+func (w *taskLogWriter) writeEntry(level, msg, event string) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if idx := logLevelIndex(level); idx >= 0 && idx < w.minLevel {
+		return nil
+	}
+
+	now := time.Now()
+	if !w.json {
+		prefix := now.Format("2006/01/02 15:04:05 ")
+		if level != "" {
+			prefix += "[" + level + "] "
+		}
+		_, err := io.WriteString(w.out, prefix+msg+"\n")
+		return err
+	}
+
+	buf, err := json.Marshal(&jsonLogLine{
+		Timestamp: now.UTC().Format(time.RFC3339Nano),
+		Level:     level,
+		Message:   msg,
+		AllocID:   w.allocID,
+		Task:      w.task,
+		Driver:    w.driver,
+		Event:     event,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.out.Write(append(buf, '\n'))
+	return err
+}
+
+// logEvent logs the event recorded for the task at the DEBUG level, with the
+// type of the event as a field of JSON logs
+func (r *TaskRunner) logEvent(event *structs.TaskEvent) {
+	msg := fmt.Sprintf("client: task '%s' for alloc '%s' recorded event '%s'",
+		r.task.Name, r.allocID, event.Type)
+	if event.Message != "" {
+		msg += ": " + event.Message
+	}
+	if r.logWriter != nil {
+		r.logWriter.writeEntry("DEBUG", msg, event.Type)
+		return
+	}
+	r.logger.Printf("[DEBUG] %s", msg)
+}
@@ -0,0 +1,148 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/hashicorp/nomad/nomad/mock"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+func TestTaskLogger_Default(t *testing.T) {
+	logger := testLogger()
+	conf := DefaultConfig()
+	task := mock.Alloc().Job.TaskGroups[0].Tasks[0]
+
+	// Without a level or JSON the client logger is used as is
+	l, w := newTaskLogger(logger, conf, "foo", task)
+	if l != logger || w != nil {
+		t.Fatalf("expected the client logger")
+	}
+}
+
+func TestTaskLogger_Level(t *testing.T) {
+	var buf bytes.Buffer
+	conf := DefaultConfig()
+	conf.LogOutput = &buf
+	conf.TaskLogLevel = "WARN"
+	conf.TaskLogLevels = map[string]string{"db": "DEBUG"}
+	task := mock.Alloc().Job.TaskGroups[0].Tasks[0]
+
+	l, _ := newTaskLogger(testLogger(), conf, "foo", task)
+	l.Printf("[DEBUG] client: debug")
+	l.Printf("[INFO] client: info")
+	l.Printf("[WARN] client: warn")
+	l.Printf("[ERR] client: err")
+	l.Printf("no level")
+
+	out := buf.String()
+	for _, s := range []string{"debug", "info"} {
+		if strings.Contains(out, s) {
+			t.Fatalf("%q logged: %s", s, out)
+		}
+	}
+	for _, s := range []string{"[WARN] client: warn", "[ERR] client: err", "no level"} {
+		if !strings.Contains(out, s) {
+			t.Fatalf("%q not logged: %s", s, out)
+		}
+	}
+
+	// The level of the task overrides the default
+	buf.Reset()
+	task.Name = "db"
+	l, _ = newTaskLogger(testLogger(), conf, "foo", task)
+	l.Printf("[DEBUG] client: debug")
+	l.Printf("[TRACE] client: trace")
+	if out := buf.String(); !strings.Contains(out, "debug") || strings.Contains(out, "trace") {
+		t.Fatalf("bad: %s", out)
+	}
+}
+
+func TestTaskLogger_JSON(t *testing.T) {
+	var buf bytes.Buffer
+	conf := DefaultConfig()
+	conf.LogOutput = &buf
+	conf.LogJSON = true
+	conf.TaskLogLevel = "INFO"
+	task := mock.Alloc().Job.TaskGroups[0].Tasks[0]
+
+	l, w := newTaskLogger(testLogger(), conf, "foo", task)
+	l.Printf("[DEBUG] client: dropped")
+	l.Printf("[ERR] client: failed to start task")
+	w.writeEntry("INFO", "client: started", structs.TaskStarted)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines: %q", lines)
+	}
+	var entries []map[string]string
+	for _, line := range lines {
+		var e map[string]string
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		if e["alloc_id"] != "foo" || e["task"] != task.Name || e["driver"] != task.Driver || e["@timestamp"] == "" {
+			t.Fatalf("bad fields: %v", e)
+		}
+		entries = append(entries, e)
+	}
+
+	if e := entries[0]; e["@level"] != "ERR" || e["@message"] != "client: failed to start task" {
+		t.Fatalf("bad: %v", e)
+	}
+	if _, ok := entries[0]["event"]; ok {
+		t.Fatalf("unexpected event: %v", entries[0])
+	}
+	if e := entries[1]; e["@level"] != "INFO" || e["event"] != structs.TaskStarted {
+		t.Fatalf("bad: %v", e)
+	}
+}
+
+func TestTaskRunner_LogEvents(t *testing.T) {
+	var buf bytes.Buffer
+	_, tr := testTaskRunner()
+	tr.config.LogOutput = &buf
+	tr.config.LogJSON = true
+	tr.config.TaskLogLevel = "DEBUG"
+	tr.logger, tr.logWriter = newTaskLogger(tr.logger, tr.config, tr.allocID, tr.task)
+
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskKilled).SetMessage("killed by user"))
+
+	var e map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if e["event"] != structs.TaskKilled || !strings.Contains(e["@message"], "killed by user") {
+		t.Fatalf("bad: %v", e)
+	}
+
+	// Events are below the level of the task
+	buf.Reset()
+	tr.config.TaskLogLevel = "INFO"
+	tr.logger, tr.logWriter = newTaskLogger(tr.logger, tr.config, tr.allocID, tr.task)
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskStarted))
+	if buf.Len() != 0 {
+		t.Fatalf("event logged: %s", buf.String())
+	}
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	conf := DefaultConfig()
+	conf.TaskLogLevel = "INFO"
+	conf.TaskLogLevels = map[string]string{"web": "TRACE"}
+	if err := ValidateLogLevels(conf); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	conf.TaskLogLevels["web"] = "VERBOSE"
+	if err := ValidateLogLevels(conf); err == nil || !strings.Contains(err.Error(), "web") {
+		t.Fatalf("expected error: %v", err)
+	}
+	conf.TaskLogLevels = nil
+	conf.TaskLogLevel = "debug"
+	if err := ValidateLogLevels(conf); err == nil {
+		t.Fatalf("expected error")
+	}
+}
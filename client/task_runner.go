@@ -1,19 +1,47 @@
 package client
 
 import (
+	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/client/driver/environment"
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/client/getter"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+const (
+	// taskStatsInterval is how often the resource usage of a running task
+	// is collected from its driver
+	taskStatsInterval = 1 * time.Second
+
+	// maxTaskEvents is the number of events retained per task. Older events
+	// are evicted as new ones are recorded.
+	maxTaskEvents = 10
+
+	// defaultMaxTaskStateSize is the size in bytes the saved state of a task
+	// is kept under if the client does not configure it
+	defaultMaxTaskStateSize = 1024 * 1024
+
+	// defaultTaskUpdateBufferSize is the number of pending updates buffered
+	// per task if the client does not configure it
+	defaultTaskUpdateBufferSize = 8
+)
+
 // TaskRunner is used to wrap a task within an allocation and provide the execution context.
 type TaskRunner struct {
 	config  *config.Config
@@ -22,39 +50,265 @@ type TaskRunner struct {
 	ctx     *driver.ExecContext
 	allocID string
 
-	task     *structs.Task
-	updateCh chan *structs.Task
-	handle   driver.DriverHandle
+	// logWriter is the writer of logger if the task has its own log level
+	// or logs as JSON
+	logWriter *taskLogWriter
+
+	task           *structs.Task
+	updateCh       chan *structs.Task
+	updateLock     sync.Mutex
+	signalCh       chan *signalRequest
+	execCh         chan chan driver.DriverHandle
+	handle         driver.DriverHandle
+	restartTracker *restartTracker
+
+	// restarts is the number of times the task was restarted, across the
+	// intervals of its restart policy
+	restarts int
+
+	// lock guards the task, its handle, the restart counters and
+	// legacyState. Only Run changes them once the task runs, so Run reads
+	// them without the lock, while the other goroutines, such as the saves
+	// of the state, take it.
+	lock sync.RWMutex
+
+	// deadlineCh fires once the current run of the task exceeds its max
+	// runtime. It is nil if the task has none.
+	deadlineCh <-chan time.Time
+
+	// caps are the capabilities of the driver of the task, set once the
+	// task is started or restored
+	caps *driver.DriverCapabilities
+
+	// restartCh receives the reason of a manual restart. restartPending is
+	// set from the request until the task has been started again, so
+	// repeated requests result in a single restart.
+	restartCh      chan string
+	restartPending bool
+	restartLock    sync.Mutex
+
+	// restoreErr is set if the state of a restored task was corrupt or its
+	// handle could not be re-opened, in which case the task is not started
+	// again
+	restoreErr error
+
+	// reattachErr is set if the handle of a restored task is of a version
+	// its driver doesn't understand, such as one started by a driver plugin
+	// before it was upgraded, in which case the task is started again.
+	// reattachHandleID is the ID of that handle, whose resources the cleanup
+	// of the driver must leave alone as it can't tell what they are.
+	reattachErr      error
+	reattachHandleID string
+
+	// lostErr is set if the task of a restored handle was gone, in which
+	// case the restart policy decides whether it is started again
+	lostErr error
+
+	// legacyState is set if the state was restored from the legacy
+	// location and has not yet been moved
+	legacyState bool
+
+	// hooks are run before the task is started and once it has stopped
+	hooks []TaskHook
+
+	// reservedPorts are the ports claimed on reservedIP with the port
+	// allocator of the client until the task runner exits
+	reservedIP    string
+	reservedPorts []int
+
+	// startedAt is when the task was last started by the task runner. It
+	// is unset for a restored task.
+	startedAt time.Time
+
+	// artifactsDownloaded is set once the artifacts of the task have been
+	// fetched so restarts don't download them again
+	artifactsDownloaded bool
+
+	// destroyReason is why the task is destroyed. It is set before destroyCh
+	// is closed.
+	destroy       bool
+	destroyReason KillReason
+	destroyCh     chan struct{}
+	destroyLock   sync.Mutex
+	waitCh        chan struct{}
+
+	// forceDestroyCh is closed by ForceDestroy to skip the shutdown delay
+	forceDestroy   bool
+	forceDestroyCh chan struct{}
+
+	shutdown     bool
+	shutdownCh   chan struct{}
+	shutdownLock sync.Mutex
+
+	// resourceUsage is the latest resource usage of the running task. It is
+	// collected every statsInterval until statsStopCh is closed, or until the
+	// driver reports stats as unsupported, which sets statsUnsupported.
+	resourceUsage    *driver.TaskResourceUsage
+	statsUnsupported bool
+	statsInterval    time.Duration
+	statsStopCh      chan struct{}
+	statsLock        sync.Mutex
+
+	// diskQuotaInterval is how often the disk usage of the local dir of the
+	// task is measured against its quota
+	diskQuotaInterval time.Duration
+
+	// templateKeys are the keys of the KV store the templates read. Once
+	// they change, the templates are rendered again after they stayed the
+	// same for keyDebounce.
+	templateKeys *templateKeys
+	keyDebounce  time.Duration
+
+	// providerSecrets are the secrets of the task read from the secret
+	// provider, which are renewed while the task runs
+	providerSecrets *providerSecrets
+
+	// dryRun is set when the runner only resolves what the task would be
+	// started with, which never fetches the provider secrets
+	dryRun bool
+
+	// persister saves the state of the task as its events are recorded, at
+	// most once per state save interval
+	persister *statePersister
+
+	// health is the aggregate health of the running task, derived from the
+	// states of its checks. The checks run until checksStopCh is closed.
+	health       string
+	checkStates  map[string]*checkState
+	checksStopCh chan struct{}
+	healthLock   sync.Mutex
+
+	// logPositions are where the stdout and stderr of the current run of
+	// the task begin, which its log checks tail from
+	logPositions map[string]logging.Position
+
+	// envFileVars are the variables read from the env files of the task when
+	// it was last started
+	envFileVars map[string]string
+
+	// healthyCh is signalled by the checks when the task becomes healthy,
+	// so that Run registers its services
+	healthyCh chan struct{}
 
-	destroy     bool
-	destroyCh   chan struct{}
-	destroyLock sync.Mutex
-	waitCh      chan struct{}
+	// services are the IDs of the services registered for the task. They
+	// are registered while servicesRegistered is set, from the task being
+	// ready until it stops running.
+	services           map[string]struct{}
+	servicesRegistered bool
+
+	// dependencies are the runners of the tasks this task depends on, by
+	// name. The task is started once they are ready and killed if one of
+	// them fails.
+	dependencies map[string]*TaskRunner
+
+	// prestart are the runners of the prestart tasks of the group, by name.
+	// The task is only started once they have all completed successfully.
+	prestart map[string]*TaskRunner
+
+	// priority is the priority of the job of the task, which weighs its
+	// resources on an oversubscribed client
+	priority int
+
+	// readyCh is closed once the task is running, and healthy if it has
+	// checks, signalling dependent tasks that they may start
+	readyCh   chan struct{}
+	readyOnce sync.Once
+
+	// completed is set if the task exited successfully. It must only be
+	// read once waitCh is closed.
+	completed bool
+
+	// events is the history of the task, oldest first, bounded to the
+	// last maxTaskEvents events
+	events     []*structs.TaskEvent
+	eventsLock sync.Mutex
+
+	// subscriptions are pushed each event as it is recorded
+	subscriptions taskSubscriptions
+
+	// clock times the restarts, the shutdown delay, the kill timeouts and
+	// the checks
+	clock config.Clock
 }
 
+// KillReason is why the client kills a task. It is recorded in the events
+// of the kill and of the exit of the task, and in the description of its
+// final status.
+type KillReason struct {
+	// Kind is one of the structs.TaskKillReason constants
+	Kind string
+
+	// Message describes the reason for operators
+	Message string
+}
+
+// allocStopped is the reason the tasks are destroyed for when their
+// allocation is stopped or removed from the client
+var allocStopped = KillReason{Kind: structs.TaskKillReasonStopped, Message: "allocation stopped"}
+
+// errDestroyedBeforeStart is returned when the task is destroyed while it
+// waits for its dependencies
+var errDestroyedBeforeStart = errors.New("task destroyed before it was started")
+
 // taskRunnerState is used to snapshot the state of the task runner
 type taskRunnerState struct {
-	Task     *structs.Task
-	HandleID string
+	Task         *structs.Task
+	HandleID     string
+	RestartCount int
+	RestartStart time.Time
+	Restarts     int
+	Events       []*structs.TaskEvent
 }
 
-// TaskStateUpdater is used to update the status of a task
-type TaskStateUpdater func(taskName, status, desc string)
+// TaskStateUpdater is used to update the status of a task. A terminal status
+// comes with how the task exited, and any other with a nil exit.
+type TaskStateUpdater func(taskName, status, desc string, exit *structs.TaskExit)
 
 // NewTaskRunner is used to create a new task context
 func NewTaskRunner(logger *log.Logger, config *config.Config,
 	updater TaskStateUpdater, ctx *driver.ExecContext,
 	allocID string, task *structs.Task) *TaskRunner {
+	updateBufferSize := config.TaskUpdateBufferSize
+	if updateBufferSize <= 0 {
+		updateBufferSize = defaultTaskUpdateBufferSize
+	}
+
+	logger, logWriter := newTaskLogger(logger, config, allocID, task)
+	clock := clockOf(config)
 	tc := &TaskRunner{
-		config:    config,
-		updater:   updater,
-		logger:    logger,
-		ctx:       ctx,
-		allocID:   allocID,
-		task:      task,
-		updateCh:  make(chan *structs.Task, 8),
-		destroyCh: make(chan struct{}),
-		waitCh:    make(chan struct{}),
+		config:            config,
+		updater:           updater,
+		logger:            logger,
+		logWriter:         logWriter,
+		ctx:               ctx,
+		allocID:           allocID,
+		task:              task,
+		updateCh:          make(chan *structs.Task, updateBufferSize),
+		signalCh:          make(chan *signalRequest),
+		execCh:            make(chan chan driver.DriverHandle),
+		restartCh:         make(chan string, 1),
+		restartTracker:    newRestartTracker(task.RestartPolicy, clock),
+		destroyCh:         make(chan struct{}),
+		forceDestroyCh:    make(chan struct{}),
+		waitCh:            make(chan struct{}),
+		shutdownCh:        make(chan struct{}),
+		readyCh:           make(chan struct{}),
+		healthyCh:         make(chan struct{}, 1),
+		statsInterval:     taskStatsInterval,
+		diskQuotaInterval: taskDiskQuotaInterval,
+		templateKeys:      newTemplateKeys(config.KVStore, logger, clock),
+		keyDebounce:       templateKeyDebounce,
+		providerSecrets:   newProviderSecrets(config.SecretProvider, clock),
+		clock:             clock,
+	}
+	tc.hooks = builtinHooks(tc)
+
+	tc.persister = newStatePersister(fmt.Sprintf("task '%s' for alloc '%s'", task.Name, allocID),
+		tc.saveState, config.StateSaveInterval, clock, logger)
+
+	// Nothing is persisted in dev mode
+	if config.DevMode {
+		tc.persister.stop()
 	}
 	return tc
 }
@@ -66,172 +320,1849 @@ func (r *TaskRunner) WaitCh() <-chan struct{} {
 
 // stateFilePath returns the path to our state file
 func (r *TaskRunner) stateFilePath() string {
-	// Get the MD5 of the task name
-	hashVal := md5.Sum([]byte(r.task.Name))
-	hashHex := hex.EncodeToString(hashVal[:])
-	dirName := fmt.Sprintf("task-%s", hashHex)
+	return taskStateFilePath(r.config.StateDir, r.allocID, r.task.Name)
+}
+
+// taskStateFilePath returns the path to the state file of the task within
+// the given state dir
+func taskStateFilePath(stateDir, allocID, taskName string) string {
+	return filepath.Join(stateDir, "alloc", allocID, taskStateDir(taskName), "state.json")
+}
+
+// taskStateDir returns the name of the state directory of the named task
+func taskStateDir(name string) string {
+	return fmt.Sprintf("task-%s", escapeFileName(name))
+}
+
+// legacyTaskStateDir returns the name of the state directory older clients
+// used for the named task
+func legacyTaskStateDir(name string) string {
+	hashVal := md5.Sum([]byte(name))
+	return fmt.Sprintf("task-%s", hex.EncodeToString(hashVal[:]))
+}
+
+// legacyStateFilePath returns the path to the state file used by older
+// clients, which named the directory after the MD5 of the task name
+func (r *TaskRunner) legacyStateFilePath() string {
+	return legacyTaskStateFilePath(r.config.StateDir, r.allocID, r.task.Name)
+}
+
+// legacyTaskStateFilePath returns the path to the state file older clients
+// used for the task within the given state dir
+func legacyTaskStateFilePath(stateDir, allocID, taskName string) string {
+	return filepath.Join(stateDir, "alloc", allocID, legacyTaskStateDir(taskName), "state.json")
+}
+
+// findTaskState returns the path of the state file of the task within the
+// state dir, falling back to the legacy location if the state has not been
+// saved since upgrading, in which case legacy is true
+func findTaskState(stateDir, allocID, taskName string) (path string, legacy bool) {
+	path = taskStateFilePath(stateDir, allocID, taskName)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		legacyPath := legacyTaskStateFilePath(stateDir, allocID, taskName)
+		if _, err := os.Stat(legacyPath); err == nil {
+			return legacyPath, true
+		}
+	}
+	return path, false
+}
 
-	// Generate the path
-	path := filepath.Join(r.config.StateDir, "alloc", r.allocID,
-		dirName, "state.json")
-	return path
+// LoadTaskState reads the state the named task of the alloc persisted into
+// the state dir, such as that of another client, without modifying
+// anything. It is meant for inspecting and migrating state.
+func LoadTaskState(stateDir, allocID, taskName string) (*taskRunnerState, error) {
+	path, _ := findTaskState(stateDir, allocID, taskName)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to find state of task '%s' for alloc '%s': %v", taskName, allocID, err)
+	}
+	var snap taskRunnerState
+	if err := restoreState(path, &snap); err != nil {
+		return nil, err
+	}
+	return &snap, nil
 }
 
 // RestoreState is used to restore our state
 func (r *TaskRunner) RestoreState() error {
-	// Load the snapshot
+	return r.RestoreStateFrom(r.config.StateDir)
+}
+
+// RestoreStateFrom restores the state the task persisted into the given
+// state dir, which may be that of another client whose state is migrated.
+// The state is saved into the state dir of the client from then on, and
+// only state within it is ever moved or removed.
+func (r *TaskRunner) RestoreStateFrom(stateDir string) error {
+	path, legacy := findTaskState(stateDir, r.allocID, r.task.Name)
+	own := filepath.Clean(stateDir) == filepath.Clean(r.config.StateDir)
+	r.lock.Lock()
+	r.legacyState = legacy && own
+	r.lock.Unlock()
+
+	// Load the snapshot. A corrupt snapshot is set aside and the task is
+	// treated as lost, so one bad file does not fail the whole restore.
 	var snap taskRunnerState
-	if err := restoreState(r.stateFilePath(), &snap); err != nil {
-		return err
+	if err := restoreState(path, &snap); err != nil {
+		if _, ok := err.(*corruptStateError); !ok {
+			return err
+		}
+		if !own {
+			r.logger.Printf("[WARN] client: ignoring corrupt state of task '%s' for alloc '%s' at %s: %v",
+				r.task.Name, r.allocID, path, err)
+			r.restoreErr = err
+			return nil
+		}
+		dst, qErr := quarantineState(path)
+		if qErr != nil {
+			return qErr
+		}
+		r.logger.Printf("[WARN] client: moved corrupt state of task '%s' for alloc '%s' to %s: %v",
+			r.task.Name, r.allocID, dst, err)
+		r.restoreErr = err
+		return nil
+	}
+
+	// A missing or empty snapshot has no task to restore, which leaves the
+	// task as it was given
+	if snap.Task == nil {
+		return fmt.Errorf("no state of task '%s' for alloc '%s' at %s", r.task.Name, r.allocID, path)
 	}
 
 	// Restore fields
+	r.lock.Lock()
 	r.task = snap.Task
+	r.restartTracker = newRestartTracker(r.task.RestartPolicy, r.clock)
+	r.restartTracker.restore(snap.RestartCount, snap.RestartStart)
+	r.restarts = snap.Restarts
+	r.lock.Unlock()
+	if r.logWriter != nil {
+		r.logWriter.setDriver(r.task.Driver)
+	}
+	r.eventsLock.Lock()
+	r.events = snap.Events
+	r.eventsLock.Unlock()
 
 	// Restore the driver
 	if snap.HandleID != "" {
-		driver, err := r.createDriver()
+		d, err := r.createDriver()
 		if err != nil {
 			return err
 		}
 
-		handle, err := driver.Open(r.ctx, snap.HandleID)
+		ctx, cancel := r.destroyContext()
+		handle, err := d.Open(ctx, r.ctx, snap.HandleID)
+		cancel()
+		if _, ok := err.(*driver.IncompatibleHandleError); ok {
+			r.logger.Printf("[WARN] client: unable to reattach to task '%s' for alloc '%s', starting it again: %v",
+				r.task.Name, r.allocID, err)
+			r.reattachErr = err
+			r.reattachHandleID = snap.HandleID
+			return nil
+		}
+		if _, ok := err.(*driver.TaskLostError); ok {
+			r.logger.Printf("[WARN] client: task '%s' for alloc '%s' was lost while the client was down: %v",
+				r.task.Name, r.allocID, err)
+			r.lostErr = err
+			return nil
+		}
 		if err != nil {
+			// The task most likely exited while we were not running. The
+			// state is otherwise intact, so let Run mark the task dead.
 			r.logger.Printf("[ERR] client: failed to open handle to task '%s' for alloc '%s': %v",
 				r.task.Name, r.allocID, err)
-			return err
+			r.restoreErr = err
+			return nil
 		}
+		r.lock.Lock()
 		r.handle = handle
+		r.lock.Unlock()
+		r.caps = d.Capabilities()
 	}
 	return nil
 }
 
-// SaveState is used to snapshot our state
+// getTask returns the task as last updated
+func (r *TaskRunner) getTask() *structs.Task {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.task
+}
+
+// getHandle returns the handle of the running task, which is nil until the
+// task is started
+func (r *TaskRunner) getHandle() driver.DriverHandle {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.handle
+}
+
+// SaveState is used to snapshot our state. It saves the state at once, along
+// with the changes whose save is pending.
 func (r *TaskRunner) SaveState() error {
+	return r.persister.flush()
+}
+
+// saveState writes a snapshot of the state. It is called by the persister,
+// which serializes the saves.
+func (r *TaskRunner) saveState() error {
+	// Secrets are only kept in memory and in the secrets dir of the task
+	r.lock.RLock()
+	task := *r.task
+	task.Secrets = nil
 	snap := taskRunnerState{
-		Task: r.task,
+		Task:         &task,
+		RestartCount: r.restartTracker.count,
+		RestartStart: r.restartTracker.startTime,
+		Restarts:     r.restarts,
+		Events:       r.Events(),
 	}
 	if r.handle != nil {
 		snap.HandleID = r.handle.ID()
 	}
-	return persistState(r.stateFilePath(), &snap)
+	legacy := r.legacyState
+	r.lock.RUnlock()
+	buf, err := r.encodeSnapshot(&snap)
+	if err != nil {
+		return err
+	}
+	if err := writeState(r.stateFilePath(), buf); err != nil {
+		return err
+	}
+
+	// Now that the state is in its current location remove the legacy one
+	if legacy {
+		if err := os.RemoveAll(filepath.Dir(r.legacyStateFilePath())); err != nil {
+			return err
+		}
+		r.lock.Lock()
+		r.legacyState = false
+		r.lock.Unlock()
+	}
+	return nil
+}
+
+// taskToStart returns the task as it is given to the driver. On an
+// oversubscribed client a copy is given whose oom_score_adj, unless the task
+// sets its own, and CPU shares are weighted by the priority of its job.
+func (r *TaskRunner) taskToStart() *structs.Task {
+	if !r.config.Oversubscribe || r.task.Resources == nil {
+		return r.task
+	}
+	task := *r.task
+	task.Resources = r.task.Resources.Copy()
+	if task.Resources.OOMScoreAdj == 0 {
+		task.Resources.OOMScoreAdj = priorityOOMScoreAdj(r.priority)
+	}
+	if task.Resources.CPU > 0 {
+		task.Resources.CPUShares = priorityCPUShares(task.Resources.CPU, r.priority)
+	}
+	return &task
+}
+
+// encodeSnapshot encodes the snapshot, leaving out its oldest events beyond
+// the persisted event limit and those that don't fit in the state size limit
+func (r *TaskRunner) encodeSnapshot(snap *taskRunnerState) ([]byte, error) {
+	total := len(snap.Events)
+	if max := r.config.MaxPersistedTaskEvents; max > 0 && len(snap.Events) > max {
+		snap.Events = snap.Events[len(snap.Events)-max:]
+	}
+	maxSize := r.config.MaxTaskStateSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxTaskStateSize
+	}
+
+	for {
+		buf, err := encodeState(r.config.StateFormat, snap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode state: %v", err)
+		}
+		if len(buf) <= maxSize || len(snap.Events) == 0 {
+			if len(buf) > maxSize {
+				r.logger.Printf("[WARN] client: state of task '%s' for alloc '%s' is %d bytes without events, over the limit of %d",
+					snap.Task.Name, r.allocID, len(buf), maxSize)
+			}
+			if n := len(snap.Events); n < total {
+				r.logger.Printf("[DEBUG] client: saving the latest %d of %d events of task '%s' for alloc '%s'",
+					n, total, snap.Task.Name, r.allocID)
+			}
+			return buf, nil
+		}
+		snap.Events = snap.Events[1:]
+	}
 }
 
 // DestroyState is used to cleanup after ourselves
 func (r *TaskRunner) DestroyState() error {
+	r.persister.stop()
+	r.lock.RLock()
+	legacy := r.legacyState
+	r.lock.RUnlock()
+	if legacy {
+		if err := os.RemoveAll(r.legacyStateFilePath()); err != nil {
+			return err
+		}
+	}
 	return os.RemoveAll(r.stateFilePath())
 }
 
-// setStatus is used to update the status of the task runner
-func (r *TaskRunner) setStatus(status, desc string) {
-	r.updater(r.task.Name, status, desc)
+// Events returns the events of the task, oldest first
+func (r *TaskRunner) Events() []*structs.TaskEvent {
+	r.eventsLock.Lock()
+	defer r.eventsLock.Unlock()
+	events := make([]*structs.TaskEvent, len(r.events))
+	copy(events, r.events)
+	return events
+}
+
+// recordEvent appends the event to the history of the task, evicting the
+// oldest event once the history is full, publishes it to the subscribers and
+// has the state of the task saved
+func (r *TaskRunner) recordEvent(event *structs.TaskEvent) {
+	r.eventsLock.Lock()
+	if len(r.events) >= maxTaskEvents {
+		n := copy(r.events, r.events[len(r.events)-maxTaskEvents+1:])
+		r.events = r.events[:n]
+	}
+	r.events = append(r.events, event)
+	r.logEvent(event)
+	r.publish(event)
+	if transition, ok := eventTransitions[event.Type]; ok {
+		r.notify(transition, event)
+	}
+	r.eventsLock.Unlock()
+	r.persister.persist()
+}
+
+// emitEvent records the event and updates the status of the task, using the
+// message of the event as the description. A terminal status set this way is
+// of a task that was not started.
+func (r *TaskRunner) emitEvent(status string, event *structs.TaskEvent) {
+	var exit *structs.TaskExit
+	if status == structs.AllocClientStatusDead || status == structs.AllocClientStatusFailed {
+		exit = &structs.TaskExit{Reason: structs.TaskExitNotStarted, Error: event.Message}
+	}
+	r.updateStatus(status, event, exit)
+}
+
+// emitExit records the event and sets the terminal status of the task, which
+// exited with the wait result. A nil result is a task that completed.
+func (r *TaskRunner) emitExit(status string, event *structs.TaskEvent, res *driver.WaitResult) {
+	r.updateStatus(status, event, taskExit(res))
+}
+
+// updateStatus records the event and updates the status of the task, along
+// with how it exited if the status is terminal. The state of a task reaching
+// a terminal status is saved at once, so a client stopped while the runner
+// cleans up after the task restores it as exited rather than reattaching to
+// it. Its state is destroyed once the runner is done.
+func (r *TaskRunner) updateStatus(status string, event *structs.TaskEvent, exit *structs.TaskExit) {
+	r.recordEvent(event)
+	if exit != nil {
+		exit.RestartCount = r.restarts
+		exit.KillReason = event.KillReason
+		r.persister.flush()
+	}
+	r.updater(r.task.Name, status, event.Message, exit)
+}
+
+// metricLabels returns the labels the metrics of the task are emitted with
+func (r *TaskRunner) metricLabels() map[string]string {
+	return map[string]string{
+		"task":   r.task.Name,
+		"driver": r.task.Driver,
+	}
+}
+
+// incrCounter increments the named task counter, if a metrics sink is set
+func (r *TaskRunner) incrCounter(name string) {
+	if sink := r.config.MetricsSink; sink != nil {
+		sink.IncrCounter([]string{"client", "task", name}, 1, r.metricLabels())
+	}
+}
+
+// setGauge sets the named task gauge, if a metrics sink is set
+func (r *TaskRunner) setGauge(name string, val float32) {
+	if sink := r.config.MetricsSink; sink != nil {
+		sink.SetGauge([]string{"client", "task", name}, val, r.metricLabels())
+	}
+}
+
+// exitEvent returns an event of the given type describing how the task
+// exited with the given wait result. A nil result is a task that completed.
+func exitEvent(eventType string, res *driver.WaitResult) *structs.TaskEvent {
+	event := structs.NewTaskEvent(eventType)
+	if res == nil || res.Successful() {
+		return event.SetMessage("task completed")
+	}
+
+	return event.SetMessage(fmt.Sprintf("task failed with: %v", res)).
+		SetExitCode(res.ExitCode).
+		SetSignal(res.Signal)
+}
+
+// startDeadline starts the timer of the max runtime of the task, of which ran
+// has already passed. Tasks without a max runtime run forever.
+func (r *TaskRunner) startDeadline(ran time.Duration) {
+	r.deadlineCh = nil
+	if r.task.MaxRuntime > 0 {
+		r.deadlineCh = r.clock.After(r.task.MaxRuntime - ran)
+	}
+}
+
+// restoredRuntime returns how long a restored task has been running for,
+// since it was last started
+func (r *TaskRunner) restoredRuntime() time.Duration {
+	events := r.Events()
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Type == structs.TaskStarted {
+			return r.clock.Now().Sub(time.Unix(0, events[i].Time))
+		}
+	}
+	return 0
+}
+
+// taskExit returns how the task exited with the given wait result. A nil
+// result is a task that completed.
+func taskExit(res *driver.WaitResult) *structs.TaskExit {
+	if res == nil || res.Successful() {
+		return &structs.TaskExit{Reason: structs.TaskExitCompleted}
+	}
+
+	exit := &structs.TaskExit{ExitCode: res.ExitCode, Signal: res.Signal}
+	switch {
+	case res.Err != nil:
+		exit.Reason = structs.TaskExitError
+		exit.Error = res.Err.Error()
+	case res.OOMKilled:
+		exit.Reason = structs.TaskExitOOMKilled
+	case res.Signal != 0:
+		exit.Reason = structs.TaskExitSignaled
+	default:
+		exit.Reason = structs.TaskExitFailed
+	}
+	return exit
+}
+
+// killEvent returns the event of the exit of a task the client killed for
+// the reason, describing both the reason and how the task exited
+func killEvent(eventType string, res *driver.WaitResult, reason KillReason) *structs.TaskEvent {
+	event := exitEvent(eventType, res).SetKillReason(reason.Kind)
+	return event.SetMessage(fmt.Sprintf("%s: %s", reason.Message, event.Message))
+}
+
+// signalNumber returns the number of the signal, or zero if it has none
+func signalNumber(sig os.Signal) int {
+	if s, ok := sig.(syscall.Signal); ok {
+		return int(s)
+	}
+	return 0
 }
 
 // createDriver makes a driver for the task
 func (r *TaskRunner) createDriver() (driver.Driver, error) {
 	driverCtx := driver.NewDriverContext(r.task.Name, r.config, r.config.Node, r.logger)
-	driver, err := driver.NewDriver(r.task.Driver, driverCtx)
+	d, err := driver.NewDriver(r.task.Driver, driverCtx)
 	if err != nil {
+		// An unknown driver is reported as is so the user sees the drivers
+		// that are available instead
+		if _, ok := err.(*driver.UnknownDriverError); ok {
+			r.logger.Printf("[ERR] client: failed to create driver of task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+			return nil, err
+		}
 		err = fmt.Errorf("failed to create driver '%s' for alloc %s: %v",
 			r.task.Driver, r.allocID, err)
 		r.logger.Printf("[ERR] client: %s", err)
 	}
-	return driver, err
+	return d, err
 }
 
-// startTask is used to start the task if there is no handle
-func (r *TaskRunner) startTask() error {
-	// Create a driver
-	driver, err := r.createDriver()
+// checkDriverVersion checks the version of the driver against the minimum
+// configured for it
+func (r *TaskRunner) checkDriverVersion(d driver.Driver) error {
+	err := driver.CheckVersion(d, r.task.Driver, r.config)
 	if err != nil {
-		r.setStatus(structs.AllocClientStatusFailed, err.Error())
-		return err
+		r.logger.Printf("[ERR] client: refusing to start task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+	}
+	return err
+}
+
+// buildEnv is used to build the environment of the task. In increasing
+// order of precedence it is made up of the node attributes, the Env of the
+// task, the variables of its env files in the order they are listed and the
+// runtime values describing the allocation and task, such as the alloc ID,
+// the alloc dir and the ports. References of the form ${NAME} in the values
+// are then interpolated, leaving unresolved ones as is, and references of
+// the form ${secret:NAME} replaced with the secrets of the task. A reference
+// to an unknown secret is an error, though the environment is still
+// returned.
+func (r *TaskRunner) buildEnv() (map[string]string, error) {
+	return r.composeEnv(r.envFileVars)
+}
+
+// templateEnv is the environment the templates are rendered with. It is
+// that of buildEnv without the env files, which may themselves be rendered
+// by the templates.
+func (r *TaskRunner) templateEnv() (map[string]string, error) {
+	return r.composeEnv(nil)
+}
+
+func (r *TaskRunner) composeEnv(envFileVars map[string]string) (map[string]string, error) {
+	env := environment.NewTaskEnivornment()
+	if node := r.config.Node; node != nil {
+		env.SetNodeAttributes(node.Attributes)
 	}
+	env.SetEnv(r.task.Env)
+	env.SetEnv(envFileVars)
+	env.SetEnv(driver.TaskRuntimeEnvironment(r.ctx, r.task))
+	env.SetAllocID(r.allocID)
+	env.SetTaskName(r.task.Name)
 
-	// Start the job
-	handle, err := driver.Start(r.ctx, r.task)
+	if unresolved := env.Interpolate(); len(unresolved) != 0 {
+		r.logger.Printf("[WARN] client: task '%s' for alloc '%s' references unset environment variables: %s",
+			r.task.Name, r.allocID, strings.Join(unresolved, ", "))
+	}
+	secrets, err := r.taskSecrets()
 	if err != nil {
-		r.logger.Printf("[ERR] client: failed to start task '%s' for alloc '%s': %v",
-			r.task.Name, r.allocID, err)
-		r.setStatus(structs.AllocClientStatusFailed,
-			fmt.Sprintf("failed to start: %v", err))
-		return err
+		return env.Map(), err
 	}
-	r.handle = handle
-	r.setStatus(structs.AllocClientStatusRunning, "task started")
-	return nil
+	// The references to the provider secrets not fetched by a dry run are
+	// left as is
+	unknown := env.ResolveSecrets(secrets)
+	if len(unknown) != 0 && !(r.dryRun && len(r.task.ProviderSecrets) != 0) {
+		return env.Map(), fmt.Errorf("environment references unknown secrets: %s", strings.Join(unknown, ", "))
+	}
+	return env.Map(), nil
 }
 
-// Run is a long running routine used to manage the task
-func (r *TaskRunner) Run() {
-	defer close(r.waitCh)
-	r.logger.Printf("[DEBUG] client: starting task context for '%s' (alloc '%s')",
-		r.task.Name, r.allocID)
+// setupPorts sets the host ports of the task on the exec context, after
+// checking that none of its static ports is already in use on the node
+func (r *TaskRunner) setupPorts() error {
+	if r.task.Resources == nil || len(r.task.Resources.Networks) == 0 {
+		return nil
+	}
 
-	// Start the task if not yet started
-	if r.handle == nil {
-		if err := r.startTask(); err != nil {
-			return
+	// The dynamic ports are the last of the reserved ports once allocated
+	network := r.task.Resources.Networks[0]
+	if len(network.ReservedPorts) < len(network.DynamicPorts) {
+		return fmt.Errorf("%d dynamic ports of the task were allocated only %d ports",
+			len(network.DynamicPorts), len(network.ReservedPorts))
+	}
+	for _, port := range network.ListStaticPorts() {
+		if portInUse(port) {
+			return fmt.Errorf("static port %d is already in use on the node", port)
 		}
 	}
+	r.ctx.SetTaskPorts(r.task.Name, network.MapDynamicPorts())
+	return nil
+}
 
-OUTER:
-	// Wait for updates
-	for {
-		select {
-		case err := <-r.handle.WaitCh():
-			if err != nil {
-				r.logger.Printf("[ERR] client: failed to complete task '%s' for alloc '%s': %v",
-					r.task.Name, r.allocID, err)
-				r.setStatus(structs.AllocClientStatusDead,
-					fmt.Sprintf("task failed with: %v", err))
-			} else {
-				r.logger.Printf("[INFO] client: completed task '%s' for alloc '%s'",
-					r.task.Name, r.allocID)
-				r.setStatus(structs.AllocClientStatusDead,
-					"task completed")
-			}
-			break OUTER
-
-		case update := <-r.updateCh:
-			// Update
-			r.task = update
-			if err := r.handle.Update(update); err != nil {
-				r.logger.Printf("[ERR] client: failed to update task '%s' for alloc '%s': %v",
-					r.task.Name, r.allocID, err)
-			}
+// reservePorts claims the ports of the task with the port allocator of the
+// client, so they are not handed to any other task of the client
+func (r *TaskRunner) reservePorts() error {
+	allocator := r.config.PortAllocator
+	if allocator == nil || r.reservedPorts != nil ||
+		r.task.Resources == nil || len(r.task.Resources.Networks) == 0 {
+		return nil
+	}
 
-		case <-r.destroyCh:
-			// Send the kill signal, and use the WaitCh to block until complete
-			if err := r.handle.Kill(); err != nil {
-				r.logger.Printf("[ERR] client: failed to kill task '%s' for alloc '%s': %v",
-					r.task.Name, r.allocID, err)
-			}
-		}
+	network := r.task.Resources.Networks[0]
+	if len(network.ReservedPorts) == 0 {
+		return nil
+	}
+	if err := allocator.Reserve(network.IP, network.ReservedPorts); err != nil {
+		return err
 	}
+	r.reservedIP, r.reservedPorts = network.IP, network.ReservedPorts
+	return nil
+}
 
-	// Cleanup after ourselves
-	r.DestroyState()
+// releasePorts releases the ports claimed by reservePorts
+func (r *TaskRunner) releasePorts() {
+	if r.reservedPorts == nil {
+		return
+	}
+	r.config.PortAllocator.Release(r.reservedIP, r.reservedPorts)
+	r.reservedIP, r.reservedPorts = "", nil
 }
 
-// Update is used to update the task of the context
-func (r *TaskRunner) Update(update *structs.Task) {
-	select {
-	case r.updateCh <- update:
-	default:
-		r.logger.Printf("[ERR] client: dropping task update '%s' (alloc '%s')",
-			update.Name, r.allocID)
+// validateTask has the driver check the config of the task and checks the
+// task against the capabilities and resource ceiling of the driver, so that a
+// task the client won't run fails before anything is started
+func (r *TaskRunner) validateTask() error {
+	d, err := r.createDriver()
+	if err != nil {
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskDriverFailure).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
+
+	if err := d.Validate(r.task); err != nil {
+		r.logger.Printf("[ERR] client: invalid config of task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskValidationFailed).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
+
+	// Refuse tasks asking for features the driver lacks, rather than
+	// failing once they run
+	if err := driver.CheckCapabilities(r.task.Driver, d.Capabilities(), r.task); err != nil {
+		r.logger.Printf("[ERR] client: refusing to start task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskValidationFailed).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
+
+	// Refuse tasks claiming more than the client allows their driver
+	if err := driver.CheckResourceCeiling(r.task.Driver, r.config, r.task); err != nil {
+		r.logger.Printf("[ERR] client: refusing to start task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskValidationFailed).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
 	}
+	return nil
 }
 
-// Destroy is used to indicate that the task context should be destroyed
-func (r *TaskRunner) Destroy() {
-	r.destroyLock.Lock()
-	defer r.destroyLock.Unlock()
+// startTask is used to start the task if there is no handle
+func (r *TaskRunner) startTask() error {
+	// Refuse drivers whose runtime was not detected on the node, rather than
+	// failing somewhere in starting the task
+	if node := r.config.Node; node != nil && !driver.Available(node, r.task.Driver) {
+		err := fmt.Errorf("driver '%s' is not available on this node", r.task.Driver)
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskDriverFailure).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
 
-	if r.destroy {
-		return
+	// Create a driver
+	driver, err := r.createDriver()
+	if err != nil {
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskDriverFailure).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
+
+	// Refuse runtimes older than the configured minimum, which may lack
+	// features the task depends on
+	if err := r.checkDriverVersion(driver); err != nil {
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskDriverFailure).SetMessage(err.Error()))
+		r.incrCounter("failed")
+		return err
+	}
+
+	r.caps = driver.Capabilities()
+	r.ctx.SetTaskNetworkMode(r.task.Name, r.caps.NetworkMode(r.task))
+
+	// Prepare the task, e.g. fetching its artifacts and rendering its
+	// templates
+	if err := r.runPrestartHooks(); err != nil {
+		return err
+	}
+
+	// Start the job once the client has a slot for it. Destroying the task
+	// cancels a start that is taking long, such as a slow image pull.
+	if err := r.acquireStartSlot(); err != nil {
+		r.emitEvent(structs.AllocClientStatusDead, r.killedBeforeStartEvent(err))
+		return err
+	}
+	r.markLogPositions()
+	ctx, cancel := r.destroyContext()
+	handle, err := driver.Start(ctx, r.ctx, r.taskToStart())
+	cancelled := ctx.Err() != nil
+	cancel()
+	r.releaseStartSlot()
+	if err != nil && cancelled {
+		r.logger.Printf("[DEBUG] client: start of task '%s' for alloc '%s' cancelled: %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusDead, r.killedBeforeStartEvent(errDestroyedBeforeStart))
+		return errDestroyedBeforeStart
+	}
+	if err != nil {
+		r.logger.Printf("[ERR] client: failed to start task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusFailed,
+			structs.NewTaskEvent(structs.TaskDriverFailure).
+				SetMessage(fmt.Sprintf("failed to start: %v", err)))
+		r.incrCounter("failed")
+		return err
+	}
+	r.lock.Lock()
+	r.handle = handle
+	r.lock.Unlock()
+	r.startedAt = r.clock.Now()
+	r.startDeadline(0)
+	r.emitEvent(structs.AllocClientStatusRunning,
+		structs.NewTaskEvent(structs.TaskStarted).SetMessage("task started"))
+	r.incrCounter("started")
+	r.setGauge("running", 1)
+	return nil
+}
+
+// downloadArtifacts is used to fetch the artifacts of the task into its
+// task directory. It is aborted if the task is destroyed.
+func (r *TaskRunner) downloadArtifacts() error {
+	if r.artifactsDownloaded || len(r.task.Artifacts) == 0 {
+		return nil
+	}
+
+	taskDir, ok := r.ctx.AllocDir.TaskDirs[r.task.Name]
+	if !ok {
+		return fmt.Errorf("task directory doesn't exist for task %v", r.task.Name)
+	}
+
+	for _, artifact := range r.task.Artifacts {
+		if err := r.downloadArtifact(artifact, taskDir); err != nil {
+			return err
+		}
+	}
+	r.artifactsDownloaded = true
+	return nil
+}
+
+// acquireStartSlot takes a slot of the start limiter of the client, waiting
+// for one if they are all taken. It fails with errDestroyedBeforeStart if the
+// task is destroyed while waiting.
+func (r *TaskRunner) acquireStartSlot() error {
+	limiter := r.config.StartLimiter
+	if limiter == nil || limiter.TryAcquire() {
+		return nil
+	}
+	r.logger.Printf("[DEBUG] client: task '%s' (alloc '%s') is waiting for a start slot",
+		r.task.Name, r.allocID)
+	r.recordEvent(structs.NewTaskEvent(structs.TaskStartQueued).
+		SetMessage("waiting for a start slot"))
+	if !limiter.Acquire(r.destroyCh) {
+		return errDestroyedBeforeStart
+	}
+	return nil
+}
+
+// releaseStartSlot frees the slot taken by acquireStartSlot
+func (r *TaskRunner) releaseStartSlot() {
+	if limiter := r.config.StartLimiter; limiter != nil {
+		limiter.Release()
+	}
+}
+
+// downloadArtifact fetches the artifact into the task directory once the
+// download limiter of the client has a slot for it
+func (r *TaskRunner) downloadArtifact(artifact *structs.TaskArtifact, taskDir string) error {
+	if limiter := r.config.DownloadLimiter; limiter != nil {
+		if !limiter.TryAcquire() {
+			r.logger.Printf("[DEBUG] client: artifact '%s' for task '%s' (alloc '%s') is waiting for a download slot",
+				artifact.Source, r.task.Name, r.allocID)
+			r.recordEvent(structs.NewTaskEvent(structs.TaskDownloadQueued).
+				SetMessage(fmt.Sprintf("artifact '%s' is waiting for a download slot", artifact.Source)))
+			if !limiter.Acquire(r.destroyCh) {
+				return getter.ErrAborted
+			}
+		}
+		defer limiter.Release()
+	}
+
+	r.logger.Printf("[DEBUG] client: downloading artifact '%s' for task '%s' (alloc '%s')",
+		artifact.Source, r.task.Name, r.allocID)
+	opts := &getter.Options{Logger: r.logger}
+	if limiter := r.config.DownloadRateLimiter; limiter != nil {
+		opts.RateLimiter = limiter
+	}
+	if cache := r.config.ArtifactCache; cache != nil {
+		opts.Cache = cache
+	}
+	if err := getter.GetArtifactWithOptions(artifact, taskDir, r.destroyCh, opts); err != nil {
+		if err == getter.ErrAborted {
+			return err
+		}
+		return fmt.Errorf("failed to download artifact '%s': %v", artifact.Source, err)
+	}
+	return nil
+}
+
+// writeSecrets writes the secrets of the task into its secrets directory
+func (r *TaskRunner) writeSecrets() error {
+	secrets, err := r.taskSecrets()
+	if err != nil {
+		return err
+	}
+	for name, value := range secrets {
+		if err := r.ctx.AllocDir.WriteSecret(r.task.Name, name, []byte(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSecrets removes the secrets of the task once it no longer runs
+func (r *TaskRunner) removeSecrets() {
+	if r.ctx.AllocDir == nil {
+		return
+	}
+	if err := r.ctx.AllocDir.RemoveSecrets(r.task.Name); err != nil {
+		r.logger.Printf("[ERR] client: failed to remove secrets of task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+	}
+}
+
+// restartTask is used to restart a failed task according to its restart
+// policy. It returns false if the task is not restarted, in which case the
+// final status has already been set.
+func (r *TaskRunner) restartTask(res *driver.WaitResult) bool {
+	// Never restart a task that is being destroyed
+	select {
+	case <-r.destroyCh:
+		r.emitExit(structs.AllocClientStatusDead, exitEvent(structs.TaskNotRestarting, res), res)
+		return false
+	default:
+	}
+
+	r.lock.Lock()
+	restart, wait := r.restartTracker.nextRestart()
+	r.lock.Unlock()
+
+	// Persist the decision so a client restart doesn't reset the budget
+	r.persister.flush()
+	mode := r.restartTracker.mode()
+	if !restart {
+		policy := r.task.RestartPolicy
+		if policy == nil {
+			r.emitExit(structs.AllocClientStatusDead, exitEvent(structs.TaskNotRestarting, res), res)
+			return false
+		}
+
+		// Only a task failed by its restart policy is left to the scheduler
+		// to place elsewhere
+		status := structs.AllocClientStatusDead
+		if mode == structs.RestartPolicyModeFail {
+			status = structs.AllocClientStatusFailed
+		}
+
+		// A policy without attempts never restarts the task, so it is not
+		// throttled either
+		if policy.Attempts == 0 {
+			r.emitExit(status, exitEvent(structs.TaskNotRestarting, res).SetRestartMode(mode), res)
+			return false
+		}
+
+		// The task failed too often within the interval, so it is throttled
+		count, window := r.restartTracker.count, r.restartTracker.window()
+		r.logger.Printf("[WARN] client: not restarting task '%s' for alloc '%s', %d restarts in %v exceed the %d allowed within %v",
+			r.task.Name, r.allocID, count, window, policy.Attempts, policy.Interval)
+		event := exitEvent(structs.TaskRestartsThrottled, res).
+			SetRestartCount(count).
+			SetRestartMode(mode).
+			SetRestartWindow(policy.Attempts, policy.Interval, window)
+		event.SetMessage(fmt.Sprintf("%s; not restarting: %d restarts in %v exhausted %d restart attempts within %v (mode %s)",
+			event.Message, count, window, policy.Attempts, policy.Interval, mode))
+		r.emitExit(status, event, res)
+		return false
+	}
+
+	r.logger.Printf("[INFO] client: restarting task '%s' for alloc '%s' in %v",
+		r.task.Name, r.allocID, wait)
+	event := exitEvent(structs.TaskRestarting, res).
+		SetRestartCount(r.restartTracker.count).
+		SetRestartMode(mode)
+	event.SetMessage(fmt.Sprintf("%s; restarting in %v", event.Message, wait))
+	r.emitEvent(structs.AllocClientStatusPending, event)
+	r.incrCounter("restarts")
+	r.lock.Lock()
+	r.restarts++
+	r.lock.Unlock()
+
+	// Wait out the backoff, aborting if we are destroyed in the meantime
+	select {
+	case <-r.clock.After(wait):
+	case <-r.destroyCh:
+		r.emitExit(structs.AllocClientStatusDead, exitEvent(structs.TaskNotRestarting, res), res)
+		return false
+	}
+
+	return r.startTask() == nil
+}
+
+// updateTemplates re-renders the templates after the task was updated or the
+// keys they read changed. If any of the outputs changed the task is signaled
+// or restarted, as the change modes of the changed templates ask. Signals the
+// driver can't send fall back to restarting the task.
+func (r *TaskRunner) updateTemplates() {
+	if len(r.task.Templates) == 0 {
+		return
+	}
+
+	env, err := r.templateEnv()
+	var changed []*structs.Template
+	if err == nil {
+		changed, err = r.renderTemplates(env)
+	}
+	if err != nil {
+		r.logger.Printf("[ERR] client: failed to re-render templates of task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.emitEvent(structs.AllocClientStatusRunning,
+			structs.NewTaskEvent(structs.TaskTemplateFailure).
+				SetMessage(fmt.Sprintf("failed to re-render templates: %v", err)))
+		return
+	}
+
+	// Each signal is sent once, however many templates ask for it
+	restart := false
+	var sigs []os.Signal
+	sent := make(map[os.Signal]bool)
+	for _, tmpl := range changed {
+		mode, name := tmpl.OnChange()
+		switch mode {
+		case structs.TemplateChangeModeNoop:
+		case structs.TemplateChangeModeRestart:
+			restart = true
+		default:
+			sig, err := parseSignal(name)
+			if err != nil || (r.caps != nil && !r.caps.Signals) {
+				r.logger.Printf("[WARN] client: can't send %s to task '%s' for alloc '%s' for changed template '%s', restarting it instead",
+					name, r.task.Name, r.allocID, tmpl.DestPath)
+				restart = true
+			} else if !sent[sig] {
+				sent[sig] = true
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+
+	// A restart picks up all of the changes, so there is no need to signal
+	if !restart {
+		for _, sig := range sigs {
+			r.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).
+				SetSignal(signalNumber(sig)).
+				SetMessage("templates changed"))
+			if err := r.handle.Signal(sig); driver.IsNotSupported(err) {
+				r.logger.Printf("[WARN] client: templates of task '%s' for alloc '%s' changed but the driver can't signal the task, restarting it instead",
+					r.task.Name, r.allocID)
+				restart = true
+				break
+			} else if err != nil {
+				r.logger.Printf("[ERR] client: failed to signal task '%s' for alloc '%s': %v",
+					r.task.Name, r.allocID, err)
+			}
+		}
+	}
+	if restart {
+		if err := r.Restart("templates changed"); err != nil {
+			r.logger.Printf("[ERR] client: failed to restart task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+		}
+	}
+}
+
+// Stats returns the latest resource usage of the task, or nil if the task
+// is not running or its driver can not report usage.
+func (r *TaskRunner) Stats() *driver.TaskResourceUsage {
+	usage, _ := r.resourceStats()
+	return usage
+}
+
+// resourceStats returns the latest resource usage of the task along with
+// whether the driver of the running task can not report usage.
+func (r *TaskRunner) resourceStats() (*driver.TaskResourceUsage, bool) {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	return r.resourceUsage, r.statsUnsupported
+}
+
+// startStats starts collecting the resource usage of the current handle.
+func (r *TaskRunner) startStats() {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	if r.statsStopCh != nil {
+		return
+	}
+	r.statsStopCh = make(chan struct{})
+	var softLimit int64
+	if r.task.Resources != nil {
+		softLimit, _ = r.task.Resources.MemoryLimits()
+	}
+	go r.collectStats(r.task.Name, r.handle, softLimit, r.statsStopCh)
+}
+
+// stopStats stops collecting resource usage and clears the latest usage.
+func (r *TaskRunner) stopStats() {
+	r.statsLock.Lock()
+	defer r.statsLock.Unlock()
+	if r.statsStopCh == nil {
+		return
+	}
+	close(r.statsStopCh)
+	r.statsStopCh = nil
+	r.resourceUsage = nil
+	r.statsUnsupported = false
+}
+
+// collectStats polls the handle for its resource usage until stopCh is
+// closed, the task runner exits or is destroyed, or the driver turns out not
+// to support stats. If the task has a memory soft limit, growing past it is
+// recorded once, until the usage falls back below it.
+func (r *TaskRunner) collectStats(taskName string, handle driver.DriverHandle, softLimit int64, stopCh chan struct{}) {
+	ticker := time.NewTicker(r.statsInterval)
+	defer ticker.Stop()
+	breached := false
+	for {
+		usage, err := handle.Stats()
+		if driver.IsNotSupported(err) {
+			r.logger.Printf("[DEBUG] client: not collecting stats of task '%s' for alloc '%s': %v",
+				taskName, r.allocID, err)
+			r.statsLock.Lock()
+			select {
+			case <-stopCh:
+			default:
+				r.statsUnsupported = true
+			}
+			r.statsLock.Unlock()
+			return
+		} else if err != nil {
+			r.logger.Printf("[DEBUG] client: failed to collect stats of task '%s' for alloc '%s': %v",
+				taskName, r.allocID, err)
+		} else {
+			r.statsLock.Lock()
+			select {
+			case <-stopCh:
+				// Don't report usage of an exited task
+			default:
+				r.resourceUsage = usage
+			}
+			r.statsLock.Unlock()
+
+			if softLimit > 0 {
+				over := int64(usage.MemoryRSS) > softLimit
+				if over && !breached {
+					msg := fmt.Sprintf("task uses %d MB of memory, exceeding its soft limit of %d MB",
+						usage.MemoryRSS/bytesPerMB, softLimit/bytesPerMB)
+					r.logger.Printf("[WARN] client: task '%s' for alloc '%s' %s", taskName, r.allocID, msg)
+					r.recordEvent(structs.NewTaskEvent(structs.TaskMemorySoftLimitExceeded).SetMessage(msg))
+					r.incrCounter("memory_soft_limit_exceeded")
+				}
+				breached = over
+			}
+		}
+
+		select {
+		case <-ticker.C:
+			// A tick racing the stop doesn't collect once more
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+		case <-stopCh:
+			return
+		case <-r.waitCh:
+			return
+		case <-r.destroyCh:
+			return
+		}
+	}
+}
+
+// killTimeout returns how long the task is given to exit once it has been
+// asked to stop, clamped to the configured maximum
+func (r *TaskRunner) killTimeout() time.Duration {
+	timeout := r.task.KillTimeout
+	if timeout == 0 {
+		timeout = r.config.KillTimeout
+	}
+	if max := r.config.MaxKillTimeout; max > 0 && timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+// drain waits out the shutdown delay of the task before it is killed, giving
+// load balancers time to stop routing to it. The wait is cut short by
+// ForceDestroy. It returns whether the task exited in the meantime, along
+// with how it exited.
+func (r *TaskRunner) drain() (bool, *driver.WaitResult) {
+	delay := r.task.ShutdownDelay
+	if delay <= 0 {
+		return false, nil
+	}
+
+	r.emitEvent(structs.AllocClientStatusRunning,
+		structs.NewTaskEvent(structs.TaskDraining).
+			SetMessage(fmt.Sprintf("waiting %v before killing the task", delay)))
+	select {
+	case <-r.clock.After(delay):
+	case <-r.forceDestroyCh:
+		r.logger.Printf("[DEBUG] client: skipping shutdown delay of task '%s' for alloc '%s'",
+			r.task.Name, r.allocID)
+	case res := <-r.handle.WaitCh():
+		return true, res
+	}
+	return false, nil
+}
+
+// sendKill asks the task to stop with its kill signal. The driver's Kill is
+// used if the task has no kill signal or the signal can't be sent by the
+// driver or on this platform.
+func (r *TaskRunner) sendKill() error {
+	name := r.task.KillSignal
+	if name == "" {
+		return r.handle.Kill()
+	}
+
+	sig, ok := signalLookup[name]
+	if !ok {
+		r.logger.Printf("[WARN] client: kill signal %s of task '%s' for alloc '%s' is not supported on this platform, using the driver's kill",
+			name, r.task.Name, r.allocID)
+		return r.handle.Kill()
+	}
+	err := r.handle.Signal(sig)
+	if driver.IsNotSupported(err) {
+		r.logger.Printf("[DEBUG] client: driver of task '%s' for alloc '%s' can't send %s, using its kill: %v",
+			r.task.Name, r.allocID, name, err)
+		return r.handle.Kill()
+	}
+	return err
+}
+
+// killTask is used to stop the task for the reason, escalating to a
+// forceful kill if it does not exit within the kill timeout. It returns how
+// the task exited.
+func (r *TaskRunner) killTask(reason KillReason) *driver.WaitResult {
+	r.logger.Printf("[DEBUG] client: killing task '%s' for alloc '%s': %s",
+		r.task.Name, r.allocID, reason.Message)
+	event := structs.NewTaskEvent(structs.TaskKilling).
+		SetMessage(fmt.Sprintf("task is being killed: %s", reason.Message)).
+		SetKillReason(reason.Kind)
+	if sig, ok := signalLookup[r.task.KillSignal]; ok {
+		event.SetMessage(fmt.Sprintf("task is being killed with %s: %s", r.task.KillSignal, reason.Message)).
+			SetSignal(signalNumber(sig))
+	}
+	r.recordEvent(event)
+
+	// Send the kill signal, and use the WaitCh to block until complete
+	if err := r.sendKill(); err != nil {
+		r.logger.Printf("[ERR] client: failed to kill task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+	}
+
+	timeout := r.killTimeout()
+	select {
+	case res := <-r.handle.WaitCh():
+		return res
+	case <-r.clock.After(timeout):
+	}
+
+	// The task did not exit in time, so escalate
+	r.logger.Printf("[WARN] client: task '%s' for alloc '%s' did not exit within %v, force killing",
+		r.task.Name, r.allocID, timeout)
+	r.emitEvent(structs.AllocClientStatusRunning,
+		structs.NewTaskEvent(structs.TaskKilling).
+			SetMessage(fmt.Sprintf("task did not exit within kill timeout of %v, force killing", timeout)))
+	r.incrCounter("kill_timeouts")
+	if err := r.handle.ForceKill(); err != nil {
+		r.logger.Printf("[ERR] client: failed to force kill task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+	}
+
+	select {
+	case res := <-r.handle.WaitCh():
+		return res
+	case <-r.clock.After(timeout):
+		return driver.NewWaitResult(0, 0, fmt.Errorf("task did not exit after being force killed"))
+	}
+}
+
+// Run is a long running routine used to manage the task
+func (r *TaskRunner) Run() {
+	defer close(r.waitCh)
+	defer r.closeSubscriptions()
+	defer r.notifyDead()
+	defer r.runPoststopHooks()
+	r.logger.Printf("[DEBUG] client: starting task context for '%s' (alloc '%s')",
+		r.task.Name, r.allocID)
+
+	// Do not start a restored task whose handle could not be re-opened
+	if r.restoreErr != nil {
+		r.emitExit(structs.AllocClientStatusDead,
+			structs.NewTaskEvent(structs.TaskRestoreFailed).
+				SetMessage(fmt.Sprintf("failed to restore task: %v", r.restoreErr)),
+			driver.NewWaitResult(0, 0, r.restoreErr))
+		r.DestroyState()
+		return
+	}
+
+	// Start the task if not yet started, once its dependencies are ready
+	restored := r.handle != nil
+	if r.lostErr != nil {
+		// A task lost while the client was down failed like one exiting
+		// with an error, so its restart policy applies
+		r.recordEvent(structs.NewTaskEvent(structs.TaskLost).
+			SetMessage(fmt.Sprintf("lost while the client was down: %v", r.lostErr)))
+		r.incrCounter("lost")
+		if !r.restartTask(driver.NewWaitResult(0, 0, r.lostErr)) {
+			return
+		}
+	} else if !restored {
+		if r.reattachErr != nil {
+			r.recordEvent(structs.NewTaskEvent(structs.TaskRestarting).
+				SetMessage(fmt.Sprintf("failed to reattach: %v; restarting", r.reattachErr)))
+			r.lock.Lock()
+			r.restarts++
+			r.lock.Unlock()
+		} else {
+			r.recordEvent(structs.NewTaskEvent(structs.TaskReceived).SetMessage("task received"))
+		}
+		if err := r.validateTask(); err != nil {
+			return
+		}
+		if err := r.awaitDependencies(); err != nil {
+			event := structs.NewTaskEvent(structs.TaskDependencyFailed).SetMessage(err.Error())
+			if err == errDestroyedBeforeStart {
+				event = r.killedBeforeStartEvent(err)
+			}
+			r.emitEvent(structs.AllocClientStatusDead, event)
+			return
+		}
+		if err := r.startTask(); err != nil {
+			return
+		}
+	} else {
+		// The checks of a restored task are run with the env files it was
+		// started with, as far as they are still readable
+		if err := r.loadEnvFiles(); err != nil {
+			r.logger.Printf("[WARN] client: failed to load env files of restored task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+		}
+
+		// The provider secrets are not persisted, so they are renewed to
+		// pick up their leases again
+		r.providerSecrets.track(r.secretPaths())
+	}
+	if len(r.task.Checks) == 0 {
+		r.markReady()
+	}
+	depFailedCh := r.watchDependencies()
+	diskQuotaCh := r.watchDiskQuota()
+	keysChangedCh := r.templateKeys.watch(r.keyDebounce, r.waitCh)
+	secretRenewalCh := r.providerSecrets.watch(r.waitCh)
+	r.startStats()
+	defer r.stopStats()
+	r.startChecks()
+	defer r.stopChecks()
+	r.startServices()
+
+	// Updates that arrived while the task was being restored are folded so
+	// the restored handle is reconciled with the newest task in one pass
+	if restored {
+		r.startDeadline(r.restoredRuntime())
+		if err := r.reservePorts(); err != nil {
+			r.logger.Printf("[WARN] client: failed to reserve ports of restored task '%s' for alloc '%s': %v",
+				r.task.Name, r.allocID, err)
+		}
+		if update := r.drainUpdates(); update != nil {
+			r.applyUpdate(update)
+		}
+	}
+
+OUTER:
+	// Wait for updates
+	for {
+		select {
+		case res := <-r.handle.WaitCh():
+			r.deregisterServices()
+			r.stopStats()
+			r.stopChecks()
+			r.setGauge("running", 0)
+
+			// A run of at least the min healthy time resets the restart
+			// attempts, while a shorter one is a failure even if the task
+			// exited successfully
+			var ran time.Duration
+			healthy := true
+			if !r.startedAt.IsZero() {
+				ran = r.clock.Now().Sub(r.startedAt)
+				r.lock.Lock()
+				healthy = r.restartTracker.healthyRun(ran)
+				r.lock.Unlock()
+			}
+			success := res == nil || res.Successful()
+			if success && healthy {
+				r.logger.Printf("[INFO] client: completed task '%s' for alloc '%s'",
+					r.task.Name, r.allocID)
+				r.emitExit(structs.AllocClientStatusDead, exitEvent(structs.TaskTerminated, nil), nil)
+				r.completed = true
+				break OUTER
+			}
+
+			if success {
+				err := fmt.Errorf("task exited after %v, within the min healthy time of %v",
+					ran, r.task.RestartPolicy.MinHealthyTime)
+				r.logger.Printf("[WARN] client: task '%s' for alloc '%s' %v",
+					r.task.Name, r.allocID, err)
+				r.recordEvent(structs.NewTaskEvent(structs.TaskExitedTooQuickly).SetMessage(err.Error()))
+				res = driver.NewWaitResult(0, 0, err)
+			} else {
+				r.logger.Printf("[ERR] client: failed to complete task '%s' for alloc '%s': %v",
+					r.task.Name, r.allocID, res)
+				r.recordEvent(exitEvent(structs.TaskTerminated, res))
+			}
+			r.incrCounter("failed")
+			if !r.restartTask(res) {
+				break OUTER
+			}
+			r.startStats()
+			r.startChecks()
+			r.startServices()
+
+		case update := <-r.updateCh:
+			r.applyUpdate(update)
+
+		case <-keysChangedCh:
+			r.logger.Printf("[DEBUG] client: keys of the templates of task '%s' for alloc '%s' changed",
+				r.task.Name, r.allocID)
+			r.updateTemplates()
+
+		case renewal := <-secretRenewalCh:
+			r.renewedSecret(renewal)
+
+		case <-r.healthyCh:
+			// Ignore a task that stopped being healthy since
+			if r.Healthy() {
+				r.registerServices()
+			}
+
+		case req := <-r.signalCh:
+			r.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).
+				SetSignal(signalNumber(req.sig)).
+				SetMessage(fmt.Sprintf("sent signal %v", req.sig)))
+			req.errCh <- r.handle.Signal(req.sig)
+
+		case handleCh := <-r.execCh:
+			handleCh <- r.handle
+
+		case reason := <-r.restartCh:
+			r.logger.Printf("[INFO] client: restarting task '%s' for alloc '%s': %s",
+				r.task.Name, r.allocID, reason)
+			r.deregisterServices()
+			r.stopStats()
+			r.stopChecks()
+			r.emitEvent(structs.AllocClientStatusPending,
+				structs.NewTaskEvent(structs.TaskRestarting).SetMessage(reason))
+			r.incrCounter("restarts")
+			r.lock.Lock()
+			r.restarts++
+			r.lock.Unlock()
+			res := r.killTask(KillReason{Kind: structs.TaskKillReasonRestarting, Message: reason})
+			r.setGauge("running", 0)
+
+			// Don't start the task again if it was destroyed meanwhile
+			select {
+			case <-r.destroyCh:
+				r.emitExit(structs.AllocClientStatusDead,
+					killEvent(structs.TaskKilled, res, r.getDestroyReason()), res)
+				break OUTER
+			default:
+			}
+
+			err := r.startTask()
+			r.restartLock.Lock()
+			r.restartPending = false
+			r.restartLock.Unlock()
+			if err != nil {
+				break OUTER
+			}
+			r.startStats()
+			r.startChecks()
+			r.startServices()
+
+		case name := <-depFailedCh:
+			// Leave it to the destroy if the whole alloc is being stopped
+			select {
+			case <-r.destroyCh:
+				continue
+			default:
+			}
+
+			r.logger.Printf("[WARN] client: killing task '%s' for alloc '%s' as its dependency '%s' failed",
+				r.task.Name, r.allocID, name)
+			r.deregisterServices()
+			r.stopChecks()
+			reason := KillReason{
+				Kind:    structs.TaskKillReasonDependencyFailed,
+				Message: fmt.Sprintf("dependency '%s' failed", name),
+			}
+			res := r.killTask(reason)
+			r.setGauge("running", 0)
+			r.emitExit(structs.AllocClientStatusDead, killEvent(structs.TaskDependencyFailed, res, reason), res)
+			break OUTER
+
+		case <-r.deadlineCh:
+			r.logger.Printf("[WARN] client: killing task '%s' for alloc '%s' as it exceeded its max runtime of %v",
+				r.task.Name, r.allocID, r.task.MaxRuntime)
+			r.recordEvent(structs.NewTaskEvent(structs.TaskDeadlineExceeded).
+				SetMessage(fmt.Sprintf("task exceeded its max runtime of %v", r.task.MaxRuntime)))
+			r.incrCounter("deadline_exceeded")
+			r.deregisterServices()
+			r.stopStats()
+			r.stopChecks()
+			reason := KillReason{
+				Kind:    structs.TaskKillReasonDeadline,
+				Message: fmt.Sprintf("killed for exceeding the max runtime of %v", r.task.MaxRuntime),
+			}
+			res := r.killTask(reason)
+			r.setGauge("running", 0)
+			if !r.task.MaxRuntimeFailure {
+				r.emitExit(structs.AllocClientStatusDead, killEvent(structs.TaskKilled, res, reason), res)
+				break OUTER
+			}
+
+			// Left to the restart policy like any other failure
+			r.incrCounter("failed")
+			if !r.restartTask(driver.NewWaitResult(0, 0, errors.New(reason.Message))) {
+				break OUTER
+			}
+			r.startStats()
+			r.startChecks()
+			r.startServices()
+
+		case used := <-diskQuotaCh:
+			r.logger.Printf("[WARN] client: killing task '%s' for alloc '%s' as it exceeded its disk quota",
+				r.task.Name, r.allocID)
+			r.deregisterServices()
+			r.stopChecks()
+			reason := KillReason{
+				Kind: structs.TaskKillReasonDiskQuota,
+				Message: fmt.Sprintf("killed for exceeding the disk quota of %d MB with %d MB",
+					r.task.Resources.DiskMB, used/bytesPerMB),
+			}
+			res := r.killTask(reason)
+			r.setGauge("running", 0)
+			r.emitExit(structs.AllocClientStatusFailed, killEvent(structs.TaskKilled, res, reason), res)
+			r.incrCounter("failed")
+			break OUTER
+
+		case <-r.destroyCh:
+			// Deregister the services first so traffic stops before the
+			// shutdown delay. The checks are stopped too so the task is no
+			// longer reported healthy while it drains, nor unhealthy because
+			// it is killed.
+			r.deregisterServices()
+			r.stopChecks()
+			reason := r.getDestroyReason()
+			exited, res := r.drain()
+			if !exited {
+				res = r.killTask(reason)
+			}
+			r.setGauge("running", 0)
+			r.emitExit(structs.AllocClientStatusDead, killEvent(structs.TaskKilled, res, reason), res)
+			break OUTER
+		}
+	}
+
+	// Cleanup after ourselves
+	r.DestroyState()
+}
+
+// markReady signals dependent tasks that the task is ready
+func (r *TaskRunner) markReady() {
+	r.readyOnce.Do(func() { close(r.readyCh) })
+}
+
+// awaitDependencies blocks until the prestart tasks of the group have
+// completed and the dependencies of the task are ready or have completed. It
+// fails if one of them exits without completing successfully, or with
+// errDestroyedBeforeStart if the task is destroyed in the meantime.
+func (r *TaskRunner) awaitDependencies() error {
+	for name, init := range r.prestart {
+		r.logger.Printf("[DEBUG] client: task '%s' for alloc '%s' is waiting for prestart task '%s'",
+			r.task.Name, r.allocID, name)
+		select {
+		case <-init.WaitCh():
+			if !init.completed {
+				return fmt.Errorf("prestart task '%s' failed before the task was started", name)
+			}
+		case <-r.destroyCh:
+			return errDestroyedBeforeStart
+		}
+	}
+	for name, dep := range r.dependencies {
+		r.logger.Printf("[DEBUG] client: task '%s' for alloc '%s' is waiting for dependency '%s'",
+			r.task.Name, r.allocID, name)
+		select {
+		case <-dep.readyCh:
+		case <-dep.WaitCh():
+			if !dep.completed {
+				return fmt.Errorf("dependency '%s' failed before the task was started", name)
+			}
+		case <-r.destroyCh:
+			return errDestroyedBeforeStart
+		}
+	}
+	return nil
+}
+
+// watchDependencies returns a channel receiving the names of the dependencies
+// that exit without completing successfully while the task runs. Their own
+// restart policies apply first, so a dependency is only considered failed once
+// it won't be restarted again.
+func (r *TaskRunner) watchDependencies() <-chan string {
+	failedCh := make(chan string, len(r.dependencies))
+	for name, dep := range r.dependencies {
+		go func(name string, dep *TaskRunner) {
+			select {
+			case <-dep.WaitCh():
+				if !dep.completed {
+					failedCh <- name
+				}
+			case <-r.waitCh:
+			}
+		}(name, dep)
+	}
+	return failedCh
+}
+
+// Update is used to update the task of the context. Updates are never
+// dropped; if the buffer is full the oldest pending update is discarded in
+// favor of the new one, since only the most recent task matters. A buffer
+// that is filling up is logged and counted, as it hints the buffer size is
+// too small for the rate of updates.
+func (r *TaskRunner) Update(update *structs.Task) {
+	r.updateLock.Lock()
+	defer r.updateLock.Unlock()
+	for {
+		select {
+		case r.updateCh <- update:
+			if pending, size := len(r.updateCh), cap(r.updateCh); pending >= size-size/4 {
+				r.logger.Printf("[WARN] client: %d of %d pending updates buffered for task '%s' (alloc '%s')",
+					pending, size, update.Name, r.allocID)
+				r.incrUpdateCounter(update, "updates_near_full")
+			}
+			return
+		default:
+		}
+
+		select {
+		case <-r.updateCh:
+			r.logger.Printf("[DEBUG] client: coalescing pending task update '%s' (alloc '%s')",
+				update.Name, r.allocID)
+			r.incrUpdateCounter(update, "updates_coalesced")
+		default:
+		}
+	}
+}
+
+// applyUpdate updates the running task to the given task. An update the
+// driver rejects is recorded and dropped, leaving the task as it was so it
+// keeps matching what the driver runs; a later update retries it.
+func (r *TaskRunner) applyUpdate(update *structs.Task) {
+	if sameTask(r.task, update) {
+		r.lock.Lock()
+		r.task = update
+		r.lock.Unlock()
+		r.logger.Printf("[DEBUG] client: skipping update of task '%s' for alloc '%s' that changes nothing",
+			r.task.Name, r.allocID)
+		return
+	}
+	if err := r.handle.Update(update); err != nil {
+		r.logger.Printf("[ERR] client: failed to update task '%s' for alloc '%s': %v",
+			r.task.Name, r.allocID, err)
+		r.recordEvent(structs.NewTaskEvent(structs.TaskUpdateFailed).
+			SetMessage(fmt.Sprintf("failed to update: %v", err)))
+		r.incrCounter("update_failed")
+		return
+	}
+	r.lock.Lock()
+	r.task = update
+	r.lock.Unlock()
+	r.updateTemplates()
+	if r.servicesRegistered {
+		r.registerServices()
+	}
+}
+
+// taskHash returns a hash of the fields of the task that affect how it is
+// run. The constraints are left out as they only matter for placing it.
+func taskHash(task *structs.Task) ([]byte, error) {
+	t := *task
+	t.Constraints = nil
+	data, err := json.Marshal(&t)
+	if err != nil {
+		return nil, err
+	}
+	sum := md5.Sum(data)
+	return sum[:], nil
+}
+
+// sameTask returns whether updating the task to the other one changes
+// nothing about how it is run
+func sameTask(task, other *structs.Task) bool {
+	h1, err := taskHash(task)
+	if err != nil {
+		return false
+	}
+	h2, err := taskHash(other)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(h1, h2)
+}
+
+// drainUpdates takes every pending update without blocking and returns the
+// newest, or nil if none were pending
+func (r *TaskRunner) drainUpdates() *structs.Task {
+	var latest *structs.Task
+	var folded int
+	for {
+		select {
+		case update := <-r.updateCh:
+			if latest != nil {
+				folded++
+			}
+			latest = update
+		default:
+			if folded != 0 {
+				r.logger.Printf("[DEBUG] client: folded %d task updates received while restoring task '%s' (alloc '%s')",
+					folded, r.task.Name, r.allocID)
+			}
+			return latest
+		}
+	}
+}
+
+// incrUpdateCounter increments the named task counter from outside the Run
+// loop, labelled after the update since the current task is owned by Run
+func (r *TaskRunner) incrUpdateCounter(update *structs.Task, name string) {
+	if sink := r.config.MetricsSink; sink != nil {
+		labels := map[string]string{"task": update.Name, "driver": update.Driver}
+		sink.IncrCounter([]string{"client", "task", name}, 1, labels)
+	}
+}
+
+// Reload applies a reload of the config of the client to the task, which
+// logs at its new level right away. Tasks using the logger of the client, as
+// they had neither a log level nor JSON logs, keep it until the client is
+// restarted. The other fields reloaded are read as they are needed, such as
+// the options of the driver each time the task is started.
+func (r *TaskRunner) Reload() {
+	if r.logWriter != nil {
+		r.logWriter.setLevel(r.config.ReadTaskLogLevel(r.logWriter.task))
+	}
+}
+
+// Restart is used to kill the running task and start it again with the same
+// task. Manual restarts happen immediately and do not count against the
+// restart policy. Requesting a restart while one is in progress has no
+// further effect.
+func (r *TaskRunner) Restart(reason string) error {
+	if reason == "" {
+		reason = "restart requested"
+	}
+
+	r.restartLock.Lock()
+	defer r.restartLock.Unlock()
+	select {
+	case <-r.waitCh:
+		return fmt.Errorf("task '%s' is not running", r.task.Name)
+	default:
+	}
+	if r.restartPending {
+		return nil
+	}
+	r.restartPending = true
+	r.restartCh <- reason
+	return nil
+}
+
+// signalRequest is a request to deliver a signal to the running task
+type signalRequest struct {
+	sig   os.Signal
+	errCh chan error
+}
+
+// Signal is used to deliver the named signal, e.g. "SIGHUP" or "HUP", to the
+// running task. Signals are delivered in order with updates and destroys.
+func (r *TaskRunner) Signal(name string) error {
+	sig, err := parseSignal(name)
+	if err != nil {
+		return err
+	}
+
+	req := &signalRequest{sig: sig, errCh: make(chan error, 1)}
+	select {
+	case r.signalCh <- req:
+	case <-r.waitCh:
+		return fmt.Errorf("task '%s' is not running", r.task.Name)
+	}
+	return <-req.errCh
+}
+
+// Exec runs the command inside the running task, e.g. to debug it, and
+// returns its combined output and exit code. The command is killed if it
+// outlives the timeout. Drivers that can not exec into tasks return a
+// *driver.NotSupportedError.
+func (r *TaskRunner) Exec(cmd []string, timeout time.Duration) ([]byte, int, error) {
+	if len(cmd) == 0 {
+		return nil, 0, fmt.Errorf("no command given")
+	}
+
+	// The handle is fetched from the run loop so the command is only run
+	// while the task is, but the command itself must not block the loop.
+	handleCh := make(chan driver.DriverHandle, 1)
+	select {
+	case r.execCh <- handleCh:
+	case <-r.waitCh:
+		return nil, 0, fmt.Errorf("task '%s' is not running", r.task.Name)
+	}
+	handle := <-handleCh
+
+	r.logger.Printf("[INFO] client: executing %q in task '%s' for alloc '%s'",
+		cmd, r.task.Name, r.allocID)
+	return handle.Exec(cmd, timeout)
+}
+
+// parseSignal returns the signal with the given name. The "SIG" prefix is
+// optional and the name is case insensitive.
+func parseSignal(name string) (os.Signal, error) {
+	upper := strings.ToUpper(name)
+	if !strings.HasPrefix(upper, "SIG") {
+		upper = "SIG" + upper
+	}
+	sig, ok := signalLookup[upper]
+	if !ok {
+		return nil, fmt.Errorf("unknown signal '%s'", name)
+	}
+	return sig, nil
+}
+
+// StreamLogs is used to stream the output of the task. The kind selects
+// between "stdout" and "stderr". If follow is false the existing output is
+// sent and the channel closed, otherwise the output is sent as it is written
+// until the task exits or the client shuts down. Marker frames tell where the
+// output was rotated or truncated, so readers can tell about the gaps. The
+// returned cancel func stops the stream and must be called once it is no
+// longer needed.
+func (r *TaskRunner) StreamLogs(kind string, follow bool) (<-chan *logging.Frame, func(), error) {
+	if r.ctx.AllocDir == nil {
+		return nil, nil, fmt.Errorf("task '%s' has no alloc dir", r.task.Name)
+	}
+
+	stdout, stderr := r.ctx.LogPaths(r.task.Name)
+	var path string
+	switch kind {
+	case "stdout":
+		path = stdout
+	case "stderr":
+		path = stderr
+	default:
+		return nil, nil, fmt.Errorf("unknown log kind '%s'", kind)
+	}
+
+	cancelCh := make(chan struct{})
+	stopCh := make(chan struct{})
+	go func() {
+		select {
+		case <-cancelCh:
+		case <-r.shutdownCh:
+		}
+		close(stopCh)
+	}()
+
+	var once sync.Once
+	cancel := func() {
+		once.Do(func() { close(cancelCh) })
+	}
+	return logging.StreamFiles(path, follow, stopCh, r.waitCh), cancel, nil
+}
+
+// Shutdown is used to stop the streams of the task runner when the client
+// is shutting down. The task itself is left running.
+func (r *TaskRunner) Shutdown() {
+	r.shutdownLock.Lock()
+	defer r.shutdownLock.Unlock()
+
+	if r.shutdown {
+		return
+	}
+	r.shutdown = true
+	close(r.shutdownCh)
+}
+
+// Destroy is used to indicate that the task context should be destroyed
+// as the allocation is stopped. It returns a channel closed once the task has
+// stopped and its state is cleaned up.
+func (r *TaskRunner) Destroy() <-chan struct{} {
+	return r.Kill(allocStopped)
+}
+
+// Kill is used to destroy the task context for the reason. Only the reason
+// of the first call is kept, though it is safe to call any number of times,
+// concurrently. Like WaitCh, the returned channel is closed once Run has
+// stopped the task and cleaned up its state.
+func (r *TaskRunner) Kill(reason KillReason) <-chan struct{} {
+	r.destroyLock.Lock()
+	defer r.destroyLock.Unlock()
+	r.setDestroyed(reason)
+	return r.waitCh
+}
+
+// ForceDestroy is used to destroy the task context without waiting out the
+// shutdown delay of the task. It also cuts short the delay of a task that is
+// already being destroyed.
+func (r *TaskRunner) ForceDestroy() {
+	r.destroyLock.Lock()
+	defer r.destroyLock.Unlock()
+
+	if !r.forceDestroy {
+		r.forceDestroy = true
+		close(r.forceDestroyCh)
+	}
+	r.setDestroyed(allocStopped)
+}
+
+// setDestroyed records the reason and closes destroyCh, unless the task is
+// already destroyed. The destroyLock must be held.
+func (r *TaskRunner) setDestroyed(reason KillReason) {
+	if r.destroy {
+		return
 	}
 	r.destroy = true
+	r.destroyReason = reason
 	close(r.destroyCh)
 }
+
+// getDestroyReason returns why the task is destroyed
+func (r *TaskRunner) getDestroyReason() KillReason {
+	r.destroyLock.Lock()
+	defer r.destroyLock.Unlock()
+	return r.destroyReason
+}
+
+// killedBeforeStartEvent returns the event of a task destroyed with the
+// error before it was started
+func (r *TaskRunner) killedBeforeStartEvent(err error) *structs.TaskEvent {
+	reason := r.getDestroyReason()
+	return structs.NewTaskEvent(structs.TaskKilled).
+		SetMessage(fmt.Sprintf("%s: %v", reason.Message, err)).
+		SetKillReason(reason.Kind)
+}
+
+// destroyContext returns a context cancelled once the task is destroyed, for
+// the driver calls that may block. The returned func must be called once the
+// call returns.
+func (r *TaskRunner) destroyContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-r.destroyCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
@@ -1,15 +1,28 @@
 package client
 
 import (
+	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/client/driver"
+	"github.com/hashicorp/nomad/client/driver/logging"
+	"github.com/hashicorp/nomad/client/metrics"
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
 	"github.com/hashicorp/nomad/testutil"
@@ -26,13 +39,19 @@ type MockTaskStateUpdater struct {
 	Name        []string
 	Status      []string
 	Description []string
+	Exit        []*structs.TaskExit
+
+	lock sync.Mutex
 }
 
-func (m *MockTaskStateUpdater) Update(name, status, desc string) {
+func (m *MockTaskStateUpdater) Update(name, status, desc string, exit *structs.TaskExit) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
 	m.Count += 1
 	m.Name = append(m.Name, name)
 	m.Status = append(m.Status, status)
 	m.Description = append(m.Description, desc)
+	m.Exit = append(m.Exit, exit)
 }
 
 func testTaskRunner() (*MockTaskStateUpdater, *TaskRunner) {
@@ -56,6 +75,49 @@ func testTaskRunner() (*MockTaskStateUpdater, *TaskRunner) {
 	return upd, tr
 }
 
+// testMockTaskRunner returns a task runner for a task using the mock driver
+// configured with the given settings.
+func testMockTaskRunner(conf map[string]string) (*MockTaskStateUpdater, *TaskRunner) {
+	upd, tr := testTaskRunner()
+	tr.task.Driver = "mock_driver"
+	tr.task.Config = conf
+	return upd, tr
+}
+
+// lastStatus returns the most recent status update
+func (m *MockTaskStateUpdater) lastStatus() (string, string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Count == 0 {
+		return "", ""
+	}
+	return m.Status[m.Count-1], m.Description[m.Count-1]
+}
+
+// lastExit returns the exit of the most recent status update
+func (m *MockTaskStateUpdater) lastExit() *structs.TaskExit {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.Count == 0 {
+		return nil
+	}
+	return m.Exit[m.Count-1]
+}
+
+// countStatus returns how many updates set the status, which unlike the
+// events of the task are all kept
+func (m *MockTaskStateUpdater) countStatus(status string) int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	n := 0
+	for _, s := range m.Status {
+		if s == status {
+			n++
+		}
+	}
+	return n
+}
+
 func TestTaskRunner_SimpleRun(t *testing.T) {
 	ctestutil.ExecCompatible(t)
 	upd, tr := testTaskRunner()
@@ -72,7 +134,7 @@ func TestTaskRunner_SimpleRun(t *testing.T) {
 	if upd.Count != 2 {
 		t.Fatalf("should have 2 updates: %#v", upd)
 	}
-	if upd.Name[0] != tr.task.Name {
+	if upd.Name[0] != tr.getTask().Name {
 		t.Fatalf("bad: %#v", upd.Name)
 	}
 	if upd.Status[0] != structs.AllocClientStatusRunning {
@@ -82,7 +144,7 @@ func TestTaskRunner_SimpleRun(t *testing.T) {
 		t.Fatalf("bad: %#v", upd.Description)
 	}
 
-	if upd.Name[1] != tr.task.Name {
+	if upd.Name[1] != tr.getTask().Name {
 		t.Fatalf("bad: %#v", upd.Name)
 	}
 	if upd.Status[1] != structs.AllocClientStatusDead {
@@ -129,6 +191,215 @@ func TestTaskRunner_Destroy(t *testing.T) {
 	}
 }
 
+func TestTaskRunner_Destroy_Reason(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+	waitDescription(t, upd, "task started")
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Both the kill and the exit of the task record why it was killed
+	events := tr.Events()
+	for _, e := range events {
+		if e.Type == structs.TaskKilling && e.KillReason != structs.TaskKillReasonStopped {
+			t.Fatalf("bad: %#v", e)
+		}
+	}
+	if last := events[len(events)-1]; last.Type != structs.TaskKilled || last.KillReason != structs.TaskKillReasonStopped {
+		t.Fatalf("bad: %#v", last)
+	}
+	if _, desc := upd.lastStatus(); !strings.HasPrefix(desc, "allocation stopped: ") {
+		t.Fatalf("bad: %s", desc)
+	}
+}
+
+func TestTaskRunner_Destroy_Concurrent(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+	waitDescription(t, upd, "task started")
+
+	// Every caller is told once the task is stopped
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-tr.Destroy():
+			case <-time.After(2 * time.Second):
+				t.Errorf("timeout")
+			}
+		}()
+	}
+	wg.Wait()
+
+	// The task is only killed once
+	if n := countEvents(tr, structs.TaskKilled); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	if n := countEvents(tr, structs.TaskKilling); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+
+	// Destroying a stopped task returns at once
+	select {
+	case <-tr.Destroy():
+	default:
+		t.Fatalf("destroy of stopped task not done")
+	}
+}
+
+func TestTaskRunner_Destroy_Wait(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s", "ignore_kill": "true"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.KillTimeout = 300 * time.Millisecond
+	go tr.Run()
+	waitDescription(t, upd, "task started")
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The channel is only closed once the task is forced to stop, after
+	// its kill timeout
+	doneCh := tr.Destroy()
+	select {
+	case <-doneCh:
+		t.Fatalf("destroy done before the task stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-doneCh:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// By then the task is dead and its state removed
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskKilled {
+		t.Fatalf("bad: %#v", last)
+	}
+	if _, err := os.Stat(tr.stateFilePath()); !os.IsNotExist(err) {
+		t.Fatalf("state not removed: %v", err)
+	}
+}
+
+func TestTaskRunner_Kill_Reason(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+	waitDescription(t, upd, "task started")
+
+	// Only the reason of the first kill is kept
+	tr.Kill(KillReason{Kind: structs.TaskKillReasonLeaderDead, Message: "leader task 'web' exited"})
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskKilled || last.KillReason != structs.TaskKillReasonLeaderDead {
+		t.Fatalf("bad: %#v", last)
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusDead ||
+		!strings.HasPrefix(desc, "leader task 'web' exited: ") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+}
+
+func TestTaskRunner_Destroy_BeforeStart(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+
+	// The dependency is never run, so the task waits until destroyed
+	_, dep := testMockTaskRunner(map[string]string{})
+	defer dep.ctx.AllocDir.Destroy()
+	tr.dependencies = map[string]*TaskRunner{"db": dep}
+	go tr.Run()
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskKilled || last.KillReason != structs.TaskKillReasonStopped {
+		t.Fatalf("bad: %#v", last)
+	}
+	if _, desc := upd.lastStatus(); desc != "allocation stopped: task destroyed before it was started" {
+		t.Fatalf("bad: %s", desc)
+	}
+}
+
+func TestTaskRunner_Destroy_KillTimeout(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10s",
+		"ignore_kill": "true",
+	})
+	tr.task.KillTimeout = 50 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	start := time.Now()
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if time.Since(start) < tr.getTask().KillTimeout {
+		t.Fatalf("task should have been given the kill timeout to exit")
+	}
+
+	// The escalation should be surfaced before the task is dead
+	if upd.Count != 3 {
+		t.Fatalf("should have 3 updates: %#v", upd)
+	}
+	if !strings.Contains(upd.Description[1], "force killing") {
+		t.Fatalf("bad: %#v", upd.Description)
+	}
+	if upd.Status[2] != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %#v", upd.Status)
+	}
+}
+
+func TestTaskRunner_KillTimeout(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	if timeout := tr.killTimeout(); timeout != tr.config.KillTimeout {
+		t.Fatalf("bad: %v", timeout)
+	}
+
+	tr.task.KillTimeout = time.Second
+	if timeout := tr.killTimeout(); timeout != time.Second {
+		t.Fatalf("bad: %v", timeout)
+	}
+
+	// Timeouts above the maximum are clamped
+	tr.task.KillTimeout = time.Hour
+	if timeout := tr.killTimeout(); timeout != tr.config.MaxKillTimeout {
+		t.Fatalf("bad: %v", timeout)
+	}
+}
+
 func TestTaskRunner_Update(t *testing.T) {
 	ctestutil.ExecCompatible(t)
 	_, tr := testTaskRunner()
@@ -142,56 +413,2978 @@ func TestTaskRunner_Update(t *testing.T) {
 
 	// Update the task definition
 	newTask := new(structs.Task)
-	*newTask = *tr.task
+	*newTask = *tr.getTask()
 	newTask.Driver = "foobar"
 	tr.Update(newTask)
 
 	// Wait for update to take place
 	testutil.WaitForResult(func() (bool, error) {
-		return tr.task == newTask, nil
+		return tr.getTask() == newTask, nil
 	}, func(err error) {
 		t.Fatalf("err: %v", err)
 	})
 }
 
-/*
-TODO: This test is disabled til a follow-up api changes the restore state interface.
-The driver/executor interface will be changed from Open to Cleanup, in which
-clean-up tears down previous allocs.
+func TestTaskRunner_Update_Burst(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10s",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
 
-func TestTaskRunner_SaveRestoreState(t *testing.T) {
-	upd, tr := testTaskRunner()
+	// Send many more updates than the buffer can hold
+	var last *structs.Task
+	for i := 0; i < 100; i++ {
+		last = new(structs.Task)
+		*last = *tr.getTask()
+		last.Meta = map[string]string{"version": fmt.Sprintf("%d", i)}
+		tr.Update(last)
+	}
 
-	// Change command to ensure we run for a bit
-	tr.task.Config["command"] = "/bin/sleep"
-	tr.task.Config["args"] = "10"
+	// The final applied task must be the last one sent
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getTask() == last, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestTaskRunner_Update_NoOp(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10s",
+	})
 	go tr.Run()
 	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+	waitDescription(t, upd, "task started")
+	handle := tr.getHandle().(*mockHandle)
 
-	// Snapshot state
-	time.Sleep(200 * time.Millisecond)
-	err := tr.SaveState()
-	if err != nil {
-		t.Fatalf("err: %v", err)
+	// Identical specs and ones only changing the constraints are skipped
+	same := new(structs.Task)
+	*same = *tr.getTask()
+	tr.Update(same)
+	constrained := new(structs.Task)
+	*constrained = *tr.getTask()
+	constrained.Constraints = []*structs.Constraint{{LTarget: "$attr.kernel.name", RTarget: "linux", Operand: "="}}
+	tr.Update(constrained)
+
+	// Changing a field the task runs with is applied
+	changed := new(structs.Task)
+	*changed = *tr.getTask()
+	changed.Env = map[string]string{"FOO": "bar"}
+	tr.Update(changed)
+
+	testutil.WaitForResult(func() (bool, error) {
+		return len(handle.receivedUpdates()) != 0, nil
+	}, func(err error) {
+		t.Fatalf("no update applied")
+	})
+	if applied := handle.receivedUpdates(); len(applied) != 1 || applied[0] != changed {
+		t.Fatalf("expected only the changed task to be applied, got %v", applied)
 	}
+}
 
-	// Create a new task runner
-	tr2 := NewTaskRunner(tr.logger, tr.config, upd.Update,
-		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
-	err = tr2.RestoreState()
-	if err != nil {
+func TestTaskRunner_Update_Failed(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10s",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+	original := tr.getTask()
+
+	// An update the driver rejects is recorded and not applied
+	rejected := new(structs.Task)
+	*rejected = *original
+	rejected.Config = map[string]string{"run_for": "10s", "update_err": "can't change the image"}
+	tr.Update(rejected)
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskUpdateFailed {
+				return strings.Contains(e.Message, "can't change the image"), nil
+			}
+		}
+		return false, fmt.Errorf("no update failed event: %v", tr.Events())
+	}, func(err error) {
 		t.Fatalf("err: %v", err)
+	})
+	if tr.getTask() != original {
+		t.Fatalf("rejected update was applied: %#v", tr.getTask())
 	}
-	go tr2.Run()
-	defer tr2.Destroy()
 
-	// Destroy and wait
-	tr2.Destroy()
+	// The next accepted update is applied
+	accepted := new(structs.Task)
+	*accepted = *original
+	accepted.Env = map[string]string{"FOO": "bar"}
+	tr.Update(accepted)
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getTask() == accepted, nil
+	}, func(err error) {
+		t.Fatalf("accepted update not applied")
+	})
+}
+
+func TestTaskRunner_Update_NearFull(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.config.TaskUpdateBufferSize = 4
+	sink := metrics.NewInmemSink()
+	tr.config.MetricsSink = sink
+	tr = NewTaskRunner(tr.logger, tr.config, tr.updater, tr.ctx, tr.allocID, tr.task)
+	if size := cap(tr.updateCh); size != 4 {
+		t.Fatalf("bad buffer size: %d", size)
+	}
+
+	// Nothing consumes the updates as the runner is not started
+	labels := map[string]string{"task": tr.task.Name, "driver": "mock_driver"}
+	nearFull := []string{"client", "task", "updates_near_full"}
+	coalesced := []string{"client", "task", "updates_coalesced"}
+	for i, exp := range []float32{0, 0, 1, 2, 3} {
+		tr.Update(tr.task)
+		if c := sink.Counter(nearFull, labels); c != exp {
+			t.Fatalf("update %d: got %v; want %v", i, c, exp)
+		}
+	}
+	if c := sink.Counter(coalesced, labels); c != 1 {
+		t.Fatalf("bad: %v", c)
+	}
+}
+
+func TestTaskRunner_RestartPolicy(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10ms",
+		"exit_err": "exit status 1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 2,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
 
 	select {
 	case <-tr.WaitCh():
 	case <-time.After(2 * time.Second):
 		t.Fatalf("timeout")
 	}
+
+	// Started, then two rounds of restarting and started again, then dead
+	exp := []string{
+		structs.AllocClientStatusRunning,
+		structs.AllocClientStatusPending,
+		structs.AllocClientStatusRunning,
+		structs.AllocClientStatusPending,
+		structs.AllocClientStatusRunning,
+		structs.AllocClientStatusDead,
+	}
+	if !reflect.DeepEqual(upd.Status, exp) {
+		t.Fatalf("bad: %#v", upd.Status)
+	}
+	if !strings.Contains(upd.Description[5], "exhausted 2 restart attempts") {
+		t.Fatalf("bad: %#v", upd.Description)
+	}
+	if tr.restartTracker.count != 2 {
+		t.Fatalf("bad: %d", tr.restartTracker.count)
+	}
+}
+
+func TestTaskRunner_RestartPolicy_Mode(t *testing.T) {
+	modes := map[string]string{
+		structs.RestartPolicyModeStop: structs.AllocClientStatusDead,
+		structs.RestartPolicyModeFail: structs.AllocClientStatusFailed,
+	}
+	for mode, expStatus := range modes {
+		upd, tr := testMockTaskRunner(map[string]string{
+			"run_for":  "10ms",
+			"exit_err": "exit status 1",
+		})
+		tr.task.RestartPolicy = &structs.RestartPolicy{
+			Attempts: 1,
+			Interval: time.Minute,
+			Delay:    10 * time.Millisecond,
+			Mode:     mode,
+		}
+		tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+		go tr.Run()
+
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout")
+		}
+		tr.ctx.AllocDir.Destroy()
+
+		status, desc := upd.lastStatus()
+		if status != expStatus || !strings.Contains(desc, "(mode "+mode+")") {
+			t.Fatalf("mode %s: bad: %s %s", mode, status, desc)
+		}
+		for _, e := range tr.Events() {
+			if (e.Type == structs.TaskRestarting || e.Type == structs.TaskRestartsThrottled) && e.RestartMode != mode {
+				t.Fatalf("mode %s: bad event: %#v", mode, e)
+			}
+		}
+	}
+}
+
+func TestTaskRunner_RestartPolicy_Throttled(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":   "10ms",
+		"exit_err":  "exit status 1",
+		"exit_code": "1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The quick failures exhausted the attempts, which the last event
+	// details
+	events := tr.Events()
+	last := events[len(events)-1]
+	if last.Type != structs.TaskRestartsThrottled {
+		t.Fatalf("bad: %#v", events)
+	}
+	if last.RestartCount != 3 || last.RestartAttempts != 3 || last.RestartInterval != time.Minute {
+		t.Fatalf("bad window: %d %d %v", last.RestartCount, last.RestartAttempts, last.RestartInterval)
+	}
+	if last.RestartWindow <= 0 || last.RestartWindow >= time.Minute {
+		t.Fatalf("bad window: %v", last.RestartWindow)
+	}
+	if last.ExitCode != 1 || !strings.Contains(last.Message, "not restarting: 3 restarts in") {
+		t.Fatalf("bad: %d %q", last.ExitCode, last.Message)
+	}
+	if n := upd.countStatus(structs.AllocClientStatusRunning); n != 4 {
+		t.Fatalf("started %d times", n)
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+
+	// An update of the task doesn't revive it
+	update := *tr.getTask()
+	tr.Update(&update)
+	time.Sleep(100 * time.Millisecond)
+	if n := upd.countStatus(structs.AllocClientStatusRunning); n != 4 {
+		t.Fatalf("started %d times", n)
+	}
+}
+
+func TestTaskRunner_Exit(t *testing.T) {
+	cases := []struct {
+		name   string
+		config map[string]string
+		exp    *structs.TaskExit
+		desc   string
+	}{
+		{
+			name:   "completed",
+			config: map[string]string{"run_for": "10ms"},
+			exp:    &structs.TaskExit{Reason: structs.TaskExitCompleted},
+			desc:   "Completed",
+		},
+		{
+			name:   "failed",
+			config: map[string]string{"run_for": "10ms", "exit_code": "3"},
+			exp:    &structs.TaskExit{Reason: structs.TaskExitFailed, ExitCode: 3},
+			desc:   "Exit Code 3",
+		},
+		{
+			name:   "signaled",
+			config: map[string]string{"run_for": "10ms", "exit_code": "143", "exit_signal": "15"},
+			exp:    &structs.TaskExit{Reason: structs.TaskExitSignaled, ExitCode: 143, Signal: 15},
+			desc:   "Exit Code 143 (Signal 15)",
+		},
+		{
+			name:   "oom killed",
+			config: map[string]string{"run_for": "10ms", "exit_code": "137", "exit_signal": "9", "oom_killed": "1"},
+			exp:    &structs.TaskExit{Reason: structs.TaskExitOOMKilled, ExitCode: 137, Signal: 9},
+			desc:   "Exit Code 137 (OOM)",
+		},
+		{
+			name:   "not started",
+			config: map[string]string{"start_err": "no such binary"},
+			exp:    &structs.TaskExit{Reason: structs.TaskExitNotStarted},
+		},
+	}
+	for _, c := range cases {
+		upd, tr := testMockTaskRunner(c.config)
+		tr.task.RestartPolicy = nil
+		tr.restartTracker = newRestartTracker(nil, tr.clock)
+		go tr.Run()
+
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: timeout", c.name)
+		}
+		tr.ctx.AllocDir.Destroy()
+
+		exit := upd.lastExit()
+		if exit == nil {
+			t.Fatalf("%s: no exit", c.name)
+		}
+		if c.exp.Reason == structs.TaskExitNotStarted {
+			if exit.Reason != c.exp.Reason || !strings.Contains(exit.Error, "no such binary") {
+				t.Fatalf("%s: bad: %#v", c.name, exit)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(exit, c.exp) {
+			t.Fatalf("%s: got %#v; want %#v", c.name, exit, c.exp)
+		}
+		if desc := exit.String(); desc != c.desc {
+			t.Fatalf("%s: got %q; want %q", c.name, desc, c.desc)
+		}
+	}
+}
+
+func TestTaskRunner_Exit_Restarts(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10ms",
+		"exit_code":   "137",
+		"exit_signal": "9",
+		"oom_killed":  "1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Only the terminal status carries the exit
+	for i, exit := range upd.Exit[:upd.Count-1] {
+		if exit != nil {
+			t.Fatalf("update %d (%s) has exit %#v", i, upd.Status[i], exit)
+		}
+	}
+	exit := upd.lastExit()
+	if exit == nil || exit.RestartCount != 3 {
+		t.Fatalf("bad: %#v", exit)
+	}
+	if desc := exit.String(); desc != "Exit Code 137 (OOM), restarted 3 times" {
+		t.Fatalf("bad: %q", desc)
+	}
+}
+
+func TestTaskRunner_Exit_Killed(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, fmt.Errorf("status %s", status)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	exit := upd.lastExit()
+	if exit == nil || exit.KillReason != structs.TaskKillReasonStopped {
+		t.Fatalf("bad: %#v", exit)
+	}
+}
+
+func TestTaskRunner_RestartPolicy_Clock(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10ms",
+		"exit_err": "exit status 1",
+	})
+	clock := newFakeClock()
+	tr.clock = clock
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Hour,
+		Delay:    time.Minute,
+		Mode:     structs.RestartPolicyModeFail,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Each backoff is waited out on the clock, which is advanced past it
+	// as soon as the task runner waits on it
+	for _, wait := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+		testutil.WaitForResult(func() (bool, error) {
+			return clock.Waiters() == 1, fmt.Errorf("task runner not waiting")
+		}, func(err error) {
+			t.Fatalf("waiting for %v: %v", wait, err)
+		})
+		events := tr.Events()
+		last := events[len(events)-1]
+		if last.Type != structs.TaskRestarting || !strings.Contains(last.Message, fmt.Sprintf("restarting in %v", wait)) {
+			t.Fatalf("bad: %#v", last)
+		}
+		clock.Advance(wait)
+	}
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusFailed || !strings.Contains(desc, "exhausted 3 restart attempts") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+}
+
+func TestTaskRunner_RestartPolicy_QuickExit(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10ms"})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts:       1,
+		Interval:       time.Minute,
+		Delay:          10 * time.Millisecond,
+		MinHealthyTime: time.Minute,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The successful exits counted against the restart attempts
+	var types []string
+	for _, e := range tr.Events() {
+		types = append(types, e.Type)
+	}
+	exp := []string{
+		structs.TaskReceived,
+		structs.TaskStarted,
+		structs.TaskExitedTooQuickly,
+		structs.TaskRestarting,
+		structs.TaskStarted,
+		structs.TaskExitedTooQuickly,
+		structs.TaskRestartsThrottled,
+	}
+	if !reflect.DeepEqual(types, exp) {
+		t.Fatalf("bad: %#v", types)
+	}
+	if tr.completed {
+		t.Fatalf("task should not be completed")
+	}
+	if _, desc := upd.lastStatus(); !strings.Contains(desc, "within the min healthy time of 1m0s") {
+		t.Fatalf("bad: %s", desc)
+	}
+}
+
+func TestTaskRunner_RestartPolicy_HealthyRun(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "100ms",
+		"exit_err": "exit status 1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts:       1,
+		Interval:       time.Minute,
+		Delay:          10 * time.Millisecond,
+		MinHealthyTime: 50 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Each run lasts past the min healthy time and resets the attempts, so
+	// the task keeps being restarted
+	testutil.WaitForResult(func() (bool, error) {
+		return countEvents(tr, structs.TaskRestarting) >= 2, nil
+	}, func(err error) {
+		t.Fatalf("task not restarted: %#v", upd.Description)
+	})
+	if n := countEvents(tr, structs.TaskNotRestarting); n != 0 {
+		t.Fatalf("task not restarted %d times", n)
+	}
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestTaskRunner_RestartPolicy_DestroyDuringBackoff(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"exit_err": "exit status 1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    time.Minute,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Wait for the task to be waiting on a restart
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusPending, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %v", status)
+	}
+}
+
+func TestTaskRunner_RestoreState_FoldUpdates(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+	defer tr.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Updates arriving while the task is restored are buffered
+	tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	var updates []*structs.Task
+	for _, key := range []string{"v1", "v2"} {
+		update := new(structs.Task)
+		*update = *tr2.task
+		update.Meta = map[string]string{"version": key}
+		tr2.Update(update)
+		updates = append(updates, update)
+	}
+	handle := tr2.handle.(*mockHandle)
+	go tr2.Run()
+	defer tr2.Destroy()
+
+	// Only the newest is applied to the restored handle
+	testutil.WaitForResult(func() (bool, error) {
+		return len(handle.receivedUpdates()) != 0, nil
+	}, func(err error) {
+		t.Fatalf("no update applied")
+	})
+	time.Sleep(50 * time.Millisecond)
+	if applied := handle.receivedUpdates(); len(applied) != 1 || applied[0] != updates[1] {
+		t.Fatalf("expected only the newest update, got %v", applied)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_RestartCount(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer tr.DestroyState()
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Minute,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	tr.restartTracker.nextRestart()
+	tr.restartTracker.nextRestart()
+
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.restartTracker.count != 2 {
+		t.Fatalf("bad: %d", tr2.restartTracker.count)
+	}
+}
+
+// testStateDirs returns a task runner saving its state into a new state
+// dir, along with a second state dir and a function removing both
+func testStateDirs(t *testing.T) (*TaskRunner, string, func()) {
+	src, err := ioutil.TempDir("", "nomad-state-src")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	dst, err := ioutil.TempDir("", "nomad-state-dst")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	_, tr := testMockTaskRunner(map[string]string{})
+	conf := tr.config.Copy()
+	conf.StateDir = src
+	tr.config = conf
+	return tr, dst, func() {
+		tr.ctx.AllocDir.Destroy()
+		os.RemoveAll(src)
+		os.RemoveAll(dst)
+	}
+}
+
+func TestLoadTaskState(t *testing.T) {
+	tr, other, cleanup := testStateDirs(t)
+	defer cleanup()
+	tr.task.RestartPolicy = &structs.RestartPolicy{Attempts: 3, Interval: time.Minute}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	tr.restartTracker.nextRestart()
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskStarted).SetMessage("task started"))
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	snap, err := LoadTaskState(tr.config.StateDir, tr.allocID, tr.task.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snap.Task.Name != tr.task.Name || snap.RestartCount != 1 ||
+		len(snap.Events) != 1 || snap.Events[0].Type != structs.TaskStarted {
+		t.Fatalf("bad: %#v", snap)
+	}
+
+	// Another dir has no state for the task
+	if _, err := LoadTaskState(other, tr.allocID, tr.task.Name); err == nil ||
+		!strings.Contains(err.Error(), "failed to find state") {
+		t.Fatalf("expected missing state error: %v", err)
+	}
+
+	// Corrupt state is reported but left in place
+	path := tr.stateFilePath()
+	if err := ioutil.WriteFile(path, []byte("{garbage"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := LoadTaskState(tr.config.StateDir, tr.allocID, tr.task.Name); err == nil {
+		t.Fatalf("expected corrupt state error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("corrupt state moved: %v", err)
+	}
+}
+
+func TestTaskRunner_RestoreStateFrom(t *testing.T) {
+	tr, other, cleanup := testStateDirs(t)
+	defer cleanup()
+	tr.task.RestartPolicy = &structs.RestartPolicy{Attempts: 3, Interval: time.Minute}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	tr.restartTracker.nextRestart()
+	tr.restartTracker.nextRestart()
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	src := tr.config.StateDir
+	saved, err := ioutil.ReadFile(tr.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A client with another state dir restores the state of the task from
+	// the first one
+	conf := tr.config.Copy()
+	conf.StateDir = other
+	tr2 := NewTaskRunner(tr.logger, conf, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreStateFrom(src); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.restartTracker.count != 2 || tr2.task.Driver != tr.task.Driver {
+		t.Fatalf("bad: %d %#v", tr2.restartTracker.count, tr2.task)
+	}
+
+	// From then on its state is saved into its own dir, leaving the source
+	// as it was
+	if err := tr2.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snap, err := LoadTaskState(other, tr.allocID, tr.task.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snap.RestartCount != 2 {
+		t.Fatalf("bad: %#v", snap)
+	}
+	if err := tr2.DestroyState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if data, err := ioutil.ReadFile(tr.stateFilePath()); err != nil || string(data) != string(saved) {
+		t.Fatalf("source state modified: %v", err)
+	}
+}
+
+func TestTaskRunner_RestoreStateFrom_Corrupt(t *testing.T) {
+	tr, other, cleanup := testStateDirs(t)
+	defer cleanup()
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	path := tr.stateFilePath()
+	if err := ioutil.WriteFile(path, []byte("{garbage"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The task is lost, but the corrupt state of the other client is not
+	// quarantined
+	conf := tr.config.Copy()
+	conf.StateDir = other
+	tr2 := NewTaskRunner(tr.logger, conf, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreStateFrom(tr.config.StateDir); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.restoreErr == nil {
+		t.Fatalf("expected restore error")
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("corrupt state moved: %v", err)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_MidBackoff(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10ms",
+		"exit_err": "exit status 1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 2,
+		Interval: time.Minute,
+		Delay:    10 * time.Second,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Wait for the task to fail and back off before its first restart
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusPending, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// A client restarting now picks up the budget where it was left
+	tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	tr.Destroy()
+	<-tr.WaitCh()
+
+	if tr2.restartTracker.count != 1 || tr2.restartTracker.startTime.IsZero() {
+		t.Fatalf("bad: %d %v", tr2.restartTracker.count, tr2.restartTracker.startTime)
+	}
+	if restart, _ := tr2.restartTracker.nextRestart(); !restart {
+		t.Fatalf("second restart should be allowed")
+	}
+	if restart, _ := tr2.restartTracker.nextRestart(); restart {
+		t.Fatalf("budget should be exhausted")
+	}
+}
+
+func TestTaskRunner_Events(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10ms",
+		"exit_err": "exit status 1",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	events := tr.Events()
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	exp := []string{
+		structs.TaskReceived,
+		structs.TaskStarted,
+		structs.TaskTerminated,
+		structs.TaskRestarting,
+		structs.TaskStarted,
+		structs.TaskTerminated,
+		structs.TaskRestartsThrottled,
+	}
+	if !reflect.DeepEqual(types, exp) {
+		t.Fatalf("bad: %#v", types)
+	}
+	if events[3].RestartCount != 1 {
+		t.Fatalf("bad restart count: %#v", events[3])
+	}
+	for i := 1; i < len(events); i++ {
+		if events[i].Time < events[i-1].Time {
+			t.Fatalf("events out of order: %#v", events)
+		}
+	}
+}
+
+func TestTaskRunner_Events_Evicted(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	for i := 0; i < maxTaskEvents+5; i++ {
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskSignaling).SetSignal(i))
+	}
+
+	// Only the most recent events are retained, oldest first
+	events := tr.Events()
+	if len(events) != maxTaskEvents {
+		t.Fatalf("bad: %d events", len(events))
+	}
+	for i, e := range events {
+		if e.Signal != i+5 {
+			t.Fatalf("event %d: bad: %#v", i, e)
+		}
+	}
+}
+
+func TestTaskRunner_Events_ExitCode(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10ms",
+		"exit_code":   "3",
+		"exit_signal": "9",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The exit code and signal reported by the driver are in the events
+	var terminated *structs.TaskEvent
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskTerminated {
+			terminated = e
+		}
+	}
+	if terminated == nil {
+		t.Fatalf("no terminated event: %#v", tr.Events())
+	}
+	if terminated.ExitCode != 3 || terminated.Signal != 9 {
+		t.Fatalf("bad: %#v", terminated)
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad status: %s", status)
+	}
+	if tr.completed {
+		t.Fatalf("task with a non-zero exit code should not complete")
+	}
+}
+
+func TestTaskRunner_Events_CleanExit(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":   "10ms",
+		"exit_code": "0",
+	})
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 3,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// A clean exit completes the task rather than restarting it
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskRestarting {
+			t.Fatalf("clean exit restarted the task: %#v", tr.Events())
+		}
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusDead || desc != "task completed" {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_Events(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer tr.DestroyState()
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskReceived))
+	tr.recordEvent(structs.NewTaskEvent(structs.TaskTerminated).SetExitCode(2).SetSignal(9))
+
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if events := tr2.Events(); !reflect.DeepEqual(events, tr.Events()) {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestTaskRunner_SaveState_EventLimits(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer tr.DestroyState()
+	for i := 0; i < maxTaskEvents; i++ {
+		tr.recordEvent(structs.NewTaskEvent(structs.TaskDriverFailure).
+			SetMessage(strings.Repeat("x", 1024)).SetSignal(i))
+	}
+
+	// Only the latest events within the limit are saved
+	tr.config.MaxPersistedTaskEvents = 4
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	snap, err := LoadTaskState(tr.config.StateDir, tr.allocID, tr.task.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(snap.Events) != 4 || snap.Events[0].Signal != maxTaskEvents-4 {
+		t.Fatalf("bad: %#v", snap.Events)
+	}
+	if len(tr.Events()) != maxTaskEvents {
+		t.Fatalf("events in memory should be kept: %d", len(tr.Events()))
+	}
+
+	// State too large even without events is still saved
+	tr.config.MaxPersistedTaskEvents = 0
+	tr.config.MaxTaskStateSize = 1
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if snap, err = LoadTaskState(tr.config.StateDir, tr.allocID, tr.task.Name); err != nil || len(snap.Events) != 0 {
+		t.Fatalf("bad: %#v %v", snap, err)
+	}
+	fi, err := os.Stat(tr.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The oldest events are left out to keep the state within the size
+	// limit, which fits a few of them
+	limit := int(fi.Size()) + 3500
+	tr.config.MaxTaskStateSize = limit
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi, err = os.Stat(tr.stateFilePath()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if fi.Size() > int64(limit) {
+		t.Fatalf("state is %d bytes; limit is %d", fi.Size(), limit)
+	}
+	snap, err = LoadTaskState(tr.config.StateDir, tr.allocID, tr.task.Name)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if n := len(snap.Events); n == 0 || n >= maxTaskEvents || snap.Events[n-1].Signal != maxTaskEvents-1 {
+		t.Fatalf("bad: %d events", n)
+	}
+}
+
+func TestTaskRunner_Oversubscribe_Priority(t *testing.T) {
+	_, low := testMockTaskRunner(map[string]string{})
+	defer low.ctx.AllocDir.Destroy()
+	_, high := testMockTaskRunner(map[string]string{})
+	defer high.ctx.AllocDir.Destroy()
+	low.priority, high.priority = 10, 90
+
+	// Without oversubscription the task is given to the driver as it is
+	if task := low.taskToStart(); task != low.task {
+		t.Fatalf("task should not be copied")
+	}
+
+	// Lower priority tasks are killed first and get fewer CPU shares
+	low.config.Oversubscribe = true
+	high.config.Oversubscribe = true
+	lowTask, highTask := low.taskToStart(), high.taskToStart()
+	if lowTask.Resources.OOMScoreAdj <= highTask.Resources.OOMScoreAdj {
+		t.Fatalf("oom_score_adj %d of low priority task is not above %d",
+			lowTask.Resources.OOMScoreAdj, highTask.Resources.OOMScoreAdj)
+	}
+	if lowTask.Resources.Shares() >= highTask.Resources.Shares() {
+		t.Fatalf("%d shares of low priority task are not below %d",
+			lowTask.Resources.Shares(), highTask.Resources.Shares())
+	}
+	if low.task.Resources.OOMScoreAdj != 0 || low.task.Resources.CPUShares != 0 {
+		t.Fatalf("task should not be modified: %#v", low.task.Resources)
+	}
+
+	// An oom_score_adj set by the task is kept
+	low.task.Resources.OOMScoreAdj = -100
+	if adj := low.taskToStart().Resources.OOMScoreAdj; adj != -100 {
+		t.Fatalf("got oom_score_adj %d", adj)
+	}
+}
+
+func TestTaskRunner_Metrics(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10ms",
+		"exit_err": "exit status 1",
+	})
+	sink := metrics.NewInmemSink()
+	tr.config.MetricsSink = sink
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	labels := map[string]string{"task": tr.getTask().Name, "driver": "mock_driver"}
+	counters := map[string]float32{
+		"started":       2,
+		"failed":        2,
+		"restarts":      1,
+		"kill_timeouts": 0,
+	}
+	for name, exp := range counters {
+		if c := sink.Counter([]string{"client", "task", name}, labels); c != exp {
+			t.Fatalf("%s: got %v; want %v", name, c, exp)
+		}
+	}
+	if g, ok := sink.Gauge([]string{"client", "task", "running"}, labels); !ok || g != 0 {
+		t.Fatalf("bad running gauge: %v %v", g, ok)
+	}
+}
+
+func TestTaskRunner_Metrics_KillTimeout(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10s",
+		"ignore_kill": "true",
+	})
+	sink := metrics.NewInmemSink()
+	tr.config.MetricsSink = sink
+	tr.task.KillTimeout = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	labels := map[string]string{"task": tr.getTask().Name, "driver": "mock_driver"}
+	if g, _ := sink.Gauge([]string{"client", "task", "running"}, labels); g != 1 {
+		t.Fatalf("bad running gauge: %v", g)
+	}
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if c := sink.Counter([]string{"client", "task", "kill_timeouts"}, labels); c != 1 {
+		t.Fatalf("bad: %v", c)
+	}
+	if g, _ := sink.Gauge([]string{"client", "task", "running"}, labels); g != 0 {
+		t.Fatalf("bad running gauge: %v", g)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_Reattach(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10s",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Snapshot state
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a new task runner and re-attach to the task
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.handle == nil {
+		t.Fatalf("handle should be restored")
+	}
+	go tr2.Run()
+
+	// Destroy and wait
+	tr2.Destroy()
+	select {
+	case <-tr2.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The restored task should not have been started again
+	if upd2.Count != 1 {
+		t.Fatalf("should have 1 update: %#v", upd2)
+	}
+	if upd2.Status[0] != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %#v", upd2.Status)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_OpenFailure(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10s",
+		"open_err": "process not found",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go tr2.Run()
+
+	select {
+	case <-tr2.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task should be dead rather than started fresh
+	if upd2.Count != 1 {
+		t.Fatalf("should have 1 update: %#v", upd2)
+	}
+	if upd2.Status[0] != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %#v", upd2.Status)
+	}
+	if !strings.Contains(upd2.Description[0], "process not found") {
+		t.Fatalf("bad: %#v", upd2.Description)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_IncompatibleHandle(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":           "10s",
+		"open_incompatible": "1",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.handle != nil || tr2.restoreErr != nil || tr2.reattachErr == nil {
+		t.Fatalf("bad: %v %v %v", tr2.handle, tr2.restoreErr, tr2.reattachErr)
+	}
+
+	// The handle is kept for the cleanup of the driver to leave alone
+	if id := tr.getHandle().ID(); tr2.reattachHandleID != id {
+		t.Fatalf("got handle %q; want %q", tr2.reattachHandleID, id)
+	}
+	go tr2.Run()
+	defer tr2.Destroy()
+
+	// The task is started again rather than lost
+	waitDescription(t, upd2, "task started")
+	var reattached bool
+	for _, e := range tr2.Events() {
+		if e.Type == structs.TaskRestarting && strings.Contains(e.Message, "failed to reattach") {
+			reattached = true
+		}
+	}
+	if !reattached {
+		t.Fatalf("bad: %#v", tr2.Events())
+	}
+	if tr2.restarts != 1 {
+		t.Fatalf("bad: %d", tr2.restarts)
+	}
+}
+
+// testLostTaskRunner returns a task runner restored from the state of a task
+// that was lost while the client was down, with the restart policy
+func testLostTaskRunner(t *testing.T, policy *structs.RestartPolicy) (*MockTaskStateUpdater, *TaskRunner, func()) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":   "10s",
+		"open_lost": "1",
+	})
+	tr.task.RestartPolicy = policy
+	tr.restartTracker = newRestartTracker(policy, tr.clock)
+	go tr.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.handle != nil || tr2.restoreErr != nil || tr2.lostErr == nil {
+		t.Fatalf("bad: %v %v %v", tr2.handle, tr2.restoreErr, tr2.lostErr)
+	}
+	cleanup := func() {
+		tr.Destroy()
+		tr2.Destroy()
+		tr.ctx.AllocDir.Destroy()
+	}
+	return upd2, tr2, cleanup
+}
+
+func TestTaskRunner_SaveRestoreState_Lost(t *testing.T) {
+	upd, tr, cleanup := testLostTaskRunner(t, &structs.RestartPolicy{
+		Attempts: 2,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+		Mode:     structs.RestartPolicyModeDelay,
+	})
+	defer cleanup()
+	go tr.Run()
+
+	// The restart policy restarts the lost task
+	waitDescription(t, upd, "task started")
+	var types []string
+	for _, e := range tr.Events() {
+		types = append(types, e.Type)
+	}
+	exp := []string{structs.TaskLost, structs.TaskRestarting, structs.TaskStarted}
+	if len(types) < len(exp) || !reflect.DeepEqual(types[len(types)-len(exp):], exp) {
+		t.Fatalf("bad: %v", types)
+	}
+	if tr.restarts != 1 || tr.restartTracker.count != 1 {
+		t.Fatalf("bad: %d %d", tr.restarts, tr.restartTracker.count)
+	}
+}
+
+func TestTaskRunner_SaveRestoreState_Lost_Fail(t *testing.T) {
+	upd, tr, cleanup := testLostTaskRunner(t, &structs.RestartPolicy{
+		Attempts: 0,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+		Mode:     structs.RestartPolicyModeFail,
+	})
+	defer cleanup()
+	go tr.Run()
+
+	// Without restarts left the lost task fails, for the scheduler to place
+	// it elsewhere
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed ||
+		!strings.Contains(desc, "process was killed") {
+		t.Fatalf("bad: %s %q", status, desc)
+	}
+	// Without attempts to use up it is not throttled
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskNotRestarting ||
+		last.RestartMode != structs.RestartPolicyModeFail {
+		t.Fatalf("bad: %#v", events)
+	}
+	if n := countEvents(tr, structs.TaskRestartsThrottled); n != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if tr.getHandle() != nil {
+		t.Fatalf("lost task should not have been started")
+	}
+}
+
+func TestTaskRunner_RestoreState_Corrupt(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer os.RemoveAll(filepath.Join(tr.config.StateDir, "alloc", tr.allocID))
+
+	path := tr.stateFilePath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, []byte("\x00garbage{"), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The restore succeeds with the corrupt file set aside
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("corrupt state should be moved: %v", err)
+	}
+	matches, err := filepath.Glob(path + ".corrupt.*")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(matches) != 1 {
+		t.Fatalf("bad: %#v", matches)
+	}
+	if buf, err := ioutil.ReadFile(matches[0]); err != nil || string(buf) != "\x00garbage{" {
+		t.Fatalf("bad: %q %v", buf, err)
+	}
+
+	// The task is reported lost rather than started
+	go tr2.Run()
+	select {
+	case <-tr2.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if upd2.Count != 1 || upd2.Status[0] != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %#v", upd2)
+	}
+	if !strings.Contains(upd2.Description[0], "failed to decode state") {
+		t.Fatalf("bad: %#v", upd2.Description)
+	}
+	if events := tr2.Events(); events[len(events)-1].Type != structs.TaskRestoreFailed {
+		t.Fatalf("bad: %#v", events)
+	}
+}
+
+func TestTaskRunner_RestoreState_Missing(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer os.RemoveAll(filepath.Join(tr.config.StateDir, "alloc", tr.allocID))
+
+	// Neither a missing nor an empty snapshot is restored, leaving the task
+	// as it was given
+	for _, contents := range []string{"", "{}"} {
+		path := tr.stateFilePath()
+		if contents != "" {
+			if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+			if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+				t.Fatalf("err: %v", err)
+			}
+		}
+		task := &structs.Task{Name: tr.task.Name}
+		tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater, tr.ctx, tr.allocID, task)
+		if err := tr2.RestoreState(); err == nil || !strings.Contains(err.Error(), "no state") {
+			t.Fatalf("expected missing state error for %q: %v", contents, err)
+		}
+		if tr2.task != task {
+			t.Fatalf("task replaced: %#v", tr2.task)
+		}
+	}
+}
+
+func TestTaskRunner_StateFilePath(t *testing.T) {
+	names := []string{"web", "a/b", "a%2Fb", "my task", "caf\u00e9", "../.."}
+	seen := make(map[string]string)
+	for _, name := range names {
+		_, tr := testMockTaskRunner(map[string]string{})
+		tr.ctx.AllocDir.Destroy()
+		tr.task.Name = name
+
+		// The state must live in its own directory directly under the alloc
+		path := tr.stateFilePath()
+		dir := filepath.Dir(path)
+		if filepath.Dir(dir) != filepath.Join(tr.config.StateDir, "alloc", tr.allocID) {
+			t.Fatalf("bad path for %q: %s", name, path)
+		}
+		if other, ok := seen[dir]; ok {
+			t.Fatalf("%q and %q share state dir %s", name, other, dir)
+		}
+		seen[dir] = name
+	}
+}
+
+func TestTaskRunner_RestoreState_Legacy(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	defer os.RemoveAll(filepath.Join(tr.config.StateDir, "alloc", tr.allocID))
+	tr.task.Name = "my task"
+
+	// Write the state where older clients put it
+	snap := taskRunnerState{Task: tr.task, RestartCount: 3}
+	persistLegacyState(t, tr.legacyStateFilePath(), &snap)
+
+	tr2 := NewTaskRunner(tr.logger, tr.config, tr.updater,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.task.Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if tr2.task.Driver != "mock_driver" || tr2.restartTracker.count != 3 {
+		t.Fatalf("bad: %#v", tr2.task)
+	}
+
+	// Saving should migrate the state to the new location
+	if err := tr2.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(tr2.stateFilePath()); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if _, err := os.Stat(filepath.Dir(tr2.legacyStateFilePath())); !os.IsNotExist(err) {
+		t.Fatalf("legacy state should be removed: %v", err)
+	}
+}
+
+func TestTaskRunner_Ports(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	network := tr.task.Resources.Networks[0]
+	network.ReservedPorts = []int{23456}
+	network.DynamicPorts = []string{"http"}
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+	if ports := tr.ctx.TaskPorts(tr.getTask().Name); ports["http"] != 23456 {
+		t.Fatalf("bad: %#v", ports)
+	}
+	env := tr.ctx.TaskEnv(tr.getTask().Name)
+	if env["NOMAD_PORT_http"] != "23456" || env["NOMAD_ADDR_http"] != network.IP+":23456" {
+		t.Fatalf("bad: %#v", env)
+	}
+}
+
+func TestTaskRunner_Ports_StaticConflict(t *testing.T) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	network := tr.task.Resources.Networks[0]
+	network.ReservedPorts = []int{port}
+	network.DynamicPorts = nil
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	exp := fmt.Sprintf("static port %d is already in use on the node", port)
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed || desc != exp {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	if n := countEvents(tr, structs.TaskPortConflict); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_DriverAvailability(t *testing.T) {
+	for _, absent := range []bool{false, true} {
+		upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+		if absent {
+			tr.config.Options = map[string]string{"driver.mock_driver.absent": "1"}
+		}
+
+		// Fingerprint the node the way the client does on startup
+		tr.config.Node = &structs.Node{Attributes: make(map[string]string)}
+		d, err := driver.NewDriver("mock_driver", driver.NewDriverContext("", tr.config, tr.config.Node, tr.logger))
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if detected, err := d.Fingerprint(tr.config, tr.config.Node); err != nil || detected == absent {
+			t.Fatalf("bad: %v %v", detected, err)
+		}
+
+		go tr.Run()
+		if !absent {
+			waitDescription(t, upd, "task started")
+			tr.Destroy()
+		}
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout")
+		}
+		tr.ctx.AllocDir.Destroy()
+		if !absent {
+			continue
+		}
+
+		// A task using an undetected driver is never started
+		if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed ||
+			desc != "driver 'mock_driver' is not available on this node" {
+			t.Fatalf("bad: %s %s", status, desc)
+		}
+		if n := countEvents(tr, structs.TaskDriverFailure); n != 1 {
+			t.Fatalf("bad: %#v", tr.Events())
+		}
+		if n := countEvents(tr, structs.TaskStarted); n != 0 {
+			t.Fatalf("bad: %#v", tr.Events())
+		}
+	}
+}
+
+func TestTaskRunner_UnknownDriver(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Driver = "mock_drvier"
+	go tr.Run()
+	defer tr.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The failure names the drivers that could have been meant
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusFailed {
+		t.Fatalf("bad: %s", status)
+	}
+	var msg string
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskDriverFailure {
+			msg = e.Message
+		}
+	}
+	if !strings.Contains(msg, "unknown driver 'mock_drvier'") || !strings.Contains(msg, "available drivers") ||
+		!strings.Contains(msg, "mock_driver") {
+		t.Fatalf("bad: %q", msg)
+	}
+}
+
+func TestTaskRunner_Capabilities(t *testing.T) {
+	defer func(fs string) { mockDriverFSIsolation = fs }(mockDriverFSIsolation)
+	mockDriverFSIsolation = driver.FSIsolationNone
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Volumes = []*structs.TaskVolume{{Source: os.TempDir(), Destination: "/data"}}
+	go tr.Run()
+	defer tr.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The volume can't be isolated, so the task is refused before it starts
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed ||
+		!strings.Contains(desc, "can't mount volumes") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_ResourceCeiling(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.config.ResourceCeilings = map[string]*config.ResourceCeiling{
+		"mock_driver": {MemoryMB: tr.task.Resources.MemoryMB - 1},
+	}
+	go tr.Run()
+	defer tr.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task is refused before it is started
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed ||
+		!strings.Contains(desc, "MB allowed for driver 'mock_driver'") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	if n := countEvents(tr, structs.TaskValidationFailed); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_DriverMinVersion(t *testing.T) {
+	defer func(v string) { mockDriverVersion = v }(mockDriverVersion)
+	mockDriverVersion = "1.6.2"
+
+	for min, ok := range map[string]bool{"1.6": true, "1.6.2": true, "1.9": false} {
+		upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+		tr.config.Options = map[string]string{"driver.mock_driver.min_version": min}
+
+		go tr.Run()
+		if ok {
+			waitDescription(t, upd, "task started")
+			tr.Destroy()
+		}
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(2 * time.Second):
+			t.Fatalf("timeout")
+		}
+		tr.ctx.AllocDir.Destroy()
+		if ok {
+			continue
+		}
+
+		// A task whose runtime is too old is never started
+		exp := "mock_driver 1.6.2 < required " + min
+		if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed || desc != exp {
+			t.Fatalf("bad: %s %s", status, desc)
+		}
+		if n := countEvents(tr, structs.TaskStarted); n != 0 {
+			t.Fatalf("bad: %#v", tr.Events())
+		}
+	}
+}
+
+func TestTaskRunner_Validate(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"validate_err": "missing command"})
+	defer tr.ctx.AllocDir.Destroy()
+
+	go tr.Run()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// A task rejected by its driver fails without being started
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusFailed || desc != "missing command" {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	if n := countEvents(tr, structs.TaskValidationFailed); n != 1 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	if n := countEvents(tr, structs.TaskStarted); n != 0 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_BuildEnv(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	tr.config.Node = &structs.Node{
+		Attributes: map[string]string{
+			"kernel.name": "linux",
+			"arch":        "amd64",
+		},
+	}
+	tr.task.Env = map[string]string{
+		// The task env overrides node attributes
+		"NOMAD_ATTR_ARCH": "386",
+
+		// but not the runtime values
+		"NOMAD_ALLOC_ID":  "foo",
+		"NOMAD_TASK_NAME": "foo",
+
+		"ADDR":    "${NOMAD_IP}:${NOMAD_PORT_http}",
+		"KERNEL":  "${NOMAD_ATTR_KERNEL_NAME}",
+		"ID":      "${NOMAD_TASK_NAME}-${NOMAD_ALLOC_ID}",
+		"MISSING": "${NOT_SET}",
+	}
+	tr.task.Resources.Networks[0].DynamicPorts = []string{"http"}
+
+	env, err := tr.buildEnv()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := map[string]string{
+		"NOMAD_ATTR_ARCH":        "386",
+		"NOMAD_ATTR_KERNEL_NAME": "linux",
+		"NOMAD_ALLOC_ID":         tr.allocID,
+		"NOMAD_TASK_NAME":        tr.task.Name,
+		"NOMAD_ALLOC_DIR":        tr.ctx.AllocDir.SharedDir,
+		"ADDR":                   fmt.Sprintf("%s:80", tr.task.Resources.Networks[0].IP),
+		"KERNEL":                 "linux",
+		"ID":                     fmt.Sprintf("%s-%s", tr.task.Name, tr.allocID),
+		"MISSING":                "${NOT_SET}",
+	}
+	for k, v := range exp {
+		if env[k] != v {
+			t.Fatalf("%s is %q; want %q", k, env[k], v)
+		}
+	}
+}
+
+// readStream reads from the stream until it has received exp or times out,
+// returning the markers received meanwhile
+func readStream(t *testing.T, ch <-chan *logging.Frame, exp string) []*logging.Marker {
+	var act []byte
+	var markers []*logging.Marker
+	timeout := time.After(2 * time.Second)
+	for string(act) != exp {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				t.Fatalf("stream closed after %q; want %q", act, exp)
+			}
+			if frame.Marker != nil {
+				markers = append(markers, frame.Marker)
+			}
+			act = append(act, frame.Data...)
+		case <-timeout:
+			t.Fatalf("timeout after %q; want %q", act, exp)
+		}
+	}
+	return markers
+}
+
+// waitStreamClosed waits for the stream to be closed without more data
+func waitStreamClosed(t *testing.T, ch <-chan *logging.Frame) {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case frame, ok := <-ch:
+			if !ok {
+				return
+			}
+			if frame.Marker == nil {
+				t.Fatalf("unexpected data: %q", frame.Data)
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for stream to close")
+		}
+	}
+}
+
+func TestTaskRunner_StreamLogs(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	if _, _, err := tr.StreamLogs("foo", false); err == nil {
+		t.Fatalf("expected error for unknown log kind")
+	}
+
+	stdout, _ := tr.ctx.LogPaths(tr.task.Name)
+	w, err := logging.NewFileRotator(stdout, 3, 4)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer w.Close()
+	if _, err := w.Write([]byte("hello world")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// The existing output spans several files
+	ch, cancel, err := tr.StreamLogs("stdout", false)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cancel()
+	markers := readStream(t, ch, "hello world")
+	waitStreamClosed(t, ch)
+
+	// The rotations between the files are marked
+	if len(markers) != 2 {
+		t.Fatalf("expected 2 markers: %#v", markers)
+	}
+	for i, m := range markers {
+		from := logging.Position{Index: i, Offset: 4}
+		to := logging.Position{Index: i + 1}
+		if m.Kind != logging.MarkerRotated || m.From != from || m.To != to {
+			t.Fatalf("bad marker %d: %#v", i, m)
+		}
+	}
+
+	// New output is streamed when following
+	ch, cancel, err = tr.StreamLogs("stdout", true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := w.Write([]byte("more output")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	readStream(t, ch, "more output")
+
+	cancel()
+	waitStreamClosed(t, ch)
+}
+
+func TestTaskRunner_StreamLogs_Shutdown(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+
+	ch, cancel, err := tr.StreamLogs("stderr", true)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer cancel()
+
+	tr.Shutdown()
+	waitStreamClosed(t, ch)
+}
+
+/*
+TODO: This test is disabled til a follow-up api changes the restore state interface.
+The driver/executor interface will be changed from Open to Cleanup, in which
+clean-up tears down previous allocs.
+
+func TestTaskRunner_SaveRestoreState(t *testing.T) {
+	upd, tr := testTaskRunner()
+
+	// Change command to ensure we run for a bit
+	tr.task.Config["command"] = "/bin/sleep"
+	tr.task.Config["args"] = "10"
+	go tr.Run()
+	defer tr.Destroy()
+
+	// Snapshot state
+	time.Sleep(200 * time.Millisecond)
+	err := tr.SaveState()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Create a new task runner
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd.Update,
+		tr.ctx, tr.allocID, &structs.Task{Name: tr.getTask().Name})
+	err = tr2.RestoreState()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go tr2.Run()
+	defer tr2.Destroy()
+
+	// Destroy and wait
+	tr2.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+*/
+
+func TestTaskRunner_Artifacts(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("corrupted"))
+	}))
+	defer ts.Close()
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Artifacts = []*structs.TaskArtifact{
+		&structs.TaskArtifact{
+			Source:   ts.URL + "/app",
+			Checksum: "sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusFailed {
+		t.Fatalf("bad: %s", status)
+	}
+	if !strings.Contains(desc, ts.URL+"/app") || !strings.Contains(desc, "checksum mismatch") {
+		t.Fatalf("bad: %s", desc)
+	}
+	if tr.getHandle() != nil {
+		t.Fatalf("task should not have been started")
+	}
+}
+
+func TestTaskRunner_Artifacts_DownloadLimit(t *testing.T) {
+	// The server holds each download a moment, tracking how many run at once
+	var lock sync.Mutex
+	var running, max int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		running++
+		if running > max {
+			max = running
+		}
+		lock.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+		w.Write([]byte("app"))
+	}))
+	defer ts.Close()
+
+	// More tasks than download slots start at once
+	limiter := newDownloadLimiter(2)
+	var runners []*TaskRunner
+	for i := 0; i < 5; i++ {
+		_, tr := testMockTaskRunner(map[string]string{"run_for": "10ms"})
+		defer tr.ctx.AllocDir.Destroy()
+		tr.config.DownloadLimiter = limiter
+		tr.task.Artifacts = []*structs.TaskArtifact{
+			&structs.TaskArtifact{Source: ts.URL + "/app"},
+		}
+		runners = append(runners, tr)
+	}
+	for _, tr := range runners {
+		go tr.Run()
+		defer tr.Destroy()
+	}
+
+	var queued int
+	for _, tr := range runners {
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+		if !tr.completed {
+			t.Fatalf("task failed: %#v", tr.Events())
+		}
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskDownloadQueued {
+				queued++
+			}
+		}
+	}
+
+	if max > 2 {
+		t.Fatalf("bad: %d downloads ran at once", max)
+	}
+	if queued == 0 {
+		t.Fatalf("no task waited for a download slot")
+	}
+}
+
+func TestTaskRunner_Artifacts_DownloadQueued_Destroy(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Artifacts = []*structs.TaskArtifact{
+		&structs.TaskArtifact{Source: "http://127.0.0.1:0/app"},
+	}
+
+	// Every download slot is taken
+	limiter := newDownloadLimiter(1)
+	limiter.TryAcquire()
+	tr.config.DownloadLimiter = limiter
+	go tr.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskDownloadQueued {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("task not waiting for a download slot: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The destroyed task abandons its queued download
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+	if tr.getHandle() != nil {
+		t.Fatalf("task should not have been started")
+	}
+	if limiter.TryAcquire() {
+		t.Fatalf("destroyed task took a download slot")
+	}
+}
+
+func TestTaskRunner_StartLimit(t *testing.T) {
+	mockStarts.Lock()
+	mockStarts.max = 0
+	mockStarts.Unlock()
+
+	// More tasks than start slots are started at once
+	limiter := newStartLimiter(2)
+	var runners []*TaskRunner
+	for i := 0; i < 6; i++ {
+		_, tr := testMockTaskRunner(map[string]string{"start_delay": "50ms", "run_for": "10ms"})
+		defer tr.ctx.AllocDir.Destroy()
+		tr.config.StartLimiter = limiter
+		runners = append(runners, tr)
+	}
+	for _, tr := range runners {
+		go tr.Run()
+		defer tr.Destroy()
+	}
+
+	var queued int
+	for _, tr := range runners {
+		select {
+		case <-tr.WaitCh():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout")
+		}
+		if !tr.completed {
+			t.Fatalf("task failed: %#v", tr.Events())
+		}
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskStartQueued {
+				queued++
+			}
+		}
+	}
+
+	mockStarts.Lock()
+	max := mockStarts.max
+	mockStarts.Unlock()
+	if max > 2 {
+		t.Fatalf("bad: %d tasks started at once", max)
+	}
+	if queued == 0 {
+		t.Fatalf("no task waited for a start slot")
+	}
+}
+
+func TestTaskRunner_StartLimit_Destroy(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Every start slot is taken
+	limiter := newStartLimiter(1)
+	limiter.TryAcquire()
+	tr.config.StartLimiter = limiter
+	go tr.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskStartQueued {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("task not waiting for a start slot: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// The destroyed task is never started
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+	if tr.getHandle() != nil {
+		t.Fatalf("task should not have been started")
+	}
+	if limiter.TryAcquire() {
+		t.Fatalf("destroyed task took a start slot")
+	}
+}
+
+func TestTaskRunner_Start_Cancelled(t *testing.T) {
+	// The start blocks until it is cancelled
+	upd, tr := testMockTaskRunner(map[string]string{"start_delay": "1h"})
+	defer tr.ctx.AllocDir.Destroy()
+	go tr.Run()
+
+	testutil.WaitForResult(func() (bool, error) {
+		mockStarts.Lock()
+		defer mockStarts.Unlock()
+		return mockStarts.running == 1, fmt.Errorf("task not being started")
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Destroying the task cancels the start, rather than waiting for it
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+	events := tr.Events()
+	if last := events[len(events)-1]; last.Type != structs.TaskKilled || last.KillReason != allocStopped.Kind {
+		t.Fatalf("bad: %#v", last)
+	}
+	if tr.getHandle() != nil {
+		t.Fatalf("task should not have been started")
+	}
+}
+
+func TestTaskRunner_Stats(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for": "500ms",
+		"stats":   "10:1024,20:2048",
+	})
+	tr.statsInterval = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// The latest sample should be cached
+	testutil.WaitForResult(func() (bool, error) {
+		usage := tr.Stats()
+		if usage == nil {
+			return false, fmt.Errorf("no stats collected")
+		}
+		if usage.CPUPercent != 20 || usage.MemoryRSS != 2048 {
+			return false, fmt.Errorf("stale stats: %#v", usage)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Collection stops once the task exits
+	if usage := tr.Stats(); usage != nil {
+		t.Fatalf("exited task has stats: %#v", usage)
+	}
+	calls := handle.numStatsCalls()
+	time.Sleep(50 * time.Millisecond)
+	if n := handle.numStatsCalls(); n != calls {
+		t.Fatalf("stats collected after exit: %d calls, then %d", calls, n)
+	}
+}
+
+func TestTaskRunner_MemorySoftLimit(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for": "10s",
+		"stats":   "10:1048576,10:3145728,10:1048576,10:3145728",
+	})
+	tr.task.Resources.MemoryMB = 2
+	tr.task.Resources.MemoryMaxMB = 4
+	tr.statsInterval = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// Each time the usage grows past the soft limit is recorded once
+	breaches := func() []*structs.TaskEvent {
+		var events []*structs.TaskEvent
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskMemorySoftLimitExceeded {
+				events = append(events, e)
+			}
+		}
+		return events
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		if n := len(breaches()); n != 2 {
+			return false, fmt.Errorf("got %d breach events; want 2", n)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	events := breaches()
+	if len(events) != 2 {
+		t.Fatalf("bad: %d breach events", len(events))
+	}
+	if !strings.Contains(events[0].Message, "uses 3 MB of memory, exceeding its soft limit of 2 MB") {
+		t.Fatalf("bad: %s", events[0].Message)
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusRunning {
+		t.Fatalf("bad: %s", status)
+	}
+}
+
+func TestTaskRunner_DiskQuota(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10s",
+		"write_local": strconv.Itoa(2 * bytesPerMB),
+	})
+	tr.task.Resources.DiskMB = 1
+	tr.diskQuotaInterval = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	// The breach is recorded once while the task keeps running
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskDiskQuotaExceeded {
+				return true, nil
+			}
+		}
+		return false, fmt.Errorf("no breach event: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	time.Sleep(50 * time.Millisecond)
+
+	var breaches []*structs.TaskEvent
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskDiskQuotaExceeded {
+			breaches = append(breaches, e)
+		}
+	}
+	if len(breaches) != 1 {
+		t.Fatalf("bad: %d breach events", len(breaches))
+	}
+	if !strings.Contains(breaches[0].Message, "uses 2 MB, exceeding the disk quota of 1 MB") {
+		t.Fatalf("bad: %s", breaches[0].Message)
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusRunning {
+		t.Fatalf("bad: %s", status)
+	}
+}
+
+func TestTaskRunner_DiskQuota_Kill(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":     "10s",
+		"write_local": strconv.Itoa(2 * bytesPerMB),
+	})
+	tr.config.DiskQuotaKill = true
+	tr.task.Resources.DiskMB = 1
+	tr.diskQuotaInterval = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task is killed and failed rather than restarted
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusFailed {
+		t.Fatalf("bad: %s", status)
+	}
+	if !strings.Contains(desc, "exceeding the disk quota of 1 MB") {
+		t.Fatalf("bad: %s", desc)
+	}
+	events := tr.Events()
+	if last := events[len(events)-1]; last.KillReason != structs.TaskKillReasonDiskQuota {
+		t.Fatalf("bad: %#v", last)
+	}
+}
+
+// deadlineEvents returns the deadline exceeded events of the task
+func deadlineEvents(tr *TaskRunner) []*structs.TaskEvent {
+	var events []*structs.TaskEvent
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskDeadlineExceeded {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+func TestTaskRunner_MaxRuntime(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.MaxRuntime = 100 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task is killed and stopped without counting as a failure
+	events := deadlineEvents(tr)
+	if len(events) != 1 || !strings.Contains(events[0].Message, "exceeded its max runtime of 100ms") {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusDead || !strings.Contains(desc, "killed for exceeding the max runtime of 100ms") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+	if exit := upd.lastExit(); exit == nil || exit.KillReason != structs.TaskKillReasonDeadline {
+		t.Fatalf("bad: %#v", exit)
+	}
+	if tr.restartTracker.count != 0 {
+		t.Fatalf("bad: %d", tr.restartTracker.count)
+	}
+}
+
+func TestTaskRunner_MaxRuntime_Finished(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10ms"})
+	tr.task.MaxRuntime = 200 * time.Millisecond
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// The task completed before its deadline, which never fires
+	time.Sleep(300 * time.Millisecond)
+	if events := deadlineEvents(tr); len(events) != 0 {
+		t.Fatalf("bad: %#v", events)
+	}
+	if exit := upd.lastExit(); exit == nil || exit.Reason != structs.TaskExitCompleted {
+		t.Fatalf("bad: %#v", exit)
+	}
+}
+
+func TestTaskRunner_MaxRuntime_Failure(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.MaxRuntime = 50 * time.Millisecond
+	tr.task.MaxRuntimeFailure = true
+	tr.task.RestartPolicy = &structs.RestartPolicy{
+		Attempts: 1,
+		Interval: time.Minute,
+		Delay:    10 * time.Millisecond,
+		Mode:     structs.RestartPolicyModeFail,
+	}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	// Each run exceeded the deadline, using up the restart attempts
+	if events := deadlineEvents(tr); len(events) != 2 {
+		t.Fatalf("bad: %#v", tr.Events())
+	}
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusFailed || !strings.Contains(desc, "exhausted 1 restart attempts") {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+}
+
+func TestTaskRunner_Stats_Unsupported(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":           "10s",
+		"stats_unsupported": "1",
+	})
+	tr.statsInterval = 10 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	// The driver is not polled again once it reports stats as unsupported
+	time.Sleep(50 * time.Millisecond)
+	if n := handle.numStatsCalls(); n != 1 {
+		t.Fatalf("stats polled %d times", n)
+	}
+	if usage := tr.Stats(); usage != nil {
+		t.Fatalf("unexpected stats: %#v", usage)
+	}
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+}
+
+func TestTaskRunner_Signal(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	for _, name := range []string{"SIGHUP", "int", "SigTerm"} {
+		if err := tr.Signal(name); err != nil {
+			t.Fatalf("Signal(%q) failed: %v", name, err)
+		}
+	}
+	if err := tr.Signal("SIGBOGUS"); err == nil {
+		t.Fatalf("unknown signal should fail")
+	}
+
+	exp := []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+	if act := handle.receivedSignals(); !reflect.DeepEqual(act, exp) {
+		t.Fatalf("received signals %v; want %v", act, exp)
+	}
+
+	// A signal to an exited task fails rather than blocking
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if err := tr.Signal("SIGHUP"); err == nil {
+		t.Fatalf("signal to an exited task should fail")
+	}
+}
+
+func TestTaskRunner_Signal_Unsupported(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":            "10s",
+		"signal_unsupported": "1",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	if err := tr.Signal("SIGHUP"); !driver.IsNotSupported(err) {
+		t.Fatalf("expected a not supported error; got %v", err)
+	}
+}
+
+func TestTaskRunner_Exec(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":        "10s",
+		"exec_exit_code": "3",
+	})
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	out, code, err := tr.Exec([]string{"cat", "/etc/hosts"}, time.Second)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(out) != "cat /etc/hosts" || code != 3 {
+		t.Fatalf("bad: %q %d", out, code)
+	}
+	if _, _, err := tr.Exec(nil, time.Second); err == nil {
+		t.Fatalf("empty command should fail")
+	}
+
+	// Exec into an exited task fails rather than blocking
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if _, _, err := tr.Exec([]string{"ls"}, time.Second); err == nil {
+		t.Fatalf("exec into an exited task should fail")
+	}
+}
+
+func TestTaskRunner_Exec_Unsupported(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":          "10s",
+		"exec_unsupported": "1",
+	})
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	if _, _, err := tr.Exec([]string{"ls"}, time.Second); !driver.IsNotSupported(err) {
+		t.Fatalf("expected a not supported error; got %v", err)
+	}
+}
+
+func TestTaskRunner_Secrets(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Secrets = map[string]string{"token": "s3cr3t-value"}
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+
+	// The secrets are written before the task is started and the task is
+	// told where to find them
+	secrets := tr.ctx.AllocDir.SecretsDir(tr.getTask().Name)
+	data, err := ioutil.ReadFile(filepath.Join(secrets, "token"))
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if string(data) != "s3cr3t-value" {
+		t.Fatalf("bad secret: %q", data)
+	}
+	if env := tr.ctx.TaskEnv(tr.getTask().Name); env["NOMAD_SECRETS_DIR"] != secrets {
+		t.Fatalf("bad NOMAD_SECRETS_DIR: %q", env["NOMAD_SECRETS_DIR"])
+	}
+
+	// They are never persisted with the state of the task
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	state, err := ioutil.ReadFile(tr.stateFilePath())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if strings.Contains(string(state), "s3cr3t-value") {
+		t.Fatalf("secret persisted in task state: %s", state)
+	}
+	if tr.getTask().Secrets["token"] != "s3cr3t-value" {
+		t.Fatalf("secrets removed from the task: %v", tr.getTask().Secrets)
+	}
+
+	// And removed once the task is destroyed
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if _, err := os.Stat(filepath.Join(secrets, "token")); !os.IsNotExist(err) {
+		t.Fatalf("secret not removed: %v", err)
+	}
+}
+
+func TestTaskRunner_Secrets_Tmpfs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("secrets are only memory backed on Linux")
+	}
+	ctestutil.MountCompatible(t)
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.Secrets = map[string]string{"token": "s3cr3t-value"}
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+	secrets := tr.ctx.AllocDir.SecretsDir(tr.getTask().Name)
+	if !isTmpfs(t, secrets) {
+		t.Fatalf("%s is not a tmpfs", secrets)
+	}
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if isTmpfs(t, secrets) {
+		t.Fatalf("%s still mounted after destroy", secrets)
+	}
+}
+
+func TestTaskRunner_Secrets_RestoreFailed(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("secrets are only memory backed on Linux")
+	}
+	ctestutil.MountCompatible(t)
+
+	_, tr := testMockTaskRunner(map[string]string{
+		"run_for":  "10s",
+		"open_err": "task is gone",
+	})
+	tr.task.Secrets = map[string]string{"token": "s3cr3t-value"}
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if err := tr.SaveState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A restored task whose handle can't be reopened unmounts its secrets
+	upd2 := &MockTaskStateUpdater{}
+	tr2 := NewTaskRunner(tr.logger, tr.config, upd2.Update, tr.ctx, tr.allocID,
+		&structs.Task{Name: tr.getTask().Name})
+	if err := tr2.RestoreState(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	go tr2.Run()
+	select {
+	case <-tr2.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if secrets := tr.ctx.AllocDir.SecretsDir(tr.getTask().Name); isTmpfs(t, secrets) {
+		t.Fatalf("%s still mounted after failed restore", secrets)
+	}
+}
+
+// isTmpfs returns whether a tmpfs is mounted at the path
+func isTmpfs(t *testing.T, path string) bool {
+	data, err := ioutil.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[4] != path {
+			continue
+		}
+		for i, f := range fields {
+			if f == "-" && i+1 < len(fields) && fields[i+1] == "tmpfs" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestTaskRunner_Restart(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.RestartPolicy = &structs.RestartPolicy{Attempts: 0, Interval: time.Minute}
+	tr.restartTracker = newRestartTracker(tr.task.RestartPolicy, tr.clock)
+	go tr.Run()
+	defer tr.Destroy()
+	defer tr.ctx.AllocDir.Destroy()
+
+	waitDescription(t, upd, "task started")
+	first := tr.getHandle()
+
+	// Repeated requests result in a single restart
+	for i := 0; i < 3; i++ {
+		if err := tr.Restart("config changed"); err != nil {
+			t.Fatalf("err: %v", err)
+		}
+	}
+	testutil.WaitForResult(func() (bool, error) {
+		if started := countEvents(tr, structs.TaskStarted); started != 2 {
+			return false, fmt.Errorf("started %d times", started)
+		}
+		return true, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	if tr.getHandle() == first {
+		t.Fatalf("expected a new handle")
+	}
+	if n := countEvents(tr, structs.TaskRestarting); n != 1 {
+		t.Fatalf("expected 1 restart: %#v", tr.Events())
+	}
+	waitDescription(t, upd, "config changed")
+
+	// Manual restarts don't use up the restart policy
+	if tr.restartTracker.count != 0 {
+		t.Fatalf("bad: %d", tr.restartTracker.count)
+	}
+	if status, desc := upd.lastStatus(); status != structs.AllocClientStatusRunning {
+		t.Fatalf("bad: %s %s", status, desc)
+	}
+
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if err := tr.Restart(""); err == nil {
+		t.Fatalf("expected error restarting a dead task")
+	}
+}
+
+// countEvents returns how many events of the given type the task recorded
+func countEvents(tr *TaskRunner, eventType string) int {
+	n := 0
+	for _, event := range tr.Events() {
+		if event.Type == eventType {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTaskRunner_ShutdownDelay(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.ShutdownDelay = 200 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	start := time.Now()
+	tr.Destroy()
+	waitDescription(t, upd, "waiting 200ms before killing the task")
+	time.Sleep(50 * time.Millisecond)
+	if killed := handle.killTime(); !killed.IsZero() {
+		t.Fatalf("task killed during the shutdown delay")
+	}
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	killed := handle.killTime()
+	if killed.IsZero() || killed.Sub(start) < tr.getTask().ShutdownDelay {
+		t.Fatalf("task killed %v after destroy, before the shutdown delay", killed.Sub(start))
+	}
+
+	var draining bool
+	for _, e := range tr.Events() {
+		draining = draining || e.Type == structs.TaskDraining
+	}
+	if !draining {
+		t.Fatalf("no draining event: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_ShutdownDelay_ForceDestroy(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.ShutdownDelay = time.Minute
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+
+	// Destroying again doesn't interrupt the delay, forcing it does
+	tr.Destroy()
+	waitDescription(t, upd, "waiting 1m0s before killing the task")
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+		t.Fatalf("shutdown delay interrupted")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tr.ForceDestroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if status, _ := upd.lastStatus(); status != structs.AllocClientStatusDead {
+		t.Fatalf("bad: %s", status)
+	}
+}
+
+func TestTaskRunner_KillSignal(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	tr.task.KillSignal = "SIGINT"
+	tr.task.KillTimeout = 200 * time.Millisecond
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	start := time.Now()
+	tr.Destroy()
+
+	// The kill signal is sent first and the task is only force killed once
+	// the kill timeout has passed
+	testutil.WaitForResult(func() (bool, error) {
+		return len(handle.receivedSignals()) == 1, nil
+	}, func(err error) {
+		t.Fatalf("kill signal not sent")
+	})
+	select {
+	case <-tr.WaitCh():
+		t.Fatalf("task force killed before the kill timeout")
+	case <-time.After(100 * time.Millisecond):
+	}
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if time.Since(start) < tr.getTask().KillTimeout {
+		t.Fatalf("task should have been given the kill timeout to exit")
+	}
+
+	if act := handle.receivedSignals(); !reflect.DeepEqual(act, []os.Signal{syscall.SIGINT}) {
+		t.Fatalf("received signals %v; want SIGINT", act)
+	}
+	if !handle.killTime().IsZero() {
+		t.Fatalf("driver kill should not be used with a kill signal")
+	}
+	if !strings.Contains(strings.Join(upd.Description, "\n"), "task did not exit within kill timeout") {
+		t.Fatalf("bad: %#v", upd.Description)
+	}
+	for _, e := range tr.Events() {
+		if e.Type == structs.TaskKilling && e.Signal == int(syscall.SIGINT) {
+			return
+		}
+	}
+	t.Fatalf("killing event without signal: %#v", tr.Events())
+}
+
+func TestTaskRunner_KillSignal_Unsupported(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{
+		"run_for":            "10s",
+		"signal_unsupported": "true",
+	})
+	tr.task.KillSignal = "SIGQUIT"
+	go tr.Run()
+	defer tr.ctx.AllocDir.Destroy()
+
+	testutil.WaitForResult(func() (bool, error) {
+		status, _ := upd.lastStatus()
+		return status == structs.AllocClientStatusRunning, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	// A driver that can't send signals is stopped with its kill
+	tr.Destroy()
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if handle.killTime().IsZero() {
+		t.Fatalf("driver kill should be used")
+	}
 }
-*/
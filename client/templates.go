@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/hashicorp/nomad/client/allocdir"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// renderTemplate renders the template with the environment of the task. The
+// variables are available as fields, e.g. {{.NOMAD_ALLOC_ID}}, and through
+// the env function, e.g. {{env "NOMAD_ALLOC_ID"}}. Referencing a variable
+// that is not set is an error. The key function, e.g. {{key "app/port"}},
+// inserts the value of a key of the KV store read by keys, which may be nil
+// if there is no store.
+func renderTemplate(tmpl *structs.Template, env map[string]string, keys func(string) (string, error)) ([]byte, error) {
+	funcs := template.FuncMap{
+		"env": func(key string) (string, error) {
+			v, ok := env[key]
+			if !ok {
+				return "", fmt.Errorf("environment variable '%s' is not set", key)
+			}
+			return v, nil
+		},
+		"key": func(key string) (string, error) {
+			if keys == nil {
+				return "", fmt.Errorf("no key/value store to read key '%s' from", key)
+			}
+			return keys(key)
+		},
+	}
+
+	t, err := template.New(tmpl.DestPath).Funcs(funcs).Option("missingkey=error").Parse(tmpl.EmbeddedTmpl)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, env); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// templateDest returns the path on the host a template of the task is
+// rendered to. The destination is relative to the task directory and must
+// stay within the alloc dir, including after resolving symlinks.
+func templateDest(allocDir *allocdir.AllocDir, taskName, dest string) (string, error) {
+	taskDir, ok := allocDir.TaskDirs[taskName]
+	if !ok {
+		return "", fmt.Errorf("task directory doesn't exist for task %v", taskName)
+	}
+	if filepath.IsAbs(dest) {
+		return "", fmt.Errorf("destination '%s' must be relative to the task directory", dest)
+	}
+
+	path := filepath.Join(taskDir, dest)
+	if !withinDir(allocDir.AllocDir, path) {
+		return "", fmt.Errorf("destination '%s' escapes the alloc dir", dest)
+	}
+
+	// Make sure no symlink along the path leads out of the alloc dir
+	root, err := filepath.EvalSymlinks(allocDir.AllocDir)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := evalExistingSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, resolved) {
+		return "", fmt.Errorf("destination '%s' escapes the alloc dir", dest)
+	}
+	return path, nil
+}
+
+// evalExistingSymlinks resolves the symlinks of the longest existing prefix
+// of the path and appends the remainder.
+func evalExistingSymlinks(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return resolved, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolved, err = evalExistingSymlinks(parent)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(resolved, filepath.Base(path)), nil
+}
+
+// withinDir returns if the path is the directory or inside of it.
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// renderTemplates renders the templates of the task and writes the outputs
+// that differ from the existing files. It returns the templates whose file
+// was written.
+func (r *TaskRunner) renderTemplates(env map[string]string) ([]*structs.Template, error) {
+	var changed []*structs.Template
+	for _, tmpl := range r.task.Templates {
+		dest, err := templateDest(r.ctx.AllocDir, r.task.Name, tmpl.DestPath)
+		if err != nil {
+			return changed, fmt.Errorf("invalid template destination: %v", err)
+		}
+
+		out, err := renderTemplate(tmpl, env, r.templateKeys.get)
+		if err != nil {
+			return changed, fmt.Errorf("failed to render template '%s': %v", tmpl.DestPath, err)
+		}
+
+		if existing, err := ioutil.ReadFile(dest); err == nil && bytes.Equal(existing, out) {
+			continue
+		}
+
+		if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+			return changed, fmt.Errorf("failed to create template directory: %v", err)
+		}
+		if err := ioutil.WriteFile(dest, out, 0666); err != nil {
+			return changed, fmt.Errorf("failed to write template '%s': %v", tmpl.DestPath, err)
+		}
+		changed = append(changed, tmpl)
+	}
+	return changed, nil
+}
@@ -0,0 +1,273 @@
+package client
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/nomad/structs"
+	"github.com/hashicorp/nomad/testutil"
+)
+
+func TestRenderTemplate(t *testing.T) {
+	env := map[string]string{"NOMAD_ALLOC_ID": "123", "PORT": "80"}
+	tmpl := &structs.Template{
+		EmbeddedTmpl: `id={{.NOMAD_ALLOC_ID}} port={{env "PORT"}}`,
+		DestPath:     "local/app.conf",
+	}
+
+	out, err := renderTemplate(tmpl, env, nil)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if exp := "id=123 port=80"; string(out) != exp {
+		t.Fatalf("got %q; want %q", out, exp)
+	}
+
+	// Missing variables are an error however they are referenced
+	for _, data := range []string{"{{.MISSING}}", `{{env "MISSING"}}`} {
+		tmpl.EmbeddedTmpl = data
+		if _, err := renderTemplate(tmpl, env, nil); err == nil || !strings.Contains(err.Error(), "MISSING") {
+			t.Fatalf("expected error for %s: %v", data, err)
+		}
+	}
+}
+
+func TestTemplateDest(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{})
+	defer tr.ctx.AllocDir.Destroy()
+	taskDir := tr.ctx.AllocDir.TaskDirs[tr.task.Name]
+
+	// A symlink pointing out of the alloc dir
+	outside, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer os.RemoveAll(outside)
+	if err := os.Symlink(outside, filepath.Join(taskDir, "link")); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	cases := map[string]string{
+		"local/app.conf":       filepath.Join(taskDir, "local", "app.conf"),
+		"new/dir/app.conf":     filepath.Join(taskDir, "new", "dir", "app.conf"),
+		"../alloc/shared.conf": filepath.Join(tr.ctx.AllocDir.SharedDir, "shared.conf"),
+		"../../escape":         "",
+		"local/../../../foo":   "",
+		"/etc/passwd":          "",
+		"link/app.conf":        "",
+	}
+	for dest, exp := range cases {
+		act, err := templateDest(tr.ctx.AllocDir, tr.task.Name, dest)
+		if exp == "" {
+			if err == nil {
+				t.Fatalf("expected error for %s, got %s", dest, act)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", dest, err)
+		}
+		if act != exp {
+			t.Fatalf("%s: got %s; want %s", dest, act, exp)
+		}
+	}
+}
+
+func TestTaskRunner_Templates_Render(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: "{{.NOMAD_ALLOC_ID}}",
+			DestPath:     "local/id",
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+
+	path := filepath.Join(tr.ctx.AllocDir.TaskDirs[tr.getTask().Name], "local", "id")
+	testutil.WaitForResult(func() (bool, error) {
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		return string(out) == tr.allocID, fmt.Errorf("got %q", out)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestTaskRunner_Templates_MissingVariable(t *testing.T) {
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: "{{.NOT_SET}}",
+			DestPath:     "local/app.conf",
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+
+	select {
+	case <-tr.WaitCh():
+	case <-time.After(2 * time.Second):
+		t.Fatalf("timeout")
+	}
+
+	status, desc := upd.lastStatus()
+	if status != structs.AllocClientStatusFailed {
+		t.Fatalf("bad: %s", status)
+	}
+	if !strings.Contains(desc, "local/app.conf") || !strings.Contains(desc, "NOT_SET") {
+		t.Fatalf("bad: %s", desc)
+	}
+}
+
+func TestTaskRunner_Templates_Update(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Env = map[string]string{"VERSION": "1"}
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: "version={{.VERSION}}",
+			DestPath:     "local/app.conf",
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	// An update that doesn't change the output doesn't signal the task
+	update := new(structs.Task)
+	*update = *tr.getTask()
+	update.Meta = map[string]string{"foo": "bar"}
+	tr.Update(update)
+	time.Sleep(100 * time.Millisecond)
+	if sigs := handle.receivedSignals(); len(sigs) != 0 {
+		t.Fatalf("unexpected signals: %v", sigs)
+	}
+
+	// Changing the inputs re-renders and sends SIGHUP once
+	update = new(structs.Task)
+	*update = *tr.getTask()
+	update.Env = map[string]string{"VERSION": "2"}
+	tr.Update(update)
+
+	path := filepath.Join(tr.ctx.AllocDir.TaskDirs[tr.getTask().Name], "local", "app.conf")
+	testutil.WaitForResult(func() (bool, error) {
+		out, err := ioutil.ReadFile(path)
+		if err != nil {
+			return false, err
+		}
+		if string(out) != "version=2" {
+			return false, fmt.Errorf("got %q", out)
+		}
+		sigs := handle.receivedSignals()
+		return reflect.DeepEqual(sigs, []os.Signal{syscall.SIGHUP}), fmt.Errorf("got signals %v", sigs)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
+
+func TestTaskRunner_Templates_Update_ChangeSignal(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Env = map[string]string{"VERSION": "1"}
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: "version={{.VERSION}}",
+			DestPath:     "local/app.conf",
+			ChangeSignal: "SIGINT",
+		},
+		&structs.Template{
+			EmbeddedTmpl: "{{.VERSION}}",
+			DestPath:     "local/version",
+			ChangeSignal: "SIGINT",
+		},
+		&structs.Template{
+			EmbeddedTmpl: "{{.VERSION}}",
+			DestPath:     "local/ignored",
+			ChangeMode:   structs.TemplateChangeModeNoop,
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+	handle := tr.getHandle().(*mockHandle)
+
+	// Both templates asking for the signal changing sends it exactly once
+	update := new(structs.Task)
+	*update = *tr.getTask()
+	update.Env = map[string]string{"VERSION": "2"}
+	tr.Update(update)
+	testutil.WaitForResult(func() (bool, error) {
+		sigs := handle.receivedSignals()
+		return reflect.DeepEqual(sigs, []os.Signal{syscall.SIGINT}), fmt.Errorf("got signals %v", sigs)
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+	time.Sleep(100 * time.Millisecond)
+	if sigs := handle.receivedSignals(); len(sigs) != 1 {
+		t.Fatalf("got signals %v", sigs)
+	}
+	if n := countEvents(tr, structs.TaskRestarting); n != 0 {
+		t.Fatalf("task restarted: %#v", tr.Events())
+	}
+}
+
+func TestTaskRunner_Templates_Update_SignalUnsupported(t *testing.T) {
+	_, tr := testMockTaskRunner(map[string]string{"run_for": "10s", "signal_unsupported": "1"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.task.Env = map[string]string{"VERSION": "1"}
+	tr.task.Templates = []*structs.Template{
+		&structs.Template{
+			EmbeddedTmpl: "version={{.VERSION}}",
+			DestPath:     "local/app.conf",
+		},
+	}
+
+	go tr.Run()
+	defer tr.Destroy()
+	testutil.WaitForResult(func() (bool, error) {
+		return tr.getHandle() != nil, nil
+	}, func(err error) {
+		t.Fatalf("task not started")
+	})
+
+	// The task can't be signaled, so it is restarted to pick up the change
+	update := new(structs.Task)
+	*update = *tr.getTask()
+	update.Env = map[string]string{"VERSION": "2"}
+	tr.Update(update)
+	testutil.WaitForResult(func() (bool, error) {
+		for _, e := range tr.Events() {
+			if e.Type == structs.TaskRestarting && e.Message == "templates changed" {
+				return countEvents(tr, structs.TaskStarted) == 2, fmt.Errorf("task not started again")
+			}
+		}
+		return false, fmt.Errorf("task not restarted: %#v", tr.Events())
+	}, func(err error) {
+		t.Fatalf("err: %v", err)
+	})
+}
@@ -27,3 +27,9 @@ func MountCompatible(t *testing.T) {
 		t.Skip("Must be root to run test")
 	}
 }
+
+func RktCompatible(t *testing.T) {
+	if runtime.GOOS != "linux" || syscall.Geteuid() != 0 {
+		t.Skip("Must be root on linux to run test")
+	}
+}
@@ -1,17 +1,42 @@
 package client
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
 	"time"
 
+	"github.com/hashicorp/go-msgpack/codec"
+	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
 
+var (
+	// stateMagic starts every state file with a header. Files without it
+	// are plain JSON written by older clients.
+	stateMagic = []byte("NOMADSTATE")
+
+	// stateMsgpackHandle is used to encode msgpack state files
+	stateMsgpackHandle = &codec.MsgpackHandle{}
+)
+
+const (
+	// stateVersion is the version of the state file header
+	stateVersion = 1
+
+	// These identify the encoding of the body in the state file header
+	stateEncodingJSON    byte = 1
+	stateEncodingMsgpack byte = 2
+)
+
 type allocTuple struct {
 	exist, updated *structs.Allocation
 }
@@ -87,22 +112,171 @@ func shuffleStrings(list []string) {
 	}
 }
 
-// persistState is used to help with saving state
-func persistState(path string, data interface{}) error {
-	buf, err := json.Marshal(data)
+// portInUse returns whether the TCP port is already bound on the host. A port
+// we are not permitted to bind is not considered in use, as only the driver
+// can tell whether the task may bind it.
+func portInUse(port int) bool {
+	return addrInUse("", port)
+}
+
+// addrInUse returns whether the TCP port is already bound on the IP, or on
+// any address if the IP is empty, following the rules of portInUse. Nothing
+// can be bound on an IP that is not an address of the host.
+func addrInUse(ip string, port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
+	if err == nil {
+		l.Close()
+		return false
+	}
+	if opErr, ok := err.(*net.OpError); ok {
+		if os.IsPermission(opErr.Err) {
+			return false
+		}
+		if sysErr, ok := opErr.Err.(*os.SyscallError); ok && sysErr.Err == syscall.EADDRNOTAVAIL {
+			return false
+		}
+	}
+	return true
+}
+
+// escapeFileName is used to make a name safe to use as a file name while
+// keeping it readable. Every byte other than letters, digits, '-', '_' and
+// '.' is percent-encoded, so distinct names always map to distinct files.
+func escapeFileName(name string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.':
+			buf.WriteByte(c)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", c)
+		}
+	}
+	return buf.String()
+}
+
+// encodeState returns the state file contents for data: a header made of
+// the magic, the version and the encoding, followed by the encoded data.
+func encodeState(format string, data interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(stateMagic)
+	buf.WriteByte(stateVersion)
+
+	switch format {
+	case "", config.StateFormatMsgpack:
+		buf.WriteByte(stateEncodingMsgpack)
+		if err := codec.NewEncoder(&buf, stateMsgpackHandle).Encode(data); err != nil {
+			return nil, err
+		}
+	case config.StateFormatJSON:
+		buf.WriteByte(stateEncodingJSON)
+		if err := json.NewEncoder(&buf).Encode(data); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown state format %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeState decodes state file contents written by encodeState, or plain
+// JSON if the header is missing
+func decodeState(buf []byte, data interface{}) error {
+	if !bytes.HasPrefix(buf, stateMagic) {
+		return json.Unmarshal(buf, data)
+	}
+	buf = buf[len(stateMagic):]
+	if len(buf) < 2 {
+		return fmt.Errorf("truncated state header")
+	}
+	if buf[0] != stateVersion {
+		return fmt.Errorf("unsupported state version %d", buf[0])
+	}
+
+	switch body := buf[2:]; buf[1] {
+	case stateEncodingMsgpack:
+		return codec.NewDecoder(bytes.NewReader(body), stateMsgpackHandle).Decode(data)
+	case stateEncodingJSON:
+		return json.Unmarshal(body, data)
+	default:
+		return fmt.Errorf("unknown state encoding %d", buf[1])
+	}
+}
+
+// persistState is used to help with saving state in the given format. The
+// state is written to a temporary file which is then renamed over the
+// destination, so a crash mid-write never leaves a partially written state
+// file behind.
+func persistState(path, format string, data interface{}) error {
+	buf, err := encodeState(format, data)
 	if err != nil {
 		return fmt.Errorf("failed to encode state: %v", err)
 	}
-	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+	return writeState(path, buf)
+}
+
+// writeState atomically replaces the state file at path with the contents
+// returned by encodeState
+func writeState(path string, buf []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("failed to make dirs for %s: %v", path, err)
 	}
-	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+
+	// Write and sync the new state to a temporary file in the same
+	// directory, which is required for the rename to be atomic
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %v", err)
+	}
+	tmpPath := tmp.Name()
+	if _, err := tmp.Write(buf); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
 		return fmt.Errorf("failed to save state: %v", err)
 	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	// Swap the new state into place
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save state: %v", err)
+	}
+
+	// Sync the directory so the rename itself is durable
+	if err := syncDir(dir); err != nil {
+		return fmt.Errorf("failed to sync state dir: %v", err)
+	}
 	return nil
 }
 
-// restoreState is used to read back in the persisted state
+// syncDir is used to flush the entries of a directory to disk
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	// Syncing a directory is not supported on all platforms
+	if err := d.Sync(); err != nil && runtime.GOOS != "windows" {
+		return err
+	}
+	return nil
+}
+
+// restoreState is used to read back in the persisted state. The format is
+// detected from the file, so state written in any format is restored.
 func restoreState(path string, data interface{}) error {
 	buf, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -111,8 +285,28 @@ func restoreState(path string, data interface{}) error {
 		}
 		return fmt.Errorf("failed to read state: %v", err)
 	}
-	if err := json.Unmarshal(buf, data); err != nil {
-		return fmt.Errorf("failed to decode state: %v", err)
+	if err := decodeState(buf, data); err != nil {
+		return &corruptStateError{err: err}
 	}
 	return nil
 }
+
+// corruptStateError is returned by restoreState if the state file exists but
+// could not be decoded
+type corruptStateError struct {
+	err error
+}
+
+func (e *corruptStateError) Error() string {
+	return fmt.Sprintf("failed to decode state: %v", e.err)
+}
+
+// quarantineState moves a corrupt state file out of the way so it can be
+// inspected later, and returns its new path
+func quarantineState(path string) (string, error) {
+	dst := fmt.Sprintf("%s.corrupt.%d", path, time.Now().Unix())
+	if err := os.Rename(path, dst); err != nil {
+		return "", fmt.Errorf("failed to quarantine corrupt state: %v", err)
+	}
+	return dst, nil
+}
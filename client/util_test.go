@@ -1,13 +1,16 @@
 package client
 
 import (
+	"encoding/json"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/nomad/client/config"
 	"github.com/hashicorp/nomad/nomad/mock"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -81,6 +84,23 @@ func TestShuffleStrings(t *testing.T) {
 	}
 }
 
+func TestEscapeFileName(t *testing.T) {
+	cases := map[string]string{
+		"web":         "web",
+		"web-1.2_foo": "web-1.2_foo",
+		"a/b":         "a%2Fb",
+		"../etc":      "..%2Fetc",
+		"my task":     "my%20task",
+		"caf\u00e9":   "caf%C3%A9",
+		"a%2Fb":       "a%252Fb",
+	}
+	for in, exp := range cases {
+		if act := escapeFileName(in); act != exp {
+			t.Fatalf("escapeFileName(%q) = %q; want %q", in, act, exp)
+		}
+	}
+}
+
 func TestPersistRestoreState(t *testing.T) {
 	dir, err := ioutil.TempDir("", "nomad")
 	if err != nil {
@@ -88,10 +108,6 @@ func TestPersistRestoreState(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 
-	// Use a state path inside a non-existent directory. This
-	// verifies that the directory is created properly.
-	statePath := filepath.Join(dir, "subdir", "test-persist")
-
 	type stateTest struct {
 		Foo int
 		Bar string
@@ -103,18 +119,177 @@ func TestPersistRestoreState(t *testing.T) {
 		Baz: true,
 	}
 
-	err = persistState(statePath, &state)
+	for _, format := range []string{"", config.StateFormatMsgpack, config.StateFormatJSON} {
+		// Use a state path inside a non-existent directory. This
+		// verifies that the directory is created properly.
+		statePath := filepath.Join(dir, "subdir-"+format, "test-persist")
+
+		err = persistState(statePath, format, &state)
+		if err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+
+		var out stateTest
+		err = restoreState(statePath, &out)
+		if err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+
+		if !reflect.DeepEqual(state, out) {
+			t.Fatalf("format %q: bad: %#v %#v", format, state, out)
+		}
+	}
+}
+
+// persistLegacyState writes the state as plain JSON, the way clients did
+// before state files had a header
+func persistLegacyState(t *testing.T, path string, data interface{}) {
+	buf, err := json.Marshal(data)
 	if err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := ioutil.WriteFile(path, buf, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
 
-	var out stateTest
-	err = restoreState(statePath, &out)
+func testTaskRunnerState() *taskRunnerState {
+	task := mock.Alloc().Job.TaskGroups[0].Tasks[0]
+	return &taskRunnerState{
+		Task:         task,
+		HandleID:     "handle",
+		RestartCount: 2,
+		RestartStart: time.Unix(1000, 0).UTC(),
+		Events: []*structs.TaskEvent{
+			structs.NewTaskEvent(structs.TaskStarted).SetMessage("task started"),
+			structs.NewTaskEvent(structs.TaskTerminated).SetExitCode(1).SetSignal(9),
+		},
+	}
+}
+
+func TestPersistRestoreState_TaskRunnerState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
 	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := testTaskRunnerState()
+	for _, format := range []string{config.StateFormatMsgpack, config.StateFormatJSON} {
+		statePath := filepath.Join(dir, format)
+		if err := persistState(statePath, format, state); err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+
+		var out taskRunnerState
+		if err := restoreState(statePath, &out); err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+		if !reflect.DeepEqual(state, &out) {
+			t.Fatalf("format %q: bad: %#v %#v", format, state, &out)
+		}
+	}
+}
+
+func TestRestoreState_Compat(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+	state := testTaskRunnerState()
+
+	// State written by older clients is read back
+	persistLegacyState(t, statePath, state)
+	var out taskRunnerState
+	if err := restoreState(statePath, &out); err != nil {
 		t.Fatalf("err: %v", err)
 	}
+	if !reflect.DeepEqual(state, &out) {
+		t.Fatalf("bad: %#v %#v", state, &out)
+	}
+
+	// Switching formats keeps the existing state readable, and saving it
+	// again writes the new format
+	for _, format := range []string{config.StateFormatMsgpack, config.StateFormatJSON, config.StateFormatMsgpack} {
+		var out taskRunnerState
+		if err := restoreState(statePath, &out); err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+		if !reflect.DeepEqual(state, &out) {
+			t.Fatalf("format %q: bad: %#v %#v", format, state, &out)
+		}
+		if err := persistState(statePath, format, &out); err != nil {
+			t.Fatalf("format %q: err: %v", format, err)
+		}
+	}
 
-	if !reflect.DeepEqual(state, out) {
-		t.Fatalf("bad: %#v %#v", state, out)
+	// Files written by a newer header version are refused rather than
+	// misread
+	buf, err := ioutil.ReadFile(statePath)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	buf[len(stateMagic)] = stateVersion + 1
+	if err := ioutil.WriteFile(statePath, buf, 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if err := restoreState(statePath, &out); err == nil || !strings.Contains(err.Error(), "unsupported state version") {
+		t.Fatalf("expected version error: %v", err)
+	}
+
+	if err := persistState(statePath, "xml", state); err == nil {
+		t.Fatalf("expected unknown format error")
+	}
+}
+
+func TestPersistState_PartialWrite(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nomad")
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	statePath := filepath.Join(dir, "state.json")
+
+	type stateTest struct {
+		Foo int
+	}
+	good := stateTest{Foo: 42}
+	if err := persistState(statePath, "", &good); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Simulate a crash while writing the next state by leaving behind a
+	// truncated temporary file
+	partial := filepath.Join(dir, "state.json.tmp123")
+	if err := ioutil.WriteFile(partial, []byte(`{"Foo": 4`), 0600); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// A failed encode must not touch the existing state either
+	bad := map[string]interface{}{"Foo": make(chan int)}
+	if err := persistState(statePath, "", bad); err == nil {
+		t.Fatalf("expected encode error")
+	}
+
+	var out stateTest
+	if err := restoreState(statePath, &out); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if !reflect.DeepEqual(good, out) {
+		t.Fatalf("bad: %#v %#v", good, out)
+	}
+
+	// Only the state file and the simulated leftover should exist
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("bad: %#v", entries)
 	}
 }
@@ -0,0 +1,206 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+var (
+	// webhookAttempts is the number of times a notification is sent to a
+	// webhook before it is dropped
+	webhookAttempts = 3
+
+	// webhookBackoff is the wait after the first failed delivery, doubling
+	// on each subsequent one
+	webhookBackoff = time.Second
+
+	// webhookTimeout bounds each delivery
+	webhookTimeout = 10 * time.Second
+)
+
+// webhookQueueSize is the number of notifications queued per webhook before
+// new ones are dropped
+const webhookQueueSize = 128
+
+// eventTransitions are the lifecycle transitions of tasks notified when an
+// event of the type is recorded. A task is dead once its runner exits.
+var eventTransitions = map[string]string{
+	structs.TaskStarted:    config.TaskTransitionStarted,
+	structs.TaskHealthy:    config.TaskTransitionHealthy,
+	structs.TaskRestarting: config.TaskTransitionRestarting,
+}
+
+// webhookNotifier delivers the lifecycle transitions of tasks to the webhooks
+// of the client. Each webhook has its own queue and sender, so a slow or
+// failing endpoint doesn't hold up the others and is notified in order.
+type webhookNotifier struct {
+	senders []*webhookSender
+
+	stopCh   chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// webhookSender delivers the queued notifications to one webhook
+type webhookSender struct {
+	url         string
+	transitions map[string]bool
+	queue       chan *config.TaskNotification
+	client      *http.Client
+	logger      *log.Logger
+}
+
+// newWebhookNotifier returns a notifier delivering to the webhooks. Close
+// must be called to stop it.
+func newWebhookNotifier(hooks []*config.TaskWebhook, logger *log.Logger) (*webhookNotifier, error) {
+	n := &webhookNotifier{stopCh: make(chan struct{})}
+	for _, hook := range hooks {
+		u, err := url.Parse(hook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid task webhook URL '%s'", hook.URL)
+		}
+		var transitions map[string]bool
+		for _, t := range hook.Transitions {
+			switch t {
+			case config.TaskTransitionStarted, config.TaskTransitionHealthy,
+				config.TaskTransitionRestarting, config.TaskTransitionDead:
+			default:
+				return nil, fmt.Errorf("unknown transition '%s' for task webhook '%s'", t, hook.URL)
+			}
+			if transitions == nil {
+				transitions = make(map[string]bool)
+			}
+			transitions[t] = true
+		}
+		n.senders = append(n.senders, &webhookSender{
+			url:         hook.URL,
+			transitions: transitions,
+			queue:       make(chan *config.TaskNotification, webhookQueueSize),
+			client:      &http.Client{Timeout: webhookTimeout},
+			logger:      logger,
+		})
+	}
+
+	for _, s := range n.senders {
+		n.wg.Add(1)
+		go func(s *webhookSender) {
+			defer n.wg.Done()
+			s.run(n.stopCh)
+		}(s)
+	}
+	return n, nil
+}
+
+// Notify queues the notification for the webhooks interested in its
+// transition, dropping it for those whose queue is full
+func (n *webhookNotifier) Notify(notification *config.TaskNotification) {
+	for _, s := range n.senders {
+		if s.transitions != nil && !s.transitions[notification.Transition] {
+			continue
+		}
+		select {
+		case s.queue <- notification:
+		default:
+			s.logger.Printf("[WARN] client: dropping '%s' notification of task '%s' for alloc '%s' to webhook '%s': queue full",
+				notification.Transition, notification.Task, notification.AllocID, s.url)
+		}
+	}
+}
+
+// Close stops the senders, dropping the notifications not yet delivered
+func (n *webhookNotifier) Close() {
+	n.stopOnce.Do(func() { close(n.stopCh) })
+	n.wg.Wait()
+}
+
+func (s *webhookSender) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case notification := <-s.queue:
+			s.deliver(notification, stopCh)
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// deliver sends the notification, retrying failures with backoff until the
+// attempts are used up or the notifier is closed
+func (s *webhookSender) deliver(notification *config.TaskNotification, stopCh <-chan struct{}) {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		s.logger.Printf("[ERR] client: failed to encode notification for webhook '%s': %v", s.url, err)
+		return
+	}
+
+	backoff := webhookBackoff
+	for attempt := 1; ; attempt++ {
+		err := s.post(body)
+		if err == nil {
+			return
+		}
+		if attempt >= webhookAttempts {
+			s.logger.Printf("[ERR] client: dropping '%s' notification of task '%s' for alloc '%s' after %d failed deliveries to webhook '%s': %v",
+				notification.Transition, notification.Task, notification.AllocID, attempt, s.url, err)
+			return
+		}
+		s.logger.Printf("[WARN] client: failed to deliver notification to webhook '%s', retrying in %v: %v",
+			s.url, backoff, err)
+
+		select {
+		case <-time.After(backoff):
+		case <-stopCh:
+			return
+		}
+		backoff *= 2
+	}
+}
+
+// post sends the body to the webhook, failing unless it responds with 2xx
+func (s *webhookSender) post(body []byte) error {
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %s", resp.Status)
+	}
+	return nil
+}
+
+// notify tells the notifier of the client, if any, that the task made the
+// transition, recorded with the given event
+func (r *TaskRunner) notify(transition string, event *structs.TaskEvent) {
+	notifier := r.config.TaskNotifier
+	if notifier == nil {
+		return
+	}
+
+	// The event is copied as the notification is encoded concurrently
+	e := *event
+	notifier.Notify(&config.TaskNotification{
+		AllocID:    r.allocID,
+		Task:       r.task.Name,
+		Transition: transition,
+		Event:      &e,
+	})
+}
+
+// notifyDead notifies that the task is dead, with its last event
+func (r *TaskRunner) notifyDead() {
+	events := r.Events()
+	if len(events) == 0 {
+		return
+	}
+	r.notify(config.TaskTransitionDead, events[len(events)-1])
+}
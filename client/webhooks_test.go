@@ -0,0 +1,241 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/nomad/structs"
+)
+
+// testWebhook is a webhook server passing on the notifications it receives.
+// It fails the first failures requests.
+type testWebhook struct {
+	*httptest.Server
+	notifications chan *config.TaskNotification
+
+	lock     sync.Mutex
+	requests int
+	failures int
+}
+
+func newTestWebhook(t *testing.T, failures int) *testWebhook {
+	h := &testWebhook{
+		notifications: make(chan *config.TaskNotification, 16),
+		failures:      failures,
+	}
+	h.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.lock.Lock()
+		h.requests++
+		fail := h.requests <= h.failures
+		h.lock.Unlock()
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if ct := req.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("bad content type: %s", ct)
+		}
+		var n config.TaskNotification
+		if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+			t.Errorf("err: %v", err)
+		}
+		h.notifications <- &n
+	}))
+	return h
+}
+
+func (h *testWebhook) numRequests() int {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.requests
+}
+
+// next returns the next notification the webhook received
+func (h *testWebhook) next(t *testing.T) *config.TaskNotification {
+	select {
+	case n := <-h.notifications:
+		return n
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timeout waiting for notification")
+		return nil
+	}
+}
+
+func TestTaskRunner_Webhooks(t *testing.T) {
+	hook := newTestWebhook(t, 0)
+	defer hook.Close()
+	notifier, err := newWebhookNotifier([]*config.TaskWebhook{{URL: hook.URL}}, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer notifier.Close()
+
+	upd, tr := testMockTaskRunner(map[string]string{"run_for": "10s"})
+	defer tr.ctx.AllocDir.Destroy()
+	tr.config.TaskNotifier = notifier
+	tr.task.Checks = []*structs.TaskCheck{{
+		Name:    "started",
+		Type:    structs.TaskCheckTypeLog,
+		Pattern: "Server started",
+		Timeout: 5 * time.Second,
+	}}
+	w := testLogWriter(t, tr)
+	defer w.Close()
+
+	go tr.Run()
+	defer tr.Destroy()
+	waitDescription(t, upd, "task started")
+	fmt.Fprintln(w, "Server started")
+	waitDescription(t, upd, "task is healthy")
+	if err := tr.Restart("config changed"); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	exp := []struct {
+		transition string
+		event      string
+	}{
+		{config.TaskTransitionStarted, structs.TaskStarted},
+		{config.TaskTransitionHealthy, structs.TaskHealthy},
+		{config.TaskTransitionRestarting, structs.TaskRestarting},
+		{config.TaskTransitionStarted, structs.TaskStarted},
+		{config.TaskTransitionDead, structs.TaskKilled},
+	}
+	for i, e := range exp {
+		// Destroy the task once it runs again
+		if e.transition == config.TaskTransitionDead {
+			tr.Destroy()
+		}
+		n := hook.next(t)
+		if n.AllocID != tr.allocID || n.Task != tr.task.Name {
+			t.Fatalf("bad notification %d: %#v", i, n)
+		}
+		if n.Transition != e.transition || n.Event == nil || n.Event.Type != e.event {
+			t.Fatalf("notification %d is %s (%#v); want %s (%s)", i, n.Transition, n.Event, e.transition, e.event)
+		}
+		if e.transition == config.TaskTransitionDead && n.Event.KillReason != structs.TaskKillReasonStopped {
+			t.Fatalf("bad kill reason: %#v", n.Event)
+		}
+	}
+
+	select {
+	case n := <-hook.notifications:
+		t.Fatalf("unexpected notification: %#v", n)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func TestWebhookNotifier_Transitions(t *testing.T) {
+	hook := newTestWebhook(t, 0)
+	defer hook.Close()
+	notifier, err := newWebhookNotifier([]*config.TaskWebhook{{
+		URL:         hook.URL,
+		Transitions: []string{config.TaskTransitionDead},
+	}}, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer notifier.Close()
+
+	// Only the transitions the webhook registered for are delivered
+	event := structs.NewTaskEvent(structs.TaskStarted)
+	notifier.Notify(&config.TaskNotification{Task: "web", Transition: config.TaskTransitionStarted, Event: event})
+	notifier.Notify(&config.TaskNotification{Task: "web", Transition: config.TaskTransitionDead, Event: event})
+	if n := hook.next(t); n.Transition != config.TaskTransitionDead {
+		t.Fatalf("bad: %#v", n)
+	}
+	if n := hook.numRequests(); n != 1 {
+		t.Fatalf("webhook got %d requests; want 1", n)
+	}
+}
+
+func TestWebhookNotifier_Retry(t *testing.T) {
+	oldBackoff := webhookBackoff
+	webhookBackoff = 10 * time.Millisecond
+	defer func() { webhookBackoff = oldBackoff }()
+
+	// Failures within the retry budget are retried
+	hook := newTestWebhook(t, webhookAttempts-1)
+	defer hook.Close()
+	notifier, err := newWebhookNotifier([]*config.TaskWebhook{{URL: hook.URL}}, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer notifier.Close()
+	notifier.Notify(&config.TaskNotification{Task: "web", Transition: config.TaskTransitionStarted})
+	if n := hook.next(t); n.Task != "web" {
+		t.Fatalf("bad: %#v", n)
+	}
+	if n := hook.numRequests(); n != webhookAttempts {
+		t.Fatalf("webhook got %d requests; want %d", n, webhookAttempts)
+	}
+}
+
+func TestWebhookNotifier_Drop(t *testing.T) {
+	oldBackoff := webhookBackoff
+	webhookBackoff = 10 * time.Millisecond
+	defer func() { webhookBackoff = oldBackoff }()
+
+	// A notification failing every attempt is dropped, and the next one is
+	// still delivered
+	hook := newTestWebhook(t, webhookAttempts)
+	defer hook.Close()
+	notifier, err := newWebhookNotifier([]*config.TaskWebhook{{URL: hook.URL}}, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer notifier.Close()
+	notifier.Notify(&config.TaskNotification{Task: "dropped", Transition: config.TaskTransitionStarted})
+	notifier.Notify(&config.TaskNotification{Task: "delivered", Transition: config.TaskTransitionStarted})
+	if n := hook.next(t); n.Task != "delivered" {
+		t.Fatalf("bad: %#v", n)
+	}
+	if n := hook.numRequests(); n != webhookAttempts+1 {
+		t.Fatalf("webhook got %d requests; want %d", n, webhookAttempts+1)
+	}
+}
+
+func TestWebhookNotifier_NonBlocking(t *testing.T) {
+	// The webhook hangs until the test is done
+	doneCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		<-doneCh
+	}))
+	defer srv.Close()
+	notifier, err := newWebhookNotifier([]*config.TaskWebhook{{URL: srv.URL}}, testLogger())
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	defer notifier.Close()
+	defer close(doneCh)
+
+	// Notifying never waits on the delivery, even once the queue is full
+	start := time.Now()
+	for i := 0; i < 2*webhookQueueSize; i++ {
+		notifier.Notify(&config.TaskNotification{Task: "web", Transition: config.TaskTransitionStarted})
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("notifying blocked for %v", elapsed)
+	}
+}
+
+func TestWebhookNotifier_Invalid(t *testing.T) {
+	for _, hook := range []*config.TaskWebhook{
+		{URL: "ftp://example.com/hook"},
+		{URL: "http://"},
+		{URL: "http://example.com/hook", Transitions: []string{"exploded"}},
+	} {
+		if _, err := newWebhookNotifier([]*config.TaskWebhook{hook}, testLogger()); err == nil ||
+			!strings.Contains(err.Error(), "task webhook") {
+			t.Fatalf("%#v: expected error: %v", hook, err)
+		}
+	}
+}
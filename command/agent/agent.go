@@ -10,6 +10,8 @@ import (
 	"sync"
 
 	"github.com/hashicorp/nomad/client"
+	clientconfig "github.com/hashicorp/nomad/client/config"
+	"github.com/hashicorp/nomad/client/metrics"
 	"github.com/hashicorp/nomad/nomad"
 	"github.com/hashicorp/nomad/nomad/structs"
 )
@@ -177,22 +179,18 @@ func (a *Agent) setupClient() error {
 		conf.RPCHandler = a.server
 	}
 	conf.LogOutput = a.logOutput
-	conf.DevMode = a.config.DevMode
-	if a.config.Region != "" {
-		conf.Region = a.config.Region
-	}
-	if a.config.DataDir != "" {
-		conf.StateDir = filepath.Join(a.config.DataDir, "client")
-		conf.AllocDir = filepath.Join(a.config.DataDir, "alloc")
-	}
-	if a.config.Client.StateDir != "" {
-		conf.StateDir = a.config.Client.StateDir
-	}
-	if a.config.Client.AllocDir != "" {
-		conf.AllocDir = a.config.Client.AllocDir
-	}
+	applyClientConfig(conf, a.config)
 	conf.Servers = a.config.Client.Servers
 
+	// Send the task metrics to statsd if configured
+	if tel := a.config.Telemetry; tel != nil && tel.StatsdAddr != "" {
+		sink, err := metrics.NewStatsdSink(tel.StatsdAddr, "nomad")
+		if err != nil {
+			return err
+		}
+		conf.MetricsSink = sink
+	}
+
 	// Setup the node
 	conf.Node = new(structs.Node)
 	conf.Node.Datacenter = a.config.Datacenter
@@ -210,6 +208,43 @@ func (a *Agent) setupClient() error {
 	return nil
 }
 
+// applyClientConfig sets the fields of the client config that are derived
+// from the agent config and checked when the client is reloaded
+func applyClientConfig(conf *clientconfig.Config, config *Config) {
+	conf.DevMode = config.DevMode
+	if config.Region != "" {
+		conf.Region = config.Region
+	}
+	if config.DataDir != "" {
+		conf.StateDir = filepath.Join(config.DataDir, "client")
+		conf.AllocDir = filepath.Join(config.DataDir, "alloc")
+	}
+	if config.Client.StateDir != "" {
+		conf.StateDir = config.Client.StateDir
+	}
+	if config.Client.AllocDir != "" {
+		conf.AllocDir = config.Client.AllocDir
+	}
+	if config.Client.Options != nil {
+		conf.Options = config.Client.Options
+	}
+	conf.TaskLogLevel = config.Client.TaskLogLevel
+	conf.TaskLogLevels = config.Client.TaskLogLevels
+	conf.LogJSON = config.Client.LogJSON
+}
+
+// Reload applies the new config to the client of the agent, if it runs
+// one. The running tasks are left alone, and the options of the client that
+// can't change until it is restarted are ignored with a warning.
+func (a *Agent) Reload(config *Config) error {
+	if a.client == nil || config.Client == nil {
+		return nil
+	}
+	conf := client.DefaultConfig()
+	applyClientConfig(conf, config)
+	return a.client.Reload(conf)
+}
+
 // Leave is used gracefully exit. Clients will inform servers
 // of their departure so that allocations can be rescheduled.
 func (a *Agent) Leave() error {
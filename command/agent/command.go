@@ -433,6 +433,11 @@ func (c *Command) handleReload(config *Config) *Config {
 		// Keep the current log level
 		newConf.LogLevel = config.LogLevel
 	}
+
+	// Reload the client, leaving its tasks running
+	if err := c.agent.Reload(newConf); err != nil {
+		c.Ui.Error(fmt.Sprintf("Failed to reload the client: %v", err))
+	}
 	return newConf
 }
 
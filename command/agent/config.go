@@ -139,6 +139,20 @@ type ClientConfig struct {
 
 	// Metadata associated with the node
 	Meta map[string]string `hcl:"meta"`
+
+	// Options are used to configure the client and its drivers, ex:
+	// "driver.raw_exec.enable"
+	Options map[string]string `hcl:"options"`
+
+	// TaskLogLevel is the minimum level of the logs about tasks, which may
+	// be higher than the log level of the agent
+	TaskLogLevel string `hcl:"task_log_level"`
+
+	// TaskLogLevels overrides TaskLogLevel for tasks by name
+	TaskLogLevels map[string]string `hcl:"task_log_levels"`
+
+	// LogJSON writes the logs about tasks as JSON
+	LogJSON bool `hcl:"log_json"`
 }
 
 // ServerConfig is configuration specific to the server mode
@@ -384,6 +398,12 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 	if b.NodeClass != "" {
 		result.NodeClass = b.NodeClass
 	}
+	if b.TaskLogLevel != "" {
+		result.TaskLogLevel = b.TaskLogLevel
+	}
+	if b.LogJSON {
+		result.LogJSON = true
+	}
 
 	// Add the servers
 	result.Servers = append(result.Servers, b.Servers...)
@@ -396,6 +416,26 @@ func (a *ClientConfig) Merge(b *ClientConfig) *ClientConfig {
 		result.Meta[k] = v
 	}
 
+	// Add the options map values
+	if result.Options == nil {
+		result.Options = make(map[string]string)
+	}
+	for k, v := range b.Options {
+		result.Options[k] = v
+	}
+
+	// Add the task log level overrides
+	if len(b.TaskLogLevels) != 0 {
+		levels := make(map[string]string, len(result.TaskLogLevels)+len(b.TaskLogLevels))
+		for k, v := range result.TaskLogLevels {
+			levels[k] = v
+		}
+		for k, v := range b.TaskLogLevels {
+			levels[k] = v
+		}
+		result.TaskLogLevels = levels
+	}
+
 	return &result
 }
 
@@ -87,6 +87,11 @@ func TestConfig_Merge(t *testing.T) {
 			NodeClass: "class2",
 			Servers:   []string{"server2"},
 			Meta:      map[string]string{"baz": "zip"},
+			Options:   map[string]string{"driver.raw_exec.enable": "1"},
+
+			TaskLogLevel:  "INFO",
+			TaskLogLevels: map[string]string{"web": "DEBUG"},
+			LogJSON:       true,
 		},
 		Server: &ServerConfig{
 			Enabled:           true,
@@ -336,6 +341,9 @@ func TestConfig_LoadConfigString(t *testing.T) {
 				"foo": "bar",
 				"baz": "zip",
 			},
+			Options: map[string]string{
+				"driver.raw_exec.enable": "1",
+			},
 		},
 		Server: &ServerConfig{
 			Enabled:           true,
@@ -403,6 +411,9 @@ client {
 		foo = "bar"
 		baz = "zip"
 	}
+	options {
+		"driver.raw_exec.enable" = "1"
+	}
 }
 server {
 	enabled = true
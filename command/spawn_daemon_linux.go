@@ -3,11 +3,15 @@ package command
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
 	"strings"
 	"syscall"
+
+	"github.com/hashicorp/nomad/client/driver/logging"
 )
 
 // Configuration for the command to start as a daemon.
@@ -20,9 +24,106 @@ type DaemonConfig struct {
 	StdinFile  string
 	StderrFile string
 
+	// If MaxLogFiles is set, the stdout and stderr are rotated into files
+	// named <StdoutFile>.<index> and <StderrFile>.<index> instead, each
+	// growing to at most MaxLogFileSize bytes.
+	MaxLogFiles    int
+	MaxLogFileSize int64
+
+	// If Syslog is set, the stdout and stderr are forwarded to syslog as
+	// well, or only there if DisableLogFiles is set too.
+	Syslog          *logging.SyslogConfig
+	DisableLogFiles bool
+
 	Chroot string
 }
 
+// openLogs opens the writers the stdout and stderr of the command are
+// captured by, forwarding them to syslog if configured.
+func (c *DaemonConfig) openLogs() (stdout, stderr io.WriteCloser, err error) {
+	if c.Syslog == nil || !c.DisableLogFiles {
+		if stdout, stderr, err = c.openLogFiles(); err != nil {
+			return nil, nil, err
+		}
+	}
+	if c.Syslog != nil {
+		stdout, stderr, err = logging.ForwardSyslog(c.Syslog, stdout, stderr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error forwarding logs to syslog: %v", err)
+		}
+	}
+	return stdout, stderr, nil
+}
+
+// openLogFiles opens the files the stdout and stderr of the command are
+// redirected to. If the command runs as another user, the files are owned by
+// that user.
+func (c *DaemonConfig) openLogFiles() (stdout, stderr io.WriteCloser, err error) {
+	var cred *syscall.Credential
+	if c.SysProcAttr != nil {
+		cred = c.SysProcAttr.Credential
+	}
+
+	if c.MaxLogFiles > 0 {
+		stdoutRotator, err := logging.NewFileRotator(c.StdoutFile, c.MaxLogFiles, c.MaxLogFileSize)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Error creating Stdout log rotator: %v", err)
+		}
+
+		stderrRotator, err := logging.NewFileRotator(c.StderrFile, c.MaxLogFiles, c.MaxLogFileSize)
+		if err != nil {
+			stdoutRotator.Close()
+			return nil, nil, fmt.Errorf("Error creating Stderr log rotator: %v", err)
+		}
+
+		if cred != nil {
+			for _, r := range []*logging.FileRotator{stdoutRotator, stderrRotator} {
+				if err := r.SetOwner(int(cred.Uid), int(cred.Gid)); err != nil {
+					stdoutRotator.Close()
+					stderrRotator.Close()
+					return nil, nil, err
+				}
+			}
+		}
+		return stdoutRotator, stderrRotator, nil
+	}
+
+	stdoutFile, err := os.OpenFile(c.StdoutFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error opening file to redirect Stdout: %v", err)
+	}
+
+	stderrFile, err := os.OpenFile(c.StderrFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	if err != nil {
+		stdoutFile.Close()
+		return nil, nil, fmt.Errorf("Error opening file to redirect Stderr: %v", err)
+	}
+
+	if cred != nil {
+		for _, f := range []*os.File{stdoutFile, stderrFile} {
+			if err := f.Chown(int(cred.Uid), int(cred.Gid)); err != nil {
+				stdoutFile.Close()
+				stderrFile.Close()
+				return nil, nil, fmt.Errorf("Error changing the owner of %v: %v", f.Name(), err)
+			}
+		}
+	}
+	return stdoutFile, stderrFile, nil
+}
+
+// forwardedSignals are the signals the spawn-daemon relays to the user
+// command, so that the client can signal the task through it.
+var forwardedSignals = []os.Signal{
+	syscall.SIGHUP,
+	syscall.SIGINT,
+	syscall.SIGQUIT,
+	syscall.SIGTERM,
+	syscall.SIGUSR1,
+	syscall.SIGUSR2,
+	syscall.SIGALRM,
+	syscall.SIGWINCH,
+}
+
 // Whether to start the user command or abort.
 type TaskStart bool
 
@@ -52,6 +153,11 @@ func (c *SpawnDaemonCommand) Run(args []string) int {
 		return c.outputStartStatus(err, 1)
 	}
 
+	// Catch the signals to forward before the user command can be started,
+	// so that they don't terminate the spawn-daemon instead.
+	sigCh := make(chan os.Signal, 8)
+	signal.Notify(sigCh, forwardedSignals...)
+
 	// Isolate the user process.
 	if _, err := syscall.Setsid(); err != nil {
 		return c.outputStartStatus(fmt.Errorf("Failed setting sid: %v", err), 1)
@@ -60,15 +166,12 @@ func (c *SpawnDaemonCommand) Run(args []string) int {
 	syscall.Umask(0)
 
 	// Redirect logs.
-	stdo, err := os.OpenFile(cmd.StdoutFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+	stdo, stde, err := cmd.openLogs()
 	if err != nil {
-		return c.outputStartStatus(fmt.Errorf("Error opening file to redirect Stdout: %v", err), 1)
-	}
-
-	stde, err := os.OpenFile(cmd.StderrFile, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
-	if err != nil {
-		return c.outputStartStatus(fmt.Errorf("Error opening file to redirect Stderr: %v", err), 1)
+		return c.outputStartStatus(err, 1)
 	}
+	defer stdo.Close()
+	defer stde.Close()
 
 	stdi, err := os.OpenFile(cmd.StdinFile, os.O_CREATE|os.O_RDONLY, 0666)
 	if err != nil {
@@ -106,8 +209,25 @@ func (c *SpawnDaemonCommand) Run(args []string) int {
 	// Indicate that the command was started successfully.
 	c.outputStartStatus(nil, 0)
 
-	// Wait and then output the exit status.
+	// Relay signals to the user command.
+	go func() {
+		for sig := range sigCh {
+			cmd.Cmd.Process.Signal(sig)
+		}
+	}()
+
+	// Wait and then exit with the exit status of the user command, so the
+	// client sees how the task exited. A command killed by a signal exits with
+	// 128 + signal, as in shells.
 	if err := cmd.Wait(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					return 128 + int(status.Signal())
+				}
+				return status.ExitStatus()
+			}
+		}
 		return 1
 	}
 
@@ -285,8 +285,22 @@ func parseTasks(result *[]*structs.Task, obj *hclobj.Object) error {
 		}
 		delete(m, "config")
 		delete(m, "constraint")
+		delete(m, "env")
+		delete(m, "secrets")
 		delete(m, "meta")
 		delete(m, "resources")
+		delete(m, "restart")
+		delete(m, "logs")
+		delete(m, "template")
+		delete(m, "provider_secret")
+		delete(m, "artifact")
+		delete(m, "check")
+		delete(m, "service")
+		delete(m, "volume")
+
+		if err := parseDurations(m, "kill_timeout", "shutdown_delay", "max_runtime"); err != nil {
+			return fmt.Errorf("task '%s': %s", o.Key, err)
+		}
 
 		// Build the task
 		var t structs.Task
@@ -315,6 +329,33 @@ func parseTasks(result *[]*structs.Task, obj *hclobj.Object) error {
 			}
 		}
 
+		// Parse out environment variables. These are in HCL as a list so
+		// we need to iterate over them and merge them.
+		if envO := o.Get("env", false); envO != nil {
+			for _, o := range envO.Elem(false) {
+				var m map[string]interface{}
+				if err := hcl.DecodeObject(&m, o); err != nil {
+					return err
+				}
+				if err := mapstructure.WeakDecode(m, &t.Env); err != nil {
+					return err
+				}
+			}
+		}
+
+		// Parse out the secrets, which are merged like the environment
+		if secretsO := o.Get("secrets", false); secretsO != nil {
+			for _, o := range secretsO.Elem(false) {
+				var m map[string]interface{}
+				if err := hcl.DecodeObject(&m, o); err != nil {
+					return err
+				}
+				if err := mapstructure.WeakDecode(m, &t.Secrets); err != nil {
+					return err
+				}
+			}
+		}
+
 		// Parse out meta fields. These are in HCL as a list so we need
 		// to iterate over them and merge them.
 		if metaO := o.Get("meta", false); metaO != nil {
@@ -339,6 +380,68 @@ func parseTasks(result *[]*structs.Task, obj *hclobj.Object) error {
 			t.Resources = &r
 		}
 
+		// If we have a restart policy, then parse that
+		if o := o.Get("restart", false); o != nil {
+			var p structs.RestartPolicy
+			if err := parseRestartPolicy(&p, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+
+			t.RestartPolicy = &p
+		}
+
+		// Parse artifacts
+		if o := o.Get("artifact", false); o != nil {
+			if err := parseArtifacts(&t.Artifacts, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// Parse templates
+		if o := o.Get("template", false); o != nil {
+			if err := parseTemplates(&t.Templates, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// Parse the secrets of the secret provider
+		if o := o.Get("provider_secret", false); o != nil {
+			if err := parseProviderSecrets(&t.ProviderSecrets, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// Parse health checks
+		if o := o.Get("check", false); o != nil {
+			if err := parseChecks(&t.Checks, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// Parse services
+		if o := o.Get("service", false); o != nil {
+			if err := parseServices(&t.Services, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// Parse host volumes
+		if o := o.Get("volume", false); o != nil {
+			if err := parseVolumes(&t.Volumes, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+		}
+
+		// If we have a log configuration, then parse that
+		if o := o.Get("logs", false); o != nil {
+			l := structs.DefaultLogConfig()
+			if err := parseLogConfig(l, o); err != nil {
+				return fmt.Errorf("task '%s': %s", t.Name, err)
+			}
+
+			t.LogConfig = l
+		}
+
 		*result = append(*result, &t)
 	}
 
@@ -405,6 +508,219 @@ func parseResources(result *structs.Resources, obj *hclobj.Object) error {
 	return nil
 }
 
+func parseRestartPolicy(result *structs.RestartPolicy, obj *hclobj.Object) error {
+	if obj.Len() > 1 {
+		return fmt.Errorf("only one 'restart' block allowed per task")
+	}
+
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+		if err := parseDurations(m, "interval", "delay", "min_healthy_time"); err != nil {
+			return err
+		}
+
+		if err := mapstructure.WeakDecode(m, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseArtifacts(result *[]*structs.TaskArtifact, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+
+		var a structs.TaskArtifact
+		if err := mapstructure.WeakDecode(m, &a); err != nil {
+			return err
+		}
+
+		*result = append(*result, &a)
+	}
+
+	return nil
+}
+
+func parseTemplates(result *[]*structs.Template, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+
+		var t structs.Template
+		if err := mapstructure.WeakDecode(m, &t); err != nil {
+			return err
+		}
+
+		*result = append(*result, &t)
+	}
+
+	return nil
+}
+
+func parseProviderSecrets(result *[]*structs.ProviderSecret, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+
+		var s structs.ProviderSecret
+		if err := mapstructure.WeakDecode(m, &s); err != nil {
+			return err
+		}
+
+		*result = append(*result, &s)
+	}
+
+	return nil
+}
+
+func parseChecks(result *[]*structs.TaskCheck, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+		if err := parseDurations(m, "interval", "timeout", "grace_period"); err != nil {
+			return err
+		}
+
+		var c structs.TaskCheck
+		if err := mapstructure.WeakDecode(m, &c); err != nil {
+			return err
+		}
+
+		*result = append(*result, &c)
+	}
+
+	return nil
+}
+
+func parseServices(result *[]*structs.Service, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+		delete(m, "check")
+
+		var s structs.Service
+		if err := mapstructure.WeakDecode(m, &s); err != nil {
+			return err
+		}
+
+		if o := o.Get("check", false); o != nil {
+			for _, co := range o.Elem(false) {
+				var cm map[string]interface{}
+				if err := hcl.DecodeObject(&cm, co); err != nil {
+					return err
+				}
+				if err := parseDurations(cm, "interval", "timeout"); err != nil {
+					return fmt.Errorf("service '%s': %s", s.Name, err)
+				}
+
+				var c structs.ServiceCheck
+				if err := mapstructure.WeakDecode(cm, &c); err != nil {
+					return err
+				}
+				s.Checks = append(s.Checks, &c)
+			}
+		}
+
+		*result = append(*result, &s)
+	}
+
+	return nil
+}
+
+func parseVolumes(result *[]*structs.TaskVolume, obj *hclobj.Object) error {
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+
+		var v structs.TaskVolume
+		if err := mapstructure.WeakDecode(m, &v); err != nil {
+			return err
+		}
+
+		*result = append(*result, &v)
+	}
+
+	return nil
+}
+
+func parseLogConfig(result *structs.LogConfig, obj *hclobj.Object) error {
+	if obj.Len() > 1 {
+		return fmt.Errorf("only one 'logs' block allowed per task")
+	}
+
+	for _, o := range obj.Elem(false) {
+		var m map[string]interface{}
+		if err := hcl.DecodeObject(&m, o); err != nil {
+			return err
+		}
+		delete(m, "syslog")
+
+		if err := mapstructure.WeakDecode(m, result); err != nil {
+			return err
+		}
+
+		// Parse forwarding to syslog
+		if o := o.Get("syslog", false); o != nil {
+			if o.Len() > 1 {
+				return fmt.Errorf("only one 'syslog' block allowed per 'logs' block")
+			}
+			for _, o := range o.Elem(false) {
+				var m map[string]interface{}
+				if err := hcl.DecodeObject(&m, o); err != nil {
+					return err
+				}
+
+				var s structs.SyslogLogConfig
+				if err := mapstructure.WeakDecode(m, &s); err != nil {
+					return err
+				}
+				result.Syslog = &s
+			}
+		}
+	}
+	return nil
+}
+
+// parseDurations converts the given keys of the map into durations. Strings
+// are parsed as Go durations and integers are treated as seconds.
+func parseDurations(m map[string]interface{}, keys ...string) error {
+	for _, key := range keys {
+		raw, ok := m[key]
+		if !ok {
+			continue
+		}
+		switch v := raw.(type) {
+		case string:
+			dur, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("invalid %s time '%s'", key, raw)
+			}
+			m[key] = dur
+		case int:
+			m[key] = time.Duration(v) * time.Second
+		default:
+			return fmt.Errorf("invalid type for %s time '%s'", key, raw)
+		}
+	}
+	return nil
+}
+
 func parseUpdate(result *structs.UpdateStrategy, obj *hclobj.Object) error {
 	if obj.Len() > 1 {
 		return fmt.Errorf("only one 'update' block allowed per job")
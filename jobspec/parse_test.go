@@ -86,6 +86,13 @@ func TestParse(t *testing.T) {
 								Config: map[string]string{
 									"image": "hashicorp/binstore",
 								},
+								Env: map[string]string{
+									"HELLO": "world",
+									"ADDR":  "${NOMAD_IP}:${NOMAD_PORT_http}",
+								},
+								Secrets: map[string]string{
+									"token": "s3cr3t",
+								},
 								Resources: &structs.Resources{
 									CPU:      500,
 									MemoryMB: 128,
@@ -148,6 +155,373 @@ func TestParse(t *testing.T) {
 			false,
 		},
 
+		{
+			"restart-policy.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:        "bar",
+								Driver:      "exec",
+								KillTimeout: 30 * time.Second,
+								KillSignal:  "SIGINT",
+								RestartPolicy: &structs.RestartPolicy{
+									Attempts:       3,
+									Interval:       10 * time.Minute,
+									Delay:          15 * time.Second,
+									Mode:           "delay",
+									Jitter:         0.2,
+									MinHealthyTime: 30 * time.Second,
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"logs.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								LogConfig: &structs.LogConfig{
+									MaxFiles:      3,
+									MaxFileSizeMB: 10,
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"logs-syslog.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								LogConfig: &structs.LogConfig{
+									MaxFiles:      3,
+									MaxFileSizeMB: 10,
+									Syslog: &structs.SyslogLogConfig{
+										Address:      "udp://10.0.0.1:514",
+										Facility:     "local3",
+										Tag:          "web",
+										DisableFiles: true,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"checks.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								Checks: []*structs.TaskCheck{
+									&structs.TaskCheck{
+										Name:             "alive",
+										Type:             "http",
+										URL:              "http://127.0.0.1:${NOMAD_PORT_http}/health",
+										ExpectedStatus:   204,
+										Interval:         10 * time.Second,
+										Timeout:          2 * time.Second,
+										GracePeriod:      30 * time.Second,
+										SuccessThreshold: 2,
+										FailureThreshold: 3,
+									},
+									&structs.TaskCheck{
+										Name:     "ready",
+										Type:     "script",
+										Command:  "/usr/local/bin/ready",
+										Args:     "-q",
+										Interval: 5 * time.Second,
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"services.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								Services: []*structs.Service{
+									&structs.Service{
+										Name:      "web",
+										PortLabel: "http",
+										Tags:      []string{"v1", "public"},
+										Checks: []*structs.ServiceCheck{
+											&structs.ServiceCheck{
+												Name:     "alive",
+												Type:     "http",
+												Path:     "/health",
+												Interval: 10 * time.Second,
+												Timeout:  2 * time.Second,
+											},
+										},
+									},
+									&structs.Service{
+										Name:      "admin",
+										PortLabel: "admin",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"depends-on.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "web",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "db",
+								Driver: "exec",
+							},
+							&structs.Task{
+								Name:      "app",
+								Driver:    "exec",
+								DependsOn: []string{"db"},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"lifecycle.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "web",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:      "migrate",
+								Driver:    "exec",
+								Lifecycle: structs.TaskLifecyclePrestart,
+							},
+							&structs.Task{
+								Name:   "app",
+								Driver: "exec",
+							},
+							&structs.Task{
+								Name:      "logs",
+								Driver:    "exec",
+								Lifecycle: structs.TaskLifecycleSidecar,
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"volumes.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "docker",
+								Volumes: []*structs.TaskVolume{
+									&structs.TaskVolume{
+										Source:      "/srv/data",
+										Destination: "/data",
+										ReadOnly:    true,
+									},
+									&structs.TaskVolume{
+										Source:      "/var/log/app",
+										Destination: "/logs",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"provider-secrets.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								ProviderSecrets: []*structs.ProviderSecret{
+									&structs.ProviderSecret{
+										Path: "secret/db",
+									},
+									&structs.ProviderSecret{
+										Path:         "secret/tls",
+										ChangeMode:   "signal",
+										ChangeSignal: "SIGUSR1",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
+		{
+			"templates.hcl",
+			&structs.Job{
+				ID:       "foo",
+				Name:     "foo",
+				Priority: 50,
+				Region:   "global",
+				Type:     "service",
+
+				TaskGroups: []*structs.TaskGroup{
+					&structs.TaskGroup{
+						Name:  "bar",
+						Count: 1,
+						Tasks: []*structs.Task{
+							&structs.Task{
+								Name:   "bar",
+								Driver: "exec",
+								Artifacts: []*structs.TaskArtifact{
+									&structs.TaskArtifact{
+										Source:   "https://example.com/app.tar.gz",
+										Checksum: "sha256:abcd",
+									},
+								},
+								Templates: []*structs.Template{
+									&structs.Template{
+										EmbeddedTmpl: "port = {{ .NOMAD_PORT_http }}",
+										DestPath:     "local/app.conf",
+									},
+									&structs.Template{
+										EmbeddedTmpl: "{{ .NOMAD_ALLOC_ID }}",
+										DestPath:     "alloc/id",
+										ChangeMode:   "restart",
+									},
+								},
+							},
+						},
+					},
+				},
+			},
+			false,
+		},
+
 		{
 			"specify-job.hcl",
 			&structs.Job{
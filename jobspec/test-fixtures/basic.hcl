@@ -36,6 +36,13 @@ job "binstore-storagelocker" {
             config {
                 image = "hashicorp/binstore"
             }
+            env {
+                HELLO = "world"
+                ADDR = "${NOMAD_IP}:${NOMAD_PORT_http}"
+            }
+            secrets {
+                token = "s3cr3t"
+            }
             resources {
                 cpu = 500
                 memory = 128
@@ -0,0 +1,23 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        check {
+            name = "alive"
+            type = "http"
+            url = "http://127.0.0.1:${NOMAD_PORT_http}/health"
+            expected_status = 204
+            interval = "10s"
+            timeout = "2s"
+            grace_period = "30s"
+            success_threshold = 2
+            failure_threshold = 3
+        }
+        check {
+            name = "ready"
+            type = "script"
+            command = "/usr/local/bin/ready"
+            args = "-q"
+            interval = "5s"
+        }
+    }
+}
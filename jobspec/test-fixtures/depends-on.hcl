@@ -0,0 +1,11 @@
+job "foo" {
+    group "web" {
+        task "db" {
+            driver = "exec"
+        }
+        task "app" {
+            driver = "exec"
+            depends_on = ["db"]
+        }
+    }
+}
@@ -0,0 +1,15 @@
+job "foo" {
+    group "web" {
+        task "migrate" {
+            driver = "exec"
+            lifecycle = "prestart"
+        }
+        task "app" {
+            driver = "exec"
+        }
+        task "logs" {
+            driver = "exec"
+            lifecycle = "sidecar"
+        }
+    }
+}
@@ -0,0 +1,14 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        logs {
+            max_files = 3
+            syslog {
+                address = "udp://10.0.0.1:514"
+                facility = "local3"
+                tag = "web"
+                disable_files = true
+            }
+        }
+    }
+}
@@ -0,0 +1,8 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        logs {
+            max_files = 3
+        }
+    }
+}
@@ -0,0 +1,13 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        provider_secret {
+            path = "secret/db"
+        }
+        provider_secret {
+            path = "secret/tls"
+            change_mode = "signal"
+            change_signal = "SIGUSR1"
+        }
+    }
+}
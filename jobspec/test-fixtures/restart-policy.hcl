@@ -0,0 +1,15 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        kill_timeout = "30s"
+        kill_signal = "SIGINT"
+        restart {
+            attempts = 3
+            interval = "10m"
+            delay = "15s"
+            mode = "delay"
+            jitter = 0.2
+            min_healthy_time = "30s"
+        }
+    }
+}
@@ -0,0 +1,21 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        service {
+            name = "web"
+            port = "http"
+            tags = ["v1", "public"]
+            check {
+                name = "alive"
+                type = "http"
+                path = "/health"
+                interval = "10s"
+                timeout = "2s"
+            }
+        }
+        service {
+            name = "admin"
+            port = "admin"
+        }
+    }
+}
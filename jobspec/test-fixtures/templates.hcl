@@ -0,0 +1,18 @@
+job "foo" {
+    task "bar" {
+        driver = "exec"
+        artifact {
+            source = "https://example.com/app.tar.gz"
+            checksum = "sha256:abcd"
+        }
+        template {
+            data = "port = {{ .NOMAD_PORT_http }}"
+            destination = "local/app.conf"
+        }
+        template {
+            data = "{{ .NOMAD_ALLOC_ID }}"
+            destination = "alloc/id"
+            change_mode = "restart"
+        }
+    }
+}
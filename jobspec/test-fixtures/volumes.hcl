@@ -0,0 +1,14 @@
+job "foo" {
+    task "bar" {
+        driver = "docker"
+        volume {
+            source = "/srv/data"
+            destination = "/data"
+            read_only = true
+        }
+        volume {
+            source = "/var/log/app"
+            destination = "/logs"
+        }
+    }
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"net"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
@@ -539,6 +542,56 @@ type Resources struct {
 	DiskMB   int `mapstructure:"disk"`
 	IOPS     int
 	Networks []*NetworkResource
+
+	// MemoryMaxMB is the hard memory limit of a task, which may burst past
+	// its MemoryMB reservation up to it. If zero, MemoryMB is the hard
+	// limit. It isn't counted when placing tasks.
+	MemoryMaxMB int `mapstructure:"memory_max"`
+
+	// OOMScoreAdj is the oom_score_adj of a task, from -1000 to 1000. Tasks
+	// with higher values are killed first when the host runs out of memory.
+	OOMScoreAdj int `mapstructure:"oom_score_adj"`
+
+	// CPUShares is the relative weight of the task for the CPU when it is
+	// contended. The CPU in MHz is used if zero. It is set by clients that
+	// oversubscribe their node rather than by the job.
+	CPUShares int `mapstructure:"-"`
+}
+
+// Validate checks the memory limits of the resources of a task
+func (r *Resources) Validate() error {
+	var mErr multierror.Error
+	if r.MemoryMaxMB != 0 && r.MemoryMaxMB < r.MemoryMB {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Memory max of %d MB is less than the memory of %d MB", r.MemoryMaxMB, r.MemoryMB))
+	}
+	if r.OOMScoreAdj < -1000 || r.OOMScoreAdj > 1000 {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("OOM score adjustment %d must be between -1000 and 1000", r.OOMScoreAdj))
+	}
+	for _, n := range r.Networks {
+		if n.Mode != "" && n.Mode != NetworkModeHost && n.Mode != NetworkModeBridge {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Unknown network mode '%s': must be '%s' or '%s'", n.Mode, NetworkModeHost, NetworkModeBridge))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// MemoryLimits returns the soft and hard memory limits in bytes. The soft
+// limit is zero unless the hard limit is above the reservation.
+func (r *Resources) MemoryLimits() (soft, hard int64) {
+	hard = int64(r.MemoryMB) * 1024 * 1024
+	if r.MemoryMaxMB > r.MemoryMB {
+		soft, hard = hard, int64(r.MemoryMaxMB)*1024*1024
+	}
+	return soft, hard
+}
+
+// Shares returns the relative weight of the task for the CPU, which is its
+// CPU in MHz unless CPUShares is set
+func (r *Resources) Shares() int {
+	if r.CPUShares > 0 {
+		return r.CPUShares
+	}
+	return r.CPU
 }
 
 // Copy returns a deep copy of the resources
@@ -609,6 +662,16 @@ func (r *Resources) GoString() string {
 	return fmt.Sprintf("*%#v", *r)
 }
 
+const (
+	// NetworkModeHost is for tasks sharing the network namespace of the
+	// host, binding their ports on it directly
+	NetworkModeHost = "host"
+
+	// NetworkModeBridge is for tasks in their own network, whose ports are
+	// mapped to those of the host
+	NetworkModeBridge = "bridge"
+)
+
 // NetworkResource is used to represent available network
 // resources
 type NetworkResource struct {
@@ -618,6 +681,7 @@ type NetworkResource struct {
 	MBits         int      // Throughput
 	ReservedPorts []int    `mapstructure:"reserved_ports"` // Reserved ports
 	DynamicPorts  []string `mapstructure:"dynamic_ports"`  // Dynamically assigned ports
+	Mode          string   // Network mode, the default of the driver if empty
 }
 
 // Copy returns a deep copy of the network resource
@@ -919,9 +983,17 @@ func (tg *TaskGroup) Validate() error {
 		mErr.Errors = append(mErr.Errors, errors.New("Missing tasks for task group"))
 	}
 
-	// Check for duplicate tasks
+	// Check for duplicate tasks and that there is at most one leader
 	tasks := make(map[string]int)
+	leader := -1
 	for idx, task := range tg.Tasks {
+		if task.Leader {
+			if leader >= 0 {
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("Task %d is marked as leader but task %d already is", idx+1, leader+1))
+			} else {
+				leader = idx
+			}
+		}
 		if task.Name == "" {
 			mErr.Errors = append(mErr.Errors, fmt.Errorf("Task %d missing name", idx+1))
 		} else if existing, ok := tasks[task.Name]; ok {
@@ -938,9 +1010,86 @@ func (tg *TaskGroup) Validate() error {
 			mErr.Errors = append(mErr.Errors, outer)
 		}
 	}
+
+	// Check the dependencies between the tasks. Prestart tasks complete
+	// before the others start and poststart tasks wait on the main tasks, so
+	// neither can be waited on by the tasks of another phase.
+	if _, err := tg.DependencyOrder(); err != nil {
+		mErr.Errors = append(mErr.Errors, err)
+	}
+	for _, task := range tg.Tasks {
+		phase := task.LifecyclePhase()
+		for _, name := range task.DependsOn {
+			dep := tg.LookupTask(name)
+			if dep == nil {
+				continue
+			}
+			depPhase := dep.LifecyclePhase()
+			if (phase == TaskLifecyclePrestart && depPhase != TaskLifecyclePrestart) ||
+				(phase != TaskLifecyclePoststart && depPhase == TaskLifecyclePoststart) {
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("%s task '%s' can't depend on %s task '%s'",
+					strings.Title(phase), task.Name, depPhase, name))
+			}
+		}
+	}
 	return mErr.ErrorOrNil()
 }
 
+// DependencyOrder returns the names of the tasks ordered such that every task
+// comes after the tasks it depends on. It fails if a task depends on a task
+// that is not in the group or if the dependencies form a cycle.
+func (tg *TaskGroup) DependencyOrder() ([]string, error) {
+	tasks := make(map[string]*Task, len(tg.Tasks))
+	for _, task := range tg.Tasks {
+		tasks[task.Name] = task
+	}
+
+	// Depth first search, tracking the path to report cycles
+	const (
+		visiting = iota + 1
+		visited
+	)
+	state := make(map[string]int, len(tg.Tasks))
+	order := make([]string, 0, len(tg.Tasks))
+	var path []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			for i, n := range path {
+				if n == name {
+					cycle := append(path[i:], name)
+					return fmt.Errorf("Task dependency cycle: %s", strings.Join(cycle, " -> "))
+				}
+			}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+		for _, dep := range tasks[name].DependsOn {
+			if _, ok := tasks[dep]; !ok {
+				return fmt.Errorf("Task '%s' depends on unknown task '%s'", name, dep)
+			}
+			if err := visit(dep); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[name] = visited
+		order = append(order, name)
+		return nil
+	}
+
+	for _, task := range tg.Tasks {
+		if err := visit(task.Name); err != nil {
+			return nil, err
+		}
+	}
+	return order, nil
+}
+
 // LookupTask finds a task by name
 func (tg *TaskGroup) LookupTask(name string) *Task {
 	for _, t := range tg.Tasks {
@@ -966,6 +1115,24 @@ type Task struct {
 	// Config is provided to the driver to initialize
 	Config map[string]string
 
+	// Env is a set of environment variables passed to the task. Values
+	// may reference other variables using ${NAME} and secrets of the task
+	// using ${secret:NAME}.
+	Env map[string]string
+
+	// EnvFiles are files of KEY=VALUE lines, rendered by a template or
+	// fetched as an artifact, whose variables are added to the environment
+	// of the task. Paths are relative to the task directory and later files
+	// override earlier ones.
+	EnvFiles []string `mapstructure:"env_files"`
+
+	// User is the user, by name or uid, the exec and raw_exec drivers run
+	// the task as. Group is its group, by name or gid, defaulting to the
+	// primary group of the user. If neither is set the driver's default
+	// user is used.
+	User  string
+	Group string
+
 	// Constraints can be specified at a task level and apply only to
 	// the particular task.
 	Constraints []*Constraint
@@ -976,6 +1143,142 @@ type Task struct {
 	// Meta is used to associate arbitrary metadata with this
 	// task. This is opaque to Nomad.
 	Meta map[string]string
+
+	// RestartPolicy controls how the client restarts the task when it
+	// fails. If nil the task is not restarted.
+	RestartPolicy *RestartPolicy
+
+	// KillTimeout is the time the task is given to exit after being
+	// asked to stop before it is forcefully killed. If zero the client
+	// default is used.
+	KillTimeout time.Duration `mapstructure:"kill_timeout"`
+
+	// KillSignal is the name of the signal, such as "SIGINT", the task is
+	// asked to stop with. If empty the driver's stop mechanism is used,
+	// which sends SIGTERM where signals are supported.
+	KillSignal string `mapstructure:"kill_signal"`
+
+	// ShutdownDelay is the time waited between the task being stopped from
+	// receiving traffic and it being asked to stop, e.g. to let load
+	// balancers drain its connections.
+	ShutdownDelay time.Duration `mapstructure:"shutdown_delay"`
+
+	// MaxRuntime is how long the task may run for once started before the
+	// client kills it, such as to bound batch tasks. If zero the task may
+	// run forever.
+	MaxRuntime time.Duration `mapstructure:"max_runtime"`
+
+	// MaxRuntimeFailure is whether a task killed for exceeding its max
+	// runtime failed, in which case it is restarted according to its
+	// restart policy. Otherwise the task is stopped.
+	MaxRuntimeFailure bool `mapstructure:"max_runtime_failure"`
+
+	// LogConfig controls the rotation of the stdout and stderr log files
+	// of the task. If nil the defaults are used.
+	LogConfig *LogConfig
+
+	// Templates are rendered into the task directory before the task is
+	// started.
+	Templates []*Template
+
+	// Artifacts are downloaded into the task directory before the task is
+	// started.
+	Artifacts []*TaskArtifact
+
+	// Checks are run by the client against the running task to determine
+	// if it is healthy.
+	Checks []*TaskCheck
+
+	// Services are registered with the local Consul agent while the task
+	// is running, and healthy if it has checks.
+	Services []*Service
+
+	// DependsOn lists the tasks of the group that must be running, and
+	// healthy if they have checks, or have completed before this task is
+	// started.
+	DependsOn []string `mapstructure:"depends_on"`
+
+	// Lifecycle is the phase of the group the task runs in, one of the
+	// TaskLifecycle constants. Tasks are main tasks by default.
+	Lifecycle string
+
+	// Leader marks the main task of the group. Once it exits, the other
+	// tasks of the group are stopped.
+	Leader bool
+
+	// Volumes are host paths mounted into the task. The client only allows
+	// sources within its volume whitelist.
+	Volumes []*TaskVolume
+
+	// Secrets maps file names to the values written into the secrets
+	// directory of the task before it is started. The client never persists
+	// them.
+	Secrets map[string]string
+
+	// ProviderSecrets are read from the secret provider of the client, such
+	// as Vault, before the task is started. The fields of each are added to
+	// the secrets of the task.
+	ProviderSecrets []*ProviderSecret
+}
+
+// The lifecycle phases of the tasks of a group
+const (
+	// TaskLifecyclePrestart tasks run to successful completion before the
+	// other tasks of the group are started, such as to prepare their data
+	TaskLifecyclePrestart = "prestart"
+
+	// TaskLifecyclePoststart tasks are started once the main tasks are
+	// running, and stopped once those have all exited
+	TaskLifecyclePoststart = "poststart"
+
+	// TaskLifecycleMain tasks are the workload of the group
+	TaskLifecycleMain = "main"
+
+	// TaskLifecycleSidecar tasks run alongside the main tasks, and are
+	// stopped once those have all exited
+	TaskLifecycleSidecar = "sidecar"
+)
+
+// TaskLifecycles are the lifecycle phases a task may run in
+var TaskLifecycles = []string{
+	TaskLifecyclePrestart, TaskLifecyclePoststart, TaskLifecycleMain, TaskLifecycleSidecar,
+}
+
+// LifecyclePhase returns the lifecycle phase of the task, defaulting to main
+func (t *Task) LifecyclePhase() string {
+	if t.Lifecycle == "" {
+		return TaskLifecycleMain
+	}
+	return t.Lifecycle
+}
+
+// KillSignals are the names of the signals a task may be asked to stop with
+var KillSignals = []string{
+	"SIGABRT", "SIGHUP", "SIGINT", "SIGKILL", "SIGQUIT", "SIGTERM", "SIGUSR1", "SIGUSR2",
+}
+
+// validFileName returns whether the name is that of a file within a
+// directory, rather than a path
+func validFileName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func validLifecycle(name string) bool {
+	for _, l := range TaskLifecycles {
+		if l == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validKillSignal(name string) bool {
+	for _, sig := range KillSignals {
+		if sig == name {
+			return true
+		}
+	}
+	return false
 }
 
 func (t *Task) GoString() string {
@@ -993,6 +1296,1055 @@ func (t *Task) Validate() error {
 	}
 	if t.Resources == nil {
 		mErr.Errors = append(mErr.Errors, errors.New("Missing task resources"))
+	} else if err := t.Resources.Validate(); err != nil {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Resources validation failed: %s", err))
+	}
+	if t.KillTimeout < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Kill timeout must be non-negative"))
+	}
+	if t.ShutdownDelay < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Shutdown delay must be non-negative"))
+	}
+	if t.MaxRuntime < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Max runtime must be non-negative"))
+	}
+	if t.KillSignal != "" && !validKillSignal(t.KillSignal) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Kill signal '%s' is not one of %s",
+			t.KillSignal, strings.Join(KillSignals, ", ")))
+	}
+	for _, dep := range t.DependsOn {
+		if dep == t.Name {
+			mErr.Errors = append(mErr.Errors, errors.New("Task can not depend on itself"))
+		}
+	}
+	if t.Lifecycle != "" && !validLifecycle(t.Lifecycle) {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Lifecycle '%s' is not one of %s",
+			t.Lifecycle, strings.Join(TaskLifecycles, ", ")))
+	} else if t.Leader && t.LifecyclePhase() != TaskLifecycleMain {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Leader task must be a main task, not %s", t.Lifecycle))
+	}
+	if t.RestartPolicy != nil {
+		if err := t.RestartPolicy.Validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	if t.LogConfig != nil {
+		if err := t.LogConfig.Validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	for idx, artifact := range t.Artifacts {
+		if err := artifact.Validate(); err != nil {
+			outer := fmt.Errorf("Artifact %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	volumes := make(map[string]int)
+	for idx, volume := range t.Volumes {
+		if existing, ok := volumes[volume.Destination]; ok && volume.Destination != "" {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Volume %d is mounted at '%s' like volume %d", idx+1, volume.Destination, existing+1))
+		} else {
+			volumes[volume.Destination] = idx
+		}
+		if err := volume.Validate(); err != nil {
+			outer := fmt.Errorf("Volume %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	for idx, path := range t.EnvFiles {
+		if path == "" {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Env file %d is missing a path", idx+1))
+		} else if filepath.IsAbs(path) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Env file '%s' must be relative to the task directory", path))
+		}
+	}
+	for name := range t.Secrets {
+		if !validFileName(name) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Secret name '%s' must be a file name", name))
+		}
+	}
+	for idx, secret := range t.ProviderSecrets {
+		if err := secret.Validate(); err != nil {
+			outer := fmt.Errorf("Provider secret %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	for idx, tmpl := range t.Templates {
+		if err := tmpl.Validate(); err != nil {
+			outer := fmt.Errorf("Template %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	checks := make(map[string]int)
+	for idx, check := range t.Checks {
+		if check.Name != "" {
+			if existing, ok := checks[check.Name]; ok {
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("Check %d redefines '%s' from check %d", idx+1, check.Name, existing+1))
+			} else {
+				checks[check.Name] = idx
+			}
+		}
+		if err := check.Validate(); err != nil {
+			outer := fmt.Errorf("Check %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	var labels []string
+	if t.Resources != nil && len(t.Resources.Networks) != 0 {
+		labels = t.Resources.Networks[0].DynamicPorts
+	}
+	services := make(map[string]int)
+	for idx, service := range t.Services {
+		if service.Name != "" {
+			if existing, ok := services[service.Name]; ok {
+				mErr.Errors = append(mErr.Errors, fmt.Errorf("Service %d redefines '%s' from service %d", idx+1, service.Name, existing+1))
+			} else {
+				services[service.Name] = idx
+			}
+		}
+		if err := service.Validate(labels); err != nil {
+			outer := fmt.Errorf("Service %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// TaskArtifact is a file downloaded into the task directory before the task
+// is started. Archives are extracted into the destination.
+type TaskArtifact struct {
+	// Source is the http or https URL of the artifact
+	Source string
+
+	// Checksum is optionally used to verify the artifact, in the form
+	// <type>:<hex digest> where type is sha256 or sha512
+	Checksum string
+
+	// Destination is the directory, relative to the task directory, the
+	// artifact is placed in. Defaults to the local directory.
+	Destination string
+}
+
+// Validate is used to sanity check an artifact
+func (a *TaskArtifact) Validate() error {
+	var mErr multierror.Error
+	if a.Source == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing artifact source"))
+	} else if !strings.HasPrefix(a.Source, "http://") && !strings.HasPrefix(a.Source, "https://") {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Unsupported artifact source '%s'", a.Source))
+	}
+	if a.Checksum != "" {
+		parts := strings.SplitN(a.Checksum, ":", 2)
+		if len(parts) != 2 || (parts[0] != "sha256" && parts[0] != "sha512") || parts[1] == "" {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Invalid artifact checksum '%s'", a.Checksum))
+		}
+	}
+	if filepath.IsAbs(a.Destination) {
+		mErr.Errors = append(mErr.Errors, errors.New("Artifact destination must be relative to the task directory"))
+	}
+	return mErr.ErrorOrNil()
+}
+
+// TaskVolume is a host path mounted into the task
+type TaskVolume struct {
+	// Source is the absolute path on the host that is mounted
+	Source string
+
+	// Destination is the absolute path the source is mounted at, inside
+	// the container or chroot of the task
+	Destination string
+
+	// ReadOnly mounts the source read-only
+	ReadOnly bool `mapstructure:"read_only"`
+}
+
+// Validate is used to sanity check a volume
+func (v *TaskVolume) Validate() error {
+	var mErr multierror.Error
+	if v.Source == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing volume source"))
+	} else if !filepath.IsAbs(v.Source) {
+		mErr.Errors = append(mErr.Errors, errors.New("Volume source must be an absolute path"))
+	}
+	if v.Destination == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing volume destination"))
+	} else if !filepath.IsAbs(v.Destination) {
+		mErr.Errors = append(mErr.Errors, errors.New("Volume destination must be an absolute path"))
+	}
+	return mErr.ErrorOrNil()
+}
+
+// Template is used to render a file into the task directory using the
+// environment of the task
+type Template struct {
+	// EmbeddedTmpl is the text/template rendered with the environment of
+	// the task
+	EmbeddedTmpl string `mapstructure:"data"`
+
+	// DestPath is the path, relative to the task directory, the output
+	// is written to. It must be inside the alloc dir.
+	DestPath string `mapstructure:"destination"`
+
+	// ChangeMode is what is done to the running task when an update changes
+	// the output, one of the TemplateChangeMode constants. Defaults to
+	// signaling the task.
+	ChangeMode string `mapstructure:"change_mode"`
+
+	// ChangeSignal is the name of the signal sent to the task in the signal
+	// change mode. Defaults to SIGHUP.
+	ChangeSignal string `mapstructure:"change_signal"`
+}
+
+const (
+	// TemplateChangeModeSignal rewrites the file in place and signals the
+	// task to reload it. Tasks whose driver can't signal them are restarted
+	// instead.
+	TemplateChangeModeSignal = "signal"
+
+	// TemplateChangeModeRestart rewrites the file and restarts the task
+	TemplateChangeModeRestart = "restart"
+
+	// TemplateChangeModeNoop only rewrites the file
+	TemplateChangeModeNoop = "noop"
+
+	// DefaultTemplateChangeSignal is the signal sent when a template
+	// changes, unless it sets another one
+	DefaultTemplateChangeSignal = "SIGHUP"
+)
+
+// OnChange returns the change mode of the template and the signal sent in
+// the signal mode, applying the defaults.
+func (t *Template) OnChange() (string, string) {
+	mode, signal := t.ChangeMode, t.ChangeSignal
+	if mode == "" {
+		mode = TemplateChangeModeSignal
+	}
+	if signal == "" {
+		signal = DefaultTemplateChangeSignal
+	}
+	return mode, signal
+}
+
+// Validate is used to sanity check a template
+func (t *Template) Validate() error {
+	var mErr multierror.Error
+	if t.DestPath == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing template destination"))
+	} else if filepath.IsAbs(t.DestPath) {
+		mErr.Errors = append(mErr.Errors, errors.New("Template destination must be relative to the task directory"))
+	}
+	switch t.ChangeMode {
+	case "", TemplateChangeModeSignal, TemplateChangeModeRestart, TemplateChangeModeNoop:
+	default:
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Template change mode '%s' is not one of %s, %s or %s",
+			t.ChangeMode, TemplateChangeModeSignal, TemplateChangeModeRestart, TemplateChangeModeNoop))
+	}
+	if t.ChangeSignal != "" {
+		if mode, _ := t.OnChange(); mode != TemplateChangeModeSignal {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Template change signal is only sent in the %s change mode",
+				TemplateChangeModeSignal))
+		} else if !validKillSignal(t.ChangeSignal) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Template change signal '%s' is not one of %s",
+				t.ChangeSignal, strings.Join(KillSignals, ", ")))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// ProviderSecret is a secret the task reads from the secret provider of the
+// client. Each field of the secret is a secret of the task named after the
+// field, which is renewed before its lease runs out while the task runs.
+type ProviderSecret struct {
+	// Path is the path of the secret in the provider
+	Path string `mapstructure:"path"`
+
+	// ChangeMode is what is done to the running task when a renewal changes
+	// the secret or fails, one of the SecretChangeMode constants. Defaults to
+	// restarting the task.
+	ChangeMode string `mapstructure:"change_mode"`
+
+	// ChangeSignal is the name of the signal sent to the task in the signal
+	// change mode. Defaults to SIGHUP.
+	ChangeSignal string `mapstructure:"change_signal"`
+}
+
+const (
+	// SecretChangeModeRestart restarts the task, which fetches the secret
+	// again before it is started
+	SecretChangeModeRestart = "restart"
+
+	// SecretChangeModeSignal rewrites the secret in place and signals the
+	// task to reload it. Tasks whose driver can't signal them are restarted
+	// instead.
+	SecretChangeModeSignal = "signal"
+
+	// SecretChangeModeNoop only rewrites the secret
+	SecretChangeModeNoop = "noop"
+
+	// DefaultSecretChangeSignal is the signal sent when a secret changes,
+	// unless it sets another one
+	DefaultSecretChangeSignal = "SIGHUP"
+)
+
+// OnChange returns the change mode of the secret and the signal sent in the
+// signal mode, applying the defaults.
+func (s *ProviderSecret) OnChange() (string, string) {
+	mode, signal := s.ChangeMode, s.ChangeSignal
+	if mode == "" {
+		mode = SecretChangeModeRestart
+	}
+	if signal == "" {
+		signal = DefaultSecretChangeSignal
+	}
+	return mode, signal
+}
+
+// Validate is used to sanity check a provider secret
+func (s *ProviderSecret) Validate() error {
+	var mErr multierror.Error
+	if s.Path == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing secret path"))
+	}
+	switch s.ChangeMode {
+	case "", SecretChangeModeRestart, SecretChangeModeSignal, SecretChangeModeNoop:
+	default:
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Secret change mode '%s' is not one of %s, %s or %s",
+			s.ChangeMode, SecretChangeModeRestart, SecretChangeModeSignal, SecretChangeModeNoop))
+	}
+	if s.ChangeSignal != "" {
+		if mode, _ := s.OnChange(); mode != SecretChangeModeSignal {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Secret change signal is only sent in the %s change mode",
+				SecretChangeModeSignal))
+		} else if !validKillSignal(s.ChangeSignal) {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Secret change signal '%s' is not one of %s",
+				s.ChangeSignal, strings.Join(KillSignals, ", ")))
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+const (
+	// TaskCheckTypeTCP checks that a TCP connection can be established
+	TaskCheckTypeTCP = "tcp"
+
+	// TaskCheckTypeHTTP checks that a GET request returns the expected
+	// status code
+	TaskCheckTypeHTTP = "http"
+
+	// TaskCheckTypeScript checks that a command exits successfully
+	TaskCheckTypeScript = "script"
+
+	// TaskCheckTypeLog checks that the task logs a line matching a pattern
+	TaskCheckTypeLog = "log"
+
+	// TaskCheckLogStdout and TaskCheckLogStderr are the logs a log check
+	// may tail
+	TaskCheckLogStdout = "stdout"
+	TaskCheckLogStderr = "stderr"
+)
+
+// TaskCheck is a health check run by the client against a running task. The
+// address, URL and arguments may reference the environment of the task,
+// e.g. ${NOMAD_PORT_http}.
+type TaskCheck struct {
+	// Name uniquely identifies the check within the task
+	Name string
+
+	// Type is one of tcp, http, script or log
+	Type string
+
+	// Address is the host:port a tcp check connects to
+	Address string
+
+	// URL is requested by an http check
+	URL string
+
+	// ExpectedStatus is the status code an http check expects. Defaults
+	// to 200.
+	ExpectedStatus int `mapstructure:"expected_status"`
+
+	// Command and Args are run from the task directory by a script check
+	Command string
+	Args    string
+
+	// Pattern is the regular expression a line of the log must match for a
+	// log check to pass, and Log the log it tails, stdout or stderr.
+	// Defaults to stdout.
+	Pattern string
+	Log     string
+
+	// Interval is the time between runs of the check. Log checks run once.
+	Interval time.Duration
+
+	// Timeout bounds a single run of the check. Defaults to the interval.
+	// A log check fails if the pattern is not matched within the timeout
+	// after its grace period, and waits indefinitely if it is zero.
+	Timeout time.Duration
+
+	// GracePeriod delays the first run of the check after the task starts
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+
+	// SuccessThreshold is the number of consecutive passes required for
+	// the check to become healthy. Defaults to 1.
+	SuccessThreshold int `mapstructure:"success_threshold"`
+
+	// FailureThreshold is the number of consecutive failures required for
+	// the check to become unhealthy. Defaults to 1.
+	FailureThreshold int `mapstructure:"failure_threshold"`
+}
+
+// Validate is used to sanity check a task check
+func (c *TaskCheck) Validate() error {
+	var mErr multierror.Error
+	if c.Name == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing check name"))
+	}
+	switch c.Type {
+	case TaskCheckTypeTCP:
+		if c.Address == "" {
+			mErr.Errors = append(mErr.Errors, errors.New("Missing address for tcp check"))
+		}
+	case TaskCheckTypeHTTP:
+		if c.URL == "" {
+			mErr.Errors = append(mErr.Errors, errors.New("Missing URL for http check"))
+		}
+		if c.ExpectedStatus < 0 {
+			mErr.Errors = append(mErr.Errors, errors.New("Expected status must be non-negative"))
+		}
+	case TaskCheckTypeScript:
+		if c.Command == "" {
+			mErr.Errors = append(mErr.Errors, errors.New("Missing command for script check"))
+		}
+	case TaskCheckTypeLog:
+		if c.Pattern == "" {
+			mErr.Errors = append(mErr.Errors, errors.New("Missing pattern for log check"))
+		} else if _, err := regexp.Compile(c.Pattern); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Invalid pattern for log check: %v", err))
+		}
+		switch c.Log {
+		case "", TaskCheckLogStdout, TaskCheckLogStderr:
+		default:
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Unsupported log '%s' for log check", c.Log))
+		}
+	default:
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Unsupported check type '%s'", c.Type))
+	}
+	if c.Interval <= 0 && c.Type != TaskCheckTypeLog {
+		mErr.Errors = append(mErr.Errors, errors.New("Check interval must be positive"))
+	}
+	if c.Timeout < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Check timeout must be non-negative"))
+	}
+	if c.GracePeriod < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Check grace period must be non-negative"))
+	}
+	if c.SuccessThreshold < 0 || c.FailureThreshold < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Check thresholds must be non-negative"))
+	}
+	return mErr.ErrorOrNil()
+}
+
+// Service is a service of the task registered with the local Consul agent.
+// Its address is the IP of the task's network and its port the host port
+// mapped to the port label.
+type Service struct {
+	// Name is the name of the service in Consul
+	Name string
+
+	// PortLabel is the label of the dynamic port the service listens on
+	PortLabel string `mapstructure:"port"`
+
+	// Tags are registered with the service
+	Tags []string
+
+	// Checks are run by the Consul agent against the service
+	Checks []*ServiceCheck
+}
+
+// Validate is used to sanity check a service against the labels of the
+// dynamic ports of the task
+func (s *Service) Validate(labels []string) error {
+	var mErr multierror.Error
+	if s.Name == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing service name"))
+	}
+	if s.PortLabel == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing service port"))
+	} else {
+		found := false
+		for _, label := range labels {
+			if label == s.PortLabel {
+				found = true
+				break
+			}
+		}
+		if !found {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Port '%s' is not a dynamic port of the task", s.PortLabel))
+		}
+	}
+	for idx, check := range s.Checks {
+		if err := check.Validate(); err != nil {
+			outer := fmt.Errorf("Check %d validation failed: %s", idx+1, err)
+			mErr.Errors = append(mErr.Errors, outer)
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+// ServiceCheck is a check run by the Consul agent against the address of
+// the service.
+type ServiceCheck struct {
+	// Name identifies the check in Consul
+	Name string
+
+	// Type is either tcp or http
+	Type string
+
+	// Path is requested by an http check
+	Path string
+
+	// Interval is the time between runs of the check
+	Interval time.Duration
+
+	// Timeout bounds a single run of the check
+	Timeout time.Duration
+}
+
+// Validate is used to sanity check a service check
+func (c *ServiceCheck) Validate() error {
+	var mErr multierror.Error
+	if c.Name == "" {
+		mErr.Errors = append(mErr.Errors, errors.New("Missing check name"))
+	}
+	switch c.Type {
+	case TaskCheckTypeTCP, TaskCheckTypeHTTP:
+	default:
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Unsupported service check type '%s'", c.Type))
+	}
+	if c.Interval <= 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Check interval must be positive"))
+	}
+	if c.Timeout < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Check timeout must be non-negative"))
+	}
+	return mErr.ErrorOrNil()
+}
+
+const (
+	// TaskReceived is recorded when the client receives the task
+	TaskReceived = "Received"
+
+	// TaskStarted is recorded when the driver started the task
+	TaskStarted = "Started"
+
+	// TaskDriverFailure is recorded when the driver could not be created or
+	// failed to start the task
+	TaskDriverFailure = "Driver Failure"
+
+	// TaskValidationFailed is recorded when the driver rejects the config
+	// of the task before it is started
+	TaskValidationFailed = "Validation Failed"
+
+	// TaskArtifactDownloadFailed is recorded when an artifact could not be
+	// downloaded
+	TaskArtifactDownloadFailed = "Failed Artifact Download"
+
+	// TaskStartQueued is recorded when the task waits for the client to
+	// have a slot to start it in
+	TaskStartQueued = "Start Queued"
+
+	// TaskDownloadQueued is recorded when an artifact waits for the client
+	// to have a free download slot
+	TaskDownloadQueued = "Download Queued"
+
+	// TaskTemplateFailure is recorded when a template could not be rendered
+	TaskTemplateFailure = "Template Failure"
+
+	// TaskSecretsFailure is recorded when the secrets could not be fetched
+	// from the secret provider, renewed, or written into the secrets
+	// directory of the task
+	TaskSecretsFailure = "Secrets Failure"
+
+	// TaskEnvFileFailure is recorded when an env file of the task could not
+	// be read or parsed
+	TaskEnvFileFailure = "Env File Failure"
+
+	// TaskHookFailed is recorded when a hook failed before the task was
+	// started
+	TaskHookFailed = "Hook Failed"
+
+	// TaskPortConflict is recorded when a static port of the task is
+	// already in use on the node
+	TaskPortConflict = "Port Conflict"
+
+	// TaskRestoreFailed is recorded when the client could not reattach to
+	// the task after restarting
+	TaskRestoreFailed = "Restore Failed"
+
+	// TaskHealthy and TaskUnhealthy are recorded when the health of the
+	// task, as determined by its checks, changes
+	TaskHealthy   = "Healthy"
+	TaskUnhealthy = "Unhealthy"
+
+	// TaskSignaling is recorded when a signal is sent to the task
+	TaskSignaling = "Signaling"
+
+	// TaskTerminated is recorded when the task exits
+	TaskTerminated = "Terminated"
+
+	// TaskExitedTooQuickly is recorded when the task exits successfully
+	// within the min healthy time of its restart policy, which counts as a
+	// failure
+	TaskExitedTooQuickly = "Exited Too Quickly"
+
+	// TaskRestarting is recorded when a failed task is going to be
+	// restarted, and TaskNotRestarting when it is not
+	TaskRestarting    = "Restarting"
+	TaskNotRestarting = "Not Restarting"
+
+	// TaskRestartsThrottled is recorded instead of TaskNotRestarting when the
+	// task is not restarted because it failed more times within the interval
+	// of its restart policy than the policy allows. The task stays dead, or
+	// failed, until the scheduler places a new version of the allocation.
+	TaskRestartsThrottled = "Restarts Throttled"
+
+	// TaskDraining is recorded when the shutdown delay of the task starts
+	TaskDraining = "Draining"
+
+	// TaskDiskQuotaExceeded is recorded when the local dir of the task grows
+	// past its disk resources
+	TaskDiskQuotaExceeded = "Disk Quota Exceeded"
+
+	// TaskMemorySoftLimitExceeded is recorded when the memory usage of the
+	// task grows past its reservation, so it is at risk of being reclaimed
+	// under memory pressure
+	TaskMemorySoftLimitExceeded = "Memory Soft Limit Exceeded"
+
+	// TaskLost is recorded when the task is found gone on reattaching to it
+	// after a client restart, such as a process that exited while the
+	// client was down. Its restart policy decides what happens next.
+	TaskLost = "Lost"
+
+	// TaskUpdateFailed is recorded when the driver rejects an update of the
+	// task, which keeps running as it was
+	TaskUpdateFailed = "Update Failed"
+
+	// TaskDeadlineExceeded is recorded when the task runs for longer than
+	// its max runtime, so it is killed
+	TaskDeadlineExceeded = "Deadline Exceeded"
+
+	// TaskKilling is recorded when the task is asked to stop, and TaskKilled
+	// once it stopped
+	TaskKilling = "Killing"
+	TaskKilled  = "Killed"
+
+	// TaskDependencyFailed is recorded when a task the task depends on
+	// failed, in which case the task is not started or is killed
+	TaskDependencyFailed = "Dependency Failed"
+
+	// TaskLeaderDead is recorded when the task is stopped because the
+	// leader task of its group exited
+	TaskLeaderDead = "Leader Task Dead"
+
+	// TaskMainDead is recorded when a sidecar or poststart task is stopped
+	// because the main tasks of its group have all exited
+	TaskMainDead = "Main Tasks Dead"
+)
+
+// The reasons the client kills a task for
+const (
+	// TaskKillReasonStopped is used when the allocation is stopped or
+	// removed from the client
+	TaskKillReasonStopped = "stopped"
+
+	// TaskKillReasonRestarting is used when the task is killed to be
+	// restarted
+	TaskKillReasonRestarting = "restarting"
+
+	// TaskKillReasonLeaderDead is used when the leader task of the group
+	// exited
+	TaskKillReasonLeaderDead = "leader dead"
+
+	// TaskKillReasonMainDead is used when the main tasks of the group have
+	// all exited
+	TaskKillReasonMainDead = "main dead"
+
+	// TaskKillReasonDependencyFailed is used when a task the task depends on
+	// failed
+	TaskKillReasonDependencyFailed = "dependency failed"
+
+	// TaskKillReasonDiskQuota is used when the task exceeded its disk quota
+	TaskKillReasonDiskQuota = "disk quota exceeded"
+
+	// TaskKillReasonNodeDrain is used when the node of the task is drained
+	TaskKillReasonNodeDrain = "node drain"
+
+	// TaskKillReasonDeadline is used when the task exceeded its max runtime
+	TaskKillReasonDeadline = "deadline exceeded"
+)
+
+// TaskEvent is an event in the lifecycle of a task. Besides the message,
+// events carry the details relevant to their type, such as the exit code of
+// a terminated task or the restart count of a restarting one.
+type TaskEvent struct {
+	Type string
+
+	// Time is the Unix nanosecond timestamp of the event
+	Time int64
+
+	// Message describes the event for operators
+	Message string
+
+	// ExitCode and Signal are how the task exited
+	ExitCode int
+	Signal   int
+
+	// RestartCount is the number of restarts of the task in the current
+	// restart interval
+	RestartCount int
+
+	// RestartMode is the mode of the restart policy the task is restarted
+	// or not restarted under
+	RestartMode string
+
+	// RestartAttempts and RestartInterval are the restarts the policy of a
+	// throttled task allows within the interval, and RestartWindow how long
+	// ago the current interval started
+	RestartAttempts int
+	RestartInterval time.Duration
+	RestartWindow   time.Duration
+
+	// Hook is the name of the hook that failed the task
+	Hook string
+
+	// KillReason is why the client killed the task, one of the
+	// TaskKillReason constants
+	KillReason string
+}
+
+func (te *TaskEvent) GoString() string {
+	return fmt.Sprintf("%v at %v", te.Type, te.Time)
+}
+
+// NewTaskEvent returns an event of the given type timestamped now
+func NewTaskEvent(event string) *TaskEvent {
+	return &TaskEvent{
+		Type: event,
+		Time: time.Now().UnixNano(),
+	}
+}
+
+// SetMessage is used to set the message of the event
+func (te *TaskEvent) SetMessage(msg string) *TaskEvent {
+	te.Message = msg
+	return te
+}
+
+// SetHook is used to set the name of the hook the event is about
+func (te *TaskEvent) SetHook(name string) *TaskEvent {
+	te.Hook = name
+	return te
+}
+
+// SetKillReason is used to set why the client killed the task
+func (te *TaskEvent) SetKillReason(reason string) *TaskEvent {
+	te.KillReason = reason
+	return te
+}
+
+// SetExitCode is used to set the exit code of the task
+func (te *TaskEvent) SetExitCode(code int) *TaskEvent {
+	te.ExitCode = code
+	return te
+}
+
+// SetSignal is used to set the signal the task was sent or killed with
+func (te *TaskEvent) SetSignal(sig int) *TaskEvent {
+	te.Signal = sig
+	return te
+}
+
+// SetRestartCount is used to set the restart count of the task
+func (te *TaskEvent) SetRestartCount(count int) *TaskEvent {
+	te.RestartCount = count
+	return te
+}
+
+// SetRestartMode is used to set the restart mode the task is restarted under
+func (te *TaskEvent) SetRestartMode(mode string) *TaskEvent {
+	te.RestartMode = mode
+	return te
+}
+
+// SetRestartWindow is used to set the restarts the policy allows within the
+// interval and how much of the current interval has elapsed
+func (te *TaskEvent) SetRestartWindow(attempts int, interval, window time.Duration) *TaskEvent {
+	te.RestartAttempts = attempts
+	te.RestartInterval = interval
+	te.RestartWindow = window
+	return te
+}
+
+// The reasons a task reached a terminal status for
+const (
+	// TaskExitCompleted is used when the task exited with code zero of its
+	// own accord
+	TaskExitCompleted = "completed"
+
+	// TaskExitFailed is used when the task exited with a non-zero code
+	TaskExitFailed = "failed"
+
+	// TaskExitSignaled is used when the task was killed by a signal
+	TaskExitSignaled = "signaled"
+
+	// TaskExitOOMKilled is used when the task was killed for running out of
+	// memory
+	TaskExitOOMKilled = "oom killed"
+
+	// TaskExitError is used when the task couldn't be waited on, or exited
+	// successfully but failed regardless
+	TaskExitError = "error"
+
+	// TaskExitNotStarted is used when the task reached a terminal status
+	// without being started
+	TaskExitNotStarted = "not started"
+)
+
+// TaskExit is how a task that reached a terminal status exited, for higher
+// layers to show without parsing the description of the status.
+type TaskExit struct {
+	// Reason is one of the TaskExit constants
+	Reason string
+
+	// ExitCode and Signal are how the task exited
+	ExitCode int
+	Signal   int
+
+	// RestartCount is the number of times the task was restarted
+	RestartCount int
+
+	// KillReason is why the client killed the task, if it did, one of the
+	// TaskKillReason constants
+	KillReason string
+
+	// Error is what went wrong, for the error and not started reasons
+	Error string `json:",omitempty"`
+}
+
+// String describes the exit for operators, such as
+// "Exit Code 137 (OOM), restarted 3 times"
+func (e *TaskExit) String() string {
+	var desc string
+	switch e.Reason {
+	case TaskExitCompleted:
+		desc = "Completed"
+	case TaskExitFailed:
+		desc = fmt.Sprintf("Exit Code %d", e.ExitCode)
+	case TaskExitSignaled:
+		desc = fmt.Sprintf("Exit Code %d (Signal %d)", e.ExitCode, e.Signal)
+	case TaskExitOOMKilled:
+		desc = fmt.Sprintf("Exit Code %d (OOM)", e.ExitCode)
+	case TaskExitNotStarted:
+		desc = fmt.Sprintf("Not Started: %s", e.Error)
+	default:
+		desc = fmt.Sprintf("Error: %s", e.Error)
+	}
+	if e.KillReason != "" {
+		desc = fmt.Sprintf("%s, killed by the client (%s)", desc, e.KillReason)
+	}
+	switch e.RestartCount {
+	case 0:
+	case 1:
+		desc += ", restarted 1 time"
+	default:
+		desc = fmt.Sprintf("%s, restarted %d times", desc, e.RestartCount)
+	}
+	return desc
+}
+
+const (
+	// DefaultLogMaxFiles is the number of log files retained per output
+	// stream of a task if not configured
+	DefaultLogMaxFiles = 10
+
+	// DefaultLogMaxFileSizeMB is the size a log file may grow to before it
+	// is rotated if not configured
+	DefaultLogMaxFileSizeMB = 10
+)
+
+// LogConfig is used to control the rotation of a task's log files
+type LogConfig struct {
+	// MaxFiles is the number of files retained per output stream
+	MaxFiles int `mapstructure:"max_files"`
+
+	// MaxFileSizeMB is the size a file may grow to before it is rotated
+	MaxFileSizeMB int `mapstructure:"max_file_size"`
+
+	// Syslog, if set, forwards the lines of output to syslog as well
+	Syslog *SyslogLogConfig
+}
+
+const (
+	// DefaultSyslogFacility is the facility the output of a task is
+	// forwarded to syslog with if not configured
+	DefaultSyslogFacility = "user"
+)
+
+// SyslogFacilities are the names of the syslog facilities output may be
+// forwarded with
+var SyslogFacilities = []string{
+	"kern", "user", "mail", "daemon", "auth", "syslog", "lpr", "news", "uucp",
+	"cron", "authpriv", "ftp", "local0", "local1", "local2", "local3",
+	"local4", "local5", "local6", "local7",
+}
+
+// SyslogLogConfig configures forwarding the stdout and stderr of a task to
+// syslog. Lines are forwarded with the info severity from stdout and the err
+// severity from stderr.
+type SyslogLogConfig struct {
+	// Address is "udp://host:port" or "tcp://host:port" for a remote syslog
+	// server. If empty, the local syslog daemon is used.
+	Address string `mapstructure:"address"`
+
+	// Facility is the facility lines are forwarded with. Defaults to user.
+	Facility string `mapstructure:"facility"`
+
+	// Tag identifies the task in the forwarded lines. Defaults to the name
+	// of the task.
+	Tag string `mapstructure:"tag"`
+
+	// DisableFiles forwards the output instead of writing it to the log
+	// files too, which leaves nothing to stream from the alloc dir
+	DisableFiles bool `mapstructure:"disable_files"`
+}
+
+// Endpoint returns the network and address of the syslog server. An empty
+// network is the local syslog daemon.
+func (s *SyslogLogConfig) Endpoint() (network, address string) {
+	if i := strings.Index(s.Address, "://"); i >= 0 {
+		return s.Address[:i], s.Address[i+3:]
+	}
+	return "", s.Address
+}
+
+// Validate is used to sanity check forwarding to syslog
+func (s *SyslogLogConfig) Validate() error {
+	var mErr multierror.Error
+	if s.Address != "" {
+		network, addr := s.Endpoint()
+		if network != "udp" && network != "tcp" {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Syslog address '%s' must start with udp:// or tcp://", s.Address))
+		} else if _, _, err := net.SplitHostPort(addr); err != nil {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Syslog address '%s' is invalid: %v", s.Address, err))
+		}
+	}
+	if s.Facility != "" {
+		valid := false
+		for _, f := range SyslogFacilities {
+			valid = valid || f == s.Facility
+		}
+		if !valid {
+			mErr.Errors = append(mErr.Errors, fmt.Errorf("Syslog facility '%s' is not one of %s",
+				s.Facility, strings.Join(SyslogFacilities, ", ")))
+		}
+	}
+	if strings.ContainsAny(s.Tag, " :[]") {
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Syslog tag '%s' may not contain spaces, colons or brackets", s.Tag))
+	}
+	return mErr.ErrorOrNil()
+}
+
+// DefaultLogConfig returns the log configuration used by tasks that don't
+// specify one
+func DefaultLogConfig() *LogConfig {
+	return &LogConfig{
+		MaxFiles:      DefaultLogMaxFiles,
+		MaxFileSizeMB: DefaultLogMaxFileSizeMB,
+	}
+}
+
+// Validate is used to sanity check a log configuration
+func (l *LogConfig) Validate() error {
+	var mErr multierror.Error
+	if l.MaxFiles < 1 {
+		mErr.Errors = append(mErr.Errors, errors.New("Log max files must be at least one"))
+	}
+	if l.MaxFileSizeMB < 1 {
+		mErr.Errors = append(mErr.Errors, errors.New("Log max file size must be at least one MB"))
+	}
+	if l.Syslog != nil {
+		if err := l.Syslog.Validate(); err != nil {
+			mErr.Errors = append(mErr.Errors, err)
+		}
+	}
+	return mErr.ErrorOrNil()
+}
+
+const (
+	// RestartPolicyModeDelay causes the task to wait out the remainder of
+	// the interval once its attempts are exhausted and then keep restarting.
+	RestartPolicyModeDelay = "delay"
+
+	// RestartPolicyModeFail causes the task to be marked failed once its
+	// attempts are exhausted within the interval, so the scheduler may
+	// place it elsewhere.
+	RestartPolicyModeFail = "fail"
+
+	// RestartPolicyModeStop causes the task to be marked dead once its
+	// attempts are exhausted within the interval, only stopping it from
+	// being restarted locally. It is the default.
+	RestartPolicyModeStop = "stop"
+)
+
+// RestartPolicy is used to control how a failed task is restarted by the
+// client. Each restart waits for Delay, doubling on every consecutive
+// failure, and at most Attempts restarts are allowed within Interval.
+type RestartPolicy struct {
+	// Attempts is the number of restarts allowed within an Interval
+	Attempts int
+
+	// Interval is the window in which Attempts restarts are allowed
+	Interval time.Duration
+
+	// Delay is the initial wait before restarting a failed task
+	Delay time.Duration
+
+	// Mode controls what happens once the attempts are exhausted
+	Mode string
+
+	// Jitter randomizes each delay by up to this fraction of it in either
+	// direction, so tasks failing together don't restart together. It must
+	// be between 0 and 1.
+	Jitter float64
+
+	// MinHealthyTime is how long the task must run for its exit to reset
+	// the attempts. A task exiting sooner counts against the attempts even
+	// if it exited successfully. Zero disables both.
+	MinHealthyTime time.Duration `mapstructure:"min_healthy_time"`
+}
+
+// Validate is used to sanity check a restart policy
+func (r *RestartPolicy) Validate() error {
+	var mErr multierror.Error
+	if r.Attempts < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Restart attempts must be non-negative"))
+	}
+	if r.Interval <= 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Restart interval must be positive"))
+	}
+	if r.Delay < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Restart delay must be non-negative"))
+	}
+	switch r.Mode {
+	case "", RestartPolicyModeDelay, RestartPolicyModeFail, RestartPolicyModeStop:
+	default:
+		mErr.Errors = append(mErr.Errors, fmt.Errorf("Unsupported restart mode '%s'", r.Mode))
+	}
+	if r.Jitter < 0 || r.Jitter > 1 {
+		mErr.Errors = append(mErr.Errors, errors.New("Restart jitter must be between 0 and 1"))
+	}
+	if r.MinHealthyTime < 0 {
+		mErr.Errors = append(mErr.Errors, errors.New("Restart min healthy time must be non-negative"))
 	}
 	return mErr.ErrorOrNil()
 }
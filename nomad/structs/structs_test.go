@@ -4,6 +4,7 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 )
@@ -100,6 +101,114 @@ func TestTaskGroup_Validate(t *testing.T) {
 	}
 }
 
+func TestTaskGroup_Validate_Leader(t *testing.T) {
+	tg := &TaskGroup{
+		Name:  "web",
+		Count: 1,
+		Tasks: []*Task{
+			&Task{Name: "web", Leader: true},
+			&Task{Name: "proxy"},
+			&Task{Name: "logs", Leader: true},
+		},
+	}
+	err := tg.Validate()
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "Task 3 is marked as leader but task 1 already is") {
+		t.Fatalf("err: %s", err)
+	}
+
+	tg.Tasks[2].Leader = false
+	err = tg.Validate()
+	if err != nil && strings.Contains(err.Error(), "leader") {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestTaskGroup_Validate_Lifecycle(t *testing.T) {
+	tg := &TaskGroup{
+		Name:  "web",
+		Count: 1,
+		Tasks: []*Task{
+			&Task{Name: "init", Lifecycle: TaskLifecyclePrestart, DependsOn: []string{"web"}},
+			&Task{Name: "web", Leader: true},
+			&Task{Name: "logs", Lifecycle: TaskLifecycleSidecar, Leader: true},
+			&Task{Name: "warm", Lifecycle: "afterwards"},
+			&Task{Name: "metrics", Lifecycle: TaskLifecyclePoststart},
+			&Task{Name: "worker", DependsOn: []string{"metrics"}},
+		},
+	}
+	err := tg.Validate()
+	for _, exp := range []string{
+		"Leader task must be a main task, not sidecar",
+		"Lifecycle 'afterwards' is not one of prestart, poststart, main, sidecar",
+		"Prestart task 'init' can't depend on main task 'web'",
+		"Main task 'worker' can't depend on poststart task 'metrics'",
+	} {
+		if err == nil || !strings.Contains(err.Error(), exp) {
+			t.Fatalf("expected %q: %v", exp, err)
+		}
+	}
+
+	// Prestart tasks may depend on each other
+	tg.Tasks = []*Task{
+		&Task{Name: "fetch", Lifecycle: TaskLifecyclePrestart},
+		&Task{Name: "init", Lifecycle: TaskLifecyclePrestart, DependsOn: []string{"fetch"}},
+		&Task{Name: "web", DependsOn: []string{"init"}},
+		&Task{Name: "logs", Lifecycle: TaskLifecycleSidecar},
+		&Task{Name: "metrics", Lifecycle: TaskLifecyclePoststart, DependsOn: []string{"web", "logs"}},
+	}
+	err = tg.Validate()
+	if err != nil && (strings.Contains(err.Error(), "Lifecycle") || strings.Contains(err.Error(), "Prestart")) {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestTaskGroup_DependencyOrder(t *testing.T) {
+	// A diamond: web and worker both depend on db, and proxy on both
+	tg := &TaskGroup{
+		Tasks: []*Task{
+			&Task{Name: "proxy", DependsOn: []string{"web", "worker"}},
+			&Task{Name: "web", DependsOn: []string{"db"}},
+			&Task{Name: "worker", DependsOn: []string{"db"}},
+			&Task{Name: "db"},
+		},
+	}
+	order, err := tg.DependencyOrder()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	exp := []string{"db", "web", "worker", "proxy"}
+	if !reflect.DeepEqual(order, exp) {
+		t.Fatalf("bad: %#v", order)
+	}
+
+	// Unknown dependencies are rejected
+	tg.Tasks[3].DependsOn = []string{"cache"}
+	if _, err := tg.DependencyOrder(); err == nil || !strings.Contains(err.Error(), "unknown task 'cache'") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTaskGroup_DependencyOrder_Cycle(t *testing.T) {
+	tg := &TaskGroup{
+		Tasks: []*Task{
+			&Task{Name: "proxy", DependsOn: []string{"web"}},
+			&Task{Name: "web", DependsOn: []string{"db"}},
+			&Task{Name: "db", DependsOn: []string{"web"}},
+		},
+	}
+	_, err := tg.DependencyOrder()
+	if err == nil || !strings.Contains(err.Error(), "cycle: web -> db -> web") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tg.Name = "web"
+	tg.Count = 1
+	if err := tg.Validate(); err == nil || !strings.Contains(err.Error(), "Task dependency cycle") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestTask_Validate(t *testing.T) {
 	task := &Task{}
 	err := task.Validate()
@@ -125,6 +234,490 @@ func TestTask_Validate(t *testing.T) {
 	}
 }
 
+func TestTask_Validate_Memory(t *testing.T) {
+	task := &Task{
+		Name:      "web",
+		Driver:    "exec",
+		Resources: &Resources{MemoryMB: 256, MemoryMaxMB: 512, OOMScoreAdj: 500},
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	task.Resources.MemoryMaxMB = 128
+	if err := task.Validate(); err == nil || !strings.Contains(err.Error(), "Memory max of 128 MB is less than") {
+		t.Fatalf("expected memory max error: %v", err)
+	}
+
+	task.Resources.MemoryMaxMB = 0
+	task.Resources.OOMScoreAdj = 1001
+	if err := task.Validate(); err == nil || !strings.Contains(err.Error(), "OOM score adjustment 1001") {
+		t.Fatalf("expected oom score error: %v", err)
+	}
+}
+
+func TestTask_Validate_MaxRuntime(t *testing.T) {
+	task := &Task{
+		Name:       "batch",
+		Driver:     "exec",
+		Resources:  &Resources{MemoryMB: 256},
+		MaxRuntime: time.Hour,
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	task.MaxRuntime = -time.Second
+	if err := task.Validate(); err == nil || !strings.Contains(err.Error(), "Max runtime must be non-negative") {
+		t.Fatalf("expected max runtime error: %v", err)
+	}
+}
+
+func TestTask_Validate_NetworkMode(t *testing.T) {
+	task := &Task{
+		Name:   "web",
+		Driver: "docker",
+		Resources: &Resources{
+			MemoryMB: 256,
+			Networks: []*NetworkResource{{Mode: NetworkModeHost}},
+		},
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	task.Resources.Networks[0].Mode = "overlay"
+	if err := task.Validate(); err == nil || !strings.Contains(err.Error(), "Unknown network mode 'overlay'") {
+		t.Fatalf("expected network mode error: %v", err)
+	}
+}
+
+func TestResources_MemoryLimits(t *testing.T) {
+	cases := []struct {
+		res        Resources
+		soft, hard int64
+	}{
+		{Resources{MemoryMB: 256}, 0, 256 << 20},
+		{Resources{MemoryMB: 256, MemoryMaxMB: 256}, 0, 256 << 20},
+		{Resources{MemoryMB: 256, MemoryMaxMB: 512}, 256 << 20, 512 << 20},
+	}
+	for _, c := range cases {
+		if soft, hard := c.res.MemoryLimits(); soft != c.soft || hard != c.hard {
+			t.Fatalf("bad limits for %#v: %d %d", c.res, soft, hard)
+		}
+	}
+}
+
+func TestResources_Shares(t *testing.T) {
+	if shares := (&Resources{CPU: 500}).Shares(); shares != 500 {
+		t.Fatalf("got %d shares", shares)
+	}
+	if shares := (&Resources{CPU: 500, CPUShares: 250}).Shares(); shares != 250 {
+		t.Fatalf("got %d shares", shares)
+	}
+}
+
+func TestTask_Validate_KillSignal(t *testing.T) {
+	task := &Task{
+		Name:       "web",
+		Driver:     "docker",
+		Resources:  &Resources{},
+		KillSignal: "SIGINT",
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, sig := range []string{"INT", "sigint", "SIGBOGUS"} {
+		task.KillSignal = sig
+		err := task.Validate()
+		if err == nil || !strings.Contains(err.Error(), "Kill signal '"+sig+"'") {
+			t.Fatalf("expected error for %s: %v", sig, err)
+		}
+	}
+}
+
+func TestTask_Validate_Secrets(t *testing.T) {
+	task := &Task{
+		Name:      "web",
+		Driver:    "docker",
+		Resources: &Resources{},
+		Secrets:   map[string]string{"token": "s3cr3t", "db.pass": "hunter2"},
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	for _, name := range []string{"", "..", "../token", "dir/token"} {
+		task.Secrets = map[string]string{name: "s3cr3t"}
+		err := task.Validate()
+		if err == nil || !strings.Contains(err.Error(), "Secret name '"+name+"'") {
+			t.Fatalf("expected error for %q: %v", name, err)
+		}
+	}
+}
+
+func TestTask_Validate_EnvFiles(t *testing.T) {
+	task := &Task{
+		Name:      "web",
+		Driver:    "docker",
+		Resources: &Resources{},
+		EnvFiles:  []string{"local/app.env", "secrets/db.env"},
+	}
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	task.EnvFiles = []string{"", "/etc/app.env"}
+	err := task.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Env file 1 is missing a path") ||
+		!strings.Contains(err.Error(), "'/etc/app.env' must be relative") {
+		t.Fatalf("expected env file errors: %v", err)
+	}
+}
+
+func TestTask_Validate_Volumes(t *testing.T) {
+	task := &Task{
+		Name:      "web",
+		Driver:    "docker",
+		Resources: &Resources{},
+		Volumes: []*TaskVolume{
+			{Source: "/srv/data", Destination: "/data", ReadOnly: true},
+			{Source: "srv/logs", Destination: "/data"},
+			{Destination: "logs"},
+		},
+	}
+	err := task.Validate()
+	mErr := err.(*multierror.Error)
+	if len(mErr.Errors) != 3 {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[0].Error(), "mounted at '/data' like volume 1") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "source must be an absolute path") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "Missing volume source") ||
+		!strings.Contains(mErr.Errors[2].Error(), "destination must be an absolute path") {
+		t.Fatalf("err: %s", err)
+	}
+
+	task.Volumes = task.Volumes[:1]
+	if err := task.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestRestartPolicy_Validate(t *testing.T) {
+	p := &RestartPolicy{
+		Attempts: -1,
+		Delay:    -1,
+		Mode:     "foo",
+	}
+	err := p.Validate()
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "attempts") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "interval") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "delay") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[3].Error(), "restart mode") {
+		t.Fatalf("err: %s", err)
+	}
+
+	p = &RestartPolicy{
+		Attempts: 2,
+		Interval: time.Minute,
+		Delay:    time.Second,
+		Mode:     RestartPolicyModeDelay,
+	}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	p.Mode = RestartPolicyModeStop
+	p.Jitter = 0.25
+	if err := p.Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	p.Jitter = 1.5
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "jitter") {
+		t.Fatalf("expected jitter error: %v", err)
+	}
+	p.Jitter = 0
+	p.MinHealthyTime = -time.Second
+	if err := p.Validate(); err == nil || !strings.Contains(err.Error(), "min healthy time") {
+		t.Fatalf("expected min healthy time error: %v", err)
+	}
+}
+
+func TestLogConfig_Validate(t *testing.T) {
+	l := &LogConfig{}
+	err := l.Validate()
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "max files") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "max file size") {
+		t.Fatalf("err: %s", err)
+	}
+
+	if err := DefaultLogConfig().Validate(); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+}
+
+func TestSyslogLogConfig_Validate(t *testing.T) {
+	s := &SyslogLogConfig{Address: "http://logs:514", Facility: "news2", Tag: "web app"}
+	err := s.Validate()
+	mErr := err.(*multierror.Error)
+	if len(mErr.Errors) != 3 {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[0].Error(), "udp:// or tcp://") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "facility") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "tag") {
+		t.Fatalf("err: %s", err)
+	}
+
+	s = &SyslogLogConfig{Address: "tcp://logs"}
+	if err := s.Validate(); err == nil || !strings.Contains(err.Error(), "invalid") {
+		t.Fatalf("expected invalid address: %v", err)
+	}
+
+	// The local syslog daemon is used without an address
+	for _, s := range []*SyslogLogConfig{
+		&SyslogLogConfig{},
+		&SyslogLogConfig{Address: "udp://10.0.0.1:514", Facility: "local3", Tag: "web"},
+	} {
+		if err := s.Validate(); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if network, addr := (&SyslogLogConfig{Address: "udp://10.0.0.1:514"}).Endpoint(); network != "udp" || addr != "10.0.0.1:514" {
+		t.Fatalf("bad endpoint: %s %s", network, addr)
+	}
+
+	// It is validated along with the log config
+	l := DefaultLogConfig()
+	l.Syslog = &SyslogLogConfig{Facility: "bogus"}
+	if err := l.Validate(); err == nil || !strings.Contains(err.Error(), "facility") {
+		t.Fatalf("expected facility error: %v", err)
+	}
+}
+
+func TestTaskArtifact_Validate(t *testing.T) {
+	a := &TaskArtifact{Checksum: "md5:abc", Destination: "/tmp"}
+	err := a.Validate()
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "Missing artifact source") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "checksum") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "relative") {
+		t.Fatalf("err: %s", err)
+	}
+
+	a = &TaskArtifact{Source: "ftp://example.com/foo"}
+	if err := a.Validate(); err == nil || !strings.Contains(err.Error(), "Unsupported") {
+		t.Fatalf("err: %v", err)
+	}
+
+	a = &TaskArtifact{Source: "https://example.com/foo.zip", Checksum: "sha512:abc"}
+	if err := a.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestProviderSecret_Validate(t *testing.T) {
+	secret := &ProviderSecret{}
+	err := secret.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Missing secret path") {
+		t.Fatalf("err: %v", err)
+	}
+
+	secret.Path = "secret/db"
+	if err := secret.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+	if mode, sig := secret.OnChange(); mode != SecretChangeModeRestart || sig != "SIGHUP" {
+		t.Fatalf("bad: %s %s", mode, sig)
+	}
+
+	secret.ChangeMode = "reload"
+	err = secret.Validate()
+	if err == nil || !strings.Contains(err.Error(), "change mode 'reload'") {
+		t.Fatalf("err: %v", err)
+	}
+
+	secret.ChangeMode = ""
+	secret.ChangeSignal = "SIGUSR1"
+	err = secret.Validate()
+	if err == nil || !strings.Contains(err.Error(), "only sent in the signal change mode") {
+		t.Fatalf("err: %v", err)
+	}
+
+	secret.ChangeMode = SecretChangeModeSignal
+	if err := secret.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTemplate_Validate(t *testing.T) {
+	tmpl := &Template{}
+	err := tmpl.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Missing template destination") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.DestPath = "/etc/passwd"
+	err = tmpl.Validate()
+	if err == nil || !strings.Contains(err.Error(), "relative") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.DestPath = "local/app.conf"
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.ChangeMode = "reload"
+	err = tmpl.Validate()
+	if err == nil || !strings.Contains(err.Error(), "change mode 'reload'") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.ChangeMode = TemplateChangeModeRestart
+	tmpl.ChangeSignal = "SIGUSR1"
+	err = tmpl.Validate()
+	if err == nil || !strings.Contains(err.Error(), "only sent in the signal change mode") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.ChangeMode = TemplateChangeModeSignal
+	tmpl.ChangeSignal = "SIGWINCH"
+	err = tmpl.Validate()
+	if err == nil || !strings.Contains(err.Error(), "change signal 'SIGWINCH'") {
+		t.Fatalf("err: %v", err)
+	}
+
+	tmpl.ChangeSignal = "SIGUSR1"
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTaskCheck_Validate(t *testing.T) {
+	check := &TaskCheck{Type: "udp"}
+	err := check.Validate()
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "Missing check name") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "Unsupported check type") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "interval must be positive") {
+		t.Fatalf("err: %s", err)
+	}
+
+	check = &TaskCheck{Name: "web", Type: TaskCheckTypeHTTP, Interval: time.Second}
+	err = check.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Missing URL") {
+		t.Fatalf("err: %v", err)
+	}
+
+	check.URL = "http://127.0.0.1:${NOMAD_PORT_http}/health"
+	if err := check.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Names must be unique within the task
+	task := &Task{
+		Name:      "web",
+		Driver:    "docker",
+		Resources: &Resources{},
+		Checks:    []*TaskCheck{check, check},
+	}
+	err = task.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Check 2 redefines 'web' from check 1") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestTaskCheck_Validate_Log(t *testing.T) {
+	// Log checks need a valid pattern but no interval
+	check := &TaskCheck{Name: "started", Type: TaskCheckTypeLog, Pattern: "(unclosed"}
+	err := check.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Invalid pattern") {
+		t.Fatalf("err: %v", err)
+	}
+
+	check.Pattern = "Server started"
+	check.Log = "syslog"
+	err = check.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Unsupported log 'syslog'") {
+		t.Fatalf("err: %v", err)
+	}
+
+	check.Log = TaskCheckLogStderr
+	if err := check.Validate(); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+}
+
+func TestService_Validate(t *testing.T) {
+	service := &Service{
+		PortLabel: "admin",
+		Checks:    []*ServiceCheck{{Name: "alive", Type: TaskCheckTypeScript}},
+	}
+	err := service.Validate([]string{"http"})
+	mErr := err.(*multierror.Error)
+	if !strings.Contains(mErr.Errors[0].Error(), "Missing service name") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[1].Error(), "'admin' is not a dynamic port") {
+		t.Fatalf("err: %s", err)
+	}
+	if !strings.Contains(mErr.Errors[2].Error(), "Unsupported service check type 'script'") {
+		t.Fatalf("err: %s", err)
+	}
+
+	service = &Service{
+		Name:      "web",
+		PortLabel: "http",
+		Checks:    []*ServiceCheck{{Name: "alive", Type: TaskCheckTypeHTTP, Path: "/health", Interval: time.Second}},
+	}
+	if err := service.Validate([]string{"http"}); err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	// Names must be unique within the task
+	task := &Task{
+		Name:   "web",
+		Driver: "docker",
+		Resources: &Resources{
+			Networks: []*NetworkResource{{DynamicPorts: []string{"http"}}},
+		},
+		Services: []*Service{service, service},
+	}
+	err = task.Validate()
+	if err == nil || !strings.Contains(err.Error(), "Service 2 redefines 'web' from service 1") {
+		t.Fatalf("err: %v", err)
+	}
+}
+
 func TestResource_NetIndex(t *testing.T) {
 	r := &Resources{
 		Networks: []*NetworkResource{
@@ -410,3 +1003,23 @@ func TestEncodeDecode(t *testing.T) {
 		t.Fatalf("bad: %#v %#v", arg, out)
 	}
 }
+
+func TestTaskExit_String(t *testing.T) {
+	cases := []struct {
+		exit *TaskExit
+		exp  string
+	}{
+		{&TaskExit{Reason: TaskExitCompleted}, "Completed"},
+		{&TaskExit{Reason: TaskExitFailed, ExitCode: 1, RestartCount: 1}, "Exit Code 1, restarted 1 time"},
+		{&TaskExit{Reason: TaskExitSignaled, ExitCode: 143, Signal: 15, KillReason: TaskKillReasonStopped},
+			"Exit Code 143 (Signal 15), killed by the client (stopped)"},
+		{&TaskExit{Reason: TaskExitOOMKilled, ExitCode: 137, Signal: 9, RestartCount: 3}, "Exit Code 137 (OOM), restarted 3 times"},
+		{&TaskExit{Reason: TaskExitError, Error: "lost"}, "Error: lost"},
+		{&TaskExit{Reason: TaskExitNotStarted, Error: "no driver"}, "Not Started: no driver"},
+	}
+	for _, c := range cases {
+		if act := c.exit.String(); act != c.exp {
+			t.Fatalf("got %q; want %q", act, c.exp)
+		}
+	}
+}